@@ -30,18 +30,61 @@ import (
 	"gopkg.in/mgo.v2/bson"
 )
 
-func getApp(name string, u *auth.User) (app.App, error) {
+// checkAppPermission checks whether the user has the given permission on
+// the app, either through their membership level in one of the teams of the
+// app, or through roles assigned on the app, on one of its teams or on its
+// pool.
+func checkAppPermission(a *app.App, u *auth.User, permission string) bool {
+	contexts := []auth.PermissionContext{{Type: auth.CtxApp, Value: a.Name}}
+	if a.Pool != "" {
+		contexts = append(contexts, auth.PermissionContext{Type: auth.CtxPool, Value: a.Pool})
+	}
+	return auth.CheckTeamsPermission(u, permission, a.Teams, contexts...)
+}
+
+// getAppWithPermission returns the app with the given name, as long as the
+// user has the given permission on it.
+func getAppWithPermission(name string, u *auth.User, permission string) (app.App, error) {
 	a, err := app.GetByName(name)
 	if err != nil {
 		return app.App{}, &errors.HTTP{Code: http.StatusNotFound, Message: fmt.Sprintf("App %s not found.", name)}
 	}
-	if u == nil || u.IsAdmin() {
+	if u == nil || checkAppPermission(a, u, permission) {
 		return *a, nil
 	}
-	if !auth.CheckUserAccess(a.Teams, u) {
-		return *a, &errors.HTTP{Code: http.StatusForbidden, Message: "user does not have access to this app"}
+	msg := "user does not have access to this app"
+	if auth.CheckUserAccessLevel(a.Teams, u, auth.TeamViewer) {
+		if level := auth.PermissionLevel(permission); level != "" {
+			msg = fmt.Sprintf("you must be a team %s to do this action", level)
+		} else {
+			msg = fmt.Sprintf("you don't have the permission %s on this app", permission)
+		}
+	}
+	return *a, &errors.HTTP{Code: http.StatusForbidden, Message: msg}
+}
+
+// getAppForToken works like getAppWithPermission, but also accepts the token
+// of the app itself, used by its units.
+func getAppForToken(name string, t auth.Token, permission string) (*app.App, error) {
+	if t.IsAppToken() {
+		if t.GetAppName() != name {
+			return nil, &errors.HTTP{Code: http.StatusForbidden, Message: "invalid app token"}
+		}
+		a, err := app.GetByName(name)
+		if err != nil {
+			return nil, &errors.HTTP{Code: http.StatusNotFound, Message: fmt.Sprintf("App %s not found.", name)}
+		}
+		return a, nil
+	}
+	u, err := t.User()
+	if err != nil {
+		return nil, err
+	}
+	a, err := getAppWithPermission(name, u, permission)
+	if err != nil {
+		return nil, err
 	}
-	return *a, nil
+	return &a, nil
 }
 
 func appIsAvailable(w http.ResponseWriter, r *http.Request, t auth.Token) error {
@@ -62,7 +105,7 @@ func appDelete(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 		return err
 	}
 	rec.Log(u.Email, "app-delete", "app="+r.URL.Query().Get(":app"))
-	a, err := getApp(r.URL.Query().Get(":app"), u)
+	a, err := getAppWithPermission(r.URL.Query().Get(":app"), u, auth.PermAppDelete)
 	if err != nil {
 		return err
 	}
@@ -118,7 +161,7 @@ func appInfo(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 		return err
 	}
 	rec.Log(u.Email, "app-info", "app="+r.URL.Query().Get(":app"))
-	app, err := getApp(r.URL.Query().Get(":app"), u)
+	app, err := getAppWithPermission(r.URL.Query().Get(":app"), u, auth.PermAppRead)
 	if err != nil {
 		return err
 	}
@@ -147,6 +190,9 @@ func createApp(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 		if e, ok := err.(*errors.ValidationError); ok {
 			return &errors.HTTP{Code: http.StatusBadRequest, Message: e.Message}
 		}
+		if _, ok := err.(*app.ResourceQuotaExceededError); ok {
+			return &errors.HTTP{Code: http.StatusForbidden, Message: err.Error()}
+		}
 		if _, ok := err.(app.NoTeamsError); ok {
 			return &errors.HTTP{
 				Code:    http.StatusBadRequest,
@@ -198,7 +244,7 @@ func setTeamOwner(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	if err != nil {
 		return err
 	}
-	a, err := getApp(r.URL.Query().Get(":app"), u)
+	a, err := getAppWithPermission(r.URL.Query().Get(":app"), u, auth.PermAppTeams)
 	if err != nil {
 		return err
 	}
@@ -209,6 +255,25 @@ func setTeamOwner(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	return nil
 }
 
+func setPlatformVersion(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	u, err := t.User()
+	if err != nil {
+		return err
+	}
+	appName := r.URL.Query().Get(":app")
+	version := r.FormValue("version")
+	rec.Log(u.Email, "set-platform-version", "app="+appName, "version="+version)
+	a, err := getAppWithPermission(appName, u, auth.PermAppUpdate)
+	if err != nil {
+		return err
+	}
+	err = a.SetPlatformVersion(version)
+	if e, ok := err.(*errors.ValidationError); ok {
+		return &errors.HTTP{Code: http.StatusBadRequest, Message: e.Message}
+	}
+	return err
+}
+
 func numberOfUnits(r *http.Request) (uint, error) {
 	missingMsg := "You must provide the number of units."
 	if r.Body == nil {
@@ -244,7 +309,7 @@ func addUnits(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 		return err
 	}
 	rec.Log(u.Email, "add-units", "app="+appName, fmt.Sprintf("units=%d", n))
-	app, err := getApp(appName, u)
+	app, err := getAppWithPermission(appName, u, auth.PermAppUpdate)
 	if err != nil {
 		return err
 	}
@@ -269,7 +334,7 @@ func removeUnits(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	}
 	appName := r.URL.Query().Get(":app")
 	rec.Log(u.Email, "remove-units", "app="+appName, fmt.Sprintf("units=%d", n))
-	app, err := getApp(appName, u)
+	app, err := getAppWithPermission(appName, u, auth.PermAppUpdate)
 	if err != nil {
 		return err
 	}
@@ -294,9 +359,9 @@ func setUnitStatus(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 		}
 	}
 	appName := r.URL.Query().Get(":app")
-	a, err := app.GetByName(appName)
+	a, err := getAppForToken(appName, t, auth.PermAppUpdate)
 	if err != nil {
-		return &errors.HTTP{Code: http.StatusNotFound, Message: err.Error()}
+		return err
 	}
 	err = a.SetUnitStatus(unitName, status)
 	if err == app.ErrUnitNotFound {
@@ -317,7 +382,7 @@ func grantAppAccess(w http.ResponseWriter, r *http.Request, t auth.Token) error
 	teamName := r.URL.Query().Get(":team")
 	rec.Log(u.Email, "grant-app-access", "app="+appName, "team="+teamName)
 	team := new(auth.Team)
-	app, err := getApp(appName, u)
+	app, err := getAppWithPermission(appName, u, auth.PermAppTeams)
 	if err != nil {
 		return err
 	}
@@ -378,7 +443,7 @@ func revokeAppAccess(w http.ResponseWriter, r *http.Request, t auth.Token) error
 	teamName := r.URL.Query().Get(":team")
 	rec.Log(u.Email, "revoke-app-access", "app="+appName, "team="+teamName)
 	team := new(auth.Team)
-	app, err := getApp(appName, u)
+	app, err := getAppWithPermission(appName, u, auth.PermAppTeams)
 	if err != nil {
 		return err
 	}
@@ -433,7 +498,7 @@ func runCommand(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	appName := r.URL.Query().Get(":app")
 	once := r.URL.Query().Get("once")
 	rec.Log(u.Email, "run-command", "app="+appName, "command="+string(c))
-	app, err := getApp(appName, u)
+	app, err := getAppWithPermission(appName, u, auth.PermAppUpdate)
 	if err != nil {
 		return err
 	}
@@ -465,7 +530,7 @@ func getEnv(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 		}
 		rec.Log(u.Email, "get-env", "app="+appName, fmt.Sprintf("envs=%s", variables))
 	}
-	app, err := getApp(appName, u)
+	app, err := getAppWithPermission(appName, u, auth.PermAppEnvRead)
 	if err != nil {
 		return err
 	}
@@ -521,7 +586,7 @@ func setEnv(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	extra := fmt.Sprintf("private=%t", !isPublicEnv)
 	appName := r.URL.Query().Get(":app")
 	rec.Log(u.Email, "set-env", "app="+appName, variables, extra)
-	app, err := getApp(appName, u)
+	app, err := getAppWithPermission(appName, u, auth.PermAppEnvSet)
 	if err != nil {
 		return err
 	}
@@ -559,7 +624,7 @@ func unsetEnv(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 		return err
 	}
 	rec.Log(u.Email, "unset-env", "app="+appName, fmt.Sprintf("envs=%s", variables))
-	app, err := getApp(appName, u)
+	app, err := getAppWithPermission(appName, u, auth.PermAppEnvSet)
 	if err != nil {
 		return err
 	}
@@ -593,7 +658,7 @@ func setCName(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	appName := r.URL.Query().Get(":app")
 	rawCName := strings.Join(v["cname"], ", ")
 	rec.Log(u.Email, "add-cname", "app="+appName, "cname="+rawCName)
-	app, err := getApp(appName, u)
+	app, err := getAppWithPermission(appName, u, auth.PermAppUpdate)
 	if err != nil {
 		return err
 	}
@@ -626,7 +691,7 @@ func unsetCName(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	appName := r.URL.Query().Get(":app")
 	rawCName := strings.Join(v["cname"], ", ")
 	rec.Log(u.Email, "remove-cname", "app="+appName, "cnames="+rawCName)
-	app, err := getApp(appName, u)
+	app, err := getAppWithPermission(appName, u, auth.PermAppUpdate)
 	if err != nil {
 		return err
 	}
@@ -675,7 +740,7 @@ func appLog(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	}
 	rec.Log(u.Email, "app-log", extra...)
 	filterLog := app.Applog{Source: source, Unit: unit}
-	a, err := getApp(appName, u)
+	a, err := getAppWithPermission(appName, u, auth.PermAppRead)
 	if err != nil {
 		return err
 	}
@@ -720,7 +785,7 @@ func getServiceInstance(instanceName, appName string, u *auth.User) (*service.Se
 		err = &errors.HTTP{Code: http.StatusNotFound, Message: fmt.Sprintf("App %s not found.", appName)}
 		return nil, nil, err
 	}
-	if !auth.CheckUserAccess(app.Teams, u) {
+	if !checkAppPermission(&app, u, auth.PermAppUpdate) {
 		err = &errors.HTTP{Code: http.StatusForbidden, Message: "This user does not have access to this app"}
 		return nil, nil, err
 	}
@@ -767,10 +832,15 @@ func unbindServiceInstance(w http.ResponseWriter, r *http.Request, t auth.Token)
 	if err != nil {
 		return err
 	}
+	force := r.URL.Query().Get("force") == "true"
 	rec.Log(u.Email, "unbind-app", "instance="+instanceName, "app="+appName)
 	w.Header().Set("Content-Type", "application/json")
 	writer := &tsuruIo.SimpleJsonMessageEncoderWriter{Encoder: json.NewEncoder(w)}
-	err = instance.UnbindApp(a, writer)
+	if force {
+		err = instance.ForceUnbindApp(a, writer)
+	} else {
+		err = instance.UnbindApp(a, writer)
+	}
 	if err != nil {
 		writer.Encode(tsuruIo.SimpleJsonMessage{Error: err.Error()})
 		return nil
@@ -787,7 +857,7 @@ func restart(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	}
 	appName := r.URL.Query().Get(":app")
 	rec.Log(u.Email, "restart", "app="+appName)
-	instance, err := getApp(appName, u)
+	instance, err := getAppWithPermission(appName, u, auth.PermAppUpdate)
 	if err != nil {
 		return err
 	}
@@ -802,7 +872,7 @@ func restart(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 
 func addLog(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	queryValues := r.URL.Query()
-	app, err := app.GetByName(queryValues.Get(":app"))
+	app, err := getAppForToken(queryValues.Get(":app"), t, auth.PermAppUpdate)
 	if err != nil {
 		return err
 	}
@@ -863,14 +933,14 @@ func swap(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 		return err
 	}
 	defer app.ReleaseApplicationLock(app2Name)
-	app1, err := getApp(app1Name, u)
+	app1, err := getAppWithPermission(app1Name, u, auth.PermAppUpdate)
 	if err != nil {
 		return err
 	}
 	if !locked1 {
 		return &errors.HTTP{Code: http.StatusConflict, Message: fmt.Sprintf("%s: %s", app1.Name, &app1.Lock)}
 	}
-	app2, err := getApp(app2Name, u)
+	app2, err := getAppWithPermission(app2Name, u, auth.PermAppUpdate)
 	if err != nil {
 		return err
 	}
@@ -904,7 +974,7 @@ func start(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	}
 	appName := r.URL.Query().Get(":app")
 	rec.Log(u.Email, "start", "app="+appName)
-	app, err := getApp(appName, u)
+	app, err := getAppWithPermission(appName, u, auth.PermAppUpdate)
 	if err != nil {
 		return err
 	}
@@ -919,7 +989,7 @@ func stop(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	}
 	appName := r.URL.Query().Get(":app")
 	rec.Log(u.Email, "stop", "app="+appName)
-	app, err := getApp(appName, u)
+	app, err := getAppWithPermission(appName, u, auth.PermAppUpdate)
 	if err != nil {
 		return err
 	}
@@ -952,7 +1022,7 @@ func registerUnit(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 			return err
 		}
 	}
-	a, err := app.GetByName(appName)
+	a, err := getAppForToken(appName, t, auth.PermAppEnvRead)
 	if err != nil {
 		return err
 	}
@@ -979,7 +1049,7 @@ func saveAppCustomData(w http.ResponseWriter, r *http.Request, t auth.Token) err
 			Message: fmt.Sprintf("Unable to decode body: %s", err.Error()),
 		}
 	}
-	a, err := app.GetByName(appName)
+	a, err := getAppForToken(appName, t, auth.PermAppUpdate)
 	if err != nil {
 		return err
 	}
@@ -347,6 +347,62 @@ func (s *S) TestAppInfoReturnsForbiddenWhenTheUserDoesNotHaveAccessToTheApp(c *c
 	c.Assert(e, check.ErrorMatches, "^user does not have access to this app$")
 }
 
+func (s *S) TestAppInfoTeamViewer(c *check.C) {
+	team := auth.Team{Name: "viewers", Users: []string{s.user.Email, s.adminuser.Email}, Owners: []string{s.adminuser.Email}, Viewers: []string{s.user.Email}}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	myApp := app.App{Name: "viewed-app", Platform: "zend", Teams: []string{team.Name}}
+	err = s.conn.Apps().Insert(myApp)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": myApp.Name})
+	request, err := http.NewRequest("GET", "/apps/"+myApp.Name+"?:app="+myApp.Name, nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = appInfo(recorder, request, s.token)
+	c.Assert(err, check.IsNil)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	url := fmt.Sprintf("/apps/%s/env?:app=%s", myApp.Name, myApp.Name)
+	request, err = http.NewRequest("POST", url, strings.NewReader(`{"DATABASE_HOST":"localhost"}`))
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	err = setEnv(recorder, request, s.token)
+	c.Assert(err, check.NotNil)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+	c.Assert(e.Message, check.Equals, "you must be a team developer to do this action")
+}
+
+func (s *S) TestAppDeleteRequiresTeamOwner(c *check.C) {
+	team := auth.Team{Name: "developers", Users: []string{s.user.Email, s.adminuser.Email}, Owners: []string{s.adminuser.Email}}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	myApp := app.App{Name: "developed-app", Platform: "zend", Teams: []string{team.Name}}
+	err = s.conn.Apps().Insert(myApp)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": myApp.Name})
+	request, err := http.NewRequest("DELETE", "/apps/"+myApp.Name+"?:app="+myApp.Name, nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = appDelete(recorder, request, s.token)
+	c.Assert(err, check.NotNil)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+	c.Assert(e.Message, check.Equals, "you must be a team owner to do this action")
+	url := fmt.Sprintf("/apps/%s/teams/%s?:app=%s&:team=%s", myApp.Name, s.team.Name, myApp.Name, s.team.Name)
+	request, err = http.NewRequest("PUT", url, nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	err = grantAppAccess(recorder, request, s.token)
+	c.Assert(err, check.NotNil)
+	e, ok = err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+}
+
 func (s *S) TestAppInfoReturnsNotFoundWhenAppDoesNotExist(c *check.C) {
 	myApp := app.App{Name: "SomeApp"}
 	request, err := http.NewRequest("GET", "/apps/"+myApp.Name+"?:app="+myApp.Name, nil)
@@ -832,7 +888,24 @@ func (s *S) TestSetUnitStatusAppNotFound(c *check.C) {
 	e, ok := err.(*errors.HTTP)
 	c.Assert(ok, check.Equals, true)
 	c.Check(e.Code, check.Equals, http.StatusNotFound)
-	c.Check(e.Message, check.Equals, "App not found.")
+	c.Check(e.Message, check.Equals, "App velha not found.")
+}
+
+func (s *S) TestSetUnitStatusNoAccessToTheApp(c *check.C) {
+	a := app.App{Name: "telegram", Platform: "zend"}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	body := strings.NewReader("status=error")
+	request, err := http.NewRequest("POST", "/apps/telegram/units/af32db?:app=telegram&:unit=af32db", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	err = setUnitStatus(recorder, request, s.token)
+	c.Assert(err, check.NotNil)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Check(e.Code, check.Equals, http.StatusForbidden)
 }
 
 func (s *S) TestSetUnitStatusDoesntRequireLock(c *check.C) {
@@ -2524,6 +2597,30 @@ func (s *S) TestBindHandlerReturns403IfTheUserDoesNotHaveAccessToTheApp(c *check
 	c.Assert(e, check.ErrorMatches, "^This user does not have access to this app$")
 }
 
+func (s *S) TestBindHandlerReturns403IfTheUserIsAViewerOfTheApp(c *check.C) {
+	team := auth.Team{Name: "viewers", Users: []string{s.user.Email, s.adminuser.Email}, Owners: []string{s.adminuser.Email}, Viewers: []string{s.user.Email}}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	instance := service.ServiceInstance{Name: "my-mysql", ServiceName: "mysql", Teams: []string{s.team.Name}}
+	err = instance.Create()
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": "my-mysql"})
+	a := app.App{Name: "serviceapp", Platform: "zend", Teams: []string{team.Name}}
+	err = s.conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	url := fmt.Sprintf("/services/instances/%s/%s?:instance=%s&:app=%s", instance.Name, a.Name, instance.Name, a.Name)
+	request, err := http.NewRequest("PUT", url, nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = bindServiceInstance(recorder, request, s.token)
+	c.Assert(err, check.NotNil)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+}
+
 func (s *S) TestUnbindHandler(c *check.C) {
 	s.provisioner.PrepareOutput([]byte("exported"))
 	var called int32
@@ -2825,7 +2922,7 @@ func (s *S) TestGetApp(c *check.C) {
 	defer s.deleteApp(&a)
 	expected, err := app.GetByName(a.Name)
 	c.Assert(err, check.IsNil)
-	app, err := getApp(a.Name, s.adminuser)
+	app, err := getAppWithPermission(a.Name, s.adminuser, auth.PermAppUpdate)
 	c.Assert(err, check.IsNil)
 	c.Assert(app, check.DeepEquals, *expected)
 }
@@ -3185,6 +3282,55 @@ func (s *S) TestSetTeamOwner(c *check.C) {
 	c.Assert(a.TeamOwner, check.Equals, team.Name)
 }
 
+func (s *S) TestSetPlatformVersion(c *check.C) {
+	err := s.conn.Platforms().Insert(app.Platform{
+		Name:     "pinplat",
+		Current:  "v2",
+		Versions: []app.PlatformVersion{{Version: "v1"}, {Version: "v2"}},
+	})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Platforms().RemoveId("pinplat")
+	a := app.App{Name: "myappx", Platform: "pinplat", Teams: []string{s.team.Name}}
+	err = app.CreateApp(&a, s.user)
+	c.Assert(err, check.IsNil)
+	defer s.deleteApp(&a)
+	body := strings.NewReader("version=v1")
+	req, err := http.NewRequest("POST", "/apps/myappx/platform-version", body)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	m := RunServer(true)
+	m.ServeHTTP(recorder, req)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	dbApp, err := app.GetByName("myappx")
+	c.Assert(err, check.IsNil)
+	c.Assert(dbApp.PlatformVersion, check.Equals, "v1")
+	action := rectest.Action{
+		Action: "set-platform-version",
+		User:   s.user.Email,
+		Extra:  []interface{}{"app=myappx", "version=v1"},
+	}
+	c.Assert(action, rectest.IsRecorded)
+}
+
+func (s *S) TestSetPlatformVersionInvalidVersion(c *check.C) {
+	a := app.App{Name: "myappx", Platform: "zend", Teams: []string{s.team.Name}}
+	err := app.CreateApp(&a, s.user)
+	c.Assert(err, check.IsNil)
+	defer s.deleteApp(&a)
+	body := strings.NewReader("version=v7")
+	req, err := http.NewRequest("POST", "/apps/myappx/platform-version", body)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	m := RunServer(true)
+	m.ServeHTTP(recorder, req)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, "Invalid version \"v7\" for platform zend.\n")
+}
+
 func (s *S) TestSetTeamOwnerToUserWhoCantBeOwner(c *check.C) {
 	a := app.App{Name: "myappx", Platform: "zend", Teams: []string{s.team.Name}, TeamOwner: s.team.Name}
 	err := app.CreateApp(&a, s.user)
@@ -8,7 +8,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/tsuru/config"
 	"github.com/tsuru/tsuru/action"
@@ -26,6 +30,10 @@ import (
 const (
 	nonManagedSchemeMsg = "Authentication scheme does not allow this operation."
 	createDisabledMsg   = "User registration is disabled for non-admin users."
+
+	// statusTooManyRequests is the status code 429, which isn't available
+	// in net/http before Go 1.6.
+	statusTooManyRequests = 429
 )
 
 var createDisabledErr = &errors.HTTP{Code: http.StatusUnauthorized, Message: createDisabledMsg}
@@ -34,6 +42,12 @@ func handleAuthError(err error) error {
 	if err == auth.ErrUserNotFound {
 		return &errors.HTTP{Code: http.StatusNotFound, Message: err.Error()}
 	}
+	if err == auth.ErrTwoFactorRequired {
+		return &errors.HTTP{Code: http.StatusPreconditionFailed, Message: err.Error()}
+	}
+	if err == auth.ErrTooManyLoginAttempts {
+		return &errors.HTTP{Code: statusTooManyRequests, Message: err.Error()}
+	}
 	switch err.(type) {
 	case *errors.ValidationError:
 		return &errors.HTTP{Code: http.StatusBadRequest, Message: err.Error()}
@@ -60,7 +74,7 @@ func createUser(w http.ResponseWriter, r *http.Request) error {
 		if err != nil {
 			return createDisabledErr
 		}
-		if !user.IsAdmin() {
+		if !auth.CheckPermission(user, auth.PermUserManage) {
 			return createDisabledErr
 		}
 	}
@@ -85,6 +99,7 @@ func login(w http.ResponseWriter, r *http.Request) error {
 		return &errors.HTTP{Code: http.StatusBadRequest, Message: "Invalid JSON"}
 	}
 	params["email"] = r.URL.Query().Get(":email")
+	params["ip"] = remoteIP(r)
 	token, err := app.AuthScheme.Login(params)
 	if err != nil {
 		return handleAuthError(err)
@@ -98,6 +113,57 @@ func login(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// remoteIP returns the IP address of the client that sent the request. The
+// X-Forwarded-For and X-Real-IP headers are only considered when the request
+// comes from one of the proxies listed in auth:lockout:trusted-proxies.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	proxies, _ := config.GetList("auth:lockout:trusted-proxies")
+	if len(proxies) == 0 || !trustedProxy(host, proxies) {
+		return host
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		addrs := strings.Split(forwarded, ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr := strings.TrimSpace(addrs[i])
+			if net.ParseIP(addr) == nil {
+				break
+			}
+			host = addr
+			if !trustedProxy(addr, proxies) {
+				break
+			}
+		}
+		return host
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return host
+}
+
+// trustedProxy checks whether addr matches one of the given proxies, which
+// may be IP addresses or networks in CIDR notation.
+func trustedProxy(addr string, proxies []string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func logout(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	return app.AuthScheme.Logout(t.GetValue())
 }
@@ -184,14 +250,25 @@ func removeTeam(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	defer conn.Close()
 	name := r.URL.Query().Get(":name")
 	rec.Log(t.GetUserName(), "remove-team", name)
+	u, err := t.User()
+	if err != nil {
+		return err
+	}
+	team, err := auth.GetTeam(name)
+	if err != nil || !team.ContainsUser(u) && !auth.CheckTeamsPermission(u, auth.PermTeamManage, []string{name}) {
+		return &errors.HTTP{Code: http.StatusNotFound, Message: fmt.Sprintf(`Team "%s" not found.`, name)}
+	}
+	if !auth.CheckTeamsPermission(u, auth.PermTeamManage, []string{name}) {
+		msg := fmt.Sprintf("You are not authorized to remove the team %s", name)
+		return &errors.HTTP{Code: http.StatusForbidden, Message: msg}
+	}
 	if n, err := conn.Apps().Find(bson.M{"teams": name}).Count(); err != nil || n > 0 {
 		msg := `This team cannot be removed because it have access to apps.
 
 Please remove the apps or revoke these accesses, and try again.`
 		return &errors.HTTP{Code: http.StatusForbidden, Message: msg}
 	}
-	query := bson.M{"_id": name, "users": t.GetUserName()}
-	err = conn.Teams().Remove(query)
+	err = conn.Teams().RemoveId(name)
 	if err == mgo.ErrNotFound {
 		return &errors.HTTP{Code: http.StatusNotFound, Message: fmt.Sprintf(`Team "%s" not found.`, name)}
 	}
@@ -275,7 +352,7 @@ func addUserToTeam(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	if err != nil {
 		return &errors.HTTP{Code: http.StatusNotFound, Message: "Team not found"}
 	}
-	if !team.ContainsUser(u) {
+	if !auth.CheckTeamsPermission(u, auth.PermTeamManage, []string{team.Name}) {
 		msg := fmt.Sprintf("You are not authorized to add new users to the team %s", team.Name)
 		return &errors.HTTP{Code: http.StatusForbidden, Message: msg}
 	}
@@ -297,7 +374,9 @@ func removeUserFromTeamInDatabase(u *auth.User, team *auth.Team) error {
 		return err
 	}
 	defer conn.Close()
-	if err = team.RemoveUser(u); err != nil {
+	if err = team.RemoveUser(u); err == auth.ErrLastTeamOwner {
+		return &errors.HTTP{Code: http.StatusForbidden, Message: err.Error()}
+	} else if err != nil {
 		return &errors.HTTP{Code: http.StatusNotFound, Message: err.Error()}
 	}
 	return conn.Teams().UpdateId(team.Name, team)
@@ -349,7 +428,7 @@ func removeUserFromTeam(w http.ResponseWriter, r *http.Request, t auth.Token) er
 	if err != nil {
 		return &errors.HTTP{Code: http.StatusNotFound, Message: "Team not found"}
 	}
-	if !team.ContainsUser(u) {
+	if !auth.CheckTeamsPermission(u, auth.PermTeamManage, []string{team.Name}) {
 		msg := fmt.Sprintf("You are not authorized to remove a member from the team %s", team.Name)
 		return &errors.HTTP{Code: http.StatusUnauthorized, Message: msg}
 	}
@@ -368,6 +447,43 @@ func removeUserFromTeam(w http.ResponseWriter, r *http.Request, t auth.Token) er
 	return removeUserFromTeamInRepository(user, team)
 }
 
+func setTeamUserLevel(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	teamName := r.URL.Query().Get(":team")
+	email := r.URL.Query().Get(":user")
+	level := r.FormValue("level")
+	u, err := t.User()
+	if err != nil {
+		return err
+	}
+	rec.Log(u.Email, "set-team-user-level", "team="+teamName, "user="+email, "level="+level)
+	team, err := auth.GetTeam(teamName)
+	if err != nil {
+		return &errors.HTTP{Code: http.StatusNotFound, Message: "Team not found"}
+	}
+	if !auth.CheckTeamsPermission(u, auth.PermTeamManage, []string{team.Name}) {
+		msg := fmt.Sprintf("You are not authorized to change the members of the team %s", team.Name)
+		return &errors.HTTP{Code: http.StatusForbidden, Message: msg}
+	}
+	user, err := auth.GetUserByEmail(email)
+	if err != nil {
+		return &errors.HTTP{Code: http.StatusNotFound, Message: "User not found"}
+	}
+	err = team.SetLevel(user, level)
+	if err == auth.ErrInvalidTeamLevel {
+		return &errors.HTTP{Code: http.StatusBadRequest, Message: err.Error()}
+	} else if err == auth.ErrLastTeamOwner {
+		return &errors.HTTP{Code: http.StatusForbidden, Message: err.Error()}
+	} else if err != nil {
+		return &errors.HTTP{Code: http.StatusNotFound, Message: err.Error()}
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Teams().UpdateId(team.Name, team)
+}
+
 func getTeam(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	teamName := r.URL.Query().Get(":name")
 	user, err := t.User()
@@ -479,12 +595,13 @@ func removeUser(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 		return err
 	}
 	email := r.URL.Query().Get("user")
-	if email != "" && u.IsAdmin() {
+	canManage := auth.CheckPermission(u, auth.PermUserManage)
+	if email != "" && canManage {
 		u, err = auth.GetUserByEmail(email)
 		if err != nil {
 			return err
 		}
-	} else if u.IsAdmin() {
+	} else if canManage {
 		return &errors.HTTP{Code: http.StatusBadRequest, Message: "please specify the user you want to remove"}
 	} else if email != "" {
 		return &errors.HTTP{Code: http.StatusForbidden, Message: "you're not allowed to remove this user"}
@@ -568,9 +685,146 @@ func showAPIToken(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	return json.NewEncoder(w).Encode(apiKey)
 }
 
+func listAPITokens(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	u, err := t.User()
+	if err != nil {
+		return err
+	}
+	tokens, err := u.APITokens()
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(tokens)
+}
+
+func createAPIToken(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	u, err := t.User()
+	if err != nil {
+		return err
+	}
+	r.ParseForm()
+	name := r.FormValue("name")
+	apps := r.Form["app"]
+	actions := r.Form["action"]
+	var expires int
+	if value := r.FormValue("expires"); value != "" {
+		expires, err = strconv.Atoi(value)
+		if err != nil || expires < 0 {
+			return &errors.HTTP{Code: http.StatusBadRequest, Message: "Invalid expiration, must be a number of seconds"}
+		}
+	}
+	rec.Log(u.Email, "create-api-token", "name="+name, fmt.Sprintf("expires=%d", expires), apps, actions)
+	token, err := u.CreateAPIToken(name, time.Duration(expires)*time.Second, apps, actions)
+	if err == auth.ErrAPITokenNameRequired || err == auth.ErrInvalidPermission {
+		return &errors.HTTP{Code: http.StatusBadRequest, Message: err.Error()}
+	} else if err == auth.ErrAPITokenAlreadyExists {
+		return &errors.HTTP{Code: http.StatusConflict, Message: err.Error()}
+	} else if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(map[string]string{"name": name, "token": token})
+}
+
+func revokeAPIToken(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	u, err := t.User()
+	if err != nil {
+		return err
+	}
+	name := r.URL.Query().Get(":name")
+	rec.Log(u.Email, "revoke-api-token", "name="+name)
+	err = u.RevokeAPIToken(name)
+	if err == auth.ErrAPITokenNotFound {
+		return &errors.HTTP{Code: http.StatusNotFound, Message: err.Error()}
+	}
+	return err
+}
+
+func twoFactorScheme() (auth.TwoFactorScheme, error) {
+	scheme, ok := app.AuthScheme.(auth.TwoFactorScheme)
+	if !ok {
+		return nil, &errors.HTTP{Code: http.StatusBadRequest, Message: nonManagedSchemeMsg}
+	}
+	return scheme, nil
+}
+
+func startTwoFactorEnrollment(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	scheme, err := twoFactorScheme()
+	if err != nil {
+		return err
+	}
+	u, err := t.User()
+	if err != nil {
+		return err
+	}
+	rec.Log(u.Email, "two-factor-enroll")
+	uri, err := scheme.StartTwoFactorEnrollment(u)
+	if err != nil {
+		return handleAuthError(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]string{"uri": uri})
+}
+
+func confirmTwoFactorEnrollment(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	scheme, err := twoFactorScheme()
+	if err != nil {
+		return err
+	}
+	u, err := t.User()
+	if err != nil {
+		return err
+	}
+	rec.Log(u.Email, "two-factor-confirm")
+	codes, err := scheme.ConfirmTwoFactorEnrollment(u, r.FormValue("code"))
+	if err != nil {
+		return handleAuthError(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+func regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	scheme, err := twoFactorScheme()
+	if err != nil {
+		return err
+	}
+	u, err := t.User()
+	if err != nil {
+		return err
+	}
+	rec.Log(u.Email, "two-factor-recovery-codes")
+	codes, err := scheme.RegenerateRecoveryCodes(u, r.FormValue("code"), remoteIP(r))
+	if err != nil {
+		return handleAuthError(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+func disableTwoFactor(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	scheme, err := twoFactorScheme()
+	if err != nil {
+		return err
+	}
+	u, err := t.User()
+	if err != nil {
+		return err
+	}
+	rec.Log(u.Email, "two-factor-disable")
+	return handleAuthError(scheme.DisableTwoFactor(u, r.URL.Query().Get("code"), remoteIP(r)))
+}
+
 type apiUser struct {
 	Email string
 	Teams []string
+	Roles []auth.RoleInstance `json:",omitempty"`
 }
 
 func listUsers(w http.ResponseWriter, r *http.Request, t auth.Token) error {
@@ -584,7 +838,7 @@ func listUsers(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 		if teams, err := user.Teams(); err == nil {
 			teamsNames = auth.GetTeamsNames(teams)
 		}
-		apiUsers[i] = apiUser{Email: user.Email, Teams: teamsNames}
+		apiUsers[i] = apiUser{Email: user.Email, Teams: teamsNames, Roles: user.Roles}
 	}
 	return json.NewEncoder(w).Encode(apiUsers)
 }
@@ -603,5 +857,5 @@ func userInfo(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 		}
 	}
 	w.Header().Add("Content-Type", "application/json")
-	return json.NewEncoder(w).Encode(apiUser{Email: user.Email, Teams: teamNames})
+	return json.NewEncoder(w).Encode(apiUser{Email: user.Email, Teams: teamNames, Roles: user.Roles})
 }
@@ -6,6 +6,7 @@ package api
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -461,6 +462,68 @@ func (s *AuthSuite) TestLoginShouldreturnErrorIfThePasswordDoesNotMatch(c *check
 	c.Assert(e.Code, check.Equals, http.StatusUnauthorized)
 }
 
+func (s *AuthSuite) TestLoginTooManyAttempts(c *check.C) {
+	config.Set("auth:lockout:max-attempts", 1)
+	defer config.Unset("auth:lockout")
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.LoginFailures().RemoveAll(nil)
+	b := bytes.NewBufferString(`{"password":"wrong-password","ip":"192.168.1.1"}`)
+	request, err := http.NewRequest("POST", "/users/whydidifall@thewho.com/tokens?:email=whydidifall@thewho.com", b)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-type", "application/json")
+	request.RemoteAddr = "10.0.0.1:51234"
+	recorder := httptest.NewRecorder()
+	err = login(recorder, request)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusUnauthorized)
+	var failure map[string]interface{}
+	err = conn.LoginFailures().Find(bson.M{"user": s.user.Email}).One(&failure)
+	c.Assert(err, check.IsNil)
+	c.Assert(failure["ip"], check.Equals, "10.0.0.1")
+	b = bytes.NewBufferString(`{"password":"123456"}`)
+	request, err = http.NewRequest("POST", "/users/whydidifall@thewho.com/tokens?:email=whydidifall@thewho.com", b)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-type", "application/json")
+	recorder = httptest.NewRecorder()
+	err = login(recorder, request)
+	e, ok = err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, statusTooManyRequests)
+	c.Assert(e.Message, check.Equals, auth.ErrTooManyLoginAttempts.Error())
+}
+
+func (s *AuthSuite) TestRemoteIPIgnoresHeadersFromUntrustedSources(c *check.C) {
+	request, err := http.NewRequest("POST", "/users/someone@tsuru.io/tokens", nil)
+	c.Assert(err, check.IsNil)
+	request.RemoteAddr = "10.0.0.1:51234"
+	request.Header.Set("X-Forwarded-For", "192.168.1.10")
+	request.Header.Set("X-Real-IP", "192.168.1.11")
+	c.Assert(remoteIP(request), check.Equals, "10.0.0.1")
+	config.Set("auth:lockout:trusted-proxies", []interface{}{"10.0.1.0/24"})
+	defer config.Unset("auth:lockout")
+	c.Assert(remoteIP(request), check.Equals, "10.0.0.1")
+}
+
+func (s *AuthSuite) TestRemoteIPFromTrustedProxies(c *check.C) {
+	config.Set("auth:lockout:trusted-proxies", []interface{}{"10.0.0.1", "172.16.0.0/12"})
+	defer config.Unset("auth:lockout")
+	request, err := http.NewRequest("POST", "/users/someone@tsuru.io/tokens", nil)
+	c.Assert(err, check.IsNil)
+	request.RemoteAddr = "10.0.0.1:51234"
+	c.Assert(remoteIP(request), check.Equals, "10.0.0.1")
+	request.Header.Set("X-Real-IP", "192.168.1.11")
+	c.Assert(remoteIP(request), check.Equals, "192.168.1.11")
+	request.Header.Set("X-Forwarded-For", "1.2.3.4, 192.168.1.10, 172.16.5.5")
+	c.Assert(remoteIP(request), check.Equals, "192.168.1.10")
+	request.Header.Set("X-Forwarded-For", "172.16.5.6, 172.16.5.5")
+	c.Assert(remoteIP(request), check.Equals, "172.16.5.6")
+	request.Header.Set("X-Forwarded-For", "192.168.1.10, garbage")
+	c.Assert(remoteIP(request), check.Equals, "10.0.0.1")
+}
+
 func (s *AuthSuite) TestLoginShouldReturnErrorAndInternalServerErrorIfReadAllFails(c *check.C) {
 	b := s.getTestData("bodyToBeClosed.txt")
 	err := b.Close()
@@ -1009,6 +1072,137 @@ func (s *AuthSuite) TestRemoveUserFromTeamInDatabase(c *check.C) {
 	c.Assert(s.team, check.Not(ContainsUser), u)
 }
 
+func (s *AuthSuite) createTeamWithLevels(c *check.C) (*auth.Team, auth.Token, *auth.User) {
+	owner := &auth.User{Email: "owner@xmen.com", Password: "123456"}
+	_, err := nativeScheme.Create(owner)
+	c.Assert(err, check.IsNil)
+	member := &auth.User{Email: "member@xmen.com", Password: "123456"}
+	_, err = nativeScheme.Create(member)
+	c.Assert(err, check.IsNil)
+	team := &auth.Team{Name: "xmen", Users: []string{owner.Email, member.Email}, Owners: []string{owner.Email}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	token, err := nativeScheme.Login(map[string]string{"email": owner.Email, "password": "123456"})
+	c.Assert(err, check.IsNil)
+	return team, token, member
+}
+
+func (s *AuthSuite) TestSetTeamUserLevel(c *check.C) {
+	team, token, member := s.createTeamWithLevels(c)
+	url := fmt.Sprintf("/teams/%s/%s/level?:team=%s&:user=%s", team.Name, member.Email, team.Name, member.Email)
+	request, err := http.NewRequest("POST", url, strings.NewReader("level=viewer"))
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	err = setTeamUserLevel(recorder, request, token)
+	c.Assert(err, check.IsNil)
+	dbTeam, err := auth.GetTeam(team.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbTeam.Level(member), check.Equals, auth.TeamViewer)
+	action := rectest.Action{
+		Action: "set-team-user-level",
+		User:   token.GetUserName(),
+		Extra:  []interface{}{"team=" + team.Name, "user=" + member.Email, "level=viewer"},
+	}
+	c.Assert(action, rectest.IsRecorded)
+}
+
+func (s *AuthSuite) TestSetTeamUserLevelInvalidLevel(c *check.C) {
+	team, token, member := s.createTeamWithLevels(c)
+	url := fmt.Sprintf("/teams/%s/%s/level?:team=%s&:user=%s", team.Name, member.Email, team.Name, member.Email)
+	request, err := http.NewRequest("POST", url, strings.NewReader("level=boss"))
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	err = setTeamUserLevel(recorder, request, token)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *AuthSuite) TestSetTeamUserLevelRequiresOwner(c *check.C) {
+	team, _, member := s.createTeamWithLevels(c)
+	token, err := nativeScheme.Login(map[string]string{"email": member.Email, "password": "123456"})
+	c.Assert(err, check.IsNil)
+	url := fmt.Sprintf("/teams/%s/%s/level?:team=%s&:user=%s", team.Name, member.Email, team.Name, member.Email)
+	request, err := http.NewRequest("POST", url, strings.NewReader("level=owner"))
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	err = setTeamUserLevel(recorder, request, token)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+}
+
+func (s *AuthSuite) TestSetTeamUserLevelWithTeamManageRole(c *check.C) {
+	team, _, member := s.createTeamWithLevels(c)
+	_, err := auth.CreateRole("team-manager", auth.CtxTeam, auth.PermTeamManage)
+	c.Assert(err, check.IsNil)
+	defer auth.RemoveRole("team-manager")
+	err = member.AddRole("team-manager", team.Name)
+	c.Assert(err, check.IsNil)
+	token, err := nativeScheme.Login(map[string]string{"email": member.Email, "password": "123456"})
+	c.Assert(err, check.IsNil)
+	url := fmt.Sprintf("/teams/%s/%s/level?:team=%s&:user=%s", team.Name, member.Email, team.Name, member.Email)
+	request, err := http.NewRequest("POST", url, strings.NewReader("level=viewer"))
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	err = setTeamUserLevel(recorder, request, token)
+	c.Assert(err, check.IsNil)
+	dbTeam, err := auth.GetTeam(team.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbTeam.Level(member), check.Equals, auth.TeamViewer)
+}
+
+func (s *AuthSuite) TestRemoveTeamRequiresOwner(c *check.C) {
+	team, _, member := s.createTeamWithLevels(c)
+	token, err := nativeScheme.Login(map[string]string{"email": member.Email, "password": "123456"})
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("DELETE", fmt.Sprintf("/teams/%s?:name=%s", team.Name, team.Name), nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = removeTeam(recorder, request, token)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+	_, err = auth.GetTeam(team.Name)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *AuthSuite) TestSetTeamUserLevelLastOwner(c *check.C) {
+	team, token, _ := s.createTeamWithLevels(c)
+	email := token.GetUserName()
+	url := fmt.Sprintf("/teams/%s/%s/level?:team=%s&:user=%s", team.Name, email, team.Name, email)
+	request, err := http.NewRequest("POST", url, strings.NewReader("level=developer"))
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	err = setTeamUserLevel(recorder, request, token)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+	c.Assert(e.Message, check.Equals, auth.ErrLastTeamOwner.Error())
+}
+
+func (s *AuthSuite) TestAddUserToTeamRequiresOwner(c *check.C) {
+	team, _, member := s.createTeamWithLevels(c)
+	token, err := nativeScheme.Login(map[string]string{"email": member.Email, "password": "123456"})
+	c.Assert(err, check.IsNil)
+	url := fmt.Sprintf("/teams/%s/%s?:team=%s&:user=%s", team.Name, s.user.Email, team.Name, s.user.Email)
+	request, err := http.NewRequest("PUT", url, nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = addUserToTeam(recorder, request, token)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+}
+
 func (s *AuthSuite) TestGetTeam(c *check.C) {
 	team, err := auth.GetTeam(s.team.Name)
 	c.Assert(err, check.IsNil)
@@ -1705,6 +1899,323 @@ func (s *AuthSuite) TestRegenerateAPITokenHandler(c *check.C) {
 	c.Assert(count, check.Equals, 1)
 }
 
+func (s *AuthSuite) TestCreateAPITokenHandler(c *check.C) {
+	conn, _ := db.Conn()
+	defer conn.Close()
+	defer conn.APITokens().RemoveAll(bson.M{"email": s.user.Email})
+	body := strings.NewReader("name=ci&expires=3600&app=myapp&action=app.deploy")
+	request, err := http.NewRequest("POST", "/users/tokens", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	err = createAPIToken(recorder, request, s.token)
+	c.Assert(err, check.IsNil)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	var got map[string]string
+	err = json.NewDecoder(recorder.Body).Decode(&got)
+	c.Assert(err, check.IsNil)
+	c.Assert(got["name"], check.Equals, "ci")
+	t, err := auth.APIAuth("bearer " + got["token"])
+	c.Assert(err, check.IsNil)
+	c.Assert(t.GetUserName(), check.Equals, s.user.Email)
+	c.Assert(t.Apps, check.DeepEquals, []string{"myapp"})
+	c.Assert(t.Actions, check.DeepEquals, []string{"app.deploy"})
+	action := rectest.Action{
+		Action: "create-api-token",
+		User:   s.user.Email,
+		Extra:  []interface{}{"name=ci", "expires=3600", []string{"myapp"}, []string{"app.deploy"}},
+	}
+	c.Assert(action, rectest.IsRecorded)
+}
+
+func (s *AuthSuite) TestCreateAPITokenHandlerInvalid(c *check.C) {
+	tests := []struct {
+		body string
+		code int
+	}{
+		{"expires=3600", http.StatusBadRequest},
+		{"name=ci&expires=soon", http.StatusBadRequest},
+		{"name=ci&action=app.destroy", http.StatusBadRequest},
+	}
+	for _, t := range tests {
+		request, err := http.NewRequest("POST", "/users/tokens", strings.NewReader(t.body))
+		c.Assert(err, check.IsNil)
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		err = createAPIToken(recorder, request, s.token)
+		e, ok := err.(*errors.HTTP)
+		c.Assert(ok, check.Equals, true)
+		c.Assert(e.Code, check.Equals, t.code)
+	}
+}
+
+func (s *AuthSuite) TestListAPITokensHandler(c *check.C) {
+	conn, _ := db.Conn()
+	defer conn.Close()
+	defer conn.APITokens().RemoveAll(bson.M{"email": s.user.Email})
+	_, err := s.user.CreateAPIToken("deploy", 0, nil, []string{auth.PermAppDeploy})
+	c.Assert(err, check.IsNil)
+	_, err = s.user.CreateAPIToken("ci", 0, nil, nil)
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("GET", "/users/tokens", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = listAPITokens(recorder, request, s.token)
+	c.Assert(err, check.IsNil)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/json")
+	var tokens []map[string]interface{}
+	err = json.NewDecoder(recorder.Body).Decode(&tokens)
+	c.Assert(err, check.IsNil)
+	c.Assert(tokens, check.HasLen, 2)
+	c.Assert(tokens[0]["name"], check.Equals, "ci")
+	c.Assert(tokens[1]["name"], check.Equals, "deploy")
+	_, ok := tokens[0]["token"]
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s *AuthSuite) TestListAPITokensHandlerNoTokens(c *check.C) {
+	request, err := http.NewRequest("GET", "/users/tokens", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = listAPITokens(recorder, request, s.token)
+	c.Assert(err, check.IsNil)
+	c.Assert(recorder.Code, check.Equals, http.StatusNoContent)
+}
+
+func (s *AuthSuite) TestRevokeAPITokenHandler(c *check.C) {
+	token, err := s.user.CreateAPIToken("ci", 0, nil, nil)
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("DELETE", "/users/tokens/ci?:name=ci", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = revokeAPIToken(recorder, request, s.token)
+	c.Assert(err, check.IsNil)
+	_, err = auth.APIAuth("bearer " + token)
+	c.Assert(err, check.Equals, auth.ErrInvalidToken)
+	recorder = httptest.NewRecorder()
+	err = revokeAPIToken(recorder, request, s.token)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *AuthSuite) TestRevokeAPITokenDoesNotLogout(c *check.C) {
+	_, err := s.user.CreateAPIToken("ci", 0, nil, nil)
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("DELETE", "/users/tokens/ci", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	m := RunServer(true)
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	tokens, err := s.user.APITokens()
+	c.Assert(err, check.IsNil)
+	c.Assert(tokens, check.HasLen, 0)
+	_, err = app.AuthScheme.Auth("bearer " + s.token.GetValue())
+	c.Assert(err, check.IsNil)
+}
+
+func (s *AuthSuite) enableTwoFactor(c *check.C, email string, recoveryCodes ...string) {
+	hashes := make([]string, len(recoveryCodes))
+	for i, code := range recoveryCodes {
+		hashes[i] = fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Replace(code, "-", "", -1))))
+	}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.TwoFactorAuth().Insert(bson.M{
+		"_id":           email,
+		"secret":        "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+		"enabled":       true,
+		"recoverycodes": hashes,
+	})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *AuthSuite) removeTwoFactor(email string) {
+	conn, _ := db.Conn()
+	defer conn.Close()
+	conn.TwoFactorAuth().RemoveId(email)
+}
+
+func (s *AuthSuite) TestLoginTwoFactorRequired(c *check.C) {
+	s.enableTwoFactor(c, s.user.Email, "abcd-efgh")
+	defer s.removeTwoFactor(s.user.Email)
+	b := bytes.NewBufferString(`{"password":"123456"}`)
+	request, err := http.NewRequest("POST", "/users/whydidifall@thewho.com/tokens?:email=whydidifall@thewho.com", b)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-type", "application/json")
+	recorder := httptest.NewRecorder()
+	err = login(recorder, request)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusPreconditionFailed)
+	c.Assert(e.Message, check.Equals, auth.ErrTwoFactorRequired.Error())
+}
+
+func (s *AuthSuite) TestLoginWithTwoFactorCode(c *check.C) {
+	s.enableTwoFactor(c, s.user.Email, "abcd-efgh")
+	defer s.removeTwoFactor(s.user.Email)
+	b := bytes.NewBufferString(`{"password":"123456","otp":"abcd-efgh"}`)
+	request, err := http.NewRequest("POST", "/users/whydidifall@thewho.com/tokens?:email=whydidifall@thewho.com", b)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-type", "application/json")
+	recorder := httptest.NewRecorder()
+	err = login(recorder, request)
+	c.Assert(err, check.IsNil)
+	var got map[string]interface{}
+	err = json.NewDecoder(recorder.Body).Decode(&got)
+	c.Assert(err, check.IsNil)
+	c.Assert(got["token"], check.NotNil)
+	b = bytes.NewBufferString(`{"password":"123456","otp":"abcd-efgh"}`)
+	request, err = http.NewRequest("POST", "/users/whydidifall@thewho.com/tokens?:email=whydidifall@thewho.com", b)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-type", "application/json")
+	recorder = httptest.NewRecorder()
+	err = login(recorder, request)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusUnauthorized)
+}
+
+func (s *AuthSuite) TestStartTwoFactorEnrollmentHandler(c *check.C) {
+	defer s.removeTwoFactor(s.user.Email)
+	request, err := http.NewRequest("POST", "/users/2fa", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = startTwoFactorEnrollment(recorder, request, s.token)
+	c.Assert(err, check.IsNil)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/json")
+	var got map[string]string
+	err = json.NewDecoder(recorder.Body).Decode(&got)
+	c.Assert(err, check.IsNil)
+	c.Assert(got["uri"], check.Matches, `^otpauth://totp/tsuru:whydidifall@thewho\.com\?.*secret=[A-Z2-7]+.*$`)
+	action := rectest.Action{Action: "two-factor-enroll", User: s.user.Email}
+	c.Assert(action, rectest.IsRecorded)
+}
+
+func (s *AuthSuite) TestStartTwoFactorEnrollmentHandlerAlreadyEnabled(c *check.C) {
+	s.enableTwoFactor(c, s.user.Email)
+	defer s.removeTwoFactor(s.user.Email)
+	request, err := http.NewRequest("POST", "/users/2fa", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = startTwoFactorEnrollment(recorder, request, s.token)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusConflict)
+}
+
+func (s *AuthSuite) TestConfirmTwoFactorEnrollmentHandlerNotEnrolling(c *check.C) {
+	request, err := http.NewRequest("POST", "/users/2fa/confirm", strings.NewReader("code=123456"))
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	err = confirmTwoFactorEnrollment(recorder, request, s.token)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *AuthSuite) TestConfirmTwoFactorEnrollmentHandlerInvalidCode(c *check.C) {
+	defer s.removeTwoFactor(s.user.Email)
+	_, err := native.NativeScheme{}.StartTwoFactorEnrollment(s.user)
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("POST", "/users/2fa/confirm", strings.NewReader("code=abcdef"))
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	err = confirmTwoFactorEnrollment(recorder, request, s.token)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+	enabled, err := native.NativeScheme{}.TwoFactorEnabled(s.user)
+	c.Assert(err, check.IsNil)
+	c.Assert(enabled, check.Equals, false)
+}
+
+func (s *AuthSuite) TestRegenerateRecoveryCodesHandler(c *check.C) {
+	s.enableTwoFactor(c, s.user.Email, "abcd-efgh")
+	defer s.removeTwoFactor(s.user.Email)
+	request, err := http.NewRequest("POST", "/users/2fa/recovery-codes", strings.NewReader("code=abcd-efgh"))
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	err = regenerateRecoveryCodes(recorder, request, s.token)
+	c.Assert(err, check.IsNil)
+	var got map[string][]string
+	err = json.NewDecoder(recorder.Body).Decode(&got)
+	c.Assert(err, check.IsNil)
+	c.Assert(got["recovery_codes"], check.HasLen, 10)
+	action := rectest.Action{Action: "two-factor-recovery-codes", User: s.user.Email}
+	c.Assert(action, rectest.IsRecorded)
+}
+
+func (s *AuthSuite) TestDisableTwoFactorHandler(c *check.C) {
+	s.enableTwoFactor(c, s.user.Email, "abcd-efgh")
+	defer s.removeTwoFactor(s.user.Email)
+	request, err := http.NewRequest("DELETE", "/users/2fa?code=wrong", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = disableTwoFactor(recorder, request, s.token)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+	request, err = http.NewRequest("DELETE", "/users/2fa?code=abcd-efgh", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	err = disableTwoFactor(recorder, request, s.token)
+	c.Assert(err, check.IsNil)
+	enabled, err := native.NativeScheme{}.TwoFactorEnabled(s.user)
+	c.Assert(err, check.IsNil)
+	c.Assert(enabled, check.Equals, false)
+	action := rectest.Action{Action: "two-factor-disable", User: s.user.Email}
+	c.Assert(action, rectest.IsRecorded)
+}
+
+func (s *AuthSuite) TestDisableTwoFactorHandlerLockout(c *check.C) {
+	config.Set("auth:lockout:max-attempts", 1)
+	defer config.Unset("auth:lockout")
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.LoginFailures().RemoveAll(nil)
+	s.enableTwoFactor(c, s.user.Email, "abcd-efgh")
+	defer s.removeTwoFactor(s.user.Email)
+	request, err := http.NewRequest("DELETE", "/users/2fa?code=wrong", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = disableTwoFactor(recorder, request, s.token)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+	request, err = http.NewRequest("DELETE", "/users/2fa?code=abcd-efgh", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	err = disableTwoFactor(recorder, request, s.token)
+	e, ok = err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, statusTooManyRequests)
+	enabled, err := native.NativeScheme{}.TwoFactorEnabled(s.user)
+	c.Assert(err, check.IsNil)
+	c.Assert(enabled, check.Equals, true)
+}
+
+func (s *AuthSuite) TestTwoFactorHandlersUnsupportedScheme(c *check.C) {
+	oldScheme := app.AuthScheme
+	defer func() { app.AuthScheme = oldScheme }()
+	app.AuthScheme = TestScheme{}
+	request, err := http.NewRequest("POST", "/users/2fa", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = startTwoFactorEnrollment(recorder, request, s.token)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(e.Message, check.Equals, nonManagedSchemeMsg)
+}
+
 func (s *AuthSuite) TestShowAPITokenForUserWithNoToken(c *check.C) {
 	conn, _ := db.Conn()
 	defer conn.Close()
@@ -24,7 +24,7 @@ func autoScaleHistoryHandler(w http.ResponseWriter, r *http.Request, t auth.Toke
 
 func autoScaleEnable(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	appName := r.URL.Query().Get(":app")
-	a, err := app.GetByName(appName)
+	a, err := getAppForToken(appName, t, auth.PermAppUpdate)
 	if err != nil {
 		return err
 	}
@@ -33,7 +33,7 @@ func autoScaleEnable(w http.ResponseWriter, r *http.Request, t auth.Token) error
 
 func autoScaleDisable(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	appName := r.URL.Query().Get(":app")
-	a, err := app.GetByName(appName)
+	a, err := getAppForToken(appName, t, auth.PermAppUpdate)
 	if err != nil {
 		return err
 	}
@@ -42,7 +42,7 @@ func autoScaleDisable(w http.ResponseWriter, r *http.Request, t auth.Token) erro
 
 func autoScaleConfig(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	appName := r.URL.Query().Get(":app")
-	a, err := app.GetByName(appName)
+	a, err := getAppForToken(appName, t, auth.PermAppUpdate)
 	if err != nil {
 		return err
 	}
@@ -17,6 +17,8 @@ import (
 	"github.com/tsuru/tsuru/auth"
 	"github.com/tsuru/tsuru/errors"
 	"github.com/tsuru/tsuru/io"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/rec"
 	"github.com/tsuru/tsuru/service"
 )
 
@@ -34,10 +36,11 @@ func deploy(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	}
 	version := r.PostFormValue("version")
 	archiveURL := r.PostFormValue("archive-url")
-	if version == "" && archiveURL == "" && file == nil {
+	image := r.PostFormValue("image")
+	if version == "" && archiveURL == "" && image == "" && file == nil {
 		return &errors.HTTP{
 			Code:    http.StatusBadRequest,
-			Message: "you must specify either the version, the archive-url or upload a file",
+			Message: "you must specify either the version, the archive-url, the image or upload a file",
 		}
 	}
 	if version != "" && archiveURL != "" {
@@ -46,6 +49,12 @@ func deploy(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 			Message: "you must specify either the version or the archive-url, but not both",
 		}
 	}
+	if image != "" && (version != "" || archiveURL != "" || file != nil) {
+		return &errors.HTTP{
+			Code:    http.StatusBadRequest,
+			Message: "you cannot specify the image along with the version, the archive-url or a file",
+		}
+	}
 	commit := r.PostFormValue("commit")
 	w.Header().Set("Content-Type", "text")
 	appName := r.URL.Query().Get(":appname")
@@ -65,7 +74,7 @@ func deploy(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 		if err != nil {
 			return err
 		}
-		app, err := getApp(appName, user)
+		app, err := getAppWithPermission(appName, user, auth.PermAppDeploy)
 		if err != nil {
 			return err
 		}
@@ -74,13 +83,14 @@ func deploy(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	}
 	writer := io.NewKeepAliveWriter(w, 30*time.Second, "please wait...")
 	err = app.Deploy(app.DeployOptions{
-		App:          instance,
-		Version:      version,
-		Commit:       commit,
-		File:         file,
-		ArchiveURL:   archiveURL,
-		OutputStream: writer,
-		User:         userName,
+		App:           instance,
+		Version:       version,
+		Commit:        commit,
+		File:          file,
+		ArchiveURL:    archiveURL,
+		ExternalImage: image,
+		OutputStream:  writer,
+		User:          userName,
 	})
 	if err == nil {
 		fmt.Fprintln(w, "\nOK")
@@ -90,9 +100,13 @@ func deploy(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 
 func deployRollback(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	appName := r.URL.Query().Get(":appname")
-	instance, err := app.GetByName(appName)
+	u, err := t.User()
+	if err != nil {
+		return err
+	}
+	instance, err := getAppWithPermission(appName, u, auth.PermAppDeploy)
 	if err != nil {
-		return &errors.HTTP{Code: http.StatusNotFound, Message: fmt.Sprintf("App %s not found.", appName)}
+		return err
 	}
 	image := r.PostFormValue("image")
 	if image == "" {
@@ -104,7 +118,7 @@ func deployRollback(w http.ResponseWriter, r *http.Request, t auth.Token) error
 	w.Header().Set("Content-Type", "application/json")
 	writer := &io.SimpleJsonMessageEncoderWriter{Encoder: json.NewEncoder(w)}
 	err = app.Deploy(app.DeployOptions{
-		App:          instance,
+		App:          &instance,
 		OutputStream: writer,
 		Image:        image,
 		User:         t.GetUserName(),
@@ -115,6 +129,29 @@ func deployRollback(w http.ResponseWriter, r *http.Request, t auth.Token) error
 	return nil
 }
 
+func cancelDeploy(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	u, err := t.User()
+	if err != nil {
+		return err
+	}
+	appName := r.URL.Query().Get(":appname")
+	instance, err := getAppWithPermission(appName, u, auth.PermAppDeploy)
+	if err != nil {
+		return err
+	}
+	rec.Log(u.Email, "cancel-deploy", "app="+appName)
+	err = app.CancelDeploy(&instance, u.Email)
+	switch err {
+	case app.ErrNoDeployInProgress:
+		return &errors.HTTP{Code: http.StatusNotFound, Message: err.Error()}
+	case provision.ErrNothingToCancel:
+		return &errors.HTTP{Code: http.StatusConflict, Message: err.Error()}
+	case app.ErrCancelDeployNotSupported:
+		return &errors.HTTP{Code: http.StatusBadRequest, Message: err.Error()}
+	}
+	return err
+}
+
 func deploysList(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	u, err := t.User()
 	if err != nil {
@@ -166,3 +203,24 @@ func deployInfo(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	}
 	return json.NewEncoder(w).Encode(data)
 }
+
+func deploysDiff(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	u, err := t.User()
+	if err != nil {
+		return err
+	}
+	from, err := app.GetDeploy(r.URL.Query().Get(":deploy"), u)
+	if err != nil {
+		return &errors.HTTP{Code: http.StatusNotFound, Message: err.Error()}
+	}
+	to, err := app.GetDeploy(r.URL.Query().Get(":other"), u)
+	if err != nil {
+		return &errors.HTTP{Code: http.StatusNotFound, Message: err.Error()}
+	}
+	diff, err := app.CompareDeploys(from, to)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(diff)
+}
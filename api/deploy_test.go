@@ -21,6 +21,7 @@ import (
 	"github.com/tsuru/tsuru/db"
 	"github.com/tsuru/tsuru/db/dbtest"
 	"github.com/tsuru/tsuru/provision/provisiontest"
+	"github.com/tsuru/tsuru/rec/rectest"
 	"github.com/tsuru/tsuru/repository"
 	"github.com/tsuru/tsuru/repository/repositorytest"
 	"github.com/tsuru/tsuru/service"
@@ -118,6 +119,25 @@ func (s *DeploySuite) TestDeployArchiveURL(c *check.C) {
 	c.Assert(recorder.Body.String(), check.Equals, "Archive deploy called\nOK\n")
 }
 
+func (s *DeploySuite) TestDeployExternalImage(c *check.C) {
+	user, _ := s.token.User()
+	a := app.App{Name: "otherapp", Platform: "python", Teams: []string{s.team.Name}}
+	err := app.CreateApp(&a, user)
+	c.Assert(err, check.IsNil)
+	defer app.Delete(&a)
+	url := fmt.Sprintf("/apps/%s/repository/clone?:appname=%s", a.Name, a.Name)
+	request, err := http.NewRequest("POST", url, strings.NewReader("image=registry.example.com/myimage:1.0"))
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Body.String(), check.Equals, "External image deploy called\nOK\n")
+	c.Assert(s.provisioner.LastImage(&a), check.Equals, "registry.example.com/myimage:1.0")
+}
+
 func (s *DeploySuite) TestDeployUploadFile(c *check.C) {
 	user, _ := s.token.User()
 	a := app.App{Name: "otherapp", Platform: "python", Teams: []string{s.team.Name}}
@@ -293,7 +313,7 @@ func (s *DeploySuite) TestDeployWithoutVersionAndArchiveURL(c *check.C) {
 	server.ServeHTTP(recorder, request)
 	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
 	message := recorder.Body.String()
-	c.Assert(message, check.Equals, "you must specify either the version, the archive-url or upload a file\n")
+	c.Assert(message, check.Equals, "you must specify either the version, the archive-url, the image or upload a file\n")
 }
 
 func (s *DeploySuite) TestDeployWithVersionAndArchiveURL(c *check.C) {
@@ -316,6 +336,73 @@ func (s *DeploySuite) TestDeployWithVersionAndArchiveURL(c *check.C) {
 	c.Assert(message, check.Equals, "you must specify either the version or the archive-url, but not both\n")
 }
 
+func (s *DeploySuite) TestDeployWithImageAndArchiveURL(c *check.C) {
+	user, _ := s.token.User()
+	a := app.App{Name: "abc", Platform: "python", Teams: []string{s.team.Name}}
+	err := app.CreateApp(&a, user)
+	c.Assert(err, check.IsNil)
+	defer app.Delete(&a)
+	defer s.conn.Logs(a.Name).DropCollection()
+	body := strings.NewReader("image=registry.example.com/myimage:1.0&archive-url=http://google.com")
+	request, err := http.NewRequest("POST", "/apps/abc/repository/clone", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	message := recorder.Body.String()
+	c.Assert(message, check.Equals, "you cannot specify the image along with the version, the archive-url or a file\n")
+}
+
+func (s *DeploySuite) TestCancelDeploy(c *check.C) {
+	user, _ := s.token.User()
+	a := app.App{Name: "otherapp", Platform: "python", Teams: []string{s.team.Name}}
+	err := app.CreateApp(&a, user)
+	c.Assert(err, check.IsNil)
+	defer app.Delete(&a)
+	locked, err := app.AcquireApplicationLock(a.Name, user.Email, "POST /apps/otherapp/deploy")
+	c.Assert(err, check.IsNil)
+	c.Assert(locked, check.Equals, true)
+	defer app.ReleaseApplicationLock(a.Name)
+	err = s.conn.RunningDeploys().Insert(bson.M{"_id": a.Name, "user": user.Email})
+	c.Assert(err, check.IsNil)
+	defer s.conn.RunningDeploys().RemoveId(a.Name)
+	url := fmt.Sprintf("/apps/%s/deploy", a.Name)
+	request, err := http.NewRequest("DELETE", url, nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var result map[string]interface{}
+	err = s.conn.RunningDeploys().FindId(a.Name).One(&result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result["canceledby"], check.Equals, user.Email)
+	c.Assert(s.provisioner.Cancels(&a), check.Equals, 1)
+	action := rectest.Action{Action: "cancel-deploy", User: user.Email, Extra: []interface{}{"app=" + a.Name}}
+	c.Assert(action, rectest.IsRecorded)
+}
+
+func (s *DeploySuite) TestCancelDeployWithoutDeployInProgress(c *check.C) {
+	user, _ := s.token.User()
+	a := app.App{Name: "otherapp", Platform: "python", Teams: []string{s.team.Name}}
+	err := app.CreateApp(&a, user)
+	c.Assert(err, check.IsNil)
+	defer app.Delete(&a)
+	url := fmt.Sprintf("/apps/%s/deploy", a.Name)
+	request, err := http.NewRequest("DELETE", url, nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+	c.Assert(recorder.Body.String(), check.Equals, "there is no deploy in progress for this app\n")
+}
+
 func (s *DeploySuite) TestDeployListNonAdmin(c *check.C) {
 	user := &auth.User{Email: "nonadmin@nonadmin.com", Password: "123456"}
 	nativeScheme := auth.ManagedScheme(native.NativeScheme{})
@@ -548,6 +635,74 @@ func (s *DeploySuite) TestDeployInfoByAdminUser(c *check.C) {
 	c.Assert(result, check.DeepEquals, lastDeploy)
 }
 
+func (s *DeploySuite) TestDeploysDiff(c *check.C) {
+	a := app.App{Name: "g1", Platform: "python", Teams: []string{s.team.Name}}
+	user, _ := s.token.User()
+	err := app.CreateApp(&a, user)
+	c.Assert(err, check.IsNil)
+	defer app.Delete(&a)
+	from := app.DeployData{
+		ID:        bson.NewObjectId(),
+		App:       "g1",
+		Timestamp: time.Now().Add(-3600 * time.Second),
+		Image:     "tsuru/app-g1:v1",
+		Origin:    "app-deploy",
+		Envs:      map[string]string{"DEBUG": "1"},
+	}
+	to := app.DeployData{
+		ID:        bson.NewObjectId(),
+		App:       "g1",
+		Timestamp: time.Now(),
+		Image:     "tsuru/app-g1:v2",
+		Origin:    "app-deploy",
+		Envs:      map[string]string{"DEBUG": "0"},
+	}
+	err = s.conn.Deploys().Insert(from, to)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Deploys().RemoveAll(nil)
+	url := fmt.Sprintf("/deploys/%s/diff/%s", from.ID.Hex(), to.ID.Hex())
+	request, err := http.NewRequest("GET", url, nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/json")
+	var result app.DeploysDiff
+	err = json.Unmarshal(recorder.Body.Bytes(), &result)
+	c.Assert(err, check.IsNil)
+	expected := app.DeploysDiff{
+		From: from.ID.Hex(),
+		To:   to.ID.Hex(),
+		Changes: []app.DeployChange{
+			{Kind: "deploy", Name: "image", From: "tsuru/app-g1:v1", To: "tsuru/app-g1:v2"},
+			{Kind: "env", Name: "DEBUG", From: "1", To: "0"},
+		},
+	}
+	c.Assert(result, check.DeepEquals, expected)
+}
+
+func (s *DeploySuite) TestDeploysDiffNotFound(c *check.C) {
+	a := app.App{Name: "g1", Platform: "python", Teams: []string{s.team.Name}}
+	user, _ := s.token.User()
+	err := app.CreateApp(&a, user)
+	c.Assert(err, check.IsNil)
+	defer app.Delete(&a)
+	from := app.DeployData{ID: bson.NewObjectId(), App: "g1", Timestamp: time.Now()}
+	err = s.conn.Deploys().Insert(from)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Deploys().RemoveAll(nil)
+	url := fmt.Sprintf("/deploys/%s/diff/%s", from.ID.Hex(), bson.NewObjectId().Hex())
+	request, err := http.NewRequest("GET", url, nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
 func (s *DeploySuite) TestDeployInfoDiff(c *check.C) {
 	a := app.App{Name: "g1", Platform: "python", Teams: []string{s.team.Name}}
 	user, _ := s.token.User()
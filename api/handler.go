@@ -21,6 +21,18 @@ var (
 		Code:    http.StatusForbidden,
 		Message: "You must be an admin",
 	}
+	permissionRequiredErr = &errors.HTTP{
+		Code:    http.StatusForbidden,
+		Message: "You don't have permission to do this action",
+	}
+	tokenScopeErr = &errors.HTTP{
+		Code:    http.StatusForbidden,
+		Message: "The API token is not allowed to do this action",
+	}
+	twoFactorRequiredErr = &errors.HTTP{
+		Code:    http.StatusForbidden,
+		Message: "You must enable two-factor authentication to perform admin actions",
+	}
 )
 
 type Handler func(http.ResponseWriter, *http.Request) error
@@ -41,15 +53,72 @@ func (fn authorizationRequiredHandler) ServeHTTP(w http.ResponseWriter, r *http.
 	}
 }
 
+// AdminRequiredHandler allows the request only to admin users, which are the
+// members of the admin team and the users with a global role granting all
+// permissions.
 type AdminRequiredHandler authorizationRequiredHandler
 
 func (fn AdminRequiredHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	t := context.GetAuthToken(r)
 	if t == nil {
 		context.AddRequestError(r, tokenRequiredErr)
-	} else if user, err := t.User(); err != nil || !user.IsAdmin() {
-		context.AddRequestError(r, adminRequiredErr)
+	} else if user, err := t.User(); err != nil || !auth.CheckPermission(user, auth.PermAll) {
+		if err == nil && user.TwoFactorMissing() {
+			context.AddRequestError(r, twoFactorRequiredErr)
+		} else {
+			context.AddRequestError(r, adminRequiredErr)
+		}
 	} else {
 		context.AddRequestError(r, fn(w, r, t))
 	}
 }
+
+type permissionRequiredHandler struct {
+	permission string
+	fn         authorizationRequiredHandler
+}
+
+// PermissionRequiredHandler allows the request only to users with a global
+// role granting the given permission, and to admin users.
+func PermissionRequiredHandler(permission string, fn authorizationRequiredHandler) http.Handler {
+	return &permissionRequiredHandler{permission: permission, fn: fn}
+}
+
+func (h *permissionRequiredHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t := context.GetAuthToken(r)
+	if t == nil {
+		context.AddRequestError(r, tokenRequiredErr)
+	} else if user, err := t.User(); err != nil || !auth.CheckPermission(user, h.permission) {
+		if err == nil && user.TwoFactorMissing() {
+			context.AddRequestError(r, twoFactorRequiredErr)
+		} else {
+			context.AddRequestError(r, permissionRequiredErr)
+		}
+	} else {
+		context.AddRequestError(r, h.fn(w, r, t))
+	}
+}
+
+type scopedHandler struct {
+	action string
+	http.Handler
+}
+
+// tokenScope marks the handler as performing the given action, so it accepts
+// API tokens restricted to the action. API tokens restricted to some actions
+// are refused by handlers that are not marked.
+func tokenScope(action string, h http.Handler) http.Handler {
+	return &scopedHandler{action: action, Handler: h}
+}
+
+// handlerAction returns the action performed by the handler, as declared
+// with tokenScope or PermissionRequiredHandler.
+func handlerAction(h http.Handler) string {
+	switch h := h.(type) {
+	case *scopedHandler:
+		return h.action
+	case *permissionRequiredHandler:
+		return h.permission
+	}
+	return ""
+}
@@ -366,6 +366,149 @@ func (s *HandlerSuite) TestAdminRequiredHandlerShouldSetVersionHeadersEvenOnErro
 	c.Assert(recorder.Header().Get("Supported-Crane"), check.Equals, craneMin)
 }
 
+func (s *HandlerSuite) TestAdminRequiredHandlerWithGlobalRoleGrantingAll(c *check.C) {
+	user := &auth.User{Email: "rain@gotthard.com", Password: "123456"}
+	_, err := nativeScheme.Create(user)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Users().Remove(bson.M{"email": user.Email})
+	_, err = auth.CreateRole("superuser", auth.CtxGlobal, auth.PermAll)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("superuser")
+	err = user.AddRole("superuser", "")
+	c.Assert(err, check.IsNil)
+	token, err := nativeScheme.Login(map[string]string{"email": user.Email, "password": "123456"})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Tokens().Remove(bson.M{"token": token.GetValue()})
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/apps", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+token.GetValue())
+	RegisterHandler("/apps", "GET", AdminRequiredHandler(authorizedSimpleHandler))
+	defer resetHandlers()
+	m := RunServer(true)
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Body.String(), check.Equals, "success")
+}
+
+func (s *HandlerSuite) TestPermissionRequiredHandler(c *check.C) {
+	user := &auth.User{Email: "rain@gotthard.com", Password: "123456"}
+	_, err := nativeScheme.Create(user)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Users().Remove(bson.M{"email": user.Email})
+	token, err := nativeScheme.Login(map[string]string{"email": user.Email, "password": "123456"})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Tokens().Remove(bson.M{"token": token.GetValue()})
+	RegisterHandler("/nodes", "GET", PermissionRequiredHandler(auth.PermNodeManage, authorizedSimpleHandler))
+	defer resetHandlers()
+	m := RunServer(true)
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/nodes", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+token.GetValue())
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(recorder.Body.String(), check.Equals, "You don't have permission to do this action\n")
+	_, err = auth.CreateRole("ops", auth.CtxGlobal, auth.PermNodeManage)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("ops")
+	err = user.AddRole("ops", "")
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Body.String(), check.Equals, "success")
+	recorder = httptest.NewRecorder()
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+}
+
+func (s *HandlerSuite) TestAdminRequiredHandlerEnforcesTwoFactor(c *check.C) {
+	config.Set("auth:two-factor:enforce-admins", true)
+	defer config.Unset("auth:two-factor:enforce-admins")
+	RegisterHandler("/apps", "GET", AdminRequiredHandler(authorizedSimpleHandler))
+	defer resetHandlers()
+	m := RunServer(true)
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/apps", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(recorder.Body.String(), check.Equals, "You must enable two-factor authentication to perform admin actions\n")
+	err = s.conn.TwoFactorAuth().Insert(bson.M{"_id": "whydidifall@thewho.com", "enabled": true})
+	c.Assert(err, check.IsNil)
+	defer s.conn.TwoFactorAuth().RemoveId("whydidifall@thewho.com")
+	recorder = httptest.NewRecorder()
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Body.String(), check.Equals, "success")
+}
+
+func (s *HandlerSuite) TestAdminRequiredHandlerEnforcesTwoFactorForAdminRoles(c *check.C) {
+	config.Set("auth:two-factor:enforce-admins", true)
+	defer config.Unset("auth:two-factor:enforce-admins")
+	user := &auth.User{Email: "root@gotthard.com", Password: "123456"}
+	_, err := nativeScheme.Create(user)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Users().Remove(bson.M{"email": user.Email})
+	token, err := nativeScheme.Login(map[string]string{"email": user.Email, "password": "123456"})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Tokens().Remove(bson.M{"token": token.GetValue()})
+	_, err = auth.CreateRole("superuser", auth.CtxGlobal, auth.PermAll)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("superuser")
+	err = user.AddRole("superuser", "")
+	c.Assert(err, check.IsNil)
+	RegisterHandler("/apps", "GET", AdminRequiredHandler(authorizedSimpleHandler))
+	defer resetHandlers()
+	m := RunServer(true)
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/apps", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+token.GetValue())
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(recorder.Body.String(), check.Equals, "You must enable two-factor authentication to perform admin actions\n")
+	err = s.conn.TwoFactorAuth().Insert(bson.M{"_id": user.Email, "enabled": true})
+	c.Assert(err, check.IsNil)
+	defer s.conn.TwoFactorAuth().RemoveId(user.Email)
+	recorder = httptest.NewRecorder()
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+}
+
+func (s *HandlerSuite) TestPermissionRequiredHandlerEnforcesTwoFactorOnlyForAdmins(c *check.C) {
+	config.Set("auth:two-factor:enforce-admins", true)
+	defer config.Unset("auth:two-factor:enforce-admins")
+	user := &auth.User{Email: "rain@gotthard.com", Password: "123456"}
+	_, err := nativeScheme.Create(user)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Users().Remove(bson.M{"email": user.Email})
+	token, err := nativeScheme.Login(map[string]string{"email": user.Email, "password": "123456"})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Tokens().Remove(bson.M{"token": token.GetValue()})
+	_, err = auth.CreateRole("ops", auth.CtxGlobal, auth.PermNodeManage)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("ops")
+	err = user.AddRole("ops", "")
+	c.Assert(err, check.IsNil)
+	RegisterHandler("/nodes", "GET", PermissionRequiredHandler(auth.PermNodeManage, authorizedSimpleHandler))
+	defer resetHandlers()
+	m := RunServer(true)
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/nodes", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+token.GetValue())
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	recorder = httptest.NewRecorder()
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+}
+
 func (s *HandlerSuite) TestAdminRequiredHandlerShouldReturnTheHandlerErrorIfAnyHappen(c *check.C) {
 	recorder := httptest.NewRecorder()
 	request, err := http.NewRequest("GET", "/apps", nil)
@@ -26,7 +26,7 @@ func fullHealthcheck(w http.ResponseWriter, r *http.Request) {
 	status := http.StatusOK
 	for _, result := range results {
 		fmt.Fprintf(&buf, "%s: %s\n", result.Name, result.Status)
-		if result.Status != hc.HealthCheckOK {
+		if result.Failed() {
 			status = http.StatusInternalServerError
 		}
 	}
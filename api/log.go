@@ -18,7 +18,7 @@ func logRemove(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 		if err != nil {
 			return err
 		}
-		a, err := getApp(r.URL.Query().Get("app"), u)
+		a, err := getAppWithPermission(r.URL.Query().Get("app"), u, auth.PermAppUpdate)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,65 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/tsuru/tsuru/auth"
+	"github.com/tsuru/tsuru/errors"
+	"github.com/tsuru/tsuru/metering"
+)
+
+// meteringReport exports the unit-hours and instance-hours used by teams in
+// a period, as JSON or CSV. The period defaults to the current month.
+func meteringReport(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	now := time.Now().In(time.UTC)
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	end := now
+	var err error
+	if value := r.URL.Query().Get("start"); value != "" {
+		start, err = parseMeteringDate(value)
+		if err != nil {
+			return &errors.HTTP{Code: http.StatusBadRequest, Message: fmt.Sprintf("Invalid start date: %s", value)}
+		}
+	}
+	if value := r.URL.Query().Get("end"); value != "" {
+		end, err = parseMeteringDate(value)
+		if err != nil {
+			return &errors.HTTP{Code: http.StatusBadRequest, Message: fmt.Sprintf("Invalid end date: %s", value)}
+		}
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		return &errors.HTTP{Code: http.StatusBadRequest, Message: fmt.Sprintf("Invalid format: %s. Use json or csv.", format)}
+	}
+	usage, err := metering.Report(start, end)
+	if err == metering.ErrInvalidPeriod {
+		return &errors.HTTP{Code: http.StatusBadRequest, Message: err.Error()}
+	}
+	if err != nil {
+		return err
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=metering-%s-%s.csv", start.Format("20060102"), end.Format("20060102")))
+		return metering.WriteCSV(w, usage)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(usage)
+}
+
+// parseMeteringDate parses dates in the format YYYY-MM-DD, or in RFC 3339
+// format.
+func parseMeteringDate(value string) (time.Time, error) {
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		date, err = time.Parse(time.RFC3339, value)
+	}
+	return date, err
+}
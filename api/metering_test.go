@@ -0,0 +1,94 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/tsuru/tsuru/metering"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) recordMeteringEvents(c *check.C) {
+	base := time.Date(2015, 10, 1, 0, 0, 0, 0, time.UTC)
+	events := []metering.Event{
+		{Kind: metering.KindUnit, Action: metering.ActionAdd, Resource: "myapp", Team: "team1", Pool: "pool1", Plan: "small", Quantity: 2, Date: base},
+		{Kind: metering.KindInstance, Action: metering.ActionCreate, Resource: "mydb", Service: "mysql", Team: "team1", Plan: "medium", Date: base.Add(12 * time.Hour)},
+	}
+	for _, evt := range events {
+		err := metering.Record(evt)
+		c.Assert(err, check.IsNil)
+	}
+}
+
+func (s *S) TestMeteringReport(c *check.C) {
+	s.recordMeteringEvents(c)
+	defer s.conn.MeteringEvents().RemoveAll(nil)
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/metering/report?start=2015-10-01&end=2015-10-02", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	m := RunServer(true)
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/json")
+	var usage []metering.Usage
+	err = json.NewDecoder(recorder.Body).Decode(&usage)
+	c.Assert(err, check.IsNil)
+	c.Assert(usage, check.DeepEquals, []metering.Usage{
+		{Kind: metering.KindInstance, Team: "team1", Plan: "medium", Hours: 12},
+		{Kind: metering.KindUnit, Team: "team1", Pool: "pool1", Plan: "small", Hours: 48},
+	})
+}
+
+func (s *S) TestMeteringReportCSV(c *check.C) {
+	s.recordMeteringEvents(c)
+	defer s.conn.MeteringEvents().RemoveAll(nil)
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/metering/report?start=2015-10-01T06:00:00Z&end=2015-10-02&format=csv", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	m := RunServer(true)
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "text/csv")
+	c.Assert(recorder.Header().Get("Content-Disposition"), check.Equals, "attachment; filename=metering-20151001-20151002.csv")
+	c.Assert(recorder.Body.String(), check.Equals, "kind,team,pool,plan,hours\ninstance,team1,,medium,12.00\nunit,team1,pool1,small,36.00\n")
+}
+
+func (s *S) TestMeteringReportInvalidParameters(c *check.C) {
+	tests := []struct {
+		query   string
+		message string
+	}{
+		{"start=yesterday", "Invalid start date: yesterday\n"},
+		{"end=10/02/2015", "Invalid end date: 10/02/2015\n"},
+		{"format=xml", "Invalid format: xml. Use json or csv.\n"},
+		{"start=2015-10-02&end=2015-10-01", metering.ErrInvalidPeriod.Error() + "\n"},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest("GET", "/metering/report?"+tt.query, nil)
+		c.Assert(err, check.IsNil)
+		request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+		m := RunServer(true)
+		m.ServeHTTP(recorder, request)
+		c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+		c.Assert(recorder.Body.String(), check.Equals, tt.message)
+	}
+}
+
+func (s *S) TestMeteringReportNonAdmin(c *check.C) {
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/metering/report", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	m := RunServer(true)
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+}
@@ -41,15 +41,37 @@ func validate(token string, r *http.Request) (auth.Token, error) {
 		}
 	} else if user, err := t.User(); err == nil {
 		if q := r.URL.Query().Get(":app"); q != "" {
-			_, err = getApp(q, user)
+			_, err = getAppWithPermission(q, user, requestPermission(r))
 			if err != nil {
 				return nil, err
 			}
 		}
 	}
+	if apiToken, ok := t.(*auth.APIToken); ok {
+		appName := r.URL.Query().Get(":app")
+		if appName == "" {
+			appName = r.URL.Query().Get(":appname")
+		}
+		if !apiToken.Allows(handlerAction(context.GetDelayedHandler(r)), appName) {
+			return nil, tokenScopeErr
+		}
+	}
 	return t, nil
 }
 
+// requestPermission returns the permission required on the app of the
+// request: the action declared by the handler, or app.read for GET requests
+// and app.update for other methods.
+func requestPermission(r *http.Request) string {
+	if action := handlerAction(context.GetDelayedHandler(r)); action != "" {
+		return action
+	}
+	if r.Method == "GET" {
+		return auth.PermAppRead
+	}
+	return auth.PermAppUpdate
+}
+
 func contextClearerMiddleware(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	defer context.Clear(r)
 	next(w, r)
@@ -264,6 +264,119 @@ func (s *S) TestAuthTokenMiddlewareUserTokenNoAccessToTheApp(c *check.C) {
 	c.Assert(e.Code, check.Equals, http.StatusForbidden)
 }
 
+func (s *S) TestAuthTokenMiddlewareUserTokenWithRolesNoAccessToTheApp(c *check.C) {
+	a := app.App{Name: "something"}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	_, err = auth.CreateRole("deployer", auth.CtxApp, auth.PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("deployer")
+	err = s.user.AddRole("deployer", a.Name)
+	c.Assert(err, check.IsNil)
+	defer s.user.RemoveRole("deployer", a.Name)
+	request, err := http.NewRequest("POST", "/?:app=something", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	context.SetDelayedHandler(request, tokenScope(auth.PermAppDeploy, authorizationRequiredHandler(deploy)))
+	h, log := doHandler()
+	authTokenMiddleware(httptest.NewRecorder(), request, h)
+	c.Assert(log.called, check.Equals, true)
+	request, err = http.NewRequest("GET", "/?:app=something", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	h, log = doHandler()
+	authTokenMiddleware(httptest.NewRecorder(), request, h)
+	c.Assert(log.called, check.Equals, false)
+	e, ok := context.GetRequestError(request).(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+}
+
+func (s *S) TestAuthTokenMiddlewareUserTokenWithRolesOnAnotherApp(c *check.C) {
+	for _, name := range []string{"something", "otherthing"} {
+		err := s.conn.Apps().Insert(app.App{Name: name})
+		c.Assert(err, check.IsNil)
+		defer s.conn.Apps().Remove(bson.M{"name": name})
+	}
+	_, err := auth.CreateRole("deployer", auth.CtxApp, auth.PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("deployer")
+	err = s.user.AddRole("deployer", "something")
+	c.Assert(err, check.IsNil)
+	defer s.user.RemoveRole("deployer", "something")
+	request, err := http.NewRequest("POST", "/?:app=otherthing", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	context.SetDelayedHandler(request, tokenScope(auth.PermAppDeploy, authorizationRequiredHandler(deploy)))
+	h, log := doHandler()
+	authTokenMiddleware(httptest.NewRecorder(), request, h)
+	c.Assert(log.called, check.Equals, false)
+	e, ok := context.GetRequestError(request).(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+}
+
+func (s *S) TestAuthTokenMiddlewareUserTokenViewerUpdatingTheApp(c *check.C) {
+	team := auth.Team{Name: "viewers", Users: []string{s.adminuser.Email, s.user.Email}, Owners: []string{s.adminuser.Email}, Viewers: []string{s.user.Email}}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	a := app.App{Name: "something", Teams: []string{team.Name}}
+	err = s.conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	request, err := http.NewRequest("GET", "/?:app=something", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	h, log := doHandler()
+	authTokenMiddleware(httptest.NewRecorder(), request, h)
+	c.Assert(log.called, check.Equals, true)
+	request, err = http.NewRequest("POST", "/?:app=something", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	h, log = doHandler()
+	authTokenMiddleware(httptest.NewRecorder(), request, h)
+	c.Assert(log.called, check.Equals, false)
+	e, ok := context.GetRequestError(request).(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+	c.Assert(e.Message, check.Equals, "you must be a team developer to do this action")
+}
+
+func (s *S) TestAuthTokenMiddlewareWithScopedAPIToken(c *check.C) {
+	token, err := s.user.CreateAPIToken("deploy-only", 0, []string{"something"}, []string{auth.PermAppDeploy})
+	c.Assert(err, check.IsNil)
+	defer s.conn.APITokens().RemoveAll(bson.M{"email": s.user.Email})
+	a := app.App{Name: "something", Teams: []string{s.team.Name}}
+	err = s.conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	request, err := http.NewRequest("POST", "/?:appname=something", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+token)
+	context.SetDelayedHandler(request, tokenScope(auth.PermAppDeploy, authorizationRequiredHandler(deploy)))
+	h, log := doHandler()
+	authTokenMiddleware(httptest.NewRecorder(), request, h)
+	c.Assert(log.called, check.Equals, true)
+	c.Assert(context.GetAuthToken(request).GetValue(), check.Equals, token)
+	request, err = http.NewRequest("DELETE", "/?:app=something", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+token)
+	context.SetDelayedHandler(request, authorizationRequiredHandler(appDelete))
+	h, log = doHandler()
+	authTokenMiddleware(httptest.NewRecorder(), request, h)
+	c.Assert(log.called, check.Equals, false)
+	c.Assert(context.GetRequestError(request), check.Equals, tokenScopeErr)
+	request, err = http.NewRequest("POST", "/?:appname=otherapp", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+token)
+	context.SetDelayedHandler(request, tokenScope(auth.PermAppDeploy, authorizationRequiredHandler(deploy)))
+	h, log = doHandler()
+	authTokenMiddleware(httptest.NewRecorder(), request, h)
+	c.Assert(log.called, check.Equals, false)
+}
+
 func (s *S) TestRunDelayedHandlerWithoutHandler(c *check.C) {
 	recorder := httptest.NewRecorder()
 	request, err := http.NewRequest("GET", "/", nil)
@@ -1,11 +1,14 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/tsuru/tsuru/app"
 	"github.com/tsuru/tsuru/auth"
+	"github.com/tsuru/tsuru/errors"
 )
 
 func platformAdd(w http.ResponseWriter, r *http.Request, t auth.Token) error {
@@ -46,3 +49,69 @@ func platformRemove(w http.ResponseWriter, r *http.Request, t auth.Token) error
 	name := r.URL.Query().Get(":name")
 	return app.PlatformRemove(name)
 }
+
+func platformRollback(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	name := r.URL.Query().Get(":name")
+	err := app.PlatformRollback(name, r.FormValue("version"))
+	if _, ok := err.(app.InvalidPlatformError); ok {
+		return &errors.HTTP{Code: http.StatusNotFound, Message: "Platform not found"}
+	}
+	if err != nil {
+		return &errors.HTTP{Code: http.StatusBadRequest, Message: err.Error()}
+	}
+	return nil
+}
+
+func platformSetState(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	name := r.URL.Query().Get(":name")
+	err := app.PlatformSetState(name, r.FormValue("state"))
+	if _, ok := err.(app.InvalidPlatformError); ok {
+		return &errors.HTTP{Code: http.StatusNotFound, Message: "Platform not found"}
+	}
+	if err != nil {
+		return &errors.HTTP{Code: http.StatusBadRequest, Message: err.Error()}
+	}
+	return nil
+}
+
+func platformRolloutStart(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	name := r.URL.Query().Get(":name")
+	opts := app.PlatformRolloutOptions{BatchPercent: -1, MaxFailurePercent: -1}
+	for param, value := range map[string]*int{
+		"batch-percent":       &opts.BatchPercent,
+		"max-failure-percent": &opts.MaxFailurePercent,
+	} {
+		if v := r.FormValue(param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > 100 {
+				return &errors.HTTP{Code: http.StatusBadRequest, Message: fmt.Sprintf("Invalid %s: must be a percentage between 0 and 100", param)}
+			}
+			*value = n
+		}
+	}
+	rollout, err := app.StartPlatformRollout(name, opts, t.GetUserName())
+	if _, ok := err.(app.InvalidPlatformError); ok {
+		return &errors.HTTP{Code: http.StatusNotFound, Message: "Platform not found"}
+	}
+	if err == app.ErrPlatformRolloutInProgress {
+		return &errors.HTTP{Code: http.StatusConflict, Message: err.Error()}
+	}
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(rollout)
+}
+
+func platformRolloutInfo(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	name := r.URL.Query().Get(":name")
+	rollout, err := app.GetPlatformRollout(name)
+	if err == app.ErrPlatformRolloutNotFound {
+		return &errors.HTTP{Code: http.StatusNotFound, Message: err.Error()}
+	}
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(rollout)
+}
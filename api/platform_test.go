@@ -5,10 +5,12 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"time"
 
 	"github.com/tsuru/tsuru/app"
 	"github.com/tsuru/tsuru/provision/provisiontest"
@@ -75,3 +77,203 @@ func (p *PlatformSuite) TestPlatformRemove(c *check.C) {
 	err = platformRemove(recorder, request, nil)
 	c.Assert(err, check.IsNil)
 }
+
+func (s *S) TestPlatformRolloutStart(c *check.C) {
+	err := s.conn.Platforms().Insert(app.Platform{Name: "rollplat"})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Platforms().RemoveId("rollplat")
+	defer s.conn.PlatformRollouts().RemoveId("rollplat")
+	body := strings.NewReader("batch-percent=50&max-failure-percent=0")
+	request, err := http.NewRequest("POST", "/platforms/rollplat/rollout", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/json")
+	var rollout app.PlatformRollout
+	err = json.NewDecoder(recorder.Body).Decode(&rollout)
+	c.Assert(err, check.IsNil)
+	c.Assert(rollout.Platform, check.Equals, "rollplat")
+	c.Assert(rollout.Status, check.Equals, app.RolloutRunning)
+	c.Assert(rollout.BatchPercent, check.Equals, 50)
+	c.Assert(rollout.MaxFailurePercent, check.Equals, 0)
+	c.Assert(rollout.User, check.Equals, s.adminuser.Email)
+}
+
+func (s *S) TestPlatformRolloutStartInvalidPercent(c *check.C) {
+	body := strings.NewReader("batch-percent=150")
+	request, err := http.NewRequest("POST", "/platforms/python/rollout", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, "Invalid batch-percent: must be a percentage between 0 and 100\n")
+}
+
+func (s *S) TestPlatformRolloutStartPlatformNotFound(c *check.C) {
+	request, err := http.NewRequest("POST", "/platforms/unknown/rollout", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+	c.Assert(recorder.Body.String(), check.Equals, "Platform not found\n")
+}
+
+func (s *S) TestPlatformRolloutStartInProgress(c *check.C) {
+	err := s.conn.PlatformRollouts().Insert(app.PlatformRollout{Platform: "zend", Status: app.RolloutRunning, UpdatedAt: time.Now()})
+	c.Assert(err, check.IsNil)
+	defer s.conn.PlatformRollouts().RemoveId("zend")
+	request, err := http.NewRequest("POST", "/platforms/zend/rollout", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusConflict)
+	c.Assert(recorder.Body.String(), check.Equals, app.ErrPlatformRolloutInProgress.Error()+"\n")
+}
+
+func (s *S) TestPlatformRolloutInfo(c *check.C) {
+	expected := app.PlatformRollout{
+		Platform:  "python",
+		Status:    app.RolloutPaused,
+		Reason:    "50% of the rebuilds failed, the maximum allowed is 10%",
+		Total:     3,
+		Pending:   []string{"app3"},
+		Succeeded: []string{"app1"},
+		Failed:    []app.RolloutFailure{{App: "app2", Error: "build failed"}},
+	}
+	err := s.conn.PlatformRollouts().Insert(expected)
+	c.Assert(err, check.IsNil)
+	defer s.conn.PlatformRollouts().RemoveId("python")
+	request, err := http.NewRequest("GET", "/platforms/python/rollout", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var rollout app.PlatformRollout
+	err = json.NewDecoder(recorder.Body).Decode(&rollout)
+	c.Assert(err, check.IsNil)
+	c.Assert(rollout.Status, check.Equals, expected.Status)
+	c.Assert(rollout.Reason, check.Equals, expected.Reason)
+	c.Assert(rollout.Pending, check.DeepEquals, expected.Pending)
+	c.Assert(rollout.Succeeded, check.DeepEquals, expected.Succeeded)
+	c.Assert(rollout.Failed, check.DeepEquals, expected.Failed)
+}
+
+func (s *S) TestPlatformRolloutInfoNotFound(c *check.C) {
+	request, err := http.NewRequest("GET", "/platforms/python/rollout", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestPlatformRollback(c *check.C) {
+	err := s.conn.Platforms().Insert(app.Platform{
+		Name:     "rollplat",
+		Current:  "v2",
+		Versions: []app.PlatformVersion{{Version: "v1"}, {Version: "v2"}},
+	})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Platforms().RemoveId("rollplat")
+	request, err := http.NewRequest("POST", "/platforms/rollplat/rollback", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var platform app.Platform
+	err = s.conn.Platforms().FindId("rollplat").One(&platform)
+	c.Assert(err, check.IsNil)
+	c.Assert(platform.Current, check.Equals, "v1")
+}
+
+func (s *S) TestPlatformRollbackInvalidVersion(c *check.C) {
+	err := s.conn.Platforms().Insert(app.Platform{
+		Name:     "rollplat",
+		Current:  "v1",
+		Versions: []app.PlatformVersion{{Version: "v1"}},
+	})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Platforms().RemoveId("rollplat")
+	body := strings.NewReader("version=v5")
+	request, err := http.NewRequest("POST", "/platforms/rollplat/rollback", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, "Version \"v5\" not found for platform rollplat.\n")
+}
+
+func (s *S) TestPlatformSetState(c *check.C) {
+	err := s.conn.Platforms().Insert(app.Platform{Name: "stateplat"})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Platforms().RemoveId("stateplat")
+	body := strings.NewReader("state=deprecated")
+	request, err := http.NewRequest("POST", "/platforms/stateplat/state", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var platform app.Platform
+	err = s.conn.Platforms().FindId("stateplat").One(&platform)
+	c.Assert(err, check.IsNil)
+	c.Assert(platform.State, check.Equals, app.PlatformDeprecated)
+}
+
+func (s *S) TestPlatformSetStateInvalidState(c *check.C) {
+	body := strings.NewReader("state=removed")
+	request, err := http.NewRequest("POST", "/platforms/zend/state", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, "Invalid state \"removed\": must be one of enabled, deprecated or disabled.\n")
+}
+
+func (s *S) TestPlatformSetStatePlatformNotFound(c *check.C) {
+	body := strings.NewReader("state=disabled")
+	request, err := http.NewRequest("POST", "/platforms/unknown/state", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestPlatformSetStateNonAdmin(c *check.C) {
+	body := strings.NewReader("state=disabled")
+	request, err := http.NewRequest("POST", "/platforms/zend/state", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	server := RunServer(true)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+}
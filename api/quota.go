@@ -12,6 +12,9 @@ import (
 	"github.com/tsuru/tsuru/app"
 	"github.com/tsuru/tsuru/auth"
 	"github.com/tsuru/tsuru/errors"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/quota"
+	"gopkg.in/mgo.v2/bson"
 )
 
 func getUserQuota(w http.ResponseWriter, r *http.Request, t auth.Token) error {
@@ -77,3 +80,167 @@ func changeAppQuota(w http.ResponseWriter, r *http.Request, t auth.Token) error
 	}
 	return app.ChangeQuota(a, limit)
 }
+
+func getTeamQuota(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	user, err := t.User()
+	if err != nil {
+		return err
+	}
+	team, err := auth.GetTeam(r.URL.Query().Get(":name"))
+	if err == auth.ErrTeamNotFound {
+		return &errors.HTTP{Code: http.StatusNotFound, Message: "Team not found"}
+	} else if err != nil {
+		return err
+	}
+	if !team.ContainsUser(user) && !auth.CheckTeamsPermission(user, auth.PermTeamManage, []string{team.Name}) {
+		return &errors.HTTP{Code: http.StatusForbidden, Message: "User is not member of this team"}
+	}
+	appQuota, unitQuota, err := auth.TeamQuotas(team)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]quota.Quota{"apps": appQuota, "units": unitQuota})
+}
+
+// changeTeamQuota changes the limits of apps and units of a team. Limits that
+// are not present in the request are kept unchanged.
+func changeTeamQuota(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	team, err := auth.GetTeam(r.URL.Query().Get(":name"))
+	if err == auth.ErrTeamNotFound {
+		return &errors.HTTP{Code: http.StatusNotFound, Message: "Team not found"}
+	} else if err != nil {
+		return err
+	}
+	appQuota, unitQuota, err := auth.TeamQuotas(team)
+	if err != nil {
+		return err
+	}
+	apps, units := appQuota.Limit, unitQuota.Limit
+	if value := r.FormValue("apps"); value != "" {
+		apps, err = strconv.Atoi(value)
+		if err != nil {
+			return &errors.HTTP{Code: http.StatusBadRequest, Message: "Invalid limit of apps"}
+		}
+	}
+	if value := r.FormValue("units"); value != "" {
+		units, err = strconv.Atoi(value)
+		if err != nil {
+			return &errors.HTTP{Code: http.StatusBadRequest, Message: "Invalid limit of units"}
+		}
+	}
+	return auth.ChangeTeamQuota(team, apps, units)
+}
+
+func getTeamResourceQuota(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	user, err := t.User()
+	if err != nil {
+		return err
+	}
+	team, err := auth.GetTeam(r.URL.Query().Get(":name"))
+	if err == auth.ErrTeamNotFound {
+		return &errors.HTTP{Code: http.StatusNotFound, Message: "Team not found"}
+	} else if err != nil {
+		return err
+	}
+	if !team.ContainsUser(user) && !auth.CheckTeamsPermission(user, auth.PermTeamManage, []string{team.Name}) {
+		return &errors.HTTP{Code: http.StatusForbidden, Message: "User is not member of this team"}
+	}
+	return writeResourceUsage(w, app.ResourceQuotaTeam, team.Name)
+}
+
+func changeTeamResourceQuota(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	team, err := auth.GetTeam(r.URL.Query().Get(":name"))
+	if err == auth.ErrTeamNotFound {
+		return &errors.HTTP{Code: http.StatusNotFound, Message: "Team not found"}
+	} else if err != nil {
+		return err
+	}
+	return changeResourceQuota(r, app.ResourceQuotaTeam, team.Name)
+}
+
+// getPoolResourceQuota returns the resource quota of a pool to members of its
+// teams and to pool managers. Pools without teams are used by every team, so
+// any user can get their quota.
+func getPoolResourceQuota(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	user, err := t.User()
+	if err != nil {
+		return err
+	}
+	pool, err := getPool(r.URL.Query().Get(":name"))
+	if err != nil {
+		return err
+	}
+	if len(pool.Teams) > 0 && !auth.CheckPermission(user, auth.PermPoolManage, auth.PermissionContext{Type: auth.CtxPool, Value: pool.Name}) {
+		teams, err := user.Teams()
+		if err != nil {
+			return err
+		}
+		if !poolHasTeam(pool, teams) {
+			return &errors.HTTP{Code: http.StatusForbidden, Message: "User has no access to this pool"}
+		}
+	}
+	return writeResourceUsage(w, app.ResourceQuotaPool, pool.Name)
+}
+
+func changePoolResourceQuota(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	pool, err := getPool(r.URL.Query().Get(":name"))
+	if err != nil {
+		return err
+	}
+	return changeResourceQuota(r, app.ResourceQuotaPool, pool.Name)
+}
+
+func getPool(name string) (*provision.Pool, error) {
+	pools, err := provision.ListPools(bson.M{"_id": name})
+	if err != nil {
+		return nil, err
+	}
+	if len(pools) == 0 {
+		return nil, &errors.HTTP{Code: http.StatusNotFound, Message: "Pool not found"}
+	}
+	return &pools[0], nil
+}
+
+func poolHasTeam(pool *provision.Pool, teams []auth.Team) bool {
+	for _, team := range teams {
+		for _, name := range pool.Teams {
+			if team.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeResourceUsage(w http.ResponseWriter, kind, name string) error {
+	usage, err := app.GetResourceUsage(kind, name)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(usage)
+}
+
+// changeResourceQuota changes the limits of memory and cpu shares of a team
+// or pool. Limits that are not present in the request are kept unchanged.
+func changeResourceQuota(r *http.Request, kind, name string) error {
+	current, err := app.GetResourceQuota(kind, name)
+	if err != nil {
+		return err
+	}
+	memory, cpushare := current.Memory, current.CpuShare
+	if value := r.FormValue("memory"); value != "" {
+		memory, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return &errors.HTTP{Code: http.StatusBadRequest, Message: "Invalid memory limit"}
+		}
+	}
+	if value := r.FormValue("cpushare"); value != "" {
+		cpushare, err = strconv.Atoi(value)
+		if err != nil {
+			return &errors.HTTP{Code: http.StatusBadRequest, Message: "Invalid cpushare limit"}
+		}
+	}
+	return app.SetResourceQuota(kind, name, memory, cpushare)
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/tsuru/tsuru/auth"
 	"github.com/tsuru/tsuru/db"
 	"github.com/tsuru/tsuru/db/dbtest"
+	"github.com/tsuru/tsuru/provision"
 	"github.com/tsuru/tsuru/quota"
 	"github.com/tsuru/tsuru/repository/repositorytest"
 	"gopkg.in/check.v1"
@@ -341,3 +342,340 @@ func (s *QuotaSuite) TestChangeAppQuotaAppNotFound(c *check.C) {
 	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
 	c.Assert(recorder.Body.String(), check.Equals, app.ErrAppNotFound.Error()+"\n")
 }
+
+func (s *QuotaSuite) TestGetTeamResourceQuota(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	a := app.App{
+		Name:      "shangrila",
+		TeamOwner: s.team.Name,
+		Plan:      app.Plan{Name: "small", Memory: 512, CpuShare: 100},
+		Quota:     quota.Quota{Limit: -1, InUse: 2},
+	}
+	err = conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer conn.Apps().Remove(bson.M{"name": a.Name})
+	err = app.SetResourceQuota(app.ResourceQuotaTeam, s.team.Name, 4096, -1)
+	c.Assert(err, check.IsNil)
+	defer conn.ResourceQuotas().RemoveAll(nil)
+	request, _ := http.NewRequest("GET", "/teams/superteam/resource-quota", nil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/json")
+	var usage app.ResourceUsage
+	err = json.NewDecoder(recorder.Body).Decode(&usage)
+	c.Assert(err, check.IsNil)
+	c.Assert(usage, check.DeepEquals, app.ResourceUsage{
+		ResourceQuota: app.ResourceQuota{Kind: "team", Name: "superteam", Memory: 4096, CpuShare: -1},
+		MemoryInUse:   1024,
+		CpuShareInUse: 200,
+	})
+}
+
+func (s *QuotaSuite) TestGetTeamResourceQuotaNotMember(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	user := &auth.User{Email: "radio@gaga.com", Password: "qwe123"}
+	_, err = nativeScheme.Create(user)
+	c.Assert(err, check.IsNil)
+	defer conn.Users().Remove(bson.M{"email": user.Email})
+	token, err := nativeScheme.Login(map[string]string{"email": user.Email, "password": "qwe123"})
+	c.Assert(err, check.IsNil)
+	request, _ := http.NewRequest("GET", "/teams/superteam/resource-quota", nil)
+	request.Header.Set("Authorization", "bearer "+token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(recorder.Body.String(), check.Equals, "User is not member of this team\n")
+}
+
+func (s *QuotaSuite) TestGetTeamResourceQuotaTeamNotFound(c *check.C) {
+	request, _ := http.NewRequest("GET", "/teams/unknown/resource-quota", nil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+	c.Assert(recorder.Body.String(), check.Equals, "Team not found\n")
+}
+
+func (s *QuotaSuite) TestChangeTeamResourceQuota(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = app.SetResourceQuota(app.ResourceQuotaTeam, s.team.Name, 4096, 300)
+	c.Assert(err, check.IsNil)
+	defer conn.ResourceQuotas().RemoveAll(nil)
+	body := bytes.NewBufferString("memory=8192")
+	request, _ := http.NewRequest("POST", "/teams/superteam/resource-quota", body)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	q, err := app.GetResourceQuota(app.ResourceQuotaTeam, s.team.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(q.Memory, check.Equals, int64(8192))
+	c.Assert(q.CpuShare, check.Equals, 300)
+}
+
+func (s *QuotaSuite) TestChangeTeamResourceQuotaInvalidValue(c *check.C) {
+	body := bytes.NewBufferString("cpushare=lots")
+	request, _ := http.NewRequest("POST", "/teams/superteam/resource-quota", body)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, "Invalid cpushare limit\n")
+}
+
+func (s *QuotaSuite) TestGetPoolResourceQuota(c *check.C) {
+	err := provision.AddPool("pool1")
+	c.Assert(err, check.IsNil)
+	defer provision.RemovePool("pool1")
+	request, _ := http.NewRequest("GET", "/pools/pool1/resource-quota", nil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var usage app.ResourceUsage
+	err = json.NewDecoder(recorder.Body).Decode(&usage)
+	c.Assert(err, check.IsNil)
+	c.Assert(usage, check.DeepEquals, app.ResourceUsage{
+		ResourceQuota: app.ResourceQuota{Kind: "pool", Name: "pool1", Memory: -1, CpuShare: -1},
+	})
+}
+
+func (s *QuotaSuite) TestGetPoolResourceQuotaTeamMember(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	user := &auth.User{Email: "radio@gaga.com", Password: "qwe123"}
+	_, err = nativeScheme.Create(user)
+	c.Assert(err, check.IsNil)
+	defer conn.Users().Remove(bson.M{"email": user.Email})
+	team := auth.Team{Name: "gagateam", Users: []string{user.Email}}
+	err = conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer conn.Teams().RemoveId(team.Name)
+	token, err := nativeScheme.Login(map[string]string{"email": user.Email, "password": "qwe123"})
+	c.Assert(err, check.IsNil)
+	err = provision.AddPool("pool1")
+	c.Assert(err, check.IsNil)
+	defer provision.RemovePool("pool1")
+	err = provision.AddTeamsToPool("pool1", []string{team.Name})
+	c.Assert(err, check.IsNil)
+	request, _ := http.NewRequest("GET", "/pools/pool1/resource-quota", nil)
+	request.Header.Set("Authorization", "bearer "+token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+}
+
+func (s *QuotaSuite) TestGetPoolResourceQuotaPoolWithoutTeams(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	user := &auth.User{Email: "radio@gaga.com", Password: "qwe123"}
+	_, err = nativeScheme.Create(user)
+	c.Assert(err, check.IsNil)
+	defer conn.Users().Remove(bson.M{"email": user.Email})
+	token, err := nativeScheme.Login(map[string]string{"email": user.Email, "password": "qwe123"})
+	c.Assert(err, check.IsNil)
+	err = provision.AddPool("pool1")
+	c.Assert(err, check.IsNil)
+	defer provision.RemovePool("pool1")
+	request, _ := http.NewRequest("GET", "/pools/pool1/resource-quota", nil)
+	request.Header.Set("Authorization", "bearer "+token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+}
+
+func (s *QuotaSuite) TestGetPoolResourceQuotaNoAccess(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	user := &auth.User{Email: "radio@gaga.com", Password: "qwe123"}
+	_, err = nativeScheme.Create(user)
+	c.Assert(err, check.IsNil)
+	defer conn.Users().Remove(bson.M{"email": user.Email})
+	token, err := nativeScheme.Login(map[string]string{"email": user.Email, "password": "qwe123"})
+	c.Assert(err, check.IsNil)
+	err = provision.AddPool("pool1")
+	c.Assert(err, check.IsNil)
+	defer provision.RemovePool("pool1")
+	err = provision.AddTeamsToPool("pool1", []string{s.team.Name})
+	c.Assert(err, check.IsNil)
+	request, _ := http.NewRequest("GET", "/pools/pool1/resource-quota", nil)
+	request.Header.Set("Authorization", "bearer "+token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(recorder.Body.String(), check.Equals, "User has no access to this pool\n")
+}
+
+func (s *QuotaSuite) TestGetPoolResourceQuotaPoolNotFound(c *check.C) {
+	request, _ := http.NewRequest("GET", "/pools/unknown/resource-quota", nil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+	c.Assert(recorder.Body.String(), check.Equals, "Pool not found\n")
+}
+
+func (s *QuotaSuite) TestChangePoolResourceQuota(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = provision.AddPool("pool1")
+	c.Assert(err, check.IsNil)
+	defer provision.RemovePool("pool1")
+	defer conn.ResourceQuotas().RemoveAll(nil)
+	body := bytes.NewBufferString("memory=8192&cpushare=500")
+	request, _ := http.NewRequest("POST", "/pools/pool1/resource-quota", body)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	q, err := app.GetResourceQuota(app.ResourceQuotaPool, "pool1")
+	c.Assert(err, check.IsNil)
+	c.Assert(*q, check.DeepEquals, app.ResourceQuota{Kind: "pool", Name: "pool1", Memory: 8192, CpuShare: 500})
+}
+
+func (s *QuotaSuite) TestChangePoolResourceQuotaPoolManager(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	user := &auth.User{Email: "radio@gaga.com", Password: "qwe123"}
+	_, err = nativeScheme.Create(user)
+	c.Assert(err, check.IsNil)
+	defer conn.Users().Remove(bson.M{"email": user.Email})
+	_, err = auth.CreateRole("pool-manager", auth.CtxPool, auth.PermPoolManage)
+	c.Assert(err, check.IsNil)
+	defer conn.Roles().RemoveId("pool-manager")
+	err = user.AddRole("pool-manager", "pool1")
+	c.Assert(err, check.IsNil)
+	token, err := nativeScheme.Login(map[string]string{"email": user.Email, "password": "qwe123"})
+	c.Assert(err, check.IsNil)
+	err = provision.AddPool("pool1")
+	c.Assert(err, check.IsNil)
+	defer provision.RemovePool("pool1")
+	defer conn.ResourceQuotas().RemoveAll(nil)
+	body := bytes.NewBufferString("memory=8192")
+	request, _ := http.NewRequest("POST", "/pools/pool1/resource-quota", body)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(recorder.Body.String(), check.Equals, "You must be an admin\n")
+	q, err := app.GetResourceQuota(app.ResourceQuotaPool, "pool1")
+	c.Assert(err, check.IsNil)
+	c.Assert(q.Memory, check.Equals, int64(-1))
+}
+
+func (s *QuotaSuite) TestGetTeamQuota(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Teams().UpdateId(s.team.Name, bson.M{"$set": bson.M{"appquota": quota.Quota{Limit: 4, InUse: 1}}})
+	c.Assert(err, check.IsNil)
+	defer conn.Teams().UpdateId(s.team.Name, bson.M{"$unset": bson.M{"appquota": "", "unitquota": ""}})
+	a := app.App{Name: "shangrila", TeamOwner: s.team.Name, Quota: quota.Quota{Limit: -1, InUse: 3}}
+	err = conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer conn.Apps().Remove(bson.M{"name": a.Name})
+	request, _ := http.NewRequest("GET", "/teams/superteam/quota", nil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/json")
+	var result map[string]quota.Quota
+	err = json.NewDecoder(recorder.Body).Decode(&result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, map[string]quota.Quota{
+		"apps":  {Limit: 4, InUse: 1},
+		"units": {Limit: -1, InUse: 3},
+	})
+}
+
+func (s *QuotaSuite) TestGetTeamQuotaTeamNotFound(c *check.C) {
+	request, _ := http.NewRequest("GET", "/teams/unknown/quota", nil)
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+	c.Assert(recorder.Body.String(), check.Equals, "Team not found\n")
+}
+
+func (s *QuotaSuite) TestChangeTeamQuota(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Teams().UpdateId(s.team.Name, bson.M{"$unset": bson.M{"appquota": "", "unitquota": ""}})
+	body := bytes.NewBufferString("apps=10&units=40")
+	request, _ := http.NewRequest("POST", "/teams/superteam/quota", body)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	team, err := auth.GetTeam(s.team.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(team.AppQuota, check.DeepEquals, &quota.Quota{Limit: 10})
+	c.Assert(team.UnitQuota, check.DeepEquals, &quota.Quota{Limit: 40})
+}
+
+func (s *QuotaSuite) TestChangeTeamQuotaInvalidLimitValue(c *check.C) {
+	body := bytes.NewBufferString("apps=many")
+	request, _ := http.NewRequest("POST", "/teams/superteam/quota", body)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, "Invalid limit of apps\n")
+}
+
+func (s *QuotaSuite) TestChangeTeamQuotaRequiresAdmin(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	user := &auth.User{Email: "radio@gaga.com", Password: "qwe123"}
+	_, err = nativeScheme.Create(user)
+	c.Assert(err, check.IsNil)
+	defer conn.Users().Remove(bson.M{"email": user.Email})
+	token, err := nativeScheme.Login(map[string]string{"email": user.Email, "password": "qwe123"})
+	c.Assert(err, check.IsNil)
+	body := bytes.NewBufferString("apps=10")
+	request, _ := http.NewRequest("POST", "/teams/superteam/quota", body)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+token.GetValue())
+	recorder := httptest.NewRecorder()
+	handler := RunServer(true)
+	handler.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, adminRequiredErr.Code)
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/tsuru/tsuru/auth"
+	"github.com/tsuru/tsuru/errors"
+	"github.com/tsuru/tsuru/rec"
+)
+
+func roleErrorToHTTP(err error) error {
+	if e, ok := err.(*errors.ValidationError); ok {
+		return &errors.HTTP{Code: http.StatusBadRequest, Message: e.Message}
+	}
+	switch err {
+	case auth.ErrRoleNotFound, auth.ErrUserNotFound:
+		return &errors.HTTP{Code: http.StatusNotFound, Message: err.Error()}
+	case auth.ErrRoleAlreadyExists:
+		return &errors.HTTP{Code: http.StatusConflict, Message: err.Error()}
+	case auth.ErrInvalidPermission, auth.ErrInvalidContextType, auth.ErrInvalidRoleContext:
+		return &errors.HTTP{Code: http.StatusBadRequest, Message: err.Error()}
+	}
+	return err
+}
+
+func listRoles(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	roles, err := auth.ListRoles()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(roles)
+}
+
+func createRole(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	r.ParseForm()
+	name := r.FormValue("name")
+	if name == "" {
+		return &errors.HTTP{Code: http.StatusBadRequest, Message: "You must provide the role name."}
+	}
+	contextType := r.FormValue("context")
+	permissions := r.Form["permission"]
+	rec.Log(t.GetUserName(), "create-role", "name="+name, "context="+contextType, permissions)
+	_, err := auth.CreateRole(name, contextType, permissions...)
+	if err != nil {
+		return roleErrorToHTTP(err)
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func removeRole(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	name := r.URL.Query().Get(":name")
+	rec.Log(t.GetUserName(), "remove-role", "name="+name)
+	return roleErrorToHTTP(auth.RemoveRole(name))
+}
+
+func addPermissionsToRole(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	r.ParseForm()
+	name := r.URL.Query().Get(":name")
+	permissions := r.Form["permission"]
+	if len(permissions) == 0 {
+		return &errors.HTTP{Code: http.StatusBadRequest, Message: "You must provide at least one permission."}
+	}
+	rec.Log(t.GetUserName(), "role-permission-add", "name="+name, permissions)
+	role, err := auth.GetRole(name)
+	if err != nil {
+		return roleErrorToHTTP(err)
+	}
+	return roleErrorToHTTP(role.AddPermissions(permissions...))
+}
+
+func assignRole(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	name := r.URL.Query().Get(":name")
+	email := r.FormValue("email")
+	contextValue := r.FormValue("context")
+	rec.Log(t.GetUserName(), "role-assign", "name="+name, "email="+email, "context="+contextValue)
+	user, err := auth.GetUserByEmail(email)
+	if err != nil {
+		return roleErrorToHTTP(err)
+	}
+	return roleErrorToHTTP(user.AddRole(name, contextValue))
+}
+
+func dissociateRole(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	name := r.URL.Query().Get(":name")
+	email := r.URL.Query().Get(":email")
+	contextValue := r.URL.Query().Get("context")
+	rec.Log(t.GetUserName(), "role-dissociate", "name="+name, "email="+email, "context="+contextValue)
+	user, err := auth.GetUserByEmail(email)
+	if err != nil {
+		return roleErrorToHTTP(err)
+	}
+	return roleErrorToHTTP(user.RemoveRole(name, contextValue))
+}
@@ -0,0 +1,216 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/tsuru/tsuru/app"
+	"github.com/tsuru/tsuru/auth"
+	"github.com/tsuru/tsuru/quota"
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) TestCreateRole(c *check.C) {
+	body := strings.NewReader("name=deployer&context=app&permission=app.deploy&permission=app.env.read")
+	request, err := http.NewRequest("POST", "/roles", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	m := RunServer(true)
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	defer s.conn.Roles().RemoveId("deployer")
+	role, err := auth.GetRole("deployer")
+	c.Assert(err, check.IsNil)
+	c.Assert(role.ContextType, check.Equals, "app")
+	c.Assert(role.Permissions, check.DeepEquals, []string{"app.deploy", "app.env.read"})
+}
+
+func (s *S) TestCreateRoleInvalidPermission(c *check.C) {
+	body := strings.NewReader("name=deployer&context=app&permission=app.destroy")
+	request, err := http.NewRequest("POST", "/roles", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	m := RunServer(true)
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, auth.ErrInvalidPermission.Error()+"\n")
+}
+
+func (s *S) TestCreateRoleAlreadyExists(c *check.C) {
+	_, err := auth.CreateRole("deployer", auth.CtxApp, auth.PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("deployer")
+	body := strings.NewReader("name=deployer&context=team")
+	request, err := http.NewRequest("POST", "/roles", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	m := RunServer(true)
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusConflict)
+}
+
+func (s *S) TestCreateRoleRequiresAdmin(c *check.C) {
+	body := strings.NewReader("name=deployer&context=app")
+	request, err := http.NewRequest("POST", "/roles", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.token.GetValue())
+	recorder := httptest.NewRecorder()
+	m := RunServer(true)
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+}
+
+func (s *S) TestListRoles(c *check.C) {
+	_, err := auth.CreateRole("deployer", auth.CtxApp, auth.PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("deployer")
+	request, err := http.NewRequest("GET", "/roles", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	m := RunServer(true)
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/json")
+	var roles []auth.Role
+	err = json.NewDecoder(recorder.Body).Decode(&roles)
+	c.Assert(err, check.IsNil)
+	c.Assert(roles, check.DeepEquals, []auth.Role{{Name: "deployer", ContextType: "app", Permissions: []string{"app.deploy"}}})
+}
+
+func (s *S) TestRemoveRole(c *check.C) {
+	_, err := auth.CreateRole("deployer", auth.CtxApp, auth.PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("DELETE", "/roles/deployer", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	m := RunServer(true)
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	_, err = auth.GetRole("deployer")
+	c.Assert(err, check.Equals, auth.ErrRoleNotFound)
+}
+
+func (s *S) TestRemoveRoleNotFound(c *check.C) {
+	request, err := http.NewRequest("DELETE", "/roles/unknown", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	m := RunServer(true)
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestAddPermissionsToRole(c *check.C) {
+	_, err := auth.CreateRole("deployer", auth.CtxApp, auth.PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("deployer")
+	body := strings.NewReader("permission=app.env.read&permission=app.env.set")
+	request, err := http.NewRequest("POST", "/roles/deployer/permissions", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	m := RunServer(true)
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	role, err := auth.GetRole("deployer")
+	c.Assert(err, check.IsNil)
+	c.Assert(role.Permissions, check.DeepEquals, []string{"app.deploy", "app.env.read", "app.env.set"})
+}
+
+func (s *S) TestAssignAndDissociateRole(c *check.C) {
+	_, err := auth.CreateRole("deployer", auth.CtxApp, auth.PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("deployer")
+	body := strings.NewReader("email=" + s.user.Email + "&context=myapp")
+	request, err := http.NewRequest("POST", "/roles/deployer/user", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	m := RunServer(true)
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	user, err := auth.GetUserByEmail(s.user.Email)
+	c.Assert(err, check.IsNil)
+	c.Assert(user.Roles, check.DeepEquals, []auth.RoleInstance{{Name: "deployer", ContextValue: "myapp"}})
+	url := fmt.Sprintf("/roles/deployer/user/%s?context=myapp", s.user.Email)
+	request, err = http.NewRequest("DELETE", url, nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder = httptest.NewRecorder()
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	user, err = auth.GetUserByEmail(s.user.Email)
+	c.Assert(err, check.IsNil)
+	c.Assert(user.Roles, check.HasLen, 0)
+}
+
+func (s *S) TestAssignRoleInvalidContext(c *check.C) {
+	_, err := auth.CreateRole("deployer", auth.CtxApp, auth.PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("deployer")
+	body := strings.NewReader("email=" + s.user.Email)
+	request, err := http.NewRequest("POST", "/roles/deployer/user", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "bearer "+s.admintoken.GetValue())
+	recorder := httptest.NewRecorder()
+	m := RunServer(true)
+	m.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestSetEnvWithRole(c *check.C) {
+	a := app.App{Name: "black-dog", Platform: "zend", TeamOwner: s.adminteam.Name}
+	err := app.CreateApp(&a, s.adminuser)
+	c.Assert(err, check.IsNil)
+	defer s.deleteApp(&a)
+	user := &auth.User{Email: "envsetter@tsuru.io", Password: "123456", Quota: quota.Unlimited}
+	_, err = nativeScheme.Create(user)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Users().Remove(bson.M{"email": user.Email})
+	token, err := nativeScheme.Login(map[string]string{"email": user.Email, "password": "123456"})
+	c.Assert(err, check.IsNil)
+	url := fmt.Sprintf("/apps/%s/env?:app=%s", a.Name, a.Name)
+	request, err := http.NewRequest("POST", url, strings.NewReader(`{"DATABASE_HOST":"localhost"}`))
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = setEnv(recorder, request, token)
+	c.Assert(err, check.NotNil)
+	_, err = auth.CreateRole("env-setter", auth.CtxApp, auth.PermAppEnvSet)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("env-setter")
+	err = user.AddRole("env-setter", a.Name)
+	c.Assert(err, check.IsNil)
+	request, err = http.NewRequest("POST", url, strings.NewReader(`{"DATABASE_HOST":"localhost"}`))
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	err = setEnv(recorder, request, token)
+	c.Assert(err, check.IsNil)
+	dbApp, err := app.GetByName(a.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbApp.Env["DATABASE_HOST"].Value, check.Equals, "localhost")
+	request, err = http.NewRequest("GET", url, nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	err = getEnv(recorder, request, token)
+	c.Assert(err, check.NotNil)
+}
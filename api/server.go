@@ -13,13 +13,17 @@ import (
 	"github.com/tsuru/config"
 	"github.com/tsuru/tsuru/app"
 	"github.com/tsuru/tsuru/auth"
+	_ "github.com/tsuru/tsuru/auth/ldap"
 	_ "github.com/tsuru/tsuru/auth/native"
 	_ "github.com/tsuru/tsuru/auth/oauth"
+	_ "github.com/tsuru/tsuru/auth/oidc"
 	"github.com/tsuru/tsuru/db"
 	"github.com/tsuru/tsuru/hc"
 	"github.com/tsuru/tsuru/log"
+	"github.com/tsuru/tsuru/metering"
 	"github.com/tsuru/tsuru/provision"
 	"github.com/tsuru/tsuru/router"
+	"github.com/tsuru/tsuru/service"
 )
 
 const Version = "0.10.3"
@@ -91,7 +95,10 @@ func RunServer(dry bool) http.Handler {
 	m.Add("Get", "/services/instances", authorizationRequiredHandler(serviceInstances))
 	m.Add("Get", "/services/instances/{name}", authorizationRequiredHandler(serviceInstance))
 	m.Add("Delete", "/services/instances/{name}", authorizationRequiredHandler(removeServiceInstance))
-	m.Add("Post", "/services/instances", authorizationRequiredHandler(createServiceInstance))
+	m.Add("Post", "/services/instances", tokenScope(auth.PermServiceInstanceCreate, authorizationRequiredHandler(createServiceInstance)))
+	m.Add("Put", "/services/instances/{name}/plan", authorizationRequiredHandler(updateServiceInstancePlan))
+	m.Add("Put", "/services/instances/{name}/teams/{team}", authorizationRequiredHandler(grantServiceInstanceAccess))
+	m.Add("Delete", "/services/instances/{name}/teams/{team}", authorizationRequiredHandler(revokeServiceInstanceAccess))
 	m.Add("Put", "/services/instances/{instance}/{app}", authorizationRequiredHandler(bindServiceInstance))
 	m.Add("Delete", "/services/instances/{instance}/{app}", authorizationRequiredHandler(unbindServiceInstance))
 	m.Add("Get", "/services/instances/{instance}/status", authorizationRequiredHandler(serviceInstanceStatus))
@@ -120,12 +127,13 @@ func RunServer(dry bool) http.Handler {
 	m.Add("Post", "/apps/{app}/stop", authorizationRequiredHandler(stop))
 	m.Add("Get", "/apps/{appname}/quota", AdminRequiredHandler(getAppQuota))
 	m.Add("Post", "/apps/{appname}/quota", AdminRequiredHandler(changeAppQuota))
-	m.Add("Get", "/apps/{app}/env", authorizationRequiredHandler(getEnv))
-	m.Add("Post", "/apps/{app}/env", authorizationRequiredHandler(setEnv))
-	m.Add("Delete", "/apps/{app}/env", authorizationRequiredHandler(unsetEnv))
+	m.Add("Get", "/apps/{app}/env", tokenScope(auth.PermAppEnvRead, authorizationRequiredHandler(getEnv)))
+	m.Add("Post", "/apps/{app}/env", tokenScope(auth.PermAppEnvSet, authorizationRequiredHandler(setEnv)))
+	m.Add("Delete", "/apps/{app}/env", tokenScope(auth.PermAppEnvSet, authorizationRequiredHandler(unsetEnv)))
 	m.Add("Get", "/apps", authorizationRequiredHandler(appList))
 	m.Add("Post", "/apps", authorizationRequiredHandler(createApp))
 	m.Add("Post", "/apps/{app}/team-owner", authorizationRequiredHandler(setTeamOwner))
+	m.Add("Post", "/apps/{app}/platform-version", authorizationRequiredHandler(setPlatformVersion))
 	forceDeleteLockHandler := AdminRequiredHandler(forceDeleteLock)
 	m.Add("Delete", "/apps/{app}/lock", forceDeleteLockHandler)
 	m.Add("Put", "/apps/{app}/units", authorizationRequiredHandler(addUnits))
@@ -141,7 +149,7 @@ func RunServer(dry bool) http.Handler {
 	m.Add("Post", "/apps/{app}/log", logPostHandler)
 	saveCustomDataHandler := authorizationRequiredHandler(saveAppCustomData)
 	m.Add("Post", "/apps/{app}/customdata", saveCustomDataHandler)
-	m.Add("Post", "/apps/{appname}/deploy/rollback", authorizationRequiredHandler(deployRollback))
+	m.Add("Post", "/apps/{appname}/deploy/rollback", tokenScope(auth.PermAppDeploy, authorizationRequiredHandler(deployRollback)))
 	m.Add("Get", "/apps/{app}/shell", authorizationRequiredHandler(remoteShellHandler))
 
 	m.Add("Get", "/autoscale", authorizationRequiredHandler(autoScaleHistoryHandler))
@@ -151,20 +159,27 @@ func RunServer(dry bool) http.Handler {
 
 	m.Add("Get", "/deploys", authorizationRequiredHandler(deploysList))
 	m.Add("Get", "/deploys/{deploy}", authorizationRequiredHandler(deployInfo))
+	m.Add("Get", "/deploys/{deploy}/diff/{other}", authorizationRequiredHandler(deploysDiff))
 
 	m.Add("Get", "/platforms", authorizationRequiredHandler(platformList))
 	m.Add("Post", "/platforms", AdminRequiredHandler(platformAdd))
 	m.Add("Put", "/platforms/{name}", AdminRequiredHandler(platformUpdate))
 	m.Add("Delete", "/platforms/{name}", AdminRequiredHandler(platformRemove))
+	m.Add("Post", "/platforms/{name}/rollback", AdminRequiredHandler(platformRollback))
+	m.Add("Post", "/platforms/{name}/state", AdminRequiredHandler(platformSetState))
+	m.Add("Get", "/platforms/{name}/rollout", AdminRequiredHandler(platformRolloutInfo))
+	m.Add("Post", "/platforms/{name}/rollout", AdminRequiredHandler(platformRolloutStart))
 
 	// These handlers don't use :app on purpose. Using :app means that only
 	// the token generate for the given app is valid, but these handlers
 	// use a token generated for Gandalf.
 	m.Add("Get", "/apps/{appname}/available", authorizationRequiredHandler(appIsAvailable))
-	m.Add("Post", "/apps/{appname}/repository/clone", authorizationRequiredHandler(deploy))
-	m.Add("Post", "/apps/{appname}/deploy", authorizationRequiredHandler(deploy))
+	m.Add("Post", "/apps/{appname}/repository/clone", tokenScope(auth.PermAppDeploy, authorizationRequiredHandler(deploy)))
+	m.Add("Post", "/apps/{appname}/deploy", tokenScope(auth.PermAppDeploy, authorizationRequiredHandler(deploy)))
+	cancelDeployHandler := tokenScope(auth.PermAppDeploy, authorizationRequiredHandler(cancelDeploy))
+	m.Add("Delete", "/apps/{appname}/deploy", cancelDeployHandler)
 
-	m.Add("Get", "/users", AdminRequiredHandler(listUsers))
+	m.Add("Get", "/users", PermissionRequiredHandler(auth.PermUserManage, listUsers))
 	m.Add("Post", "/users", Handler(createUser))
 	m.Add("Get", "/users/info", authorizationRequiredHandler(userInfo))
 	m.Add("Get", "/auth/scheme", Handler(authScheme))
@@ -181,6 +196,13 @@ func RunServer(dry bool) http.Handler {
 	m.Add("Delete", "/users/keys", authorizationRequiredHandler(removeKeyFromUser))
 	m.Add("Get", "/users/api-key", authorizationRequiredHandler(showAPIToken))
 	m.Add("Post", "/users/api-key", authorizationRequiredHandler(regenerateAPIToken))
+	m.Add("Get", "/users/tokens", authorizationRequiredHandler(listAPITokens))
+	m.Add("Post", "/users/tokens", authorizationRequiredHandler(createAPIToken))
+	m.Add("Delete", "/users/tokens/{name}", authorizationRequiredHandler(revokeAPIToken))
+	m.Add("Post", "/users/2fa", authorizationRequiredHandler(startTwoFactorEnrollment))
+	m.Add("Post", "/users/2fa/confirm", authorizationRequiredHandler(confirmTwoFactorEnrollment))
+	m.Add("Post", "/users/2fa/recovery-codes", authorizationRequiredHandler(regenerateRecoveryCodes))
+	m.Add("Delete", "/users/2fa", authorizationRequiredHandler(disableTwoFactor))
 
 	m.Add("Delete", "/logs", AdminRequiredHandler(logRemove))
 
@@ -188,8 +210,13 @@ func RunServer(dry bool) http.Handler {
 	m.Add("Post", "/teams", authorizationRequiredHandler(createTeam))
 	m.Add("Get", "/teams/{name}", authorizationRequiredHandler(getTeam))
 	m.Add("Delete", "/teams/{name}", authorizationRequiredHandler(removeTeam))
+	m.Add("Get", "/teams/{name}/quota", authorizationRequiredHandler(getTeamQuota))
+	m.Add("Post", "/teams/{name}/quota", AdminRequiredHandler(changeTeamQuota))
+	m.Add("Get", "/teams/{name}/resource-quota", authorizationRequiredHandler(getTeamResourceQuota))
+	m.Add("Post", "/teams/{name}/resource-quota", AdminRequiredHandler(changeTeamResourceQuota))
 	m.Add("Put", "/teams/{team}/{user}", authorizationRequiredHandler(addUserToTeam))
 	m.Add("Delete", "/teams/{team}/{user}", authorizationRequiredHandler(removeUserFromTeam))
+	m.Add("Post", "/teams/{team}/{user}/level", authorizationRequiredHandler(setTeamUserLevel))
 
 	m.Add("Put", "/swap", authorizationRequiredHandler(swap))
 
@@ -206,14 +233,25 @@ func RunServer(dry bool) http.Handler {
 	m.Add("Delete", "/plans/{planname}", AdminRequiredHandler(removePlan))
 	m.Add("Get", "/plans/routers", AdminRequiredHandler(listRouters))
 
+	m.Add("Get", "/metering/report", AdminRequiredHandler(meteringReport))
+
 	m.Add("Get", "/debug/goroutines", AdminRequiredHandler(dumpGoroutines))
 
+	m.Add("Get", "/roles", AdminRequiredHandler(listRoles))
+	m.Add("Post", "/roles", AdminRequiredHandler(createRole))
+	m.Add("Delete", "/roles/{name}", AdminRequiredHandler(removeRole))
+	m.Add("Post", "/roles/{name}/permissions", AdminRequiredHandler(addPermissionsToRole))
+	m.Add("Post", "/roles/{name}/user", AdminRequiredHandler(assignRole))
+	m.Add("Delete", "/roles/{name}/user/{email}", AdminRequiredHandler(dissociateRole))
+
 	m.Add("Get", "/pools", authorizationRequiredHandler(listPoolsToUser))
-	m.Add("Get", "/pool", AdminRequiredHandler(listPoolHandler))
-	m.Add("Post", "/pool", AdminRequiredHandler(addPoolHandler))
-	m.Add("Delete", "/pool", AdminRequiredHandler(removePoolHandler))
-	m.Add("Post", "/pool/team", AdminRequiredHandler(addTeamToPoolHandler))
-	m.Add("Delete", "/pool/team", AdminRequiredHandler(removeTeamToPoolHandler))
+	m.Add("Get", "/pool", PermissionRequiredHandler(auth.PermPoolManage, listPoolHandler))
+	m.Add("Post", "/pool", PermissionRequiredHandler(auth.PermPoolManage, addPoolHandler))
+	m.Add("Delete", "/pool", PermissionRequiredHandler(auth.PermPoolManage, removePoolHandler))
+	m.Add("Post", "/pool/team", PermissionRequiredHandler(auth.PermPoolManage, addTeamToPoolHandler))
+	m.Add("Delete", "/pool/team", PermissionRequiredHandler(auth.PermPoolManage, removeTeamToPoolHandler))
+	m.Add("Get", "/pools/{name}/resource-quota", authorizationRequiredHandler(getPoolResourceQuota))
+	m.Add("Post", "/pools/{name}/resource-quota", AdminRequiredHandler(changePoolResourceQuota))
 
 	n := negroni.New()
 	n.Use(negroni.NewRecovery())
@@ -228,6 +266,7 @@ func RunServer(dry bool) http.Handler {
 		logPostHandler,
 		runHandler,
 		forceDeleteLockHandler,
+		cancelDeployHandler,
 		registerUnitHandler,
 		saveCustomDataHandler,
 		setUnitStatusHandler,
@@ -304,6 +343,17 @@ func RunServer(dry bool) http.Handler {
 			fatal(err)
 		}
 		app.StartAutoScale()
+		app.StartQuotaReconciler()
+		metering.StartCheckpoints()
+		service.StartPendingInstancesWatcher()
+		err = app.InitializeDeployQueue()
+		if err != nil {
+			fatal(err)
+		}
+		err = app.InitializePlatformRollouts()
+		if err != nil {
+			fatal(err)
+		}
 		tls, _ := config.GetBool("use-tls")
 		if tls {
 			certFile, err := config.GetString("tls:cert-file")
@@ -23,12 +23,19 @@ func createServiceInstance(w http.ResponseWriter, r *http.Request, t auth.Token)
 	if err != nil {
 		return err
 	}
-	var body map[string]string
+	var body struct {
+		ServiceName string `json:"service_name"`
+		Name        string
+		Plan        string
+		Owner       string
+		Tags        []string
+		Parameters  map[string]string
+	}
 	err = json.Unmarshal(b, &body)
 	if err != nil {
 		return err
 	}
-	serviceName := body["service_name"]
+	serviceName := body.ServiceName
 	user, err := t.User()
 	if err != nil {
 		return err
@@ -39,9 +46,11 @@ func createServiceInstance(w http.ResponseWriter, r *http.Request, t auth.Token)
 		return &errors.HTTP{Code: http.StatusNotFound, Message: err.Error()}
 	}
 	instance := service.ServiceInstance{
-		Name:      body["name"],
-		PlanName:  body["plan"],
-		TeamOwner: body["owner"],
+		Name:       body.Name,
+		PlanName:   body.Plan,
+		TeamOwner:  body.Owner,
+		Tags:       body.Tags,
+		Parameters: body.Parameters,
 	}
 	return service.CreateServiceInstance(instance, &srv, user)
 }
@@ -61,6 +70,10 @@ func removeServiceInstance(w http.ResponseWriter, r *http.Request, t auth.Token)
 	if err != nil {
 		return err
 	}
+	if si.Operation == service.OperationDeprovision {
+		w.Write([]byte("service instance is being removed by the service"))
+		return nil
+	}
 	w.Write([]byte("service instance successfuly removed"))
 	return nil
 }
@@ -71,9 +84,10 @@ func serviceInstances(w http.ResponseWriter, r *http.Request, t auth.Token) erro
 		return err
 	}
 	appName := r.URL.Query().Get("app")
+	tags := r.URL.Query()["tag"]
 	rec.Log(u.Email, "list-service-instances", "app="+appName)
 	services, _ := service.GetServicesByTeamKindAndNoRestriction("teams", u)
-	sInstances, _ := service.GetServiceInstancesByServicesAndTeams(services, u, appName)
+	sInstances, _ := service.GetServiceInstancesByServicesAndTeams(services, u, appName, tags)
 	result := make([]service.ServiceModel, len(services))
 	for i, s := range services {
 		result[i].Service = s.Name
@@ -81,6 +95,12 @@ func serviceInstances(w http.ResponseWriter, r *http.Request, t auth.Token) erro
 		for _, si := range sInstances {
 			if si.ServiceName == s.Name {
 				result[i].Instances = append(result[i].Instances, si.Name)
+				if len(si.Tags) > 0 {
+					if result[i].InstanceTags == nil {
+						result[i].InstanceTags = make(map[string][]string)
+					}
+					result[i].InstanceTags[si.Name] = si.Tags
+				}
 			}
 		}
 	}
@@ -100,7 +120,7 @@ func serviceInstance(w http.ResponseWriter, r *http.Request, t auth.Token) error
 	if err != nil {
 		return err
 	}
-	instance, err := getServiceInstanceOrError(r.URL.Query().Get(":name"), u)
+	instance, err := getServiceInstanceForReadOrError(r.URL.Query().Get(":name"), u)
 	if err != nil {
 		return err
 	}
@@ -113,7 +133,7 @@ func serviceInstanceStatus(w http.ResponseWriter, r *http.Request, t auth.Token)
 		return err
 	}
 	siName := r.URL.Query().Get(":instance")
-	si, err := getServiceInstanceOrError(siName, u)
+	si, err := getServiceInstanceForReadOrError(siName, u)
 	if err != nil {
 		return err
 	}
@@ -131,6 +151,81 @@ func serviceInstanceStatus(w http.ResponseWriter, r *http.Request, t auth.Token)
 	return nil
 }
 
+func grantServiceInstanceAccess(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	u, err := t.User()
+	if err != nil {
+		return err
+	}
+	siName := r.URL.Query().Get(":name")
+	teamName := r.URL.Query().Get(":team")
+	rec.Log(u.Email, "grant-service-instance-access", "instance="+siName, "team="+teamName)
+	si, err := getOwnedServiceInstanceOrError(siName, u)
+	if err != nil {
+		return err
+	}
+	if _, err = auth.GetTeam(teamName); err != nil {
+		return &errors.HTTP{Code: http.StatusNotFound, Message: "Team not found"}
+	}
+	err = si.Grant(teamName)
+	switch err {
+	case service.ErrTeamAlreadyHasAccess:
+		return &errors.HTTP{Code: http.StatusConflict, Message: err.Error()}
+	case service.ErrTeamServiceRestricted:
+		return &errors.HTTP{Code: http.StatusForbidden, Message: err.Error()}
+	}
+	return err
+}
+
+func revokeServiceInstanceAccess(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	u, err := t.User()
+	if err != nil {
+		return err
+	}
+	siName := r.URL.Query().Get(":name")
+	teamName := r.URL.Query().Get(":team")
+	rec.Log(u.Email, "revoke-service-instance-access", "instance="+siName, "team="+teamName)
+	si, err := getOwnedServiceInstanceOrError(siName, u)
+	if err != nil {
+		return err
+	}
+	err = si.Revoke(teamName)
+	switch err {
+	case service.ErrTeamHasNoAccess:
+		return &errors.HTTP{Code: http.StatusNotFound, Message: err.Error()}
+	case service.ErrRevokeOwnerAccess:
+		return &errors.HTTP{Code: http.StatusForbidden, Message: err.Error()}
+	}
+	return err
+}
+
+func updateServiceInstancePlan(w http.ResponseWriter, r *http.Request, t auth.Token) error {
+	u, err := t.User()
+	if err != nil {
+		return err
+	}
+	var body map[string]string
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return &errors.HTTP{Code: http.StatusBadRequest, Message: "Invalid JSON in the request body."}
+	}
+	siName := r.URL.Query().Get(":name")
+	planName := body["plan"]
+	rec.Log(u.Email, "update-service-instance-plan", "instance="+siName, "plan="+planName)
+	if planName == "" {
+		return &errors.HTTP{Code: http.StatusBadRequest, Message: "You must provide the name of the plan."}
+	}
+	si, err := getOwnedServiceInstanceOrError(siName, u)
+	if err != nil {
+		return err
+	}
+	err = si.UpdatePlan(planName)
+	if err == service.ErrInvalidPlan {
+		msg := fmt.Sprintf("The plan %q does not exist in the service %q.", planName, si.ServiceName)
+		return &errors.HTTP{Code: http.StatusBadRequest, Message: msg}
+	}
+	return err
+}
+
 func serviceInfo(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	u, err := t.User()
 	if err != nil {
@@ -138,7 +233,7 @@ func serviceInfo(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	}
 	serviceName := r.URL.Query().Get(":name")
 	rec.Log(u.Email, "service-info", serviceName)
-	_, err = getServiceOrError(serviceName, u)
+	_, err = getServiceForReadOrError(serviceName, u)
 	if err != nil {
 		return err
 	}
@@ -173,7 +268,7 @@ func serviceDoc(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	}
 	sName := r.URL.Query().Get(":name")
 	rec.Log(u.Email, "service-doc", sName)
-	s, err := getServiceOrError(sName, u)
+	s, err := getServiceForReadOrError(sName, u)
 	if err != nil {
 		return err
 	}
@@ -181,7 +276,19 @@ func serviceDoc(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	return nil
 }
 
+// getServiceOrError returns the service with the given name, as long as it
+// isn't restricted or the user is at least a developer in one of its teams.
 func getServiceOrError(name string, u *auth.User) (service.Service, error) {
+	return getServiceWithAccess(name, u, auth.CheckUserAccess)
+}
+
+// getServiceForReadOrError works like getServiceOrError, but also allows
+// viewers of the teams of restricted services.
+func getServiceForReadOrError(name string, u *auth.User) (service.Service, error) {
+	return getServiceWithAccess(name, u, auth.CheckUserReadAccess)
+}
+
+func getServiceWithAccess(name string, u *auth.User, checkAccess func([]string, *auth.User) bool) (service.Service, error) {
 	s := service.Service{Name: name}
 	err := s.Get()
 	if err != nil {
@@ -190,7 +297,7 @@ func getServiceOrError(name string, u *auth.User) (service.Service, error) {
 	if !s.IsRestricted {
 		return s, nil
 	}
-	if !auth.CheckUserAccess(s.Teams, u) {
+	if !checkAccess(s.Teams, u) {
 		msg := "This user does not have access to this service"
 		return s, &errors.HTTP{Code: http.StatusForbidden, Message: msg}
 	}
@@ -198,7 +305,16 @@ func getServiceOrError(name string, u *auth.User) (service.Service, error) {
 }
 
 func getServiceInstanceOrError(name string, u *auth.User) (*service.ServiceInstance, error) {
-	si, err := service.GetServiceInstance(name, u)
+	return serviceInstanceOrError(service.GetServiceInstance(name, u))
+}
+
+// getServiceInstanceForReadOrError works like getServiceInstanceOrError, but
+// also allows viewers of the teams of the instance, for read-only access.
+func getServiceInstanceForReadOrError(name string, u *auth.User) (*service.ServiceInstance, error) {
+	return serviceInstanceOrError(service.GetServiceInstanceForRead(name, u))
+}
+
+func serviceInstanceOrError(si *service.ServiceInstance, err error) (*service.ServiceInstance, error) {
 	if err != nil {
 		switch err {
 		case service.ErrServiceInstanceNotFound:
@@ -218,6 +334,24 @@ func getServiceInstanceOrError(name string, u *auth.User) (*service.ServiceInsta
 	return si, nil
 }
 
+// getOwnedServiceInstanceOrError returns the service instance with the given
+// name, as long as the user is an owner of the team that owns the instance.
+func getOwnedServiceInstanceOrError(name string, u *auth.User) (*service.ServiceInstance, error) {
+	si, err := getServiceInstanceOrError(name, u)
+	if err != nil {
+		return nil, err
+	}
+	owners := si.Teams
+	if si.TeamOwner != "" {
+		owners = []string{si.TeamOwner}
+	}
+	if !auth.CheckTeamsPermission(u, auth.PermServiceInstanceManage, owners) {
+		msg := "you must be an owner of the team that owns this service instance to do this action"
+		return nil, &errors.HTTP{Code: http.StatusForbidden, Message: msg}
+	}
+	return si, nil
+}
+
 func servicePlans(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	u, err := t.User()
 	if err != nil {
@@ -243,7 +377,12 @@ func serviceProxy(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 		return err
 	}
 	siName := r.URL.Query().Get(":instance")
-	si, err := getServiceInstanceOrError(siName, u)
+	var si *service.ServiceInstance
+	if r.Method == "GET" {
+		si, err = getServiceInstanceForReadOrError(siName, u)
+	} else {
+		si, err = getServiceInstanceOrError(siName, u)
+	}
 	if err != nil {
 		return err
 	}
@@ -11,6 +11,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"time"
 
 	"github.com/tsuru/config"
 	"github.com/tsuru/tsuru/app"
@@ -111,6 +113,34 @@ func (s *ConsumptionSuite) TestCreateInstanceWithPlan(c *check.C) {
 	c.Assert(si.ServiceName, check.Equals, "mysql")
 }
 
+func (s *ConsumptionSuite) TestCreateInstanceWithTagsAndParameters(c *check.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"DATABASE_HOST":"localhost"}`))
+	}))
+	defer ts.Close()
+	se := service.Service{
+		Name:     "mysql",
+		Teams:    []string{s.team.Name},
+		Endpoint: map[string]string{"production": ts.URL},
+	}
+	se.Create()
+	defer s.conn.Services().Remove(bson.M{"_id": se.Name})
+	body := `{"name":"brainSQL","service_name":"mysql","owner":"` + s.team.Name + `",` +
+		`"tags":["production","backup"],"parameters":{"version":"5.6"}}`
+	request, err := http.NewRequest("POST", "/services/instances", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	err = createServiceInstance(recorder, request, s.token)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": "brainSQL"})
+	var si service.ServiceInstance
+	err = s.conn.ServiceInstances().Find(bson.M{"name": "brainSQL"}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Tags, check.DeepEquals, []string{"production", "backup"})
+	c.Assert(si.Parameters, check.DeepEquals, map[string]string{"version": "5.6"})
+}
+
 func (s *ConsumptionSuite) TestCreateInstanceHandlerSavesServiceInstanceInDb(c *check.C) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`{"DATABASE_HOST":"localhost"}`))
@@ -391,6 +421,44 @@ func (s *ConsumptionSuite) TestServicesInstancesHandlerAppFilter(c *check.C) {
 	c.Assert(action, rectest.IsRecorded)
 }
 
+func (s *ConsumptionSuite) TestServicesInstancesHandlerTagFilter(c *check.C) {
+	srv := service.Service{Name: "redis", Teams: []string{s.team.Name}}
+	err := srv.Create()
+	c.Assert(err, check.IsNil)
+	instance := service.ServiceInstance{
+		Name:        "redis-globo",
+		ServiceName: "redis",
+		Teams:       []string{s.team.Name},
+		Tags:        []string{"production", "cache"},
+	}
+	err = instance.Create()
+	c.Assert(err, check.IsNil)
+	instance2 := service.ServiceInstance{
+		Name:        "redis-other",
+		ServiceName: "redis",
+		Teams:       []string{s.team.Name},
+		Tags:        []string{"staging"},
+	}
+	err = instance2.Create()
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("GET", "/services/instances?tag=production", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = serviceInstances(recorder, request, s.token)
+	c.Assert(err, check.IsNil)
+	var instances []service.ServiceModel
+	err = json.NewDecoder(recorder.Body).Decode(&instances)
+	c.Assert(err, check.IsNil)
+	expected := []service.ServiceModel{
+		{
+			Service:      "redis",
+			Instances:    []string{"redis-globo"},
+			InstanceTags: map[string][]string{"redis-globo": {"production", "cache"}},
+		},
+	}
+	c.Assert(instances, check.DeepEquals, expected)
+}
+
 func (s *ConsumptionSuite) TestServicesInstancesHandlerReturnsOnlyServicesThatTheUserHasAccess(c *check.C) {
 	u := &auth.User{Email: "me@globo.com", Password: "123456"}
 	_, err := nativeScheme.Create(u)
@@ -641,6 +709,7 @@ func (s *ConsumptionSuite) TestGetServiceInstance(c *check.C) {
 		ServiceName: "mongodb",
 		Teams:       []string{s.team.Name},
 		Apps:        []string{"myapp"},
+		State:       service.StateReady,
 	}
 	s.conn.ServiceInstances().Insert(instance)
 	defer s.conn.ServiceInstances().Remove(instance)
@@ -654,6 +723,28 @@ func (s *ConsumptionSuite) TestGetServiceInstance(c *check.C) {
 	c.Assert(got, check.DeepEquals, instance)
 }
 
+func (s *ConsumptionSuite) TestGetServiceInstancePending(c *check.C) {
+	instance := service.ServiceInstance{
+		Name:        "mongo-1",
+		ServiceName: "mongodb",
+		Teams:       []string{s.team.Name},
+		State:       service.StatePending,
+		Transitions: []service.StateTransition{{State: service.StatePending, Date: time.Now()}},
+	}
+	s.conn.ServiceInstances().Insert(instance)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": instance.Name})
+	request, _ := http.NewRequest("GET", "/services/instances/mongo-1?:name=mongo-1", nil)
+	recorder := httptest.NewRecorder()
+	err := serviceInstance(recorder, request, s.token)
+	c.Assert(err, check.IsNil)
+	var got service.ServiceInstance
+	err = json.NewDecoder(recorder.Body).Decode(&got)
+	c.Assert(err, check.IsNil)
+	c.Assert(got.State, check.Equals, service.StatePending)
+	c.Assert(got.Transitions, check.HasLen, 1)
+	c.Assert(got.Transitions[0].State, check.Equals, service.StatePending)
+}
+
 func (s *ConsumptionSuite) TestGetServiceInstanceNotFound(c *check.C) {
 	request, _ := http.NewRequest("GET", "/services/instances/mongo-1?:name=mongo-1", nil)
 	recorder := httptest.NewRecorder()
@@ -881,3 +972,218 @@ func (s *ConsumptionSuite) TestServiceProxyError(c *check.C) {
 	c.Assert(recorder.Code, check.Equals, http.StatusBadGateway)
 	c.Assert(recorder.Body.Bytes(), check.DeepEquals, []byte("some error"))
 }
+
+func (s *ConsumptionSuite) TestGrantServiceInstanceAccess(c *check.C) {
+	team := auth.Team{Name: "otherteam"}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	si := service.ServiceInstance{Name: "mongo-1", ServiceName: "mongodb", Teams: []string{s.team.Name}, TeamOwner: s.team.Name}
+	err = s.conn.ServiceInstances().Insert(si)
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("PUT", "/services/instances/mongo-1/teams/otherteam?:name=mongo-1&:team=otherteam", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = grantServiceInstanceAccess(recorder, request, s.token)
+	c.Assert(err, check.IsNil)
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Teams, check.DeepEquals, []string{s.team.Name, team.Name})
+	recorder = httptest.NewRecorder()
+	err = grantServiceInstanceAccess(recorder, request, s.token)
+	c.Assert(err, check.NotNil)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusConflict)
+}
+
+func (s *ConsumptionSuite) TestGrantServiceInstanceAccessRestrictedService(c *check.C) {
+	team := auth.Team{Name: "otherteam"}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	srv := service.Service{Name: "mongodb", IsRestricted: true, Teams: []string{s.team.Name}}
+	err = s.conn.Services().Insert(srv)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(srv.Name)
+	si := service.ServiceInstance{Name: "mongo-1", ServiceName: "mongodb", Teams: []string{s.team.Name}, TeamOwner: s.team.Name}
+	err = s.conn.ServiceInstances().Insert(si)
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("PUT", "/services/instances/mongo-1/teams/otherteam?:name=mongo-1&:team=otherteam", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = grantServiceInstanceAccess(recorder, request, s.token)
+	c.Assert(err, check.NotNil)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+	c.Assert(e.Message, check.Equals, service.ErrTeamServiceRestricted.Error())
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Teams, check.DeepEquals, []string{s.team.Name})
+}
+
+func (s *ConsumptionSuite) TestGrantServiceInstanceAccessTeamNotFound(c *check.C) {
+	si := service.ServiceInstance{Name: "mongo-1", ServiceName: "mongodb", Teams: []string{s.team.Name}, TeamOwner: s.team.Name}
+	err := s.conn.ServiceInstances().Insert(si)
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("PUT", "/services/instances/mongo-1/teams/unknown?:name=mongo-1&:team=unknown", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = grantServiceInstanceAccess(recorder, request, s.token)
+	c.Assert(err, check.NotNil)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusNotFound)
+	c.Assert(e.Message, check.Equals, "Team not found")
+}
+
+func (s *ConsumptionSuite) TestGrantServiceInstanceAccessNotOwner(c *check.C) {
+	team := auth.Team{Name: "viewers", Users: []string{"owner@tsuru.io", s.user.Email}, Owners: []string{"owner@tsuru.io"}, Viewers: []string{s.user.Email}}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	si := service.ServiceInstance{Name: "mongo-1", ServiceName: "mongodb", Teams: []string{team.Name, s.team.Name}, TeamOwner: team.Name}
+	err = s.conn.ServiceInstances().Insert(si)
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("DELETE", "/services/instances/mongo-1/teams/tsuruteam?:name=mongo-1&:team=tsuruteam", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = revokeServiceInstanceAccess(recorder, request, s.token)
+	c.Assert(err, check.NotNil)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+	c.Assert(e.Message, check.Equals, "you must be an owner of the team that owns this service instance to do this action")
+}
+
+func (s *ConsumptionSuite) TestRevokeServiceInstanceAccess(c *check.C) {
+	si := service.ServiceInstance{Name: "mongo-1", ServiceName: "mongodb", Teams: []string{s.team.Name, "otherteam"}, TeamOwner: s.team.Name}
+	err := s.conn.ServiceInstances().Insert(si)
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("DELETE", "/services/instances/mongo-1/teams/otherteam?:name=mongo-1&:team=otherteam", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = revokeServiceInstanceAccess(recorder, request, s.token)
+	c.Assert(err, check.IsNil)
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Teams, check.DeepEquals, []string{s.team.Name})
+	recorder = httptest.NewRecorder()
+	err = revokeServiceInstanceAccess(recorder, request, s.token)
+	c.Assert(err, check.NotNil)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *ConsumptionSuite) TestRevokeServiceInstanceAccessFromOwner(c *check.C) {
+	si := service.ServiceInstance{Name: "mongo-1", ServiceName: "mongodb", Teams: []string{s.team.Name, "otherteam"}, TeamOwner: s.team.Name}
+	err := s.conn.ServiceInstances().Insert(si)
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("DELETE", "/services/instances/mongo-1/teams/tsuruteam?:name=mongo-1&:team=tsuruteam", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = revokeServiceInstanceAccess(recorder, request, s.token)
+	c.Assert(err, check.NotNil)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusForbidden)
+	c.Assert(e.Message, check.Equals, service.ErrRevokeOwnerAccess.Error())
+}
+
+func (s *ConsumptionSuite) TestUpdateServiceInstancePlan(c *check.C) {
+	var planRequest string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/resources/plans" {
+			w.Write([]byte(`[{"name": "small", "description": "small"}, {"name": "large", "description": "large"}]`))
+			return
+		}
+		planRequest = r.Method + " " + r.URL.Path + " " + r.FormValue("plan")
+	}))
+	defer ts.Close()
+	se := service.Service{Name: "mongodb", Teams: []string{s.team.Name}, Endpoint: map[string]string{"production": ts.URL}}
+	err := se.Create()
+	c.Assert(err, check.IsNil)
+	si := service.ServiceInstance{Name: "mongo-1", ServiceName: "mongodb", PlanName: "small", Teams: []string{s.team.Name}, TeamOwner: s.team.Name}
+	err = s.conn.ServiceInstances().Insert(si)
+	c.Assert(err, check.IsNil)
+	body := bytes.NewBufferString(`{"plan": "large"}`)
+	request, err := http.NewRequest("PUT", "/services/instances/mongo-1/plan?:name=mongo-1", body)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = updateServiceInstancePlan(recorder, request, s.token)
+	c.Assert(err, check.IsNil)
+	c.Assert(planRequest, check.Equals, "PUT /resources/mongo-1/plan large")
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.PlanName, check.Equals, "large")
+}
+
+func (s *ConsumptionSuite) TestUpdateServiceInstancePlanInvalidPlan(c *check.C) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/resources/plans" {
+			w.Write([]byte(`[{"name": "small", "description": "small"}]`))
+			return
+		}
+		requests++
+	}))
+	defer ts.Close()
+	se := service.Service{Name: "mongodb", Teams: []string{s.team.Name}, Endpoint: map[string]string{"production": ts.URL}}
+	err := se.Create()
+	c.Assert(err, check.IsNil)
+	si := service.ServiceInstance{Name: "mongo-1", ServiceName: "mongodb", PlanName: "small", Teams: []string{s.team.Name}, TeamOwner: s.team.Name}
+	err = s.conn.ServiceInstances().Insert(si)
+	c.Assert(err, check.IsNil)
+	body := bytes.NewBufferString(`{"plan": "huge"}`)
+	request, err := http.NewRequest("PUT", "/services/instances/mongo-1/plan?:name=mongo-1", body)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = updateServiceInstancePlan(recorder, request, s.token)
+	c.Assert(err, check.NotNil)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(e.Message, check.Equals, `The plan "huge" does not exist in the service "mongodb".`)
+	c.Assert(requests, check.Equals, 0)
+}
+
+func (s *ConsumptionSuite) TestUpdateServiceInstancePlanPendingInstance(c *check.C) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer ts.Close()
+	se := service.Service{Name: "mongodb", Teams: []string{s.team.Name}, Endpoint: map[string]string{"production": ts.URL}}
+	err := se.Create()
+	c.Assert(err, check.IsNil)
+	si := service.ServiceInstance{Name: "mongo-1", ServiceName: "mongodb", PlanName: "small", Teams: []string{s.team.Name}, TeamOwner: s.team.Name, State: service.StatePending}
+	err = s.conn.ServiceInstances().Insert(si)
+	c.Assert(err, check.IsNil)
+	body := bytes.NewBufferString(`{"plan": "large"}`)
+	request, err := http.NewRequest("PUT", "/services/instances/mongo-1/plan?:name=mongo-1", body)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = updateServiceInstancePlan(recorder, request, s.token)
+	c.Assert(err, check.NotNil)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusConflict)
+	c.Assert(requests, check.Equals, 0)
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.PlanName, check.Equals, "small")
+}
+
+func (s *ConsumptionSuite) TestUpdateServiceInstancePlanWithoutPlan(c *check.C) {
+	body := bytes.NewBufferString(`{}`)
+	request, err := http.NewRequest("PUT", "/services/instances/mongo-1/plan?:name=mongo-1", body)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	err = updateServiceInstancePlan(recorder, request, s.token)
+	c.Assert(err, check.NotNil)
+	e, ok := err.(*errors.HTTP)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Code, check.Equals, http.StatusBadRequest)
+}
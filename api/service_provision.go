@@ -24,6 +24,7 @@ type serviceYaml struct {
 	Username string
 	Password string
 	Endpoint map[string]string
+	Broker   string
 }
 
 func (sy *serviceYaml) validate() error {
@@ -96,6 +97,7 @@ func serviceCreate(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 		Username:   sy.Username,
 		Endpoint:   sy.Endpoint,
 		Password:   sy.Password,
+		Broker:     sy.Broker,
 		OwnerTeams: auth.GetTeamsNames(teams),
 	}
 	err = s.Create()
@@ -137,6 +139,7 @@ func serviceUpdate(w http.ResponseWriter, r *http.Request, t auth.Token) error {
 	s.Endpoint = y.Endpoint
 	s.Password = y.Password
 	s.Username = y.Username
+	s.Broker = y.Broker
 	if err = s.Update(); err != nil {
 		return err
 	}
@@ -27,7 +27,7 @@ func remoteShellHandler(w http.ResponseWriter, r *http.Request, t auth.Token) er
 		return err
 	}
 	appName := r.URL.Query().Get(":app")
-	app, err := getApp(appName, u)
+	app, err := getAppWithPermission(appName, u, auth.PermAppUpdate)
 	if err != nil {
 		return err
 	}
@@ -66,6 +66,32 @@ var reserveUserApp = action.Action{
 	MinParams: 2,
 }
 
+// reserveTeamApp reserves the app in the quota of its team owner. If the team
+// does not have a quota, reserveTeamApp.Forward just return nil.
+var reserveTeamApp = action.Action{
+	Name: "reserve-team-app",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		var app *App
+		switch ctx.Params[0].(type) {
+		case *App:
+			app = ctx.Params[0].(*App)
+		default:
+			return nil, errors.New("First parameter must be *App.")
+		}
+		if err := auth.ReserveTeamApp(app.TeamOwner); err != nil {
+			return nil, err
+		}
+		return app.TeamOwner, nil
+	},
+	Backward: func(ctx action.BWContext) {
+		team := ctx.FWResult.(string)
+		if err := auth.ReleaseTeamApp(team); err != nil {
+			log.Errorf("Failed to rollback reserveTeamApp: %s", err)
+		}
+	},
+	MinParams: 1,
+}
+
 // insertApp is an action that inserts an app in the database in Forward and
 // removes it in the Backward.
 //
@@ -21,6 +21,7 @@ import (
 	"github.com/tsuru/tsuru/db"
 	"github.com/tsuru/tsuru/errors"
 	"github.com/tsuru/tsuru/log"
+	"github.com/tsuru/tsuru/metering"
 	"github.com/tsuru/tsuru/provision"
 	"github.com/tsuru/tsuru/quota"
 	"github.com/tsuru/tsuru/repository"
@@ -66,6 +67,7 @@ func (l *AppLock) String() string {
 type App struct {
 	Env             map[string]bind.EnvVar
 	Platform        string `bson:"framework"`
+	PlatformVersion string
 	Name            string
 	Ip              string
 	CName           []string
@@ -94,6 +96,12 @@ func (app *App) MarshalJSON() ([]byte, error) {
 	result := make(map[string]interface{})
 	result["name"] = app.Name
 	result["platform"] = app.Platform
+	if app.PlatformVersion != "" {
+		result["platform"] = app.Platform + ":" + app.PlatformVersion
+	}
+	if platform, err := getPlatform(app.Platform); err == nil && platform.State != "" && platform.State != PlatformEnabled {
+		result["platformState"] = platform.State
+	}
 	result["teams"] = app.Teams
 	result["units"] = app.Units()
 	result["repository"] = repo.ReadWriteURL
@@ -177,6 +185,9 @@ func GetByName(name string) (*App, error) {
 //       1. Save the app in the database
 //       2. Create the git repository using the repository manager
 //       3. Provision the app using the provisioner
+//
+// The app is created only if one unit of its plan fits in the resource quotas
+// of its team owner and its pool.
 func CreateApp(app *App, user *auth.User) error {
 	teams, err := user.Teams()
 	if err != nil {
@@ -185,9 +196,15 @@ func CreateApp(app *App, user *auth.User) error {
 	if len(teams) == 0 {
 		return NoTeamsError{}
 	}
-	if _, err := getPlatform(app.Platform); err != nil {
+	app.Platform, app.PlatformVersion = parsePlatform(app.Platform)
+	platform, err := getPlatformVersion(app.Platform, app.PlatformVersion)
+	if err != nil {
 		return err
 	}
+	if platform.Disabled() && !user.IsAdmin() {
+		msg := fmt.Sprintf("Platform %s is disabled, it can't be used by new apps.", platform.Name)
+		return &errors.ValidationError{Message: msg}
+	}
 	var plan *Plan
 	if app.Plan.Name == "" {
 		plan, err = DefaultPlan()
@@ -214,8 +231,13 @@ func CreateApp(app *App, user *auth.User) error {
 	if err != nil {
 		return err
 	}
+	err = checkResourceQuotas(app, 1)
+	if err != nil {
+		return err
+	}
 	actions := []*action.Action{
 		&reserveUserApp,
+		&reserveTeamApp,
 		&insertApp,
 		&exportEnvironmentsAction,
 		&createRepository,
@@ -246,7 +268,7 @@ func (app *App) unbind() error {
 		msg += fmt.Sprintf("- %s (%s)", instanceName, reason.Error())
 	}
 	for _, instance := range instances {
-		err = instance.UnbindApp(app, nil)
+		err = instance.ForceUnbindApp(app, nil)
 		if err != nil {
 			addMsg(instance.Name, err)
 		}
@@ -262,9 +284,12 @@ func asyncDestroyAppProvisioner(app *App) *sync.WaitGroup {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		units := len(app.Units())
 		err := Provisioner.Destroy(app)
 		if err != nil {
 			log.Errorf("Unable to destroy app in provisioner: %s", err.Error())
+		} else {
+			app.recordUnitsMetering(metering.ActionRemove, units)
 		}
 		err = app.unbind()
 		if err != nil {
@@ -325,6 +350,8 @@ func Delete(app *App) error {
 			log.Errorf("Unable to release app quota: %s", err.Error())
 		}
 	}
+	releaseFromTeam(app.TeamOwner, app.Quota.InUse)
+	releaseResourceQuotas(app, app.Quota.InUse)
 	return nil
 }
 
@@ -381,7 +408,11 @@ func (app *App) AddUnits(n uint, writer io.Writer) error {
 		&reserveUnitsToAdd,
 		&provisionAddUnits,
 	).Execute(app, n, writer)
-	return err
+	if err != nil {
+		return err
+	}
+	app.recordUnitsMetering(metering.ActionAdd, int(n))
+	return nil
 }
 
 // RemoveUnits removes n units from the app. It's a process composed of
@@ -400,7 +431,15 @@ func (app *App) RemoveUnits(n uint) error {
 	}
 	go func() {
 		defer ReleaseApplicationLock(app.Name)
-		Provisioner.RemoveUnits(app, n)
+		err := Provisioner.RemoveUnits(app, n)
+		if err == nil {
+			app.recordUnitsMetering(metering.ActionRemove, int(n))
+			err = auth.ReleaseTeamUnits(app.TeamOwner, int(n))
+			if err != nil {
+				log.Errorf("Unable to release units from team quota: %s", err)
+			}
+			releaseResourceQuotas(app, int(n))
+		}
 		conn, err := db.Conn()
 		if err != nil {
 			log.Errorf("Error: %s", err)
@@ -497,11 +536,26 @@ func (app *App) GetTeams() []auth.Team {
 
 // SetTeamOwner sets the TeamOwner value.
 func (app *App) SetTeamOwner(team *auth.Team, u *auth.User) error {
+	oldTeamOwner := app.TeamOwner
 	app.TeamOwner = team.Name
 	err := app.ValidateTeamOwner(u)
 	if err != nil {
 		return err
 	}
+	memory, cpushare := app.Plan.Memory*int64(app.Quota.InUse), app.Plan.CpuShare*app.Quota.InUse
+	if oldTeamOwner != team.Name {
+		err = reserveInTeam(team.Name, app.Quota.InUse)
+		if err != nil {
+			app.TeamOwner = oldTeamOwner
+			return err
+		}
+		err = reserveResourceQuota(ResourceQuotaTeam, team.Name, memory, cpushare)
+		if err != nil {
+			releaseFromTeam(team.Name, app.Quota.InUse)
+			app.TeamOwner = oldTeamOwner
+			return err
+		}
+	}
 	app.Grant(team)
 	conn, err := db.Conn()
 	if err != nil {
@@ -510,11 +564,45 @@ func (app *App) SetTeamOwner(team *auth.Team, u *auth.User) error {
 	defer conn.Close()
 	err = conn.Apps().Update(bson.M{"name": app.Name}, app)
 	if err != nil {
+		if oldTeamOwner != team.Name {
+			releaseFromTeam(team.Name, app.Quota.InUse)
+			releaseResourceQuota(ResourceQuotaTeam, team.Name, memory, cpushare)
+		}
 		return err
 	}
+	if oldTeamOwner != team.Name {
+		releaseFromTeam(oldTeamOwner, app.Quota.InUse)
+		releaseResourceQuota(ResourceQuotaTeam, oldTeamOwner, memory, cpushare)
+		app.recordUnitsMetering(metering.ActionUpdate, 0)
+	}
 	return nil
 }
 
+// reserveInTeam reserves an app with the given number of units in the quotas
+// of the team.
+func reserveInTeam(teamName string, units int) error {
+	err := auth.ReserveTeamApp(teamName)
+	if err != nil {
+		return err
+	}
+	err = auth.ReserveTeamUnits(teamName, units)
+	if err != nil {
+		auth.ReleaseTeamApp(teamName)
+	}
+	return err
+}
+
+func releaseFromTeam(teamName string, units int) {
+	err := auth.ReleaseTeamApp(teamName)
+	if err != nil {
+		log.Errorf("Unable to release app from quota of team %s: %s", teamName, err)
+	}
+	err = auth.ReleaseTeamUnits(teamName, units)
+	if err != nil {
+		log.Errorf("Unable to release units from quota of team %s: %s", teamName, err)
+	}
+}
+
 func (app *App) ValidateTeamOwner(user *auth.User) error {
 	if _, err := auth.GetTeam(app.TeamOwner); err == auth.ErrTeamNotFound {
 		return err
@@ -673,6 +761,30 @@ func (app *App) GetPool() string {
 	return app.Pool
 }
 
+// effectivePool returns the pool where the units of the app run. Apps without
+// a pool run in the pools of their teams or, when their teams don't have
+// pools, in the pools without teams, as in the docker scheduler. It returns
+// an empty string when there are no pools.
+func (app *App) effectivePool() (string, error) {
+	if app.Pool != "" {
+		return app.Pool, nil
+	}
+	pools, err := provision.ListPools(bson.M{"$or": []bson.M{{"teams": app.TeamOwner}, {"teams": bson.M{"$in": app.Teams}}}})
+	if err != nil {
+		return "", err
+	}
+	if len(pools) == 0 {
+		pools, err = provision.ListPools(bson.M{"$or": []bson.M{{"teams": bson.M{"$exists": false}}, {"teams": bson.M{"$size": 0}}}})
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(pools) == 0 {
+		return "", nil
+	}
+	return pools[0].Name, nil
+}
+
 // GetTeamOwner returns the team owner of the app.
 func (app *App) GetTeamOwner() string {
 	return app.TeamOwner
@@ -708,6 +820,44 @@ func (app *App) GetPlatform() string {
 	return app.Platform
 }
 
+// GetPlatformVersion returns the version of the platform used by the app:
+// the version pinned in the app or the current version of the platform. An
+// empty version means the latest image of the platform.
+func (app *App) GetPlatformVersion() string {
+	if app.PlatformVersion != "" {
+		return app.PlatformVersion
+	}
+	platform, err := getPlatform(app.Platform)
+	if err != nil {
+		return ""
+	}
+	return platform.Current
+}
+
+// SetPlatformVersion pins the app to the given version of its platform. An
+// empty version unpins the app, making it follow the current version of the
+// platform. The next deploy of the app uses the new version.
+func (app *App) SetPlatformVersion(version string) error {
+	if _, err := getPlatformVersion(app.Platform, version); err != nil {
+		return err
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Apps().Update(
+		bson.M{"name": app.Name},
+		bson.M{"$set": bson.M{"platformversion": version, "updateplatform": true}},
+	)
+	if err != nil {
+		return err
+	}
+	app.PlatformVersion = version
+	app.UpdatePlatform = true
+	return nil
+}
+
 // GetDeploys returns the amount of deploys of an app.
 func (app *App) GetDeploys() uint {
 	return app.Deploys
@@ -159,6 +159,100 @@ func (s *S) TestCreateApp(c *check.C) {
 	c.Assert(err, check.IsNil)
 }
 
+func (s *S) TestCreateAppWithPinnedPlatformVersion(c *check.C) {
+	err := s.conn.Platforms().Insert(Platform{
+		Name:     "pinned",
+		Current:  "v2",
+		Versions: []PlatformVersion{{Version: "v1"}, {Version: "v2"}},
+	})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Platforms().RemoveId("pinned")
+	a := App{Name: "appname", Platform: "pinned:v1"}
+	err = CreateApp(&a, s.user)
+	c.Assert(err, check.IsNil)
+	defer Delete(&a)
+	retrievedApp, err := GetByName(a.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(retrievedApp.Platform, check.Equals, "pinned")
+	c.Assert(retrievedApp.PlatformVersion, check.Equals, "v1")
+	c.Assert(retrievedApp.GetPlatformVersion(), check.Equals, "v1")
+}
+
+func (s *S) TestCreateAppWithInvalidPlatformVersion(c *check.C) {
+	err := s.conn.Platforms().Insert(Platform{Name: "pinned", Current: "v1", Versions: []PlatformVersion{{Version: "v1"}}})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Platforms().RemoveId("pinned")
+	a := App{Name: "appname", Platform: "pinned:v3"}
+	err = CreateApp(&a, s.user)
+	c.Assert(err, check.FitsTypeOf, &errors.ValidationError{})
+	c.Assert(err, check.ErrorMatches, `Invalid version "v3" for platform pinned.`)
+}
+
+func (s *S) TestCreateAppWithDisabledPlatform(c *check.C) {
+	err := s.conn.Platforms().Insert(Platform{Name: "oldplat", State: PlatformDisabled})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Platforms().RemoveId("oldplat")
+	a := App{Name: "appname", Platform: "oldplat"}
+	err = CreateApp(&a, s.user)
+	c.Assert(err, check.FitsTypeOf, &errors.ValidationError{})
+	c.Assert(err, check.ErrorMatches, "Platform oldplat is disabled, it can't be used by new apps.")
+}
+
+func (s *S) TestCreateAppWithDisabledPlatformByAdmin(c *check.C) {
+	s.createAdminUserAndTeam(c)
+	defer s.removeAdminUserAndTeam(c)
+	err := s.conn.Platforms().Insert(Platform{Name: "oldplat", State: PlatformDisabled})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Platforms().RemoveId("oldplat")
+	a := App{Name: "appname", Platform: "oldplat"}
+	err = CreateApp(&a, s.admin)
+	c.Assert(err, check.IsNil)
+	defer Delete(&a)
+	c.Assert(a.Platform, check.Equals, "oldplat")
+}
+
+func (s *S) TestAppMarshalJSONDeprecatedPlatform(c *check.C) {
+	err := s.conn.Platforms().Insert(Platform{Name: "oldplat", State: PlatformDeprecated})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Platforms().RemoveId("oldplat")
+	app := App{Name: "name", Platform: "oldplat"}
+	data, err := app.MarshalJSON()
+	c.Assert(err, check.IsNil)
+	result := make(map[string]interface{})
+	err = json.Unmarshal(data, &result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result["platformState"], check.Equals, PlatformDeprecated)
+}
+
+func (s *S) TestAppSetPlatformVersion(c *check.C) {
+	err := s.conn.Platforms().Insert(Platform{
+		Name:     "pinned",
+		Current:  "v2",
+		Versions: []PlatformVersion{{Version: "v1"}, {Version: "v2"}},
+	})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Platforms().RemoveId("pinned")
+	a := App{Name: "appname", Platform: "pinned"}
+	err = s.conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	c.Assert(a.GetPlatformVersion(), check.Equals, "v2")
+	err = a.SetPlatformVersion("v1")
+	c.Assert(err, check.IsNil)
+	dbApp, err := GetByName(a.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbApp.PlatformVersion, check.Equals, "v1")
+	c.Assert(dbApp.UpdatePlatform, check.Equals, true)
+	err = a.SetPlatformVersion("v9")
+	c.Assert(err, check.ErrorMatches, `Invalid version "v9" for platform pinned.`)
+	err = a.SetPlatformVersion("")
+	c.Assert(err, check.IsNil)
+	dbApp, err = GetByName(a.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbApp.PlatformVersion, check.Equals, "")
+	c.Assert(dbApp.GetPlatformVersion(), check.Equals, "v2")
+}
+
 func (s *S) TestCreateAppDefaultPlan(c *check.C) {
 	a := App{
 		Name:     "appname",
@@ -255,6 +349,36 @@ func (s *S) TestCreateAppUserQuotaExceeded(c *check.C) {
 	c.Assert(ok, check.Equals, true)
 }
 
+func (s *S) TestCreateAppTeamQuotaExceeded(c *check.C) {
+	app := App{Name: "america", Platform: "python"}
+	s.conn.Teams().UpdateId(s.team.Name, bson.M{"$set": bson.M{"appquota": quota.Quota{Limit: 1, InUse: 1}}})
+	defer s.conn.Teams().UpdateId(s.team.Name, bson.M{"$unset": bson.M{"appquota": ""}})
+	err := CreateApp(&app, s.user)
+	e, ok := err.(*AppCreationError)
+	c.Assert(ok, check.Equals, true)
+	_, ok = e.Err.(*quota.QuotaExceededError)
+	c.Assert(ok, check.Equals, true)
+	user, err := auth.GetUserByEmail(s.user.Email)
+	c.Assert(err, check.IsNil)
+	c.Assert(user.Quota.InUse, check.Equals, 0)
+}
+
+func (s *S) TestCreateAppReservesTeamQuota(c *check.C) {
+	app := App{Name: "america", Platform: "python"}
+	s.conn.Teams().UpdateId(s.team.Name, bson.M{"$set": bson.M{"appquota": quota.Quota{Limit: 2}}})
+	defer s.conn.Teams().UpdateId(s.team.Name, bson.M{"$unset": bson.M{"appquota": ""}})
+	err := CreateApp(&app, s.user)
+	c.Assert(err, check.IsNil)
+	team, err := auth.GetTeam(s.team.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(team.AppQuota.InUse, check.Equals, 1)
+	err = Delete(&app)
+	c.Assert(err, check.IsNil)
+	team, err = auth.GetTeam(s.team.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(team.AppQuota.InUse, check.Equals, 0)
+}
+
 func (s *S) TestCreateAppTeamOwner(c *check.C) {
 	app := App{Name: "america", Platform: "python", TeamOwner: "tsuruteam"}
 	err := CreateApp(&app, s.user)
@@ -1961,6 +2085,16 @@ func (s *S) TestAppMarshalJSON(c *check.C) {
 	c.Assert(result, check.DeepEquals, expected)
 }
 
+func (s *S) TestAppMarshalJSONPinnedPlatformVersion(c *check.C) {
+	app := App{Name: "name", Platform: "python", PlatformVersion: "3.4-2015.06"}
+	data, err := app.MarshalJSON()
+	c.Assert(err, check.IsNil)
+	result := make(map[string]interface{})
+	err = json.Unmarshal(data, &result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result["platform"], check.Equals, "python:3.4-2015.06")
+}
+
 func (s *S) TestAppMarshalJSONWithoutRepository(c *check.C) {
 	app := App{
 		Name:      "name",
@@ -2658,6 +2792,59 @@ func (s *S) TestAppValidateTeamOwnerAdminCanSetAppToAnyTeam(c *check.C) {
 	c.Assert(err, check.IsNil)
 }
 
+func (s *S) TestAppSetTeamOwnerMovesTeamQuota(c *check.C) {
+	oldTeam := auth.Team{
+		Name:      "old",
+		Users:     []string{s.user.Email},
+		AppQuota:  &quota.Quota{Limit: 5, InUse: 1},
+		UnitQuota: &quota.Quota{Limit: 10, InUse: 3},
+	}
+	newTeam := auth.Team{
+		Name:      "new",
+		Users:     []string{s.user.Email},
+		AppQuota:  &quota.Quota{Limit: 5},
+		UnitQuota: &quota.Quota{Limit: 10},
+	}
+	err := s.conn.Teams().Insert(oldTeam, newTeam)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveAll(bson.M{"_id": bson.M{"$in": []string{"old", "new"}}})
+	a := App{Name: "test", Platform: "python", TeamOwner: "old", Quota: quota.Quota{Limit: -1, InUse: 3}}
+	err = s.conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	err = a.SetTeamOwner(&newTeam, s.user)
+	c.Assert(err, check.IsNil)
+	team, err := auth.GetTeam("old")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.AppQuota.InUse, check.Equals, 0)
+	c.Assert(team.UnitQuota.InUse, check.Equals, 0)
+	team, err = auth.GetTeam("new")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.AppQuota.InUse, check.Equals, 1)
+	c.Assert(team.UnitQuota.InUse, check.Equals, 3)
+}
+
+func (s *S) TestAppSetTeamOwnerTeamQuotaExceeded(c *check.C) {
+	newTeam := auth.Team{
+		Name:      "new",
+		Users:     []string{s.user.Email},
+		UnitQuota: &quota.Quota{Limit: 2},
+	}
+	err := s.conn.Teams().Insert(newTeam)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(newTeam.Name)
+	a := App{Name: "test", Platform: "python", TeamOwner: s.team.Name, Quota: quota.Quota{Limit: -1, InUse: 3}}
+	err = s.conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	err = a.SetTeamOwner(&newTeam, s.user)
+	c.Assert(err, check.FitsTypeOf, &quota.QuotaExceededError{})
+	c.Assert(a.TeamOwner, check.Equals, s.team.Name)
+	dbApp, err := GetByName(a.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbApp.TeamOwner, check.Equals, s.team.Name)
+}
+
 func (s *S) TestUpdateCustomData(c *check.C) {
 	a := App{Name: "my-test-app"}
 	err := s.conn.Apps().Insert(a)
@@ -2742,3 +2929,25 @@ func (s *S) TestShellToAnApp(c *check.C) {
 	expected[0].App = &a
 	c.Assert(s.provisioner.Shells(unit.Name), check.DeepEquals, expected)
 }
+
+func (s *S) TestAppEffectivePool(c *check.C) {
+	err := provision.AddPool("public")
+	c.Assert(err, check.IsNil)
+	defer provision.RemovePool("public")
+	a := App{Name: "warpaint", TeamOwner: "tsuruteam", Teams: []string{"tsuruteam"}}
+	pool, err := a.effectivePool()
+	c.Assert(err, check.IsNil)
+	c.Assert(pool, check.Equals, "public")
+	err = provision.AddPool("teampool")
+	c.Assert(err, check.IsNil)
+	defer provision.RemovePool("teampool")
+	err = provision.AddTeamsToPool("teampool", []string{"tsuruteam"})
+	c.Assert(err, check.IsNil)
+	pool, err = a.effectivePool()
+	c.Assert(err, check.IsNil)
+	c.Assert(pool, check.Equals, "teampool")
+	a.Pool = "pool1"
+	pool, err = a.effectivePool()
+	c.Assert(err, check.IsNil)
+	c.Assert(pool, check.Equals, "pool1")
+}
@@ -0,0 +1,215 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/tsuru/tsuru/app/bind"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/log"
+	"github.com/tsuru/tsuru/service"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// BindingAppNotFound means that the service instance is bound to an
+	// app that doesn't exist anymore.
+	BindingAppNotFound = "app-not-found"
+
+	// BindingMissingEnvs means that the service instance is bound to the
+	// app, but the app doesn't have the environment variables of the
+	// instance.
+	BindingMissingEnvs = "missing-envs"
+
+	// BindingStaleEnvs means that the app has the environment variables of
+	// a service instance that isn't bound to it.
+	BindingStaleEnvs = "stale-envs"
+)
+
+// BindingMismatch describes a bind between an app and a service instance
+// that is only half done, as seen from the list of apps of the instance and
+// from the environment variables of the app.
+type BindingMismatch struct {
+	Kind     string
+	App      string
+	Instance string
+	Service  string
+	Fixed    bool
+}
+
+func (m BindingMismatch) String() string {
+	var msg string
+	switch m.Kind {
+	case BindingAppNotFound:
+		msg = fmt.Sprintf("instance %q of service %q is bound to the app %q, which doesn't exist", m.Instance, m.Service, m.App)
+	case BindingMissingEnvs:
+		msg = fmt.Sprintf("instance %q of service %q is bound to the app %q, but the app doesn't have its environment variables", m.Instance, m.Service, m.App)
+	case BindingStaleEnvs:
+		msg = fmt.Sprintf("app %q has the environment variables of the instance %q of service %q, which isn't bound to it", m.App, m.Instance, m.Service)
+	}
+	if m.Fixed {
+		msg += " (fixed)"
+	}
+	return msg
+}
+
+// ReconcileServiceBindings compares the apps bound to each service instance
+// with the environment variables of the apps, returning the binds that are
+// only half done. When fix is true, the binds are undone:
+//
+//   - instances bound to apps that don't exist have the app removed from
+//     their list of apps;
+//   - instances bound to apps that don't have their environment variables
+//     are unbound from the app;
+//   - apps with the environment variables of instances that aren't bound to
+//     them have the variables removed.
+//
+// Apps that are locked are ignored. Failures to fix a bind are logged, and
+// the mismatch is reported as not fixed.
+func ReconcileServiceBindings(fix bool) ([]BindingMismatch, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var apps []App
+	err = conn.Apps().Find(nil).All(&apps)
+	if err != nil {
+		return nil, err
+	}
+	var instances []service.ServiceInstance
+	err = conn.ServiceInstances().Find(nil).All(&instances)
+	if err != nil {
+		return nil, err
+	}
+	appsByName := make(map[string]*App, len(apps))
+	for i := range apps {
+		appsByName[apps[i].Name] = &apps[i]
+	}
+	instancesByName := make(map[string]*service.ServiceInstance, len(instances))
+	var mismatches []BindingMismatch
+	for i := range instances {
+		si := &instances[i]
+		instancesByName[si.Name] = si
+		for _, appName := range si.Apps {
+			m := BindingMismatch{App: appName, Instance: si.Name, Service: si.ServiceName}
+			a, ok := appsByName[appName]
+			if !ok {
+				m.Kind = BindingAppNotFound
+				if fix {
+					m.Fixed = fixBinding(m, func() error {
+						return conn.ServiceInstances().Update(bson.M{"name": si.Name}, bson.M{"$pull": bson.M{"apps": appName}})
+					})
+				}
+				mismatches = append(mismatches, m)
+				continue
+			}
+			if a.Lock.Locked || a.hasServiceInstance(si.ServiceName, si.Name) {
+				continue
+			}
+			m.Kind = BindingMissingEnvs
+			if fix {
+				m.Fixed = fixBinding(m, func() error {
+					return si.UnbindApp(a, nil)
+				})
+			}
+			mismatches = append(mismatches, m)
+		}
+	}
+	for i := range apps {
+		a := &apps[i]
+		if a.Lock.Locked {
+			continue
+		}
+		for _, instance := range a.boundServiceInstances() {
+			si, ok := instancesByName[instance.Name]
+			if ok && si.FindApp(a.Name) > -1 {
+				continue
+			}
+			if ok && instance.service == "" {
+				instance.service = si.ServiceName
+			}
+			m := BindingMismatch{Kind: BindingStaleEnvs, App: a.Name, Instance: instance.Name, Service: instance.service}
+			if fix {
+				m.Fixed = fixBinding(m, func() error {
+					return a.RemoveInstance(instance.service, instance.ServiceInstance, nil)
+				})
+			}
+			mismatches = append(mismatches, m)
+		}
+	}
+	return mismatches, nil
+}
+
+func fixBinding(m BindingMismatch, fn func() error) bool {
+	err := fn()
+	if err != nil {
+		log.Errorf("[bind-reconcile] unable to fix %s: %s", m, err)
+		return false
+	}
+	return true
+}
+
+// hasServiceInstance reports whether the instance is listed in the
+// TSURU_SERVICES environment variable of the app.
+func (app *App) hasServiceInstance(serviceName, instanceName string) bool {
+	for _, instance := range app.parsedTsuruServices()[serviceName] {
+		if instance.Name == instanceName {
+			return true
+		}
+	}
+	return false
+}
+
+type boundServiceInstance struct {
+	bind.ServiceInstance
+	service string
+}
+
+// boundServiceInstances returns the service instances whose environment
+// variables are set in the app, either in TSURU_SERVICES or as variables
+// tagged with the name of the instance.
+func (app *App) boundServiceInstances() []boundServiceInstance {
+	var instances []boundServiceInstance
+	seen := make(map[string]int)
+	tsuruServices := app.parsedTsuruServices()
+	serviceNames := make([]string, 0, len(tsuruServices))
+	for name := range tsuruServices {
+		serviceNames = append(serviceNames, name)
+	}
+	sort.Strings(serviceNames)
+	for _, serviceName := range serviceNames {
+		for _, instance := range tsuruServices[serviceName] {
+			if instance.Envs == nil {
+				instance.Envs = make(map[string]string)
+			}
+			seen[instance.Name] = len(instances)
+			instances = append(instances, boundServiceInstance{ServiceInstance: instance, service: serviceName})
+		}
+	}
+	envNames := make([]string, 0, len(app.Env))
+	for name := range app.Env {
+		envNames = append(envNames, name)
+	}
+	sort.Strings(envNames)
+	for _, name := range envNames {
+		env := app.Env[name]
+		if env.InstanceName == "" {
+			continue
+		}
+		i, ok := seen[env.InstanceName]
+		if !ok {
+			i = len(instances)
+			seen[env.InstanceName] = i
+			instances = append(instances, boundServiceInstance{
+				ServiceInstance: bind.ServiceInstance{Name: env.InstanceName, Envs: make(map[string]string)},
+			})
+		}
+		instances[i].Envs[env.Name] = env.Value
+	}
+	return instances
+}
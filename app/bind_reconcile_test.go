@@ -0,0 +1,136 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+
+	"github.com/tsuru/tsuru/app/bind"
+	"github.com/tsuru/tsuru/service"
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) createBindReconcileFixtures(c *check.C, endpoint string) {
+	srvc := service.Service{Name: "mysql", Endpoint: map[string]string{"production": endpoint}}
+	err := s.conn.Services().Insert(&srvc)
+	c.Assert(err, check.IsNil)
+	app1 := App{Name: "app1", Env: map[string]bind.EnvVar{
+		"DATABASE_HOST": {Name: "DATABASE_HOST", Value: "localhost", InstanceName: "mydb"},
+		"CACHE_HOST":    {Name: "CACHE_HOST", Value: "cache", InstanceName: "stale"},
+		"MY_VAR":        {Name: "MY_VAR", Value: "123"},
+		TsuruServicesEnvVar: {
+			Name:  TsuruServicesEnvVar,
+			Value: `{"mysql": [{"instance_name": "mydb", "envs": {"DATABASE_HOST": "localhost"}}]}`,
+		},
+	}}
+	app2 := App{Name: "app2"}
+	err = s.conn.Apps().Insert(app1, app2)
+	c.Assert(err, check.IsNil)
+	instances := []service.ServiceInstance{
+		{Name: "mydb", ServiceName: "mysql", Apps: []string{"app1"}},
+		{Name: "orphan", ServiceName: "mysql", Apps: []string{"ghost"}},
+		{Name: "half", ServiceName: "mysql", Apps: []string{"app2"}},
+	}
+	for _, si := range instances {
+		err = s.conn.ServiceInstances().Insert(si)
+		c.Assert(err, check.IsNil)
+	}
+}
+
+func (s *S) removeBindReconcileFixtures() {
+	s.conn.Services().RemoveId("mysql")
+	s.conn.Apps().RemoveAll(bson.M{"name": bson.M{"$in": []string{"app1", "app2"}}})
+	s.conn.ServiceInstances().RemoveAll(bson.M{"name": bson.M{"$in": []string{"mydb", "orphan", "half"}}})
+}
+
+func (s *S) TestReconcileServiceBindings(c *check.C) {
+	s.createBindReconcileFixtures(c, "http://localhost:1234")
+	defer s.removeBindReconcileFixtures()
+	mismatches, err := ReconcileServiceBindings(false)
+	c.Assert(err, check.IsNil)
+	c.Assert(mismatches, check.DeepEquals, []BindingMismatch{
+		{Kind: BindingAppNotFound, App: "ghost", Instance: "orphan", Service: "mysql"},
+		{Kind: BindingMissingEnvs, App: "app2", Instance: "half", Service: "mysql"},
+		{Kind: BindingStaleEnvs, App: "app1", Instance: "stale", Service: ""},
+	})
+	a, err := GetByName("app1")
+	c.Assert(err, check.IsNil)
+	c.Assert(a.Env["CACHE_HOST"].Value, check.Equals, "cache")
+}
+
+func (s *S) TestReconcileServiceBindingsFix(c *check.C) {
+	var unbinds int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" && r.URL.Path == "/resources/half/bind-app" {
+			atomic.AddInt32(&unbinds, 1)
+		}
+	}))
+	defer ts.Close()
+	s.createBindReconcileFixtures(c, ts.URL)
+	defer s.removeBindReconcileFixtures()
+	mismatches, err := ReconcileServiceBindings(true)
+	c.Assert(err, check.IsNil)
+	c.Assert(mismatches, check.HasLen, 3)
+	for _, m := range mismatches {
+		c.Assert(m.Fixed, check.Equals, true)
+	}
+	c.Assert(atomic.LoadInt32(&unbinds), check.Equals, int32(1))
+	var si service.ServiceInstance
+	err = s.conn.ServiceInstances().Find(bson.M{"name": "orphan"}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Apps, check.HasLen, 0)
+	err = s.conn.ServiceInstances().Find(bson.M{"name": "half"}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Apps, check.HasLen, 0)
+	a, err := GetByName("app1")
+	c.Assert(err, check.IsNil)
+	_, ok := a.Env["CACHE_HOST"]
+	c.Assert(ok, check.Equals, false)
+	c.Assert(a.Env["DATABASE_HOST"].Value, check.Equals, "localhost")
+	c.Assert(a.Env["MY_VAR"].Value, check.Equals, "123")
+	mismatches, err = ReconcileServiceBindings(false)
+	c.Assert(err, check.IsNil)
+	c.Assert(mismatches, check.HasLen, 0)
+}
+
+func (s *S) TestReconcileServiceBindingsFixFailure(c *check.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	s.createBindReconcileFixtures(c, ts.URL)
+	defer s.removeBindReconcileFixtures()
+	mismatches, err := ReconcileServiceBindings(true)
+	c.Assert(err, check.IsNil)
+	c.Assert(mismatches, check.HasLen, 3)
+	c.Assert(mismatches[1].Kind, check.Equals, BindingMissingEnvs)
+	c.Assert(mismatches[1].Fixed, check.Equals, false)
+	var si service.ServiceInstance
+	err = s.conn.ServiceInstances().Find(bson.M{"name": "half"}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Apps, check.DeepEquals, []string{"app2"})
+}
+
+func (s *S) TestReconcileServiceBindingsIgnoresLockedApps(c *check.C) {
+	s.createBindReconcileFixtures(c, "http://localhost:1234")
+	defer s.removeBindReconcileFixtures()
+	_, err := s.conn.Apps().UpdateAll(bson.M{"name": bson.M{"$in": []string{"app1", "app2"}}}, bson.M{"$set": bson.M{"lock.locked": true}})
+	c.Assert(err, check.IsNil)
+	mismatches, err := ReconcileServiceBindings(false)
+	c.Assert(err, check.IsNil)
+	c.Assert(mismatches, check.DeepEquals, []BindingMismatch{
+		{Kind: BindingAppNotFound, App: "ghost", Instance: "orphan", Service: "mysql"},
+	})
+}
+
+func (s *S) TestBindingMismatchString(c *check.C) {
+	m := BindingMismatch{Kind: BindingMissingEnvs, App: "myapp", Instance: "mydb", Service: "mysql", Fixed: true}
+	c.Assert(m.String(), check.Equals, `instance "mydb" of service "mysql" is bound to the app "myapp", but the app doesn't have its environment variables (fixed)`)
+	m = BindingMismatch{Kind: BindingStaleEnvs, App: "myapp", Instance: "mydb", Service: "mysql"}
+	c.Assert(m.String(), check.Equals, `app "myapp" has the environment variables of the instance "mydb" of service "mysql", which isn't bound to it`)
+}
@@ -6,34 +6,81 @@ package app
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/tsuru/config"
 	"github.com/tsuru/tsuru/auth"
 	"github.com/tsuru/tsuru/db"
 	"github.com/tsuru/tsuru/log"
 	"github.com/tsuru/tsuru/provision"
 	"github.com/tsuru/tsuru/repository"
 	"github.com/tsuru/tsuru/service"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
+var (
+	ErrExternalImageNotSupported = errors.New("the provisioner does not support deploying external images")
+	ErrNoDeployInProgress        = errors.New("there is no deploy in progress for this app")
+	ErrCancelDeployNotSupported  = errors.New("the provisioner does not support canceling deploys")
+)
+
+const (
+	privateEnvValue        = "*** (private variable)"
+	changedPrivateEnvValue = "*** (private variable, changed)"
+)
+
 type DeployData struct {
-	ID          bson.ObjectId `bson:"_id,omitempty"`
-	App         string
-	Timestamp   time.Time
-	Duration    time.Duration
-	Commit      string
-	Error       string
-	Image       string
-	Log         string
-	User        string
-	Origin      string
-	CanRollback bool
-	RemoveDate  time.Time `bson:",omitempty"`
+	ID            bson.ObjectId `bson:"_id,omitempty"`
+	App           string
+	Timestamp     time.Time
+	Duration      time.Duration
+	Commit        string
+	Error         string
+	Image         string
+	Log           string
+	User          string
+	Origin        string
+	CanRollback   bool
+	RemoveDate    time.Time               `bson:",omitempty"`
+	Envs          map[string]string       `bson:",omitempty"`
+	Plan          Plan                    `bson:",omitempty"`
+	TsuruYaml     provision.TsuruYamlData `bson:",omitempty"`
+	ImageLabels   map[string]string       `bson:",omitempty"`
+	ArchiveURL    string                  `bson:",omitempty"`
+	ExternalImage string                  `bson:",omitempty"`
+	// PrivateEnvs holds keyed hashes of the values of the private
+	// environment variables, used only to detect changes between deploys.
+	PrivateEnvs map[string]string `bson:",omitempty" json:"-"`
+}
+
+// DeployChange describes something that changed between two deploys. Kind
+// is one of "deploy", "env", "plan", "tsuru.yaml" and "label".
+type DeployChange struct {
+	Kind string
+	Name string
+	From string
+	To   string
+}
+
+// DeploysDiff holds the differences between two deploys. Diff contains the
+// code diff, available only for git based deploys of the same app.
+type DeploysDiff struct {
+	From    string
+	To      string
+	Changes []DeployChange
+	Diff    string
 }
 
 type DiffDeployData struct {
@@ -52,6 +99,21 @@ func (d *DiffDeployData) MarshalJSON() ([]byte, error) {
 	return json.Marshal(*d)
 }
 
+// runningDeploy represents a deploy in progress, it's removed from the
+// database when the deploy finishes. Deploys waiting in the deploy queue are
+// marked as waiting, and the API server waiting for them updates their
+// heartbeat periodically.
+type runningDeploy struct {
+	App        string `bson:"_id"`
+	User       string
+	Pool       string
+	Timestamp  time.Time
+	Started    time.Time
+	Heartbeat  time.Time
+	Waiting    bool
+	CanceledBy string
+}
+
 type DeployOptions struct {
 	App          *App
 	Version      string
@@ -61,6 +123,9 @@ type DeployOptions struct {
 	OutputStream io.Writer
 	User         string
 	Image        string
+	// ExternalImage is the name of an image built outside tsuru, available
+	// in one of the registries allowed by the provisioner.
+	ExternalImage string
 }
 
 func (app *App) ListDeploys(u *auth.User) ([]DeployData, error) {
@@ -182,6 +247,9 @@ func GetDeploy(id string, u *auth.User) (*DeployData, error) {
 		return nil, err
 	}
 	defer conn.Close()
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New("Deploy not found.")
+	}
 	if err := conn.Deploys().FindId(bson.ObjectIdHex(id)).One(&dep); err != nil {
 		return nil, err
 	}
@@ -210,15 +278,178 @@ func GetDiffInDeploys(d *DeployData) (string, error) {
 	return repository.Manager().Diff(d.App, list[1].Commit, list[0].Commit)
 }
 
+// CompareDeploys returns what changed from one deploy to another, regardless
+// of the origin of the deploys.
+func CompareDeploys(from, to *DeployData) (*DeploysDiff, error) {
+	diff := DeploysDiff{From: from.ID.Hex(), To: to.ID.Hex()}
+	fromValues := map[string]string{"app": from.App, "origin": from.Origin, "image": from.Image, "commit": from.Commit}
+	toValues := map[string]string{"app": to.App, "origin": to.Origin, "image": to.Image, "commit": to.Commit}
+	diff.Changes = append(diff.Changes, deployChanges("deploy", fromValues, toValues)...)
+	diff.Changes = append(diff.Changes, deployChanges("env", from.Envs, changedPrivateEnvs(from, to))...)
+	diff.Changes = append(diff.Changes, deployChanges("plan", planValues(from.Plan), planValues(to.Plan))...)
+	diff.Changes = append(diff.Changes, deployChanges("tsuru.yaml", tsuruYamlValues(from.TsuruYaml), tsuruYamlValues(to.TsuruYaml))...)
+	diff.Changes = append(diff.Changes, deployChanges("label", from.ImageLabels, to.ImageLabels)...)
+	if from.App == to.App && from.Origin == "git" && to.Origin == "git" && from.Commit != to.Commit {
+		code, err := repository.Manager().Diff(from.App, from.Commit, to.Commit)
+		if err != nil {
+			return nil, err
+		}
+		diff.Diff = code
+	}
+	return &diff, nil
+}
+
+func deployChanges(kind string, from, to map[string]string) []DeployChange {
+	names := make([]string, 0, len(from)+len(to))
+	for name := range from {
+		names = append(names, name)
+	}
+	for name := range to {
+		if _, ok := from[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var changes []DeployChange
+	for _, name := range names {
+		if from[name] != to[name] {
+			changes = append(changes, DeployChange{Kind: kind, Name: name, From: from[name], To: to[name]})
+		}
+	}
+	return changes
+}
+
+func planValues(plan Plan) map[string]string {
+	if plan.Name == "" {
+		return nil
+	}
+	return map[string]string{
+		"name":     plan.Name,
+		"memory":   strconv.FormatInt(plan.Memory, 10),
+		"swap":     strconv.FormatInt(plan.Swap, 10),
+		"cpushare": strconv.Itoa(plan.CpuShare),
+		"router":   plan.Router,
+	}
+}
+
+func tsuruYamlValues(data provision.TsuruYamlData) map[string]string {
+	values := map[string]string{
+		"hooks.restart.before": strings.Join(data.Hooks.Restart.Before, "\n"),
+		"hooks.restart.after":  strings.Join(data.Hooks.Restart.After, "\n"),
+		"hooks.build":          strings.Join(data.Hooks.Build, "\n"),
+		"healthcheck.path":     data.Healthcheck.Path,
+		"healthcheck.method":   data.Healthcheck.Method,
+		"healthcheck.match":    data.Healthcheck.Match,
+	}
+	if data.Healthcheck.Status != 0 {
+		values["healthcheck.status"] = strconv.Itoa(data.Healthcheck.Status)
+	}
+	if data.Healthcheck.AllowedFailures != 0 {
+		values["healthcheck.allowed_failures"] = strconv.Itoa(data.Healthcheck.AllowedFailures)
+	}
+	return values
+}
+
+const privateEnvKeyID = "deploy-private-env-key"
+
+// privateEnvKey returns the key used to hash the values of private
+// environment variables. It's the one defined in deploy:private-env-key or,
+// when it's not defined, a random key generated in the first use and stored in
+// the database.
+func privateEnvKey() (string, error) {
+	if key, _ := config.GetString("deploy:private-env-key"); key != "" {
+		return key, nil
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	var secret struct {
+		Value string
+	}
+	err = conn.Secrets().FindId(privateEnvKeyID).One(&secret)
+	if err == nil {
+		return secret.Value, nil
+	}
+	if err != mgo.ErrNotFound {
+		return "", err
+	}
+	var b [32]byte
+	if _, err = rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	secret.Value = hex.EncodeToString(b[:])
+	err = conn.Secrets().Insert(bson.M{"_id": privateEnvKeyID, "value": secret.Value})
+	if mgo.IsDup(err) {
+		err = conn.Secrets().FindId(privateEnvKeyID).One(&secret)
+	}
+	if err != nil {
+		return "", err
+	}
+	return secret.Value, nil
+}
+
+// deployEnvs returns a snapshot of the environment variables of the app.
+// Values of private variables are not stored: they're replaced by a
+// placeholder, and their hashes, keyed with key, are returned separately, so
+// changes can be detected without exposing the values.
+func deployEnvs(app *App, key string) (map[string]string, map[string]string) {
+	envs := make(map[string]string, len(app.Env))
+	private := make(map[string]string)
+	for name, env := range app.Env {
+		if env.Public {
+			envs[name] = env.Value
+			continue
+		}
+		envs[name] = privateEnvValue
+		if key != "" {
+			mac := hmac.New(sha256.New, []byte(key))
+			mac.Write([]byte(env.Value))
+			private[name] = hex.EncodeToString(mac.Sum(nil))
+		}
+	}
+	return envs, private
+}
+
+// changedPrivateEnvs returns the environment variables of the deploy to,
+// marking the private variables whose value changed since the deploy from.
+func changedPrivateEnvs(from, to *DeployData) map[string]string {
+	envs := make(map[string]string, len(to.Envs))
+	for name, value := range to.Envs {
+		envs[name] = value
+		fromHash, ok := from.PrivateEnvs[name]
+		if ok && from.Envs[name] == privateEnvValue && value == privateEnvValue && fromHash != to.PrivateEnvs[name] {
+			envs[name] = changedPrivateEnvValue
+		}
+	}
+	return envs
+}
+
 // Deploy runs a deployment of an application. It will first try to run an
-// archive based deploy (if opts.ArchiveURL is not empty), and then fallback to
-// the Git based deployment.
+// image based deploy (if opts.ExternalImage or opts.Image is not empty), then
+// an upload or archive based deploy (if opts.File or opts.ArchiveURL is not
+// empty), and then fallback to the Git based deployment.
 func Deploy(opts DeployOptions) error {
 	var outBuffer bytes.Buffer
 	start := time.Now()
 	logWriter := LogWriter{App: opts.App, Writer: opts.OutputStream}
 	writer := io.MultiWriter(&outBuffer, &logWriter)
-	imageId, err := deployToProvisioner(&opts, writer)
+	err := startRunningDeploy(&opts)
+	if err != nil {
+		return err
+	}
+	if platform, err := getPlatform(opts.App.Platform); err == nil && platform.Deprecated() {
+		fmt.Fprintf(writer, "---- WARNING: the platform %s is deprecated, consider moving the app to another platform ----\n", platform.Name)
+	}
+	var imageId string
+	err = waitDeployQueue(opts.App, writer)
+	if err == nil {
+		units := len(opts.App.Units())
+		imageId, err = deployToProvisioner(&opts, writer)
+		opts.App.recordUnitsChange(units)
+	}
+	err = finishRunningDeploy(opts.App.Name, err)
 	elapsed := time.Since(start)
 	saveErr := saveDeployData(&opts, imageId, outBuffer.String(), elapsed, err)
 	if saveErr != nil {
@@ -237,7 +468,113 @@ func Deploy(opts DeployOptions) error {
 	return nil
 }
 
+func startRunningDeploy(opts *DeployOptions) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	removeStaleRunningDeploys(conn)
+	pool, err := opts.App.effectivePool()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	deploy := runningDeploy{
+		App:       opts.App.Name,
+		User:      opts.User,
+		Pool:      pool,
+		Timestamp: now,
+		Started:   now,
+		Heartbeat: now,
+	}
+	if deployQueueEnabled() {
+		deploy.Started = time.Time{}
+		deploy.Waiting = true
+	}
+	_, err = conn.RunningDeploys().UpsertId(deploy.App, deploy)
+	return err
+}
+
+// removeStaleRunningDeploys removes the deploys in progress left behind by API
+// servers that died in the middle of a deploy: deploys running for longer
+// than staleDeployTimeout, deploys waiting in the queue for longer than the
+// queue timeout and deploys waiting without a recent heartbeat.
+func removeStaleRunningDeploys(conn *db.Storage) {
+	now := time.Now()
+	_, err := conn.RunningDeploys().RemoveAll(bson.M{"$or": []bson.M{
+		{"waiting": false, "started": bson.M{"$lt": now.Add(-staleDeployTimeout)}},
+		{"waiting": true, "timestamp": bson.M{"$lt": now.Add(-deployQueueTimeout())}},
+		{"waiting": true, "heartbeat": bson.M{"$lt": now.Add(-deployQueueHeartbeatTimeout)}},
+	}})
+	if err != nil {
+		log.Errorf("unable to remove stale deploys in progress: %s", err)
+	}
+}
+
+// finishRunningDeploy removes the deploy of the app from the list of deploys
+// in progress, returning the error that should be recorded for the deploy:
+// canceled deploys are always reported as a cancellation.
+func finishRunningDeploy(appName string, deployErr error) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return deployErr
+	}
+	defer conn.Close()
+	var deploy runningDeploy
+	_, err = conn.RunningDeploys().FindId(appName).Apply(mgo.Change{Remove: true}, &deploy)
+	if err != nil || deploy.CanceledBy == "" {
+		return deployErr
+	}
+	return fmt.Errorf("canceled by %s", deploy.CanceledBy)
+}
+
+// CancelDeploy cancels the deploy in progress for the given app, marking it
+// as canceled by the given user. Deploys waiting in the deploy queue give up
+// waiting, while the provisioner stops the build of running deploys, rolling
+// them back. It returns ErrNoDeployInProgress when there is no deploy to
+// cancel, and the error of the provisioner when it can't cancel the deploy,
+// in which case the deploy is not marked as canceled.
+func CancelDeploy(app *App, user string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	removeStaleRunningDeploys(conn)
+	var deploy runningDeploy
+	_, err = conn.RunningDeploys().Find(bson.M{"_id": app.Name, "canceledby": bson.M{"$in": []interface{}{"", nil}}}).Apply(
+		mgo.Change{Update: bson.M{"$set": bson.M{"canceledby": user}}},
+		&deploy,
+	)
+	if err == mgo.ErrNotFound {
+		return ErrNoDeployInProgress
+	}
+	if err != nil {
+		return err
+	}
+	if deploy.Waiting {
+		return nil
+	}
+	canceler, ok := Provisioner.(provision.DeployCanceler)
+	if !ok {
+		err = ErrCancelDeployNotSupported
+	} else {
+		err = canceler.CancelDeploy(app)
+	}
+	if err != nil {
+		conn.RunningDeploys().UpdateId(app.Name, bson.M{"$set": bson.M{"canceledby": ""}})
+	}
+	return err
+}
+
 func deployToProvisioner(opts *DeployOptions, writer io.Writer) (string, error) {
+	if opts.ExternalImage != "" {
+		if deployer, ok := Provisioner.(provision.ExternalImageDeployer); ok {
+			return deployer.ExternalImageDeploy(opts.App, opts.ExternalImage, writer)
+		}
+		return "", ErrExternalImageNotSupported
+	}
 	if opts.Image != "" {
 		if deployer, ok := Provisioner.(provision.ImageDeployer); ok {
 			return deployer.ImageDeploy(opts.App, opts.Image, writer)
@@ -256,7 +593,7 @@ func deployToProvisioner(opts *DeployOptions, writer io.Writer) (string, error)
 	return Provisioner.(provision.GitDeployer).GitDeploy(opts.App, opts.Version, writer)
 }
 
-func saveDeployData(opts *DeployOptions, imageId, log string, duration time.Duration, deployError error) error {
+func saveDeployData(opts *DeployOptions, imageId, deployLog string, duration time.Duration, deployError error) error {
 	conn, err := db.Conn()
 	if err != nil {
 		return err
@@ -268,19 +605,38 @@ func saveDeployData(opts *DeployOptions, imageId, log string, duration time.Dura
 		Duration:  duration,
 		Commit:    opts.Commit,
 		Image:     imageId,
-		Log:       log,
+		Log:       deployLog,
 		User:      opts.User,
 	}
 	if opts.Commit != "" {
 		deploy.Origin = "git"
 	} else if opts.Image != "" {
 		deploy.Origin = "rollback"
+	} else if opts.ExternalImage != "" {
+		deploy.Origin = "image"
+		deploy.ExternalImage = opts.ExternalImage
 	} else {
 		deploy.Origin = "app-deploy"
+		deploy.ArchiveURL = opts.ArchiveURL
 	}
 	if deployError != nil {
 		deploy.Error = deployError.Error()
 	}
+	key, err := privateEnvKey()
+	if err != nil {
+		log.Errorf("WARNING: couldn't get the key to hash private env vars: %s", err)
+	}
+	deploy.Envs, deploy.PrivateEnvs = deployEnvs(opts.App, key)
+	deploy.Plan = opts.App.Plan
+	if provider, ok := Provisioner.(provision.ImageDataProvider); ok && imageId != "" {
+		data, err := provider.ImageData(imageId)
+		if err != nil {
+			log.Errorf("WARNING: couldn't get data from image %s: %s", imageId, err)
+		} else {
+			deploy.TsuruYaml = data.TsuruYaml
+			deploy.ImageLabels = data.Labels
+		}
+	}
 	return conn.Deploys().Insert(deploy)
 }
 
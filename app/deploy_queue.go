@@ -0,0 +1,286 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/monsterqueue"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/log"
+	"github.com/tsuru/tsuru/queue"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	deployQueueTaskName = "deploy-queue"
+
+	// staleDeployTimeout is the time after which a deploy is not considered
+	// in the deploy queue limits anymore, preventing deploys from API
+	// servers that died in the middle of a deploy from blocking the queue.
+	staleDeployTimeout = 2 * time.Hour
+
+	defaultDeployQueueTimeout = time.Hour
+)
+
+var (
+	deployQueueInterval         = 500 * time.Millisecond
+	deployQueuePositionInterval = 5 * time.Second
+
+	// deployQueueHeartbeatTimeout is the time after which a deploy waiting
+	// in the queue without heartbeats is considered abandoned by an API
+	// server that died, and removed from the queue. The heartbeat is
+	// updated along with the position of the deploy in the queue.
+	deployQueueHeartbeatTimeout = 30 * time.Second
+)
+
+// deployQueueTask is the task that waits until the deploy of an app can run
+// without exceeding the limits of concurrent deploys.
+type deployQueueTask struct{}
+
+func (t *deployQueueTask) Name() string {
+	return deployQueueTaskName
+}
+
+func (t *deployQueueTask) Run(job monsterqueue.Job) {
+	appName, _ := job.Parameters()["app"].(string)
+	for {
+		admitted, err := admitDeploy(appName)
+		if err != nil {
+			job.Error(err)
+			return
+		}
+		if admitted {
+			job.Success(true)
+			return
+		}
+		time.Sleep(deployQueueInterval)
+	}
+}
+
+// InitializeDeployQueue registers the task used by the deploy queue. It must
+// be called in the startup of the API server whenever deploys are limited
+// through the settings deploy:queue:max-concurrent and
+// deploy:queue:max-concurrent-per-pool.
+func InitializeDeployQueue() error {
+	if !deployQueueEnabled() {
+		return nil
+	}
+	q, err := queue.Queue()
+	if err != nil {
+		return err
+	}
+	return q.RegisterTask(&deployQueueTask{})
+}
+
+func deployQueueLimits() (int, int) {
+	maxGlobal, _ := config.GetInt("deploy:queue:max-concurrent")
+	maxPerPool, _ := config.GetInt("deploy:queue:max-concurrent-per-pool")
+	return maxGlobal, maxPerPool
+}
+
+func deployQueueEnabled() bool {
+	maxGlobal, maxPerPool := deployQueueLimits()
+	return maxGlobal > 0 || maxPerPool > 0
+}
+
+func deployQueueTimeout() time.Duration {
+	timeout, err := config.GetInt("deploy:queue:timeout")
+	if err != nil || timeout <= 0 {
+		return defaultDeployQueueTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// waitDeployQueue blocks until the deploy of the app is allowed to run by the
+// deploy queue, reporting the position of the deploy in the queue to the
+// given writer.
+func waitDeployQueue(app *App, w io.Writer) error {
+	if !deployQueueEnabled() {
+		return nil
+	}
+	q, err := queue.Queue()
+	if err != nil {
+		return err
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reportDeployQueuePosition(app.Name, w, quit)
+	}()
+	timeout := deployQueueTimeout()
+	job, err := q.EnqueueWait(deployQueueTaskName, monsterqueue.JobParams{"app": app.Name}, timeout)
+	close(quit)
+	<-done
+	if err != nil {
+		if err == monsterqueue.ErrQueueWaitTimeout {
+			return fmt.Errorf("timed out after %v waiting in the deploy queue", timeout)
+		}
+		return err
+	}
+	_, err = job.Result()
+	return err
+}
+
+func reportDeployQueuePosition(appName string, w io.Writer, quit <-chan struct{}) {
+	var lastPosition int
+	for {
+		if err := touchQueuedDeploy(appName); err != nil {
+			log.Errorf("[deploy-queue] unable to update the heartbeat of %q in the queue: %s", appName, err)
+		}
+		position, err := deployQueuePosition(appName)
+		if err != nil {
+			log.Errorf("[deploy-queue] unable to get the position of %q in the queue: %s", appName, err)
+		} else if position > 0 && position != lastPosition {
+			fmt.Fprintf(w, "---- Deploy queued, position %d in the queue ----\n", position)
+			lastPosition = position
+		}
+		select {
+		case <-quit:
+			return
+		case <-time.After(deployQueuePositionInterval):
+		}
+	}
+}
+
+// touchQueuedDeploy updates the heartbeat of the deploy of the app while it
+// waits in the queue.
+func touchQueuedDeploy(appName string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.RunningDeploys().Update(
+		bson.M{"_id": appName, "waiting": true},
+		bson.M{"$set": bson.M{"heartbeat": time.Now()}},
+	)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// deployQueuePosition returns the position of the deploy of the app in the
+// queue of its pool, or zero if the deploy is not waiting anymore.
+func deployQueuePosition(appName string) (int, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	var deploy runningDeploy
+	err = conn.RunningDeploys().FindId(appName).One(&deploy)
+	if err != nil {
+		return 0, err
+	}
+	if !deploy.Waiting {
+		return 0, nil
+	}
+	ahead, err := conn.RunningDeploys().Find(waitingAheadQuery(&deploy)).Count()
+	if err != nil {
+		return 0, err
+	}
+	return ahead + 1, nil
+}
+
+func waitingAheadQuery(deploy *runningDeploy) bson.M {
+	return bson.M{
+		"pool":    deploy.Pool,
+		"waiting": true,
+		"timestamp": bson.M{
+			"$lt": deploy.Timestamp,
+			"$gt": time.Now().Add(-deployQueueTimeout()),
+		},
+		"heartbeat": bson.M{"$gt": time.Now().Add(-deployQueueHeartbeatTimeout)},
+	}
+}
+
+// admitDeploy checks whether the deploy of the given app can run without
+// exceeding the limits of concurrent deploys, marking it as running. Deploys
+// run in the order they were queued in each pool.
+func admitDeploy(appName string) (bool, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	var deploy runningDeploy
+	err = conn.RunningDeploys().FindId(appName).One(&deploy)
+	if err != nil {
+		return false, err
+	}
+	if deploy.CanceledBy != "" {
+		return false, fmt.Errorf("canceled by %s", deploy.CanceledBy)
+	}
+	if !deploy.Waiting {
+		return true, nil
+	}
+	if deploy.Heartbeat.Before(time.Now().Add(-deployQueueHeartbeatTimeout)) {
+		conn.RunningDeploys().Remove(bson.M{"_id": appName, "waiting": true, "heartbeat": deploy.Heartbeat})
+		return false, fmt.Errorf("abandoned while waiting in the deploy queue")
+	}
+	locked, err := acquireDeployQueueLock(conn)
+	if err != nil || !locked {
+		return false, err
+	}
+	defer releaseDeployQueueLock(conn)
+	ahead, err := conn.RunningDeploys().Find(waitingAheadQuery(&deploy)).Count()
+	if err != nil || ahead > 0 {
+		return false, err
+	}
+	maxGlobal, maxPerPool := deployQueueLimits()
+	running := bson.M{"waiting": false, "started": bson.M{"$gt": time.Now().Add(-staleDeployTimeout)}}
+	if maxGlobal > 0 {
+		n, err := conn.RunningDeploys().Find(running).Count()
+		if err != nil || n >= maxGlobal {
+			return false, err
+		}
+	}
+	if maxPerPool > 0 {
+		running["pool"] = deploy.Pool
+		n, err := conn.RunningDeploys().Find(running).Count()
+		if err != nil || n >= maxPerPool {
+			return false, err
+		}
+	}
+	err = conn.RunningDeploys().Update(
+		bson.M{"_id": appName, "canceledby": ""},
+		bson.M{"$set": bson.M{"waiting": false, "started": time.Now()}},
+	)
+	if err == mgo.ErrNotFound {
+		return false, fmt.Errorf("canceled while waiting in the deploy queue")
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// acquireDeployQueueLock acquires the lock used to serialize the admission
+// of deploys among API servers, the lock expires after one minute.
+func acquireDeployQueueLock(conn *db.Storage) (bool, error) {
+	now := time.Now()
+	_, err := conn.Collection("deploy_queue_lock").Upsert(
+		bson.M{"_id": "lock", "$or": []bson.M{{"locked": false}, {"acquiredate": bson.M{"$lt": now.Add(-time.Minute)}}}},
+		bson.M{"$set": bson.M{"locked": true, "acquiredate": now}},
+	)
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func releaseDeployQueueLock(conn *db.Storage) {
+	err := conn.Collection("deploy_queue_lock").UpdateId("lock", bson.M{"$set": bson.M{"locked": false}})
+	if err != nil {
+		log.Errorf("[deploy-queue] unable to release the queue lock: %s", err)
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/queue"
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) setDeployQueueLimits(global, perPool int) {
+	config.Set("deploy:queue:max-concurrent", global)
+	config.Set("deploy:queue:max-concurrent-per-pool", perPool)
+}
+
+func (s *S) unsetDeployQueueLimits() {
+	config.Unset("deploy:queue")
+	s.conn.RunningDeploys().RemoveAll(nil)
+	s.conn.Collection("deploy_queue_lock").RemoveAll(nil)
+}
+
+func (s *S) TestDeployQueueEnabled(c *check.C) {
+	defer s.unsetDeployQueueLimits()
+	c.Assert(deployQueueEnabled(), check.Equals, false)
+	s.setDeployQueueLimits(0, 2)
+	c.Assert(deployQueueEnabled(), check.Equals, true)
+	s.setDeployQueueLimits(3, 0)
+	c.Assert(deployQueueEnabled(), check.Equals, true)
+}
+
+func (s *S) TestStartRunningDeployWithQueue(c *check.C) {
+	s.setDeployQueueLimits(1, 0)
+	defer s.unsetDeployQueueLimits()
+	a := App{Name: "someApp", Pool: "pool1"}
+	err := startRunningDeploy(&DeployOptions{App: &a, User: "someone@tsuru.io"})
+	c.Assert(err, check.IsNil)
+	var deploy runningDeploy
+	err = s.conn.RunningDeploys().FindId(a.Name).One(&deploy)
+	c.Assert(err, check.IsNil)
+	c.Assert(deploy.Waiting, check.Equals, true)
+	c.Assert(deploy.Pool, check.Equals, "pool1")
+	c.Assert(deploy.Started.IsZero(), check.Equals, true)
+}
+
+func (s *S) TestStartRunningDeployWithQueueTeamPool(c *check.C) {
+	s.setDeployQueueLimits(0, 1)
+	defer s.unsetDeployQueueLimits()
+	err := provision.AddPool("teampool")
+	c.Assert(err, check.IsNil)
+	defer provision.RemovePool("teampool")
+	err = provision.AddTeamsToPool("teampool", []string{"tsuruteam"})
+	c.Assert(err, check.IsNil)
+	a := App{Name: "someApp", TeamOwner: "tsuruteam"}
+	err = startRunningDeploy(&DeployOptions{App: &a, User: "someone@tsuru.io"})
+	c.Assert(err, check.IsNil)
+	var deploy runningDeploy
+	err = s.conn.RunningDeploys().FindId(a.Name).One(&deploy)
+	c.Assert(err, check.IsNil)
+	c.Assert(deploy.Pool, check.Equals, "teampool")
+	c.Assert(deploy.Heartbeat.IsZero(), check.Equals, false)
+}
+
+func (s *S) TestAdmitDeployGlobalLimit(c *check.C) {
+	s.setDeployQueueLimits(1, 0)
+	defer s.unsetDeployQueueLimits()
+	now := time.Now()
+	err := s.conn.RunningDeploys().Insert(
+		runningDeploy{App: "app1", Pool: "pool1", Timestamp: now.Add(-time.Minute), Started: now},
+		runningDeploy{App: "app2", Pool: "pool2", Timestamp: now, Heartbeat: now, Waiting: true},
+	)
+	c.Assert(err, check.IsNil)
+	admitted, err := admitDeploy("app2")
+	c.Assert(err, check.IsNil)
+	c.Assert(admitted, check.Equals, false)
+	err = s.conn.RunningDeploys().RemoveId("app1")
+	c.Assert(err, check.IsNil)
+	admitted, err = admitDeploy("app2")
+	c.Assert(err, check.IsNil)
+	c.Assert(admitted, check.Equals, true)
+	var deploy runningDeploy
+	err = s.conn.RunningDeploys().FindId("app2").One(&deploy)
+	c.Assert(err, check.IsNil)
+	c.Assert(deploy.Waiting, check.Equals, false)
+	c.Assert(deploy.Started.IsZero(), check.Equals, false)
+}
+
+func (s *S) TestAdmitDeployPerPoolLimit(c *check.C) {
+	s.setDeployQueueLimits(0, 1)
+	defer s.unsetDeployQueueLimits()
+	now := time.Now()
+	err := s.conn.RunningDeploys().Insert(
+		runningDeploy{App: "app1", Pool: "pool1", Timestamp: now.Add(-time.Minute), Started: now},
+		runningDeploy{App: "app2", Pool: "pool1", Timestamp: now, Heartbeat: now, Waiting: true},
+		runningDeploy{App: "app3", Pool: "pool2", Timestamp: now, Heartbeat: now, Waiting: true},
+	)
+	c.Assert(err, check.IsNil)
+	admitted, err := admitDeploy("app2")
+	c.Assert(err, check.IsNil)
+	c.Assert(admitted, check.Equals, false)
+	admitted, err = admitDeploy("app3")
+	c.Assert(err, check.IsNil)
+	c.Assert(admitted, check.Equals, true)
+}
+
+func (s *S) TestAdmitDeployIgnoresStaleDeploys(c *check.C) {
+	s.setDeployQueueLimits(1, 0)
+	defer s.unsetDeployQueueLimits()
+	now := time.Now()
+	err := s.conn.RunningDeploys().Insert(
+		runningDeploy{App: "app1", Timestamp: now.Add(-3 * time.Hour), Started: now.Add(-3 * time.Hour)},
+		runningDeploy{App: "app2", Timestamp: now, Heartbeat: now, Waiting: true},
+	)
+	c.Assert(err, check.IsNil)
+	admitted, err := admitDeploy("app2")
+	c.Assert(err, check.IsNil)
+	c.Assert(admitted, check.Equals, true)
+}
+
+func (s *S) TestAdmitDeployKeepsOrderInPool(c *check.C) {
+	s.setDeployQueueLimits(0, 1)
+	defer s.unsetDeployQueueLimits()
+	now := time.Now()
+	err := s.conn.RunningDeploys().Insert(
+		runningDeploy{App: "app1", Pool: "pool1", Timestamp: now.Add(-time.Minute), Heartbeat: now, Waiting: true},
+		runningDeploy{App: "app2", Pool: "pool1", Timestamp: now, Heartbeat: now, Waiting: true},
+	)
+	c.Assert(err, check.IsNil)
+	admitted, err := admitDeploy("app2")
+	c.Assert(err, check.IsNil)
+	c.Assert(admitted, check.Equals, false)
+	admitted, err = admitDeploy("app1")
+	c.Assert(err, check.IsNil)
+	c.Assert(admitted, check.Equals, true)
+}
+
+func (s *S) TestAdmitDeployIgnoresAbandonedDeploys(c *check.C) {
+	s.setDeployQueueLimits(0, 1)
+	defer s.unsetDeployQueueLimits()
+	now := time.Now()
+	err := s.conn.RunningDeploys().Insert(
+		runningDeploy{App: "app1", Pool: "pool1", Timestamp: now.Add(-time.Minute), Heartbeat: now.Add(-time.Minute), Waiting: true},
+		runningDeploy{App: "app2", Pool: "pool1", Timestamp: now, Heartbeat: now, Waiting: true},
+	)
+	c.Assert(err, check.IsNil)
+	admitted, err := admitDeploy("app2")
+	c.Assert(err, check.IsNil)
+	c.Assert(admitted, check.Equals, true)
+	admitted, err = admitDeploy("app1")
+	c.Assert(err, check.ErrorMatches, "abandoned while waiting in the deploy queue")
+	c.Assert(admitted, check.Equals, false)
+	n, err := s.conn.RunningDeploys().FindId("app1").Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 0)
+}
+
+func (s *S) TestTouchQueuedDeploy(c *check.C) {
+	defer s.unsetDeployQueueLimits()
+	old := time.Now().Add(-time.Minute)
+	err := s.conn.RunningDeploys().Insert(runningDeploy{App: "app1", Timestamp: old, Heartbeat: old, Waiting: true})
+	c.Assert(err, check.IsNil)
+	err = touchQueuedDeploy("app1")
+	c.Assert(err, check.IsNil)
+	var deploy runningDeploy
+	err = s.conn.RunningDeploys().FindId("app1").One(&deploy)
+	c.Assert(err, check.IsNil)
+	c.Assert(deploy.Heartbeat.After(old.Add(time.Second)), check.Equals, true)
+	err = touchQueuedDeploy("app2")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestAdmitDeployCanceled(c *check.C) {
+	s.setDeployQueueLimits(1, 0)
+	defer s.unsetDeployQueueLimits()
+	err := s.conn.RunningDeploys().Insert(runningDeploy{App: "app1", Timestamp: time.Now(), Waiting: true, CanceledBy: "admin@tsuru.io"})
+	c.Assert(err, check.IsNil)
+	admitted, err := admitDeploy("app1")
+	c.Assert(err, check.ErrorMatches, "canceled by admin@tsuru.io")
+	c.Assert(admitted, check.Equals, false)
+}
+
+func (s *S) TestAdmitDeployLocked(c *check.C) {
+	s.setDeployQueueLimits(1, 0)
+	defer s.unsetDeployQueueLimits()
+	err := s.conn.RunningDeploys().Insert(runningDeploy{App: "app1", Timestamp: time.Now(), Heartbeat: time.Now(), Waiting: true})
+	c.Assert(err, check.IsNil)
+	err = s.conn.Collection("deploy_queue_lock").Insert(bson.M{"_id": "lock", "locked": true, "acquiredate": time.Now()})
+	c.Assert(err, check.IsNil)
+	admitted, err := admitDeploy("app1")
+	c.Assert(err, check.IsNil)
+	c.Assert(admitted, check.Equals, false)
+	err = s.conn.Collection("deploy_queue_lock").UpdateId("lock", bson.M{"$set": bson.M{"acquiredate": time.Now().Add(-2 * time.Minute)}})
+	c.Assert(err, check.IsNil)
+	admitted, err = admitDeploy("app1")
+	c.Assert(err, check.IsNil)
+	c.Assert(admitted, check.Equals, true)
+}
+
+func (s *S) TestDeployQueuePosition(c *check.C) {
+	s.setDeployQueueLimits(0, 1)
+	defer s.unsetDeployQueueLimits()
+	now := time.Now()
+	err := s.conn.RunningDeploys().Insert(
+		runningDeploy{App: "app1", Pool: "pool1", Timestamp: now.Add(-2 * time.Minute), Started: now},
+		runningDeploy{App: "app2", Pool: "pool1", Timestamp: now.Add(-time.Minute), Heartbeat: now, Waiting: true},
+		runningDeploy{App: "app3", Pool: "pool1", Timestamp: now, Heartbeat: now, Waiting: true},
+		runningDeploy{App: "app4", Pool: "pool2", Timestamp: now.Add(-time.Minute), Heartbeat: now, Waiting: true},
+	)
+	c.Assert(err, check.IsNil)
+	position, err := deployQueuePosition("app1")
+	c.Assert(err, check.IsNil)
+	c.Assert(position, check.Equals, 0)
+	position, err = deployQueuePosition("app2")
+	c.Assert(err, check.IsNil)
+	c.Assert(position, check.Equals, 1)
+	position, err = deployQueuePosition("app3")
+	c.Assert(err, check.IsNil)
+	c.Assert(position, check.Equals, 2)
+}
+
+func (s *S) TestWaitDeployQueue(c *check.C) {
+	s.setDeployQueueLimits(1, 0)
+	defer s.unsetDeployQueueLimits()
+	queue.ResetQueue()
+	defer queue.ResetQueue()
+	err := InitializeDeployQueue()
+	c.Assert(err, check.IsNil)
+	oldInterval := deployQueueInterval
+	deployQueueInterval = 50 * time.Millisecond
+	defer func() { deployQueueInterval = oldInterval }()
+	now := time.Now()
+	err = s.conn.RunningDeploys().Insert(
+		runningDeploy{App: "app1", Timestamp: now.Add(-time.Minute), Started: now},
+		runningDeploy{App: "app2", Timestamp: now, Heartbeat: now, Waiting: true},
+	)
+	c.Assert(err, check.IsNil)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		s.conn.RunningDeploys().RemoveId("app1")
+	}()
+	var buf bytes.Buffer
+	err = waitDeployQueue(&App{Name: "app2"}, &buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "---- Deploy queued, position 1 in the queue ----\n")
+	var deploy runningDeploy
+	err = s.conn.RunningDeploys().FindId("app2").One(&deploy)
+	c.Assert(err, check.IsNil)
+	c.Assert(deploy.Waiting, check.Equals, false)
+}
+
+func (s *S) TestWaitDeployQueueDisabled(c *check.C) {
+	var buf bytes.Buffer
+	err := waitDeployQueue(&App{Name: "app1"}, &buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "")
+}
@@ -6,13 +6,20 @@ package app
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"strings"
 	"time"
 
 	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/app/bind"
 	"github.com/tsuru/tsuru/auth"
 	"github.com/tsuru/tsuru/auth/native"
+	"github.com/tsuru/tsuru/provision"
 	"github.com/tsuru/tsuru/provision/provisiontest"
 	"github.com/tsuru/tsuru/repository"
 	"github.com/tsuru/tsuru/repository/repositorytest"
@@ -383,6 +390,148 @@ func (s *S) TestGetDeployNotFound(c *check.C) {
 	c.Assert(deploy, check.IsNil)
 }
 
+func (s *S) TestGetDeployInvalidID(c *check.C) {
+	deploy, err := GetDeploy("invalid", nil)
+	c.Assert(err, check.ErrorMatches, "Deploy not found.")
+	c.Assert(deploy, check.IsNil)
+}
+
+func (s *S) TestCompareDeploys(c *check.C) {
+	from := DeployData{
+		ID:     bson.NewObjectId(),
+		App:    "g1",
+		Image:  "tsuru/app-g1:v1",
+		Origin: "app-deploy",
+		Envs:   map[string]string{"DATABASE_HOST": "10.0.0.1", "DEBUG": "1"},
+		Plan:   Plan{Name: "small", Memory: 128, Swap: 0, CpuShare: 50},
+		TsuruYaml: provision.TsuruYamlData{
+			Healthcheck: provision.TsuruYamlHealthcheck{Path: "/"},
+		},
+		ImageLabels: map[string]string{"version": "1.0"},
+	}
+	to := DeployData{
+		ID:     bson.NewObjectId(),
+		App:    "g1",
+		Image:  "tsuru/app-g1:v2",
+		Origin: "image",
+		Envs:   map[string]string{"DATABASE_HOST": "10.0.0.2", "NEW_RELIC": "on"},
+		Plan:   Plan{Name: "medium", Memory: 256, Swap: 0, CpuShare: 50},
+		TsuruYaml: provision.TsuruYamlData{
+			Healthcheck: provision.TsuruYamlHealthcheck{Path: "/healthcheck", Status: 200},
+		},
+		ImageLabels: map[string]string{"version": "1.1"},
+	}
+	diff, err := CompareDeploys(&from, &to)
+	c.Assert(err, check.IsNil)
+	c.Assert(diff.From, check.Equals, from.ID.Hex())
+	c.Assert(diff.To, check.Equals, to.ID.Hex())
+	c.Assert(diff.Diff, check.Equals, "")
+	expected := []DeployChange{
+		{Kind: "deploy", Name: "image", From: "tsuru/app-g1:v1", To: "tsuru/app-g1:v2"},
+		{Kind: "deploy", Name: "origin", From: "app-deploy", To: "image"},
+		{Kind: "env", Name: "DATABASE_HOST", From: "10.0.0.1", To: "10.0.0.2"},
+		{Kind: "env", Name: "DEBUG", From: "1", To: ""},
+		{Kind: "env", Name: "NEW_RELIC", From: "", To: "on"},
+		{Kind: "plan", Name: "memory", From: "128", To: "256"},
+		{Kind: "plan", Name: "name", From: "small", To: "medium"},
+		{Kind: "tsuru.yaml", Name: "healthcheck.path", From: "/", To: "/healthcheck"},
+		{Kind: "tsuru.yaml", Name: "healthcheck.status", From: "", To: "200"},
+		{Kind: "label", Name: "version", From: "1.0", To: "1.1"},
+	}
+	c.Assert(diff.Changes, check.DeepEquals, expected)
+}
+
+func (s *S) TestCompareDeploysPrivateEnvs(c *check.C) {
+	from := DeployData{
+		ID:          bson.NewObjectId(),
+		App:         "g1",
+		Envs:        map[string]string{"PASSWORD": "*** (private variable)", "TOKEN": "*** (private variable)"},
+		PrivateEnvs: map[string]string{"PASSWORD": "hash1", "TOKEN": "hash2"},
+	}
+	to := DeployData{
+		ID:          bson.NewObjectId(),
+		App:         "g1",
+		Envs:        map[string]string{"PASSWORD": "*** (private variable)", "TOKEN": "*** (private variable)"},
+		PrivateEnvs: map[string]string{"PASSWORD": "hash3", "TOKEN": "hash2"},
+	}
+	diff, err := CompareDeploys(&from, &to)
+	c.Assert(err, check.IsNil)
+	c.Assert(diff.Changes, check.DeepEquals, []DeployChange{
+		{Kind: "env", Name: "PASSWORD", From: "*** (private variable)", To: "*** (private variable, changed)"},
+	})
+}
+
+func (s *S) TestPrivateEnvKey(c *check.C) {
+	config.Set("deploy:private-env-key", "deploy-secret")
+	defer config.Unset("deploy:private-env-key")
+	key, err := privateEnvKey()
+	c.Assert(err, check.IsNil)
+	c.Assert(key, check.Equals, "deploy-secret")
+	n, err := s.conn.Secrets().Find(nil).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 0)
+}
+
+func (s *S) TestPrivateEnvKeyGenerated(c *check.C) {
+	defer s.conn.Secrets().RemoveId(privateEnvKeyID)
+	key, err := privateEnvKey()
+	c.Assert(err, check.IsNil)
+	c.Assert(key, check.Matches, "^[0-9a-f]{64}$")
+	other, err := privateEnvKey()
+	c.Assert(err, check.IsNil)
+	c.Assert(other, check.Equals, key)
+	var secret map[string]string
+	err = s.conn.Secrets().FindId(privateEnvKeyID).One(&secret)
+	c.Assert(err, check.IsNil)
+	c.Assert(secret["value"], check.Equals, key)
+}
+
+func (s *S) TestDeployDetectsPrivateEnvChangesWithoutKey(c *check.C) {
+	defer s.conn.Secrets().RemoveId(privateEnvKeyID)
+	a := App{
+		Name:     "otherapp",
+		Platform: "zend",
+		Teams:    []string{s.team.Name},
+		Env: map[string]bind.EnvVar{
+			"PASSWORD": {Name: "PASSWORD", Value: "secret", Public: false},
+			"TOKEN":    {Name: "TOKEN", Value: "token", Public: false},
+		},
+	}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	err = Deploy(DeployOptions{App: &a, OutputStream: &bytes.Buffer{}, Image: "some-image"})
+	c.Assert(err, check.IsNil)
+	a.Env["PASSWORD"] = bind.EnvVar{Name: "PASSWORD", Value: "other-secret", Public: false}
+	err = Deploy(DeployOptions{App: &a, OutputStream: &bytes.Buffer{}, Image: "some-image"})
+	c.Assert(err, check.IsNil)
+	var deploys []DeployData
+	err = s.conn.Deploys().Find(bson.M{"app": a.Name}).Sort("_id").All(&deploys)
+	c.Assert(err, check.IsNil)
+	c.Assert(deploys, check.HasLen, 2)
+	c.Assert(deploys[0].PrivateEnvs["PASSWORD"], check.Not(check.Equals), "")
+	diff, err := CompareDeploys(&deploys[0], &deploys[1])
+	c.Assert(err, check.IsNil)
+	c.Assert(diff.Changes, check.DeepEquals, []DeployChange{
+		{Kind: "env", Name: "PASSWORD", From: "*** (private variable)", To: "*** (private variable, changed)"},
+	})
+}
+
+func (s *S) TestCompareDeploysGit(c *check.C) {
+	repository.Manager().CreateRepository("g1", nil)
+	defer repository.Manager().RemoveRepository("g1")
+	from := DeployData{ID: bson.NewObjectId(), App: "g1", Commit: "545b1904af34458704e2aa06ff1aaffad5289f8f", Origin: "git"}
+	to := DeployData{ID: bson.NewObjectId(), App: "g1", Commit: "1b970b076bbb30d708e262b402d4e31910e1dc10", Origin: "git"}
+	diff, err := CompareDeploys(&from, &to)
+	c.Assert(err, check.IsNil)
+	c.Assert(diff.Diff, check.Equals, repositorytest.Diff)
+	c.Assert(diff.Changes, check.DeepEquals, []DeployChange{
+		{Kind: "deploy", Name: "commit", From: from.Commit, To: to.Commit},
+	})
+}
+
 func (s *S) TestGetDiffInDeploys(c *check.C) {
 	s.conn.Deploys().RemoveAll(nil)
 	myDeploy := DeployData{
@@ -470,6 +619,57 @@ func (s *S) TestDeployApp(c *check.C) {
 	c.Assert(logs, check.Equals, "Git deploy called")
 }
 
+func (s *S) TestDeployAppWithDeprecatedPlatform(c *check.C) {
+	err := s.conn.Platforms().Insert(Platform{Name: "oldplat", State: PlatformDeprecated})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Platforms().RemoveId("oldplat")
+	a := App{
+		Name:     "someApp",
+		Platform: "oldplat",
+		Teams:    []string{s.team.Name},
+	}
+	err = s.conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	writer := &bytes.Buffer{}
+	err = Deploy(DeployOptions{
+		App:          &a,
+		Version:      "version",
+		Commit:       "1ee1f1084927b3a5db59c9033bc5c4abefb7b93c",
+		OutputStream: writer,
+	})
+	c.Assert(err, check.IsNil)
+	logs := writer.String()
+	c.Assert(logs, check.Equals, "---- WARNING: the platform oldplat is deprecated, consider moving the app to another platform ----\nGit deploy called")
+}
+
+func (s *S) TestDeployAppWithDisabledPlatform(c *check.C) {
+	err := s.conn.Platforms().Insert(Platform{Name: "oldplat", State: PlatformDisabled})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Platforms().RemoveId("oldplat")
+	a := App{
+		Name:     "someApp",
+		Platform: "oldplat",
+		Teams:    []string{s.team.Name},
+	}
+	err = s.conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	writer := &bytes.Buffer{}
+	err = Deploy(DeployOptions{
+		App:          &a,
+		Version:      "version",
+		Commit:       "1ee1f1084927b3a5db59c9033bc5c4abefb7b93c",
+		OutputStream: writer,
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(writer.String(), check.Equals, "Git deploy called")
+}
+
 func (s *S) TestDeployAppWithUpdatePlatform(c *check.C) {
 	a := App{
 		Name:           "someApp",
@@ -589,6 +789,87 @@ func (s *S) TestDeployAppSaveDeployDataOriginRollback(c *check.C) {
 	c.Assert(result["origin"], check.Equals, "rollback")
 }
 
+func (s *S) TestDeployAppSaveDeployDataOriginImage(c *check.C) {
+	a := App{
+		Name:     "otherapp",
+		Platform: "zend",
+		Teams:    []string{s.team.Name},
+	}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	writer := &bytes.Buffer{}
+	err = Deploy(DeployOptions{
+		App:           &a,
+		OutputStream:  writer,
+		ExternalImage: "registry.example.com/some-image:1.0",
+	})
+	c.Assert(err, check.IsNil)
+	s.conn.Apps().Find(bson.M{"name": a.Name}).One(&a)
+	c.Assert(a.Deploys, check.Equals, uint(1))
+	var result map[string]interface{}
+	s.conn.Deploys().Find(bson.M{"app": a.Name}).One(&result)
+	c.Assert(result["app"], check.Equals, a.Name)
+	c.Assert(result["image"], check.Equals, "app-image")
+	c.Assert(result["log"], check.Equals, "External image deploy called")
+	c.Assert(result["origin"], check.Equals, "image")
+	c.Assert(result["externalimage"], check.Equals, "registry.example.com/some-image:1.0")
+}
+
+func (s *S) TestDeployAppSaveDeployDataSnapshot(c *check.C) {
+	config.Set("deploy:private-env-key", "deploy-secret")
+	defer config.Unset("deploy:private-env-key")
+	a := App{
+		Name:     "otherapp",
+		Platform: "zend",
+		Teams:    []string{s.team.Name},
+		Plan:     Plan{Name: "small", Memory: 128, CpuShare: 50},
+		Env: map[string]bind.EnvVar{
+			"DEBUG":    {Name: "DEBUG", Value: "1", Public: true},
+			"PASSWORD": {Name: "PASSWORD", Value: "secret", Public: false},
+		},
+	}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	imageData := provision.ImageData{
+		TsuruYaml: provision.TsuruYamlData{
+			Healthcheck: provision.TsuruYamlHealthcheck{Path: "/healthcheck"},
+		},
+		Labels: map[string]string{"version": "1.0"},
+	}
+	s.provisioner.SetImageData("some-image", imageData)
+	writer := &bytes.Buffer{}
+	err = Deploy(DeployOptions{
+		App:          &a,
+		OutputStream: writer,
+		Image:        "some-image",
+	})
+	c.Assert(err, check.IsNil)
+	var result DeployData
+	err = s.conn.Deploys().Find(bson.M{"app": a.Name}).One(&result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Envs, check.DeepEquals, map[string]string{
+		"DEBUG":    "1",
+		"PASSWORD": "*** (private variable)",
+	})
+	mac := hmac.New(sha256.New, []byte("deploy-secret"))
+	mac.Write([]byte("secret"))
+	c.Assert(result.PrivateEnvs, check.DeepEquals, map[string]string{
+		"PASSWORD": hex.EncodeToString(mac.Sum(nil)),
+	})
+	data, err := json.Marshal(result)
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.Contains(string(data), result.PrivateEnvs["PASSWORD"]), check.Equals, false)
+	c.Assert(result.Plan, check.DeepEquals, a.Plan)
+	c.Assert(result.TsuruYaml, check.DeepEquals, imageData.TsuruYaml)
+	c.Assert(result.ImageLabels, check.DeepEquals, imageData.Labels)
+}
+
 func (s *S) TestDeployAppSaveDeployDataOriginAppDeploy(c *check.C) {
 	a := App{
 		Name:     "otherapp",
@@ -787,6 +1068,151 @@ func (s *S) TestDeployToProvisionerImage(c *check.C) {
 	c.Assert(logs, check.Equals, "Image deploy called")
 }
 
+func (s *S) TestDeployToProvisionerExternalImage(c *check.C) {
+	a := App{
+		Name:     "someApp",
+		Platform: "django",
+		Teams:    []string{s.team.Name},
+	}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	writer := &bytes.Buffer{}
+	opts := DeployOptions{App: &a, ExternalImage: "registry.example.com/my-image:1.0"}
+	_, err = deployToProvisioner(&opts, writer)
+	c.Assert(err, check.IsNil)
+	logs := writer.String()
+	c.Assert(logs, check.Equals, "External image deploy called")
+	c.Assert(s.provisioner.LastImage(&a), check.Equals, "registry.example.com/my-image:1.0")
+}
+
+func (s *S) TestDeployRemovesRunningDeploy(c *check.C) {
+	a := App{
+		Name:     "someApp",
+		Platform: "django",
+		Teams:    []string{s.team.Name},
+	}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	err = Deploy(DeployOptions{App: &a, Version: "version", OutputStream: ioutil.Discard})
+	c.Assert(err, check.IsNil)
+	n, err := s.conn.RunningDeploys().FindId(a.Name).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 0)
+}
+
+func (s *S) TestCancelDeploy(c *check.C) {
+	a := App{Name: "someApp", Platform: "django"}
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	err := s.conn.RunningDeploys().Insert(runningDeploy{App: a.Name, User: "someone@tsuru.io", Timestamp: time.Now(), Started: time.Now()})
+	c.Assert(err, check.IsNil)
+	defer s.conn.RunningDeploys().RemoveId(a.Name)
+	err = CancelDeploy(&a, "admin@tsuru.io")
+	c.Assert(err, check.IsNil)
+	var deploy runningDeploy
+	err = s.conn.RunningDeploys().FindId(a.Name).One(&deploy)
+	c.Assert(err, check.IsNil)
+	c.Assert(deploy.CanceledBy, check.Equals, "admin@tsuru.io")
+	c.Assert(s.provisioner.Cancels(&a), check.Equals, 1)
+}
+
+func (s *S) TestCancelDeployWaitingInTheQueue(c *check.C) {
+	a := App{Name: "someApp", Platform: "django"}
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	err := s.conn.RunningDeploys().Insert(runningDeploy{App: a.Name, User: "someone@tsuru.io", Timestamp: time.Now(), Heartbeat: time.Now(), Waiting: true})
+	c.Assert(err, check.IsNil)
+	defer s.conn.RunningDeploys().RemoveId(a.Name)
+	err = CancelDeploy(&a, "admin@tsuru.io")
+	c.Assert(err, check.IsNil)
+	var deploy runningDeploy
+	err = s.conn.RunningDeploys().FindId(a.Name).One(&deploy)
+	c.Assert(err, check.IsNil)
+	c.Assert(deploy.CanceledBy, check.Equals, "admin@tsuru.io")
+	c.Assert(s.provisioner.Cancels(&a), check.Equals, 0)
+}
+
+func (s *S) TestCancelDeployProvisionerFailure(c *check.C) {
+	a := App{Name: "someApp", Platform: "django"}
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	err := s.conn.RunningDeploys().Insert(runningDeploy{App: a.Name, User: "someone@tsuru.io", Timestamp: time.Now(), Started: time.Now()})
+	c.Assert(err, check.IsNil)
+	defer s.conn.RunningDeploys().RemoveId(a.Name)
+	s.provisioner.PrepareFailure("CancelDeploy", provision.ErrNothingToCancel)
+	err = CancelDeploy(&a, "admin@tsuru.io")
+	c.Assert(err, check.Equals, provision.ErrNothingToCancel)
+	var deploy runningDeploy
+	err = s.conn.RunningDeploys().FindId(a.Name).One(&deploy)
+	c.Assert(err, check.IsNil)
+	c.Assert(deploy.CanceledBy, check.Equals, "")
+}
+
+func (s *S) TestCancelDeployIgnoresStaleDeploys(c *check.C) {
+	a := App{Name: "someApp", Platform: "django"}
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	old := time.Now().Add(-staleDeployTimeout - time.Minute)
+	err := s.conn.RunningDeploys().Insert(runningDeploy{App: a.Name, User: "someone@tsuru.io", Timestamp: old, Started: old})
+	c.Assert(err, check.IsNil)
+	defer s.conn.RunningDeploys().RemoveId(a.Name)
+	err = CancelDeploy(&a, "admin@tsuru.io")
+	c.Assert(err, check.Equals, ErrNoDeployInProgress)
+	n, err := s.conn.RunningDeploys().FindId(a.Name).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 0)
+}
+
+func (s *S) TestCancelDeployWithoutDeployInProgress(c *check.C) {
+	a := App{Name: "someApp", Platform: "django"}
+	s.provisioner.Provision(&a)
+	defer s.provisioner.Destroy(&a)
+	err := CancelDeploy(&a, "admin@tsuru.io")
+	c.Assert(err, check.Equals, ErrNoDeployInProgress)
+	c.Assert(s.provisioner.Cancels(&a), check.Equals, 0)
+}
+
+func (s *S) TestFinishRunningDeployCanceled(c *check.C) {
+	a := App{Name: "someApp", Platform: "django", Lock: AppLock{Locked: true, Owner: "someone@tsuru.io"}}
+	err := s.conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+	err = s.conn.RunningDeploys().Insert(runningDeploy{App: a.Name, CanceledBy: "admin@tsuru.io"})
+	c.Assert(err, check.IsNil)
+	defer s.conn.RunningDeploys().RemoveId(a.Name)
+	err = finishRunningDeploy(a.Name, errors.New("Exit status 137"))
+	c.Assert(err, check.ErrorMatches, "canceled by admin@tsuru.io")
+	n, err := s.conn.RunningDeploys().FindId(a.Name).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 0)
+	dbApp, err := GetByName(a.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbApp.Lock.Locked, check.Equals, true)
+}
+
+func (s *S) TestFinishRunningDeployCanceledAfterSuccess(c *check.C) {
+	err := s.conn.RunningDeploys().Insert(runningDeploy{App: "someApp", CanceledBy: "admin@tsuru.io"})
+	c.Assert(err, check.IsNil)
+	defer s.conn.RunningDeploys().RemoveId("someApp")
+	err = finishRunningDeploy("someApp", nil)
+	c.Assert(err, check.ErrorMatches, "canceled by admin@tsuru.io")
+}
+
+func (s *S) TestFinishRunningDeployNotCanceled(c *check.C) {
+	err := s.conn.RunningDeploys().Insert(runningDeploy{App: "someApp"})
+	c.Assert(err, check.IsNil)
+	defer s.conn.RunningDeploys().RemoveId("someApp")
+	deployErr := errors.New("Exit status 1")
+	err = finishRunningDeploy("someApp", deployErr)
+	c.Assert(err, check.Equals, deployErr)
+}
+
 func (s *S) TestMarkDeploysAsRemoved(c *check.C) {
 	s.createAdminUserAndTeam(c)
 	a := App{Name: "someApp"}
@@ -0,0 +1,77 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/log"
+	"github.com/tsuru/tsuru/metering"
+)
+
+// recordUnitsMetering records, for metering, that n units were added to or
+// removed from the app, or that its team owner changed (action update).
+// Failures are logged, as they must not break the operation on the app.
+func (app *App) recordUnitsMetering(action string, n int) {
+	if n <= 0 && action != metering.ActionUpdate {
+		return
+	}
+	err := metering.Record(metering.Event{
+		Kind:     metering.KindUnit,
+		Action:   action,
+		Resource: app.Name,
+		Team:     app.TeamOwner,
+		Pool:     app.Pool,
+		Plan:     app.Plan.Name,
+		Quantity: n,
+	})
+	if err != nil {
+		log.Errorf("[metering] unable to record the %s event of the units of the app %q: %s", action, app.Name, err)
+	}
+}
+
+// recordUnitsChange records the difference between the number of units of
+// the app before an operation and the current number of units.
+func (app *App) recordUnitsChange(before int) {
+	after := len(app.Units())
+	if after > before {
+		app.recordUnitsMetering(metering.ActionAdd, after-before)
+	} else if after < before {
+		app.recordUnitsMetering(metering.ActionRemove, before-after)
+	}
+}
+
+// RecordMeteringBaseline records, for metering, the units of the apps that
+// already existed when their events started being recorded.
+func RecordMeteringBaseline() error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var apps []App
+	err = conn.Apps().Find(nil).All(&apps)
+	if err != nil {
+		return err
+	}
+	for _, app := range apps {
+		units := len(app.Units())
+		if units == 0 {
+			continue
+		}
+		_, err = metering.RecordBaseline(metering.Event{
+			Kind:     metering.KindUnit,
+			Action:   metering.ActionAdd,
+			Resource: app.Name,
+			Team:     app.TeamOwner,
+			Pool:     app.Pool,
+			Plan:     app.Plan.Name,
+			Quantity: units,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"time"
+
+	"github.com/tsuru/tsuru/metering"
+	"github.com/tsuru/tsuru/quota"
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) meteringEvents(c *check.C, appName string) []metering.Event {
+	var events []metering.Event
+	err := s.conn.MeteringEvents().Find(bson.M{"resource": appName}).All(&events)
+	c.Assert(err, check.IsNil)
+	for i := range events {
+		events[i].Date = time.Time{}
+	}
+	return events
+}
+
+func (s *S) TestAddUnitsRecordsMetering(c *check.C) {
+	app := App{
+		Name: "warpaint", Platform: "python", TeamOwner: "tsuruteam",
+		Pool: "pool1", Plan: Plan{Name: "small"}, Quota: quota.Unlimited,
+	}
+	err := s.conn.Apps().Insert(app)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": app.Name})
+	s.provisioner.Provision(&app)
+	defer s.provisioner.Destroy(&app)
+	err = app.AddUnits(3, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.meteringEvents(c, app.Name), check.DeepEquals, []metering.Event{
+		{Kind: metering.KindUnit, Action: metering.ActionAdd, Resource: "warpaint", Team: "tsuruteam", Pool: "pool1", Plan: "small", Quantity: 3},
+	})
+}
+
+func (s *S) TestAddUnitsFailureDoesNotRecordMetering(c *check.C) {
+	app := App{Name: "warpaint", Platform: "python", Quota: quota.Unlimited}
+	err := s.conn.Apps().Insert(app)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().Remove(bson.M{"name": app.Name})
+	err = app.AddUnits(3, nil)
+	c.Assert(err, check.NotNil)
+	c.Assert(s.meteringEvents(c, app.Name), check.HasLen, 0)
+}
+
+func (s *S) TestRecordUnitsChange(c *check.C) {
+	app := App{Name: "warpaint", Platform: "python", TeamOwner: "tsuruteam", Plan: Plan{Name: "small"}}
+	s.provisioner.Provision(&app)
+	defer s.provisioner.Destroy(&app)
+	s.provisioner.AddUnits(&app, 3, nil)
+	app.recordUnitsChange(0)
+	app.recordUnitsChange(3)
+	app.recordUnitsChange(5)
+	c.Assert(s.meteringEvents(c, app.Name), check.DeepEquals, []metering.Event{
+		{Kind: metering.KindUnit, Action: metering.ActionAdd, Resource: "warpaint", Team: "tsuruteam", Plan: "small", Quantity: 3},
+		{Kind: metering.KindUnit, Action: metering.ActionRemove, Resource: "warpaint", Team: "tsuruteam", Plan: "small", Quantity: 2},
+	})
+}
+
+func (s *S) TestRecordUnitsMeteringUpdate(c *check.C) {
+	app := App{Name: "warpaint", TeamOwner: "tsuruteam", Pool: "pool1", Plan: Plan{Name: "small"}}
+	app.recordUnitsMetering(metering.ActionRemove, 0)
+	app.recordUnitsMetering(metering.ActionUpdate, 0)
+	c.Assert(s.meteringEvents(c, app.Name), check.DeepEquals, []metering.Event{
+		{Kind: metering.KindUnit, Action: metering.ActionUpdate, Resource: "warpaint", Team: "tsuruteam", Pool: "pool1", Plan: "small"},
+	})
+}
+
+func (s *S) TestRecordMeteringBaseline(c *check.C) {
+	app1 := App{Name: "warpaint", Platform: "python", TeamOwner: "tsuruteam", Pool: "pool1", Plan: Plan{Name: "small"}}
+	app2 := App{Name: "lunatic", Platform: "python", TeamOwner: "tsuruteam", Plan: Plan{Name: "small"}}
+	app3 := App{Name: "unitless", Platform: "python", TeamOwner: "tsuruteam"}
+	apps := []*App{&app1, &app2, &app3}
+	for _, a := range apps {
+		err := s.conn.Apps().Insert(a)
+		c.Assert(err, check.IsNil)
+		defer s.conn.Apps().Remove(bson.M{"name": a.Name})
+		s.provisioner.Provision(a)
+		defer s.provisioner.Destroy(a)
+	}
+	s.provisioner.AddUnits(&app1, 2, nil)
+	s.provisioner.AddUnits(&app2, 1, nil)
+	app2.recordUnitsMetering(metering.ActionAdd, 1)
+	err := RecordMeteringBaseline()
+	c.Assert(err, check.IsNil)
+	c.Assert(s.meteringEvents(c, app1.Name), check.DeepEquals, []metering.Event{
+		{Kind: metering.KindUnit, Action: metering.ActionAdd, Resource: "warpaint", Team: "tsuruteam", Pool: "pool1", Plan: "small", Quantity: 2},
+	})
+	c.Assert(s.meteringEvents(c, app2.Name), check.HasLen, 1)
+	c.Assert(s.meteringEvents(c, app3.Name), check.HasLen, 0)
+}
@@ -8,16 +8,105 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/tsuru/tsuru/db"
+	tsuruErrors "github.com/tsuru/tsuru/errors"
 	"github.com/tsuru/tsuru/log"
 	"github.com/tsuru/tsuru/provision"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
+const (
+	PlatformEnabled    = "enabled"
+	PlatformDeprecated = "deprecated"
+	PlatformDisabled   = "disabled"
+)
+
 type Platform struct {
 	Name string `bson:"_id"`
+	// State is one of enabled, deprecated and disabled. Deprecated platforms
+	// can still be used, with a warning, and disabled platforms can't be
+	// used by new apps. An empty state means the platform is enabled.
+	State string `bson:",omitempty" json:",omitempty"`
+	// Current is the version of the platform used by apps that don't pin
+	// a version. It's empty for platforms created before versioning.
+	Current  string            `bson:",omitempty" json:",omitempty"`
+	Versions []PlatformVersion `bson:",omitempty" json:",omitempty"`
+}
+
+// PlatformVersion is an image of the platform, created whenever the platform
+// is added or updated.
+type PlatformVersion struct {
+	Version   string
+	CreatedAt time.Time
+}
+
+var platformVersionRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
+
+// Deprecated checks whether the platform is deprecated.
+func (p *Platform) Deprecated() bool {
+	return p.State == PlatformDeprecated
+}
+
+// Disabled checks whether the platform is disabled.
+func (p *Platform) Disabled() bool {
+	return p.State == PlatformDisabled
+}
+
+// hasVersion checks whether the given version of the platform exists.
+func (p *Platform) hasVersion(version string) bool {
+	for _, v := range p.Versions {
+		if v.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// newVersion returns the version that should be used by a new image of the
+// platform, it's either the version provided by the admin or the next
+// sequential version (v1, v2, ...).
+func (p *Platform) newVersion(version string) (string, error) {
+	if version == "" {
+		for i := len(p.Versions) + 1; ; i++ {
+			version = fmt.Sprintf("v%d", i)
+			if !p.hasVersion(version) {
+				return version, nil
+			}
+		}
+	}
+	if !platformVersionRegexp.MatchString(version) {
+		return "", fmt.Errorf("Invalid platform version %q: versions must contain only letters, numbers, underscores, dots and dashes.", version)
+	}
+	if p.hasVersion(version) {
+		return "", fmt.Errorf("Version %q already exists for platform %s.", version, p.Name)
+	}
+	return version, nil
+}
+
+// parsePlatform splits a platform in the format <name>:<version> in the name
+// and the version of the platform.
+func parsePlatform(platform string) (string, string) {
+	parts := strings.SplitN(platform, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// platformArgs copies the args sent to the provisioner, including the version
+// of the platform being built.
+func platformArgs(args map[string]string, version string) map[string]string {
+	result := make(map[string]string, len(args)+1)
+	for k, v := range args {
+		result[k] = v
+	}
+	result["version"] = version
+	return result
 }
 
 // Platforms returns the list of available platforms.
@@ -43,7 +132,16 @@ func PlatformAdd(name string, args map[string]string, w io.Writer) error {
 	if name == "" {
 		return errors.New("Platform name is required.")
 	}
+	if strings.Contains(name, ":") {
+		return errors.New("Platform name must not contain colons.")
+	}
 	p := Platform{Name: name}
+	version, err := p.newVersion(args["version"])
+	if err != nil {
+		return err
+	}
+	p.Current = version
+	p.Versions = []PlatformVersion{{Version: version, CreatedAt: time.Now()}}
 	conn, err := db.Conn()
 	if err != nil {
 		return err
@@ -55,7 +153,7 @@ func PlatformAdd(name string, args map[string]string, w io.Writer) error {
 		}
 		return err
 	}
-	err = provisioner.PlatformAdd(name, args, w)
+	err = provisioner.PlatformAdd(name, platformArgs(args, version), w)
 	if err != nil {
 		dbErr := conn.Platforms().RemoveId(p.Name)
 		if dbErr != nil {
@@ -95,12 +193,90 @@ func PlatformUpdate(name string, args map[string]string, w io.Writer) error {
 		}
 		return err
 	}
-	err = provisioner.PlatformUpdate(name, args, w)
+	version, err := platform.newVersion(args["version"])
 	if err != nil {
 		return err
 	}
+	err = provisioner.PlatformUpdate(name, platformArgs(args, version), w)
+	if err != nil {
+		return err
+	}
+	err = conn.Platforms().UpdateId(name, bson.M{
+		"$set":  bson.M{"current": version},
+		"$push": bson.M{"versions": PlatformVersion{Version: version, CreatedAt: time.Now()}},
+	})
+	if err != nil {
+		return err
+	}
+	return markAppsForPlatformUpdate(name)
+}
+
+// PlatformRollback changes the current version of the platform to a previous
+// version. When version is empty, the platform is rolled back to the version
+// created before the current one.
+func PlatformRollback(name, version string) error {
+	platform, err := getPlatform(name)
+	if err != nil {
+		return err
+	}
+	if version == "" {
+		for i, v := range platform.Versions {
+			if v.Version == platform.Current && i > 0 {
+				version = platform.Versions[i-1].Version
+			}
+		}
+		if version == "" {
+			return errors.New("Platform has no previous version.")
+		}
+	}
+	if !platform.hasVersion(version) {
+		return fmt.Errorf("Version %q not found for platform %s.", version, name)
+	}
+	if version == platform.Current {
+		return fmt.Errorf("Version %q is already the current version of platform %s.", version, name)
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Platforms().UpdateId(name, bson.M{"$set": bson.M{"current": version}})
+	if err != nil {
+		return err
+	}
+	return markAppsForPlatformUpdate(name)
+}
+
+// PlatformSetState changes the state of the platform. Apps using a platform
+// are not affected by its state, they keep being deployed, but deprecated
+// platforms are flagged in the deploy and in the app info, and disabled
+// platforms can't be used by new apps, unless created by admin users.
+func PlatformSetState(name, state string) error {
+	if state != PlatformEnabled && state != PlatformDeprecated && state != PlatformDisabled {
+		return fmt.Errorf("Invalid state %q: must be one of %s, %s or %s.", state, PlatformEnabled, PlatformDeprecated, PlatformDisabled)
+	}
+	if _, err := getPlatform(name); err != nil {
+		return err
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Platforms().UpdateId(name, bson.M{"$set": bson.M{"state": state}})
+}
+
+// markAppsForPlatformUpdate marks the apps using the current version of the
+// platform, so their next deploy uses the new image of the platform. Apps
+// pinned to a version are not affected.
+func markAppsForPlatformUpdate(name string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 	var apps []App
-	err = conn.Apps().Find(bson.M{"framework": name}).All(&apps)
+	err = conn.Apps().Find(bson.M{"framework": name, "platformversion": bson.M{"$in": []interface{}{"", nil}}}).All(&apps)
 	if err != nil {
 		return err
 	}
@@ -149,6 +325,20 @@ func getPlatform(name string) (*Platform, error) {
 	return &p, nil
 }
 
+// getPlatformVersion returns the platform and validates the version,
+// returning a validation error when it doesn't exist.
+func getPlatformVersion(name, version string) (*Platform, error) {
+	p, err := getPlatform(name)
+	if err != nil {
+		return nil, err
+	}
+	if version != "" && !p.hasVersion(version) {
+		msg := fmt.Sprintf("Invalid version %q for platform %s.", version, name)
+		return nil, &tsuruErrors.ValidationError{Message: msg}
+	}
+	return p, nil
+}
+
 type InvalidPlatformError struct{}
 
 func (InvalidPlatformError) Error() string {
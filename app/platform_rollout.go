@@ -0,0 +1,531 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/monsterqueue"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/log"
+	"github.com/tsuru/tsuru/queue"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	RolloutRunning  = "running"
+	RolloutPaused   = "paused"
+	RolloutFinished = "finished"
+
+	defaultRolloutBatchPercent      = 20
+	defaultRolloutMaxFailurePercent = 10
+	defaultRolloutBatchTimeout      = time.Hour
+
+	platformRolloutTaskName = "platform-rollout"
+)
+
+var (
+	// rolloutHeartbeatInterval is the interval in which a running rollout
+	// records that it's still alive.
+	rolloutHeartbeatInterval = time.Minute
+
+	// rolloutStaleTimeout is the time after which a running rollout that
+	// didn't record that it's alive is considered dead, and may be resumed.
+	rolloutStaleTimeout = 5 * time.Minute
+)
+
+var (
+	ErrPlatformRolloutInProgress = errors.New("there is already a rollout in progress for this platform")
+	ErrPlatformRolloutNotFound   = errors.New("rollout not found")
+
+	errExternalImageRebuild = errors.New("app deployed from an external image, which is not built with the platform")
+)
+
+// PlatformRolloutOptions controls how the apps of a platform are rebuilt:
+// BatchPercent is the percentage of the apps rebuilt at the same time, and the
+// rollout is paused whenever the percentage of failed rebuilds is greater
+// than MaxFailurePercent.
+type PlatformRolloutOptions struct {
+	BatchPercent      int
+	MaxFailurePercent int
+}
+
+// RolloutFailure describes an app that could not be rebuilt in a rollout.
+type RolloutFailure struct {
+	App   string
+	Error string
+}
+
+// PlatformRollout represents the rebuild of the apps using a platform after
+// the platform is updated.
+type PlatformRollout struct {
+	Platform          string `bson:"_id"`
+	Status            string
+	Reason            string
+	User              string
+	BatchPercent      int
+	MaxFailurePercent int
+	Total             int
+	Pending           []string
+	Succeeded         []string
+	Failed            []RolloutFailure
+	Skipped           []RolloutFailure
+	StartedAt         time.Time
+	FinishedAt        time.Time `bson:",omitempty"`
+	UpdatedAt         time.Time
+	Runner            string
+}
+
+// FailurePercent returns the percentage of failed rebuilds among the rebuilds
+// already executed in the rollout.
+func (r *PlatformRollout) FailurePercent() int {
+	done := len(r.Succeeded) + len(r.Failed)
+	if done == 0 {
+		return 0
+	}
+	return len(r.Failed) * 100 / done
+}
+
+func (r *PlatformRollout) batchSize() int {
+	size := (r.Total*r.BatchPercent + 99) / 100
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// GetPlatformRollout returns the last rollout of the given platform.
+func GetPlatformRollout(platform string) (*PlatformRollout, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var rollout PlatformRollout
+	err = conn.PlatformRollouts().FindId(platform).One(&rollout)
+	if err == mgo.ErrNotFound {
+		return nil, ErrPlatformRolloutNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rollout, nil
+}
+
+// platformRolloutTask is the task that rebuilds the apps of a rollout. The
+// task is a no-op if the rollout was resumed by another runner in the
+// meantime.
+type platformRolloutTask struct{}
+
+func (t *platformRolloutTask) Name() string {
+	return platformRolloutTaskName
+}
+
+func (t *platformRolloutTask) Run(job monsterqueue.Job) {
+	params := job.Parameters()
+	platform, _ := params["platform"].(string)
+	runner, _ := params["runner"].(string)
+	rollout, err := GetPlatformRollout(platform)
+	if err != nil {
+		job.Error(err)
+		return
+	}
+	if rollout.Status != RolloutRunning || rollout.Runner != runner {
+		job.Success(false)
+		return
+	}
+	runPlatformRollout(rollout)
+	job.Success(true)
+}
+
+// InitializePlatformRollouts registers the task used by platform rollouts and
+// resumes the rollouts left running by API servers that died in the middle
+// of them. It must be called in the startup of the API server.
+func InitializePlatformRollouts() error {
+	q, err := queue.Queue()
+	if err != nil {
+		return err
+	}
+	err = q.RegisterTask(&platformRolloutTask{})
+	if err != nil {
+		return err
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var rollouts []PlatformRollout
+	err = conn.PlatformRollouts().Find(staleRolloutQuery(bson.M{})).All(&rollouts)
+	if err != nil {
+		return err
+	}
+	for _, rollout := range rollouts {
+		runner := bson.NewObjectId().Hex()
+		err = conn.PlatformRollouts().Update(
+			staleRolloutQuery(bson.M{"_id": rollout.Platform}),
+			bson.M{"$set": bson.M{"runner": runner, "updatedat": time.Now()}},
+		)
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		log.Debugf("[platform-rollout] resuming rollout of %s", rollout.Platform)
+		err = enqueuePlatformRollout(rollout.Platform, runner)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// staleRolloutQuery restricts the query to running rollouts that didn't
+// record that they're alive in the last rolloutStaleTimeout.
+func staleRolloutQuery(query bson.M) bson.M {
+	query["status"] = RolloutRunning
+	query["$or"] = []bson.M{
+		{"updatedat": bson.M{"$lt": time.Now().Add(-rolloutStaleTimeout)}},
+		{"updatedat": bson.M{"$exists": false}},
+	}
+	return query
+}
+
+func enqueuePlatformRollout(platform, runner string) error {
+	q, err := queue.Queue()
+	if err != nil {
+		return err
+	}
+	_, err = q.Enqueue(platformRolloutTaskName, monsterqueue.JobParams{"platform": platform, "runner": runner})
+	return err
+}
+
+func rolloutBatchTimeout() time.Duration {
+	timeout, err := config.GetInt("platform-rollout:batch-timeout")
+	if err != nil || timeout <= 0 {
+		return defaultRolloutBatchTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// StartPlatformRollout starts rebuilding, in background, the apps using the
+// given platform that were not deployed since the last update of the
+// platform. Starting a rollout that was paused, or whose runner died,
+// resumes it, rebuilding the apps that are still pending.
+func StartPlatformRollout(platform string, opts PlatformRolloutOptions, user string) (*PlatformRollout, error) {
+	if _, err := getPlatform(platform); err != nil {
+		return nil, err
+	}
+	if opts.BatchPercent <= 0 || opts.BatchPercent > 100 {
+		opts.BatchPercent = defaultRolloutBatchPercent
+	}
+	if opts.MaxFailurePercent < 0 || opts.MaxFailurePercent > 100 {
+		opts.MaxFailurePercent = defaultRolloutMaxFailurePercent
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	rollout, err := GetPlatformRollout(platform)
+	if err != nil && err != ErrPlatformRolloutNotFound {
+		return nil, err
+	}
+	stale := rollout != nil && rollout.Status == RolloutRunning && rollout.UpdatedAt.Before(time.Now().Add(-rolloutStaleTimeout))
+	if rollout != nil && rollout.Status == RolloutRunning && !stale {
+		return nil, ErrPlatformRolloutInProgress
+	}
+	runner := bson.NewObjectId().Hex()
+	now := time.Now()
+	if rollout != nil && (rollout.Status == RolloutPaused || stale) {
+		query := bson.M{"_id": platform, "status": RolloutPaused}
+		if stale {
+			query = staleRolloutQuery(bson.M{"_id": platform})
+		}
+		rollout.BatchPercent = opts.BatchPercent
+		rollout.MaxFailurePercent = opts.MaxFailurePercent
+		rollout.Reason = ""
+		rollout.Runner = runner
+		rollout.UpdatedAt = now
+		err = conn.PlatformRollouts().Update(query, bson.M{"$set": bson.M{
+			"status":            RolloutRunning,
+			"reason":            "",
+			"batchpercent":      opts.BatchPercent,
+			"maxfailurepercent": opts.MaxFailurePercent,
+			"runner":            runner,
+			"updatedat":         now,
+		}})
+		if err == mgo.ErrNotFound {
+			return nil, ErrPlatformRolloutInProgress
+		}
+		if err != nil {
+			return nil, err
+		}
+		rollout.Status = RolloutRunning
+	} else {
+		var apps []App
+		err = conn.Apps().Find(bson.M{"framework": platform, "updateplatform": true}).Sort("name").All(&apps)
+		if err != nil {
+			return nil, err
+		}
+		pending := make([]string, len(apps))
+		for i, a := range apps {
+			pending[i] = a.Name
+		}
+		rollout = &PlatformRollout{
+			Platform:          platform,
+			Status:            RolloutRunning,
+			User:              user,
+			BatchPercent:      opts.BatchPercent,
+			MaxFailurePercent: opts.MaxFailurePercent,
+			Total:             len(pending),
+			Pending:           pending,
+			StartedAt:         now,
+			UpdatedAt:         now,
+			Runner:            runner,
+		}
+		_, err = conn.PlatformRollouts().Upsert(
+			bson.M{"_id": platform, "status": bson.M{"$ne": RolloutRunning}},
+			rollout,
+		)
+		if mgo.IsDup(err) {
+			return nil, ErrPlatformRolloutInProgress
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = enqueuePlatformRollout(platform, runner)
+	if err != nil {
+		return nil, err
+	}
+	return rollout, nil
+}
+
+type rebuildResult struct {
+	app     string
+	skipped bool
+	err     error
+}
+
+// runPlatformRollout rebuilds the pending apps of the rollout in batches,
+// saving the progress after each batch. When the batch timeout is reached,
+// rebuilds that didn't start yet are abandoned and the deploys in progress are
+// canceled, and the rollout waits for all of them before starting the next
+// batch, so it never runs more deploys than the batch size. Apps are reported
+// as failed only when they were not rebuilt. The rollout stops if it was
+// resumed by another runner.
+func runPlatformRollout(rollout *PlatformRollout) {
+	quit := make(chan struct{})
+	defer close(quit)
+	go rolloutHeartbeat(rollout.Platform, rollout.Runner, quit)
+	timeout := rolloutBatchTimeout()
+	for len(rollout.Pending) > 0 {
+		size := rollout.batchSize()
+		if size > len(rollout.Pending) {
+			size = len(rollout.Pending)
+		}
+		batch := rollout.Pending[:size]
+		results := make(chan rebuildResult, len(batch))
+		cancel := make(chan struct{})
+		for _, appName := range batch {
+			go func(appName string) {
+				skipped, err := rebuildApp(appName, rollout, cancel)
+				results <- rebuildResult{app: appName, skipped: skipped, err: err}
+			}(appName)
+		}
+		done := make(map[string]rebuildResult, len(batch))
+		timedOut := make(map[string]bool)
+		timer := time.After(timeout)
+		for len(done) < len(batch) {
+			select {
+			case result := <-results:
+				done[result.app] = result
+			case <-timer:
+				close(cancel)
+				for _, appName := range batch {
+					if _, ok := done[appName]; !ok {
+						timedOut[appName] = true
+						cancelRebuild(appName, rollout)
+					}
+				}
+			}
+		}
+		for _, appName := range batch {
+			result := done[appName]
+			if result.err != nil && timedOut[appName] {
+				result.err = fmt.Errorf("timed out after %v rebuilding the app", timeout)
+			}
+			if result.err == nil {
+				rollout.Succeeded = append(rollout.Succeeded, appName)
+				continue
+			}
+			failure := RolloutFailure{App: appName, Error: result.err.Error()}
+			if result.skipped {
+				rollout.Skipped = append(rollout.Skipped, failure)
+			} else {
+				rollout.Failed = append(rollout.Failed, failure)
+			}
+		}
+		rollout.Pending = rollout.Pending[size:]
+		if len(rollout.Pending) > 0 && rollout.FailurePercent() > rollout.MaxFailurePercent {
+			rollout.Status = RolloutPaused
+			rollout.Reason = fmt.Sprintf("%d%% of the rebuilds failed, the maximum allowed is %d%%", rollout.FailurePercent(), rollout.MaxFailurePercent)
+			break
+		}
+		if len(rollout.Pending) > 0 {
+			err := savePlatformRollout(rollout)
+			if err == mgo.ErrNotFound {
+				log.Errorf("[platform-rollout] rollout of %s was resumed by another runner, stopping", rollout.Platform)
+				return
+			}
+			if err != nil {
+				log.Errorf("[platform-rollout] unable to save progress of rollout of %s: %s", rollout.Platform, err)
+			}
+		}
+	}
+	if len(rollout.Pending) == 0 {
+		rollout.Status = RolloutFinished
+		rollout.FinishedAt = time.Now()
+	}
+	if err := savePlatformRollout(rollout); err != nil {
+		log.Errorf("[platform-rollout] unable to save progress of rollout of %s: %s", rollout.Platform, err)
+	}
+}
+
+// cancelRebuild cancels the deploy of the app started by the rollout, if it's
+// in progress.
+func cancelRebuild(appName string, rollout *PlatformRollout) {
+	err := CancelDeploy(&App{Name: appName}, rollout.User)
+	if err != nil && err != ErrNoDeployInProgress {
+		log.Errorf("[platform-rollout] unable to cancel the rebuild of %s: %s", appName, err)
+	}
+}
+
+// rolloutHeartbeat records periodically that the rollout is alive, until quit
+// is closed.
+func rolloutHeartbeat(platform, runner string, quit <-chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(rolloutHeartbeatInterval):
+		}
+		conn, err := db.Conn()
+		if err != nil {
+			log.Errorf("[platform-rollout] unable to record heartbeat of rollout of %s: %s", platform, err)
+			continue
+		}
+		conn.PlatformRollouts().Update(
+			bson.M{"_id": platform, "runner": runner, "status": RolloutRunning},
+			bson.M{"$set": bson.M{"updatedat": time.Now()}},
+		)
+		conn.Close()
+	}
+}
+
+// savePlatformRollout saves the progress of the rollout, returning
+// mgo.ErrNotFound if the rollout was resumed by another runner.
+func savePlatformRollout(rollout *PlatformRollout) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rollout.UpdatedAt = time.Now()
+	return conn.PlatformRollouts().Update(bson.M{"_id": rollout.Platform, "runner": rollout.Runner}, rollout)
+}
+
+// rebuildApp deploys again the code of the last deploy of the app, using the
+// updated platform. Apps that were already rebuilt, or that were never
+// deployed, are skipped. The deploy doesn't start once cancel is closed.
+func rebuildApp(appName string, rollout *PlatformRollout, cancel <-chan struct{}) (bool, error) {
+	a, err := GetByName(appName)
+	if err != nil {
+		return true, err
+	}
+	if a.Platform != rollout.Platform || !a.UpdatePlatform {
+		return true, errors.New("app already rebuilt with the current platform")
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	var last DeployData
+	err = conn.Deploys().Find(bson.M{"app": appName, "error": "", "removedate": bson.M{"$exists": false}}).Sort("-timestamp").One(&last)
+	if err == mgo.ErrNotFound {
+		return true, errors.New("app has no successful deploys")
+	}
+	if err != nil {
+		return false, err
+	}
+	opts, err := rebuildOptions(conn, &last)
+	if err == errExternalImageRebuild {
+		return true, err
+	}
+	if err != nil {
+		return false, err
+	}
+	locked, err := AcquireApplicationLock(appName, rollout.User, "platform rollout")
+	if err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, errors.New("app is locked")
+	}
+	defer ReleaseApplicationLock(appName)
+	select {
+	case <-cancel:
+		return false, errors.New("rebuild canceled")
+	default:
+	}
+	opts.App = a
+	opts.OutputStream = ioutil.Discard
+	opts.User = rollout.User
+	return false, Deploy(opts)
+}
+
+// rebuildOptions returns the options for deploying again the source of the
+// given deploy. Rollbacks are rebuilt from the deploy that built their image.
+// Deploys of external images are not rebuilt, since the platform isn't used to
+// build them.
+func rebuildOptions(conn *db.Storage, deploy *DeployData) (DeployOptions, error) {
+	if deploy.Origin == "rollback" {
+		var source DeployData
+		err := conn.Deploys().Find(bson.M{
+			"app":    deploy.App,
+			"image":  deploy.Image,
+			"origin": bson.M{"$ne": "rollback"},
+		}).Sort("-timestamp").One(&source)
+		if err == mgo.ErrNotFound {
+			return DeployOptions{}, fmt.Errorf("unable to find the deploy that built the image %s", deploy.Image)
+		}
+		if err != nil {
+			return DeployOptions{}, err
+		}
+		deploy = &source
+	}
+	switch deploy.Origin {
+	case "git":
+		if deploy.Commit != "" {
+			return DeployOptions{Version: deploy.Commit, Commit: deploy.Commit}, nil
+		}
+	case "image":
+		return DeployOptions{}, errExternalImageRebuild
+	case "app-deploy":
+		if deploy.ArchiveURL != "" {
+			return DeployOptions{ArchiveURL: deploy.ArchiveURL}, nil
+		}
+		return DeployOptions{}, errors.New("the archive uploaded in the last deploy of the app is not stored")
+	}
+	return DeployOptions{}, fmt.Errorf("the source of the last deploy of the app is not stored (origin: %s)", deploy.Origin)
+}
@@ -0,0 +1,414 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/queue"
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *PlatformSuite) createRolloutApp(c *check.C, name, platform, origin string) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	conn.Platforms().Insert(Platform{Name: platform})
+	a := App{Name: name, Platform: platform, UpdatePlatform: true}
+	err = conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	s.provisioner.Provision(&a)
+	deploy := DeployData{App: name, Timestamp: time.Now(), Origin: origin}
+	switch origin {
+	case "git":
+		deploy.Commit = "abc123"
+	case "image":
+		deploy.ExternalImage = "registry.example.com/" + name + ":1.0"
+	}
+	err = conn.Deploys().Insert(deploy)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *PlatformSuite) removeRolloutApps(names ...string) {
+	conn, err := db.Conn()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Apps().RemoveAll(bson.M{"name": bson.M{"$in": names}})
+	conn.Deploys().RemoveAll(bson.M{"app": bson.M{"$in": names}})
+	conn.PlatformRollouts().RemoveAll(nil)
+	for _, name := range names {
+		s.provisioner.Destroy(&App{Name: name})
+	}
+}
+
+func (s *PlatformSuite) waitRollout(c *check.C, platform string) *PlatformRollout {
+	timeout := time.After(5 * time.Second)
+	for {
+		rollout, err := GetPlatformRollout(platform)
+		c.Assert(err, check.IsNil)
+		if rollout.Status != RolloutRunning {
+			return rollout
+		}
+		select {
+		case <-timeout:
+			c.Fatal("timed out waiting for the rollout")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func (s *PlatformSuite) TestRunPlatformRollout(c *check.C) {
+	s.createRolloutApp(c, "app1", "python", "git")
+	s.createRolloutApp(c, "app2", "python", "git")
+	s.createRolloutApp(c, "app3", "python", "app-deploy")
+	defer s.removeRolloutApps("app1", "app2", "app3")
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	rollout := PlatformRollout{
+		Platform:     "python",
+		Status:       RolloutRunning,
+		User:         "admin@tsuru.io",
+		BatchPercent: 50,
+		Total:        3,
+		Pending:      []string{"app1", "app2", "app3"},
+	}
+	err = conn.PlatformRollouts().Insert(rollout)
+	c.Assert(err, check.IsNil)
+	runPlatformRollout(&rollout)
+	dbRollout, err := GetPlatformRollout("python")
+	c.Assert(err, check.IsNil)
+	c.Assert(dbRollout.Status, check.Equals, RolloutFinished)
+	c.Assert(dbRollout.Pending, check.HasLen, 0)
+	c.Assert(dbRollout.Succeeded, check.DeepEquals, []string{"app1", "app2"})
+	c.Assert(dbRollout.Failed, check.DeepEquals, []RolloutFailure{
+		{App: "app3", Error: "the archive uploaded in the last deploy of the app is not stored"},
+	})
+	c.Assert(dbRollout.Skipped, check.HasLen, 0)
+	c.Assert(dbRollout.FinishedAt.IsZero(), check.Equals, false)
+	a, err := GetByName("app1")
+	c.Assert(err, check.IsNil)
+	c.Assert(a.UpdatePlatform, check.Equals, false)
+	c.Assert(a.Lock.Locked, check.Equals, false)
+	c.Assert(s.provisioner.Version(a), check.Equals, "abc123")
+}
+
+func (s *PlatformSuite) TestRunPlatformRolloutPausesOnFailures(c *check.C) {
+	s.createRolloutApp(c, "app1", "python", "git")
+	s.createRolloutApp(c, "app2", "python", "git")
+	defer s.removeRolloutApps("app1", "app2")
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	rollout := PlatformRollout{
+		Platform:     "python",
+		Status:       RolloutRunning,
+		BatchPercent: 50,
+		Total:        2,
+		Pending:      []string{"app1", "app2"},
+	}
+	err = conn.PlatformRollouts().Insert(rollout)
+	c.Assert(err, check.IsNil)
+	s.provisioner.PrepareFailure("GitDeploy", errors.New("build failed"))
+	runPlatformRollout(&rollout)
+	dbRollout, err := GetPlatformRollout("python")
+	c.Assert(err, check.IsNil)
+	c.Assert(dbRollout.Status, check.Equals, RolloutPaused)
+	c.Assert(dbRollout.Reason, check.Equals, "100% of the rebuilds failed, the maximum allowed is 0%")
+	c.Assert(dbRollout.Pending, check.DeepEquals, []string{"app2"})
+	c.Assert(dbRollout.Failed, check.DeepEquals, []RolloutFailure{{App: "app1", Error: "build failed"}})
+	a, err := GetByName("app1")
+	c.Assert(err, check.IsNil)
+	c.Assert(a.UpdatePlatform, check.Equals, true)
+}
+
+func (s *PlatformSuite) TestRunPlatformRolloutBatchTimeout(c *check.C) {
+	s.createRolloutApp(c, "app1", "python", "git")
+	defer s.removeRolloutApps("app1")
+	config.Set("platform-rollout:batch-timeout", 1)
+	defer config.Unset("platform-rollout:batch-timeout")
+	config.Set("deploy:queue:max-concurrent", 1)
+	defer config.Unset("deploy:queue")
+	err := InitializeDeployQueue()
+	c.Assert(err, check.IsNil)
+	oldInterval := deployQueueInterval
+	deployQueueInterval = 50 * time.Millisecond
+	defer func() { deployQueueInterval = oldInterval }()
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Collection("deploy_queue_lock").RemoveAll(nil)
+	defer conn.RunningDeploys().RemoveAll(nil)
+	now := time.Now()
+	err = conn.RunningDeploys().Insert(runningDeploy{App: "other", Timestamp: now, Started: now})
+	c.Assert(err, check.IsNil)
+	rollout := PlatformRollout{
+		Platform:     "python",
+		Status:       RolloutRunning,
+		User:         "admin@tsuru.io",
+		BatchPercent: 100,
+		Total:        1,
+		Pending:      []string{"app1"},
+	}
+	err = conn.PlatformRollouts().Insert(rollout)
+	c.Assert(err, check.IsNil)
+	runPlatformRollout(&rollout)
+	n, err := conn.RunningDeploys().FindId("app1").Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 0)
+	dbRollout, err := GetPlatformRollout("python")
+	c.Assert(err, check.IsNil)
+	c.Assert(dbRollout.Status, check.Equals, RolloutFinished)
+	c.Assert(dbRollout.Succeeded, check.HasLen, 0)
+	c.Assert(dbRollout.Failed, check.DeepEquals, []RolloutFailure{
+		{App: "app1", Error: "timed out after 1s rebuilding the app"},
+	})
+	err = conn.RunningDeploys().RemoveId("other")
+	c.Assert(err, check.IsNil)
+	time.Sleep(200 * time.Millisecond)
+	a, err := GetByName("app1")
+	c.Assert(err, check.IsNil)
+	c.Assert(a.UpdatePlatform, check.Equals, true)
+	c.Assert(a.Lock.Locked, check.Equals, false)
+	c.Assert(s.provisioner.Version(a), check.Equals, "")
+}
+
+func (s *PlatformSuite) TestRebuildAppCanceled(c *check.C) {
+	s.createRolloutApp(c, "app1", "python", "git")
+	defer s.removeRolloutApps("app1")
+	cancel := make(chan struct{})
+	close(cancel)
+	skipped, err := rebuildApp("app1", &PlatformRollout{Platform: "python"}, cancel)
+	c.Assert(skipped, check.Equals, false)
+	c.Assert(err, check.ErrorMatches, "rebuild canceled")
+	a, err := GetByName("app1")
+	c.Assert(err, check.IsNil)
+	c.Assert(a.UpdatePlatform, check.Equals, true)
+	c.Assert(a.Lock.Locked, check.Equals, false)
+	c.Assert(s.provisioner.Version(a), check.Equals, "")
+}
+
+func (s *PlatformSuite) TestStartPlatformRollout(c *check.C) {
+	s.createRolloutApp(c, "app1", "python", "git")
+	s.createRolloutApp(c, "app2", "ruby", "git")
+	defer s.removeRolloutApps("app1", "app2")
+	rollout, err := StartPlatformRollout("python", PlatformRolloutOptions{MaxFailurePercent: -1}, "admin@tsuru.io")
+	c.Assert(err, check.IsNil)
+	c.Assert(rollout.Status, check.Equals, RolloutRunning)
+	c.Assert(rollout.Total, check.Equals, 1)
+	c.Assert(rollout.BatchPercent, check.Equals, 20)
+	c.Assert(rollout.MaxFailurePercent, check.Equals, 10)
+	dbRollout := s.waitRollout(c, "python")
+	c.Assert(dbRollout.Status, check.Equals, RolloutFinished)
+	c.Assert(dbRollout.Succeeded, check.DeepEquals, []string{"app1"})
+	c.Assert(dbRollout.User, check.Equals, "admin@tsuru.io")
+}
+
+func (s *PlatformSuite) TestStartPlatformRolloutInProgress(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	conn.Platforms().Insert(Platform{Name: "python"})
+	err = conn.PlatformRollouts().Insert(PlatformRollout{Platform: "python", Status: RolloutRunning, UpdatedAt: time.Now()})
+	c.Assert(err, check.IsNil)
+	defer conn.PlatformRollouts().RemoveAll(nil)
+	_, err = StartPlatformRollout("python", PlatformRolloutOptions{}, "admin@tsuru.io")
+	c.Assert(err, check.Equals, ErrPlatformRolloutInProgress)
+}
+
+func (s *PlatformSuite) TestStartPlatformRolloutResumesPausedRollout(c *check.C) {
+	s.createRolloutApp(c, "app1", "python", "git")
+	s.createRolloutApp(c, "app2", "python", "git")
+	defer s.removeRolloutApps("app1", "app2")
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.PlatformRollouts().Insert(PlatformRollout{
+		Platform: "python",
+		Status:   RolloutPaused,
+		Reason:   "100% of the rebuilds failed, the maximum allowed is 0%",
+		Total:    2,
+		Pending:  []string{"app2"},
+		Failed:   []RolloutFailure{{App: "app1", Error: "build failed"}},
+	})
+	c.Assert(err, check.IsNil)
+	rollout, err := StartPlatformRollout("python", PlatformRolloutOptions{BatchPercent: 100, MaxFailurePercent: 50}, "admin@tsuru.io")
+	c.Assert(err, check.IsNil)
+	c.Assert(rollout.Pending, check.DeepEquals, []string{"app2"})
+	dbRollout := s.waitRollout(c, "python")
+	c.Assert(dbRollout.Status, check.Equals, RolloutFinished)
+	c.Assert(dbRollout.Reason, check.Equals, "")
+	c.Assert(dbRollout.Succeeded, check.DeepEquals, []string{"app2"})
+	c.Assert(dbRollout.Failed, check.DeepEquals, []RolloutFailure{{App: "app1", Error: "build failed"}})
+}
+
+func (s *PlatformSuite) TestStartPlatformRolloutResumesStaleRollout(c *check.C) {
+	s.createRolloutApp(c, "app1", "python", "git")
+	s.createRolloutApp(c, "app2", "python", "git")
+	defer s.removeRolloutApps("app1", "app2")
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.PlatformRollouts().Insert(PlatformRollout{
+		Platform:  "python",
+		Status:    RolloutRunning,
+		Total:     2,
+		Pending:   []string{"app2"},
+		Succeeded: []string{"app1"},
+		UpdatedAt: time.Now().Add(-2 * rolloutStaleTimeout),
+		Runner:    "dead-runner",
+	})
+	c.Assert(err, check.IsNil)
+	rollout, err := StartPlatformRollout("python", PlatformRolloutOptions{BatchPercent: 100}, "admin@tsuru.io")
+	c.Assert(err, check.IsNil)
+	c.Assert(rollout.Pending, check.DeepEquals, []string{"app2"})
+	c.Assert(rollout.Runner, check.Not(check.Equals), "dead-runner")
+	dbRollout := s.waitRollout(c, "python")
+	c.Assert(dbRollout.Status, check.Equals, RolloutFinished)
+	c.Assert(dbRollout.Succeeded, check.DeepEquals, []string{"app1", "app2"})
+}
+
+func (s *PlatformSuite) TestInitializePlatformRolloutsResumesStaleRollouts(c *check.C) {
+	s.createRolloutApp(c, "app1", "python", "git")
+	s.createRolloutApp(c, "app2", "ruby", "git")
+	defer s.removeRolloutApps("app1", "app2")
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.PlatformRollouts().Insert(PlatformRollout{
+		Platform:     "python",
+		Status:       RolloutRunning,
+		BatchPercent: 100,
+		Total:        1,
+		Pending:      []string{"app1"},
+		UpdatedAt:    time.Now().Add(-2 * rolloutStaleTimeout),
+	}, PlatformRollout{
+		Platform:     "ruby",
+		Status:       RolloutRunning,
+		BatchPercent: 100,
+		Total:        1,
+		Pending:      []string{"app2"},
+		UpdatedAt:    time.Now(),
+		Runner:       "alive-runner",
+	})
+	c.Assert(err, check.IsNil)
+	queue.ResetQueue()
+	err = InitializePlatformRollouts()
+	c.Assert(err, check.IsNil)
+	dbRollout := s.waitRollout(c, "python")
+	c.Assert(dbRollout.Status, check.Equals, RolloutFinished)
+	c.Assert(dbRollout.Succeeded, check.DeepEquals, []string{"app1"})
+	dbRollout, err = GetPlatformRollout("ruby")
+	c.Assert(err, check.IsNil)
+	c.Assert(dbRollout.Status, check.Equals, RolloutRunning)
+	c.Assert(dbRollout.Runner, check.Equals, "alive-runner")
+	c.Assert(dbRollout.Pending, check.DeepEquals, []string{"app2"})
+}
+
+func (s *PlatformSuite) TestRunPlatformRolloutStopsWhenResumedByAnotherRunner(c *check.C) {
+	s.createRolloutApp(c, "app1", "python", "git")
+	s.createRolloutApp(c, "app2", "python", "git")
+	defer s.removeRolloutApps("app1", "app2")
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	rollout := PlatformRollout{
+		Platform:     "python",
+		Status:       RolloutRunning,
+		BatchPercent: 50,
+		Total:        2,
+		Pending:      []string{"app1", "app2"},
+		Runner:       "old-runner",
+	}
+	err = conn.PlatformRollouts().Insert(rollout)
+	c.Assert(err, check.IsNil)
+	err = conn.PlatformRollouts().UpdateId("python", bson.M{"$set": bson.M{"runner": "new-runner"}})
+	c.Assert(err, check.IsNil)
+	runPlatformRollout(&rollout)
+	dbRollout, err := GetPlatformRollout("python")
+	c.Assert(err, check.IsNil)
+	c.Assert(dbRollout.Runner, check.Equals, "new-runner")
+	c.Assert(dbRollout.Pending, check.DeepEquals, []string{"app1", "app2"})
+	c.Assert(dbRollout.Succeeded, check.HasLen, 0)
+}
+
+func (s *PlatformSuite) TestRebuildOptions(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Deploys().Insert(DeployData{App: "myapp", Timestamp: time.Now(), Origin: "git", Commit: "abc123", Image: "tsuru/app-myapp:v1"})
+	c.Assert(err, check.IsNil)
+	defer conn.Deploys().RemoveAll(bson.M{"app": "myapp"})
+	tests := []struct {
+		deploy DeployData
+		opts   DeployOptions
+		err    string
+	}{
+		{DeployData{Origin: "git", Commit: "abc123"}, DeployOptions{Version: "abc123", Commit: "abc123"}, ""},
+		{DeployData{Origin: "image", ExternalImage: "registry.example.com/myapp:1.0"}, DeployOptions{}, errExternalImageRebuild.Error()},
+		{DeployData{Origin: "app-deploy", ArchiveURL: "https://example.com/myapp.tar.gz"}, DeployOptions{ArchiveURL: "https://example.com/myapp.tar.gz"}, ""},
+		{DeployData{App: "myapp", Origin: "rollback", Image: "tsuru/app-myapp:v1"}, DeployOptions{Version: "abc123", Commit: "abc123"}, ""},
+		{DeployData{App: "myapp", Origin: "rollback", Image: "tsuru/app-myapp:v0"}, DeployOptions{}, "unable to find the deploy that built the image tsuru/app-myapp:v0"},
+		{DeployData{Origin: "app-deploy"}, DeployOptions{}, "the archive uploaded in the last deploy of the app is not stored"},
+		{DeployData{Origin: "image"}, DeployOptions{}, errExternalImageRebuild.Error()},
+		{DeployData{Origin: "upload"}, DeployOptions{}, "the source of the last deploy of the app is not stored (origin: upload)"},
+	}
+	for _, tt := range tests {
+		opts, err := rebuildOptions(conn, &tt.deploy)
+		if tt.err != "" {
+			c.Check(err, check.ErrorMatches, regexp.QuoteMeta(tt.err))
+			continue
+		}
+		c.Check(err, check.IsNil)
+		c.Check(opts, check.DeepEquals, tt.opts)
+	}
+}
+
+func (s *PlatformSuite) TestRunPlatformRolloutSkipsImageDeploys(c *check.C) {
+	s.createRolloutApp(c, "app1", "python", "image")
+	defer s.removeRolloutApps("app1")
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	rollout := PlatformRollout{
+		Platform:     "python",
+		Status:       RolloutRunning,
+		BatchPercent: 100,
+		Total:        1,
+		Pending:      []string{"app1"},
+	}
+	err = conn.PlatformRollouts().Insert(rollout)
+	c.Assert(err, check.IsNil)
+	runPlatformRollout(&rollout)
+	dbRollout, err := GetPlatformRollout("python")
+	c.Assert(err, check.IsNil)
+	c.Assert(dbRollout.Status, check.Equals, RolloutFinished)
+	c.Assert(dbRollout.Succeeded, check.HasLen, 0)
+	c.Assert(dbRollout.Failed, check.HasLen, 0)
+	c.Assert(dbRollout.Skipped, check.DeepEquals, []RolloutFailure{
+		{App: "app1", Error: errExternalImageRebuild.Error()},
+	})
+	a, err := GetByName("app1")
+	c.Assert(err, check.IsNil)
+	c.Assert(a.Lock.Locked, check.Equals, false)
+	c.Assert(s.provisioner.LastImage(a), check.Equals, "")
+}
+
+func (s *PlatformSuite) TestStartPlatformRolloutInvalidPlatform(c *check.C) {
+	_, err := StartPlatformRollout("unknown", PlatformRolloutOptions{}, "admin@tsuru.io")
+	c.Assert(err, check.FitsTypeOf, InvalidPlatformError{})
+}
+
+func (s *PlatformSuite) TestGetPlatformRolloutNotFound(c *check.C) {
+	_, err := GetPlatformRollout("python")
+	c.Assert(err, check.Equals, ErrPlatformRolloutNotFound)
+}
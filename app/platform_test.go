@@ -11,6 +11,7 @@ import (
 	"github.com/tsuru/tsuru/db"
 	"github.com/tsuru/tsuru/db/dbtest"
 	"github.com/tsuru/tsuru/provision/provisiontest"
+	"github.com/tsuru/tsuru/queue"
 	"github.com/tsuru/tsuru/repository/repositorytest"
 	"gopkg.in/check.v1"
 	"gopkg.in/mgo.v2/bson"
@@ -34,10 +35,14 @@ func (s *PlatformSuite) TearDownSuite(c *check.C) {
 	c.Assert(err, check.IsNil)
 	dbtest.ClearAllCollections(conn.Apps().Database)
 	conn.Close()
+	queue.ResetQueue()
 }
 
 func (s *PlatformSuite) SetUpTest(c *check.C) {
 	repositorytest.Reset()
+	queue.ResetQueue()
+	err := InitializePlatformRollouts()
+	c.Assert(err, check.IsNil)
 }
 
 func (s *PlatformSuite) TestPlatforms(c *check.C) {
@@ -101,8 +106,63 @@ func (s *PlatformSuite) TestPlatformAdd(c *check.C) {
 	c.Assert(err, check.IsNil)
 	platform := provisioner.GetPlatform(name)
 	c.Assert(platform.Name, check.Equals, name)
-	c.Assert(platform.Args, check.DeepEquals, args)
+	c.Assert(platform.Args, check.DeepEquals, map[string]string{
+		"dockerfile": "http://localhost/Dockerfile",
+		"version":    "v1",
+	})
 	c.Assert(platform.Version, check.Equals, 1)
+	dbPlatform, err := getPlatform(name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbPlatform.Current, check.Equals, "v1")
+	c.Assert(dbPlatform.Versions, check.HasLen, 1)
+	c.Assert(dbPlatform.Versions[0].Version, check.Equals, "v1")
+}
+
+func (s *PlatformSuite) TestPlatformAddWithVersion(c *check.C) {
+	provisioner := provisiontest.ExtensibleFakeProvisioner{
+		FakeProvisioner: provisiontest.NewFakeProvisioner(),
+	}
+	Provisioner = &provisioner
+	defer func() {
+		Provisioner = s.provisioner
+	}()
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	name := "test_platform_add"
+	args := map[string]string{"dockerfile": "http://localhost/Dockerfile", "version": "3.4-2015.06"}
+	err = PlatformAdd(name, args, nil)
+	defer conn.Platforms().Remove(bson.M{"_id": name})
+	c.Assert(err, check.IsNil)
+	c.Assert(provisioner.GetPlatform(name).Args["version"], check.Equals, "3.4-2015.06")
+	dbPlatform, err := getPlatform(name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbPlatform.Current, check.Equals, "3.4-2015.06")
+}
+
+func (s *PlatformSuite) TestPlatformAddInvalidVersion(c *check.C) {
+	provisioner := provisiontest.ExtensibleFakeProvisioner{
+		FakeProvisioner: provisiontest.NewFakeProvisioner(),
+	}
+	Provisioner = &provisioner
+	defer func() {
+		Provisioner = s.provisioner
+	}()
+	err := PlatformAdd("test_platform_add", map[string]string{"version": "3.4/beta"}, nil)
+	c.Assert(err, check.ErrorMatches, `Invalid platform version "3.4/beta".*`)
+	c.Assert(provisioner.GetPlatform("test_platform_add"), check.IsNil)
+}
+
+func (s *PlatformSuite) TestPlatformAddNameWithColon(c *check.C) {
+	provisioner := provisiontest.ExtensibleFakeProvisioner{
+		FakeProvisioner: provisiontest.NewFakeProvisioner(),
+	}
+	Provisioner = &provisioner
+	defer func() {
+		Provisioner = s.provisioner
+	}()
+	err := PlatformAdd("python:3.4", nil, nil)
+	c.Assert(err, check.ErrorMatches, "Platform name must not contain colons.")
 }
 
 func (s *PlatformSuite) TestPlatformAddDuplicate(c *check.C) {
@@ -192,6 +252,149 @@ func (s *PlatformSuite) TestPlatformUpdate(c *check.C) {
 	defer conn.Platforms().Remove(bson.M{"_id": name})
 	err = PlatformUpdate(name, args, nil)
 	c.Assert(err, check.IsNil)
+	platform, err := getPlatform(name)
+	c.Assert(err, check.IsNil)
+	c.Assert(platform.Current, check.Equals, "v2")
+	c.Assert(platform.Versions, check.HasLen, 2)
+	c.Assert(platform.Versions[0].Version, check.Equals, "v1")
+	c.Assert(platform.Versions[1].Version, check.Equals, "v2")
+	c.Assert(provisioner.GetPlatform(name).Args["version"], check.Equals, "v2")
+}
+
+func (s *PlatformSuite) TestPlatformUpdateDuplicateVersion(c *check.C) {
+	provisioner := provisiontest.ExtensibleFakeProvisioner{
+		FakeProvisioner: provisiontest.NewFakeProvisioner(),
+	}
+	Provisioner = &provisioner
+	defer func() {
+		Provisioner = s.provisioner
+	}()
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	name := "test_platform_update"
+	err = PlatformAdd(name, map[string]string{"version": "2015.06"}, nil)
+	c.Assert(err, check.IsNil)
+	defer conn.Platforms().Remove(bson.M{"_id": name})
+	err = PlatformUpdate(name, map[string]string{"version": "2015.06"}, nil)
+	c.Assert(err, check.ErrorMatches, `Version "2015.06" already exists for platform test_platform_update.`)
+	c.Assert(provisioner.GetPlatform(name).Version, check.Equals, 1)
+}
+
+func (s *PlatformSuite) TestPlatformUpdateDoesNotMarkPinnedApps(c *check.C) {
+	provisioner := provisiontest.ExtensibleFakeProvisioner{
+		FakeProvisioner: provisiontest.NewFakeProvisioner(),
+	}
+	Provisioner = &provisioner
+	defer func() {
+		Provisioner = s.provisioner
+	}()
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	name := "test_platform_update"
+	err = PlatformAdd(name, nil, nil)
+	c.Assert(err, check.IsNil)
+	defer conn.Platforms().Remove(bson.M{"_id": name})
+	err = conn.Apps().Insert(App{Name: "pinned_app", Platform: name, PlatformVersion: "v1"})
+	c.Assert(err, check.IsNil)
+	defer conn.Apps().Remove(bson.M{"name": "pinned_app"})
+	err = PlatformUpdate(name, nil, nil)
+	c.Assert(err, check.IsNil)
+	a, err := GetByName("pinned_app")
+	c.Assert(err, check.IsNil)
+	c.Assert(a.UpdatePlatform, check.Equals, false)
+	c.Assert(a.GetPlatformVersion(), check.Equals, "v1")
+}
+
+func (s *PlatformSuite) TestPlatformRollback(c *check.C) {
+	provisioner := provisiontest.ExtensibleFakeProvisioner{
+		FakeProvisioner: provisiontest.NewFakeProvisioner(),
+	}
+	Provisioner = &provisioner
+	defer func() {
+		Provisioner = s.provisioner
+	}()
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	name := "test_platform_rollback"
+	err = PlatformAdd(name, nil, nil)
+	c.Assert(err, check.IsNil)
+	defer conn.Platforms().Remove(bson.M{"_id": name})
+	err = PlatformUpdate(name, nil, nil)
+	c.Assert(err, check.IsNil)
+	err = PlatformUpdate(name, nil, nil)
+	c.Assert(err, check.IsNil)
+	err = conn.Apps().Insert(App{Name: "rollback_app", Platform: name})
+	c.Assert(err, check.IsNil)
+	defer conn.Apps().Remove(bson.M{"name": "rollback_app"})
+	err = PlatformRollback(name, "")
+	c.Assert(err, check.IsNil)
+	platform, err := getPlatform(name)
+	c.Assert(err, check.IsNil)
+	c.Assert(platform.Current, check.Equals, "v2")
+	a, err := GetByName("rollback_app")
+	c.Assert(err, check.IsNil)
+	c.Assert(a.UpdatePlatform, check.Equals, true)
+	c.Assert(a.GetPlatformVersion(), check.Equals, "v2")
+	err = PlatformRollback(name, "v1")
+	c.Assert(err, check.IsNil)
+	platform, err = getPlatform(name)
+	c.Assert(err, check.IsNil)
+	c.Assert(platform.Current, check.Equals, "v1")
+	err = PlatformRollback(name, "")
+	c.Assert(err, check.ErrorMatches, "Platform has no previous version.")
+	err = PlatformRollback(name, "v1")
+	c.Assert(err, check.ErrorMatches, `Version "v1" is already the current version of platform test_platform_rollback.`)
+	err = PlatformRollback(name, "v9")
+	c.Assert(err, check.ErrorMatches, `Version "v9" not found for platform test_platform_rollback.`)
+}
+
+func (s *PlatformSuite) TestPlatformRollbackInvalidPlatform(c *check.C) {
+	err := PlatformRollback("unknown", "v1")
+	c.Assert(err, check.FitsTypeOf, InvalidPlatformError{})
+}
+
+func (s *PlatformSuite) TestPlatformSetState(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Platforms().Insert(Platform{Name: "stateplat"})
+	c.Assert(err, check.IsNil)
+	defer conn.Platforms().RemoveId("stateplat")
+	err = PlatformSetState("stateplat", PlatformDeprecated)
+	c.Assert(err, check.IsNil)
+	platform, err := getPlatform("stateplat")
+	c.Assert(err, check.IsNil)
+	c.Assert(platform.Deprecated(), check.Equals, true)
+	c.Assert(platform.Disabled(), check.Equals, false)
+	err = PlatformSetState("stateplat", PlatformDisabled)
+	c.Assert(err, check.IsNil)
+	platform, err = getPlatform("stateplat")
+	c.Assert(err, check.IsNil)
+	c.Assert(platform.Disabled(), check.Equals, true)
+	err = PlatformSetState("stateplat", PlatformEnabled)
+	c.Assert(err, check.IsNil)
+	platform, err = getPlatform("stateplat")
+	c.Assert(err, check.IsNil)
+	c.Assert(platform.State, check.Equals, PlatformEnabled)
+}
+
+func (s *PlatformSuite) TestPlatformSetStateInvalid(c *check.C) {
+	err := PlatformSetState("stateplat", "removed")
+	c.Assert(err, check.ErrorMatches, `Invalid state "removed": must be one of enabled, deprecated or disabled.`)
+	err = PlatformSetState("unknown", PlatformDisabled)
+	c.Assert(err, check.FitsTypeOf, InvalidPlatformError{})
+}
+
+func (s *PlatformSuite) TestParsePlatform(c *check.C) {
+	name, version := parsePlatform("python:3.4-2015.06")
+	c.Assert(name, check.Equals, "python")
+	c.Assert(version, check.Equals, "3.4-2015.06")
+	name, version = parsePlatform("python")
+	c.Assert(name, check.Equals, "python")
+	c.Assert(version, check.Equals, "")
 }
 
 func (s *PlatformSuite) TestPlatformUpdateWithoutName(c *check.C) {
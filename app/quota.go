@@ -7,6 +7,7 @@ package app
 import (
 	"errors"
 
+	"github.com/tsuru/tsuru/auth"
 	"github.com/tsuru/tsuru/db"
 	"github.com/tsuru/tsuru/quota"
 	"gopkg.in/mgo.v2"
@@ -18,6 +19,24 @@ func reserveUnits(app *App, quantity int) error {
 	if err != nil {
 		return err
 	}
+	err = auth.ReserveTeamUnits(app.TeamOwner, quantity)
+	if err != nil {
+		return err
+	}
+	err = reserveResourceQuotas(app, quantity)
+	if err != nil {
+		auth.ReleaseTeamUnits(app.TeamOwner, quantity)
+		return err
+	}
+	err = reserveAppUnits(app, quantity)
+	if err != nil {
+		releaseResourceQuotas(app, quantity)
+		auth.ReleaseTeamUnits(app.TeamOwner, quantity)
+	}
+	return err
+}
+
+func reserveAppUnits(app *App, quantity int) error {
 	conn, err := db.Conn()
 	if err != nil {
 		return err
@@ -78,7 +97,11 @@ func releaseUnits(app *App, quantity int) error {
 			bson.M{"$inc": bson.M{"quota.inuse": -1 * quantity}},
 		)
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	releaseResourceQuotas(app, quantity)
+	return auth.ReleaseTeamUnits(app.TeamOwner, quantity)
 }
 
 func checkAppUsage(name string, quantity int) (*App, error) {
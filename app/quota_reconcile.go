@@ -0,0 +1,178 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/auth"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/db/storage"
+	"github.com/tsuru/tsuru/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	QuotaApp       = "app"
+	QuotaUser      = "user"
+	QuotaTeamApps  = "team-apps"
+	QuotaTeamUnits = "team-units"
+)
+
+// QuotaMismatch describes a quota whose recorded usage differs from the real
+// usage, computed from the units in the provisioner and the ownership of the
+// apps.
+type QuotaMismatch struct {
+	Kind     string
+	Name     string
+	Recorded int
+	Actual   int
+	Fixed    bool
+}
+
+func (m QuotaMismatch) String() string {
+	status := ""
+	if m.Fixed {
+		status = " (fixed)"
+	}
+	return fmt.Sprintf("%s %s: recorded usage is %d, actual usage is %d%s", m.Kind, m.Name, m.Recorded, m.Actual, status)
+}
+
+// StartQuotaReconciler starts reconciling the quotas in background, in the
+// interval defined by the setting quota:reconcile:interval (in seconds). When
+// quota:reconcile:fix is true, mismatches are also fixed.
+func StartQuotaReconciler() {
+	interval, _ := config.GetInt("quota:reconcile:interval")
+	if interval > 0 {
+		fix, _ := config.GetBool("quota:reconcile:fix")
+		go runQuotaReconciler(time.Duration(interval)*time.Second, fix)
+	}
+}
+
+func runQuotaReconciler(interval time.Duration, fix bool) {
+	for {
+		time.Sleep(interval)
+		mismatches, err := ReconcileQuotas(fix)
+		if err != nil {
+			log.Errorf("[quota-reconcile] unable to reconcile quotas: %s", err)
+			continue
+		}
+		for _, m := range mismatches {
+			log.Errorf("[quota-reconcile] %s", m)
+		}
+	}
+}
+
+// ReconcileQuotas recomputes the usage of the quotas of apps, users and teams
+// from the units in the provisioner and the ownership of the apps, returning
+// the quotas whose recorded usage is wrong. When fix is true, the recorded
+// usage is replaced by the actual usage.
+//
+// Apps that are locked are ignored, as units may be in the middle of being
+// added or removed. A quota is only fixed if its recorded usage didn't change
+// during the reconciliation.
+func ReconcileQuotas(fix bool) ([]QuotaMismatch, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var apps []App
+	err = conn.Apps().Find(nil).All(&apps)
+	if err != nil {
+		return nil, err
+	}
+	var mismatches []QuotaMismatch
+	userApps := make(map[string]int)
+	teamApps := make(map[string]int)
+	teamUnits := make(map[string]int)
+	skippedTeams := make(map[string]bool)
+	skippedUsers := make(map[string]bool)
+	for i := range apps {
+		a := &apps[i]
+		if a.Lock.Locked {
+			skippedTeams[a.TeamOwner] = true
+			skippedUsers[a.Owner] = true
+			continue
+		}
+		units := len(Provisioner.Units(a))
+		userApps[a.Owner]++
+		teamApps[a.TeamOwner]++
+		teamUnits[a.TeamOwner] += units
+		if units != a.Quota.InUse {
+			m := QuotaMismatch{Kind: QuotaApp, Name: a.Name, Recorded: a.Quota.InUse, Actual: units}
+			if fix {
+				m.Fixed, err = fixQuota(conn.Apps(), bson.M{"name": a.Name}, "quota.inuse", m)
+				if err != nil {
+					return nil, err
+				}
+			}
+			mismatches = append(mismatches, m)
+		}
+	}
+	var users []auth.User
+	err = conn.Users().Find(nil).All(&users)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if skippedUsers[u.Email] || userApps[u.Email] == u.Quota.InUse {
+			continue
+		}
+		m := QuotaMismatch{Kind: QuotaUser, Name: u.Email, Recorded: u.Quota.InUse, Actual: userApps[u.Email]}
+		if fix {
+			m.Fixed, err = fixQuota(conn.Users(), bson.M{"email": u.Email}, "quota.inuse", m)
+			if err != nil {
+				return nil, err
+			}
+		}
+		mismatches = append(mismatches, m)
+	}
+	var teams []auth.Team
+	err = conn.Teams().Find(nil).All(&teams)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range teams {
+		if skippedTeams[t.Name] {
+			continue
+		}
+		var teamMismatches []QuotaMismatch
+		if t.AppQuota != nil && t.AppQuota.InUse != teamApps[t.Name] {
+			teamMismatches = append(teamMismatches, QuotaMismatch{Kind: QuotaTeamApps, Name: t.Name, Recorded: t.AppQuota.InUse, Actual: teamApps[t.Name]})
+		}
+		if t.UnitQuota != nil && t.UnitQuota.InUse != teamUnits[t.Name] {
+			teamMismatches = append(teamMismatches, QuotaMismatch{Kind: QuotaTeamUnits, Name: t.Name, Recorded: t.UnitQuota.InUse, Actual: teamUnits[t.Name]})
+		}
+		for _, m := range teamMismatches {
+			if fix {
+				field := "appquota.inuse"
+				if m.Kind == QuotaTeamUnits {
+					field = "unitquota.inuse"
+				}
+				m.Fixed, err = fixQuota(conn.Teams(), bson.M{"_id": t.Name}, field, m)
+				if err != nil {
+					return nil, err
+				}
+			}
+			mismatches = append(mismatches, m)
+		}
+	}
+	return mismatches, nil
+}
+
+// fixQuota replaces the recorded usage of the quota with the actual usage,
+// unless the recorded usage changed since it was read.
+func fixQuota(coll *storage.Collection, query bson.M, field string, m QuotaMismatch) (bool, error) {
+	query[field] = m.Recorded
+	err := coll.Update(query, bson.M{"$set": bson.M{field: m.Actual}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"github.com/tsuru/tsuru/auth"
+	"github.com/tsuru/tsuru/quota"
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) createReconcileFixtures(c *check.C) {
+	team := auth.Team{
+		Name:      "reconciled",
+		AppQuota:  &quota.Quota{Limit: 10, InUse: 5},
+		UnitQuota: &quota.Quota{Limit: 10, InUse: 3},
+	}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	user := auth.User{Email: "reconciled@tsuru.io", Quota: quota.Quota{Limit: -1, InUse: 4}}
+	err = s.conn.Users().Insert(user)
+	c.Assert(err, check.IsNil)
+	app1 := App{Name: "app1", Owner: user.Email, TeamOwner: team.Name, Quota: quota.Quota{Limit: -1, InUse: 1}}
+	app2 := App{Name: "app2", Owner: user.Email, TeamOwner: team.Name, Quota: quota.Quota{Limit: -1, InUse: 0}}
+	err = s.conn.Apps().Insert(app1, app2)
+	c.Assert(err, check.IsNil)
+	s.provisioner.Provision(&app1)
+	s.provisioner.Provision(&app2)
+	s.provisioner.AddUnits(&app1, 1, nil)
+	s.provisioner.AddUnits(&app2, 2, nil)
+}
+
+func (s *S) removeReconcileFixtures() {
+	s.conn.Teams().RemoveId("reconciled")
+	s.conn.Users().Remove(bson.M{"email": "reconciled@tsuru.io"})
+	s.conn.Apps().RemoveAll(bson.M{"name": bson.M{"$in": []string{"app1", "app2"}}})
+}
+
+func (s *S) TestReconcileQuotas(c *check.C) {
+	s.createReconcileFixtures(c)
+	defer s.removeReconcileFixtures()
+	mismatches, err := ReconcileQuotas(false)
+	c.Assert(err, check.IsNil)
+	c.Assert(mismatches, check.DeepEquals, []QuotaMismatch{
+		{Kind: QuotaApp, Name: "app2", Recorded: 0, Actual: 2},
+		{Kind: QuotaUser, Name: "reconciled@tsuru.io", Recorded: 4, Actual: 2},
+		{Kind: QuotaTeamApps, Name: "reconciled", Recorded: 5, Actual: 2},
+	})
+	a, err := GetByName("app2")
+	c.Assert(err, check.IsNil)
+	c.Assert(a.Quota.InUse, check.Equals, 0)
+}
+
+func (s *S) TestReconcileQuotasFix(c *check.C) {
+	s.createReconcileFixtures(c)
+	defer s.removeReconcileFixtures()
+	mismatches, err := ReconcileQuotas(true)
+	c.Assert(err, check.IsNil)
+	c.Assert(mismatches, check.HasLen, 3)
+	for _, m := range mismatches {
+		c.Assert(m.Fixed, check.Equals, true)
+	}
+	a, err := GetByName("app2")
+	c.Assert(err, check.IsNil)
+	c.Assert(a.Quota.InUse, check.Equals, 2)
+	user, err := auth.GetUserByEmail("reconciled@tsuru.io")
+	c.Assert(err, check.IsNil)
+	c.Assert(user.Quota.InUse, check.Equals, 2)
+	team, err := auth.GetTeam("reconciled")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.AppQuota.InUse, check.Equals, 2)
+	c.Assert(team.UnitQuota.InUse, check.Equals, 3)
+	mismatches, err = ReconcileQuotas(false)
+	c.Assert(err, check.IsNil)
+	c.Assert(mismatches, check.HasLen, 0)
+}
+
+func (s *S) TestReconcileQuotasIgnoresLockedApps(c *check.C) {
+	s.createReconcileFixtures(c)
+	defer s.removeReconcileFixtures()
+	err := s.conn.Apps().Update(bson.M{"name": "app2"}, bson.M{"$set": bson.M{"lock.locked": true}})
+	c.Assert(err, check.IsNil)
+	mismatches, err := ReconcileQuotas(false)
+	c.Assert(err, check.IsNil)
+	c.Assert(mismatches, check.HasLen, 0)
+}
+
+func (s *S) TestQuotaMismatchString(c *check.C) {
+	m := QuotaMismatch{Kind: QuotaTeamUnits, Name: "myteam", Recorded: 3, Actual: 5, Fixed: true}
+	c.Assert(m.String(), check.Equals, "team-units myteam: recorded usage is 3, actual usage is 5 (fixed)")
+}
@@ -8,6 +8,7 @@ import (
 	"runtime"
 	"sync"
 
+	"github.com/tsuru/tsuru/auth"
 	"github.com/tsuru/tsuru/quota"
 	"gopkg.in/check.v1"
 	"gopkg.in/mgo.v2"
@@ -65,6 +66,44 @@ func (s *S) TestReserveUnitsUnlimitedQuota(c *check.C) {
 	c.Assert(app.Quota.InUse, check.Equals, 6)
 }
 
+func (s *S) TestReserveUnitsTeamQuotaExceeded(c *check.C) {
+	team := auth.Team{Name: "pos", UnitQuota: &quota.Quota{Limit: 5, InUse: 2}}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	app := &App{Name: "together", TeamOwner: team.Name, Quota: quota.Unlimited}
+	s.conn.Apps().Insert(app)
+	defer s.conn.Apps().Remove(bson.M{"name": app.Name})
+	err = reserveUnits(app, 4)
+	e, ok := err.(*quota.QuotaExceededError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Available, check.Equals, uint(3))
+	c.Assert(e.Requested, check.Equals, uint(4))
+	err = reserveUnits(app, 3)
+	c.Assert(err, check.IsNil)
+	app, err = GetByName(app.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(app.Quota.InUse, check.Equals, 3)
+	dbTeam, err := auth.GetTeam(team.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbTeam.UnitQuota.InUse, check.Equals, 5)
+}
+
+func (s *S) TestReleaseUnitsReleasesTeamQuota(c *check.C) {
+	team := auth.Team{Name: "pos", UnitQuota: &quota.Quota{Limit: 5, InUse: 4}}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	app := &App{Name: "together", TeamOwner: team.Name, Quota: quota.Quota{Limit: -1, InUse: 4}}
+	s.conn.Apps().Insert(app)
+	defer s.conn.Apps().Remove(bson.M{"name": app.Name})
+	err = releaseUnits(app, 3)
+	c.Assert(err, check.IsNil)
+	dbTeam, err := auth.GetTeam(team.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbTeam.UnitQuota.InUse, check.Equals, 1)
+}
+
 func (s *S) TestReserveUnitsIsAtomic(c *check.C) {
 	ncpu := runtime.NumCPU()
 	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(ncpu))
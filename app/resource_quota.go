@@ -0,0 +1,367 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	ResourceQuotaTeam = "team"
+	ResourceQuotaPool = "pool"
+)
+
+var ErrInvalidResourceQuotaKind = errors.New("invalid kind of resource quota, must be team or pool")
+
+// ResourceQuota limits the aggregate memory and cpu shares of the units of
+// the apps owned by a team or running in a pool. The memory and cpu shares of
+// each unit are defined by the plan of the app. Negative limits mean
+// unlimited.
+type ResourceQuota struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Memory   int64  `json:"memory"`
+	CpuShare int    `json:"cpushare"`
+}
+
+// ResourceUsage holds the limits of a resource quota along with the amount
+// of memory and cpu shares currently reserved by the units of the apps. The
+// reserved amounts are stored along with the quota, and updated as units are
+// added and removed.
+type ResourceUsage struct {
+	ResourceQuota `bson:",inline"`
+	MemoryInUse   int64 `json:"memoryInUse"`
+	CpuShareInUse int   `json:"cpushareInUse"`
+}
+
+type ResourceQuotaExceededError struct {
+	Kind      string
+	Name      string
+	Resource  string
+	Available int64
+	Requested int64
+}
+
+func (err *ResourceQuotaExceededError) Error() string {
+	return fmt.Sprintf("Quota of %s exceeded for %s %s. Available: %d. Requested: %d.",
+		err.Resource, err.Kind, err.Name, err.Available, err.Requested)
+}
+
+func validResourceQuotaKind(kind string) bool {
+	return kind == ResourceQuotaTeam || kind == ResourceQuotaPool
+}
+
+// GetResourceQuota returns the resource quota of the given team or pool. Teams
+// and pools without a quota are unlimited.
+func GetResourceQuota(kind, name string) (*ResourceQuota, error) {
+	if !validResourceQuotaKind(kind) {
+		return nil, ErrInvalidResourceQuotaKind
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var q ResourceQuota
+	err = conn.ResourceQuotas().Find(bson.M{"kind": kind, "name": name}).One(&q)
+	if err == mgo.ErrNotFound {
+		return &ResourceQuota{Kind: kind, Name: name, Memory: -1, CpuShare: -1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// SetResourceQuota defines the limits of memory and cpu shares of the given
+// team or pool. Limits lesser than zero mean unlimited. The usage of new
+// quotas starts with the resources reserved by the units of the apps.
+func SetResourceQuota(kind, name string, memory int64, cpushare int) error {
+	if !validResourceQuotaKind(kind) {
+		return ErrInvalidResourceQuotaKind
+	}
+	if memory < 0 {
+		memory = -1
+	}
+	if cpushare < 0 {
+		cpushare = -1
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for {
+		err = conn.ResourceQuotas().Update(
+			bson.M{"kind": kind, "name": name},
+			bson.M{"$set": bson.M{"memory": memory, "cpushare": cpushare}},
+		)
+		if err != mgo.ErrNotFound {
+			return err
+		}
+		memoryInUse, cpushareInUse, err := resourcesInUse(kind, name)
+		if err != nil {
+			return err
+		}
+		err = conn.ResourceQuotas().Insert(ResourceUsage{
+			ResourceQuota: ResourceQuota{Kind: kind, Name: name, Memory: memory, CpuShare: cpushare},
+			MemoryInUse:   memoryInUse,
+			CpuShareInUse: cpushareInUse,
+		})
+		if !mgo.IsDup(err) {
+			return err
+		}
+	}
+}
+
+// GetResourceUsage returns the resource quota of the given team or pool and
+// the amount of memory and cpu shares reserved by the units of its apps.
+func GetResourceUsage(kind, name string) (*ResourceUsage, error) {
+	if !validResourceQuotaKind(kind) {
+		return nil, ErrInvalidResourceQuotaKind
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var usage ResourceUsage
+	err = conn.ResourceQuotas().Find(bson.M{"kind": kind, "name": name}).One(&usage)
+	if err == nil {
+		return &usage, nil
+	}
+	if err != mgo.ErrNotFound {
+		return nil, err
+	}
+	memory, cpushare, err := resourcesInUse(kind, name)
+	if err != nil {
+		return nil, err
+	}
+	return &ResourceUsage{
+		ResourceQuota: ResourceQuota{Kind: kind, Name: name, Memory: -1, CpuShare: -1},
+		MemoryInUse:   memory,
+		CpuShareInUse: cpushare,
+	}, nil
+}
+
+// resourcesInUse computes the amount of memory and cpu shares reserved by
+// the units of the apps owned by the team or running in the pool.
+func resourcesInUse(kind, name string) (int64, int, error) {
+	query := bson.M{"teamowner": name}
+	if kind == ResourceQuotaPool {
+		query = bson.M{"pool": bson.M{"$in": []string{name, ""}}}
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	var apps []App
+	err = conn.Apps().Find(query).Select(bson.M{"pool": 1, "teamowner": 1, "teams": 1, "plan": 1, "quota": 1}).All(&apps)
+	if err != nil {
+		return 0, 0, err
+	}
+	var memory int64
+	var cpushare int
+	for i := range apps {
+		a := &apps[i]
+		if kind == ResourceQuotaPool && a.Pool == "" {
+			pool, err := a.effectivePool()
+			if err != nil {
+				return 0, 0, err
+			}
+			if pool != name {
+				continue
+			}
+		}
+		memory += a.Plan.Memory * int64(a.Quota.InUse)
+		cpushare += a.Plan.CpuShare * a.Quota.InUse
+	}
+	return memory, cpushare, nil
+}
+
+type resourceQuotaOwner struct {
+	kind, name string
+}
+
+// resourceQuotaOwners returns the team owner and the effective pool of the
+// app, whose resource quotas limit the units of the app.
+func resourceQuotaOwners(app *App) ([]resourceQuotaOwner, error) {
+	pool, err := app.effectivePool()
+	if err != nil {
+		return nil, err
+	}
+	var owners []resourceQuotaOwner
+	if app.TeamOwner != "" {
+		owners = append(owners, resourceQuotaOwner{ResourceQuotaTeam, app.TeamOwner})
+	}
+	if pool != "" {
+		owners = append(owners, resourceQuotaOwner{ResourceQuotaPool, pool})
+	}
+	return owners, nil
+}
+
+// check checks whether the given amounts of memory and cpu shares fit in the
+// quota.
+func (usage *ResourceUsage) check(memory int64, cpushare int) error {
+	if usage.Memory > -1 && usage.MemoryInUse+memory > usage.Memory {
+		return newResourceQuotaExceededError(usage, "memory", usage.Memory-usage.MemoryInUse, memory)
+	}
+	if usage.CpuShare > -1 && int64(usage.CpuShareInUse)+int64(cpushare) > int64(usage.CpuShare) {
+		return newResourceQuotaExceededError(usage, "cpu shares", int64(usage.CpuShare-usage.CpuShareInUse), int64(cpushare))
+	}
+	return nil
+}
+
+// checkResourceQuotas checks whether the given number of units of the app fit
+// in the resource quotas of the team owner and the pool of the app, without
+// reserving them.
+func checkResourceQuotas(app *App, units int) error {
+	owners, err := resourceQuotaOwners(app)
+	if err != nil {
+		return err
+	}
+	for _, owner := range owners {
+		usage, err := GetResourceUsage(owner.kind, owner.name)
+		if err != nil {
+			return err
+		}
+		err = usage.check(app.Plan.Memory*int64(units), app.Plan.CpuShare*units)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reserveResourceQuotas reserves the memory and cpu shares of the given
+// number of units of the app in the resource quotas of the team owner and the
+// pool of the app, returning an error when any of them is exceeded.
+func reserveResourceQuotas(app *App, units int) error {
+	owners, err := resourceQuotaOwners(app)
+	if err != nil {
+		return err
+	}
+	memory, cpushare := app.Plan.Memory*int64(units), app.Plan.CpuShare*units
+	for i, owner := range owners {
+		err = reserveResourceQuota(owner.kind, owner.name, memory, cpushare)
+		if err != nil {
+			for _, reserved := range owners[:i] {
+				releaseResourceQuota(reserved.kind, reserved.name, memory, cpushare)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseResourceQuotas releases the memory and cpu shares of the given
+// number of units of the app from the resource quotas of the team owner and
+// the pool of the app.
+func releaseResourceQuotas(app *App, units int) {
+	owners, err := resourceQuotaOwners(app)
+	if err != nil {
+		log.Errorf("Unable to release units of app %s from resource quotas: %s", app.Name, err)
+		return
+	}
+	for _, owner := range owners {
+		releaseResourceQuota(owner.kind, owner.name, app.Plan.Memory*int64(units), app.Plan.CpuShare*units)
+	}
+}
+
+// reserveResourceQuota reserves the given amounts of memory and cpu shares
+// in the resource quota of the team or pool, which are unlimited when the
+// quota isn't defined.
+func reserveResourceQuota(kind, name string, memory int64, cpushare int) error {
+	if memory == 0 && cpushare == 0 {
+		return nil
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for {
+		var usage ResourceUsage
+		err = conn.ResourceQuotas().Find(bson.M{"kind": kind, "name": name}).One(&usage)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = usage.check(memory, cpushare)
+		if err != nil {
+			return err
+		}
+		err = conn.ResourceQuotas().Update(
+			bson.M{"kind": kind, "name": name, "memoryinuse": usage.MemoryInUse, "cpushareinuse": usage.CpuShareInUse},
+			bson.M{"$inc": bson.M{"memoryinuse": memory, "cpushareinuse": cpushare}},
+		)
+		if err != mgo.ErrNotFound {
+			return err
+		}
+	}
+}
+
+// releaseResourceQuota releases the given amounts of memory and cpu shares
+// from the resource quota of the team or pool. Failures are logged, as they
+// must not break the removal of units.
+func releaseResourceQuota(kind, name string, memory int64, cpushare int) {
+	if memory == 0 && cpushare == 0 {
+		return
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		log.Errorf("Unable to release resources from quota of %s %s: %s", kind, name, err)
+		return
+	}
+	defer conn.Close()
+	for {
+		var usage ResourceUsage
+		err = conn.ResourceQuotas().Find(bson.M{"kind": kind, "name": name}).One(&usage)
+		if err == mgo.ErrNotFound {
+			return
+		}
+		if err == nil {
+			memoryInUse, cpushareInUse := usage.MemoryInUse-memory, usage.CpuShareInUse-cpushare
+			if memoryInUse < 0 {
+				memoryInUse = 0
+			}
+			if cpushareInUse < 0 {
+				cpushareInUse = 0
+			}
+			err = conn.ResourceQuotas().Update(
+				bson.M{"kind": kind, "name": name, "memoryinuse": usage.MemoryInUse, "cpushareinuse": usage.CpuShareInUse},
+				bson.M{"$set": bson.M{"memoryinuse": memoryInUse, "cpushareinuse": cpushareInUse}},
+			)
+		}
+		if err != mgo.ErrNotFound {
+			if err != nil {
+				log.Errorf("Unable to release resources from quota of %s %s: %s", kind, name, err)
+			}
+			return
+		}
+	}
+}
+
+func newResourceQuotaExceededError(usage *ResourceUsage, resource string, available, requested int64) error {
+	if available < 0 {
+		available = 0
+	}
+	return &ResourceQuotaExceededError{
+		Kind:      usage.Kind,
+		Name:      usage.Name,
+		Resource:  resource,
+		Available: available,
+		Requested: requested,
+	}
+}
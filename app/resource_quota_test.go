@@ -0,0 +1,196 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/quota"
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) TestResourceQuotaExceededError(c *check.C) {
+	err := ResourceQuotaExceededError{Kind: "team", Name: "myteam", Resource: "memory", Available: 10, Requested: 20}
+	c.Assert(err.Error(), check.Equals, "Quota of memory exceeded for team myteam. Available: 10. Requested: 20.")
+}
+
+func (s *S) TestGetResourceQuotaUnlimited(c *check.C) {
+	q, err := GetResourceQuota(ResourceQuotaTeam, "myteam")
+	c.Assert(err, check.IsNil)
+	c.Assert(*q, check.DeepEquals, ResourceQuota{Kind: "team", Name: "myteam", Memory: -1, CpuShare: -1})
+}
+
+func (s *S) TestGetResourceQuotaInvalidKind(c *check.C) {
+	_, err := GetResourceQuota("user", "myteam")
+	c.Assert(err, check.Equals, ErrInvalidResourceQuotaKind)
+}
+
+func (s *S) TestSetResourceQuota(c *check.C) {
+	err := SetResourceQuota(ResourceQuotaPool, "pool1", 1024, 300)
+	c.Assert(err, check.IsNil)
+	q, err := GetResourceQuota(ResourceQuotaPool, "pool1")
+	c.Assert(err, check.IsNil)
+	c.Assert(*q, check.DeepEquals, ResourceQuota{Kind: "pool", Name: "pool1", Memory: 1024, CpuShare: 300})
+	err = SetResourceQuota(ResourceQuotaPool, "pool1", -10, 200)
+	c.Assert(err, check.IsNil)
+	q, err = GetResourceQuota(ResourceQuotaPool, "pool1")
+	c.Assert(err, check.IsNil)
+	c.Assert(*q, check.DeepEquals, ResourceQuota{Kind: "pool", Name: "pool1", Memory: -1, CpuShare: 200})
+	n, err := s.conn.ResourceQuotas().Find(nil).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 1)
+}
+
+func (s *S) TestSetResourceQuotaInvalidKind(c *check.C) {
+	err := SetResourceQuota("user", "myteam", 1024, 300)
+	c.Assert(err, check.Equals, ErrInvalidResourceQuotaKind)
+}
+
+func (s *S) TestGetResourceUsage(c *check.C) {
+	plan := Plan{Name: "small", Memory: 256, CpuShare: 50}
+	err := s.conn.Apps().Insert(
+		App{Name: "app1", TeamOwner: "myteam", Pool: "pool1", Plan: plan, Quota: quota.Quota{Limit: -1, InUse: 2}},
+		App{Name: "app2", TeamOwner: "myteam", Pool: "pool2", Plan: plan, Quota: quota.Quota{Limit: -1, InUse: 1}},
+		App{Name: "app3", TeamOwner: "otherteam", Pool: "pool1", Plan: plan, Quota: quota.Quota{Limit: -1, InUse: 4}},
+	)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().RemoveAll(bson.M{"name": bson.M{"$in": []string{"app1", "app2", "app3"}}})
+	err = SetResourceQuota(ResourceQuotaTeam, "myteam", 2048, -1)
+	c.Assert(err, check.IsNil)
+	usage, err := GetResourceUsage(ResourceQuotaTeam, "myteam")
+	c.Assert(err, check.IsNil)
+	c.Assert(usage.Memory, check.Equals, int64(2048))
+	c.Assert(usage.CpuShare, check.Equals, -1)
+	c.Assert(usage.MemoryInUse, check.Equals, int64(768))
+	c.Assert(usage.CpuShareInUse, check.Equals, 150)
+	usage, err = GetResourceUsage(ResourceQuotaPool, "pool1")
+	c.Assert(err, check.IsNil)
+	c.Assert(usage.MemoryInUse, check.Equals, int64(1536))
+	c.Assert(usage.CpuShareInUse, check.Equals, 300)
+}
+
+func (s *S) TestReserveUnitsTeamMemoryQuotaExceeded(c *check.C) {
+	app := App{
+		Name:      "together",
+		TeamOwner: "myteam",
+		Plan:      Plan{Name: "small", Memory: 256, CpuShare: 50},
+		Quota:     quota.Unlimited,
+	}
+	s.conn.Apps().Insert(app)
+	defer s.conn.Apps().Remove(bson.M{"name": app.Name})
+	err := SetResourceQuota(ResourceQuotaTeam, "myteam", 1024, -1)
+	c.Assert(err, check.IsNil)
+	err = reserveUnits(&app, 3)
+	c.Assert(err, check.IsNil)
+	err = reserveUnits(&app, 2)
+	c.Assert(err, check.FitsTypeOf, &ResourceQuotaExceededError{})
+	c.Assert(err, check.ErrorMatches, `Quota of memory exceeded for team myteam. Available: 256. Requested: 512.`)
+	a, err := GetByName(app.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(a.Quota.InUse, check.Equals, 3)
+}
+
+func (s *S) TestReserveUnitsPoolCpuShareQuotaExceeded(c *check.C) {
+	app := App{
+		Name:  "together",
+		Pool:  "pool1",
+		Plan:  Plan{Name: "small", Memory: 256, CpuShare: 50},
+		Quota: quota.Unlimited,
+	}
+	s.conn.Apps().Insert(app)
+	defer s.conn.Apps().Remove(bson.M{"name": app.Name})
+	err := SetResourceQuota(ResourceQuotaPool, "pool1", -1, 100)
+	c.Assert(err, check.IsNil)
+	err = reserveUnits(&app, 3)
+	c.Assert(err, check.ErrorMatches, `Quota of cpu shares exceeded for pool pool1. Available: 100. Requested: 150.`)
+	err = reserveUnits(&app, 2)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestReserveUnitsEffectivePoolQuotaExceeded(c *check.C) {
+	err := provision.AddPool("teampool")
+	c.Assert(err, check.IsNil)
+	defer provision.RemovePool("teampool")
+	err = provision.AddTeamsToPool("teampool", []string{"myteam"})
+	c.Assert(err, check.IsNil)
+	app := App{
+		Name:      "together",
+		TeamOwner: "myteam",
+		Plan:      Plan{Name: "small", Memory: 256, CpuShare: 50},
+		Quota:     quota.Unlimited,
+	}
+	s.conn.Apps().Insert(app)
+	defer s.conn.Apps().Remove(bson.M{"name": app.Name})
+	err = SetResourceQuota(ResourceQuotaPool, "teampool", 512, -1)
+	c.Assert(err, check.IsNil)
+	err = reserveUnits(&app, 3)
+	c.Assert(err, check.ErrorMatches, `Quota of memory exceeded for pool teampool. Available: 512. Requested: 768.`)
+}
+
+func (s *S) TestReserveAndReleaseResourceQuotas(c *check.C) {
+	app := App{
+		Name:      "together",
+		TeamOwner: "myteam",
+		Pool:      "pool1",
+		Plan:      Plan{Name: "small", Memory: 256, CpuShare: 50},
+		Quota:     quota.Unlimited,
+	}
+	s.conn.Apps().Insert(app)
+	defer s.conn.Apps().Remove(bson.M{"name": app.Name})
+	err := SetResourceQuota(ResourceQuotaTeam, "myteam", 1024, -1)
+	c.Assert(err, check.IsNil)
+	err = SetResourceQuota(ResourceQuotaPool, "pool1", -1, 200)
+	c.Assert(err, check.IsNil)
+	err = reserveResourceQuotas(&app, 4)
+	c.Assert(err, check.IsNil)
+	usage, err := GetResourceUsage(ResourceQuotaTeam, "myteam")
+	c.Assert(err, check.IsNil)
+	c.Assert(usage.MemoryInUse, check.Equals, int64(1024))
+	c.Assert(usage.CpuShareInUse, check.Equals, 200)
+	err = reserveResourceQuotas(&app, 1)
+	c.Assert(err, check.FitsTypeOf, &ResourceQuotaExceededError{})
+	releaseResourceQuotas(&app, 3)
+	usage, err = GetResourceUsage(ResourceQuotaPool, "pool1")
+	c.Assert(err, check.IsNil)
+	c.Assert(usage.MemoryInUse, check.Equals, int64(256))
+	c.Assert(usage.CpuShareInUse, check.Equals, 50)
+	releaseResourceQuotas(&app, 2)
+	usage, err = GetResourceUsage(ResourceQuotaTeam, "myteam")
+	c.Assert(err, check.IsNil)
+	c.Assert(usage.MemoryInUse, check.Equals, int64(0))
+	c.Assert(usage.CpuShareInUse, check.Equals, 0)
+}
+
+func (s *S) TestReserveResourceQuotasRollsBackWhenExceeded(c *check.C) {
+	app := App{
+		Name:      "together",
+		TeamOwner: "myteam",
+		Pool:      "pool1",
+		Plan:      Plan{Name: "small", Memory: 256, CpuShare: 50},
+	}
+	err := SetResourceQuota(ResourceQuotaTeam, "myteam", 1024, -1)
+	c.Assert(err, check.IsNil)
+	err = SetResourceQuota(ResourceQuotaPool, "pool1", -1, 100)
+	c.Assert(err, check.IsNil)
+	err = reserveResourceQuotas(&app, 3)
+	c.Assert(err, check.ErrorMatches, `Quota of cpu shares exceeded for pool pool1. Available: 100. Requested: 150.`)
+	usage, err := GetResourceUsage(ResourceQuotaTeam, "myteam")
+	c.Assert(err, check.IsNil)
+	c.Assert(usage.MemoryInUse, check.Equals, int64(0))
+}
+
+func (s *S) TestCreateAppResourceQuotaExceeded(c *check.C) {
+	myPlan := Plan{Name: "myplan", Memory: 512, CpuShare: 100}
+	err := myPlan.Save()
+	c.Assert(err, check.IsNil)
+	defer PlanRemove(myPlan.Name)
+	err = SetResourceQuota(ResourceQuotaTeam, s.team.Name, 256, -1)
+	c.Assert(err, check.IsNil)
+	a := App{Name: "appname", Platform: "python", Plan: Plan{Name: "myplan"}}
+	err = CreateApp(&a, s.user)
+	c.Assert(err, check.FitsTypeOf, &ResourceQuotaExceededError{})
+	_, err = GetByName(a.Name)
+	c.Assert(err, check.Equals, ErrAppNotFound)
+}
@@ -127,6 +127,8 @@ func (s *S) TearDownTest(c *check.C) {
 	)
 	s.conn.AutoScale().RemoveAll(nil)
 	s.conn.Deploys().RemoveAll(nil)
+	s.conn.ResourceQuotas().RemoveAll(nil)
+	s.conn.MeteringEvents().RemoveAll(nil)
 }
 
 func (s *S) getTestData(p ...string) io.ReadCloser {
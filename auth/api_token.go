@@ -5,13 +5,55 @@
 package auth
 
 import (
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/tsuru/tsuru/db"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
+var (
+	ErrAPITokenNotFound      = errors.New("api token not found")
+	ErrAPITokenAlreadyExists = errors.New("there is already an api token with this name")
+	ErrAPITokenNameRequired  = errors.New("api token name is required")
+)
+
+// APIToken is the token used by users to access the API without logging in.
+// It is either the API key of the user or one of their named API tokens, which
+// may be restricted to some apps and actions.
 type APIToken struct {
-	Token     string `json:"token" bson:"apikey"`
-	UserEmail string `json:"email" bson:"email"`
+	Token     string   `json:"token" bson:"apikey"`
+	UserEmail string   `json:"email" bson:"email"`
+	Name      string   `json:"name,omitempty" bson:"-"`
+	Apps      []string `json:"apps,omitempty" bson:"-"`
+	Actions   []string `json:"actions,omitempty" bson:"-"`
+}
+
+// NamedAPIToken is an API token created by a user. Only the hash of the token
+// is stored, the token itself is returned only when it's created.
+//
+// Tokens with apps can only be used in requests to these apps, and tokens
+// with actions can only be used in requests performing these actions, which
+// are named after the permissions assigned through roles. Tokens with a zero
+// ExpiresAt never expire.
+type NamedAPIToken struct {
+	Hash       string    `bson:"_id" json:"-"`
+	Name       string    `json:"name"`
+	UserEmail  string    `bson:"email" json:"email"`
+	Apps       []string  `json:"apps,omitempty"`
+	Actions    []string  `json:"actions,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+}
+
+// Expired checks whether the token is expired.
+func (t *NamedAPIToken) Expired() bool {
+	return !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt)
 }
 
 func (t *APIToken) GetValue() string {
@@ -52,6 +94,147 @@ func getAPIToken(header string) (*APIToken, error) {
 	return &t, nil
 }
 
+// Allows checks whether the token can be used to perform the given action in
+// the given app. The app is empty for actions that are not related to apps.
+func (t *APIToken) Allows(action, app string) bool {
+	if len(t.Actions) > 0 {
+		var found bool
+		for _, a := range t.Actions {
+			if grants(a, action) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(t.Apps) > 0 {
+		for _, a := range t.Apps {
+			if a == app {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func hashAPIToken(token string) string {
+	h := crypto.SHA256.New()
+	h.Write([]byte(token))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func getNamedAPIToken(header string) (*APIToken, error) {
+	token, err := ParseToken(header)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var t NamedAPIToken
+	hash := hashAPIToken(token)
+	err = conn.APITokens().FindId(hash).One(&t)
+	if err != nil || t.Expired() {
+		return nil, ErrInvalidToken
+	}
+	err = conn.APITokens().UpdateId(hash, bson.M{"$set": bson.M{"lastusedat": time.Now()}})
+	if err == mgo.ErrNotFound {
+		// the token was revoked after being found.
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &APIToken{
+		Token:     token,
+		UserEmail: t.UserEmail,
+		Name:      t.Name,
+		Apps:      t.Apps,
+		Actions:   t.Actions,
+	}, nil
+}
+
+// APIAuth validates the given API key or named API token, recording the last
+// use of named tokens.
 func APIAuth(token string) (*APIToken, error) {
-	return getAPIToken(token)
+	t, err := getAPIToken(token)
+	if err == ErrInvalidToken {
+		return getNamedAPIToken(token)
+	}
+	return t, err
+}
+
+// CreateAPIToken creates a named API token for the user, returning the token.
+// Tokens are restricted to the given apps and actions, when they are not
+// empty, and expire after the given duration, when it's greater than zero.
+func (u *User) CreateAPIToken(name string, expiresIn time.Duration, apps, actions []string) (string, error) {
+	if name == "" {
+		return "", ErrAPITokenNameRequired
+	}
+	for _, a := range actions {
+		if !validPermission(a) {
+			return "", ErrInvalidPermission
+		}
+	}
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := fmt.Sprintf("%x", b)
+	t := NamedAPIToken{
+		Hash:      hashAPIToken(token),
+		Name:      name,
+		UserEmail: u.Email,
+		Apps:      apps,
+		Actions:   actions,
+		CreatedAt: time.Now(),
+	}
+	if expiresIn > 0 {
+		t.ExpiresAt = t.CreatedAt.Add(expiresIn)
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	err = conn.APITokens().Insert(t)
+	if mgo.IsDup(err) {
+		return "", ErrAPITokenAlreadyExists
+	}
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// APITokens returns the named API tokens of the user, sorted by name.
+func (u *User) APITokens() ([]NamedAPIToken, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var tokens []NamedAPIToken
+	err = conn.APITokens().Find(bson.M{"email": u.Email}).Sort("name").All(&tokens)
+	return tokens, err
+}
+
+// RevokeAPIToken removes the named API token of the user.
+func (u *User) RevokeAPIToken(name string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.APITokens().Remove(bson.M{"email": u.Email, "name": name})
+	if err == mgo.ErrNotFound {
+		return ErrAPITokenNotFound
+	}
+	return err
 }
@@ -4,7 +4,12 @@
 
 package auth
 
-import "gopkg.in/check.v1"
+import (
+	"time"
+
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
 
 func (s *S) TestGetAPIToken(c *check.C) {
 	user := User{Email: "para@xmen.com", APIKey: "Quenço"}
@@ -36,3 +41,92 @@ func (s *S) TestGetAPITokenInvalid(c *check.C) {
 	c.Assert(t, check.IsNil)
 	c.Assert(err, check.Equals, ErrInvalidToken)
 }
+
+func (s *S) TestCreateAPIToken(c *check.C) {
+	user := User{Email: "para@xmen.com"}
+	err := user.Create()
+	c.Assert(err, check.IsNil)
+	defer user.Delete()
+	token, err := user.CreateAPIToken("ci", time.Hour, []string{"myapp"}, []string{PermAppDeploy})
+	c.Assert(err, check.IsNil)
+	c.Assert(token, check.Not(check.Equals), "")
+	tokens, err := user.APITokens()
+	c.Assert(err, check.IsNil)
+	c.Assert(tokens, check.HasLen, 1)
+	c.Assert(tokens[0].Name, check.Equals, "ci")
+	c.Assert(tokens[0].Hash, check.Equals, hashAPIToken(token))
+	c.Assert(tokens[0].Apps, check.DeepEquals, []string{"myapp"})
+	c.Assert(tokens[0].Actions, check.DeepEquals, []string{"app.deploy"})
+	c.Assert(tokens[0].ExpiresAt.Sub(tokens[0].CreatedAt) > 59*time.Minute, check.Equals, true)
+	c.Assert(tokens[0].LastUsedAt.IsZero(), check.Equals, true)
+}
+
+func (s *S) TestCreateAPITokenInvalid(c *check.C) {
+	user := User{Email: "para@xmen.com"}
+	_, err := user.CreateAPIToken("", 0, nil, nil)
+	c.Assert(err, check.Equals, ErrAPITokenNameRequired)
+	_, err = user.CreateAPIToken("ci", 0, nil, []string{"app.destroy"})
+	c.Assert(err, check.Equals, ErrInvalidPermission)
+}
+
+func (s *S) TestCreateAPITokenDuplicated(c *check.C) {
+	user := User{Email: "para@xmen.com"}
+	_, err := user.CreateAPIToken("ci", 0, nil, nil)
+	c.Assert(err, check.IsNil)
+	defer s.conn.APITokens().RemoveAll(bson.M{"email": user.Email})
+	_, err = user.CreateAPIToken("ci", 0, nil, nil)
+	c.Assert(err, check.Equals, ErrAPITokenAlreadyExists)
+}
+
+func (s *S) TestRevokeAPIToken(c *check.C) {
+	user := User{Email: "para@xmen.com"}
+	token, err := user.CreateAPIToken("ci", 0, nil, nil)
+	c.Assert(err, check.IsNil)
+	err = user.RevokeAPIToken("ci")
+	c.Assert(err, check.IsNil)
+	_, err = APIAuth("bearer " + token)
+	c.Assert(err, check.Equals, ErrInvalidToken)
+	err = user.RevokeAPIToken("ci")
+	c.Assert(err, check.Equals, ErrAPITokenNotFound)
+}
+
+func (s *S) TestAPIAuthNamedToken(c *check.C) {
+	user := User{Email: "para@xmen.com"}
+	token, err := user.CreateAPIToken("ci", 0, []string{"myapp"}, []string{PermAppDeploy})
+	c.Assert(err, check.IsNil)
+	defer s.conn.APITokens().RemoveAll(bson.M{"email": user.Email})
+	t, err := APIAuth("bearer " + token)
+	c.Assert(err, check.IsNil)
+	c.Assert(t.GetValue(), check.Equals, token)
+	c.Assert(t.GetUserName(), check.Equals, user.Email)
+	c.Assert(t.Name, check.Equals, "ci")
+	tokens, err := user.APITokens()
+	c.Assert(err, check.IsNil)
+	c.Assert(tokens[0].LastUsedAt.IsZero(), check.Equals, false)
+}
+
+func (s *S) TestAPIAuthExpiredNamedToken(c *check.C) {
+	user := User{Email: "para@xmen.com"}
+	token, err := user.CreateAPIToken("ci", time.Hour, nil, nil)
+	c.Assert(err, check.IsNil)
+	defer s.conn.APITokens().RemoveAll(bson.M{"email": user.Email})
+	err = s.conn.APITokens().UpdateId(hashAPIToken(token), bson.M{"$set": bson.M{"expiresat": time.Now().Add(-time.Minute)}})
+	c.Assert(err, check.IsNil)
+	_, err = APIAuth("bearer " + token)
+	c.Assert(err, check.Equals, ErrInvalidToken)
+}
+
+func (s *S) TestAPITokenAllows(c *check.C) {
+	t := APIToken{Token: "abc"}
+	c.Assert(t.Allows(PermAppDeploy, "myapp"), check.Equals, true)
+	c.Assert(t.Allows("", ""), check.Equals, true)
+	t = APIToken{Token: "abc", Actions: []string{PermAppDeploy, "app.env"}}
+	c.Assert(t.Allows(PermAppDeploy, "myapp"), check.Equals, true)
+	c.Assert(t.Allows(PermAppEnvRead, "myapp"), check.Equals, true)
+	c.Assert(t.Allows(PermNodeManage, ""), check.Equals, false)
+	c.Assert(t.Allows("", "myapp"), check.Equals, false)
+	t = APIToken{Token: "abc", Apps: []string{"myapp"}}
+	c.Assert(t.Allows(PermAppDeploy, "myapp"), check.Equals, true)
+	c.Assert(t.Allows(PermAppDeploy, "otherapp"), check.Equals, false)
+	c.Assert(t.Allows(PermNodeManage, ""), check.Equals, false)
+}
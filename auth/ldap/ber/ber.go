@@ -0,0 +1,254 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ber implements the subset of the Basic Encoding Rules (X.690) that
+// is needed to speak LDAPv3: single byte tags and definite lengths.
+package ber
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Classes of BER tags.
+const (
+	ClassUniversal   = 0x00
+	ClassApplication = 0x40
+	ClassContext     = 0x80
+)
+
+// Universal tags used by LDAP.
+const (
+	TagBoolean     = 0x01
+	TagInteger     = 0x02
+	TagOctetString = 0x04
+	TagEnumerated  = 0x0a
+	TagSequence    = 0x10
+	TagSet         = 0x11
+)
+
+const (
+	// maxPacketSize limits the size of a single packet, which in LDAP is a
+	// whole message.
+	maxPacketSize = 1 << 20
+	// maxDepth limits the nesting of constructed packets. LDAP messages
+	// are much shallower than that.
+	maxDepth = 16
+)
+
+var (
+	ErrTruncated      = errors.New("ber: truncated packet")
+	ErrInvalidLength  = errors.New("ber: invalid length")
+	ErrUnsupportedTag = errors.New("ber: multi-byte tags are not supported")
+	ErrTooDeep        = errors.New("ber: packet nested too deeply")
+)
+
+// Packet is a BER encoded element. Primitive packets hold their contents in
+// Value, while constructed packets hold their elements in Children.
+type Packet struct {
+	Class       byte
+	Constructed bool
+	Tag         byte
+	Value       []byte
+	Children    []*Packet
+}
+
+// NewPrimitive returns a primitive packet with the given class, tag and
+// contents.
+func NewPrimitive(class, tag byte, value []byte) *Packet {
+	return &Packet{Class: class, Tag: tag, Value: value}
+}
+
+// NewConstructed returns a constructed packet with the given class, tag and
+// elements.
+func NewConstructed(class, tag byte, children ...*Packet) *Packet {
+	return &Packet{Class: class, Tag: tag, Constructed: true, Children: children}
+}
+
+// NewSequence returns a universal SEQUENCE packet.
+func NewSequence(children ...*Packet) *Packet {
+	return NewConstructed(ClassUniversal, TagSequence, children...)
+}
+
+// NewString returns a universal OCTET STRING packet.
+func NewString(s string) *Packet {
+	return NewPrimitive(ClassUniversal, TagOctetString, []byte(s))
+}
+
+// NewInteger returns a universal INTEGER packet.
+func NewInteger(n int) *Packet {
+	return NewPrimitive(ClassUniversal, TagInteger, encodeInt(int64(n)))
+}
+
+// NewEnumerated returns a universal ENUMERATED packet.
+func NewEnumerated(n int) *Packet {
+	return NewPrimitive(ClassUniversal, TagEnumerated, encodeInt(int64(n)))
+}
+
+// NewBoolean returns a universal BOOLEAN packet.
+func NewBoolean(b bool) *Packet {
+	value := []byte{0}
+	if b {
+		value[0] = 0xff
+	}
+	return NewPrimitive(ClassUniversal, TagBoolean, value)
+}
+
+// Is checks whether the packet has the given class and tag.
+func (p *Packet) Is(class, tag byte) bool {
+	return p.Class == class && p.Tag == tag
+}
+
+// Int decodes the contents of the packet as a two's complement integer.
+func (p *Packet) Int() int {
+	if len(p.Value) == 0 {
+		return 0
+	}
+	n := int64(int8(p.Value[0]))
+	for _, b := range p.Value[1:] {
+		n = n<<8 | int64(b)
+	}
+	return int(n)
+}
+
+// Bool decodes the contents of the packet as a boolean.
+func (p *Packet) Bool() bool {
+	return len(p.Value) > 0 && p.Value[0] != 0
+}
+
+// Text returns the contents of the packet as a string.
+func (p *Packet) Text() string {
+	return string(p.Value)
+}
+
+// Bytes returns the BER encoding of the packet.
+func (p *Packet) Bytes() []byte {
+	content := p.Value
+	if p.Constructed {
+		content = nil
+		for _, child := range p.Children {
+			content = append(content, child.Bytes()...)
+		}
+	}
+	identifier := p.Class | p.Tag
+	if p.Constructed {
+		identifier |= 0x20
+	}
+	data := append([]byte{identifier}, encodeLength(len(content))...)
+	return append(data, content...)
+}
+
+// Decode decodes the first packet in data, returning it along with the
+// remaining bytes. Packets larger than 1 MiB, or with constructed packets
+// nested more than 16 levels deep, are refused.
+func Decode(data []byte) (*Packet, []byte, error) {
+	return decode(data, 0)
+}
+
+func decode(data []byte, depth int) (*Packet, []byte, error) {
+	if depth >= maxDepth {
+		return nil, nil, ErrTooDeep
+	}
+	if len(data) < 2 {
+		return nil, nil, ErrTruncated
+	}
+	if data[0]&0x1f == 0x1f {
+		return nil, nil, ErrUnsupportedTag
+	}
+	p := Packet{
+		Class:       data[0] & 0xc0,
+		Constructed: data[0]&0x20 != 0,
+		Tag:         data[0] & 0x1f,
+	}
+	length, size, err := decodeLength(data[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	data = data[1+size:]
+	if len(data) < length {
+		return nil, nil, ErrTruncated
+	}
+	content, rest := data[:length], data[length:]
+	if !p.Constructed {
+		p.Value = content
+		return &p, rest, nil
+	}
+	for len(content) > 0 {
+		var child *Packet
+		child, content, err = decode(content, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		p.Children = append(p.Children, child)
+	}
+	return &p, rest, nil
+}
+
+// Read reads and decodes a single packet from r.
+func Read(r io.Reader) (*Packet, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[1]&0x80 != 0 {
+		size := int(header[1] & 0x7f)
+		if size == 0 || size > 4 {
+			return nil, ErrInvalidLength
+		}
+		lengthBytes := make([]byte, size)
+		if _, err := io.ReadFull(r, lengthBytes); err != nil {
+			return nil, err
+		}
+		header = append(header, lengthBytes...)
+	}
+	length, _, err := decodeLength(header[1:])
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(header)+length)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[len(header):]); err != nil {
+		return nil, err
+	}
+	p, _, err := Decode(data)
+	return p, err
+}
+
+func decodeLength(data []byte) (length int, size int, err error) {
+	if data[0]&0x80 == 0 {
+		return int(data[0]), 1, nil
+	}
+	n := int(data[0] & 0x7f)
+	if n == 0 || n > 4 || len(data) < n+1 {
+		return 0, 0, ErrInvalidLength
+	}
+	for _, b := range data[1 : n+1] {
+		length = length<<8 | int(b)
+	}
+	if length < 0 || length > maxPacketSize {
+		return 0, 0, fmt.Errorf("ber: packet too large (%d bytes)", length)
+	}
+	return length, n + 1, nil
+}
+
+func encodeLength(length int) []byte {
+	if length < 0x80 {
+		return []byte{byte(length)}
+	}
+	var data []byte
+	for ; length > 0; length >>= 8 {
+		data = append([]byte{byte(length)}, data...)
+	}
+	return append([]byte{0x80 | byte(len(data))}, data...)
+}
+
+func encodeInt(n int64) []byte {
+	data := []byte{byte(n)}
+	for n > 127 || n < -128 {
+		n >>= 8
+		data = append([]byte{byte(n)}, data...)
+	}
+	return data
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ber
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) TestEncodeAndDecode(c *check.C) {
+	p := NewSequence(
+		NewInteger(1),
+		NewConstructed(ClassApplication, 0, NewInteger(3), NewString("cn=admin"), NewPrimitive(ClassContext, 0, []byte("secret"))),
+	)
+	data := p.Bytes()
+	c.Assert(data[0], check.Equals, byte(0x30))
+	decoded, rest, err := Decode(data)
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Assert(decoded.Is(ClassUniversal, TagSequence), check.Equals, true)
+	c.Assert(decoded.Children, check.HasLen, 2)
+	c.Assert(decoded.Children[0].Int(), check.Equals, 1)
+	bind := decoded.Children[1]
+	c.Assert(bind.Is(ClassApplication, 0), check.Equals, true)
+	c.Assert(bind.Constructed, check.Equals, true)
+	c.Assert(bind.Children[1].Text(), check.Equals, "cn=admin")
+	c.Assert(bind.Children[2].Is(ClassContext, 0), check.Equals, true)
+	c.Assert(bind.Children[2].Text(), check.Equals, "secret")
+}
+
+func (s *S) TestIntegers(c *check.C) {
+	for _, n := range []int{0, 1, 127, 128, 255, 256, -1, -128, -129, 65536} {
+		p, _, err := Decode(NewInteger(n).Bytes())
+		c.Assert(err, check.IsNil)
+		c.Check(p.Int(), check.Equals, n)
+	}
+	c.Assert(NewInteger(128).Value, check.DeepEquals, []byte{0x00, 0x80})
+	c.Assert(NewEnumerated(49).Bytes(), check.DeepEquals, []byte{0x0a, 0x01, 0x31})
+}
+
+func (s *S) TestBoolean(c *check.C) {
+	c.Assert(NewBoolean(true).Bool(), check.Equals, true)
+	c.Assert(NewBoolean(false).Bool(), check.Equals, false)
+}
+
+func (s *S) TestLongLength(c *check.C) {
+	value := strings.Repeat("a", 300)
+	data := NewString(value).Bytes()
+	c.Assert(data[:4], check.DeepEquals, []byte{0x04, 0x82, 0x01, 0x2c})
+	p, _, err := Decode(data)
+	c.Assert(err, check.IsNil)
+	c.Assert(p.Text(), check.Equals, value)
+}
+
+func (s *S) TestDecodeNonMinimalLength(c *check.C) {
+	data := []byte{0x30, 0x84, 0x00, 0x00, 0x00, 0x03, 0x02, 0x01, 0x05}
+	p, _, err := Decode(data)
+	c.Assert(err, check.IsNil)
+	c.Assert(p.Children, check.HasLen, 1)
+	c.Assert(p.Children[0].Int(), check.Equals, 5)
+}
+
+func (s *S) TestDecodeTruncated(c *check.C) {
+	data := NewString("something").Bytes()
+	_, _, err := Decode(data[:5])
+	c.Assert(err, check.Equals, ErrTruncated)
+}
+
+func (s *S) TestDecodeTooLarge(c *check.C) {
+	data := []byte{0x04, 0x84, 0x7f, 0xff, 0xff, 0xff}
+	_, _, err := Decode(data)
+	c.Assert(err, check.ErrorMatches, `ber: packet too large \(2147483647 bytes\)`)
+	data = []byte{0x04, 0x84, 0xff, 0xff, 0xff, 0xff}
+	_, _, err = Decode(data)
+	c.Assert(err, check.NotNil)
+	_, err = Read(bytes.NewReader(data))
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestDecodeTooDeep(c *check.C) {
+	p := NewString("leaf")
+	for i := 0; i < maxDepth-1; i++ {
+		p = NewSequence(p)
+	}
+	decoded, _, err := Decode(p.Bytes())
+	c.Assert(err, check.IsNil)
+	c.Assert(decoded.Bytes(), check.DeepEquals, p.Bytes())
+	_, _, err = Decode(NewSequence(p).Bytes())
+	c.Assert(err, check.Equals, ErrTooDeep)
+	_, err = Read(bytes.NewReader(NewSequence(p).Bytes()))
+	c.Assert(err, check.Equals, ErrTooDeep)
+}
+
+func (s *S) TestRead(c *check.C) {
+	var buf bytes.Buffer
+	buf.Write(NewSequence(NewInteger(1), NewString("first")).Bytes())
+	buf.Write(NewSequence(NewInteger(2), NewString(strings.Repeat("b", 200))).Bytes())
+	p, err := Read(&buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(p.Children[1].Text(), check.Equals, "first")
+	p, err = Read(&buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(p.Children[0].Int(), check.Equals, 2)
+	c.Assert(p.Children[1].Value, check.HasLen, 200)
+	_, err = Read(&buf)
+	c.Assert(err, check.NotNil)
+}
@@ -0,0 +1,200 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tsuru/tsuru/auth/ldap/ber"
+)
+
+const (
+	protocolVersion = 3
+
+	appBindRequest       = 0
+	appBindResponse      = 1
+	appUnbindRequest     = 2
+	appSearchRequest     = 3
+	appSearchResultEntry = 4
+	appSearchResultDone  = 5
+
+	resultSuccess            = 0
+	resultInvalidCredentials = 49
+
+	scopeWholeSubtree = 2
+	neverDerefAliases = 0
+
+	filterEqualityMatch = 3
+
+	// noAttributes is the special attribute list that asks the server not
+	// to return any attribute (RFC 4511, section 4.5.1.8).
+	noAttributes = "1.1"
+
+	// maxSearchResults limits the number of entries asked in searches, and
+	// the number of responses accepted from the server for a single search.
+	maxSearchResults = 1000
+)
+
+// resultError is returned whenever the server answers an operation with a
+// result code other than success.
+type resultError struct {
+	code    int
+	message string
+}
+
+func (e *resultError) Error() string {
+	return fmt.Sprintf("ldap: operation failed with result code %d: %s", e.code, e.message)
+}
+
+type entry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+type conn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	lastID  int
+}
+
+func dial(addr string, useTLS bool, timeout time.Duration) (*conn, error) {
+	var (
+		c   net.Conn
+		err error
+	)
+	dialer := net.Dialer{Timeout: timeout}
+	if useTLS {
+		host, _, _ := net.SplitHostPort(addr)
+		c, err = tls.DialWithDialer(&dialer, "tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		c, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &conn{conn: c, reader: bufio.NewReader(c), timeout: timeout}, nil
+}
+
+func (c *conn) Close() error {
+	c.send(ber.NewPrimitive(ber.ClassApplication, appUnbindRequest, nil))
+	return c.conn.Close()
+}
+
+func (c *conn) bind(dn, password string) error {
+	request := ber.NewConstructed(ber.ClassApplication, appBindRequest,
+		ber.NewInteger(protocolVersion),
+		ber.NewString(dn),
+		ber.NewPrimitive(ber.ClassContext, 0, []byte(password)),
+	)
+	id, err := c.send(request)
+	if err != nil {
+		return err
+	}
+	response, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if !response.Is(ber.ClassApplication, appBindResponse) {
+		return fmt.Errorf("ldap: unexpected response to bind request: %d", response.Tag)
+	}
+	return checkResult(response)
+}
+
+func (c *conn) search(baseDN string, filter *ber.Packet, attributes ...string) ([]entry, error) {
+	attrList := ber.NewSequence()
+	for _, attr := range attributes {
+		attrList.Children = append(attrList.Children, ber.NewString(attr))
+	}
+	request := ber.NewConstructed(ber.ClassApplication, appSearchRequest,
+		ber.NewString(baseDN),
+		ber.NewEnumerated(scopeWholeSubtree),
+		ber.NewEnumerated(neverDerefAliases),
+		ber.NewInteger(maxSearchResults),
+		ber.NewInteger(int(c.timeout/time.Second)),
+		ber.NewBoolean(false),
+		filter,
+		attrList,
+	)
+	id, err := c.send(request)
+	if err != nil {
+		return nil, err
+	}
+	var entries []entry
+	for i := 0; ; i++ {
+		if i > maxSearchResults {
+			return nil, fmt.Errorf("ldap: too many results received from server")
+		}
+		response, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		if response.Is(ber.ClassApplication, appSearchResultDone) {
+			return entries, checkResult(response)
+		}
+		if !response.Is(ber.ClassApplication, appSearchResultEntry) || len(response.Children) < 2 {
+			// search result references are ignored.
+			continue
+		}
+		e := entry{dn: response.Children[0].Text(), attributes: make(map[string][]string)}
+		for _, attr := range response.Children[1].Children {
+			if len(attr.Children) < 2 {
+				continue
+			}
+			name := strings.ToLower(attr.Children[0].Text())
+			for _, value := range attr.Children[1].Children {
+				e.attributes[name] = append(e.attributes[name], value.Text())
+			}
+		}
+		entries = append(entries, e)
+	}
+}
+
+func (c *conn) send(op *ber.Packet) (int, error) {
+	c.lastID++
+	message := ber.NewSequence(ber.NewInteger(c.lastID), op)
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(message.Bytes())
+	return c.lastID, err
+}
+
+func (c *conn) receive(id int) (*ber.Packet, error) {
+	for i := 0; ; i++ {
+		if i > maxSearchResults {
+			return nil, fmt.Errorf("ldap: too many unexpected messages received from server")
+		}
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+		message, err := ber.Read(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		if len(message.Children) < 2 {
+			return nil, fmt.Errorf("ldap: invalid message received from server")
+		}
+		if message.Children[0].Int() == id {
+			return message.Children[1], nil
+		}
+	}
+}
+
+func checkResult(response *ber.Packet) error {
+	if len(response.Children) < 3 {
+		return fmt.Errorf("ldap: invalid result received from server")
+	}
+	code := response.Children[0].Int()
+	if code != resultSuccess {
+		return &resultError{code: code, message: response.Children[2].Text()}
+	}
+	return nil
+}
+
+func equalityFilter(attribute, value string) *ber.Packet {
+	return ber.NewConstructed(ber.ClassContext, filterEqualityMatch, ber.NewString(attribute), ber.NewString(value))
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ldap
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestClientBind(c *check.C) {
+	conn, err := dial(s.server.Addr(), false, time.Second)
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.bind("uid=gopher,ou=people,dc=tsuru,dc=io", "123456")
+	c.Assert(err, check.IsNil)
+	err = conn.bind("uid=gopher,ou=people,dc=tsuru,dc=io", "wrong")
+	c.Assert(err, check.FitsTypeOf, &resultError{})
+	c.Assert(err.(*resultError).code, check.Equals, resultInvalidCredentials)
+}
+
+func (s *S) TestClientSearch(c *check.C) {
+	conn, err := dial(s.server.Addr(), false, time.Second)
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	entries, err := conn.search("dc=tsuru,dc=io", equalityFilter("member", "UID=gopher,ou=people,dc=tsuru,dc=io"), "CN")
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.DeepEquals, []entry{
+		{dn: "cn=developers,ou=groups,dc=tsuru,dc=io", attributes: map[string][]string{"cn": {"developers"}}},
+	})
+	entries, err = conn.search("dc=tsuru,dc=io", equalityFilter("mail", "gopher@tsuru.io"), noAttributes)
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.DeepEquals, []entry{
+		{dn: "uid=gopher,ou=people,dc=tsuru,dc=io", attributes: map[string][]string{}},
+	})
+}
+
+func (s *S) TestClientSearchNoSuchObject(c *check.C) {
+	conn, err := dial(s.server.Addr(), false, time.Second)
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	_, err = conn.search("dc=example,dc=com", equalityFilter("mail", "gopher@tsuru.io"))
+	c.Assert(err, check.FitsTypeOf, &resultError{})
+	c.Assert(err.(*resultError).code, check.Equals, 32)
+}
+
+func (s *S) TestClientSearchTooManyResults(c *check.C) {
+	for i := 0; i <= maxSearchResults; i++ {
+		s.server.AddEntry(fmt.Sprintf("cn=group%d,ou=groups,dc=tsuru,dc=io", i), "", map[string][]string{
+			"member": {"uid=gopher,ou=people,dc=tsuru,dc=io"},
+		})
+	}
+	conn, err := dial(s.server.Addr(), false, 5*time.Second)
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	_, err = conn.search("ou=groups,dc=tsuru,dc=io", equalityFilter("member", "uid=gopher,ou=people,dc=tsuru,dc=io"), "cn")
+	c.Assert(err, check.ErrorMatches, "ldap: too many results received from server")
+}
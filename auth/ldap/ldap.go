@@ -0,0 +1,223 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ldap provides an authentication scheme that validates users against
+// a LDAP directory, keeping their team memberships in sync with LDAP groups.
+package ldap
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/auth"
+	"github.com/tsuru/tsuru/auth/native"
+	"github.com/tsuru/tsuru/errors"
+)
+
+const defaultTimeout = 10 * time.Second
+
+var (
+	ErrMissingPasswordError = &errors.ValidationError{Message: "you must provide a password to login"}
+	ErrMissingEmailError    = &errors.ValidationError{Message: "you must provide a email to login"}
+)
+
+type LDAPScheme struct{}
+
+func init() {
+	auth.RegisterScheme("ldap", LDAPScheme{})
+}
+
+type ldapConfig struct {
+	server               string
+	tls                  bool
+	timeout              time.Duration
+	bindDN               string
+	bindPassword         string
+	userBaseDN           string
+	userAttribute        string
+	groupBaseDN          string
+	groupMemberAttribute string
+	groupNameAttribute   string
+	groups               map[string]string
+}
+
+func loadConfig() (*ldapConfig, error) {
+	server, err := config.GetString("auth:ldap:server")
+	if err != nil {
+		return nil, err
+	}
+	userBaseDN, err := config.GetString("auth:ldap:user-base-dn")
+	if err != nil {
+		return nil, err
+	}
+	conf := ldapConfig{
+		server:               server,
+		timeout:              defaultTimeout,
+		userBaseDN:           userBaseDN,
+		userAttribute:        "mail",
+		groupMemberAttribute: "member",
+		groupNameAttribute:   "cn",
+		groups:               make(map[string]string),
+	}
+	conf.tls, _ = config.GetBool("auth:ldap:tls")
+	if timeout, err := config.GetInt("auth:ldap:timeout"); err == nil {
+		conf.timeout = time.Duration(timeout) * time.Second
+	}
+	conf.bindDN, _ = config.GetString("auth:ldap:bind-dn")
+	conf.bindPassword, _ = config.GetString("auth:ldap:bind-password")
+	if attr, _ := config.GetString("auth:ldap:user-attribute"); attr != "" {
+		conf.userAttribute = attr
+	}
+	conf.groupBaseDN, _ = config.GetString("auth:ldap:group-base-dn")
+	if attr, _ := config.GetString("auth:ldap:group-member-attribute"); attr != "" {
+		conf.groupMemberAttribute = attr
+	}
+	if attr, _ := config.GetString("auth:ldap:group-name-attribute"); attr != "" {
+		conf.groupNameAttribute = attr
+	}
+	groups, _ := config.Get("auth:ldap:groups")
+	groupsMap, _ := groups.(map[interface{}]interface{})
+	for group, team := range groupsMap {
+		conf.groups[fmt.Sprint(group)] = fmt.Sprint(team)
+	}
+	return &conf, nil
+}
+
+func (s LDAPScheme) Login(params map[string]string) (auth.Token, error) {
+	email, ok := params["email"]
+	if !ok {
+		return nil, ErrMissingEmailError
+	}
+	// An empty password would be taken as an anonymous bind by the server,
+	// which always succeeds.
+	password := params["password"]
+	if password == "" {
+		return nil, ErrMissingPasswordError
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	c, err := dial(conf.server, conf.tls, conf.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if err = conf.serviceBind(c); err != nil {
+		return nil, err
+	}
+	dn, err := conf.findUser(c, email)
+	if err != nil {
+		return nil, err
+	}
+	err = c.bind(dn, password)
+	if e, ok := err.(*resultError); ok && e.code == resultInvalidCredentials {
+		return nil, auth.AuthenticationFailure{}
+	} else if err != nil {
+		return nil, err
+	}
+	var groups []string
+	if conf.groupBaseDN != "" {
+		if err = conf.serviceBind(c); err != nil {
+			return nil, err
+		}
+		if groups, err = conf.userGroups(c, dn); err != nil {
+			return nil, err
+		}
+	}
+	user, err := auth.GetUserByEmail(email)
+	if err != nil {
+		if err != auth.ErrUserNotFound {
+			return nil, err
+		}
+		registrationEnabled, _ := config.GetBool("auth:user-registration")
+		if !registrationEnabled {
+			return nil, err
+		}
+		user = &auth.User{Email: email}
+		if err = user.Create(); err != nil {
+			return nil, err
+		}
+	}
+	if conf.groupBaseDN != "" {
+		if err = auth.SyncTeams(user, groups, conf.groups); err != nil {
+			return nil, err
+		}
+	}
+	return native.IssueToken(user)
+}
+
+// serviceBind binds using the credentials of the service account, when it's
+// configured. Otherwise, searches are made anonymously.
+func (conf *ldapConfig) serviceBind(c *conn) error {
+	if conf.bindDN == "" {
+		return nil
+	}
+	return c.bind(conf.bindDN, conf.bindPassword)
+}
+
+func (conf *ldapConfig) findUser(c *conn, email string) (string, error) {
+	entries, err := c.search(conf.userBaseDN, equalityFilter(conf.userAttribute, email), noAttributes)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "", auth.ErrUserNotFound
+	}
+	if len(entries) > 1 {
+		return "", fmt.Errorf("ldap: found %d entries for the user %q", len(entries), email)
+	}
+	return entries[0].dn, nil
+}
+
+func (conf *ldapConfig) userGroups(c *conn, dn string) ([]string, error) {
+	entries, err := c.search(conf.groupBaseDN, equalityFilter(conf.groupMemberAttribute, dn), conf.groupNameAttribute)
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, e := range entries {
+		groups = append(groups, e.attributes[strings.ToLower(conf.groupNameAttribute)]...)
+	}
+	return groups, nil
+}
+
+func (s LDAPScheme) AppLogin(appName string) (auth.Token, error) {
+	nativeScheme := native.NativeScheme{}
+	return nativeScheme.AppLogin(appName)
+}
+
+func (s LDAPScheme) Logout(token string) error {
+	nativeScheme := native.NativeScheme{}
+	return nativeScheme.Logout(token)
+}
+
+func (s LDAPScheme) Auth(token string) (auth.Token, error) {
+	nativeScheme := native.NativeScheme{}
+	return nativeScheme.Auth(token)
+}
+
+func (s LDAPScheme) Name() string {
+	return "ldap"
+}
+
+func (s LDAPScheme) Info() (auth.SchemeInfo, error) {
+	return nil, nil
+}
+
+func (s LDAPScheme) Create(user *auth.User) (*auth.User, error) {
+	user.Password = ""
+	err := user.Create()
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s LDAPScheme) Remove(u *auth.User) error {
+	nativeScheme := native.NativeScheme{}
+	return nativeScheme.Remove(u)
+}
@@ -0,0 +1,217 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ldap
+
+import (
+	"sort"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/auth"
+	"github.com/tsuru/tsuru/auth/native"
+	"gopkg.in/check.v1"
+)
+
+var ldapScheme = LDAPScheme{}
+
+func (s *S) TestLDAPSchemeIsRegistered(c *check.C) {
+	scheme, err := auth.GetScheme("ldap")
+	c.Assert(err, check.IsNil)
+	c.Assert(scheme, check.Equals, ldapScheme)
+	c.Assert(scheme.Name(), check.Equals, "ldap")
+}
+
+func (s *S) TestLogin(c *check.C) {
+	token, err := ldapScheme.Login(map[string]string{"email": "gopher@tsuru.io", "password": "123456"})
+	c.Assert(err, check.IsNil)
+	c.Assert(token, check.FitsTypeOf, &native.Token{})
+	c.Assert(token.GetUserName(), check.Equals, "gopher@tsuru.io")
+	c.Assert(token.IsAppToken(), check.Equals, false)
+	user, err := auth.GetUserByEmail("gopher@tsuru.io")
+	c.Assert(err, check.IsNil)
+	c.Assert(user.Password, check.Equals, "")
+	authToken, err := ldapScheme.Auth("bearer " + token.GetValue())
+	c.Assert(err, check.IsNil)
+	c.Assert(authToken.GetUserName(), check.Equals, "gopher@tsuru.io")
+	s.server.RLock()
+	defer s.server.RUnlock()
+	c.Assert(s.server.Binds, check.DeepEquals, []string{"uid=gopher,ou=people,dc=tsuru,dc=io"})
+}
+
+func (s *S) TestLoginWithServiceAccount(c *check.C) {
+	s.server.AddEntry("cn=tsuru,dc=tsuru,dc=io", "service", map[string][]string{"cn": {"tsuru"}})
+	config.Set("auth:ldap:bind-dn", "cn=tsuru,dc=tsuru,dc=io")
+	config.Set("auth:ldap:bind-password", "service")
+	defer config.Unset("auth:ldap:bind-dn")
+	defer config.Unset("auth:ldap:bind-password")
+	_, err := ldapScheme.Login(map[string]string{"email": "gopher@tsuru.io", "password": "123456"})
+	c.Assert(err, check.IsNil)
+	s.server.RLock()
+	defer s.server.RUnlock()
+	c.Assert(s.server.Binds, check.DeepEquals, []string{
+		"cn=tsuru,dc=tsuru,dc=io",
+		"uid=gopher,ou=people,dc=tsuru,dc=io",
+		"cn=tsuru,dc=tsuru,dc=io",
+	})
+}
+
+func (s *S) TestLoginWrongServiceAccountPassword(c *check.C) {
+	s.server.AddEntry("cn=tsuru,dc=tsuru,dc=io", "service", map[string][]string{"cn": {"tsuru"}})
+	config.Set("auth:ldap:bind-dn", "cn=tsuru,dc=tsuru,dc=io")
+	config.Set("auth:ldap:bind-password", "wrong")
+	defer config.Unset("auth:ldap:bind-dn")
+	defer config.Unset("auth:ldap:bind-password")
+	_, err := ldapScheme.Login(map[string]string{"email": "gopher@tsuru.io", "password": "123456"})
+	c.Assert(err, check.FitsTypeOf, &resultError{})
+	c.Assert(err.(*resultError).code, check.Equals, resultInvalidCredentials)
+}
+
+func (s *S) TestLoginWrongPassword(c *check.C) {
+	_, err := ldapScheme.Login(map[string]string{"email": "gopher@tsuru.io", "password": "wrong"})
+	c.Assert(err, check.FitsTypeOf, auth.AuthenticationFailure{})
+	_, err = auth.GetUserByEmail("gopher@tsuru.io")
+	c.Assert(err, check.Equals, auth.ErrUserNotFound)
+}
+
+func (s *S) TestLoginMissingParams(c *check.C) {
+	_, err := ldapScheme.Login(map[string]string{"password": "123456"})
+	c.Assert(err, check.Equals, ErrMissingEmailError)
+	_, err = ldapScheme.Login(map[string]string{"email": "gopher@tsuru.io"})
+	c.Assert(err, check.Equals, ErrMissingPasswordError)
+	_, err = ldapScheme.Login(map[string]string{"email": "gopher@tsuru.io", "password": ""})
+	c.Assert(err, check.Equals, ErrMissingPasswordError)
+}
+
+func (s *S) TestLoginUserNotInDirectory(c *check.C) {
+	_, err := ldapScheme.Login(map[string]string{"email": "nobody@tsuru.io", "password": "123456"})
+	c.Assert(err, check.Equals, auth.ErrUserNotFound)
+}
+
+func (s *S) TestLoginRegistrationDisabled(c *check.C) {
+	config.Set("auth:user-registration", false)
+	defer config.Set("auth:user-registration", true)
+	_, err := ldapScheme.Login(map[string]string{"email": "gopher@tsuru.io", "password": "123456"})
+	c.Assert(err, check.Equals, auth.ErrUserNotFound)
+	user := auth.User{Email: "gopher@tsuru.io"}
+	err = user.Create()
+	c.Assert(err, check.IsNil)
+	_, err = ldapScheme.Login(map[string]string{"email": "gopher@tsuru.io", "password": "123456"})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestLoginSyncsTeams(c *check.C) {
+	other := auth.User{Email: "other@tsuru.io"}
+	err := other.Create()
+	c.Assert(err, check.IsNil)
+	user := auth.User{Email: "gopher@tsuru.io"}
+	err = user.Create()
+	c.Assert(err, check.IsNil)
+	opsteam := auth.Team{Name: "opsteam", Users: []string{other.Email, user.Email}, Owners: []string{other.Email}}
+	err = s.conn.Teams().Insert(opsteam)
+	c.Assert(err, check.IsNil)
+	unmanaged := auth.Team{Name: "unmanaged", Users: []string{user.Email}}
+	err = s.conn.Teams().Insert(unmanaged)
+	c.Assert(err, check.IsNil)
+	_, err = ldapScheme.Login(map[string]string{"email": "gopher@tsuru.io", "password": "123456"})
+	c.Assert(err, check.IsNil)
+	teams, err := user.Teams()
+	c.Assert(err, check.IsNil)
+	names := auth.GetTeamsNames(teams)
+	sort.Strings(names)
+	c.Assert(names, check.DeepEquals, []string{"devteam", "unmanaged"})
+	devteam, err := auth.GetTeam("devteam")
+	c.Assert(err, check.IsNil)
+	c.Assert(devteam.Users, check.DeepEquals, []string{user.Email})
+	dbOpsteam, err := auth.GetTeam("opsteam")
+	c.Assert(err, check.IsNil)
+	c.Assert(dbOpsteam.Users, check.DeepEquals, []string{other.Email})
+}
+
+func (s *S) TestLoginAddsUserToExistingTeam(c *check.C) {
+	other := auth.User{Email: "other@tsuru.io"}
+	err := other.Create()
+	c.Assert(err, check.IsNil)
+	devteam := auth.Team{Name: "devteam", Users: []string{other.Email}, Owners: []string{other.Email}}
+	err = s.conn.Teams().Insert(devteam)
+	c.Assert(err, check.IsNil)
+	_, err = ldapScheme.Login(map[string]string{"email": "gopher@tsuru.io", "password": "123456"})
+	c.Assert(err, check.IsNil)
+	team, err := auth.GetTeam("devteam")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.Users, check.DeepEquals, []string{other.Email, "gopher@tsuru.io"})
+	c.Assert(team.Level(&auth.User{Email: "gopher@tsuru.io"}), check.Equals, auth.TeamDeveloper)
+}
+
+func (s *S) TestLoginRemovesLastTeamOwner(c *check.C) {
+	other := auth.User{Email: "other@tsuru.io"}
+	err := other.Create()
+	c.Assert(err, check.IsNil)
+	user := auth.User{Email: "gopher@tsuru.io"}
+	err = user.Create()
+	c.Assert(err, check.IsNil)
+	opsteam := auth.Team{Name: "opsteam", Users: []string{user.Email, other.Email}, Owners: []string{user.Email}}
+	err = s.conn.Teams().Insert(opsteam)
+	c.Assert(err, check.IsNil)
+	_, err = ldapScheme.Login(map[string]string{"email": "gopher@tsuru.io", "password": "123456"})
+	c.Assert(err, check.IsNil)
+	team, err := auth.GetTeam("opsteam")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.Users, check.DeepEquals, []string{other.Email})
+	c.Assert(team.Synced, check.Equals, true)
+}
+
+func (s *S) TestLoginWithoutGroupBaseDNDoesNotSyncTeams(c *check.C) {
+	config.Unset("auth:ldap:group-base-dn")
+	defer config.Set("auth:ldap:group-base-dn", "ou=groups,dc=tsuru,dc=io")
+	_, err := ldapScheme.Login(map[string]string{"email": "gopher@tsuru.io", "password": "123456"})
+	c.Assert(err, check.IsNil)
+	_, err = auth.GetTeam("devteam")
+	c.Assert(err, check.Equals, auth.ErrTeamNotFound)
+}
+
+func (s *S) TestLoginCustomAttributes(c *check.C) {
+	config.Set("auth:ldap:user-attribute", "uid")
+	defer config.Unset("auth:ldap:user-attribute")
+	_, err := ldapScheme.Login(map[string]string{"email": "gopher", "password": "123456"})
+	c.Assert(err, check.IsNil)
+	_, err = auth.GetUserByEmail("gopher")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestLogout(c *check.C) {
+	token, err := ldapScheme.Login(map[string]string{"email": "gopher@tsuru.io", "password": "123456"})
+	c.Assert(err, check.IsNil)
+	err = ldapScheme.Logout(token.GetValue())
+	c.Assert(err, check.IsNil)
+	_, err = ldapScheme.Auth("bearer " + token.GetValue())
+	c.Assert(err, check.Equals, auth.ErrInvalidToken)
+}
+
+func (s *S) TestAppLogin(c *check.C) {
+	token, err := ldapScheme.AppLogin("myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(token.IsAppToken(), check.Equals, true)
+	c.Assert(token.GetAppName(), check.Equals, "myapp")
+}
+
+func (s *S) TestCreateAndRemove(c *check.C) {
+	user, err := ldapScheme.Create(&auth.User{Email: "gopher@tsuru.io", Password: "123456"})
+	c.Assert(err, check.IsNil)
+	c.Assert(user.Password, check.Equals, "")
+	_, err = ldapScheme.Login(map[string]string{"email": "gopher@tsuru.io", "password": "123456"})
+	c.Assert(err, check.IsNil)
+	err = ldapScheme.Remove(user)
+	c.Assert(err, check.IsNil)
+	_, err = auth.GetUserByEmail(user.Email)
+	c.Assert(err, check.Equals, auth.ErrUserNotFound)
+	count, err := s.conn.Tokens().Find(nil).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, 0)
+}
+
+func (s *S) TestInfo(c *check.C) {
+	info, err := ldapScheme.Info()
+	c.Assert(err, check.IsNil)
+	c.Assert(info, check.IsNil)
+}
@@ -0,0 +1,290 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ldaptest provides a fake LDAP server, to be used in tests.
+package ldaptest
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/tsuru/tsuru/auth/ldap/ber"
+)
+
+const (
+	appBindRequest       = 0
+	appBindResponse      = 1
+	appUnbindRequest     = 2
+	appSearchRequest     = 3
+	appSearchResultEntry = 4
+	appSearchResultDone  = 5
+
+	resultSuccess            = 0
+	resultNoSuchObject       = 32
+	resultInvalidCredentials = 49
+	resultUnwillingToPerform = 53
+
+	scopeBaseObject   = 0
+	scopeSingleLevel  = 1
+	scopeWholeSubtree = 2
+
+	filterAnd           = 0
+	filterOr            = 1
+	filterNot           = 2
+	filterEqualityMatch = 3
+	filterPresent       = 7
+)
+
+// Entry represents an entry stored in the fake server.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+	password   string
+}
+
+// Server is a fake LDAP server implementation.
+//
+// It supports only simple binds and searches with and, or, not, equality and
+// presence filters. Attribute names, values and DNs are compared ignoring
+// case, and DNs are not normalized in any other way. The base DN of a search
+// is considered to exist whenever there's at least one entry under it.
+//
+// Use NewServer to create a new instance and start serving; Server.Addr() will
+// get you the address of the server and Stop will stop the server, closing
+// the listener. Every bind that arrives at the server is stored in the Binds
+// slice.
+type Server struct {
+	// Binds stores the DNs of all successful binds that arrived at the
+	// server. Use the mutex to access it.
+	Binds []string
+	sync.RWMutex
+	entries  []Entry
+	listener net.Listener
+}
+
+// NewServer creates a new LDAP server, for testing purposes.
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := Server{listener: l}
+	go s.serve()
+	return &s, nil
+}
+
+// Addr returns the address of the server, in the form <host>:<port>.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Stop stops the server. It's safe to call this method multiple times.
+func (s *Server) Stop() {
+	s.listener.Close()
+}
+
+// AddEntry adds an entry to the server. Entries with a non-empty password can
+// be used in simple binds.
+func (s *Server) AddEntry(dn, password string, attributes map[string][]string) {
+	s.Lock()
+	defer s.Unlock()
+	s.entries = append(s.entries, Entry{DN: dn, Attributes: attributes, password: password})
+}
+
+// Reset resets the server, removing all entries and recorded binds.
+func (s *Server) Reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.entries = nil
+	s.Binds = nil
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		message, err := ber.Read(reader)
+		if err != nil || len(message.Children) < 2 {
+			return
+		}
+		id := message.Children[0].Int()
+		op := message.Children[1]
+		if op.Class != ber.ClassApplication {
+			return
+		}
+		var responses []*ber.Packet
+		switch op.Tag {
+		case appBindRequest:
+			responses = append(responses, s.bind(op))
+		case appSearchRequest:
+			responses = s.search(op)
+		case appUnbindRequest:
+			return
+		default:
+			return
+		}
+		for _, response := range responses {
+			reply := ber.NewSequence(ber.NewInteger(id), response)
+			if _, err := conn.Write(reply.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) bind(op *ber.Packet) *ber.Packet {
+	if len(op.Children) < 3 || !op.Children[2].Is(ber.ClassContext, 0) {
+		return result(appBindResponse, resultUnwillingToPerform, "only simple binds are supported")
+	}
+	dn, password := op.Children[1].Text(), op.Children[2].Text()
+	if dn == "" && password == "" {
+		return result(appBindResponse, resultSuccess, "")
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, e := range s.entries {
+		if strings.EqualFold(e.DN, dn) && e.password != "" && e.password == password {
+			s.Binds = append(s.Binds, e.DN)
+			return result(appBindResponse, resultSuccess, "")
+		}
+	}
+	return result(appBindResponse, resultInvalidCredentials, "invalid credentials")
+}
+
+func (s *Server) search(op *ber.Packet) []*ber.Packet {
+	if len(op.Children) < 8 {
+		return []*ber.Packet{result(appSearchResultDone, resultUnwillingToPerform, "invalid search request")}
+	}
+	baseDN := strings.ToLower(op.Children[0].Text())
+	scope := op.Children[1].Int()
+	filter := op.Children[6]
+	var attributes []string
+	for _, attr := range op.Children[7].Children {
+		attributes = append(attributes, attr.Text())
+	}
+	s.RLock()
+	defer s.RUnlock()
+	var responses []*ber.Packet
+	baseFound := false
+	for _, e := range s.entries {
+		dn := strings.ToLower(e.DN)
+		if dn == baseDN || strings.HasSuffix(dn, ","+baseDN) {
+			baseFound = true
+		}
+		if !inScope(dn, baseDN, scope) || !e.matches(filter) {
+			continue
+		}
+		responses = append(responses, e.packet(attributes))
+	}
+	if !baseFound {
+		return []*ber.Packet{result(appSearchResultDone, resultNoSuchObject, "no such object")}
+	}
+	return append(responses, result(appSearchResultDone, resultSuccess, ""))
+}
+
+func inScope(dn, baseDN string, scope int) bool {
+	if dn == baseDN {
+		return scope != scopeSingleLevel
+	}
+	if !strings.HasSuffix(dn, ","+baseDN) {
+		return false
+	}
+	switch scope {
+	case scopeSingleLevel:
+		return !strings.Contains(strings.TrimSuffix(dn, ","+baseDN), ",")
+	case scopeWholeSubtree:
+		return true
+	}
+	return false
+}
+
+func (e *Entry) values(attribute string) []string {
+	for name, values := range e.Attributes {
+		if strings.EqualFold(name, attribute) {
+			return values
+		}
+	}
+	return nil
+}
+
+func (e *Entry) matches(filter *ber.Packet) bool {
+	if filter.Class != ber.ClassContext {
+		return false
+	}
+	switch filter.Tag {
+	case filterAnd:
+		for _, f := range filter.Children {
+			if !e.matches(f) {
+				return false
+			}
+		}
+		return true
+	case filterOr:
+		for _, f := range filter.Children {
+			if e.matches(f) {
+				return true
+			}
+		}
+		return false
+	case filterNot:
+		return len(filter.Children) == 1 && !e.matches(filter.Children[0])
+	case filterEqualityMatch:
+		if len(filter.Children) < 2 {
+			return false
+		}
+		for _, value := range e.values(filter.Children[0].Text()) {
+			if strings.EqualFold(value, filter.Children[1].Text()) {
+				return true
+			}
+		}
+		return false
+	case filterPresent:
+		return strings.EqualFold(filter.Text(), "objectClass") || len(e.values(filter.Text())) > 0
+	}
+	return false
+}
+
+func (e *Entry) packet(attributes []string) *ber.Packet {
+	var names []string
+	if len(attributes) == 0 || (len(attributes) == 1 && attributes[0] == "*") {
+		for name := range e.Attributes {
+			names = append(names, name)
+		}
+	} else {
+		for _, name := range attributes {
+			if len(e.values(name)) > 0 {
+				names = append(names, name)
+			}
+		}
+	}
+	attrList := ber.NewSequence()
+	for _, name := range names {
+		values := ber.NewConstructed(ber.ClassUniversal, ber.TagSet)
+		for _, value := range e.values(name) {
+			values.Children = append(values.Children, ber.NewString(value))
+		}
+		attrList.Children = append(attrList.Children, ber.NewSequence(ber.NewString(name), values))
+	}
+	return ber.NewConstructed(ber.ClassApplication, appSearchResultEntry, ber.NewString(e.DN), attrList)
+}
+
+func result(tag byte, code int, message string) *ber.Packet {
+	return ber.NewConstructed(ber.ClassApplication, tag,
+		ber.NewEnumerated(code),
+		ber.NewString(""),
+		ber.NewString(message),
+	)
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ldaptest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/tsuru/tsuru/auth/ldap/ber"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	server *Server
+}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpTest(c *check.C) {
+	var err error
+	s.server, err = NewServer()
+	c.Assert(err, check.IsNil)
+	s.server.AddEntry("uid=gopher,ou=people,dc=tsuru,dc=io", "123456", map[string][]string{
+		"mail": {"gopher@tsuru.io"},
+		"cn":   {"Gopher"},
+	})
+	s.server.AddEntry("uid=nopass,ou=people,dc=tsuru,dc=io", "", map[string][]string{
+		"mail": {"nopass@tsuru.io"},
+	})
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	s.server.Stop()
+}
+
+func (s *S) roundTrip(c *check.C, conn net.Conn, id int, op *ber.Packet) []*ber.Packet {
+	_, err := conn.Write(ber.NewSequence(ber.NewInteger(id), op).Bytes())
+	c.Assert(err, check.IsNil)
+	var responses []*ber.Packet
+	for {
+		message, err := ber.Read(conn)
+		c.Assert(err, check.IsNil)
+		c.Assert(message.Children[0].Int(), check.Equals, id)
+		response := message.Children[1]
+		responses = append(responses, response)
+		if response.Tag == appBindResponse || response.Tag == appSearchResultDone {
+			return responses
+		}
+	}
+}
+
+func bindRequest(dn, password string) *ber.Packet {
+	return ber.NewConstructed(ber.ClassApplication, appBindRequest,
+		ber.NewInteger(3), ber.NewString(dn), ber.NewPrimitive(ber.ClassContext, 0, []byte(password)))
+}
+
+func searchRequest(baseDN string, filter *ber.Packet, attributes ...string) *ber.Packet {
+	attrList := ber.NewSequence()
+	for _, attr := range attributes {
+		attrList.Children = append(attrList.Children, ber.NewString(attr))
+	}
+	return ber.NewConstructed(ber.ClassApplication, appSearchRequest,
+		ber.NewString(baseDN), ber.NewEnumerated(scopeWholeSubtree), ber.NewEnumerated(0),
+		ber.NewInteger(0), ber.NewInteger(0), ber.NewBoolean(false), filter, attrList)
+}
+
+func (s *S) TestBind(c *check.C) {
+	conn, err := net.Dial("tcp", s.server.Addr())
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	responses := s.roundTrip(c, conn, 1, bindRequest("uid=gopher,ou=people,dc=tsuru,dc=io", "123456"))
+	c.Assert(responses[0].Children[0].Int(), check.Equals, resultSuccess)
+	responses = s.roundTrip(c, conn, 2, bindRequest("uid=gopher,ou=people,dc=tsuru,dc=io", "wrong"))
+	c.Assert(responses[0].Children[0].Int(), check.Equals, resultInvalidCredentials)
+	responses = s.roundTrip(c, conn, 3, bindRequest("uid=nopass,ou=people,dc=tsuru,dc=io", ""))
+	c.Assert(responses[0].Children[0].Int(), check.Equals, resultInvalidCredentials)
+	responses = s.roundTrip(c, conn, 4, bindRequest("", ""))
+	c.Assert(responses[0].Children[0].Int(), check.Equals, resultSuccess)
+	s.server.RLock()
+	defer s.server.RUnlock()
+	c.Assert(s.server.Binds, check.DeepEquals, []string{"uid=gopher,ou=people,dc=tsuru,dc=io"})
+}
+
+func (s *S) TestSearch(c *check.C) {
+	conn, err := net.Dial("tcp", s.server.Addr())
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	filter := ber.NewConstructed(ber.ClassContext, filterAnd,
+		ber.NewPrimitive(ber.ClassContext, filterPresent, []byte("objectClass")),
+		ber.NewConstructed(ber.ClassContext, filterEqualityMatch, ber.NewString("MAIL"), ber.NewString("Gopher@tsuru.io")),
+	)
+	responses := s.roundTrip(c, conn, 1, searchRequest("dc=tsuru,dc=io", filter, "cn"))
+	c.Assert(responses, check.HasLen, 2)
+	c.Assert(responses[0].Tag, check.Equals, byte(appSearchResultEntry))
+	c.Assert(responses[0].Children[0].Text(), check.Equals, "uid=gopher,ou=people,dc=tsuru,dc=io")
+	attributes := responses[0].Children[1].Children
+	c.Assert(attributes, check.HasLen, 1)
+	c.Assert(attributes[0].Children[0].Text(), check.Equals, "cn")
+	c.Assert(attributes[0].Children[1].Children[0].Text(), check.Equals, "Gopher")
+	c.Assert(responses[1].Children[0].Int(), check.Equals, resultSuccess)
+	filter = ber.NewConstructed(ber.ClassContext, filterNot,
+		ber.NewConstructed(ber.ClassContext, filterEqualityMatch, ber.NewString("mail"), ber.NewString("gopher@tsuru.io")),
+	)
+	responses = s.roundTrip(c, conn, 2, searchRequest("ou=people,dc=tsuru,dc=io", filter))
+	c.Assert(responses, check.HasLen, 2)
+	c.Assert(responses[0].Children[0].Text(), check.Equals, "uid=nopass,ou=people,dc=tsuru,dc=io")
+}
+
+func (s *S) TestSearchNoSuchObject(c *check.C) {
+	conn, err := net.Dial("tcp", s.server.Addr())
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	filter := ber.NewPrimitive(ber.ClassContext, filterPresent, []byte("mail"))
+	responses := s.roundTrip(c, conn, 1, searchRequest("dc=example,dc=com", filter))
+	c.Assert(responses, check.HasLen, 1)
+	c.Assert(responses[0].Children[0].Int(), check.Equals, resultNoSuchObject)
+}
+
+func (s *S) TestReset(c *check.C) {
+	s.server.Reset()
+	s.server.RLock()
+	defer s.server.RUnlock()
+	c.Assert(s.server.entries, check.HasLen, 0)
+	c.Assert(s.server.Binds, check.HasLen, 0)
+}
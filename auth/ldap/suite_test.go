@@ -0,0 +1,74 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ldap
+
+import (
+	"testing"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/auth/ldap/ldaptest"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/db/dbtest"
+	"github.com/tsuru/tsuru/repository/repositorytest"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	conn   *db.Storage
+	server *ldaptest.Server
+}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	var err error
+	s.server, err = ldaptest.NewServer()
+	c.Assert(err, check.IsNil)
+	config.Set("auth:ldap:server", s.server.Addr())
+	config.Set("auth:ldap:user-base-dn", "ou=people,dc=tsuru,dc=io")
+	config.Set("auth:ldap:group-base-dn", "ou=groups,dc=tsuru,dc=io")
+	config.Set("auth:ldap:groups", map[interface{}]interface{}{
+		"developers": "devteam",
+		"operations": "opsteam",
+	})
+	config.Set("auth:token-expire-days", 2)
+	config.Set("auth:hash-cost", bcrypt.MinCost)
+	config.Set("auth:user-registration", true)
+	config.Set("admin-team", "admin")
+	config.Set("database:url", "127.0.0.1:27017")
+	config.Set("database:name", "tsuru_auth_ldap_test")
+	config.Set("repo-manager", "fake")
+}
+
+func (s *S) SetUpTest(c *check.C) {
+	s.conn, _ = db.Conn()
+	repositorytest.Reset()
+	s.server.AddEntry("uid=gopher,ou=people,dc=tsuru,dc=io", "123456", map[string][]string{
+		"uid":  {"gopher"},
+		"mail": {"gopher@tsuru.io"},
+	})
+	s.server.AddEntry("cn=developers,ou=groups,dc=tsuru,dc=io", "", map[string][]string{
+		"cn":     {"developers"},
+		"member": {"uid=gopher,ou=people,dc=tsuru,dc=io"},
+	})
+	s.server.AddEntry("cn=operations,ou=groups,dc=tsuru,dc=io", "", map[string][]string{
+		"cn":     {"operations"},
+		"member": {"uid=someone,ou=people,dc=tsuru,dc=io"},
+	})
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	err := dbtest.ClearAllCollections(s.conn.Users().Database)
+	c.Assert(err, check.IsNil)
+	s.conn.Close()
+	s.server.Reset()
+}
+
+func (s *S) TearDownSuite(c *check.C) {
+	s.server.Stop()
+}
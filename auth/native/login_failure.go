@@ -0,0 +1,116 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package native
+
+import (
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/rec"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const defaultLockoutDuration = 15 * time.Minute
+
+type loginFailure struct {
+	User     string
+	IP       string
+	Date     time.Time
+	ExpireAt time.Time
+}
+
+type lockoutConfig struct {
+	maxAttempts      int
+	maxAttemptsPerIP int
+	duration         time.Duration
+}
+
+func (l *lockoutConfig) enabled() bool {
+	return l.maxAttempts > 0 || l.maxAttemptsPerIP > 0
+}
+
+func loadLockoutConfig() lockoutConfig {
+	var l lockoutConfig
+	l.maxAttempts, _ = config.GetInt("auth:lockout:max-attempts")
+	l.maxAttemptsPerIP, _ = config.GetInt("auth:lockout:max-attempts-per-ip")
+	if seconds, err := config.GetInt("auth:lockout:duration"); err == nil && seconds > 0 {
+		l.duration = time.Duration(seconds) * time.Second
+	} else {
+		l.duration = defaultLockoutDuration
+	}
+	return l
+}
+
+// loginLocked checks whether the user or the IP reached the maximum number of
+// failed login attempts in the lockout duration. Failures older than that are
+// not considered, so the lockout is lifted as they expire.
+func loginLocked(email, ip string) (bool, error) {
+	l := loadLockoutConfig()
+	if !l.enabled() {
+		return false, nil
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	since := time.Now().Add(-l.duration)
+	if l.maxAttempts > 0 {
+		n, err := conn.LoginFailures().Find(bson.M{"user": email, "date": bson.M{"$gt": since}}).Count()
+		if err != nil {
+			return false, err
+		}
+		if n >= l.maxAttempts {
+			return true, nil
+		}
+	}
+	if l.maxAttemptsPerIP > 0 && ip != "" {
+		n, err := conn.LoginFailures().Find(bson.M{"ip": ip, "date": bson.M{"$gt": since}}).Count()
+		if err != nil {
+			return false, err
+		}
+		if n >= l.maxAttemptsPerIP {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func recordLoginFailure(email, ip string) error {
+	rec.Log(email, "login-failure", ip)
+	l := loadLockoutConfig()
+	if !l.enabled() {
+		return nil
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	now := time.Now()
+	return conn.LoginFailures().Insert(loginFailure{
+		User:     email,
+		IP:       ip,
+		Date:     now,
+		ExpireAt: now.Add(l.duration),
+	})
+}
+
+// clearLoginFailures removes the failures of the user after a successful
+// login. Failures from the IP are kept, so a valid account can't be used to
+// reset the counter of an attacker.
+func clearLoginFailures(email string) error {
+	if l := loadLockoutConfig(); !l.enabled() {
+		return nil
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.LoginFailures().RemoveAll(bson.M{"user": email})
+	return err
+}
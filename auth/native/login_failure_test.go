@@ -0,0 +1,144 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package native
+
+import (
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/auth"
+	"github.com/tsuru/tsuru/rec/rectest"
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) failLogin(c *check.C, email, ip string) {
+	_, err := nativeScheme.Login(map[string]string{"email": email, "password": "wrong-password", "ip": ip})
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestLoadLockoutConfig(c *check.C) {
+	l := loadLockoutConfig()
+	c.Assert(l.enabled(), check.Equals, false)
+	c.Assert(l.duration, check.Equals, defaultLockoutDuration)
+	config.Set("auth:lockout:max-attempts", 3)
+	config.Set("auth:lockout:duration", 60)
+	defer config.Unset("auth:lockout")
+	l = loadLockoutConfig()
+	c.Assert(l.enabled(), check.Equals, true)
+	c.Assert(l.maxAttempts, check.Equals, 3)
+	c.Assert(l.duration, check.Equals, time.Minute)
+}
+
+func (s *S) TestLoginFailuresAreNotStoredWithoutLockout(c *check.C) {
+	s.failLogin(c, s.user.Email, "10.0.0.1")
+	n, err := s.conn.LoginFailures().Find(nil).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 0)
+	action := rectest.Action{User: s.user.Email, Action: "login-failure", Extra: []interface{}{"10.0.0.1"}}
+	c.Assert(action, rectest.IsRecorded)
+}
+
+func (s *S) TestLoginLockoutPerUser(c *check.C) {
+	config.Set("auth:lockout:max-attempts", 3)
+	defer config.Unset("auth:lockout")
+	for i := 0; i < 3; i++ {
+		s.failLogin(c, s.user.Email, "10.0.0.1")
+	}
+	var failure loginFailure
+	err := s.conn.LoginFailures().Find(bson.M{"user": s.user.Email}).One(&failure)
+	c.Assert(err, check.IsNil)
+	c.Assert(failure.IP, check.Equals, "10.0.0.1")
+	c.Assert(failure.ExpireAt.Sub(failure.Date), check.Equals, defaultLockoutDuration)
+	_, err = nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456", "ip": "10.0.0.2"})
+	c.Assert(err, check.Equals, auth.ErrTooManyLoginAttempts)
+	action := rectest.Action{User: s.user.Email, Action: "login-locked", Extra: []interface{}{"10.0.0.2"}}
+	c.Assert(action, rectest.IsRecorded)
+}
+
+func (s *S) TestLoginLockoutExpires(c *check.C) {
+	config.Set("auth:lockout:max-attempts", 1)
+	defer config.Unset("auth:lockout")
+	old := time.Now().Add(-defaultLockoutDuration - time.Minute)
+	err := s.conn.LoginFailures().Insert(loginFailure{User: s.user.Email, Date: old, ExpireAt: old.Add(defaultLockoutDuration)})
+	c.Assert(err, check.IsNil)
+	_, err = nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456"})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestLoginLockoutPerIP(c *check.C) {
+	config.Set("auth:lockout:max-attempts-per-ip", 2)
+	defer config.Unset("auth:lockout")
+	s.failLogin(c, "unknown@tsuru.io", "10.0.0.1")
+	s.failLogin(c, s.user.Email, "10.0.0.1")
+	_, err := nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456", "ip": "10.0.0.1"})
+	c.Assert(err, check.Equals, auth.ErrTooManyLoginAttempts)
+	_, err = nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456", "ip": "10.0.0.2"})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestSuccessfulLoginClearsUserFailures(c *check.C) {
+	config.Set("auth:lockout:max-attempts", 3)
+	config.Set("auth:lockout:max-attempts-per-ip", 10)
+	defer config.Unset("auth:lockout")
+	s.failLogin(c, s.user.Email, "10.0.0.1")
+	s.failLogin(c, s.user.Email, "10.0.0.1")
+	_, err := nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456", "ip": "10.0.0.1"})
+	c.Assert(err, check.IsNil)
+	n, err := s.conn.LoginFailures().Find(bson.M{"user": s.user.Email}).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 0)
+	locked, err := loginLocked(s.user.Email, "10.0.0.1")
+	c.Assert(err, check.IsNil)
+	c.Assert(locked, check.Equals, false)
+}
+
+func (s *S) TestLoginFailureWithTwoFactorCode(c *check.C) {
+	config.Set("auth:lockout:max-attempts", 1)
+	defer config.Unset("auth:lockout")
+	s.enableTwoFactor(c, s.user)
+	_, err := nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456"})
+	c.Assert(err, check.Equals, auth.ErrTwoFactorRequired)
+	_, err = nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456", "otp": "wrong"})
+	c.Assert(err, check.FitsTypeOf, auth.AuthenticationFailure{})
+	locked, err := loginLocked(s.user.Email, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(locked, check.Equals, true)
+}
+
+func (s *S) TestDisableTwoFactorLockout(c *check.C) {
+	config.Set("auth:lockout:max-attempts", 2)
+	defer config.Unset("auth:lockout")
+	_, codes := s.enableTwoFactor(c, s.user)
+	err := nativeScheme.DisableTwoFactor(s.user, "", "10.0.0.1")
+	c.Assert(err, check.Equals, ErrMissingTwoFactorCode)
+	for i := 0; i < 2; i++ {
+		err = nativeScheme.DisableTwoFactor(s.user, "wrong", "10.0.0.1")
+		c.Assert(err, check.Equals, ErrInvalidTwoFactorCode)
+	}
+	n, err := s.conn.LoginFailures().Find(bson.M{"user": s.user.Email, "ip": "10.0.0.1"}).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 2)
+	err = nativeScheme.DisableTwoFactor(s.user, codes[0], "10.0.0.1")
+	c.Assert(err, check.Equals, auth.ErrTooManyLoginAttempts)
+	enabled, err := nativeScheme.TwoFactorEnabled(s.user)
+	c.Assert(err, check.IsNil)
+	c.Assert(enabled, check.Equals, true)
+}
+
+func (s *S) TestRegenerateRecoveryCodesLockoutPerIP(c *check.C) {
+	config.Set("auth:lockout:max-attempts-per-ip", 1)
+	defer config.Unset("auth:lockout")
+	_, codes := s.enableTwoFactor(c, s.user)
+	_, err := nativeScheme.RegenerateRecoveryCodes(s.user, "wrong", "10.0.0.1")
+	c.Assert(err, check.Equals, ErrInvalidTwoFactorCode)
+	_, err = nativeScheme.RegenerateRecoveryCodes(s.user, codes[0], "10.0.0.1")
+	c.Assert(err, check.Equals, auth.ErrTooManyLoginAttempts)
+	action := rectest.Action{User: s.user.Email, Action: "login-locked", Extra: []interface{}{"10.0.0.1"}}
+	c.Assert(action, rectest.IsRecorded)
+	newCodes, err := nativeScheme.RegenerateRecoveryCodes(s.user, codes[0], "10.0.0.2")
+	c.Assert(err, check.IsNil)
+	c.Assert(newCodes, check.HasLen, recoveryCodesCount)
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/tsuru/tsuru/auth"
 	"github.com/tsuru/tsuru/db"
 	"github.com/tsuru/tsuru/errors"
+	"github.com/tsuru/tsuru/rec"
 	"github.com/tsuru/tsuru/validation"
 )
 
@@ -35,14 +36,30 @@ func (s NativeScheme) Login(params map[string]string) (auth.Token, error) {
 	if !ok {
 		return nil, ErrMissingPasswordError
 	}
-	user, err := auth.GetUserByEmail(email)
+	ip := params["ip"]
+	locked, err := loginLocked(email, ip)
 	if err != nil {
 		return nil, err
 	}
-	token, err := createToken(user, password)
-	if err != nil {
+	if locked {
+		rec.Log(email, "login-locked", ip)
+		return nil, auth.ErrTooManyLoginAttempts
+	}
+	user, err := auth.GetUserByEmail(email)
+	if err == auth.ErrUserNotFound {
+		recordLoginFailure(email, ip)
+		return nil, err
+	} else if err != nil {
 		return nil, err
 	}
+	token, err := createToken(user, password, params["otp"])
+	if _, ok := err.(auth.AuthenticationFailure); ok {
+		recordLoginFailure(email, ip)
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	clearLoginFailures(email)
 	return token, nil
 }
 
@@ -62,8 +79,8 @@ func (s NativeScheme) Create(user *auth.User) (*auth.User, error) {
 	if !validation.ValidateEmail(user.Email) {
 		return nil, ErrInvalidEmail
 	}
-	if !validation.ValidateLength(user.Password, passwordMinLen, passwordMaxLen) {
-		return nil, ErrInvalidPassword
+	if err := validatePassword(user.Password); err != nil {
+		return nil, err
 	}
 	if _, err := auth.GetUserByEmail(user.Email); err == nil {
 		return nil, ErrEmailRegistered
@@ -85,8 +102,8 @@ func (s NativeScheme) ChangePassword(token auth.Token, oldPassword string, newPa
 	if err = checkPassword(user.Password, oldPassword); err != nil {
 		return ErrPasswordMismatch
 	}
-	if !validation.ValidateLength(newPassword, passwordMinLen, passwordMaxLen) {
-		return ErrInvalidPassword
+	if err = validatePassword(newPassword); err != nil {
+		return err
 	}
 	user.Password = newPassword
 	hashPassword(user)
@@ -134,6 +151,10 @@ func (s NativeScheme) Remove(u *auth.User) error {
 	if err != nil {
 		return err
 	}
+	err = removeTwoFactor(u.Email)
+	if err != nil {
+		return err
+	}
 	return u.Delete()
 }
 
@@ -0,0 +1,84 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package native
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/errors"
+	"github.com/tsuru/tsuru/validation"
+)
+
+// passwordPolicy holds the rules for passwords chosen by users, loaded from
+// the auth:password settings. The minimum length can only be raised, as
+// shorter passwords are always refused on login.
+type passwordPolicy struct {
+	minLength        int
+	requireUppercase bool
+	requireLowercase bool
+	requireDigit     bool
+	requireSymbol    bool
+}
+
+func loadPasswordPolicy() passwordPolicy {
+	p := passwordPolicy{minLength: passwordMinLen}
+	if minLength, err := config.GetInt("auth:password:min-length"); err == nil {
+		p.minLength = minLength
+	}
+	if p.minLength < passwordMinLen {
+		p.minLength = passwordMinLen
+	} else if p.minLength > passwordMaxLen {
+		p.minLength = passwordMaxLen
+	}
+	p.requireUppercase, _ = config.GetBool("auth:password:require-uppercase")
+	p.requireLowercase, _ = config.GetBool("auth:password:require-lowercase")
+	p.requireDigit, _ = config.GetBool("auth:password:require-digit")
+	p.requireSymbol, _ = config.GetBool("auth:password:require-symbol")
+	return p
+}
+
+func validatePassword(password string) error {
+	p := loadPasswordPolicy()
+	if !validation.ValidateLength(password, p.minLength, passwordMaxLen) {
+		if p.minLength == passwordMinLen {
+			return ErrInvalidPassword
+		}
+		msg := fmt.Sprintf("password length should be least %d characters and at most %d characters", p.minLength, passwordMaxLen)
+		return &errors.ValidationError{Message: msg}
+	}
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	var missing []string
+	if p.requireUppercase && !upper {
+		missing = append(missing, "one uppercase letter")
+	}
+	if p.requireLowercase && !lower {
+		missing = append(missing, "one lowercase letter")
+	}
+	if p.requireDigit && !digit {
+		missing = append(missing, "one digit")
+	}
+	if p.requireSymbol && !symbol {
+		missing = append(missing, "one symbol")
+	}
+	if len(missing) > 0 {
+		return &errors.ValidationError{Message: "password must contain at least " + strings.Join(missing, ", ")}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package native
+
+import (
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/auth"
+	"github.com/tsuru/tsuru/errors"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestValidatePasswordDefaultPolicy(c *check.C) {
+	c.Assert(validatePassword("123456"), check.IsNil)
+	c.Assert(validatePassword("12345"), check.Equals, ErrInvalidPassword)
+	c.Assert(validatePassword("123456789012345678901234567890123456789012345678901"), check.Equals, ErrInvalidPassword)
+}
+
+func (s *S) TestValidatePasswordMinLength(c *check.C) {
+	config.Set("auth:password:min-length", 10)
+	defer config.Unset("auth:password:min-length")
+	err := validatePassword("123456789")
+	c.Assert(err, check.FitsTypeOf, &errors.ValidationError{})
+	c.Assert(err, check.ErrorMatches, "password length should be least 10 characters and at most 50 characters")
+	c.Assert(validatePassword("1234567890"), check.IsNil)
+}
+
+func (s *S) TestValidatePasswordMinLengthCantBeLowered(c *check.C) {
+	config.Set("auth:password:min-length", 2)
+	defer config.Unset("auth:password:min-length")
+	c.Assert(validatePassword("123"), check.Equals, ErrInvalidPassword)
+}
+
+func (s *S) TestValidatePasswordComplexity(c *check.C) {
+	config.Set("auth:password:require-uppercase", true)
+	config.Set("auth:password:require-lowercase", true)
+	config.Set("auth:password:require-digit", true)
+	config.Set("auth:password:require-symbol", true)
+	defer func() {
+		config.Unset("auth:password:require-uppercase")
+		config.Unset("auth:password:require-lowercase")
+		config.Unset("auth:password:require-digit")
+		config.Unset("auth:password:require-symbol")
+	}()
+	err := validatePassword("123456")
+	c.Assert(err, check.FitsTypeOf, &errors.ValidationError{})
+	c.Assert(err, check.ErrorMatches, "password must contain at least one uppercase letter, one lowercase letter, one symbol")
+	err = validatePassword("Abcdefg")
+	c.Assert(err, check.ErrorMatches, "password must contain at least one digit, one symbol")
+	c.Assert(validatePassword("Abc-123"), check.IsNil)
+}
+
+func (s *S) TestNativeCreateAppliesPasswordPolicy(c *check.C) {
+	config.Set("auth:password:require-digit", true)
+	defer config.Unset("auth:password:require-digit")
+	user := &auth.User{Email: "x@x.com", Password: "abcdefg"}
+	_, err := nativeScheme.Create(user)
+	c.Assert(err, check.FitsTypeOf, &errors.ValidationError{})
+	_, err = auth.GetUserByEmail(user.Email)
+	c.Assert(err, check.Equals, auth.ErrUserNotFound)
+}
+
+func (s *S) TestChangePasswordAppliesPasswordPolicy(c *check.C) {
+	config.Set("auth:password:require-symbol", true)
+	defer config.Unset("auth:password:require-symbol")
+	err := nativeScheme.ChangePassword(s.token, "123456", "abcdefg")
+	c.Assert(err, check.FitsTypeOf, &errors.ValidationError{})
+	err = nativeScheme.ChangePassword(s.token, "123456", "abc-defg")
+	c.Assert(err, check.IsNil)
+}
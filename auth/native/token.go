@@ -162,13 +162,23 @@ func checkPassword(passwordHash string, password string) error {
 	return auth.AuthenticationFailure{Message: "Authentication failed, wrong password."}
 }
 
-func createToken(u *auth.User, password string) (*Token, error) {
+func createToken(u *auth.User, password, otp string) (*Token, error) {
 	if u.Email == "" {
 		return nil, errors.New("User does not have an email")
 	}
 	if err := checkPassword(u.Password, password); err != nil {
 		return nil, err
 	}
+	if err := checkSecondFactor(u, otp); err != nil {
+		return nil, err
+	}
+	return IssueToken(u)
+}
+
+// IssueToken generates and stores a new token for the given user, without
+// checking any password. It's used by schemes that authenticate users against
+// external sources, but keep using native tokens.
+func IssueToken(u *auth.User) (*Token, error) {
 	conn, err := db.Conn()
 	if err != nil {
 		return nil, err
@@ -201,7 +201,7 @@ func (s *S) TestCreateTokenShouldSaveTheTokenInTheDatabase(c *check.C) {
 	_, err := nativeScheme.Create(&u)
 	c.Assert(err, check.IsNil)
 	defer u.Delete()
-	_, err = createToken(&u, "123456")
+	_, err = createToken(&u, "123456", "")
 	c.Assert(err, check.IsNil)
 	var result Token
 	err = s.conn.Tokens().Find(bson.M{"useremail": u.Email}).One(&result)
@@ -209,6 +209,25 @@ func (s *S) TestCreateTokenShouldSaveTheTokenInTheDatabase(c *check.C) {
 	c.Assert(result.Token, check.NotNil)
 }
 
+func (s *S) TestIssueToken(c *check.C) {
+	u := auth.User{Email: "cyclops@xmen.com"}
+	err := u.Create()
+	c.Assert(err, check.IsNil)
+	defer u.Delete()
+	t, err := IssueToken(&u)
+	c.Assert(err, check.IsNil)
+	c.Assert(t.UserEmail, check.Equals, u.Email)
+	var result Token
+	err = s.conn.Tokens().Find(bson.M{"token": t.Token}).One(&result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.UserEmail, check.Equals, u.Email)
+}
+
+func (s *S) TestIssueTokenUserWithoutEmail(c *check.C) {
+	_, err := IssueToken(&auth.User{})
+	c.Assert(err, check.ErrorMatches, "^Impossible to generate tokens for users without email$")
+}
+
 func (s *S) TestCreateTokenRemoveOldTokens(c *check.C) {
 	config.Set("auth:max-simultaneous-sessions", 2)
 	u := auth.User{Email: "para@xmen.com", Password: "123456"}
@@ -221,7 +240,7 @@ func (s *S) TestCreateTokenRemoveOldTokens(c *check.C) {
 	t2 := t1
 	t2.Token += "aa"
 	err = s.conn.Tokens().Insert(t1, t2)
-	_, err = createToken(&u, "123456")
+	_, err = createToken(&u, "123456", "")
 	c.Assert(err, check.IsNil)
 	ok := make(chan bool, 1)
 	go func() {
@@ -252,13 +271,13 @@ func (s *S) TestCreateTokenUsesDefaultCostWhenHasCostIsUndefined(c *check.C) {
 	defer u.Delete()
 	cost = 0
 	tokenExpire = 0
-	_, err = createToken(&u, "123456")
+	_, err = createToken(&u, "123456", "")
 	c.Assert(err, check.IsNil)
 }
 
 func (s *S) TestCreateTokenShouldReturnErrorIfTheProvidedUserDoesNotHaveEmailDefined(c *check.C) {
 	u := auth.User{Password: "123"}
-	_, err := createToken(&u, "123")
+	_, err := createToken(&u, "123", "")
 	c.Assert(err, check.NotNil)
 	c.Assert(err, check.ErrorMatches, "^User does not have an email$")
 }
@@ -268,7 +287,7 @@ func (s *S) TestCreateTokenShouldValidateThePassword(c *check.C) {
 	_, err := nativeScheme.Create(&u)
 	c.Assert(err, check.IsNil)
 	defer u.Delete()
-	_, err = createToken(&u, "123")
+	_, err = createToken(&u, "123", "")
 	c.Assert(err, check.NotNil)
 }
 
@@ -0,0 +1,328 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package native
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/auth"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/errors"
+	"github.com/tsuru/tsuru/rec"
+	"gopkg.in/mgo.v2"
+)
+
+const (
+	totpPeriod         = 30
+	totpDigits         = 6
+	totpSecretSize     = 20
+	recoveryCodesCount = 10
+	recoveryCodeSize   = 5
+)
+
+var (
+	ErrTwoFactorAlreadyEnabled = &errors.ConflictError{Message: "two-factor authentication is already enabled"}
+	ErrTwoFactorNotEnabled     = &errors.ValidationError{Message: "two-factor authentication is not enabled"}
+	ErrTwoFactorNotEnrolling   = &errors.ValidationError{Message: "you must start the two-factor authentication enrollment first"}
+	ErrMissingTwoFactorCode    = &errors.ValidationError{Message: "you must provide the two-factor authentication code"}
+	ErrInvalidTwoFactorCode    = &errors.NotAuthorizedError{Message: "invalid two-factor authentication code"}
+)
+
+// twoFactor holds the TOTP secret of a user, along with the hashes of their
+// unused recovery codes. The enrollment is pending until the user confirms it
+// with a valid code.
+type twoFactor struct {
+	UserEmail     string `bson:"_id"`
+	Secret        string
+	Enabled       bool
+	RecoveryCodes []string
+	LastCounter   int64
+}
+
+func getTwoFactor(email string) (*twoFactor, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var tf twoFactor
+	err = conn.TwoFactorAuth().FindId(email).One(&tf)
+	if err == mgo.ErrNotFound {
+		return nil, ErrTwoFactorNotEnabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tf, nil
+}
+
+func getEnabledTwoFactor(email string) (*twoFactor, error) {
+	tf, err := getTwoFactor(email)
+	if err != nil {
+		return nil, err
+	}
+	if !tf.Enabled {
+		return nil, ErrTwoFactorNotEnabled
+	}
+	return tf, nil
+}
+
+func removeTwoFactor(email string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.TwoFactorAuth().RemoveId(email)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (tf *twoFactor) save() error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.TwoFactorAuth().UpsertId(tf.UserEmail, tf)
+	return err
+}
+
+// validateCode checks the given TOTP code against the previous, the current
+// and the next time steps. Codes can't be reused, so steps older than the
+// last accepted one are ignored.
+func (tf *twoFactor) validateCode(code string) bool {
+	counter := time.Now().Unix() / totpPeriod
+	for c := counter - 1; c <= counter+1; c++ {
+		if c <= tf.LastCounter {
+			continue
+		}
+		expected, err := totpCode(tf.Secret, c)
+		if err == nil && hmac.Equal([]byte(expected), []byte(code)) {
+			tf.LastCounter = c
+			return true
+		}
+	}
+	return false
+}
+
+func (tf *twoFactor) useRecoveryCode(code string) bool {
+	hash := hashRecoveryCode(code)
+	for i, stored := range tf.RecoveryCodes {
+		if hmac.Equal([]byte(stored), []byte(hash)) {
+			tf.RecoveryCodes = append(tf.RecoveryCodes[:i], tf.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// verify accepts either a TOTP code or one of the recovery codes, storing the
+// changes in the database.
+func (tf *twoFactor) verify(code string) error {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return ErrMissingTwoFactorCode
+	}
+	if !tf.validateCode(code) && !tf.useRecoveryCode(code) {
+		return ErrInvalidTwoFactorCode
+	}
+	return tf.save()
+}
+
+func (tf *twoFactor) resetRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodesCount)
+	tf.RecoveryCodes = make([]string, recoveryCodesCount)
+	for i := range codes {
+		var b [recoveryCodeSize]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b[:]))
+		codes[i] = code[:4] + "-" + code[4:]
+		tf.RecoveryCodes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(code, "-", "", -1))
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(code)))
+}
+
+// totpCode generates the TOTP code (RFC 6238) for the given base32 encoded
+// secret and time step.
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := base32.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+func provisioningURI(email, secret string) string {
+	issuer, _ := config.GetString("auth:two-factor:issuer")
+	if issuer == "" {
+		issuer = "tsuru"
+	}
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(totpPeriod))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + email,
+		RawQuery: params.Encode(),
+	}
+	return u.String()
+}
+
+// checkSecondFactor is called by Login after the password is validated. Users
+// without two-factor authentication enabled don't need to provide any code.
+func checkSecondFactor(u *auth.User, code string) error {
+	tf, err := getEnabledTwoFactor(u.Email)
+	if err == ErrTwoFactorNotEnabled {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if code == "" {
+		return auth.ErrTwoFactorRequired
+	}
+	err = tf.verify(code)
+	if err == ErrInvalidTwoFactorCode {
+		return auth.AuthenticationFailure{Message: "Authentication failed, invalid two-factor authentication code."}
+	}
+	return err
+}
+
+func (s NativeScheme) TwoFactorEnabled(user *auth.User) (bool, error) {
+	_, err := getEnabledTwoFactor(user.Email)
+	if err == ErrTwoFactorNotEnabled {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// StartTwoFactorEnrollment generates a new TOTP secret for the user, returning
+// the provisioning URI that should be added to an authenticator app. The
+// enrollment must then be confirmed with ConfirmTwoFactorEnrollment.
+func (s NativeScheme) StartTwoFactorEnrollment(user *auth.User) (string, error) {
+	tf, err := getTwoFactor(user.Email)
+	if err == nil && tf.Enabled {
+		return "", ErrTwoFactorAlreadyEnabled
+	} else if err != nil && err != ErrTwoFactorNotEnabled {
+		return "", err
+	}
+	var key [totpSecretSize]byte
+	if _, err = rand.Read(key[:]); err != nil {
+		return "", err
+	}
+	tf = &twoFactor{UserEmail: user.Email, Secret: base32.StdEncoding.EncodeToString(key[:])}
+	if err = tf.save(); err != nil {
+		return "", err
+	}
+	return provisioningURI(user.Email, tf.Secret), nil
+}
+
+// ConfirmTwoFactorEnrollment enables two-factor authentication for the user,
+// given a valid code, and returns the recovery codes.
+func (s NativeScheme) ConfirmTwoFactorEnrollment(user *auth.User, code string) ([]string, error) {
+	tf, err := getTwoFactor(user.Email)
+	if err == ErrTwoFactorNotEnabled {
+		return nil, ErrTwoFactorNotEnrolling
+	} else if err != nil {
+		return nil, err
+	}
+	if tf.Enabled {
+		return nil, ErrTwoFactorAlreadyEnabled
+	}
+	if code == "" {
+		return nil, ErrMissingTwoFactorCode
+	}
+	if !tf.validateCode(strings.TrimSpace(code)) {
+		return nil, ErrInvalidTwoFactorCode
+	}
+	codes, err := tf.resetRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	tf.Enabled = true
+	return codes, tf.save()
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of the user, given a
+// valid code.
+func (s NativeScheme) RegenerateRecoveryCodes(user *auth.User, code, ip string) ([]string, error) {
+	tf, err := getEnabledTwoFactor(user.Email)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyWithLockout(tf, code, ip); err != nil {
+		return nil, err
+	}
+	codes, err := tf.resetRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	return codes, tf.save()
+}
+
+// DisableTwoFactor disables two-factor authentication for the user, given a
+// valid code.
+func (s NativeScheme) DisableTwoFactor(user *auth.User, code, ip string) error {
+	tf, err := getEnabledTwoFactor(user.Email)
+	if err != nil {
+		return err
+	}
+	if err = verifyWithLockout(tf, code, ip); err != nil {
+		return err
+	}
+	return removeTwoFactor(user.Email)
+}
+
+// verifyWithLockout verifies the code under the same lockout rules used by
+// Login: it's refused while the user or the IP is locked out, and invalid codes
+// are recorded as failed attempts.
+func verifyWithLockout(tf *twoFactor, code, ip string) error {
+	locked, err := loginLocked(tf.UserEmail, ip)
+	if err != nil {
+		return err
+	}
+	if locked {
+		rec.Log(tf.UserEmail, "login-locked", ip)
+		return auth.ErrTooManyLoginAttempts
+	}
+	err = tf.verify(code)
+	if err == ErrInvalidTwoFactorCode {
+		if recErr := recordLoginFailure(tf.UserEmail, ip); recErr != nil {
+			return recErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,184 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package native
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/auth"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) enableTwoFactor(c *check.C, u *auth.User) (string, []string) {
+	_, err := nativeScheme.StartTwoFactorEnrollment(u)
+	c.Assert(err, check.IsNil)
+	tf, err := getTwoFactor(u.Email)
+	c.Assert(err, check.IsNil)
+	code, err := totpCode(tf.Secret, time.Now().Unix()/totpPeriod-1)
+	c.Assert(err, check.IsNil)
+	codes, err := nativeScheme.ConfirmTwoFactorEnrollment(u, code)
+	c.Assert(err, check.IsNil)
+	return tf.Secret, codes
+}
+
+func (s *S) TestTotpCode(c *check.C) {
+	// test vectors from RFC 6238, truncated to 6 digits.
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	code, err := totpCode(secret, 59/totpPeriod)
+	c.Assert(err, check.IsNil)
+	c.Assert(code, check.Equals, "287082")
+	code, err = totpCode(secret, 1111111109/totpPeriod)
+	c.Assert(err, check.IsNil)
+	c.Assert(code, check.Equals, "081804")
+	_, err = totpCode("not base32!", 1)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestProvisioningURI(c *check.C) {
+	uri := provisioningURI("gopher@tsuru.io", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	c.Assert(uri, check.Equals, "otpauth://totp/tsuru:gopher@tsuru.io?algorithm=SHA1&digits=6&issuer=tsuru&period=30&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	config.Set("auth:two-factor:issuer", "My tsuru")
+	defer config.Unset("auth:two-factor:issuer")
+	parsed, err := url.Parse(provisioningURI("gopher@tsuru.io", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"))
+	c.Assert(err, check.IsNil)
+	c.Assert(parsed.Path, check.Equals, "/My tsuru:gopher@tsuru.io")
+	c.Assert(parsed.Query().Get("issuer"), check.Equals, "My tsuru")
+}
+
+func (s *S) TestStartTwoFactorEnrollment(c *check.C) {
+	uri, err := nativeScheme.StartTwoFactorEnrollment(s.user)
+	c.Assert(err, check.IsNil)
+	tf, err := getTwoFactor(s.user.Email)
+	c.Assert(err, check.IsNil)
+	c.Assert(tf.Enabled, check.Equals, false)
+	c.Assert(tf.Secret, check.HasLen, 32)
+	c.Assert(uri, check.Equals, provisioningURI(s.user.Email, tf.Secret))
+	enabled, err := nativeScheme.TwoFactorEnabled(s.user)
+	c.Assert(err, check.IsNil)
+	c.Assert(enabled, check.Equals, false)
+	_, err = nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456"})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestStartTwoFactorEnrollmentAlreadyEnabled(c *check.C) {
+	s.enableTwoFactor(c, s.user)
+	_, err := nativeScheme.StartTwoFactorEnrollment(s.user)
+	c.Assert(err, check.Equals, ErrTwoFactorAlreadyEnabled)
+}
+
+func (s *S) TestConfirmTwoFactorEnrollment(c *check.C) {
+	_, codes := s.enableTwoFactor(c, s.user)
+	c.Assert(codes, check.HasLen, recoveryCodesCount)
+	c.Assert(codes[0], check.Matches, `^[a-z2-7]{4}-[a-z2-7]{4}$`)
+	enabled, err := nativeScheme.TwoFactorEnabled(s.user)
+	c.Assert(err, check.IsNil)
+	c.Assert(enabled, check.Equals, true)
+	tf, err := getTwoFactor(s.user.Email)
+	c.Assert(err, check.IsNil)
+	c.Assert(tf.RecoveryCodes, check.HasLen, recoveryCodesCount)
+	c.Assert(tf.RecoveryCodes[0], check.Equals, hashRecoveryCode(codes[0]))
+}
+
+func (s *S) TestConfirmTwoFactorEnrollmentInvalidCode(c *check.C) {
+	_, err := nativeScheme.ConfirmTwoFactorEnrollment(s.user, "123456")
+	c.Assert(err, check.Equals, ErrTwoFactorNotEnrolling)
+	_, err = nativeScheme.StartTwoFactorEnrollment(s.user)
+	c.Assert(err, check.IsNil)
+	_, err = nativeScheme.ConfirmTwoFactorEnrollment(s.user, "")
+	c.Assert(err, check.Equals, ErrMissingTwoFactorCode)
+	_, err = nativeScheme.ConfirmTwoFactorEnrollment(s.user, "abcdef")
+	c.Assert(err, check.Equals, ErrInvalidTwoFactorCode)
+	enabled, err := nativeScheme.TwoFactorEnabled(s.user)
+	c.Assert(err, check.IsNil)
+	c.Assert(enabled, check.Equals, false)
+}
+
+func (s *S) TestLoginWithTwoFactor(c *check.C) {
+	secret, _ := s.enableTwoFactor(c, s.user)
+	_, err := nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456"})
+	c.Assert(err, check.Equals, auth.ErrTwoFactorRequired)
+	_, err = nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456", "otp": "000000x"})
+	c.Assert(err, check.FitsTypeOf, auth.AuthenticationFailure{})
+	code, err := totpCode(secret, time.Now().Unix()/totpPeriod)
+	c.Assert(err, check.IsNil)
+	token, err := nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456", "otp": code})
+	c.Assert(err, check.IsNil)
+	c.Assert(token.GetUserName(), check.Equals, s.user.Email)
+}
+
+func (s *S) TestLoginWithTwoFactorCodeCannotBeReused(c *check.C) {
+	secret, _ := s.enableTwoFactor(c, s.user)
+	tf, err := getTwoFactor(s.user.Email)
+	c.Assert(err, check.IsNil)
+	code, err := totpCode(secret, tf.LastCounter)
+	c.Assert(err, check.IsNil)
+	_, err = nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456", "otp": code})
+	c.Assert(err, check.FitsTypeOf, auth.AuthenticationFailure{})
+}
+
+func (s *S) TestLoginWithTwoFactorWrongPassword(c *check.C) {
+	s.enableTwoFactor(c, s.user)
+	_, err := nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "wrong-password"})
+	c.Assert(err, check.FitsTypeOf, auth.AuthenticationFailure{})
+}
+
+func (s *S) TestLoginWithRecoveryCode(c *check.C) {
+	_, codes := s.enableTwoFactor(c, s.user)
+	_, err := nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456", "otp": codes[3]})
+	c.Assert(err, check.IsNil)
+	_, err = nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456", "otp": codes[3]})
+	c.Assert(err, check.FitsTypeOf, auth.AuthenticationFailure{})
+	tf, err := getTwoFactor(s.user.Email)
+	c.Assert(err, check.IsNil)
+	c.Assert(tf.RecoveryCodes, check.HasLen, recoveryCodesCount-1)
+}
+
+func (s *S) TestRegenerateRecoveryCodes(c *check.C) {
+	_, err := nativeScheme.RegenerateRecoveryCodes(s.user, "123456", "")
+	c.Assert(err, check.Equals, ErrTwoFactorNotEnabled)
+	_, codes := s.enableTwoFactor(c, s.user)
+	newCodes, err := nativeScheme.RegenerateRecoveryCodes(s.user, codes[0], "")
+	c.Assert(err, check.IsNil)
+	c.Assert(newCodes, check.HasLen, recoveryCodesCount)
+	_, err = nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456", "otp": codes[1]})
+	c.Assert(err, check.FitsTypeOf, auth.AuthenticationFailure{})
+	_, err = nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456", "otp": newCodes[1]})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestDisableTwoFactor(c *check.C) {
+	_, codes := s.enableTwoFactor(c, s.user)
+	err := nativeScheme.DisableTwoFactor(s.user, "", "")
+	c.Assert(err, check.Equals, ErrMissingTwoFactorCode)
+	err = nativeScheme.DisableTwoFactor(s.user, "wrong", "")
+	c.Assert(err, check.Equals, ErrInvalidTwoFactorCode)
+	err = nativeScheme.DisableTwoFactor(s.user, codes[0], "")
+	c.Assert(err, check.IsNil)
+	_, err = getTwoFactor(s.user.Email)
+	c.Assert(err, check.Equals, ErrTwoFactorNotEnabled)
+	_, err = nativeScheme.Login(map[string]string{"email": s.user.Email, "password": "123456"})
+	c.Assert(err, check.IsNil)
+	err = nativeScheme.DisableTwoFactor(s.user, codes[1], "")
+	c.Assert(err, check.Equals, ErrTwoFactorNotEnabled)
+}
+
+func (s *S) TestRemoveUserRemovesTwoFactor(c *check.C) {
+	u := &auth.User{Email: "twofactor@tsuru.io", Password: "123456"}
+	_, err := nativeScheme.Create(u)
+	c.Assert(err, check.IsNil)
+	s.enableTwoFactor(c, u)
+	err = nativeScheme.Remove(u)
+	c.Assert(err, check.IsNil)
+	_, err = getTwoFactor(u.Email)
+	c.Assert(err, check.Equals, ErrTwoFactorNotEnabled)
+}
+
+func (s *S) TestNativeSchemeSupportsTwoFactor(c *check.C) {
+	var scheme auth.Scheme = nativeScheme
+	_, ok := scheme.(auth.TwoFactorScheme)
+	c.Assert(ok, check.Equals, true)
+}
@@ -6,6 +6,7 @@ package oauth
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
 
@@ -29,11 +30,20 @@ type OAuthParser interface {
 	Parse(infoResponse *http.Response) (string, error)
 }
 
+// OAuthGroupsParser is implemented by parsers that are also able to extract
+// the groups of the user from the info response. Team memberships are kept
+// in sync with these groups only when the parser implements this interface.
+type OAuthGroupsParser interface {
+	ParseGroups(infoResponse *http.Response) (string, []string, error)
+}
+
 type OAuthScheme struct {
 	BaseConfig   oauth2.Config
 	InfoUrl      string
 	CallbackPort int
 	Parser       OAuthParser
+	GroupsClaim  string
+	Groups       map[string]string
 }
 
 func init() {
@@ -78,8 +88,19 @@ func (s *OAuthScheme) loadConfig() (oauth2.Config, error) {
 	if err != nil {
 		log.Debugf("auth:oauth:callback-port not found using random port: %s", err)
 	}
+	groupsClaim, err := config.GetString("auth:oauth:groups-claim")
+	if err != nil {
+		groupsClaim = "groups"
+	}
+	groups, _ := config.Get("auth:oauth:groups")
+	groupsMap, _ := groups.(map[interface{}]interface{})
+	s.Groups = make(map[string]string, len(groupsMap))
+	for group, team := range groupsMap {
+		s.Groups[fmt.Sprint(group)] = fmt.Sprint(team)
+	}
 	s.InfoUrl = infoURL
 	s.CallbackPort = callbackPort
+	s.GroupsClaim = groupsClaim
 	s.BaseConfig = oauth2.Config{
 		ClientID:     clientId,
 		ClientSecret: clientSecret,
@@ -127,7 +148,14 @@ func (s *OAuthScheme) handleToken(t *oauth2.Token) (*Token, error) {
 		return nil, err
 	}
 	defer response.Body.Close()
-	email, err := s.Parser.Parse(response)
+	var email string
+	var groups []string
+	groupsParser, syncGroups := s.Parser.(OAuthGroupsParser)
+	if syncGroups {
+		email, groups, err = groupsParser.ParseGroups(response)
+	} else {
+		email, err = s.Parser.Parse(response)
+	}
 	if email == "" {
 		return nil, ErrEmptyUserEmail
 	}
@@ -146,7 +174,13 @@ func (s *OAuthScheme) handleToken(t *oauth2.Token) (*Token, error) {
 			return nil, err
 		}
 	}
-	token := Token{*t, email}
+	if syncGroups && len(s.Groups) > 0 {
+		err = auth.SyncTeams(user, groups, s.Groups)
+		if err != nil {
+			return nil, err
+		}
+	}
+	token := Token{Token: *t, UserEmail: email}
 	err = token.save()
 	if err != nil {
 		return nil, err
@@ -177,6 +211,12 @@ func (s *OAuthScheme) Auth(header string) (auth.Token, error) {
 	if err != nil {
 		return nil, err
 	}
+	if !token.Valid() && token.RefreshToken != "" {
+		if err = s.refresh(&config, token); err != nil {
+			log.Errorf("[oauth] failed to refresh token of %s: %s", token.UserEmail, err)
+			return nil, auth.ErrInvalidToken
+		}
+	}
 	client := config.Client(context.Background(), &token.Token)
 	rsp, err := client.Get(s.InfoUrl)
 	if err != nil {
@@ -186,6 +226,16 @@ func (s *OAuthScheme) Auth(header string) (auth.Token, error) {
 	return token, nil
 }
 
+// refresh uses the refresh token to get a new access token from the
+// provider, storing it in the database.
+func (s *OAuthScheme) refresh(config *oauth2.Config, token *Token) error {
+	newToken, err := config.TokenSource(context.Background(), &token.Token).Token()
+	if err != nil {
+		return err
+	}
+	return token.update(newToken)
+}
+
 func (s *OAuthScheme) Name() string {
 	return "oauth"
 }
@@ -200,14 +250,32 @@ func (s *OAuthScheme) Info() (auth.SchemeInfo, error) {
 }
 
 func (s *OAuthScheme) Parse(infoResponse *http.Response) (string, error) {
-	user := struct {
-		Email string `json:"email"`
-	}{}
-	err := json.NewDecoder(infoResponse.Body).Decode(&user)
+	email, _, err := s.ParseGroups(infoResponse)
+	return email, err
+}
+
+// ParseGroups extracts the email and the groups of the user from the info
+// response. The groups are taken from the claim defined by
+// auth:oauth:groups-claim, which may be either a list or a single string.
+func (s *OAuthScheme) ParseGroups(infoResponse *http.Response) (string, []string, error) {
+	var info map[string]interface{}
+	err := json.NewDecoder(infoResponse.Body).Decode(&info)
 	if err != nil {
-		return user.Email, err
+		return "", nil, err
+	}
+	email, _ := info["email"].(string)
+	var groups []string
+	switch claim := info[s.GroupsClaim].(type) {
+	case string:
+		groups = append(groups, claim)
+	case []interface{}:
+		for _, group := range claim {
+			if name, ok := group.(string); ok {
+				groups = append(groups, name)
+			}
+		}
 	}
-	return user.Email, nil
+	return email, groups, nil
 }
 
 func (s *OAuthScheme) Create(user *auth.User) (*auth.User, error) {
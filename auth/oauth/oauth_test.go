@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/tsuru/config"
 	"github.com/tsuru/tsuru/auth"
@@ -141,6 +142,25 @@ func (s *S) TestOAuthParseInvalid(c *check.C) {
 	c.Assert(err, check.NotNil)
 }
 
+func (s *S) TestOAuthParseGroups(c *check.C) {
+	b := ioutil.NopCloser(bytes.NewBufferString(`{"email":"x@x.com","groups":["devs",1,"ops"]}`))
+	rsp := &http.Response{Body: b}
+	scheme := OAuthScheme{GroupsClaim: "groups"}
+	email, groups, err := scheme.ParseGroups(rsp)
+	c.Assert(err, check.IsNil)
+	c.Assert(email, check.Equals, "x@x.com")
+	c.Assert(groups, check.DeepEquals, []string{"devs", "ops"})
+}
+
+func (s *S) TestOAuthParseGroupsSingleValue(c *check.C) {
+	b := ioutil.NopCloser(bytes.NewBufferString(`{"email":"x@x.com","role":"admin"}`))
+	rsp := &http.Response{Body: b}
+	scheme := OAuthScheme{GroupsClaim: "role"}
+	_, groups, err := scheme.ParseGroups(rsp)
+	c.Assert(err, check.IsNil)
+	c.Assert(groups, check.DeepEquals, []string{"admin"})
+}
+
 func (s *S) TestOAuthAuth(c *check.C) {
 	existing := Token{Token: oauth2.Token{AccessToken: "myvalidtoken"}, UserEmail: "x@x.com"}
 	err := existing.save()
@@ -153,6 +173,108 @@ func (s *S) TestOAuthAuth(c *check.C) {
 	c.Assert(token.GetValue(), check.Equals, "myvalidtoken")
 }
 
+func (s *S) TestOAuthAuthRefreshesExpiredToken(c *check.C) {
+	existing := Token{
+		Token:     oauth2.Token{AccessToken: "expired_token", RefreshToken: "my_refresh", Expiry: time.Now().Add(-time.Hour)},
+		UserEmail: "x@x.com",
+	}
+	err := existing.save()
+	c.Assert(err, check.IsNil)
+	s.rsps["/token"] = `access_token=new_token&refresh_token=new_refresh&expires_in=3600`
+	scheme := OAuthScheme{}
+	token, err := scheme.Auth("bearer expired_token")
+	c.Assert(err, check.IsNil)
+	c.Assert(token.GetValue(), check.Equals, "expired_token")
+	c.Assert(len(s.reqs), check.Equals, 2)
+	c.Assert(s.reqs[0].URL.Path, check.Equals, "/token")
+	c.Assert(s.bodies[0], check.Matches, ".*grant_type=refresh_token.*")
+	c.Assert(s.bodies[0], check.Matches, ".*refresh_token=my_refresh.*")
+	c.Assert(s.reqs[1].URL.Path, check.Equals, "/user")
+	c.Assert(s.reqs[1].Header.Get("Authorization"), check.Equals, "Bearer new_token")
+	dbToken, err := getToken("bearer expired_token")
+	c.Assert(err, check.IsNil)
+	c.Assert(dbToken.AccessToken, check.Equals, "new_token")
+	c.Assert(dbToken.RefreshToken, check.Equals, "new_refresh")
+	c.Assert(dbToken.Value, check.Equals, "expired_token")
+	c.Assert(dbToken.Valid(), check.Equals, true)
+}
+
+func (s *S) TestOAuthAuthRefreshFailure(c *check.C) {
+	existing := Token{
+		Token:     oauth2.Token{AccessToken: "expired_token", RefreshToken: "my_refresh", Expiry: time.Now().Add(-time.Hour)},
+		UserEmail: "x@x.com",
+	}
+	err := existing.save()
+	c.Assert(err, check.IsNil)
+	s.rsps["/token"] = `error=invalid_grant`
+	scheme := OAuthScheme{}
+	_, err = scheme.Auth("bearer expired_token")
+	c.Assert(err, check.Equals, auth.ErrInvalidToken)
+	c.Assert(len(s.reqs), check.Equals, 1)
+}
+
+func (s *S) TestOAuthLoginSyncsTeams(c *check.C) {
+	config.Set("auth:oauth:groups", map[interface{}]interface{}{"developers": "backend", "sre": "ops"})
+	defer config.Unset("auth:oauth:groups")
+	owner := auth.User{Email: "owner@althor.com"}
+	err := s.conn.Teams().Insert(auth.Team{Name: "ops", Users: []string{owner.Email, "rand@althor.com"}, Owners: []string{owner.Email}})
+	c.Assert(err, check.IsNil)
+	scheme := OAuthScheme{}
+	s.rsps["/token"] = `access_token=my_token&refresh_token=my_refresh`
+	s.rsps["/user"] = `{"email":"rand@althor.com","groups":["developers","designers"]}`
+	params := map[string]string{"code": "abcdefg", "redirectUrl": "http://localhost"}
+	token, err := scheme.Login(params)
+	c.Assert(err, check.IsNil)
+	u, err := token.User()
+	c.Assert(err, check.IsNil)
+	team, err := auth.GetTeam("backend")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.ContainsUser(u), check.Equals, true)
+	team, err = auth.GetTeam("ops")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.ContainsUser(u), check.Equals, false)
+	dbToken, err := getToken("bearer my_token")
+	c.Assert(err, check.IsNil)
+	c.Assert(dbToken.RefreshToken, check.Equals, "my_refresh")
+}
+
+func (s *S) TestOAuthLoginSyncsTeamsCustomClaim(c *check.C) {
+	config.Set("auth:oauth:groups", map[interface{}]interface{}{"engineering": "backend"})
+	config.Set("auth:oauth:groups-claim", "department")
+	defer config.Unset("auth:oauth:groups")
+	defer config.Unset("auth:oauth:groups-claim")
+	scheme := OAuthScheme{}
+	s.rsps["/token"] = `access_token=my_token`
+	s.rsps["/user"] = `{"email":"rand@althor.com","department":"engineering"}`
+	params := map[string]string{"code": "abcdefg", "redirectUrl": "http://localhost"}
+	_, err := scheme.Login(params)
+	c.Assert(err, check.IsNil)
+	team, err := auth.GetTeam("backend")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.Users, check.DeepEquals, []string{"rand@althor.com"})
+}
+
+type emailParser struct{}
+
+func (emailParser) Parse(infoResponse *http.Response) (string, error) {
+	return "rand@althor.com", nil
+}
+
+func (s *S) TestOAuthLoginDoesNotSyncTeamsWithoutGroupsParser(c *check.C) {
+	config.Set("auth:oauth:groups", map[interface{}]interface{}{"sre": "ops"})
+	defer config.Unset("auth:oauth:groups")
+	err := s.conn.Teams().Insert(auth.Team{Name: "ops", Users: []string{"rand@althor.com"}})
+	c.Assert(err, check.IsNil)
+	scheme := OAuthScheme{Parser: emailParser{}}
+	s.rsps["/token"] = `access_token=my_token`
+	params := map[string]string{"code": "abcdefg", "redirectUrl": "http://localhost"}
+	_, err = scheme.Login(params)
+	c.Assert(err, check.IsNil)
+	team, err := auth.GetTeam("ops")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.Users, check.DeepEquals, []string{"rand@althor.com"})
+}
+
 func (s *S) TestOAuthAppLogin(c *check.C) {
 	scheme := OAuthScheme{}
 	token, err := scheme.AppLogin("myApp")
@@ -17,9 +17,16 @@ import (
 type Token struct {
 	oauth2.Token
 	UserEmail string `json:"email"`
+	// Value is the token known by the client. It's the first access token
+	// issued by the provider, and it's kept when the access token is
+	// refreshed.
+	Value string
 }
 
 func (t *Token) GetValue() string {
+	if t.Value != "" {
+		return t.Value
+	}
 	return t.AccessToken
 }
 
@@ -52,7 +59,7 @@ func getToken(header string) (*Token, error) {
 	}
 	coll := collection()
 	defer coll.Close()
-	err = coll.Find(bson.M{"token.accesstoken": token}).One(&t)
+	err = coll.Find(valueQuery(token)).One(&t)
 	if err != nil {
 		return nil, auth.ErrInvalidToken
 	}
@@ -62,7 +69,7 @@ func getToken(header string) (*Token, error) {
 func deleteToken(token string) error {
 	coll := collection()
 	defer coll.Close()
-	return coll.Remove(bson.M{"token.accesstoken": token})
+	return coll.Remove(valueQuery(token))
 }
 
 func deleteAllTokens(email string) error {
@@ -72,12 +79,31 @@ func deleteAllTokens(email string) error {
 	return err
 }
 
+// valueQuery finds tokens by the value known by the client. Tokens stored
+// before the value was introduced are found by the access token.
+func valueQuery(token string) bson.M {
+	return bson.M{"$or": []bson.M{{"value": token}, {"token.accesstoken": token}}}
+}
+
 func (t *Token) save() error {
+	if t.Value == "" {
+		t.Value = t.AccessToken
+	}
 	coll := collection()
 	defer coll.Close()
 	return coll.Insert(t)
 }
 
+// update replaces the provider token, keeping the value known by the client.
+func (t *Token) update(newToken *oauth2.Token) error {
+	coll := collection()
+	defer coll.Close()
+	value := t.GetValue()
+	t.Token = *newToken
+	t.Value = value
+	return coll.Update(valueQuery(value), t)
+}
+
 func collection() *storage.Collection {
 	name, err := config.GetString("auth:oauth:collection")
 	if err != nil {
@@ -8,6 +8,7 @@ import (
 	"github.com/tsuru/tsuru/auth"
 	"golang.org/x/oauth2"
 	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
 )
 
 func (s *S) TestGetToken(c *check.C) {
@@ -53,6 +54,38 @@ func (s *S) TestSave(c *check.C) {
 	c.Assert(tokens[0].GetValue(), check.Equals, "myvalidtoken")
 }
 
+func (s *S) TestSaveSetsValue(c *check.C) {
+	existing := Token{Token: oauth2.Token{AccessToken: "myvalidtoken"}, UserEmail: "x@x.com"}
+	err := existing.save()
+	c.Assert(err, check.IsNil)
+	c.Assert(existing.Value, check.Equals, "myvalidtoken")
+}
+
+func (s *S) TestUpdateKeepsValue(c *check.C) {
+	existing := Token{Token: oauth2.Token{AccessToken: "myvalidtoken"}, UserEmail: "x@x.com"}
+	err := existing.save()
+	c.Assert(err, check.IsNil)
+	err = existing.update(&oauth2.Token{AccessToken: "newtoken", RefreshToken: "refresh"})
+	c.Assert(err, check.IsNil)
+	t, err := getToken("bearer myvalidtoken")
+	c.Assert(err, check.IsNil)
+	c.Assert(t.AccessToken, check.Equals, "newtoken")
+	c.Assert(t.RefreshToken, check.Equals, "refresh")
+	c.Assert(t.GetValue(), check.Equals, "myvalidtoken")
+}
+
+func (s *S) TestGetTokenStoredWithoutValue(c *check.C) {
+	coll := collection()
+	defer coll.Close()
+	err := coll.Insert(bson.M{"token": bson.M{"accesstoken": "oldtoken"}, "useremail": "x@x.com"})
+	c.Assert(err, check.IsNil)
+	t, err := getToken("bearer oldtoken")
+	c.Assert(err, check.IsNil)
+	c.Assert(t.GetValue(), check.Equals, "oldtoken")
+	err = deleteToken("oldtoken")
+	c.Assert(err, check.IsNil)
+}
+
 func (s *S) TestDelete(c *check.C) {
 	existing := Token{Token: oauth2.Token{AccessToken: "myvalidtoken"}, UserEmail: "x@x.com"}
 	err := existing.save()
@@ -0,0 +1,249 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package oidc provides an authentication scheme backed by an OpenID Connect
+// provider. The provider endpoints are found through discovery, and users are
+// identified by the claims of the ID token, whose signature is validated with
+// the keys published by the provider.
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/auth"
+	"github.com/tsuru/tsuru/auth/native"
+	"github.com/tsuru/tsuru/errors"
+)
+
+const (
+	defaultTimeout  = 10 * time.Second
+	defaultCacheTTL = time.Hour
+)
+
+var (
+	ErrMissingCodeError       = &errors.ValidationError{Message: "You must provide code to login"}
+	ErrMissingCodeRedirectUrl = &errors.ValidationError{Message: "You must provide the used redirect url to login"}
+	ErrEmptyUserEmail         = &errors.NotAuthorizedError{Message: "Couldn't find the user email in the ID token."}
+	ErrEmailNotVerified       = &errors.NotAuthorizedError{Message: "The email of the user is not verified by the provider."}
+)
+
+type OIDCScheme struct{}
+
+func init() {
+	auth.RegisterScheme("oidc", OIDCScheme{})
+}
+
+type oidcConfig struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	scope        string
+	callbackPort int
+	timeout      time.Duration
+	cacheTTL     time.Duration
+	emailClaim   string
+	groupsClaim  string
+	groups       map[string]string
+}
+
+func loadConfig() (*oidcConfig, error) {
+	issuer, err := config.GetString("auth:oidc:issuer")
+	if err != nil {
+		return nil, err
+	}
+	clientID, err := config.GetString("auth:oidc:client-id")
+	if err != nil {
+		return nil, err
+	}
+	conf := oidcConfig{
+		issuer:      issuer,
+		clientID:    clientID,
+		scope:       "openid email profile",
+		timeout:     defaultTimeout,
+		cacheTTL:    defaultCacheTTL,
+		emailClaim:  "email",
+		groupsClaim: "groups",
+		groups:      make(map[string]string),
+	}
+	conf.clientSecret, _ = config.GetString("auth:oidc:client-secret")
+	if scope, _ := config.GetString("auth:oidc:scope"); scope != "" {
+		conf.scope = scope
+	}
+	conf.callbackPort, _ = config.GetInt("auth:oidc:callback-port")
+	if timeout, err := config.GetInt("auth:oidc:timeout"); err == nil {
+		conf.timeout = time.Duration(timeout) * time.Second
+	}
+	if ttl, err := config.GetInt("auth:oidc:cache-ttl"); err == nil {
+		conf.cacheTTL = time.Duration(ttl) * time.Second
+	}
+	if claim, _ := config.GetString("auth:oidc:email-claim"); claim != "" {
+		conf.emailClaim = claim
+	}
+	if claim, _ := config.GetString("auth:oidc:groups-claim"); claim != "" {
+		conf.groupsClaim = claim
+	}
+	groups, _ := config.Get("auth:oidc:groups")
+	groupsMap, _ := groups.(map[interface{}]interface{})
+	for group, team := range groupsMap {
+		conf.groups[fmt.Sprint(group)] = fmt.Sprint(team)
+	}
+	return &conf, nil
+}
+
+func (conf *oidcConfig) provider() (*provider, error) {
+	return cachedDiscover(&http.Client{Timeout: conf.timeout}, conf.issuer, conf.cacheTTL)
+}
+
+// Login exchanges the authorization code for an ID token. Clients using PKCE
+// must also send the code verifier, in the code_verifier parameter, and the
+// nonce sent in the authorization request must be sent in the nonce parameter,
+// to be checked against the ID token.
+func (s OIDCScheme) Login(params map[string]string) (auth.Token, error) {
+	code, ok := params["code"]
+	if !ok {
+		return nil, ErrMissingCodeError
+	}
+	redirectUrl, ok := params["redirectUrl"]
+	if !ok {
+		return nil, ErrMissingCodeRedirectUrl
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	p, err := conf.provider()
+	if err != nil {
+		return nil, err
+	}
+	idToken, err := p.exchange(conf.clientID, conf.clientSecret, code, redirectUrl, params["code_verifier"])
+	if err != nil {
+		return nil, authFailure(err)
+	}
+	claims, err := p.verify(idToken, conf.clientID, time.Now())
+	if err != nil {
+		return nil, authFailure(err)
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != params["nonce"] {
+		return nil, authFailure(invalidToken("the nonce doesn't match the login request"))
+	}
+	return conf.login(claims)
+}
+
+func authFailure(err error) error {
+	if e, ok := err.(*authError); ok {
+		return auth.AuthenticationFailure{Message: "Authentication failed, " + e.message + "."}
+	}
+	return err
+}
+
+func (conf *oidcConfig) login(claims map[string]interface{}) (auth.Token, error) {
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		return nil, ErrEmailNotVerified
+	}
+	email, _ := claims[conf.emailClaim].(string)
+	if email == "" {
+		return nil, ErrEmptyUserEmail
+	}
+	user, err := auth.GetUserByEmail(email)
+	if err != nil {
+		if err != auth.ErrUserNotFound {
+			return nil, err
+		}
+		registrationEnabled, _ := config.GetBool("auth:user-registration")
+		if !registrationEnabled {
+			return nil, err
+		}
+		user = &auth.User{Email: email}
+		if err = user.Create(); err != nil {
+			return nil, err
+		}
+	}
+	if len(conf.groups) > 0 {
+		if err = auth.SyncTeams(user, claimValues(claims[conf.groupsClaim]), conf.groups); err != nil {
+			return nil, err
+		}
+	}
+	return native.IssueToken(user)
+}
+
+// claimValues returns the values of a claim that may be either a list or a
+// single string.
+func claimValues(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return []string{claim}
+	case []interface{}:
+		values := make([]string, 0, len(claim))
+		for _, v := range claim {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func (s OIDCScheme) AppLogin(appName string) (auth.Token, error) {
+	nativeScheme := native.NativeScheme{}
+	return nativeScheme.AppLogin(appName)
+}
+
+func (s OIDCScheme) Logout(token string) error {
+	nativeScheme := native.NativeScheme{}
+	return nativeScheme.Logout(token)
+}
+
+func (s OIDCScheme) Auth(token string) (auth.Token, error) {
+	nativeScheme := native.NativeScheme{}
+	return nativeScheme.Auth(token)
+}
+
+func (s OIDCScheme) Name() string {
+	return "oidc"
+}
+
+// Info returns the authorization URL, which clients must complete with the
+// redirect URL, the PKCE code challenge and random state and nonce values. The
+// state must be checked by the client when handling the redirect, and the nonce
+// must be sent back to Login.
+func (s OIDCScheme) Info() (auth.SchemeInfo, error) {
+	conf, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	p, err := conf.provider()
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", conf.clientID)
+	params.Set("scope", conf.scope)
+	params.Set("redirect_uri", "__redirect_url__")
+	return auth.SchemeInfo{
+		"authorizeUrl": p.authorizeURL(params),
+		"port":         strconv.Itoa(conf.callbackPort),
+		"pkce":         "S256",
+	}, nil
+}
+
+func (s OIDCScheme) Create(user *auth.User) (*auth.User, error) {
+	user.Password = ""
+	err := user.Create()
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s OIDCScheme) Remove(u *auth.User) error {
+	nativeScheme := native.NativeScheme{}
+	return nativeScheme.Remove(u)
+}
@@ -0,0 +1,250 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package oidc
+
+import (
+	"net/url"
+	"sort"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/auth"
+	"github.com/tsuru/tsuru/auth/native"
+	"github.com/tsuru/tsuru/auth/oidc/oidctest"
+	"gopkg.in/check.v1"
+)
+
+var oidcScheme = OIDCScheme{}
+
+func loginParams(code string) map[string]string {
+	return map[string]string{"code": code, "redirectUrl": "http://localhost:1234"}
+}
+
+func (s *S) TestOIDCSchemeIsRegistered(c *check.C) {
+	scheme, err := auth.GetScheme("oidc")
+	c.Assert(err, check.IsNil)
+	c.Assert(scheme, check.Equals, oidcScheme)
+	c.Assert(scheme.Name(), check.Equals, "oidc")
+}
+
+func (s *S) TestLogin(c *check.C) {
+	s.issuer.AddCode("abc", map[string]interface{}{"email": "gopher@tsuru.io", "email_verified": true}, "")
+	token, err := oidcScheme.Login(loginParams("abc"))
+	c.Assert(err, check.IsNil)
+	c.Assert(token, check.FitsTypeOf, &native.Token{})
+	c.Assert(token.GetUserName(), check.Equals, "gopher@tsuru.io")
+	user, err := auth.GetUserByEmail("gopher@tsuru.io")
+	c.Assert(err, check.IsNil)
+	c.Assert(user.Password, check.Equals, "")
+	authToken, err := oidcScheme.Auth("bearer " + token.GetValue())
+	c.Assert(err, check.IsNil)
+	c.Assert(authToken.GetUserName(), check.Equals, "gopher@tsuru.io")
+}
+
+func (s *S) TestLoginWithPKCE(c *check.C) {
+	s.issuer.AddCode("abc", map[string]interface{}{"email": "gopher@tsuru.io"}, oidctest.CodeChallenge("verifier"))
+	s.issuer.AddCode("def", map[string]interface{}{"email": "gopher@tsuru.io"}, oidctest.CodeChallenge("verifier"))
+	params := loginParams("abc")
+	params["code_verifier"] = "wrong"
+	_, err := oidcScheme.Login(params)
+	c.Assert(err, check.FitsTypeOf, auth.AuthenticationFailure{})
+	c.Assert(err, check.ErrorMatches, `Authentication failed, the provider refused the authorization code: invalid_grant \(PKCE verification failed\)\.`)
+	params = loginParams("def")
+	params["code_verifier"] = "verifier"
+	token, err := oidcScheme.Login(params)
+	c.Assert(err, check.IsNil)
+	c.Assert(token.GetUserName(), check.Equals, "gopher@tsuru.io")
+}
+
+func (s *S) TestLoginWithNonce(c *check.C) {
+	s.issuer.AddCode("abc", map[string]interface{}{"email": "gopher@tsuru.io", "nonce": "n0nc3"}, "")
+	s.issuer.AddCode("def", map[string]interface{}{"email": "gopher@tsuru.io", "nonce": "n0nc3"}, "")
+	s.issuer.AddCode("ghi", map[string]interface{}{"email": "gopher@tsuru.io"}, "")
+	params := loginParams("abc")
+	params["nonce"] = "other"
+	_, err := oidcScheme.Login(params)
+	c.Assert(err, check.FitsTypeOf, auth.AuthenticationFailure{})
+	c.Assert(err, check.ErrorMatches, "Authentication failed, invalid ID token: the nonce doesn't match the login request.")
+	_, err = auth.GetUserByEmail("gopher@tsuru.io")
+	c.Assert(err, check.Equals, auth.ErrUserNotFound)
+	params = loginParams("ghi")
+	params["nonce"] = "n0nc3"
+	_, err = oidcScheme.Login(params)
+	c.Assert(err, check.FitsTypeOf, auth.AuthenticationFailure{})
+	params = loginParams("def")
+	params["nonce"] = "n0nc3"
+	token, err := oidcScheme.Login(params)
+	c.Assert(err, check.IsNil)
+	c.Assert(token.GetUserName(), check.Equals, "gopher@tsuru.io")
+}
+
+func (s *S) TestLoginWithClientSecret(c *check.C) {
+	config.Set("auth:oidc:client-secret", "s3cr3t")
+	defer config.Unset("auth:oidc:client-secret")
+	s.issuer.AddCode("abc", map[string]interface{}{"email": "gopher@tsuru.io"}, "")
+	_, err := oidcScheme.Login(loginParams("abc"))
+	c.Assert(err, check.IsNil)
+	s.issuer.RLock()
+	defer s.issuer.RUnlock()
+	c.Assert(s.issuer.Exchanges, check.HasLen, 1)
+	c.Assert(s.issuer.Exchanges[0].Get("client_id"), check.Equals, "tsuru")
+}
+
+func (s *S) TestLoginMissingParams(c *check.C) {
+	_, err := oidcScheme.Login(map[string]string{"redirectUrl": "http://localhost"})
+	c.Assert(err, check.Equals, ErrMissingCodeError)
+	_, err = oidcScheme.Login(map[string]string{"code": "abc"})
+	c.Assert(err, check.Equals, ErrMissingCodeRedirectUrl)
+}
+
+func (s *S) TestLoginInvalidCode(c *check.C) {
+	_, err := oidcScheme.Login(loginParams("unknown"))
+	c.Assert(err, check.FitsTypeOf, auth.AuthenticationFailure{})
+	_, err = auth.GetUserByEmail("gopher@tsuru.io")
+	c.Assert(err, check.Equals, auth.ErrUserNotFound)
+}
+
+func (s *S) TestLoginInvalidIDToken(c *check.C) {
+	s.issuer.AddCode("abc", map[string]interface{}{"email": "gopher@tsuru.io", "aud": "other"}, "")
+	_, err := oidcScheme.Login(loginParams("abc"))
+	c.Assert(err, check.FitsTypeOf, auth.AuthenticationFailure{})
+	c.Assert(err, check.ErrorMatches, "Authentication failed, invalid ID token: the token was not issued to this client.")
+}
+
+func (s *S) TestLoginEmailNotVerified(c *check.C) {
+	s.issuer.AddCode("abc", map[string]interface{}{"email": "gopher@tsuru.io", "email_verified": false}, "")
+	_, err := oidcScheme.Login(loginParams("abc"))
+	c.Assert(err, check.Equals, ErrEmailNotVerified)
+}
+
+func (s *S) TestLoginMissingEmail(c *check.C) {
+	s.issuer.AddCode("abc", map[string]interface{}{"sub": "123"}, "")
+	_, err := oidcScheme.Login(loginParams("abc"))
+	c.Assert(err, check.Equals, ErrEmptyUserEmail)
+}
+
+func (s *S) TestLoginCustomEmailClaim(c *check.C) {
+	config.Set("auth:oidc:email-claim", "preferred_username")
+	defer config.Unset("auth:oidc:email-claim")
+	s.issuer.AddCode("abc", map[string]interface{}{"email": "other@tsuru.io", "preferred_username": "gopher@tsuru.io"}, "")
+	token, err := oidcScheme.Login(loginParams("abc"))
+	c.Assert(err, check.IsNil)
+	c.Assert(token.GetUserName(), check.Equals, "gopher@tsuru.io")
+}
+
+func (s *S) TestLoginRegistrationDisabled(c *check.C) {
+	config.Set("auth:user-registration", false)
+	defer config.Set("auth:user-registration", true)
+	s.issuer.AddCode("abc", map[string]interface{}{"email": "gopher@tsuru.io"}, "")
+	s.issuer.AddCode("def", map[string]interface{}{"email": "gopher@tsuru.io"}, "")
+	_, err := oidcScheme.Login(loginParams("abc"))
+	c.Assert(err, check.Equals, auth.ErrUserNotFound)
+	user := auth.User{Email: "gopher@tsuru.io"}
+	err = user.Create()
+	c.Assert(err, check.IsNil)
+	_, err = oidcScheme.Login(loginParams("def"))
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestLoginSyncsTeams(c *check.C) {
+	user := auth.User{Email: "gopher@tsuru.io"}
+	err := user.Create()
+	c.Assert(err, check.IsNil)
+	opsteam := auth.Team{Name: "opsteam", Users: []string{user.Email}}
+	err = s.conn.Teams().Insert(opsteam)
+	c.Assert(err, check.IsNil)
+	unmanaged := auth.Team{Name: "unmanaged", Users: []string{user.Email}}
+	err = s.conn.Teams().Insert(unmanaged)
+	c.Assert(err, check.IsNil)
+	s.issuer.AddCode("abc", map[string]interface{}{
+		"email":  "gopher@tsuru.io",
+		"groups": []string{"developers", "unknown"},
+	}, "")
+	_, err = oidcScheme.Login(loginParams("abc"))
+	c.Assert(err, check.IsNil)
+	teams, err := user.Teams()
+	c.Assert(err, check.IsNil)
+	names := auth.GetTeamsNames(teams)
+	sort.Strings(names)
+	c.Assert(names, check.DeepEquals, []string{"devteam", "unmanaged"})
+}
+
+func (s *S) TestLoginSyncsTeamsFromStringClaim(c *check.C) {
+	config.Set("auth:oidc:groups-claim", "role")
+	defer config.Unset("auth:oidc:groups-claim")
+	s.issuer.AddCode("abc", map[string]interface{}{"email": "gopher@tsuru.io", "role": "operations"}, "")
+	_, err := oidcScheme.Login(loginParams("abc"))
+	c.Assert(err, check.IsNil)
+	team, err := auth.GetTeam("opsteam")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.Users, check.DeepEquals, []string{"gopher@tsuru.io"})
+}
+
+func (s *S) TestLoginWithoutGroupsMappingDoesNotSyncTeams(c *check.C) {
+	groups, _ := config.Get("auth:oidc:groups")
+	config.Unset("auth:oidc:groups")
+	defer config.Set("auth:oidc:groups", groups)
+	s.issuer.AddCode("abc", map[string]interface{}{"email": "gopher@tsuru.io", "groups": []string{"developers"}}, "")
+	_, err := oidcScheme.Login(loginParams("abc"))
+	c.Assert(err, check.IsNil)
+	_, err = auth.GetTeam("devteam")
+	c.Assert(err, check.Equals, auth.ErrTeamNotFound)
+}
+
+func (s *S) TestClaimValues(c *check.C) {
+	c.Assert(claimValues("a"), check.DeepEquals, []string{"a"})
+	c.Assert(claimValues([]interface{}{"a", 1, "b"}), check.DeepEquals, []string{"a", "b"})
+	c.Assert(claimValues(nil), check.IsNil)
+}
+
+func (s *S) TestInfo(c *check.C) {
+	config.Set("auth:oidc:callback-port", 7777)
+	defer config.Unset("auth:oidc:callback-port")
+	info, err := oidcScheme.Info()
+	c.Assert(err, check.IsNil)
+	c.Assert(info["port"], check.Equals, "7777")
+	c.Assert(info["pkce"], check.Equals, "S256")
+	authorizeUrl, err := url.Parse(info["authorizeUrl"].(string))
+	c.Assert(err, check.IsNil)
+	c.Assert(authorizeUrl.Path, check.Equals, "/authorize")
+	query := authorizeUrl.Query()
+	c.Assert(query.Get("response_type"), check.Equals, "code")
+	c.Assert(query.Get("client_id"), check.Equals, "tsuru")
+	c.Assert(query.Get("scope"), check.Equals, "openid email profile")
+	c.Assert(query.Get("redirect_uri"), check.Equals, "__redirect_url__")
+}
+
+func (s *S) TestInfoDiscoveryFailure(c *check.C) {
+	config.Set("auth:oidc:issuer", "http://127.0.0.1:1")
+	defer config.Set("auth:oidc:issuer", s.issuer.URL())
+	_, err := oidcScheme.Info()
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestLogout(c *check.C) {
+	s.issuer.AddCode("abc", map[string]interface{}{"email": "gopher@tsuru.io"}, "")
+	token, err := oidcScheme.Login(loginParams("abc"))
+	c.Assert(err, check.IsNil)
+	err = oidcScheme.Logout(token.GetValue())
+	c.Assert(err, check.IsNil)
+	_, err = oidcScheme.Auth("bearer " + token.GetValue())
+	c.Assert(err, check.Equals, auth.ErrInvalidToken)
+}
+
+func (s *S) TestAppLogin(c *check.C) {
+	token, err := oidcScheme.AppLogin("myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(token.IsAppToken(), check.Equals, true)
+	c.Assert(token.GetAppName(), check.Equals, "myapp")
+}
+
+func (s *S) TestCreateAndRemove(c *check.C) {
+	user, err := oidcScheme.Create(&auth.User{Email: "gopher@tsuru.io", Password: "123456"})
+	c.Assert(err, check.IsNil)
+	c.Assert(user.Password, check.Equals, "")
+	err = oidcScheme.Remove(user)
+	c.Assert(err, check.IsNil)
+	_, err = auth.GetUserByEmail("gopher@tsuru.io")
+	c.Assert(err, check.Equals, auth.ErrUserNotFound)
+}
@@ -0,0 +1,237 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package oidctest provides a fake OpenID Connect provider, to be used in
+// tests.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyID is the key ID of the key used to sign the tokens, until the key is
+// rotated.
+const KeyID = "test-key"
+
+type authorization struct {
+	claims    map[string]interface{}
+	challenge string
+}
+
+// Issuer is a fake OpenID Connect provider.
+//
+// It supports discovery, publishes its signing key and exchanges the codes
+// registered with AddCode for ID tokens signed with RS256. Codes can be used
+// only once, and codes registered with a PKCE challenge are exchanged only if
+// the request carries the matching S256 verifier.
+//
+// Use NewIssuer to create a new instance and start serving; URL will get you
+// the issuer identifier and Close will stop the server. Every request that
+// arrives at the token endpoint is stored in the Exchanges slice.
+type Issuer struct {
+	// Exchanges stores the forms of all requests that arrived at the token
+	// endpoint. Use the mutex to access it.
+	Exchanges []url.Values
+	// DiscoveryRequests and KeysRequests count the requests to the discovery
+	// and the keys endpoints. Use the mutex to access them.
+	DiscoveryRequests int
+	KeysRequests      int
+	sync.RWMutex
+	clientID string
+	key      *rsa.PrivateKey
+	keyID    string
+	rotated  int
+	codes    map[string]authorization
+	server   *httptest.Server
+}
+
+// NewIssuer creates a new provider that issues tokens to the given client.
+func NewIssuer(clientID string) (*Issuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	i := Issuer{clientID: clientID, key: key, keyID: KeyID, codes: make(map[string]authorization)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", i.discovery)
+	mux.HandleFunc("/keys", i.keys)
+	mux.HandleFunc("/token", i.token)
+	i.server = httptest.NewServer(mux)
+	return &i, nil
+}
+
+// URL returns the issuer identifier, which is also the base URL of the
+// server.
+func (i *Issuer) URL() string {
+	return i.server.URL
+}
+
+// Close stops the server.
+func (i *Issuer) Close() {
+	i.server.Close()
+}
+
+// Reset removes all registered codes and recorded exchanges, and zeroes the
+// request counters.
+func (i *Issuer) Reset() {
+	i.Lock()
+	defer i.Unlock()
+	i.codes = make(map[string]authorization)
+	i.Exchanges = nil
+	i.DiscoveryRequests = 0
+	i.KeysRequests = 0
+}
+
+// RotateKey replaces the signing key with a new one, with a new key ID, and
+// returns the new key ID. Tokens signed with the old key won't validate
+// anymore.
+func (i *Issuer) RotateKey() (string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", err
+	}
+	i.Lock()
+	defer i.Unlock()
+	i.rotated++
+	i.key = key
+	i.keyID = fmt.Sprintf("%s-%d", KeyID, i.rotated)
+	return i.keyID, nil
+}
+
+// AddCode registers an authorization code. The ID token issued for the code
+// has the given claims, in addition to valid iss, aud, iat and exp claims,
+// which may be overridden. When challenge is not empty, the client must send
+// the PKCE verifier for it.
+func (i *Issuer) AddCode(code string, claims map[string]interface{}, challenge string) {
+	now := time.Now()
+	all := map[string]interface{}{
+		"iss": i.URL(),
+		"aud": i.clientID,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+	i.Lock()
+	defer i.Unlock()
+	i.codes[code] = authorization{claims: all, challenge: challenge}
+}
+
+// SignToken returns a token with exactly the given claims, signed with the
+// key of the issuer.
+func (i *Issuer) SignToken(claims map[string]interface{}) string {
+	i.RLock()
+	key, keyID := i.key, i.keyID
+	i.RUnlock()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	payload, _ := json.Marshal(claims)
+	signed := encode(header) + "." + encode(payload)
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + encode(signature)
+}
+
+// CodeChallenge returns the S256 PKCE challenge for the given verifier.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return encode(sum[:])
+}
+
+func encode(data []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	i.Lock()
+	i.DiscoveryRequests++
+	i.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                i.URL(),
+		"authorization_endpoint":                i.URL() + "/authorize",
+		"token_endpoint":                        i.URL() + "/token",
+		"jwks_uri":                              i.URL() + "/keys",
+		"response_types_supported":              []string{"code"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (i *Issuer) keys(w http.ResponseWriter, r *http.Request) {
+	i.Lock()
+	i.KeysRequests++
+	key, keyID := i.key, i.keyID
+	i.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": keyID,
+			"n":   encode(key.N.Bytes()),
+			"e":   encode(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
+
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+	i.Lock()
+	i.Exchanges = append(i.Exchanges, r.PostForm)
+	auth, ok := i.codes[r.PostForm.Get("code")]
+	delete(i.codes, r.PostForm.Get("code"))
+	i.Unlock()
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		writeError(w, "unsupported_grant_type", "")
+		return
+	}
+	if !ok {
+		writeError(w, "invalid_grant", "unknown code")
+		return
+	}
+	if auth.challenge != "" && CodeChallenge(r.PostForm.Get("code_verifier")) != auth.challenge {
+		writeError(w, "invalid_grant", "PKCE verification failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "access-" + r.PostForm.Get("code"),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     i.SignToken(auth.claims),
+	})
+}
+
+func writeError(w http.ResponseWriter, code, description string) {
+	body := map[string]string{"error": code}
+	if description != "" {
+		body["error_description"] = description
+	}
+	writeJSON(w, http.StatusBadRequest, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
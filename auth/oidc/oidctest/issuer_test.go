@@ -0,0 +1,154 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package oidctest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	issuer *Issuer
+}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	var err error
+	s.issuer, err = NewIssuer("tsuru")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	s.issuer.Reset()
+}
+
+func (s *S) TearDownSuite(c *check.C) {
+	s.issuer.Close()
+}
+
+func decodeSegment(c *check.C, seg string, v interface{}) {
+	if l := len(seg) % 4; l > 0 {
+		seg += strings.Repeat("=", 4-l)
+	}
+	data, err := base64.URLEncoding.DecodeString(seg)
+	c.Assert(err, check.IsNil)
+	c.Assert(json.Unmarshal(data, v), check.IsNil)
+}
+
+func (s *S) exchange(c *check.C, form url.Values) (int, map[string]interface{}) {
+	resp, err := http.PostForm(s.issuer.URL()+"/token", form)
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	var body map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	c.Assert(err, check.IsNil)
+	return resp.StatusCode, body
+}
+
+func (s *S) TestDiscovery(c *check.C) {
+	resp, err := http.Get(s.issuer.URL() + "/.well-known/openid-configuration")
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	var metadata map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&metadata)
+	c.Assert(err, check.IsNil)
+	c.Assert(metadata["issuer"], check.Equals, s.issuer.URL())
+	c.Assert(metadata["token_endpoint"], check.Equals, s.issuer.URL()+"/token")
+	c.Assert(metadata["jwks_uri"], check.Equals, s.issuer.URL()+"/keys")
+}
+
+func (s *S) TestKeys(c *check.C) {
+	resp, err := http.Get(s.issuer.URL() + "/keys")
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	var set struct {
+		Keys []map[string]string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	c.Assert(err, check.IsNil)
+	c.Assert(set.Keys, check.HasLen, 1)
+	c.Assert(set.Keys[0]["kid"], check.Equals, KeyID)
+	c.Assert(set.Keys[0]["kty"], check.Equals, "RSA")
+	c.Assert(set.Keys[0]["e"], check.Equals, "AQAB")
+}
+
+func (s *S) TestRotateKey(c *check.C) {
+	issuer, err := NewIssuer("tsuru")
+	c.Assert(err, check.IsNil)
+	defer issuer.Close()
+	kid, err := issuer.RotateKey()
+	c.Assert(err, check.IsNil)
+	c.Assert(kid, check.Equals, KeyID+"-1")
+	resp, err := http.Get(issuer.URL() + "/keys")
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	var set struct {
+		Keys []map[string]string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	c.Assert(err, check.IsNil)
+	c.Assert(set.Keys, check.HasLen, 1)
+	c.Assert(set.Keys[0]["kid"], check.Equals, kid)
+	var header map[string]interface{}
+	decodeSegment(c, strings.Split(issuer.SignToken(nil), ".")[0], &header)
+	c.Assert(header["kid"], check.Equals, kid)
+	issuer.RLock()
+	defer issuer.RUnlock()
+	c.Assert(issuer.KeysRequests, check.Equals, 1)
+	c.Assert(issuer.DiscoveryRequests, check.Equals, 0)
+}
+
+func (s *S) TestExchange(c *check.C) {
+	s.issuer.AddCode("abc", map[string]interface{}{"email": "gopher@tsuru.io"}, "")
+	status, body := s.exchange(c, url.Values{"grant_type": {"authorization_code"}, "code": {"abc"}})
+	c.Assert(status, check.Equals, http.StatusOK)
+	parts := strings.Split(body["id_token"].(string), ".")
+	c.Assert(parts, check.HasLen, 3)
+	var header, claims map[string]interface{}
+	decodeSegment(c, parts[0], &header)
+	c.Assert(header["alg"], check.Equals, "RS256")
+	c.Assert(header["kid"], check.Equals, KeyID)
+	decodeSegment(c, parts[1], &claims)
+	c.Assert(claims["email"], check.Equals, "gopher@tsuru.io")
+	c.Assert(claims["iss"], check.Equals, s.issuer.URL())
+	c.Assert(claims["aud"], check.Equals, "tsuru")
+	status, body = s.exchange(c, url.Values{"grant_type": {"authorization_code"}, "code": {"abc"}})
+	c.Assert(status, check.Equals, http.StatusBadRequest)
+	c.Assert(body["error"], check.Equals, "invalid_grant")
+	s.issuer.RLock()
+	defer s.issuer.RUnlock()
+	c.Assert(s.issuer.Exchanges, check.HasLen, 2)
+	c.Assert(s.issuer.Exchanges[0].Get("code"), check.Equals, "abc")
+}
+
+func (s *S) TestExchangeWithPKCE(c *check.C) {
+	// example from RFC 7636, appendix B.
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	c.Assert(CodeChallenge(verifier), check.Equals, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM")
+	s.issuer.AddCode("abc", nil, CodeChallenge(verifier))
+	s.issuer.AddCode("def", nil, CodeChallenge(verifier))
+	status, body := s.exchange(c, url.Values{"grant_type": {"authorization_code"}, "code": {"abc"}, "code_verifier": {"wrong"}})
+	c.Assert(status, check.Equals, http.StatusBadRequest)
+	c.Assert(body["error"], check.Equals, "invalid_grant")
+	status, body = s.exchange(c, url.Values{"grant_type": {"authorization_code"}, "code": {"def"}, "code_verifier": {verifier}})
+	c.Assert(status, check.Equals, http.StatusOK)
+	c.Assert(body["id_token"], check.Not(check.Equals), "")
+}
+
+func (s *S) TestExchangeUnsupportedGrant(c *check.C) {
+	s.issuer.AddCode("abc", nil, "")
+	status, body := s.exchange(c, url.Values{"grant_type": {"password"}, "code": {"abc"}})
+	c.Assert(status, check.Equals, http.StatusBadRequest)
+	c.Assert(body["error"], check.Equals, "unsupported_grant_type")
+}
@@ -0,0 +1,348 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package oidc
+
+import (
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const discoveryPath = "/.well-known/openid-configuration"
+
+// leeway is the clock skew tolerated when checking the times in ID tokens.
+const leeway = time.Minute
+
+var algorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+}
+
+// authError is returned when the provider refuses the authorization code, or
+// when the ID token is not valid.
+type authError struct {
+	message string
+}
+
+func (e *authError) Error() string {
+	return e.message
+}
+
+func invalidToken(format string, args ...interface{}) error {
+	return &authError{message: "invalid ID token: " + fmt.Sprintf(format, args...)}
+}
+
+// provider holds the metadata of an OpenID Connect provider, as returned by
+// the discovery endpoint.
+type provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	client                *http.Client
+	keySet                *keyCache
+	cacheTTL              time.Duration
+}
+
+// keyCache holds the signing keys of a provider, shared by all copies of the
+// cached provider.
+type keyCache struct {
+	sync.Mutex
+	keys     map[string]*rsa.PublicKey
+	expireAt time.Time
+}
+
+type cachedProvider struct {
+	provider *provider
+	expireAt time.Time
+}
+
+var providers = struct {
+	sync.Mutex
+	entries map[string]cachedProvider
+}{entries: make(map[string]cachedProvider)}
+
+// cachedDiscover works like discover, but keeps the metadata and the keys of
+// the provider for the given ttl, so they're not fetched in every login.
+func cachedDiscover(client *http.Client, issuer string, ttl time.Duration) (*provider, error) {
+	providers.Lock()
+	defer providers.Unlock()
+	entry, ok := providers.entries[issuer]
+	if !ok || time.Now().After(entry.expireAt) {
+		p, err := discover(client, issuer)
+		if err != nil {
+			return nil, err
+		}
+		p.keySet = &keyCache{}
+		entry = cachedProvider{provider: p, expireAt: time.Now().Add(ttl)}
+		providers.entries[issuer] = entry
+	}
+	p := *entry.provider
+	p.client = client
+	p.cacheTTL = ttl
+	return &p, nil
+}
+
+func discover(client *http.Client, issuer string) (*provider, error) {
+	var p provider
+	err := getJSON(client, strings.TrimSuffix(issuer, "/")+discoveryPath, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Issuer != issuer {
+		return nil, fmt.Errorf("oidc: the provider returned the issuer %q, expected %q", p.Issuer, issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc: incomplete provider metadata from %s", issuer)
+	}
+	p.client = client
+	return &p, nil
+}
+
+func getJSON(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: unexpected status %d from %s", resp.StatusCode, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// authorizeURL returns the URL of the authorization endpoint with the given
+// parameters.
+func (p *provider) authorizeURL(params url.Values) string {
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.AuthorizationEndpoint + sep + params.Encode()
+}
+
+// exchange sends the authorization code to the token endpoint, returning the
+// ID token. The verifier is the PKCE code verifier, if the client used one.
+func (p *provider) exchange(clientID, clientSecret, code, redirectURL, verifier string) (string, error) {
+	params := url.Values{}
+	params.Set("grant_type", "authorization_code")
+	params.Set("code", code)
+	params.Set("redirect_uri", redirectURL)
+	params.Set("client_id", clientID)
+	if verifier != "" {
+		params.Set("code_verifier", verifier)
+	}
+	req, err := http.NewRequest("POST", p.TokenEndpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if result.Error != "" {
+		msg := "the provider refused the authorization code: " + result.Error
+		if result.ErrorDescription != "" {
+			msg += " (" + result.ErrorDescription + ")"
+		}
+		return "", &authError{message: msg}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc: unexpected status %d from the token endpoint", resp.StatusCode)
+	}
+	if err != nil {
+		return "", err
+	}
+	if result.IDToken == "" {
+		return "", &authError{message: "the provider didn't return an ID token"}
+	}
+	return result.IDToken, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// keys fetches the signing keys of the provider. Only RSA keys are supported.
+func (p *provider) keys() (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := getJSON(p.client, p.JWKSURI, &set)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := decodeSegment(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeSegment(k.E)
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// signingKey returns the key with the given ID. Cached keys are used while
+// they don't expire, and they're fetched again when the key isn't among them,
+// so keys rotated by the provider are found.
+func (p *provider) signingKey(kid string) (*rsa.PublicKey, error) {
+	ks := p.keySet
+	if ks == nil {
+		ks = &keyCache{}
+	}
+	ks.Lock()
+	defer ks.Unlock()
+	if ks.keys != nil && time.Now().Before(ks.expireAt) {
+		if key, ok := findKey(ks.keys, kid); ok {
+			return key, nil
+		}
+	}
+	keys, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	ks.keys = keys
+	ks.expireAt = time.Now().Add(p.cacheTTL)
+	key, ok := findKey(keys, kid)
+	if !ok {
+		return nil, invalidToken("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// findKey looks for the key with the given ID. Tokens without a key ID are
+// accepted only when the provider has a single key.
+func findKey(keys map[string]*rsa.PublicKey, kid string) (*rsa.PublicKey, bool) {
+	key, ok := keys[kid]
+	if !ok && kid == "" && len(keys) == 1 {
+		for _, k := range keys {
+			key, ok = k, true
+		}
+	}
+	return key, ok
+}
+
+// verify checks the signature of the ID token against the keys of the
+// provider, and validates its issuer, audience and expiration, returning the
+// claims of the token.
+func (p *provider) verify(rawToken, clientID string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, invalidToken("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJSONSegment(parts[0], &header); err != nil {
+		return nil, invalidToken("malformed header")
+	}
+	hash, ok := algorithms[header.Alg]
+	if !ok {
+		return nil, invalidToken("unsupported algorithm %q", header.Alg)
+	}
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, invalidToken("malformed signature")
+	}
+	key, err := p.signingKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), signature); err != nil {
+		return nil, invalidToken("bad signature")
+	}
+	var claims map[string]interface{}
+	if err = decodeJSONSegment(parts[1], &claims); err != nil {
+		return nil, invalidToken("malformed claims")
+	}
+	if iss, _ := claims["iss"].(string); iss != p.Issuer {
+		return nil, invalidToken("unexpected issuer %q", iss)
+	}
+	if !containsAudience(claims["aud"], clientID) {
+		return nil, invalidToken("the token was not issued to this client")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, invalidToken("missing expiration")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return nil, invalidToken("the token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, invalidToken("the token is not valid yet")
+	}
+	return claims, nil
+}
+
+func containsAudience(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decodeSegment decodes base64url encoded data, with or without padding.
+func decodeSegment(seg string) ([]byte, error) {
+	if l := len(seg) % 4; l > 0 {
+		seg += strings.Repeat("=", 4-l)
+	}
+	return base64.URLEncoding.DecodeString(seg)
+}
+
+func decodeJSONSegment(seg string, v interface{}) error {
+	data, err := decodeSegment(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
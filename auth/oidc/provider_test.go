@@ -0,0 +1,253 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package oidc
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tsuru/tsuru/auth/oidc/oidctest"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) provider(c *check.C) *provider {
+	p, err := discover(http.DefaultClient, s.issuer.URL())
+	c.Assert(err, check.IsNil)
+	return p
+}
+
+func (s *S) claims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   s.issuer.URL(),
+		"aud":   "tsuru",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"email": "gopher@tsuru.io",
+	}
+}
+
+func (s *S) TestDiscover(c *check.C) {
+	p := s.provider(c)
+	c.Assert(p.Issuer, check.Equals, s.issuer.URL())
+	c.Assert(p.AuthorizationEndpoint, check.Equals, s.issuer.URL()+"/authorize")
+	c.Assert(p.TokenEndpoint, check.Equals, s.issuer.URL()+"/token")
+	c.Assert(p.JWKSURI, check.Equals, s.issuer.URL()+"/keys")
+}
+
+func (s *S) TestDiscoverIssuerMismatch(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"issuer":"https://evil.example.com","authorization_endpoint":"a","token_endpoint":"t","jwks_uri":"k"}`))
+	}))
+	defer server.Close()
+	_, err := discover(http.DefaultClient, server.URL)
+	c.Assert(err, check.ErrorMatches, `oidc: the provider returned the issuer "https://evil.example.com", expected ".*"`)
+}
+
+func (s *S) TestDiscoverIncompleteMetadata(c *check.C) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"issuer":"` + server.URL + `","authorization_endpoint":"a"}`))
+	}))
+	defer server.Close()
+	_, err := discover(http.DefaultClient, server.URL)
+	c.Assert(err, check.ErrorMatches, "oidc: incomplete provider metadata from .*")
+}
+
+func (s *S) resetProviders() {
+	providers.Lock()
+	defer providers.Unlock()
+	providers.entries = make(map[string]cachedProvider)
+}
+
+func (s *S) TestCachedDiscover(c *check.C) {
+	s.resetProviders()
+	defer s.resetProviders()
+	p, err := cachedDiscover(http.DefaultClient, s.issuer.URL(), time.Hour)
+	c.Assert(err, check.IsNil)
+	c.Assert(p.TokenEndpoint, check.Equals, s.issuer.URL()+"/token")
+	other, err := cachedDiscover(http.DefaultClient, s.issuer.URL(), time.Hour)
+	c.Assert(err, check.IsNil)
+	c.Assert(other.TokenEndpoint, check.Equals, s.issuer.URL()+"/token")
+	c.Assert(other.keySet, check.Equals, p.keySet)
+	s.issuer.RLock()
+	c.Assert(s.issuer.DiscoveryRequests, check.Equals, 1)
+	s.issuer.RUnlock()
+	_, err = cachedDiscover(http.DefaultClient, s.issuer.URL(), 0)
+	c.Assert(err, check.IsNil)
+	_, err = cachedDiscover(http.DefaultClient, s.issuer.URL(), 0)
+	c.Assert(err, check.IsNil)
+	s.issuer.RLock()
+	c.Assert(s.issuer.DiscoveryRequests, check.Equals, 3)
+	s.issuer.RUnlock()
+}
+
+func (s *S) TestCachedDiscoverFailure(c *check.C) {
+	s.resetProviders()
+	defer s.resetProviders()
+	_, err := cachedDiscover(http.DefaultClient, "http://127.0.0.1:1", time.Hour)
+	c.Assert(err, check.NotNil)
+	providers.Lock()
+	c.Assert(providers.entries, check.HasLen, 0)
+	providers.Unlock()
+}
+
+func (s *S) TestVerifyCachesKeys(c *check.C) {
+	s.resetProviders()
+	defer s.resetProviders()
+	p, err := cachedDiscover(http.DefaultClient, s.issuer.URL(), time.Hour)
+	c.Assert(err, check.IsNil)
+	for i := 0; i < 2; i++ {
+		_, err = p.verify(s.issuer.SignToken(s.claims()), "tsuru", time.Now())
+		c.Assert(err, check.IsNil)
+	}
+	s.issuer.RLock()
+	c.Assert(s.issuer.KeysRequests, check.Equals, 1)
+	s.issuer.RUnlock()
+	_, err = s.issuer.RotateKey()
+	c.Assert(err, check.IsNil)
+	p, err = cachedDiscover(http.DefaultClient, s.issuer.URL(), time.Hour)
+	c.Assert(err, check.IsNil)
+	_, err = p.verify(s.issuer.SignToken(s.claims()), "tsuru", time.Now())
+	c.Assert(err, check.IsNil)
+	_, err = p.verify(s.issuer.SignToken(s.claims()), "tsuru", time.Now())
+	c.Assert(err, check.IsNil)
+	s.issuer.RLock()
+	c.Assert(s.issuer.KeysRequests, check.Equals, 2)
+	c.Assert(s.issuer.DiscoveryRequests, check.Equals, 1)
+	s.issuer.RUnlock()
+}
+
+func (s *S) TestVerifyRefetchesExpiredKeys(c *check.C) {
+	s.resetProviders()
+	defer s.resetProviders()
+	p, err := cachedDiscover(http.DefaultClient, s.issuer.URL(), 0)
+	c.Assert(err, check.IsNil)
+	for i := 0; i < 2; i++ {
+		_, err = p.verify(s.issuer.SignToken(s.claims()), "tsuru", time.Now())
+		c.Assert(err, check.IsNil)
+	}
+	s.issuer.RLock()
+	defer s.issuer.RUnlock()
+	c.Assert(s.issuer.KeysRequests, check.Equals, 2)
+}
+
+func (s *S) TestAuthorizeURL(c *check.C) {
+	p := &provider{AuthorizationEndpoint: "https://idp.example.com/auth"}
+	c.Assert(p.authorizeURL(url.Values{"a": {"b"}}), check.Equals, "https://idp.example.com/auth?a=b")
+	p.AuthorizationEndpoint = "https://idp.example.com/auth?tenant=x"
+	c.Assert(p.authorizeURL(url.Values{"a": {"b"}}), check.Equals, "https://idp.example.com/auth?tenant=x&a=b")
+}
+
+func (s *S) TestExchange(c *check.C) {
+	s.issuer.AddCode("abc", map[string]interface{}{"email": "gopher@tsuru.io"}, oidctest.CodeChallenge("verifier"))
+	p := s.provider(c)
+	idToken, err := p.exchange("tsuru", "", "abc", "http://localhost:1234", "verifier")
+	c.Assert(err, check.IsNil)
+	claims, err := p.verify(idToken, "tsuru", time.Now())
+	c.Assert(err, check.IsNil)
+	c.Assert(claims["email"], check.Equals, "gopher@tsuru.io")
+	s.issuer.RLock()
+	defer s.issuer.RUnlock()
+	c.Assert(s.issuer.Exchanges, check.HasLen, 1)
+	c.Assert(s.issuer.Exchanges[0].Get("redirect_uri"), check.Equals, "http://localhost:1234")
+	c.Assert(s.issuer.Exchanges[0].Get("client_id"), check.Equals, "tsuru")
+	c.Assert(s.issuer.Exchanges[0].Get("code_verifier"), check.Equals, "verifier")
+}
+
+func (s *S) TestExchangeRefused(c *check.C) {
+	s.issuer.AddCode("abc", nil, oidctest.CodeChallenge("verifier"))
+	p := s.provider(c)
+	_, err := p.exchange("tsuru", "", "abc", "http://localhost:1234", "wrong")
+	c.Assert(err, check.FitsTypeOf, &authError{})
+	c.Assert(err, check.ErrorMatches, `the provider refused the authorization code: invalid_grant \(PKCE verification failed\)`)
+}
+
+func (s *S) TestVerify(c *check.C) {
+	p := s.provider(c)
+	claims, err := p.verify(s.issuer.SignToken(s.claims()), "tsuru", time.Now())
+	c.Assert(err, check.IsNil)
+	c.Assert(claims["email"], check.Equals, "gopher@tsuru.io")
+	withList := s.claims()
+	withList["aud"] = []string{"other", "tsuru"}
+	_, err = p.verify(s.issuer.SignToken(withList), "tsuru", time.Now())
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestVerifyInvalidClaims(c *check.C) {
+	p := s.provider(c)
+	now := time.Now()
+	var tests = []struct {
+		claim string
+		value interface{}
+		err   string
+	}{
+		{"iss", "https://evil.example.com", `invalid ID token: unexpected issuer "https://evil.example.com"`},
+		{"aud", "other", "invalid ID token: the token was not issued to this client"},
+		{"aud", []string{"other"}, "invalid ID token: the token was not issued to this client"},
+		{"exp", now.Add(-2 * time.Minute).Unix(), "invalid ID token: the token is expired"},
+		{"exp", nil, "invalid ID token: missing expiration"},
+		{"nbf", now.Add(2 * time.Minute).Unix(), "invalid ID token: the token is not valid yet"},
+	}
+	for _, t := range tests {
+		claims := s.claims()
+		if t.value == nil {
+			delete(claims, t.claim)
+		} else {
+			claims[t.claim] = t.value
+		}
+		_, err := p.verify(s.issuer.SignToken(claims), "tsuru", now)
+		c.Check(err, check.FitsTypeOf, &authError{})
+		c.Check(err, check.ErrorMatches, t.err)
+	}
+}
+
+func (s *S) TestVerifyToleratesClockSkew(c *check.C) {
+	p := s.provider(c)
+	claims := s.claims()
+	claims["exp"] = time.Now().Add(-30 * time.Second).Unix()
+	_, err := p.verify(s.issuer.SignToken(claims), "tsuru", time.Now())
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestVerifyBadSignature(c *check.C) {
+	p := s.provider(c)
+	parts := strings.Split(s.issuer.SignToken(s.claims()), ".")
+	tampered := s.claims()
+	tampered["email"] = "admin@tsuru.io"
+	forged := strings.Split(s.issuer.SignToken(tampered), ".")
+	token := parts[0] + "." + forged[1] + "." + parts[2]
+	_, err := p.verify(token, "tsuru", time.Now())
+	c.Assert(err, check.ErrorMatches, "invalid ID token: bad signature")
+}
+
+func (s *S) TestVerifyUnsupportedAlgorithm(c *check.C) {
+	p := s.provider(c)
+	parts := strings.Split(s.issuer.SignToken(s.claims()), ".")
+	header := strings.TrimRight(base64.URLEncoding.EncodeToString([]byte(`{"alg":"none"}`)), "=")
+	_, err := p.verify(header+"."+parts[1]+".", "tsuru", time.Now())
+	c.Assert(err, check.ErrorMatches, `invalid ID token: unsupported algorithm "none"`)
+	header = strings.TrimRight(base64.URLEncoding.EncodeToString([]byte(`{"alg":"HS256"}`)), "=")
+	_, err = p.verify(header+"."+parts[1]+"."+parts[2], "tsuru", time.Now())
+	c.Assert(err, check.ErrorMatches, `invalid ID token: unsupported algorithm "HS256"`)
+}
+
+func (s *S) TestVerifyUnknownKey(c *check.C) {
+	p := s.provider(c)
+	parts := strings.Split(s.issuer.SignToken(s.claims()), ".")
+	header := strings.TrimRight(base64.URLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"other"}`)), "=")
+	_, err := p.verify(header+"."+parts[1]+"."+parts[2], "tsuru", time.Now())
+	c.Assert(err, check.ErrorMatches, `invalid ID token: unknown signing key "other"`)
+}
+
+func (s *S) TestVerifyMalformedToken(c *check.C) {
+	p := s.provider(c)
+	_, err := p.verify("not-a-token", "tsuru", time.Now())
+	c.Assert(err, check.ErrorMatches, "invalid ID token: malformed token")
+	_, err = p.verify("!!.e30.", "tsuru", time.Now())
+	c.Assert(err, check.ErrorMatches, "invalid ID token: malformed header")
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package oidc
+
+import (
+	"testing"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/auth/oidc/oidctest"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/db/dbtest"
+	"github.com/tsuru/tsuru/repository/repositorytest"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	conn   *db.Storage
+	issuer *oidctest.Issuer
+}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	var err error
+	s.issuer, err = oidctest.NewIssuer("tsuru")
+	c.Assert(err, check.IsNil)
+	config.Set("auth:oidc:issuer", s.issuer.URL())
+	config.Set("auth:oidc:client-id", "tsuru")
+	config.Set("auth:oidc:groups", map[interface{}]interface{}{
+		"developers": "devteam",
+		"operations": "opsteam",
+	})
+	config.Set("auth:token-expire-days", 2)
+	config.Set("auth:hash-cost", bcrypt.MinCost)
+	config.Set("auth:user-registration", true)
+	config.Set("admin-team", "admin")
+	config.Set("database:url", "127.0.0.1:27017")
+	config.Set("database:name", "tsuru_auth_oidc_test")
+	config.Set("repo-manager", "fake")
+}
+
+func (s *S) SetUpTest(c *check.C) {
+	s.conn, _ = db.Conn()
+	repositorytest.Reset()
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	err := dbtest.ClearAllCollections(s.conn.Users().Database)
+	c.Assert(err, check.IsNil)
+	s.conn.Close()
+	s.issuer.Reset()
+}
+
+func (s *S) TearDownSuite(c *check.C) {
+	s.issuer.Close()
+}
@@ -105,3 +105,189 @@ func ChangeQuota(user *User, limit int) error {
 	user.Quota.Limit = limit
 	return user.Update()
 }
+
+const (
+	teamAppQuota  = "appquota"
+	teamUnitQuota = "unitquota"
+)
+
+// ReserveTeamApp reserves an app in the quota of the given team, returning an
+// error when the team can't own any other app. Teams without an app quota,
+// or that don't exist anymore, are unlimited.
+func ReserveTeamApp(teamName string) error {
+	return reserveTeamQuota(teamName, teamAppQuota, 1)
+}
+
+// ReleaseTeamApp releases an app from the quota of the given team.
+func ReleaseTeamApp(teamName string) error {
+	return releaseTeamQuota(teamName, teamAppQuota, 1)
+}
+
+// ReserveTeamUnits reserves the given number of units in the quota of the
+// given team, returning an error when there isn't enough space available.
+func ReserveTeamUnits(teamName string, quantity int) error {
+	return reserveTeamQuota(teamName, teamUnitQuota, quantity)
+}
+
+// ReleaseTeamUnits releases the given number of units from the quota of the
+// given team.
+func ReleaseTeamUnits(teamName string, quantity int) error {
+	return releaseTeamQuota(teamName, teamUnitQuota, quantity)
+}
+
+func (t *Team) quota(field string) *quota.Quota {
+	if field == teamAppQuota {
+		return t.AppQuota
+	}
+	return t.UnitQuota
+}
+
+func reserveTeamQuota(teamName, field string, quantity int) error {
+	if teamName == "" || quantity == 0 {
+		return nil
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for {
+		team, err := GetTeam(teamName)
+		if err == ErrTeamNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		q := team.quota(field)
+		if q == nil {
+			return nil
+		}
+		if q.Limit > -1 && q.InUse+quantity > q.Limit {
+			available := q.Limit - q.InUse
+			if available < 0 {
+				available = 0
+			}
+			return &quota.QuotaExceededError{
+				Available: uint(available),
+				Requested: uint(quantity),
+			}
+		}
+		err = conn.Teams().Update(
+			bson.M{"_id": teamName, field + ".inuse": q.InUse},
+			bson.M{"$inc": bson.M{field + ".inuse": quantity}},
+		)
+		if err != mgo.ErrNotFound {
+			return err
+		}
+	}
+}
+
+func releaseTeamQuota(teamName, field string, quantity int) error {
+	if teamName == "" || quantity == 0 {
+		return nil
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for {
+		team, err := GetTeam(teamName)
+		if err == ErrTeamNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		q := team.quota(field)
+		if q == nil {
+			return nil
+		}
+		if q.InUse-quantity < 0 {
+			return errors.New("Not enough reserved quota in the team")
+		}
+		err = conn.Teams().Update(
+			bson.M{"_id": teamName, field + ".inuse": q.InUse},
+			bson.M{"$inc": bson.M{field + ".inuse": -1 * quantity}},
+		)
+		if err != mgo.ErrNotFound {
+			return err
+		}
+	}
+}
+
+// TeamQuotas returns the app and unit quotas of the team. The usage of teams
+// without quotas is computed from the apps owned by the team.
+func TeamQuotas(team *Team) (quota.Quota, quota.Quota, error) {
+	appQuota, unitQuota := team.AppQuota, team.UnitQuota
+	if appQuota == nil || unitQuota == nil {
+		apps, units, err := teamUsage(team.Name)
+		if err != nil {
+			return quota.Quota{}, quota.Quota{}, err
+		}
+		if appQuota == nil {
+			appQuota = &quota.Quota{Limit: -1, InUse: apps}
+		}
+		if unitQuota == nil {
+			unitQuota = &quota.Quota{Limit: -1, InUse: units}
+		}
+	}
+	return *appQuota, *unitQuota, nil
+}
+
+// ChangeTeamQuota redefines the limits of apps and units of the team. The new
+// limits must be bigger than or equal to the current usage of the team, and
+// limits smaller than 0 mean unlimited.
+func ChangeTeamQuota(team *Team, apps, units int) error {
+	appQuota, unitQuota, err := TeamQuotas(team)
+	if err != nil {
+		return err
+	}
+	if apps < 0 {
+		apps = -1
+	} else if apps < appQuota.InUse {
+		return errors.New("new limit of apps is lesser than the current allocated value")
+	}
+	if units < 0 {
+		units = -1
+	} else if units < unitQuota.InUse {
+		return errors.New("new limit of units is lesser than the current allocated value")
+	}
+	appQuota.Limit = apps
+	unitQuota.Limit = units
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Teams().UpdateId(team.Name, bson.M{"$set": bson.M{teamAppQuota: appQuota, teamUnitQuota: unitQuota}})
+	if err != nil {
+		return err
+	}
+	team.AppQuota = &appQuota
+	team.UnitQuota = &unitQuota
+	return nil
+}
+
+// teamUsage returns the number of apps owned by the team and the number of
+// units of these apps.
+func teamUsage(teamName string) (int, int, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	var apps []struct {
+		Quota quota.Quota
+	}
+	err = conn.Apps().Find(bson.M{"teamowner": teamName}).Select(bson.M{"quota": 1}).All(&apps)
+	if err != nil {
+		return 0, 0, err
+	}
+	var units int
+	for _, a := range apps {
+		units += a.Quota.InUse
+	}
+	return len(apps), units, nil
+}
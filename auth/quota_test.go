@@ -12,6 +12,7 @@ import (
 	"github.com/tsuru/tsuru/quota"
 	"gopkg.in/check.v1"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 func (s *S) TestReserveApp(c *check.C) {
@@ -265,3 +266,102 @@ func (s *S) TestChangeQuotaUserNotFound(c *check.C) {
 	c.Assert(err, check.NotNil)
 	c.Assert(err, check.Equals, mgo.ErrNotFound)
 }
+
+func (s *S) TestReserveTeamApp(c *check.C) {
+	team := Team{Name: "pos", AppQuota: &quota.Quota{Limit: 2}}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	err = ReserveTeamApp(team.Name)
+	c.Assert(err, check.IsNil)
+	err = ReserveTeamApp(team.Name)
+	c.Assert(err, check.IsNil)
+	err = ReserveTeamApp(team.Name)
+	e, ok := err.(*quota.QuotaExceededError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.Available, check.Equals, uint(0))
+	c.Assert(e.Requested, check.Equals, uint(1))
+	dbTeam, err := GetTeam(team.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbTeam.AppQuota.InUse, check.Equals, 2)
+}
+
+func (s *S) TestReserveTeamAppWithoutQuota(c *check.C) {
+	team := Team{Name: "pos"}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	err = ReserveTeamApp(team.Name)
+	c.Assert(err, check.IsNil)
+	dbTeam, err := GetTeam(team.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbTeam.AppQuota, check.IsNil)
+}
+
+func (s *S) TestReserveTeamUnitsIsSafe(c *check.C) {
+	team := Team{Name: "pos", UnitQuota: &quota.Quota{Limit: 30}}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	originalProcs := runtime.GOMAXPROCS(runtime.NumCPU())
+	defer runtime.GOMAXPROCS(originalProcs)
+	var wg sync.WaitGroup
+	for i := 0; i < 24; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ReserveTeamUnits(team.Name, 2)
+		}()
+	}
+	wg.Wait()
+	dbTeam, err := GetTeam(team.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbTeam.UnitQuota.InUse, check.Equals, 30)
+}
+
+func (s *S) TestReleaseTeamUnits(c *check.C) {
+	team := Team{Name: "pos", UnitQuota: &quota.Quota{Limit: 10, InUse: 6}}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	err = ReleaseTeamUnits(team.Name, 4)
+	c.Assert(err, check.IsNil)
+	err = ReleaseTeamUnits(team.Name, 3)
+	c.Assert(err, check.ErrorMatches, "Not enough reserved quota in the team")
+	dbTeam, err := GetTeam(team.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbTeam.UnitQuota.InUse, check.Equals, 2)
+}
+
+func (s *S) TestTeamQuotasWithoutQuota(c *check.C) {
+	team := Team{Name: "pos"}
+	err := s.conn.Apps().Insert(
+		bson.M{"name": "app1", "teamowner": "pos", "quota": quota.Quota{Limit: -1, InUse: 3}},
+		bson.M{"name": "app2", "teamowner": "pos", "quota": quota.Quota{Limit: -1, InUse: 2}},
+		bson.M{"name": "app3", "teamowner": "other", "quota": quota.Quota{Limit: -1, InUse: 1}},
+	)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().RemoveAll(nil)
+	appQuota, unitQuota, err := TeamQuotas(&team)
+	c.Assert(err, check.IsNil)
+	c.Assert(appQuota, check.DeepEquals, quota.Quota{Limit: -1, InUse: 2})
+	c.Assert(unitQuota, check.DeepEquals, quota.Quota{Limit: -1, InUse: 5})
+}
+
+func (s *S) TestChangeTeamQuota(c *check.C) {
+	team := Team{Name: "pos"}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	err = s.conn.Apps().Insert(bson.M{"name": "app1", "teamowner": "pos", "quota": quota.Quota{Limit: -1, InUse: 3}})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Apps().RemoveAll(nil)
+	err = ChangeTeamQuota(&team, 5, -3)
+	c.Assert(err, check.IsNil)
+	dbTeam, err := GetTeam(team.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbTeam.AppQuota, check.DeepEquals, &quota.Quota{Limit: 5, InUse: 1})
+	c.Assert(dbTeam.UnitQuota, check.DeepEquals, &quota.Quota{Limit: -1, InUse: 3})
+	err = ChangeTeamQuota(dbTeam, 5, 2)
+	c.Assert(err, check.ErrorMatches, "new limit of units is lesser than the current allocated value")
+}
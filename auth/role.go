@@ -0,0 +1,424 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/tsuru/tsuru/db"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Permissions that can be granted to users through roles. Permissions are
+// hierarchical: granting "app" grants every permission starting with "app.",
+// and PermAll grants every permission.
+const (
+	PermAll                   = "*"
+	PermAppRead               = "app.read"
+	PermAppUpdate             = "app.update"
+	PermAppDeploy             = "app.deploy"
+	PermAppDelete             = "app.delete"
+	PermAppEnv                = "app.env"
+	PermAppEnvSet             = "app.env.set"
+	PermAppEnvRead            = "app.env.read"
+	PermAppTeams              = "app.teams"
+	PermTeamManage            = "team.manage"
+	PermPoolManage            = "pool.manage"
+	PermUserManage            = "user.manage"
+	PermNodeManage            = "node.manage"
+	PermServiceInstanceCreate = "service.instance.create"
+	PermServiceInstanceUpdate = "service.instance.update"
+	PermServiceInstanceManage = "service.instance.manage"
+)
+
+// Contexts in which roles are assigned to users. A role assigned in the
+// global context applies to everything, other roles apply only to the team,
+// pool or app they were assigned to.
+const (
+	CtxGlobal = "global"
+	CtxTeam   = "team"
+	CtxPool   = "pool"
+	CtxApp    = "app"
+)
+
+var (
+	ErrRoleNotFound       = errors.New("role not found")
+	ErrRoleAlreadyExists  = errors.New("role already exists")
+	ErrInvalidPermission  = errors.New("invalid permission")
+	ErrInvalidContextType = errors.New("invalid context, must be one of global, team, pool or app")
+	ErrInvalidRoleContext = errors.New("roles in the global context can't have a context value, other roles require one")
+)
+
+var permissions = []string{
+	PermAppRead,
+	PermAppUpdate,
+	PermAppDeploy,
+	PermAppDelete,
+	PermAppEnvSet,
+	PermAppEnvRead,
+	PermAppTeams,
+	PermTeamManage,
+	PermPoolManage,
+	PermUserManage,
+	PermNodeManage,
+	PermServiceInstanceCreate,
+	PermServiceInstanceUpdate,
+	PermServiceInstanceManage,
+}
+
+// levelPermissions lists the permissions that each membership level grants on
+// the team and on the objects that belong to it, like apps.
+var levelPermissions = []struct {
+	level       string
+	permissions []string
+}{
+	{TeamViewer, []string{PermAppRead}},
+	{TeamDeveloper, []string{PermAppRead, PermAppUpdate, PermAppDeploy, PermAppEnv, PermServiceInstanceUpdate}},
+	{TeamOwner, []string{"app", "service.instance", PermTeamManage}},
+}
+
+// Role is a named set of permissions, assigned to users in a context.
+type Role struct {
+	Name        string   `bson:"_id" json:"name"`
+	ContextType string   `json:"context"`
+	Permissions []string `json:"permissions"`
+}
+
+// RoleInstance is a role assigned to a user. ContextValue is the name of the
+// team, pool or app the role applies to, and is empty for global roles.
+type RoleInstance struct {
+	Name         string `json:"name"`
+	ContextValue string `json:"context,omitempty"`
+}
+
+// PermissionContext identifies an object to which permissions may be
+// granted, like an app or a team.
+type PermissionContext struct {
+	Type  string
+	Value string
+}
+
+func validContextType(contextType string) bool {
+	switch contextType {
+	case CtxGlobal, CtxTeam, CtxPool, CtxApp:
+		return true
+	}
+	return false
+}
+
+func validPermission(permission string) bool {
+	if permission == PermAll {
+		return true
+	}
+	for _, p := range permissions {
+		if grants(permission, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// grants checks whether the granted permission includes the given
+// permission.
+func grants(granted, permission string) bool {
+	return granted == PermAll || granted == permission || strings.HasPrefix(permission, granted+".")
+}
+
+// CreateRole creates a role with the given permissions, to be assigned in
+// contexts of the given type.
+func CreateRole(name, contextType string, perms ...string) (*Role, error) {
+	if name == "" {
+		return nil, errors.New("role name is required")
+	}
+	if !validContextType(contextType) {
+		return nil, ErrInvalidContextType
+	}
+	for _, p := range perms {
+		if !validPermission(p) {
+			return nil, ErrInvalidPermission
+		}
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	role := Role{Name: name, ContextType: contextType, Permissions: perms}
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+	err = conn.Roles().Insert(role)
+	if mgo.IsDup(err) {
+		return nil, ErrRoleAlreadyExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// GetRole returns the role with the given name.
+func GetRole(name string) (*Role, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var role Role
+	err = conn.Roles().FindId(name).One(&role)
+	if err == mgo.ErrNotFound {
+		return nil, ErrRoleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// ListRoles returns all the roles, sorted by name.
+func ListRoles() ([]Role, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var roles []Role
+	err = conn.Roles().Find(nil).Sort("_id").All(&roles)
+	return roles, err
+}
+
+// RemoveRole removes the role, unassigning it from all users.
+func RemoveRole(name string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Roles().RemoveId(name)
+	if err == mgo.ErrNotFound {
+		return ErrRoleNotFound
+	}
+	if err != nil {
+		return err
+	}
+	_, err = conn.Users().UpdateAll(
+		bson.M{"roles.name": name},
+		bson.M{"$pull": bson.M{"roles": bson.M{"name": name}}},
+	)
+	return err
+}
+
+// AddPermissions adds permissions to the role.
+func (r *Role) AddPermissions(perms ...string) error {
+	for _, p := range perms {
+		if !validPermission(p) {
+			return ErrInvalidPermission
+		}
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Roles().UpdateId(r.Name, bson.M{"$addToSet": bson.M{"permissions": bson.M{"$each": perms}}})
+	if err == mgo.ErrNotFound {
+		return ErrRoleNotFound
+	}
+	if err != nil {
+		return err
+	}
+	for _, p := range perms {
+		if !r.hasPermission(p) {
+			r.Permissions = append(r.Permissions, p)
+		}
+	}
+	return nil
+}
+
+func (r *Role) hasPermission(permission string) bool {
+	for _, p := range r.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// AddRole assigns the role to the user in the given context. The context
+// value must be empty for global roles.
+func (u *User) AddRole(name, contextValue string) error {
+	role, err := GetRole(name)
+	if err != nil {
+		return err
+	}
+	if (role.ContextType == CtxGlobal) != (contextValue == "") {
+		return ErrInvalidRoleContext
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	instance := RoleInstance{Name: name, ContextValue: contextValue}
+	err = conn.Users().Update(bson.M{"email": u.Email}, bson.M{"$addToSet": bson.M{"roles": instance}})
+	if err == mgo.ErrNotFound {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	for _, r := range u.Roles {
+		if r == instance {
+			return nil
+		}
+	}
+	u.Roles = append(u.Roles, instance)
+	return nil
+}
+
+// RemoveRole unassigns the role, in the given context, from the user.
+func (u *User) RemoveRole(name, contextValue string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	instance := RoleInstance{Name: name, ContextValue: contextValue}
+	err = conn.Users().Update(bson.M{"email": u.Email}, bson.M{"$pull": bson.M{"roles": instance}})
+	if err == mgo.ErrNotFound {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	for i, r := range u.Roles {
+		if r == instance {
+			u.Roles = append(u.Roles[:i], u.Roles[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// CheckPermission checks whether the user has the given permission in any of
+// the given contexts. Roles assigned in the global context grant their
+// permissions in every context, and members of the admin team have every
+// permission.
+//
+// Admin privileges, held by members of the admin team and through roles
+// granting all permissions, are only granted to users with two-factor
+// authentication enabled when auth:two-factor:enforce-admins is set.
+func CheckPermission(u *User, permission string, contexts ...PermissionContext) bool {
+	var missingChecked, missing bool
+	twoFactorMissing := func() bool {
+		if !missingChecked {
+			missing, missingChecked = u.adminTwoFactorMissing(), true
+		}
+		return missing
+	}
+	if u.InAdminTeam() && !twoFactorMissing() {
+		return true
+	}
+	roles, err := u.loadRoles()
+	if err != nil {
+		return false
+	}
+	for _, instance := range u.Roles {
+		role := roles[instance.Name]
+		if role == nil || !role.grants(permission) {
+			continue
+		}
+		if role.grants(PermAll) && twoFactorMissing() {
+			continue
+		}
+		if role.ContextType == CtxGlobal {
+			return true
+		}
+		for _, ctx := range contexts {
+			if ctx.Type == role.ContextType && ctx.Value == instance.ContextValue {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadRoles returns the roles assigned to the user, by name.
+func (u *User) loadRoles() (map[string]*Role, error) {
+	if len(u.Roles) == 0 {
+		return nil, nil
+	}
+	names := make([]string, len(u.Roles))
+	for i, r := range u.Roles {
+		names[i] = r.Name
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var roles []Role
+	err = conn.Roles().Find(bson.M{"_id": bson.M{"$in": names}}).All(&roles)
+	if err != nil {
+		return nil, err
+	}
+	rolesMap := make(map[string]*Role, len(roles))
+	for i := range roles {
+		rolesMap[roles[i].Name] = &roles[i]
+	}
+	return rolesMap, nil
+}
+
+// hasAdminRole checks whether any of the roles assigned to the user grants
+// all permissions.
+func hasAdminRole(u *User, roles map[string]*Role) bool {
+	for _, instance := range u.Roles {
+		if role := roles[instance.Name]; role != nil && role.grants(PermAll) {
+			return true
+		}
+	}
+	return false
+}
+
+// PermissionLevel returns the lowest membership level that grants the
+// permission on the team and on the objects that belong to it, or an empty
+// string when the permission can only be granted by roles.
+func PermissionLevel(permission string) string {
+	for _, l := range levelPermissions {
+		for _, p := range l.permissions {
+			if grants(p, permission) {
+				return l.level
+			}
+		}
+	}
+	return ""
+}
+
+// CheckTeamsPermission checks whether the user has the given permission on an
+// object that belongs to the given teams, either through their membership
+// level in one of the teams, or through roles assigned on one of the teams or
+// in one of the other given contexts.
+func CheckTeamsPermission(u *User, permission string, teamNames []string, contexts ...PermissionContext) bool {
+	if level := PermissionLevel(permission); level != "" && CheckUserAccessLevel(teamNames, u, level) {
+		return true
+	}
+	all := make([]PermissionContext, 0, len(contexts)+len(teamNames))
+	all = append(all, contexts...)
+	for _, team := range teamNames {
+		all = append(all, PermissionContext{Type: CtxTeam, Value: team})
+	}
+	return CheckPermission(u, permission, all...)
+}
+
+func (r *Role) grants(permission string) bool {
+	for _, p := range r.Permissions {
+		if grants(p, permission) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) TestCreateRole(c *check.C) {
+	role, err := CreateRole("deployer", CtxApp, PermAppDeploy, "app.env")
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId(role.Name)
+	c.Assert(*role, check.DeepEquals, Role{Name: "deployer", ContextType: "app", Permissions: []string{"app.deploy", "app.env"}})
+	dbRole, err := GetRole("deployer")
+	c.Assert(err, check.IsNil)
+	c.Assert(dbRole, check.DeepEquals, role)
+}
+
+func (s *S) TestCreateRoleAlreadyExists(c *check.C) {
+	_, err := CreateRole("deployer", CtxApp, PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("deployer")
+	_, err = CreateRole("deployer", CtxTeam, PermAppDeploy)
+	c.Assert(err, check.Equals, ErrRoleAlreadyExists)
+}
+
+func (s *S) TestCreateRoleInvalid(c *check.C) {
+	_, err := CreateRole("deployer", "planet", PermAppDeploy)
+	c.Assert(err, check.Equals, ErrInvalidContextType)
+	_, err = CreateRole("deployer", CtxApp, "app.destroy")
+	c.Assert(err, check.Equals, ErrInvalidPermission)
+	_, err = CreateRole("", CtxApp, PermAppDeploy)
+	c.Assert(err, check.ErrorMatches, "role name is required")
+}
+
+func (s *S) TestGetRoleNotFound(c *check.C) {
+	_, err := GetRole("unknown")
+	c.Assert(err, check.Equals, ErrRoleNotFound)
+}
+
+func (s *S) TestListRoles(c *check.C) {
+	_, err := CreateRole("ops", CtxGlobal, PermNodeManage)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("ops")
+	_, err = CreateRole("deployer", CtxApp, PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("deployer")
+	roles, err := ListRoles()
+	c.Assert(err, check.IsNil)
+	c.Assert(roles, check.HasLen, 2)
+	c.Assert(roles[0].Name, check.Equals, "deployer")
+	c.Assert(roles[1].Name, check.Equals, "ops")
+}
+
+func (s *S) TestRemoveRole(c *check.C) {
+	_, err := CreateRole("deployer", CtxApp, PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	u := User{Email: "deployer@tsuru.io", Password: "123456"}
+	err = u.Create()
+	c.Assert(err, check.IsNil)
+	defer s.conn.Users().Remove(bson.M{"email": u.Email})
+	err = u.AddRole("deployer", "myapp")
+	c.Assert(err, check.IsNil)
+	err = RemoveRole("deployer")
+	c.Assert(err, check.IsNil)
+	_, err = GetRole("deployer")
+	c.Assert(err, check.Equals, ErrRoleNotFound)
+	dbUser, err := GetUserByEmail(u.Email)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbUser.Roles, check.HasLen, 0)
+	err = RemoveRole("deployer")
+	c.Assert(err, check.Equals, ErrRoleNotFound)
+}
+
+func (s *S) TestRoleAddPermissions(c *check.C) {
+	role, err := CreateRole("deployer", CtxApp, PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId(role.Name)
+	err = role.AddPermissions(PermAppEnvRead, PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	c.Assert(role.Permissions, check.DeepEquals, []string{"app.deploy", "app.env.read"})
+	dbRole, err := GetRole(role.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbRole.Permissions, check.DeepEquals, []string{"app.deploy", "app.env.read"})
+	err = role.AddPermissions("node.destroy")
+	c.Assert(err, check.Equals, ErrInvalidPermission)
+}
+
+func (s *S) TestUserAddAndRemoveRole(c *check.C) {
+	_, err := CreateRole("deployer", CtxApp, PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("deployer")
+	u := User{Email: "deployer@tsuru.io", Password: "123456"}
+	err = u.Create()
+	c.Assert(err, check.IsNil)
+	defer s.conn.Users().Remove(bson.M{"email": u.Email})
+	err = u.AddRole("deployer", "myapp")
+	c.Assert(err, check.IsNil)
+	err = u.AddRole("deployer", "myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(u.Roles, check.DeepEquals, []RoleInstance{{Name: "deployer", ContextValue: "myapp"}})
+	dbUser, err := GetUserByEmail(u.Email)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbUser.Roles, check.DeepEquals, u.Roles)
+	err = u.RemoveRole("deployer", "myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(u.Roles, check.HasLen, 0)
+	dbUser, err = GetUserByEmail(u.Email)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbUser.Roles, check.HasLen, 0)
+}
+
+func (s *S) TestUserAddRoleInvalidContext(c *check.C) {
+	_, err := CreateRole("deployer", CtxApp, PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("deployer")
+	_, err = CreateRole("ops", CtxGlobal, PermNodeManage)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("ops")
+	u := User{Email: "deployer@tsuru.io"}
+	err = u.AddRole("deployer", "")
+	c.Assert(err, check.Equals, ErrInvalidRoleContext)
+	err = u.AddRole("ops", "myapp")
+	c.Assert(err, check.Equals, ErrInvalidRoleContext)
+	err = u.AddRole("unknown", "myapp")
+	c.Assert(err, check.Equals, ErrRoleNotFound)
+}
+
+func (s *S) TestCheckPermission(c *check.C) {
+	_, err := CreateRole("deployer", CtxTeam, "app")
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("deployer")
+	_, err = CreateRole("ops", CtxGlobal, PermNodeManage)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("ops")
+	u := User{Email: "deployer@tsuru.io", Roles: []RoleInstance{{Name: "deployer", ContextValue: "myteam"}}}
+	myteam := PermissionContext{Type: CtxTeam, Value: "myteam"}
+	otherteam := PermissionContext{Type: CtxTeam, Value: "otherteam"}
+	c.Assert(CheckPermission(&u, PermAppDeploy, myteam), check.Equals, true)
+	c.Assert(CheckPermission(&u, PermAppEnvSet, otherteam, myteam), check.Equals, true)
+	c.Assert(CheckPermission(&u, PermAppDeploy, otherteam), check.Equals, false)
+	c.Assert(CheckPermission(&u, PermAppDeploy), check.Equals, false)
+	c.Assert(CheckPermission(&u, PermServiceInstanceCreate, myteam), check.Equals, false)
+	c.Assert(CheckPermission(&u, PermNodeManage), check.Equals, false)
+	u.Roles = append(u.Roles, RoleInstance{Name: "ops"})
+	c.Assert(CheckPermission(&u, PermNodeManage), check.Equals, true)
+	c.Assert(CheckPermission(&u, PermNodeManage, otherteam), check.Equals, true)
+	c.Assert(CheckPermission(&u, PermAll), check.Equals, false)
+}
+
+func (s *S) TestCheckPermissionAdmin(c *check.C) {
+	u := User{Email: "admin@tsuru.io", Password: "123456"}
+	err := u.Create()
+	c.Assert(err, check.IsNil)
+	defer s.conn.Users().Remove(bson.M{"email": u.Email})
+	team := Team{Name: "admin", Users: []string{u.Email}}
+	err = s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	c.Assert(CheckPermission(&u, PermAll), check.Equals, true)
+	c.Assert(CheckPermission(&u, PermNodeManage), check.Equals, true)
+}
+
+func (s *S) TestPermissionLevel(c *check.C) {
+	c.Assert(PermissionLevel(PermAppRead), check.Equals, TeamViewer)
+	c.Assert(PermissionLevel(PermAppUpdate), check.Equals, TeamDeveloper)
+	c.Assert(PermissionLevel(PermAppEnvRead), check.Equals, TeamDeveloper)
+	c.Assert(PermissionLevel(PermServiceInstanceUpdate), check.Equals, TeamDeveloper)
+	c.Assert(PermissionLevel(PermAppDelete), check.Equals, TeamOwner)
+	c.Assert(PermissionLevel(PermAppTeams), check.Equals, TeamOwner)
+	c.Assert(PermissionLevel(PermTeamManage), check.Equals, TeamOwner)
+	c.Assert(PermissionLevel(PermNodeManage), check.Equals, "")
+	c.Assert(PermissionLevel(PermPoolManage), check.Equals, "")
+}
+
+func (s *S) TestCheckTeamsPermission(c *check.C) {
+	team := Team{
+		Name:    "levels",
+		Users:   []string{"owner@tsuru.io", "dev@tsuru.io", "viewer@tsuru.io"},
+		Owners:  []string{"owner@tsuru.io"},
+		Viewers: []string{"viewer@tsuru.io"},
+	}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	_, err = CreateRole("app-deployer", CtxApp, PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("app-deployer")
+	teams := []string{team.Name}
+	owner := User{Email: "owner@tsuru.io"}
+	dev := User{Email: "dev@tsuru.io"}
+	viewer := User{Email: "viewer@tsuru.io"}
+	c.Assert(CheckTeamsPermission(&owner, PermAppDelete, teams), check.Equals, true)
+	c.Assert(CheckTeamsPermission(&dev, PermAppDelete, teams), check.Equals, false)
+	c.Assert(CheckTeamsPermission(&dev, PermAppUpdate, teams), check.Equals, true)
+	c.Assert(CheckTeamsPermission(&viewer, PermAppUpdate, teams), check.Equals, false)
+	c.Assert(CheckTeamsPermission(&viewer, PermAppRead, teams), check.Equals, true)
+	c.Assert(CheckTeamsPermission(&owner, PermNodeManage, teams), check.Equals, false)
+	outsider := User{Email: "outsider@tsuru.io", Roles: []RoleInstance{{Name: "app-deployer", ContextValue: "myapp"}}}
+	myapp := PermissionContext{Type: CtxApp, Value: "myapp"}
+	otherapp := PermissionContext{Type: CtxApp, Value: "otherapp"}
+	c.Assert(CheckTeamsPermission(&outsider, PermAppDeploy, teams, myapp), check.Equals, true)
+	c.Assert(CheckTeamsPermission(&outsider, PermAppDeploy, teams, otherapp), check.Equals, false)
+	c.Assert(CheckTeamsPermission(&outsider, PermAppRead, teams, myapp), check.Equals, false)
+}
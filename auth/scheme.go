@@ -4,7 +4,10 @@
 
 package auth
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 type SchemeInfo map[string]interface{}
 
@@ -26,6 +29,25 @@ type ManagedScheme interface {
 	ChangePassword(token Token, oldPassword string, newPassword string) error
 }
 
+// TwoFactorScheme is implemented by schemes that support time-based one-time
+// passwords (TOTP) as a second authentication factor.
+type TwoFactorScheme interface {
+	Scheme
+	TwoFactorEnabled(user *User) (bool, error)
+	StartTwoFactorEnrollment(user *User) (string, error)
+	ConfirmTwoFactorEnrollment(user *User, code string) ([]string, error)
+	RegenerateRecoveryCodes(user *User, code, ip string) ([]string, error)
+	DisableTwoFactor(user *User, code, ip string) error
+}
+
+// ErrTwoFactorRequired is returned by Login when the user has two-factor
+// authentication enabled and no code was provided.
+var ErrTwoFactorRequired = errors.New("two-factor authentication code required")
+
+// ErrTooManyLoginAttempts is returned by Login when the user, or the source of
+// the request, is temporarily locked out after too many failed attempts.
+var ErrTooManyLoginAttempts = errors.New("too many failed login attempts, try again later")
+
 type AuthenticationFailure struct {
 	Message string
 }
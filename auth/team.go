@@ -10,25 +10,54 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/tsuru/config"
 	"github.com/tsuru/tsuru/db"
 	"github.com/tsuru/tsuru/log"
+	"github.com/tsuru/tsuru/quota"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
+// Membership levels of the users in a team. Viewers can only read the apps of
+// the team, developers can also change and deploy them, and owners can also
+// remove them, share them with other teams and manage the team members.
+const (
+	TeamViewer    = "viewer"
+	TeamDeveloper = "developer"
+	TeamOwner     = "owner"
+)
+
 var (
 	ErrInvalidTeamName   = errors.New("invalid team name")
 	ErrTeamAlreadyExists = errors.New("team already exists")
 	ErrTeamNotFound      = errors.New("team not found")
+	ErrInvalidTeamLevel  = errors.New("invalid level, must be one of viewer, developer or owner")
+	ErrLastTeamOwner     = errors.New("a team must have at least one owner")
 
 	teamNameRegexp = regexp.MustCompile(`^[a-zA-Z][-@_.+\w]+$`)
+
+	teamLevels = map[string]int{TeamViewer: 1, TeamDeveloper: 2, TeamOwner: 3}
 )
 
 // Team represents a real world team, a team has team members (users) and
-// a name.
+// a name. Teams may also have quotas limiting the number of apps they own
+// and the number of units of these apps, teams without quotas are unlimited.
+//
+// Members listed in Owners or in Viewers have the respective levels, other
+// members are developers. Teams without owners, created before the
+// introduction of levels, have all their members as owners.
+//
+// Synced teams have their members managed by an identity provider, through
+// SyncTeams. They don't need owners, as their members may leave them at any
+// time.
 type Team struct {
-	Name  string   `bson:"_id" json:"name"`
-	Users []string `json:"users"`
+	Name      string       `bson:"_id" json:"name"`
+	Users     []string     `json:"users"`
+	Owners    []string     `bson:",omitempty" json:"owners,omitempty"`
+	Viewers   []string     `bson:",omitempty" json:"viewers,omitempty"`
+	Synced    bool         `bson:",omitempty" json:"synced,omitempty"`
+	AppQuota  *quota.Quota `bson:",omitempty" json:"appQuota,omitempty"`
+	UnitQuota *quota.Quota `bson:",omitempty" json:"unitQuota,omitempty"`
 }
 
 // ContainsUser checks if the team contains the user.
@@ -62,14 +91,94 @@ func (t *Team) RemoveUser(u *User) error {
 	if index < 0 {
 		return fmt.Errorf("User %s is not in the team %s.", u.Email, t.Name)
 	}
+	if !t.Synced && len(t.Owners) == 1 && t.Owners[0] == u.Email && len(t.Users) > 1 {
+		return ErrLastTeamOwner
+	}
 	last := len(t.Users) - 1
 	if index < last {
 		t.Users[index] = t.Users[last]
 	}
 	t.Users = t.Users[:last]
+	t.Owners = removeEmail(t.Owners, u.Email)
+	t.Viewers = removeEmail(t.Viewers, u.Email)
+	return nil
+}
+
+// Level returns the membership level of the user in the team, or an empty
+// string if the user is not a member of the team.
+func (t *Team) Level(u *User) string {
+	if !t.ContainsUser(u) {
+		return ""
+	}
+	if (len(t.Owners) == 0 && !t.Synced) || containsEmail(t.Owners, u.Email) {
+		return TeamOwner
+	}
+	if containsEmail(t.Viewers, u.Email) {
+		return TeamViewer
+	}
+	return TeamDeveloper
+}
+
+// HasLevel checks whether the user is a member of the team with at least the
+// given level.
+func (t *Team) HasLevel(u *User, level string) bool {
+	current := t.Level(u)
+	return current != "" && teamLevels[current] >= teamLevels[level]
+}
+
+// SetLevel changes the membership level of a user in the team. It doesn't
+// store the change in the database.
+func (t *Team) SetLevel(u *User, level string) error {
+	if _, ok := teamLevels[level]; !ok {
+		return ErrInvalidTeamLevel
+	}
+	if !t.ContainsUser(u) {
+		return fmt.Errorf("User %s is not in the team %s.", u.Email, t.Name)
+	}
+	t.keepLegacyOwners()
+	owners := removeEmail(t.Owners, u.Email)
+	if !t.Synced && level != TeamOwner && len(owners) == 0 {
+		return ErrLastTeamOwner
+	}
+	t.Owners = owners
+	t.Viewers = removeEmail(t.Viewers, u.Email)
+	switch level {
+	case TeamOwner:
+		t.Owners = append(t.Owners, u.Email)
+	case TeamViewer:
+		t.Viewers = append(t.Viewers, u.Email)
+	}
 	return nil
 }
 
+// keepLegacyOwners stores the current members of teams without owners, which
+// are all owners, as the owners of the team.
+func (t *Team) keepLegacyOwners() {
+	if len(t.Owners) == 0 && !t.Synced {
+		t.Owners = make([]string, len(t.Users))
+		copy(t.Owners, t.Users)
+	}
+}
+
+func containsEmail(emails []string, email string) bool {
+	for _, e := range emails {
+		if e == email {
+			return true
+		}
+	}
+	return false
+}
+
+func removeEmail(emails []string, email string) []string {
+	var result []string
+	for _, e := range emails {
+		if e != email {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
 // AllowedApps returns the apps that the team has access.
 func (t *Team) AllowedApps() ([]string, error) {
 	conn, err := db.Conn()
@@ -102,6 +211,16 @@ func CreateTeam(name string, user ...*User) error {
 	for i, u := range user {
 		team.Users[i] = u.Email
 	}
+	if len(team.Users) > 0 {
+		team.Owners = make([]string, len(team.Users))
+		copy(team.Owners, team.Users)
+	}
+	if limit, err := config.GetInt("quota:apps-per-team"); err == nil && limit > -1 {
+		team.AppQuota = &quota.Quota{Limit: limit}
+	}
+	if limit, err := config.GetInt("quota:units-per-team"); err == nil && limit > -1 {
+		team.UnitQuota = &quota.Quota{Limit: limit}
+	}
 	conn, err := db.Conn()
 	if err != nil {
 		return err
@@ -114,6 +233,65 @@ func CreateTeam(name string, user ...*User) error {
 	return err
 }
 
+// SyncTeams keeps the memberships of the user in sync with the groups they
+// belong to in an external identity provider. The mapping goes from group
+// names to team names: the user is added to the teams mapped to their groups,
+// creating teams when needed, and removed from the mapped teams of the groups
+// they don't belong to anymore. Teams that aren't in the mapping are left
+// untouched.
+//
+// Mapped teams become synced teams: teams created for groups don't have
+// owners, and users are removed from them even when they are their last
+// owners.
+func SyncTeams(user *User, groups []string, mapping map[string]string) error {
+	memberOf := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		memberOf[group] = true
+	}
+	teams := make(map[string]bool)
+	for group, team := range mapping {
+		teams[team] = teams[team] || memberOf[group]
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for name, member := range teams {
+		team, err := GetTeam(name)
+		if err == ErrTeamNotFound {
+			if !member {
+				continue
+			}
+			err = CreateTeam(name)
+			if err != nil && err != ErrTeamAlreadyExists {
+				return err
+			}
+			team, err = GetTeam(name)
+		}
+		if err != nil {
+			return err
+		}
+		if member == team.ContainsUser(user) && team.Synced {
+			continue
+		}
+		team.keepLegacyOwners()
+		team.Synced = true
+		if member && !team.ContainsUser(user) {
+			err = team.AddUser(user)
+		} else if !member && team.ContainsUser(user) {
+			err = team.RemoveUser(user)
+		}
+		if err != nil {
+			return err
+		}
+		if err = conn.Teams().UpdateId(team.Name, team); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func isTeamNameValid(name string) bool {
 	return teamNameRegexp.MatchString(name)
 }
@@ -145,8 +323,20 @@ func GetTeamsNames(teams []Team) []string {
 }
 
 // CheckUserAccess verifies if the user has access to a list
-// of teams.
+// of teams, being at least a developer in one of them.
 func CheckUserAccess(teamNames []string, u *User) bool {
+	return CheckUserAccessLevel(teamNames, u, TeamDeveloper)
+}
+
+// CheckUserReadAccess verifies if the user is a member of one of the teams,
+// with any level. It must only be used to give read-only access.
+func CheckUserReadAccess(teamNames []string, u *User) bool {
+	return CheckUserAccessLevel(teamNames, u, TeamViewer)
+}
+
+// CheckUserAccessLevel verifies if the user is a member of any of the teams
+// with at least the given level.
+func CheckUserAccessLevel(teamNames []string, u *User, level string) bool {
 	q := bson.M{"_id": bson.M{"$in": teamNames}}
 	var teams []Team
 	conn, err := db.Conn()
@@ -157,7 +347,7 @@ func CheckUserAccess(teamNames []string, u *User) bool {
 	defer conn.Close()
 	conn.Teams().Find(q).All(&teams)
 	for _, team := range teams {
-		if team.ContainsUser(u) {
+		if team.HasLevel(u, level) {
 			return true
 		}
 	}
@@ -5,6 +5,8 @@
 package auth
 
 import (
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/quota"
 	"gopkg.in/check.v1"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -69,6 +71,84 @@ func (s *S) TestRemoveUserFromTeam(c *check.C) {
 	c.Assert(t.Users, check.DeepEquals, []string{"nobody@globo.com"})
 }
 
+func (s *S) TestRemoveUserFromTeamRemovesLevel(c *check.C) {
+	users := []string{"somebody@globo.com", "nobody@globo.com", "anybody@globo.com"}
+	t := &Team{Name: "timeredbull", Users: users, Owners: []string{"somebody@globo.com", "nobody@globo.com"}, Viewers: []string{"anybody@globo.com"}}
+	err := t.RemoveUser(&User{Email: "somebody@globo.com"})
+	c.Assert(err, check.IsNil)
+	c.Assert(t.Owners, check.DeepEquals, []string{"nobody@globo.com"})
+	err = t.RemoveUser(&User{Email: "anybody@globo.com"})
+	c.Assert(err, check.IsNil)
+	c.Assert(t.Viewers, check.HasLen, 0)
+}
+
+func (s *S) TestRemoveUserFromTeamLastOwner(c *check.C) {
+	users := []string{"somebody@globo.com", "nobody@globo.com"}
+	t := &Team{Name: "timeredbull", Users: users, Owners: []string{"somebody@globo.com"}}
+	err := t.RemoveUser(&User{Email: "somebody@globo.com"})
+	c.Assert(err, check.Equals, ErrLastTeamOwner)
+	c.Assert(t.Users, check.DeepEquals, users)
+}
+
+func (s *S) TestTeamLevel(c *check.C) {
+	owner := &User{Email: "owner@globo.com"}
+	developer := &User{Email: "developer@globo.com"}
+	viewer := &User{Email: "viewer@globo.com"}
+	t := Team{
+		Name:    "timeredbull",
+		Users:   []string{owner.Email, developer.Email, viewer.Email},
+		Owners:  []string{owner.Email},
+		Viewers: []string{viewer.Email},
+	}
+	c.Assert(t.Level(owner), check.Equals, TeamOwner)
+	c.Assert(t.Level(developer), check.Equals, TeamDeveloper)
+	c.Assert(t.Level(viewer), check.Equals, TeamViewer)
+	c.Assert(t.Level(&User{Email: "nobody@globo.com"}), check.Equals, "")
+	c.Assert(t.HasLevel(owner, TeamDeveloper), check.Equals, true)
+	c.Assert(t.HasLevel(developer, TeamDeveloper), check.Equals, true)
+	c.Assert(t.HasLevel(developer, TeamOwner), check.Equals, false)
+	c.Assert(t.HasLevel(viewer, TeamViewer), check.Equals, true)
+	c.Assert(t.HasLevel(viewer, TeamDeveloper), check.Equals, false)
+	c.Assert(t.HasLevel(&User{Email: "nobody@globo.com"}, TeamViewer), check.Equals, false)
+}
+
+func (s *S) TestTeamLevelWithoutOwners(c *check.C) {
+	u := &User{Email: "somebody@globo.com"}
+	t := Team{Name: "timeredbull", Users: []string{u.Email}}
+	c.Assert(t.Level(u), check.Equals, TeamOwner)
+}
+
+func (s *S) TestTeamSetLevel(c *check.C) {
+	one := &User{Email: "one@globo.com"}
+	two := &User{Email: "two@globo.com"}
+	t := Team{Name: "timeredbull", Users: []string{one.Email, two.Email}}
+	err := t.SetLevel(two, TeamViewer)
+	c.Assert(err, check.IsNil)
+	c.Assert(t.Owners, check.DeepEquals, []string{one.Email})
+	c.Assert(t.Viewers, check.DeepEquals, []string{two.Email})
+	err = t.SetLevel(two, TeamDeveloper)
+	c.Assert(err, check.IsNil)
+	c.Assert(t.Level(two), check.Equals, TeamDeveloper)
+	c.Assert(t.Viewers, check.HasLen, 0)
+	err = t.SetLevel(two, TeamOwner)
+	c.Assert(err, check.IsNil)
+	c.Assert(t.Owners, check.DeepEquals, []string{one.Email, two.Email})
+	err = t.SetLevel(one, TeamDeveloper)
+	c.Assert(err, check.IsNil)
+	err = t.SetLevel(two, TeamDeveloper)
+	c.Assert(err, check.Equals, ErrLastTeamOwner)
+	c.Assert(t.Level(two), check.Equals, TeamOwner)
+}
+
+func (s *S) TestTeamSetLevelInvalid(c *check.C) {
+	u := &User{Email: "one@globo.com"}
+	t := Team{Name: "timeredbull", Users: []string{u.Email}}
+	err := t.SetLevel(u, "boss")
+	c.Assert(err, check.Equals, ErrInvalidTeamLevel)
+	err = t.SetLevel(&User{Email: "nobody@globo.com"}, TeamViewer)
+	c.Assert(err, check.ErrorMatches, "^User nobody@globo.com is not in the team timeredbull.$")
+}
+
 func (s *S) TestShouldReturnErrorWhenTryingToRemoveAUserThatIsNotInTheTeam(c *check.C) {
 	u := &User{Email: "nobody@globo.com"}
 	t := &Team{Name: "timeredbull"}
@@ -113,6 +193,21 @@ func (s *S) TestCheckUserAccess(c *check.C) {
 	c.Assert(CheckUserAccess([]string{t.Name}, &u2), check.Equals, false)
 }
 
+func (s *S) TestCheckUserAccessLevel(c *check.C) {
+	owner := User{Email: "owner@ledzeppelin.com"}
+	viewer := User{Email: "viewer@ledzeppelin.com"}
+	t := Team{Name: "ledzeppelin", Users: []string{owner.Email, viewer.Email}, Owners: []string{owner.Email}, Viewers: []string{viewer.Email}}
+	err := s.conn.Teams().Insert(t)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().Remove(bson.M{"_id": t.Name})
+	c.Assert(CheckUserAccessLevel([]string{t.Name}, &owner, TeamOwner), check.Equals, true)
+	c.Assert(CheckUserAccessLevel([]string{t.Name}, &viewer, TeamViewer), check.Equals, true)
+	c.Assert(CheckUserAccessLevel([]string{t.Name}, &viewer, TeamDeveloper), check.Equals, false)
+	c.Assert(CheckUserAccess([]string{t.Name}, &owner), check.Equals, true)
+	c.Assert(CheckUserAccess([]string{t.Name}, &viewer), check.Equals, false)
+	c.Assert(CheckUserReadAccess([]string{t.Name}, &viewer), check.Equals, true)
+}
+
 func (s *S) TestCheckUserAccessWithMultipleUsersOnMultipleTeams(c *check.C) {
 	one := User{Email: "imone@thewho.com", Password: "123"}
 	punk := User{Email: "punk@thewho.com", Password: "123"}
@@ -147,6 +242,96 @@ func (s *S) TestCreateTeam(c *check.C) {
 	c.Assert(err, check.IsNil)
 	expectedUsers := []string{"king@pos.com", "reconc@pos.com", "song@pos.com"}
 	c.Assert(team.Users, check.DeepEquals, expectedUsers)
+	c.Assert(team.Owners, check.DeepEquals, expectedUsers)
+}
+
+func (s *S) TestSyncTeams(c *check.C) {
+	owner := User{Email: "owner@tsuru.io"}
+	user := User{Email: "gopher@tsuru.io"}
+	err := CreateTeam("backend", &owner)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().Remove(bson.M{"_id": "backend"})
+	err = s.conn.Teams().Insert(Team{Name: "ops", Users: []string{owner.Email, user.Email}, Owners: []string{owner.Email}})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().Remove(bson.M{"_id": "ops"})
+	err = s.conn.Teams().Insert(Team{Name: "unmapped", Users: []string{user.Email}})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().Remove(bson.M{"_id": "unmapped"})
+	defer s.conn.Teams().Remove(bson.M{"_id": "frontend"})
+	mapping := map[string]string{"developers": "backend", "designers": "frontend", "sre": "ops", "qa": "qa"}
+	err = SyncTeams(&user, []string{"developers", "designers", "other"}, mapping)
+	c.Assert(err, check.IsNil)
+	team, err := GetTeam("backend")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.ContainsUser(&user), check.Equals, true)
+	c.Assert(team.Synced, check.Equals, true)
+	c.Assert(team.Level(&owner), check.Equals, TeamOwner)
+	team, err = GetTeam("frontend")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.Users, check.DeepEquals, []string{user.Email})
+	c.Assert(team.Owners, check.HasLen, 0)
+	c.Assert(team.Synced, check.Equals, true)
+	c.Assert(team.Level(&user), check.Equals, TeamDeveloper)
+	team, err = GetTeam("ops")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.ContainsUser(&user), check.Equals, false)
+	team, err = GetTeam("unmapped")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.ContainsUser(&user), check.Equals, true)
+	c.Assert(team.Synced, check.Equals, false)
+	_, err = GetTeam("qa")
+	c.Assert(err, check.Equals, ErrTeamNotFound)
+}
+
+func (s *S) TestSyncTeamsRemovesLastOwner(c *check.C) {
+	user := User{Email: "gopher@tsuru.io"}
+	other := User{Email: "other@tsuru.io"}
+	err := s.conn.Teams().Insert(Team{Name: "ops", Users: []string{user.Email, other.Email}, Owners: []string{user.Email}})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().Remove(bson.M{"_id": "ops"})
+	err = SyncTeams(&user, nil, map[string]string{"sre": "ops"})
+	c.Assert(err, check.IsNil)
+	team, err := GetTeam("ops")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.Users, check.DeepEquals, []string{other.Email})
+	c.Assert(team.Owners, check.HasLen, 0)
+	c.Assert(team.Level(&other), check.Equals, TeamDeveloper)
+}
+
+func (s *S) TestSyncTeamsKeepsLegacyOwners(c *check.C) {
+	user := User{Email: "gopher@tsuru.io"}
+	other := User{Email: "other@tsuru.io"}
+	err := s.conn.Teams().Insert(Team{Name: "ops", Users: []string{other.Email}})
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().Remove(bson.M{"_id": "ops"})
+	err = SyncTeams(&user, []string{"sre"}, map[string]string{"sre": "ops"})
+	c.Assert(err, check.IsNil)
+	team, err := GetTeam("ops")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.Level(&other), check.Equals, TeamOwner)
+	c.Assert(team.Level(&user), check.Equals, TeamDeveloper)
+}
+
+func (s *S) TestSyncedTeamDoesNotNeedOwners(c *check.C) {
+	user := User{Email: "gopher@tsuru.io"}
+	other := User{Email: "other@tsuru.io"}
+	team := Team{Name: "ops", Users: []string{user.Email, other.Email}, Owners: []string{user.Email}, Synced: true}
+	err := team.SetLevel(&user, TeamDeveloper)
+	c.Assert(err, check.IsNil)
+	c.Assert(team.Owners, check.HasLen, 0)
+	c.Assert(team.Level(&user), check.Equals, TeamDeveloper)
+}
+
+func (s *S) TestCreateTeamWithDefaultQuotas(c *check.C) {
+	config.Set("quota:apps-per-team", 10)
+	defer config.Unset("quota:apps-per-team")
+	err := CreateTeam("pos")
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().Remove(bson.M{"_id": "pos"})
+	team, err := GetTeam("pos")
+	c.Assert(err, check.IsNil)
+	c.Assert(team.AppQuota, check.DeepEquals, &quota.Quota{Limit: 10})
+	c.Assert(team.UnitQuota, check.IsNil)
 }
 
 func (s *S) TestCreateTeamDuplicate(c *check.C) {
@@ -33,6 +33,7 @@ type User struct {
 	Password string
 	quota.Quota
 	APIKey string
+	Roles  []RoleInstance `bson:",omitempty"`
 }
 
 // ListUsers list all users registred in tsuru
@@ -100,6 +101,10 @@ func (u *User) Delete() error {
 	if err != nil {
 		log.Errorf("failed to remove user %q from the database: %s", u.Email, err)
 	}
+	_, err = conn.APITokens().RemoveAll(bson.M{"email": u.Email})
+	if err != nil {
+		log.Errorf("failed to remove api tokens of user %q from the database: %s", u.Email, err)
+	}
 	err = repository.Manager().RemoveUser(u.Email)
 	if err != nil {
 		log.Errorf("failed to remove user %q from the repository manager: %s", u.Email, err)
@@ -148,7 +153,52 @@ func (u *User) RemoveKey(key repository.Key) error {
 	return ErrKeyDisabled
 }
 
+// IsAdmin checks whether the user has admin privileges, being a member of the
+// admin team or having a global role granting all permissions. When
+// auth:two-factor:enforce-admins is set, these users don't have admin
+// privileges until they enable two-factor authentication.
 func (u *User) IsAdmin() bool {
+	return CheckPermission(u, PermAll)
+}
+
+// TwoFactorMissing checks whether the user would have admin privileges, but
+// lacks them because two-factor authentication is not enabled.
+func (u *User) TwoFactorMissing() bool {
+	if !u.InAdminTeam() {
+		roles, err := u.loadRoles()
+		if err != nil || !hasAdminRole(u, roles) {
+			return false
+		}
+	}
+	return u.adminTwoFactorMissing()
+}
+
+// adminTwoFactorMissing checks whether two-factor authentication is required
+// for admins, through auth:two-factor:enforce-admins, and the user hasn't
+// enabled it. It's only required when the authentication scheme in use
+// supports it.
+func (u *User) adminTwoFactorMissing() bool {
+	if enforce, _ := config.GetBool("auth:two-factor:enforce-admins"); !enforce {
+		return false
+	}
+	name, _ := config.GetString("auth:scheme")
+	if name == "" {
+		name = "native"
+	}
+	scheme, err := GetScheme(name)
+	if err != nil {
+		return false
+	}
+	tfScheme, ok := scheme.(TwoFactorScheme)
+	if !ok {
+		return false
+	}
+	enabled, err := tfScheme.TwoFactorEnabled(u)
+	return err != nil || !enabled
+}
+
+// InAdminTeam checks whether the user is a member of the admin team.
+func (u *User) InAdminTeam() bool {
 	adminTeamName, err := config.GetString("admin-team")
 	if err != nil {
 		return false
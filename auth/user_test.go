@@ -205,6 +205,92 @@ func (s *S) TestIsAdminReturnsFalseWhenUserDoNotHaveATeamNamedWithAdminTeamConf(
 	c.Assert(s.user.IsAdmin(), check.Equals, false)
 }
 
+type twoFactorTestScheme struct {
+	TestScheme
+	enabled bool
+}
+
+func (t twoFactorTestScheme) TwoFactorEnabled(user *User) (bool, error) {
+	return t.enabled, nil
+}
+func (t twoFactorTestScheme) StartTwoFactorEnrollment(user *User) (string, error) {
+	return "", nil
+}
+func (t twoFactorTestScheme) ConfirmTwoFactorEnrollment(user *User, code string) ([]string, error) {
+	return nil, nil
+}
+func (t twoFactorTestScheme) RegenerateRecoveryCodes(user *User, code, ip string) ([]string, error) {
+	return nil, nil
+}
+func (t twoFactorTestScheme) DisableTwoFactor(user *User, code, ip string) error {
+	return nil
+}
+
+func (s *S) TestIsAdminEnforcesTwoFactor(c *check.C) {
+	adminTeamName, err := config.GetString("admin-team")
+	c.Assert(err, check.IsNil)
+	t := Team{Name: adminTeamName, Users: []string{s.user.Email}}
+	err = s.conn.Teams().Insert(&t)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(t.Name)
+	config.Set("auth:scheme", "twofactor")
+	defer config.Unset("auth:scheme")
+	config.Set("auth:two-factor:enforce-admins", true)
+	defer config.Unset("auth:two-factor:enforce-admins")
+	RegisterScheme("twofactor", twoFactorTestScheme{})
+	defer UnregisterScheme("twofactor")
+	c.Assert(s.user.IsAdmin(), check.Equals, false)
+	c.Assert(s.user.TwoFactorMissing(), check.Equals, true)
+	c.Assert(CheckPermission(s.user, PermAll), check.Equals, false)
+	RegisterScheme("twofactor", twoFactorTestScheme{enabled: true})
+	c.Assert(s.user.IsAdmin(), check.Equals, true)
+	c.Assert(s.user.TwoFactorMissing(), check.Equals, false)
+	c.Assert(CheckPermission(s.user, PermAll), check.Equals, true)
+}
+
+func (s *S) TestCheckPermissionEnforcesTwoFactorForAdminRoles(c *check.C) {
+	config.Set("auth:scheme", "twofactor")
+	defer config.Unset("auth:scheme")
+	config.Set("auth:two-factor:enforce-admins", true)
+	defer config.Unset("auth:two-factor:enforce-admins")
+	RegisterScheme("twofactor", twoFactorTestScheme{})
+	defer UnregisterScheme("twofactor")
+	_, err := CreateRole("superuser", CtxGlobal, PermAll)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("superuser")
+	_, err = CreateRole("deployer", CtxGlobal, PermAppDeploy)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Roles().RemoveId("deployer")
+	u := User{Email: "root@tsuru.io", Password: "123456"}
+	err = u.Create()
+	c.Assert(err, check.IsNil)
+	defer u.Delete()
+	err = u.AddRole("superuser", "")
+	c.Assert(err, check.IsNil)
+	c.Assert(CheckPermission(&u, PermAll), check.Equals, false)
+	c.Assert(CheckPermission(&u, PermAppDeploy), check.Equals, false)
+	c.Assert(u.IsAdmin(), check.Equals, false)
+	c.Assert(u.TwoFactorMissing(), check.Equals, true)
+	err = u.AddRole("deployer", "")
+	c.Assert(err, check.IsNil)
+	c.Assert(CheckPermission(&u, PermAppDeploy), check.Equals, true)
+	c.Assert(CheckPermission(&u, PermAll), check.Equals, false)
+	RegisterScheme("twofactor", twoFactorTestScheme{enabled: true})
+	c.Assert(CheckPermission(&u, PermAll), check.Equals, true)
+	c.Assert(u.IsAdmin(), check.Equals, true)
+	c.Assert(u.TwoFactorMissing(), check.Equals, false)
+}
+
+func (s *S) TestTwoFactorMissingNotAdmin(c *check.C) {
+	config.Set("auth:scheme", "twofactor")
+	defer config.Unset("auth:scheme")
+	config.Set("auth:two-factor:enforce-admins", true)
+	defer config.Unset("auth:two-factor:enforce-admins")
+	RegisterScheme("twofactor", twoFactorTestScheme{})
+	defer UnregisterScheme("twofactor")
+	c.Assert(s.user.TwoFactorMissing(), check.Equals, false)
+}
+
 type testApp struct {
 	Name  string
 	Teams []string
@@ -7,7 +7,7 @@ package cmd
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
+	gerrors "errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,6 +15,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/tsuru/tsuru/errors"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -45,12 +46,12 @@ func nativeLogin(context *Context, client *Client) error {
 	if err != nil {
 		return err
 	}
-	b := bytes.NewBufferString(`{"password":"` + password + `"}`)
-	request, err := http.NewRequest("POST", url, b)
-	if err != nil {
-		return err
+	params := map[string]string{"password": password}
+	response, err := requestToken(client, url, params)
+	if e, ok := err.(*errors.HTTP); ok && e.Code == http.StatusPreconditionFailed {
+		params["otp"] = readTwoFactorCode(context)
+		response, err = requestToken(client, url, params)
 	}
-	response, err := client.Do(request)
 	if err != nil {
 		return err
 	}
@@ -68,6 +69,18 @@ func nativeLogin(context *Context, client *Client) error {
 	return writeToken(out["token"].(string))
 }
 
+func requestToken(client *Client, url string, params map[string]string) (*http.Response, error) {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(request)
+}
+
 func (c *login) getScheme() *loginScheme {
 	if c.scheme == nil {
 		info, err := schemeInfo()
@@ -81,7 +94,7 @@ func (c *login) getScheme() *loginScheme {
 }
 
 func (c *login) Run(context *Context, client *Client) error {
-	if c.getScheme().Name == "oauth" {
+	if name := c.getScheme().Name; name == "oauth" || name == "oidc" {
 		return c.oauthLogin(context, client)
 	}
 	return nativeLogin(context, client)
@@ -94,8 +107,9 @@ func (c *login) Info() *Info {
 		Usage: usage,
 		Desc: `Initiates a new tsuru session for a user. If using tsuru native authentication
 scheme, it will ask for the email and the password and check if the user is
-successfully authenticated. If using OAuth, it will open a web browser for the
-user to complete the login.
+successfully authenticated. Users with two-factor authentication enabled will
+also be asked for the authentication code. If using OAuth or OpenID Connect, it
+will open a web browser for the user to complete the login.
 
 After that, the token generated by the tsuru server will be stored in
 [[${HOME}/.tsuru_token]].
@@ -123,7 +137,7 @@ func (c *logout) Run(context *Context, client *Client) error {
 	}
 	err := filesystem().Remove(JoinWithUserDir(".tsuru_token"))
 	if err != nil && os.IsNotExist(err) {
-		return errors.New("You're not logged in!")
+		return gerrors.New("You're not logged in!")
 	}
 	fmt.Fprintln(context.Stdout, "Successfully logged out!")
 	return nil
@@ -180,7 +194,7 @@ func PasswordFromReader(reader io.Reader) (string, error) {
 	}
 	if len(password) == 0 {
 		msg := "You must provide the password!"
-		return "", errors.New(msg)
+		return "", gerrors.New(msg)
 	}
 	return string(password), err
 }
@@ -6,6 +6,7 @@ package cmd
 
 import (
 	"bytes"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -89,6 +90,43 @@ func (s *S) TestNativeLoginShouldNotDependOnTsuruTokenFile(c *check.C) {
 	c.Assert(manager.stdout.(*bytes.Buffer).String(), check.Equals, expected)
 }
 
+func (s *S) TestNativeLoginWithTwoFactor(c *check.C) {
+	nativeScheme()
+	fsystem = &fstest.RecordingFs{FileContent: "old-token"}
+	defer func() {
+		fsystem = nil
+	}()
+	expected := "Password: \nTwo-factor authentication code: Successfully logged in!\n"
+	reader := strings.NewReader("chico\n123456\n")
+	context := Context{[]string{"foo@foo.com"}, manager.stdout, manager.stderr, reader}
+	transport := cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			{
+				Transport: cmdtest.Transport{Message: "two-factor authentication code required", Status: http.StatusPreconditionFailed},
+				CondFunc: func(r *http.Request) bool {
+					body, _ := ioutil.ReadAll(r.Body)
+					return r.URL.Path == "/users/foo@foo.com/tokens" && string(body) == `{"password":"chico"}`
+				},
+			},
+			{
+				Transport: cmdtest.Transport{Message: `{"token": "sometoken", "is_admin": true}`, Status: http.StatusOK},
+				CondFunc: func(r *http.Request) bool {
+					body, _ := ioutil.ReadAll(r.Body)
+					return r.URL.Path == "/users/foo@foo.com/tokens" && string(body) == `{"otp":"123456","password":"chico"}`
+				},
+			},
+		},
+	}
+	client := NewClient(&http.Client{Transport: &transport}, nil, manager)
+	command := login{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(manager.stdout.(*bytes.Buffer).String(), check.Equals, expected)
+	token, err := ReadToken()
+	c.Assert(err, check.IsNil)
+	c.Assert(token, check.Equals, "sometoken")
+}
+
 func (s *S) TestNativeLoginShouldReturnErrorIfThePasswordIsNotGiven(c *check.C) {
 	nativeScheme()
 	context := Context{[]string{"foo@foo.com"}, manager.stdout, manager.stderr, strings.NewReader("\n")}
@@ -67,6 +67,12 @@ func BuildBaseManager(name, version, versionHeader string, lookup Lookup) *Manag
 	m.Register(&targetRemove{})
 	m.Register(&targetSet{})
 	m.Register(userInfo{})
+	m.Register(&tokenCreate{})
+	m.Register(tokenList{})
+	m.Register(tokenRevoke{})
+	m.Register(twoFactorEnable{})
+	m.Register(twoFactorDisable{})
+	m.Register(twoFactorRecoveryCodes{})
 	m.RegisterTopic("target", fmt.Sprintf(targetTopic, name))
 	return m
 }
@@ -612,6 +612,32 @@ func (s *S) TestUserInfoIsRegisteredByBaseManager(c *check.C) {
 	c.Assert(info, check.FitsTypeOf, userInfo{})
 }
 
+func (s *S) TestTokenCommandsAreRegisteredByBaseManager(c *check.C) {
+	manager := BuildBaseManager("tsuru", "1.0", "", nil)
+	create, ok := manager.Commands["token-create"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(create, check.FitsTypeOf, &tokenCreate{})
+	list, ok := manager.Commands["token-list"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(list, check.FitsTypeOf, tokenList{})
+	revoke, ok := manager.Commands["token-revoke"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(revoke, check.FitsTypeOf, tokenRevoke{})
+}
+
+func (s *S) TestTwoFactorCommandsAreRegisteredByBaseManager(c *check.C) {
+	manager := BuildBaseManager("tsuru", "1.0", "", nil)
+	enable, ok := manager.Commands["two-factor-enable"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(enable, check.FitsTypeOf, twoFactorEnable{})
+	disable, ok := manager.Commands["two-factor-disable"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(disable, check.FitsTypeOf, twoFactorDisable{})
+	recovery, ok := manager.Commands["two-factor-recovery-codes"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(recovery, check.FitsTypeOf, twoFactorRecoveryCodes{})
+}
+
 func (s *S) TestInvalidCommandFuzzyMatch01(c *check.C) {
 	lookup := func(ctx *Context) error {
 		return os.ErrNotExist
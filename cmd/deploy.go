@@ -0,0 +1,46 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type AppDeployCancel struct {
+	GuessingCommand
+}
+
+func (c *AppDeployCancel) Info() *Info {
+	return &Info{
+		Name:  "app-deploy-cancel",
+		Usage: "app-deploy-cancel [-a/--app <appname>]",
+		Desc: `Cancels the deploy in progress for the app. The build is stopped, the
+changes made by the deploy are rolled back and the deploy is recorded as
+canceled.`,
+		MinArgs: 0,
+	}
+}
+
+func (c *AppDeployCancel) Run(context *Context, client *Client) error {
+	appName, err := c.Guess()
+	if err != nil {
+		return err
+	}
+	url, err := GetURL(fmt.Sprintf("/apps/%s/deploy", appName))
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	_, err = client.Do(request)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Deploy of app %q successfully canceled.\n", appName)
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestAppDeployCancelInfo(c *check.C) {
+	var command AppDeployCancel
+	info := command.Info()
+	c.Assert(info, check.NotNil)
+	c.Assert(info.Name, check.Equals, "app-deploy-cancel")
+}
+
+func (s *S) TestAppDeployCancelRun(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	var called bool
+	context := Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	trans := cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: "", Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			called = true
+			return req.Method == "DELETE" && req.URL.Path == "/apps/myapp/deploy"
+		},
+	}
+	client := NewClient(&http.Client{Transport: &trans}, nil, manager)
+	command := AppDeployCancel{GuessingCommand{G: &cmdtest.FakeGuesser{Name: "myapp"}}}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(called, check.Equals, true)
+	c.Assert(stdout.String(), check.Equals, "Deploy of app \"myapp\" successfully canceled.\n")
+}
+
+func (s *S) TestAppDeployCancelRunWithoutDeployInProgress(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	trans := cmdtest.Transport{Message: "there is no deploy in progress for this app", Status: http.StatusNotFound}
+	client := NewClient(&http.Client{Transport: &trans}, nil, manager)
+	command := AppDeployCancel{GuessingCommand{G: &cmdtest.FakeGuesser{Name: "myapp"}}}
+	err := command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, "there is no deploy in progress for this app")
+}
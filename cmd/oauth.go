@@ -6,7 +6,11 @@ package cmd
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -18,6 +22,8 @@ import (
 
 var execut exec.Executor
 
+var errInvalidState = errors.New("the authorization response doesn't match the login request")
+
 const callbackPage = `<!DOCTYPE html>
 <html>
 <head>
@@ -59,9 +65,40 @@ func port(schemeData map[string]string) string {
 	return ":0"
 }
 
-func convertToken(code, redirectUrl string) (string, error) {
+// randomValue generates an unguessable value, used as the state and the nonce
+// of the authorization request.
+func randomValue() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64URLEncode(b[:]), nil
+}
+
+// pkceVerifier generates a PKCE code verifier (RFC 7636), which is sent along
+// with the code when the scheme supports it.
+func pkceVerifier() (string, error) {
+	return randomValue()
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64URLEncode(sum[:])
+}
+
+func base64URLEncode(data []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
+}
+
+func convertToken(code, redirectUrl, verifier, nonce string) (string, error) {
 	var token string
 	params := map[string]string{"code": code, "redirectUrl": redirectUrl}
+	if verifier != "" {
+		params["code_verifier"] = verifier
+	}
+	if nonce != "" {
+		params["nonce"] = nonce
+	}
 	u, err := GetURL("/auth/login")
 	if err != nil {
 		return token, fmt.Errorf("Error in GetURL: %s", err.Error())
@@ -88,13 +125,20 @@ func convertToken(code, redirectUrl string) (string, error) {
 	return data["token"].(string), nil
 }
 
-func callback(redirectUrl string, finish chan bool) http.HandlerFunc {
+// callback handles the redirect from the authorization server. Responses
+// whose state doesn't match the one sent in the authorization request are
+// refused, so the code is never exchanged.
+func callback(redirectUrl, state, verifier, nonce string, finish chan bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			finish <- true
 		}()
 		var page string
-		token, err := convertToken(r.URL.Query().Get("code"), redirectUrl)
+		var token string
+		err := errInvalidState
+		if r.URL.Query().Get("state") == state {
+			token, err = convertToken(r.URL.Query().Get("code"), redirectUrl, verifier, nonce)
+		}
 		if err == nil {
 			writeToken(token)
 			page = fmt.Sprintf(callbackPage, successMarkup)
@@ -120,7 +164,24 @@ func (c *login) oauthLogin(context *Context, client *Client) error {
 	}
 	redirectUrl := fmt.Sprintf("http://localhost:%s", port)
 	authUrl := strings.Replace(schemeData["authorizeUrl"], "__redirect_url__", redirectUrl, 1)
-	http.HandleFunc("/", callback(redirectUrl, finish))
+	state, err := randomValue()
+	if err != nil {
+		return err
+	}
+	nonce, err := randomValue()
+	if err != nil {
+		return err
+	}
+	authUrl += "&state=" + state + "&nonce=" + nonce
+	var verifier string
+	if schemeData["pkce"] == "S256" {
+		verifier, err = pkceVerifier()
+		if err != nil {
+			return err
+		}
+		authUrl += "&code_challenge=" + pkceChallenge(verifier) + "&code_challenge_method=S256"
+	}
+	http.HandleFunc("/", callback(redirectUrl, state, verifier, nonce, finish))
 	server := &http.Server{}
 	go server.Serve(l)
 	err = open(authUrl)
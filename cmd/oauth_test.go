@@ -5,6 +5,7 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -51,7 +52,7 @@ func (s *S) TestCallbackHandler(c *check.C) {
 	writeTarget(ts.URL)
 	redirectUrl := "someurl"
 	finish := make(chan bool, 1)
-	handler := callback(redirectUrl, finish)
+	handler := callback(redirectUrl, "", "", "", finish)
 	body := `{"code":"xpto"}`
 	request, err := http.NewRequest("GET", "/", strings.NewReader(body))
 	c.Assert(err, check.IsNil)
@@ -66,3 +67,68 @@ func (s *S) TestCallbackHandler(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Assert(string(data), check.Equals, "xpto")
 }
+
+func (s *S) TestCallbackHandlerWithVerifier(c *check.C) {
+	var params map[string]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&params)
+		w.Write([]byte(`{"token": "xpto"}`))
+	}))
+	defer ts.Close()
+	rfs := &fstest.RecordingFs{}
+	fsystem = rfs
+	defer func() {
+		fsystem = nil
+	}()
+	writeTarget(ts.URL)
+	finish := make(chan bool, 1)
+	handler := callback("someurl", "state", "verifier", "nonce", finish)
+	request, err := http.NewRequest("GET", "/?code=abc&state=state", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	c.Assert(<-finish, check.Equals, true)
+	c.Assert(params, check.DeepEquals, map[string]string{
+		"code":          "abc",
+		"redirectUrl":   "someurl",
+		"code_verifier": "verifier",
+		"nonce":         "nonce",
+	})
+}
+
+func (s *S) TestCallbackHandlerInvalidState(c *check.C) {
+	var called bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.Write([]byte(`{"token": "xpto"}`))
+	}))
+	defer ts.Close()
+	rfs := &fstest.RecordingFs{}
+	fsystem = rfs
+	defer func() {
+		fsystem = nil
+	}()
+	writeTarget(ts.URL)
+	finish := make(chan bool, 1)
+	handler := callback("someurl", "state", "verifier", "nonce", finish)
+	request, err := http.NewRequest("GET", "/?code=abc&state=other", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	c.Assert(<-finish, check.Equals, true)
+	c.Assert(called, check.Equals, false)
+	expectedPage := fmt.Sprintf(callbackPage, fmt.Sprintf(errorMarkup, errInvalidState.Error()))
+	c.Assert(recorder.Body.String(), check.Equals, expectedPage)
+}
+
+func (s *S) TestPKCE(c *check.C) {
+	verifier, err := pkceVerifier()
+	c.Assert(err, check.IsNil)
+	c.Assert(verifier, check.Matches, `^[A-Za-z0-9_-]{43}$`)
+	other, err := pkceVerifier()
+	c.Assert(err, check.IsNil)
+	c.Assert(other, check.Not(check.Equals), verifier)
+	// example from RFC 7636, appendix B.
+	challenge := pkceChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	c.Assert(challenge, check.Equals, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM")
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"launchpad.net/gnuflag"
+)
+
+type quotaUsage struct {
+	Limit int
+	InUse int
+}
+
+func (q quotaUsage) String() string {
+	if q.Limit < 0 {
+		return fmt.Sprintf("%d/unlimited", q.InUse)
+	}
+	return fmt.Sprintf("%d/%d", q.InUse, q.Limit)
+}
+
+type TeamQuotaView struct{}
+
+func (c *TeamQuotaView) Info() *Info {
+	return &Info{
+		Name:    "team-quota-view",
+		Usage:   "team-quota-view <teamname>",
+		Desc:    "Displays the number of apps owned by the team and the number of units of these apps, along with the limits of the team.",
+		MinArgs: 1,
+	}
+}
+
+func (c *TeamQuotaView) Run(context *Context, client *Client) error {
+	teamName := context.Args[0]
+	url, err := GetURL(fmt.Sprintf("/teams/%s/quota", teamName))
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	var quotas map[string]quotaUsage
+	err = json.NewDecoder(response.Body).Decode(&quotas)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Team: %s\n", teamName)
+	fmt.Fprintf(context.Stdout, "Apps: %s\n", quotas["apps"])
+	fmt.Fprintf(context.Stdout, "Units: %s\n", quotas["units"])
+	return nil
+}
+
+type TeamQuotaChange struct {
+	fs    *gnuflag.FlagSet
+	apps  string
+	units string
+}
+
+func (c *TeamQuotaChange) Info() *Info {
+	return &Info{
+		Name:  "team-quota-change",
+		Usage: "team-quota-change <teamname> [--apps <limit>] [--units <limit>]",
+		Desc: `Changes the limit of apps owned by the team and the limit of units of
+these apps. Negative limits mean unlimited, and limits that are not
+provided are kept unchanged. Only admin users can change quotas.`,
+		MinArgs: 1,
+	}
+}
+
+func (c *TeamQuotaChange) Run(context *Context, client *Client) error {
+	teamName := context.Args[0]
+	params := make(url.Values)
+	if c.apps != "" {
+		params.Set("apps", c.apps)
+	}
+	if c.units != "" {
+		params.Set("units", c.units)
+	}
+	if len(params) == 0 {
+		return errors.New("You must provide the limit of apps or units.")
+	}
+	url, err := GetURL(fmt.Sprintf("/teams/%s/quota", teamName))
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", url, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = client.Do(request)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Quota of team %q successfully changed.\n", teamName)
+	return nil
+}
+
+func (c *TeamQuotaChange) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("team-quota-change", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.apps, "apps", "", "The maximum number of apps owned by the team")
+		c.fs.StringVar(&c.units, "units", "", "The maximum number of units of the apps owned by the team")
+	}
+	return c.fs
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestTeamQuotaViewInfo(c *check.C) {
+	var command TeamQuotaView
+	info := command.Info()
+	c.Assert(info, check.NotNil)
+	c.Assert(info.Name, check.Equals, "team-quota-view")
+	c.Assert(info.MinArgs, check.Equals, 1)
+}
+
+func (s *S) TestTeamQuotaViewRun(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := Context{
+		Args:   []string{"myteam"},
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	trans := cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{
+			Message: `{"apps":{"Limit":4,"InUse":1},"units":{"Limit":-1,"InUse":3}}`,
+			Status:  http.StatusOK,
+		},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && req.URL.Path == "/teams/myteam/quota"
+		},
+	}
+	client := NewClient(&http.Client{Transport: &trans}, nil, manager)
+	command := TeamQuotaView{}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Team: myteam\nApps: 1/4\nUnits: 3/unlimited\n")
+}
+
+func (s *S) TestTeamQuotaChangeInfo(c *check.C) {
+	var command TeamQuotaChange
+	info := command.Info()
+	c.Assert(info, check.NotNil)
+	c.Assert(info.Name, check.Equals, "team-quota-change")
+	c.Assert(info.MinArgs, check.Equals, 1)
+}
+
+func (s *S) TestTeamQuotaChangeRun(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	var called bool
+	context := Context{
+		Args:   []string{"myteam"},
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	trans := cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: "", Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			called = true
+			body, _ := ioutil.ReadAll(req.Body)
+			return req.Method == "POST" && req.URL.Path == "/teams/myteam/quota" &&
+				string(body) == "apps=10"
+		},
+	}
+	client := NewClient(&http.Client{Transport: &trans}, nil, manager)
+	command := TeamQuotaChange{}
+	command.Flags().Parse(true, []string{"--apps", "10"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(called, check.Equals, true)
+	c.Assert(stdout.String(), check.Equals, "Quota of team \"myteam\" successfully changed.\n")
+}
+
+func (s *S) TestTeamQuotaChangeRunWithoutLimits(c *check.C) {
+	context := Context{Args: []string{"myteam"}}
+	command := TeamQuotaChange{}
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "You must provide the limit of apps or units.")
+}
+
+func (s *S) TestTeamQuotaChangeFlags(c *check.C) {
+	command := TeamQuotaChange{}
+	flagset := command.Flags()
+	c.Assert(flagset, check.NotNil)
+	flagset.Parse(true, []string{"--apps", "3", "--units", "-1"})
+	c.Assert(command.apps, check.Equals, "3")
+	c.Assert(command.units, check.Equals, "-1")
+}
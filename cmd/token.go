@@ -0,0 +1,182 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"launchpad.net/gnuflag"
+)
+
+type apiToken struct {
+	Name       string
+	Apps       []string
+	Actions    []string
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+}
+
+type tokenCreate struct {
+	fs      *gnuflag.FlagSet
+	expires time.Duration
+	apps    StringSliceFlag
+	actions StringSliceFlag
+}
+
+func (c *tokenCreate) Info() *Info {
+	return &Info{
+		Name:  "token-create",
+		Usage: "token-create <name> [--expires <duration>] [--app <appname>]... [--action <action>]...",
+		Desc: `Creates a named API token for the current user. The token is displayed only
+once, so store it in a safe place.
+
+The token may be restricted to some apps and to some actions, like app.deploy,
+app.env.read, app.env.set, node.manage and service.instance.create. Tokens
+expire after the given duration (for example, 720h), or never expire when no
+duration is given.`,
+		MinArgs: 1,
+	}
+}
+
+func (c *tokenCreate) Run(context *Context, client *Client) error {
+	params := url.Values{}
+	params.Set("name", context.Args[0])
+	if c.expires < 0 {
+		return errors.New("The expiration must be a positive duration.")
+	}
+	if c.expires > 0 {
+		params.Set("expires", fmt.Sprintf("%d", int64(c.expires/time.Second)))
+	}
+	for _, app := range c.apps {
+		params.Add("app", app)
+	}
+	for _, action := range c.actions {
+		params.Add("action", action)
+	}
+	u, err := GetURL("/users/tokens")
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", u, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	var result map[string]string
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Token %q successfully created: %s\n", result["name"], result["token"])
+	return nil
+}
+
+func (c *tokenCreate) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("token-create", gnuflag.ExitOnError)
+		c.fs.DurationVar(&c.expires, "expires", 0, "The duration of the token, it never expires by default")
+		c.fs.Var(&c.apps, "app", "App in which the token can be used, may be repeated")
+		c.fs.Var(&c.actions, "action", "Action that can be performed with the token, may be repeated")
+	}
+	return c.fs
+}
+
+type tokenList struct{}
+
+func (tokenList) Info() *Info {
+	return &Info{
+		Name:  "token-list",
+		Usage: "token-list",
+		Desc:  "Lists the named API tokens of the current user.",
+	}
+}
+
+func (tokenList) Run(context *Context, client *Client) error {
+	u, err := GetURL("/users/tokens")
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNoContent {
+		fmt.Fprintln(context.Stdout, "No API tokens.")
+		return nil
+	}
+	var tokens []apiToken
+	err = json.NewDecoder(response.Body).Decode(&tokens)
+	if err != nil {
+		return err
+	}
+	table := NewTable()
+	table.Headers = Row{"Name", "Apps", "Actions", "Expires", "Last used"}
+	for _, t := range tokens {
+		apps := strings.Join(t.Apps, ", ")
+		if apps == "" {
+			apps = "all"
+		}
+		actions := strings.Join(t.Actions, ", ")
+		if actions == "" {
+			actions = "all"
+		}
+		expires := "never"
+		if !t.ExpiresAt.IsZero() {
+			expires = t.ExpiresAt.Format(time.RFC3339)
+		}
+		lastUsed := "never"
+		if !t.LastUsedAt.IsZero() {
+			lastUsed = t.LastUsedAt.Format(time.RFC3339)
+		}
+		table.AddRow(Row{t.Name, apps, actions, expires, lastUsed})
+	}
+	context.Stdout.Write(table.Bytes())
+	return nil
+}
+
+type tokenRevoke struct{}
+
+func (tokenRevoke) Info() *Info {
+	return &Info{
+		Name:    "token-revoke",
+		Usage:   "token-revoke <name>",
+		Desc:    "Revokes a named API token of the current user.",
+		MinArgs: 1,
+	}
+}
+
+func (tokenRevoke) Run(context *Context, client *Client) error {
+	name := context.Args[0]
+	u, err := GetURL("/users/tokens/" + url.QueryEscape(name))
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("DELETE", u, nil)
+	if err != nil {
+		return err
+	}
+	_, err = client.Do(request)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Token %q successfully revoked.\n", name)
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestTokenCreateInfo(c *check.C) {
+	var command tokenCreate
+	info := command.Info()
+	c.Assert(info, check.NotNil)
+	c.Assert(info.Name, check.Equals, "token-create")
+	c.Assert(info.MinArgs, check.Equals, 1)
+}
+
+func (s *S) TestTokenCreateRun(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := Context{
+		Args:   []string{"ci"},
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	trans := cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{
+			Message: `{"name":"ci","token":"abc123"}`,
+			Status:  http.StatusCreated,
+		},
+		CondFunc: func(req *http.Request) bool {
+			body, _ := ioutil.ReadAll(req.Body)
+			return req.Method == "POST" && req.URL.Path == "/users/tokens" &&
+				string(body) == "action=app.deploy&app=myapp&app=otherapp&expires=86400&name=ci"
+		},
+	}
+	client := NewClient(&http.Client{Transport: &trans}, nil, manager)
+	command := tokenCreate{}
+	command.Flags().Parse(true, []string{"--expires", "24h", "--app", "myapp", "--app", "otherapp", "--action", "app.deploy"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Token \"ci\" successfully created: abc123\n")
+}
+
+func (s *S) TestTokenCreateFlags(c *check.C) {
+	command := tokenCreate{}
+	flagset := command.Flags()
+	c.Assert(flagset, check.NotNil)
+	flagset.Parse(true, []string{"--app", "myapp"})
+	c.Assert(command.apps, check.DeepEquals, StringSliceFlag{"myapp"})
+	c.Assert(flagset.Lookup("expires"), check.NotNil)
+	c.Assert(flagset.Lookup("action"), check.NotNil)
+}
+
+func (s *S) TestTokenListRun(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	trans := cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{
+			Message: `[{"name":"ci","apps":["myapp"],"actions":["app.deploy"],"expiresAt":"2015-10-01T10:00:00Z","lastUsedAt":"0001-01-01T00:00:00Z"}]`,
+			Status:  http.StatusOK,
+		},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && req.URL.Path == "/users/tokens"
+		},
+	}
+	client := NewClient(&http.Client{Transport: &trans}, nil, manager)
+	err := tokenList{}.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `+------+-------+------------+----------------------+-----------+
+| Name | Apps  | Actions    | Expires              | Last used |
++------+-------+------------+----------------------+-----------+
+| ci   | myapp | app.deploy | 2015-10-01T10:00:00Z | never     |
++------+-------+------------+----------------------+-----------+
+`
+	c.Assert(stdout.String(), check.Equals, expected)
+}
+
+func (s *S) TestTokenListRunNoTokens(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	trans := cmdtest.Transport{Message: "", Status: http.StatusNoContent}
+	client := NewClient(&http.Client{Transport: &trans}, nil, manager)
+	err := tokenList{}.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "No API tokens.\n")
+}
+
+func (s *S) TestTokenRevokeRun(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := Context{
+		Args:   []string{"ci"},
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	trans := cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: "", Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "DELETE" && req.URL.Path == "/users/tokens/ci"
+		},
+	}
+	client := NewClient(&http.Client{Transport: &trans}, nil, manager)
+	err := tokenRevoke{}.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Token \"ci\" successfully revoked.\n")
+}
+
+func (s *S) TestTokenRevokeRunEscapesName(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := Context{
+		Args:   []string{"ci#1"},
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	trans := cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: "", Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "DELETE" && req.URL.Path == "/users/tokens/ci#1"
+		},
+	}
+	client := NewClient(&http.Client{Transport: &trans}, nil, manager)
+	err := tokenRevoke{}.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Token \"ci#1\" successfully revoked.\n")
+}
@@ -0,0 +1,55 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/tsuru/tsuru/app"
+	"github.com/tsuru/tsuru/cmd"
+	"launchpad.net/gnuflag"
+)
+
+type bindReconcileCmd struct {
+	fs  *gnuflag.FlagSet
+	fix bool
+}
+
+func (*bindReconcileCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "bind-reconcile",
+		Usage: "bind-reconcile [--fix]",
+		Desc: `Compares the apps bound to each service instance with the environment
+variables of the apps, reporting the binds that are only half done. With --fix,
+these binds are undone, so they can be done again with the bind command.`,
+	}
+}
+
+func (c *bindReconcileCmd) Run(context *cmd.Context, client *cmd.Client) error {
+	err := setupProvisioner()
+	if err != nil {
+		return err
+	}
+	mismatches, err := app.ReconcileServiceBindings(c.fix)
+	if err != nil {
+		return err
+	}
+	if len(mismatches) == 0 {
+		fmt.Fprintln(context.Stdout, "No bind mismatches found.")
+		return nil
+	}
+	for _, m := range mismatches {
+		fmt.Fprintln(context.Stdout, m)
+	}
+	return nil
+}
+
+func (c *bindReconcileCmd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("bind-reconcile", gnuflag.ExitOnError)
+		c.fs.BoolVar(&c.fix, "fix", false, "Undo the binds that are only half done")
+	}
+	return c.fs
+}
@@ -0,0 +1,45 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+
+	"github.com/tsuru/tsuru/app"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/provision/provisiontest"
+	"github.com/tsuru/tsuru/service"
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) TestBindReconcileCmdInfo(c *check.C) {
+	info := (&bindReconcileCmd{}).Info()
+	c.Assert(info.Name, check.Equals, "bind-reconcile")
+}
+
+func (s *S) TestBindReconcileCmdRun(c *check.C) {
+	oldProvisioner := app.Provisioner
+	app.Provisioner = provisiontest.NewFakeProvisioner()
+	defer func() { app.Provisioner = oldProvisioner }()
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	si := service.ServiceInstance{Name: "mydb", ServiceName: "mysql", Apps: []string{"ghost"}}
+	err = conn.ServiceInstances().Insert(si)
+	c.Assert(err, check.IsNil)
+	defer conn.ServiceInstances().Remove(bson.M{"name": si.Name})
+	var stdout bytes.Buffer
+	command := bindReconcileCmd{}
+	command.Flags().Parse(true, []string{"--fix"})
+	err = command.Run(&cmd.Context{Stdout: &stdout}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, `instance "mydb" of service "mysql" is bound to the app "ghost", which doesn't exist (fixed)`+"\n")
+	stdout.Reset()
+	err = command.Run(&cmd.Context{Stdout: &stdout}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "No bind mismatches found.\n")
+}
@@ -27,6 +27,8 @@ func buildManager() *cmd.Manager {
 	m.Register(&tsrCommand{Command: tokenCmd{}})
 	m.Register(&tsrCommand{Command: &migrateCmd{}})
 	m.Register(&tsrCommand{Command: gandalfSyncCmd{}})
+	m.Register(&tsrCommand{Command: &quotaReconcileCmd{}})
+	m.Register(&tsrCommand{Command: &bindReconcileCmd{}})
 	registerProvisionersCommands(m)
 	return m
 }
@@ -79,3 +79,21 @@ func (s *S) TestShouldRegisterAllCommandsFromProvisioners(c *check.C) {
 	c.Assert(ok, check.Equals, true)
 	c.Assert(tsrFake.Command, check.FitsTypeOf, &FakeCommand{})
 }
+
+func (s *S) TestQuotaReconcileCmdIsRegistered(c *check.C) {
+	manager := buildManager()
+	cmd, ok := manager.Commands["quota-reconcile"]
+	c.Assert(ok, check.Equals, true)
+	reconcile, ok := cmd.(*tsrCommand)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(reconcile.Command, check.FitsTypeOf, &quotaReconcileCmd{})
+}
+
+func (s *S) TestBindReconcileCmdIsRegistered(c *check.C) {
+	manager := buildManager()
+	cmd, ok := manager.Commands["bind-reconcile"]
+	c.Assert(ok, check.Equals, true)
+	reconcile, ok := cmd.(*tsrCommand)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(reconcile.Command, check.FitsTypeOf, &bindReconcileCmd{})
+}
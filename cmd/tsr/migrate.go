@@ -6,10 +6,12 @@ package main
 
 import (
 	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/app"
 	"github.com/tsuru/tsuru/cmd"
 	"github.com/tsuru/tsuru/migration"
 	"github.com/tsuru/tsuru/provision"
 	"github.com/tsuru/tsuru/provision/docker"
+	"github.com/tsuru/tsuru/service"
 	"launchpad.net/gnuflag"
 )
 
@@ -39,6 +41,10 @@ func (c *migrateCmd) Run(context *cmd.Context, client *cmd.Client) error {
 	if err != nil {
 		return err
 	}
+	err = migration.Register("metering-baseline", c.meteringBaseline)
+	if err != nil {
+		return err
+	}
 	return migration.Run(context.Stdout, c.dry)
 }
 
@@ -58,6 +64,18 @@ func (c *migrateCmd) migrateImages() error {
 	return nil
 }
 
+func (c *migrateCmd) meteringBaseline() error {
+	err := setupProvisioner()
+	if err != nil {
+		return err
+	}
+	err = app.RecordMeteringBaseline()
+	if err != nil {
+		return err
+	}
+	return service.RecordMeteringBaseline()
+}
+
 func (c *migrateCmd) Flags() *gnuflag.FlagSet {
 	if c.fs == nil {
 		c.fs = gnuflag.NewFlagSet("migrate", gnuflag.ExitOnError)
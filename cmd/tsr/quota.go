@@ -0,0 +1,77 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/tsuru/tsuru/app"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/provision"
+	"launchpad.net/gnuflag"
+)
+
+type quotaReconcileCmd struct {
+	fs  *gnuflag.FlagSet
+	fix bool
+}
+
+func (*quotaReconcileCmd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "quota-reconcile",
+		Usage: "quota-reconcile [--fix]",
+		Desc: `Recomputes the usage of the quotas of apps, users and teams from the units
+in the provisioner and the ownership of the apps, reporting the quotas whose
+recorded usage is wrong. With --fix, the recorded usage is also fixed.`,
+	}
+}
+
+func (c *quotaReconcileCmd) Run(context *cmd.Context, client *cmd.Client) error {
+	err := setupProvisioner()
+	if err != nil {
+		return err
+	}
+	mismatches, err := app.ReconcileQuotas(c.fix)
+	if err != nil {
+		return err
+	}
+	if len(mismatches) == 0 {
+		fmt.Fprintln(context.Stdout, "No quota mismatches found.")
+		return nil
+	}
+	for _, m := range mismatches {
+		fmt.Fprintln(context.Stdout, m)
+	}
+	return nil
+}
+
+func (c *quotaReconcileCmd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("quota-reconcile", gnuflag.ExitOnError)
+		c.fs.BoolVar(&c.fix, "fix", false, "Fix the recorded usage of the quotas")
+	}
+	return c.fs
+}
+
+// setupProvisioner initializes app.Provisioner with the configured
+// provisioner, unless it's already set.
+func setupProvisioner() error {
+	if app.Provisioner != nil {
+		return nil
+	}
+	name, _ := getProvisioner()
+	p, err := provision.Get(name)
+	if err != nil {
+		return err
+	}
+	if initializableProvisioner, ok := p.(provision.InitializableProvisioner); ok {
+		err = initializableProvisioner.Initialize()
+		if err != nil {
+			return err
+		}
+	}
+	app.Provisioner = p
+	return nil
+}
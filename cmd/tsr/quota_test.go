@@ -0,0 +1,45 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+
+	"github.com/tsuru/tsuru/app"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/provision/provisiontest"
+	"github.com/tsuru/tsuru/quota"
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) TestQuotaReconcileCmdInfo(c *check.C) {
+	info := (&quotaReconcileCmd{}).Info()
+	c.Assert(info.Name, check.Equals, "quota-reconcile")
+}
+
+func (s *S) TestQuotaReconcileCmdRun(c *check.C) {
+	oldProvisioner := app.Provisioner
+	app.Provisioner = provisiontest.NewFakeProvisioner()
+	defer func() { app.Provisioner = oldProvisioner }()
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	a := app.App{Name: "myapp", Quota: quota.Quota{Limit: -1, InUse: 2}}
+	err = conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer conn.Apps().Remove(bson.M{"name": a.Name})
+	var stdout bytes.Buffer
+	command := quotaReconcileCmd{}
+	command.Flags().Parse(true, []string{"--fix"})
+	err = command.Run(&cmd.Context{Stdout: &stdout}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "app myapp: recorded usage is 2, actual usage is 0 (fixed)\n")
+	stdout.Reset()
+	err = command.Run(&cmd.Context{Stdout: &stdout}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "No quota mismatches found.\n")
+}
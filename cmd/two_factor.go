@@ -0,0 +1,145 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func readTwoFactorCode(context *Context) string {
+	fmt.Fprint(context.Stdout, "Two-factor authentication code: ")
+	var code string
+	fmt.Fscanf(context.Stdin, "%s\n", &code)
+	return code
+}
+
+func postRecoveryCodes(client *Client, path, code string) ([]string, error) {
+	u, err := GetURL(path)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("code", code)
+	request, err := http.NewRequest("POST", u, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var result map[string][]string
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	return result["recovery_codes"], nil
+}
+
+func writeRecoveryCodes(context *Context, codes []string) {
+	fmt.Fprintln(context.Stdout, "Store the following recovery codes in a safe place. Each one of them can be used only once, in place of the authentication code:")
+	for _, code := range codes {
+		fmt.Fprintf(context.Stdout, "    %s\n", code)
+	}
+}
+
+type twoFactorEnable struct{}
+
+func (twoFactorEnable) Info() *Info {
+	return &Info{
+		Name:  "two-factor-enable",
+		Usage: "two-factor-enable",
+		Desc: `Enables two-factor authentication for the current user. The command displays
+a provisioning URI that must be added to an authenticator app, and then asks
+for the code generated by the app to confirm the enrollment.`,
+	}
+}
+
+func (twoFactorEnable) Run(context *Context, client *Client) error {
+	u, err := GetURL("/users/2fa")
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", u, nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	var result map[string]string
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Add the following URI to your authenticator app:\n\n    %s\n\n", result["uri"])
+	codes, err := postRecoveryCodes(client, "/users/2fa/confirm", readTwoFactorCode(context))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(context.Stdout, "\nTwo-factor authentication successfully enabled!")
+	writeRecoveryCodes(context, codes)
+	return nil
+}
+
+type twoFactorDisable struct{}
+
+func (twoFactorDisable) Info() *Info {
+	return &Info{
+		Name:  "two-factor-disable",
+		Usage: "two-factor-disable",
+		Desc: `Disables two-factor authentication for the current user. It asks for an
+authentication code, one of the recovery codes may be used instead.`,
+	}
+}
+
+func (twoFactorDisable) Run(context *Context, client *Client) error {
+	params := url.Values{}
+	params.Set("code", readTwoFactorCode(context))
+	u, err := GetURL("/users/2fa?" + params.Encode())
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("DELETE", u, nil)
+	if err != nil {
+		return err
+	}
+	_, err = client.Do(request)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(context.Stdout, "\nTwo-factor authentication successfully disabled.")
+	return nil
+}
+
+type twoFactorRecoveryCodes struct{}
+
+func (twoFactorRecoveryCodes) Info() *Info {
+	return &Info{
+		Name:  "two-factor-recovery-codes",
+		Usage: "two-factor-recovery-codes",
+		Desc: `Generates new recovery codes for the current user, invalidating the previous
+ones. It asks for an authentication code, one of the recovery codes may be used
+instead.`,
+	}
+}
+
+func (twoFactorRecoveryCodes) Run(context *Context, client *Client) error {
+	codes, err := postRecoveryCodes(client, "/users/2fa/recovery-codes", readTwoFactorCode(context))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(context.Stdout)
+	writeRecoveryCodes(context, codes)
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestTwoFactorEnableInfo(c *check.C) {
+	info := twoFactorEnable{}.Info()
+	c.Assert(info, check.NotNil)
+	c.Assert(info.Name, check.Equals, "two-factor-enable")
+}
+
+func (s *S) TestTwoFactorEnableRun(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+		Stdin:  strings.NewReader("123456\n"),
+	}
+	trans := cmdtest.MultiConditionalTransport{
+		ConditionalTransports: []cmdtest.ConditionalTransport{
+			{
+				Transport: cmdtest.Transport{Message: `{"uri":"otpauth://totp/tsuru:gopher@tsuru.io?secret=ABC"}`, Status: http.StatusOK},
+				CondFunc: func(req *http.Request) bool {
+					return req.Method == "POST" && req.URL.Path == "/users/2fa"
+				},
+			},
+			{
+				Transport: cmdtest.Transport{Message: `{"recovery_codes":["abcd-efgh","ijkl-mnop"]}`, Status: http.StatusOK},
+				CondFunc: func(req *http.Request) bool {
+					body, _ := ioutil.ReadAll(req.Body)
+					return req.Method == "POST" && req.URL.Path == "/users/2fa/confirm" && string(body) == "code=123456"
+				},
+			},
+		},
+	}
+	client := NewClient(&http.Client{Transport: &trans}, nil, manager)
+	err := twoFactorEnable{}.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Add the following URI to your authenticator app:
+
+    otpauth://totp/tsuru:gopher@tsuru.io?secret=ABC
+
+Two-factor authentication code: 
+Two-factor authentication successfully enabled!
+Store the following recovery codes in a safe place. Each one of them can be used only once, in place of the authentication code:
+    abcd-efgh
+    ijkl-mnop
+`
+	c.Assert(stdout.String(), check.Equals, expected)
+}
+
+func (s *S) TestTwoFactorDisableInfo(c *check.C) {
+	info := twoFactorDisable{}.Info()
+	c.Assert(info, check.NotNil)
+	c.Assert(info.Name, check.Equals, "two-factor-disable")
+}
+
+func (s *S) TestTwoFactorDisableRun(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+		Stdin:  strings.NewReader("abcd-efgh\n"),
+	}
+	trans := cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: "", Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "DELETE" && req.URL.Path == "/users/2fa" && req.URL.Query().Get("code") == "abcd-efgh"
+		},
+	}
+	client := NewClient(&http.Client{Transport: &trans}, nil, manager)
+	err := twoFactorDisable{}.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Two-factor authentication code: \nTwo-factor authentication successfully disabled.\n")
+}
+
+func (s *S) TestTwoFactorRecoveryCodesInfo(c *check.C) {
+	info := twoFactorRecoveryCodes{}.Info()
+	c.Assert(info, check.NotNil)
+	c.Assert(info.Name, check.Equals, "two-factor-recovery-codes")
+}
+
+func (s *S) TestTwoFactorRecoveryCodesRun(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+		Stdin:  strings.NewReader("123456\n"),
+	}
+	trans := cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: `{"recovery_codes":["abcd-efgh"]}`, Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			body, _ := ioutil.ReadAll(req.Body)
+			return req.Method == "POST" && req.URL.Path == "/users/2fa/recovery-codes" && string(body) == "code=123456"
+		},
+	}
+	client := NewClient(&http.Client{Transport: &trans}, nil, manager)
+	err := twoFactorRecoveryCodes{}.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s)Two-factor authentication code: \n.*\n    abcd-efgh\n$`)
+}
@@ -12,6 +12,8 @@
 package db
 
 import (
+	"time"
+
 	"github.com/tsuru/config"
 	"github.com/tsuru/tsuru/db/storage"
 	"github.com/tsuru/tsuru/hc"
@@ -86,11 +88,26 @@ func (s *Storage) Deploys() *storage.Collection {
 	return c
 }
 
+// RunningDeploys returns the collection of deploys in progress from MongoDB.
+func (s *Storage) RunningDeploys() *storage.Collection {
+	return s.Collection("running_deploys")
+}
+
+// Secrets returns the collection of secrets generated by tsuru from MongoDB.
+func (s *Storage) Secrets() *storage.Collection {
+	return s.Collection("secrets")
+}
+
 // Platforms returns the platforms collection from MongoDB.
 func (s *Storage) Platforms() *storage.Collection {
 	return s.Collection("platforms")
 }
 
+// PlatformRollouts returns the collection of platform rollouts from MongoDB.
+func (s *Storage) PlatformRollouts() *storage.Collection {
+	return s.Collection("platform_rollouts")
+}
+
 // Logs returns the logs collection from MongoDB.
 func (s *Storage) Logs(appName string) *storage.Collection {
 	if appName == "" {
@@ -170,3 +187,59 @@ func (s *Storage) Quota() *storage.Collection {
 	c.EnsureIndex(userIndex)
 	return c
 }
+
+// Roles returns the roles collection from MongoDB.
+func (s *Storage) Roles() *storage.Collection {
+	return s.Collection("roles")
+}
+
+// APITokens returns the api_tokens collection from MongoDB.
+func (s *Storage) APITokens() *storage.Collection {
+	nameIndex := mgo.Index{Key: []string{"email", "name"}, Unique: true}
+	c := s.Collection("api_tokens")
+	c.EnsureIndex(nameIndex)
+	return c
+}
+
+// ResourceQuotas returns the resource_quotas collection from MongoDB.
+func (s *Storage) ResourceQuotas() *storage.Collection {
+	ownerIndex := mgo.Index{Key: []string{"kind", "name"}, Unique: true}
+	c := s.Collection("resource_quotas")
+	c.EnsureIndex(ownerIndex)
+	return c
+}
+
+// TwoFactorAuth returns the two_factor_auth collection from MongoDB.
+func (s *Storage) TwoFactorAuth() *storage.Collection {
+	return s.Collection("two_factor_auth")
+}
+
+// LoginFailures returns the login_failures collection from MongoDB. Failures
+// are removed by MongoDB once their expireat date is reached.
+func (s *Storage) LoginFailures() *storage.Collection {
+	userIndex := mgo.Index{Key: []string{"user", "date"}}
+	ipIndex := mgo.Index{Key: []string{"ip", "date"}}
+	expireIndex := mgo.Index{Key: []string{"expireat"}, ExpireAfter: time.Second}
+	c := s.Collection("login_failures")
+	c.EnsureIndex(userIndex)
+	c.EnsureIndex(ipIndex)
+	c.EnsureIndex(expireIndex)
+	return c
+}
+
+// MeteringEvents returns the metering_events collection from MongoDB.
+func (s *Storage) MeteringEvents() *storage.Collection {
+	dateIndex := mgo.Index{Key: []string{"date"}}
+	c := s.Collection("metering_events")
+	c.EnsureIndex(dateIndex)
+	return c
+}
+
+// MeteringCheckpoints returns the metering_checkpoints collection from
+// MongoDB.
+func (s *Storage) MeteringCheckpoints() *storage.Collection {
+	dateIndex := mgo.Index{Key: []string{"date"}}
+	c := s.Collection("metering_checkpoints")
+	c.EnsureIndex(dateIndex)
+	return c
+}
@@ -163,6 +163,22 @@ func (s *S) TestDeploys(c *check.C) {
 	c.Assert(deploys, HasIndex, []string{"-timestamp"})
 }
 
+func (s *S) TestRunningDeploys(c *check.C) {
+	strg, err := Conn()
+	c.Assert(err, check.IsNil)
+	deploys := strg.RunningDeploys()
+	deploysc := strg.Collection("running_deploys")
+	c.Assert(deploys, check.DeepEquals, deploysc)
+}
+
+func (s *S) TestSecrets(c *check.C) {
+	strg, err := Conn()
+	c.Assert(err, check.IsNil)
+	secrets := strg.Secrets()
+	secretsc := strg.Collection("secrets")
+	c.Assert(secrets, check.DeepEquals, secretsc)
+}
+
 func (s *S) TestPlatforms(c *check.C) {
 	strg, err := Conn()
 	c.Assert(err, check.IsNil)
@@ -171,6 +187,14 @@ func (s *S) TestPlatforms(c *check.C) {
 	c.Assert(plats, check.DeepEquals, platsc)
 }
 
+func (s *S) TestPlatformRollouts(c *check.C) {
+	strg, err := Conn()
+	c.Assert(err, check.IsNil)
+	rollouts := strg.PlatformRollouts()
+	rolloutsc := strg.Collection("platform_rollouts")
+	c.Assert(rollouts, check.DeepEquals, rolloutsc)
+}
+
 func (s *S) TestLogs(c *check.C) {
 	strg, err := Conn()
 	c.Assert(err, check.IsNil)
@@ -239,3 +263,78 @@ func (s *S) TestQuotaOwnerIsUnique(c *check.C) {
 	quota := strg.Quota()
 	c.Assert(quota, HasUniqueIndex, []string{"owner"})
 }
+
+func (s *S) TestRoles(c *check.C) {
+	strg, err := Conn()
+	c.Assert(err, check.IsNil)
+	roles := strg.Roles()
+	rolesc := strg.Collection("roles")
+	c.Assert(roles, check.DeepEquals, rolesc)
+}
+
+func (s *S) TestResourceQuotas(c *check.C) {
+	strg, err := Conn()
+	c.Assert(err, check.IsNil)
+	quotas := strg.ResourceQuotas()
+	quotasc := strg.Collection("resource_quotas")
+	c.Assert(quotas, check.DeepEquals, quotasc)
+}
+
+func (s *S) TestResourceQuotasKindAndNameAreUnique(c *check.C) {
+	strg, err := Conn()
+	c.Assert(err, check.IsNil)
+	quotas := strg.ResourceQuotas()
+	c.Assert(quotas, HasUniqueIndex, []string{"kind", "name"})
+}
+
+func (s *S) TestAPITokens(c *check.C) {
+	strg, err := Conn()
+	c.Assert(err, check.IsNil)
+	tokens := strg.APITokens()
+	tokensc := strg.Collection("api_tokens")
+	c.Assert(tokens, check.DeepEquals, tokensc)
+}
+
+func (s *S) TestAPITokensEmailAndNameAreUnique(c *check.C) {
+	strg, err := Conn()
+	c.Assert(err, check.IsNil)
+	tokens := strg.APITokens()
+	c.Assert(tokens, HasUniqueIndex, []string{"email", "name"})
+}
+
+func (s *S) TestTwoFactorAuth(c *check.C) {
+	strg, err := Conn()
+	c.Assert(err, check.IsNil)
+	twoFactor := strg.TwoFactorAuth()
+	twoFactorc := strg.Collection("two_factor_auth")
+	c.Assert(twoFactor, check.DeepEquals, twoFactorc)
+}
+
+func (s *S) TestLoginFailures(c *check.C) {
+	strg, err := Conn()
+	c.Assert(err, check.IsNil)
+	failures := strg.LoginFailures()
+	failuresc := strg.Collection("login_failures")
+	c.Assert(failures, check.DeepEquals, failuresc)
+	c.Assert(failures, HasIndex, []string{"user", "date"})
+	c.Assert(failures, HasIndex, []string{"ip", "date"})
+	c.Assert(failures, HasIndex, []string{"expireat"})
+}
+
+func (s *S) TestMeteringEvents(c *check.C) {
+	strg, err := Conn()
+	c.Assert(err, check.IsNil)
+	events := strg.MeteringEvents()
+	eventsc := strg.Collection("metering_events")
+	c.Assert(events, check.DeepEquals, eventsc)
+	c.Assert(events, HasIndex, []string{"date"})
+}
+
+func (s *S) TestMeteringCheckpoints(c *check.C) {
+	strg, err := Conn()
+	c.Assert(err, check.IsNil)
+	checkpoints := strg.MeteringCheckpoints()
+	checkpointsc := strg.Collection("metering_checkpoints")
+	c.Assert(checkpoints, check.DeepEquals, checkpointsc)
+	c.Assert(checkpoints, HasIndex, []string{"date"})
+}
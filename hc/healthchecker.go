@@ -7,13 +7,26 @@
 // use.
 package hc
 
-import "errors"
+import (
+	"errors"
+	"strings"
+)
 
 // HealthCheckOK is the status returned when the healthcheck works.
 const HealthCheckOK = "WORKING"
 
+const warningPrefix = "warning - "
+
 var ErrDisabledComponent = errors.New("disabled component")
 
+// Warning is returned by checkers to report information about a component
+// that doesn't make the healthcheck fail.
+type Warning string
+
+func (w Warning) Error() string {
+	return string(w)
+}
+
 var checkers []healthChecker
 
 type healthChecker struct {
@@ -29,6 +42,11 @@ type Result struct {
 	Status string
 }
 
+// Failed reports whether the check failed. Warnings are not failures.
+func (r Result) Failed() bool {
+	return r.Status != HealthCheckOK && !strings.HasPrefix(r.Status, warningPrefix)
+}
+
 // AddChecker adds a new checker to the internal list of checkers. Checkers
 // added to this list can then be checked using the Check function.
 func AddChecker(name string, check func() error) {
@@ -41,7 +59,10 @@ func AddChecker(name string, check func() error) {
 func Check() []Result {
 	results := make([]Result, 0, len(checkers))
 	for _, checker := range checkers {
-		if err := checker.check(); err != nil && err != ErrDisabledComponent {
+		err := checker.check()
+		if w, ok := err.(Warning); ok {
+			results = append(results, Result{Name: checker.name, Status: warningPrefix + string(w)})
+		} else if err != nil && err != ErrDisabledComponent {
 			results = append(results, Result{Name: checker.name, Status: "fail - " + err.Error()})
 		} else if err == nil {
 			results = append(results, Result{Name: checker.name, Status: HealthCheckOK})
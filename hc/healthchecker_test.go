@@ -23,14 +23,22 @@ func (HCSuite) TestCheck(c *check.C) {
 	AddChecker("success", successChecker)
 	AddChecker("failing", failingChecker)
 	AddChecker("disabled", disabledChecker)
+	AddChecker("warning", warningChecker)
 	expected := []Result{
 		{Name: "success", Status: HealthCheckOK},
 		{Name: "failing", Status: "fail - something went wrong"},
+		{Name: "warning", Status: "warning - something is odd"},
 	}
 	result := Check()
 	c.Assert(result, check.DeepEquals, expected)
 }
 
+func (HCSuite) TestResultFailed(c *check.C) {
+	c.Assert(Result{Status: HealthCheckOK}.Failed(), check.Equals, false)
+	c.Assert(Result{Status: "warning - something is odd"}.Failed(), check.Equals, false)
+	c.Assert(Result{Status: "fail - something went wrong"}.Failed(), check.Equals, true)
+}
+
 func successChecker() error {
 	return nil
 }
@@ -42,3 +50,7 @@ func failingChecker() error {
 func disabledChecker() error {
 	return ErrDisabledComponent
 }
+
+func warningChecker() error {
+	return Warning("something is odd")
+}
@@ -0,0 +1,391 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package metering records the lifecycle of the resources used by teams, app
+// units and service instances, and reports their usage in hours, for
+// chargeback.
+package metering
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	defaultCheckpointInterval = 24 * time.Hour
+
+	// checkpointDelay keeps checkpoints behind the current time, so events
+	// being recorded while a checkpoint is created are not left out of it.
+	checkpointDelay = 10 * time.Minute
+)
+
+const (
+	// KindUnit identifies events of app units. The resource of these events
+	// is the name of the app.
+	KindUnit = "unit"
+
+	// KindInstance identifies events of service instances. The resource of
+	// these events is the name of the instance.
+	KindInstance = "instance"
+)
+
+const (
+	// ActionCreate means that a service instance was created.
+	ActionCreate = "create"
+
+	// ActionDestroy means that a service instance was removed.
+	ActionDestroy = "destroy"
+
+	// ActionAdd means that Quantity units were added to an app.
+	ActionAdd = "add"
+
+	// ActionRemove means that Quantity units were removed from an app.
+	ActionRemove = "remove"
+
+	// ActionUpdate means that the team, the pool or the plan of the
+	// resource changed. Usage after the event is accounted to the new
+	// values.
+	ActionUpdate = "update"
+)
+
+var (
+	// ErrMissingKind is returned when an event is recorded without a kind.
+	ErrMissingKind = errors.New("metering: missing kind")
+
+	// ErrMissingAction is returned when an event is recorded without an
+	// action.
+	ErrMissingAction = errors.New("metering: missing action")
+
+	// ErrMissingResource is returned when an event is recorded without a
+	// resource.
+	ErrMissingResource = errors.New("metering: missing resource")
+
+	// ErrInvalidPeriod is returned when the start of the period of a report
+	// isn't before its end.
+	ErrInvalidPeriod = errors.New("metering: the start of the period must be before its end")
+)
+
+// Event is a change in the resources used by a team.
+type Event struct {
+	Kind     string
+	Action   string
+	Resource string
+	Service  string
+	Team     string
+	Pool     string
+	Plan     string
+	Quantity int
+	Date     time.Time
+}
+
+// Record stores the event in the database. The date of the event defaults to
+// the current time.
+func Record(evt Event) error {
+	if evt.Kind == "" {
+		return ErrMissingKind
+	}
+	if evt.Action == "" {
+		return ErrMissingAction
+	}
+	if evt.Resource == "" {
+		return ErrMissingResource
+	}
+	if evt.Date.IsZero() {
+		evt.Date = time.Now()
+	}
+	evt.Date = evt.Date.In(time.UTC)
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.MeteringEvents().Insert(evt)
+}
+
+// RecordBaseline records the event only if no events of its resource were
+// recorded yet, returning whether the event was recorded. It's used to record
+// the resources that existed before their events started being recorded.
+func RecordBaseline(evt Event) (bool, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	n, err := conn.MeteringEvents().Find(bson.M{"kind": evt.Kind, "service": evt.Service, "resource": evt.Resource}).Count()
+	if err != nil || n > 0 {
+		return false, err
+	}
+	return true, Record(evt)
+}
+
+// Usage is the number of hours used of a kind of resource, by a team, in a
+// pool and plan.
+type Usage struct {
+	Kind  string  `json:"kind"`
+	Team  string  `json:"team"`
+	Pool  string  `json:"pool"`
+	Plan  string  `json:"plan"`
+	Hours float64 `json:"hours"`
+}
+
+type usageKey struct {
+	kind, team, pool, plan string
+}
+
+type resourceKey struct {
+	kind, service, name string
+}
+
+type resourceState struct {
+	key      usageKey
+	quantity int
+	since    time.Time
+}
+
+// apply changes the state of the resource according to the event.
+func (state *resourceState) apply(evt Event) {
+	state.since = evt.Date
+	if evt.Team != "" {
+		state.key.team = evt.Team
+	}
+	if evt.Pool != "" {
+		state.key.pool = evt.Pool
+	}
+	if evt.Plan != "" {
+		state.key.plan = evt.Plan
+	}
+	switch evt.Action {
+	case ActionCreate:
+		state.quantity = 1
+	case ActionDestroy:
+		state.quantity = 0
+	case ActionAdd:
+		state.quantity += evt.Quantity
+	case ActionRemove:
+		state.quantity -= evt.Quantity
+		if state.quantity < 0 {
+			state.quantity = 0
+		}
+	}
+}
+
+func stateOf(states map[resourceKey]*resourceState, evt Event) *resourceState {
+	id := resourceKey{kind: evt.Kind, service: evt.Service, name: evt.Resource}
+	state, ok := states[id]
+	if !ok {
+		state = &resourceState{key: usageKey{kind: evt.Kind}}
+		states[id] = state
+	}
+	return state
+}
+
+// resourceSnapshot is the state of a resource stored in a checkpoint.
+type resourceSnapshot struct {
+	Kind     string
+	Service  string
+	Resource string
+	Team     string
+	Pool     string
+	Plan     string
+	Quantity int
+}
+
+// checkpoint holds the state of the resources in use at its date, considering
+// the events recorded before it.
+type checkpoint struct {
+	Date      time.Time
+	Resources []resourceSnapshot
+}
+
+// loadStates returns the states of the resources at the last checkpoint not
+// after the given date, along with the date of the checkpoint. Without
+// checkpoints, no resources are in use and the date is zero.
+func loadStates(conn *db.Storage, date time.Time) (map[resourceKey]*resourceState, time.Time, error) {
+	states := make(map[resourceKey]*resourceState)
+	var cp checkpoint
+	err := conn.MeteringCheckpoints().Find(bson.M{"date": bson.M{"$lte": date}}).Sort("-date").One(&cp)
+	if err == mgo.ErrNotFound {
+		return states, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	for _, r := range cp.Resources {
+		id := resourceKey{kind: r.Kind, service: r.Service, name: r.Resource}
+		states[id] = &resourceState{
+			key:      usageKey{kind: r.Kind, team: r.Team, pool: r.Pool, plan: r.Plan},
+			quantity: r.Quantity,
+			since:    cp.Date,
+		}
+	}
+	return states, cp.Date, nil
+}
+
+// events returns the events recorded in the period between start and end,
+// sorted by date.
+func events(conn *db.Storage, start, end time.Time) ([]Event, error) {
+	var events []Event
+	err := conn.MeteringEvents().Find(bson.M{"date": bson.M{"$gte": start, "$lt": end}}).Sort("date").All(&events)
+	return events, err
+}
+
+// Report replays the recorded events, returning the unit-hours and
+// instance-hours used in the period between start and end, grouped by kind,
+// team, pool and plan. The replay starts from the last checkpoint before the
+// start of the period.
+func Report(start, end time.Time) ([]Usage, error) {
+	if !start.Before(end) {
+		return nil, ErrInvalidPeriod
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	states, since, err := loadStates(conn, start)
+	if err != nil {
+		return nil, err
+	}
+	evts, err := events(conn, since, end)
+	if err != nil {
+		return nil, err
+	}
+	return replay(states, evts, start, end), nil
+}
+
+// replay computes the usage in the period between start and end from the
+// initial states of the resources and the events after them, which must be
+// sorted by date.
+func replay(states map[resourceKey]*resourceState, events []Event, start, end time.Time) []Usage {
+	hours := make(map[usageKey]float64)
+	account := func(state *resourceState, until time.Time) {
+		from, to := state.since, until
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(end) {
+			to = end
+		}
+		if state.quantity > 0 && to.After(from) {
+			hours[state.key] += float64(state.quantity) * to.Sub(from).Hours()
+		}
+	}
+	for _, evt := range events {
+		state := stateOf(states, evt)
+		account(state, evt.Date)
+		state.apply(evt)
+	}
+	for _, state := range states {
+		account(state, end)
+	}
+	usage := make([]Usage, 0, len(hours))
+	for key, h := range hours {
+		usage = append(usage, Usage{Kind: key.kind, Team: key.team, Pool: key.pool, Plan: key.plan, Hours: h})
+	}
+	sort.Sort(usageList(usage))
+	return usage
+}
+
+// Checkpoint stores the state of the resources in use at the given date, so
+// reports of later periods don't need to replay the events before it.
+func Checkpoint(date time.Time) error {
+	date = date.In(time.UTC)
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	states, since, err := loadStates(conn, date)
+	if err != nil {
+		return err
+	}
+	if !since.Before(date) {
+		return nil
+	}
+	evts, err := events(conn, since, date)
+	if err != nil {
+		return err
+	}
+	for _, evt := range evts {
+		stateOf(states, evt).apply(evt)
+	}
+	cp := checkpoint{Date: date, Resources: make([]resourceSnapshot, 0, len(states))}
+	for id, state := range states {
+		if state.quantity == 0 {
+			continue
+		}
+		cp.Resources = append(cp.Resources, resourceSnapshot{
+			Kind:     id.kind,
+			Service:  id.service,
+			Resource: id.name,
+			Team:     state.key.team,
+			Pool:     state.key.pool,
+			Plan:     state.key.plan,
+			Quantity: state.quantity,
+		})
+	}
+	return conn.MeteringCheckpoints().Insert(cp)
+}
+
+// StartCheckpoints starts storing checkpoints in background, in the interval
+// defined by the setting metering:checkpoint-interval, in seconds.
+func StartCheckpoints() {
+	interval := defaultCheckpointInterval
+	if seconds, err := config.GetInt("metering:checkpoint-interval"); err == nil && seconds > 0 {
+		interval = time.Duration(seconds) * time.Second
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			if err := Checkpoint(time.Now().Add(-checkpointDelay)); err != nil {
+				log.Errorf("[metering] unable to store checkpoint: %s", err)
+			}
+		}
+	}()
+}
+
+type usageList []Usage
+
+func (l usageList) Len() int      { return len(l) }
+func (l usageList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l usageList) Less(i, j int) bool {
+	if l[i].Kind != l[j].Kind {
+		return l[i].Kind < l[j].Kind
+	}
+	if l[i].Team != l[j].Team {
+		return l[i].Team < l[j].Team
+	}
+	if l[i].Pool != l[j].Pool {
+		return l[i].Pool < l[j].Pool
+	}
+	return l[i].Plan < l[j].Plan
+}
+
+// WriteCSV writes the usage as CSV, with a header line, and the hours rounded
+// to two decimal places.
+func WriteCSV(w io.Writer, usage []Usage) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"kind", "team", "pool", "plan", "hours"})
+	if err != nil {
+		return err
+	}
+	for _, u := range usage {
+		err = writer.Write([]string{u.Kind, u.Team, u.Pool, u.Plan, strconv.FormatFloat(u.Hours, 'f', 2, 64)})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,227 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metering
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/db/dbtest"
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+var _ = check.Suite(&S{})
+
+type S struct{}
+
+func (s *S) SetUpSuite(c *check.C) {
+	config.Set("database:url", "127.0.0.1:27017")
+	config.Set("database:name", "tsuru_metering_test")
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	conn.MeteringEvents().RemoveAll(nil)
+	conn.MeteringCheckpoints().RemoveAll(nil)
+}
+
+func (s *S) TearDownSuite(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	dbtest.ClearAllCollections(conn.Apps().Database)
+}
+
+var base = time.Date(2015, 10, 1, 0, 0, 0, 0, time.UTC)
+
+func hoursAfter(n int) time.Time {
+	return base.Add(time.Duration(n) * time.Hour)
+}
+
+func (s *S) recordEvents(c *check.C, events ...Event) {
+	for _, evt := range events {
+		err := Record(evt)
+		c.Assert(err, check.IsNil)
+	}
+}
+
+func (s *S) TestRecord(c *check.C) {
+	err := Record(Event{Kind: KindUnit, Action: ActionAdd, Resource: "myapp", Team: "myteam", Pool: "pool1", Plan: "small", Quantity: 2})
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	var events []Event
+	err = conn.MeteringEvents().Find(nil).All(&events)
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].Date.IsZero(), check.Equals, false)
+	events[0].Date = time.Time{}
+	c.Assert(events[0], check.DeepEquals, Event{Kind: KindUnit, Action: ActionAdd, Resource: "myapp", Team: "myteam", Pool: "pool1", Plan: "small", Quantity: 2})
+}
+
+func (s *S) TestRecordValidation(c *check.C) {
+	err := Record(Event{Action: ActionAdd, Resource: "myapp"})
+	c.Assert(err, check.Equals, ErrMissingKind)
+	err = Record(Event{Kind: KindUnit, Resource: "myapp"})
+	c.Assert(err, check.Equals, ErrMissingAction)
+	err = Record(Event{Kind: KindUnit, Action: ActionAdd})
+	c.Assert(err, check.Equals, ErrMissingResource)
+}
+
+func (s *S) TestReport(c *check.C) {
+	s.recordEvents(c,
+		Event{Kind: KindUnit, Action: ActionAdd, Resource: "app1", Team: "team1", Pool: "pool1", Plan: "small", Quantity: 2, Date: hoursAfter(0)},
+		Event{Kind: KindInstance, Action: ActionCreate, Resource: "mydb", Service: "mysql", Team: "team1", Plan: "medium", Date: hoursAfter(1)},
+		Event{Kind: KindUnit, Action: ActionAdd, Resource: "app2", Team: "team2", Pool: "pool1", Plan: "small", Quantity: 1, Date: hoursAfter(2)},
+		Event{Kind: KindUnit, Action: ActionRemove, Resource: "app1", Team: "team1", Pool: "pool1", Plan: "small", Quantity: 1, Date: hoursAfter(4)},
+		Event{Kind: KindInstance, Action: ActionDestroy, Resource: "mydb", Service: "mysql", Team: "team1", Plan: "medium", Date: hoursAfter(6)},
+	)
+	usage, err := Report(hoursAfter(0), hoursAfter(10))
+	c.Assert(err, check.IsNil)
+	c.Assert(usage, check.DeepEquals, []Usage{
+		{Kind: KindInstance, Team: "team1", Plan: "medium", Hours: 5},
+		{Kind: KindUnit, Team: "team1", Pool: "pool1", Plan: "small", Hours: 14},
+		{Kind: KindUnit, Team: "team2", Pool: "pool1", Plan: "small", Hours: 8},
+	})
+}
+
+func (s *S) TestReportClipsToThePeriod(c *check.C) {
+	s.recordEvents(c,
+		Event{Kind: KindUnit, Action: ActionAdd, Resource: "app1", Team: "team1", Pool: "pool1", Plan: "small", Quantity: 3, Date: hoursAfter(0)},
+		Event{Kind: KindUnit, Action: ActionRemove, Resource: "app1", Team: "team1", Pool: "pool1", Plan: "small", Quantity: 1, Date: hoursAfter(5)},
+		Event{Kind: KindUnit, Action: ActionAdd, Resource: "app1", Team: "team1", Pool: "pool1", Plan: "small", Quantity: 4, Date: hoursAfter(20)},
+	)
+	usage, err := Report(hoursAfter(4), hoursAfter(8))
+	c.Assert(err, check.IsNil)
+	c.Assert(usage, check.DeepEquals, []Usage{
+		{Kind: KindUnit, Team: "team1", Pool: "pool1", Plan: "small", Hours: 9},
+	})
+}
+
+func (s *S) TestReportUpdate(c *check.C) {
+	s.recordEvents(c,
+		Event{Kind: KindInstance, Action: ActionCreate, Resource: "mydb", Service: "mysql", Team: "team1", Plan: "small", Date: hoursAfter(0)},
+		Event{Kind: KindInstance, Action: ActionCreate, Resource: "mydb", Service: "redis", Team: "team2", Plan: "small", Date: hoursAfter(0)},
+		Event{Kind: KindInstance, Action: ActionUpdate, Resource: "mydb", Service: "mysql", Plan: "large", Date: hoursAfter(2)},
+		Event{Kind: KindUnit, Action: ActionAdd, Resource: "app1", Team: "team1", Pool: "pool1", Plan: "small", Quantity: 1, Date: hoursAfter(0)},
+		Event{Kind: KindUnit, Action: ActionUpdate, Resource: "app1", Team: "team2", Date: hoursAfter(3)},
+	)
+	usage, err := Report(hoursAfter(0), hoursAfter(4))
+	c.Assert(err, check.IsNil)
+	c.Assert(usage, check.DeepEquals, []Usage{
+		{Kind: KindInstance, Team: "team1", Plan: "large", Hours: 2},
+		{Kind: KindInstance, Team: "team1", Plan: "small", Hours: 2},
+		{Kind: KindInstance, Team: "team2", Plan: "small", Hours: 4},
+		{Kind: KindUnit, Team: "team1", Pool: "pool1", Plan: "small", Hours: 3},
+		{Kind: KindUnit, Team: "team2", Pool: "pool1", Plan: "small", Hours: 1},
+	})
+}
+
+func (s *S) TestReportIgnoresRemovalOfMissingUnits(c *check.C) {
+	s.recordEvents(c,
+		Event{Kind: KindUnit, Action: ActionRemove, Resource: "app1", Team: "team1", Plan: "small", Quantity: 2, Date: hoursAfter(0)},
+		Event{Kind: KindUnit, Action: ActionAdd, Resource: "app1", Team: "team1", Plan: "small", Quantity: 1, Date: hoursAfter(1)},
+	)
+	usage, err := Report(hoursAfter(0), hoursAfter(3))
+	c.Assert(err, check.IsNil)
+	c.Assert(usage, check.DeepEquals, []Usage{
+		{Kind: KindUnit, Team: "team1", Plan: "small", Hours: 2},
+	})
+}
+
+func (s *S) TestReportWithoutEvents(c *check.C) {
+	usage, err := Report(hoursAfter(0), hoursAfter(1))
+	c.Assert(err, check.IsNil)
+	c.Assert(usage, check.HasLen, 0)
+}
+
+func (s *S) TestReportInvalidPeriod(c *check.C) {
+	usage, err := Report(hoursAfter(1), hoursAfter(1))
+	c.Assert(err, check.Equals, ErrInvalidPeriod)
+	c.Assert(usage, check.IsNil)
+}
+
+func (s *S) TestRecordBaseline(c *check.C) {
+	s.recordEvents(c, Event{Kind: KindUnit, Action: ActionAdd, Resource: "app1", Quantity: 1, Date: hoursAfter(0)})
+	recorded, err := RecordBaseline(Event{Kind: KindUnit, Action: ActionAdd, Resource: "app1", Quantity: 2})
+	c.Assert(err, check.IsNil)
+	c.Assert(recorded, check.Equals, false)
+	recorded, err = RecordBaseline(Event{Kind: KindUnit, Action: ActionAdd, Resource: "app2", Quantity: 2})
+	c.Assert(err, check.IsNil)
+	c.Assert(recorded, check.Equals, true)
+	recorded, err = RecordBaseline(Event{Kind: KindInstance, Action: ActionCreate, Resource: "app1", Service: "mysql"})
+	c.Assert(err, check.IsNil)
+	c.Assert(recorded, check.Equals, true)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	n, err := conn.MeteringEvents().Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 3)
+}
+
+func (s *S) TestCheckpoint(c *check.C) {
+	s.recordEvents(c,
+		Event{Kind: KindUnit, Action: ActionAdd, Resource: "app1", Team: "team1", Pool: "pool1", Plan: "small", Quantity: 3, Date: hoursAfter(0)},
+		Event{Kind: KindInstance, Action: ActionCreate, Resource: "mydb", Service: "mysql", Team: "team1", Plan: "medium", Date: hoursAfter(1)},
+		Event{Kind: KindInstance, Action: ActionDestroy, Resource: "mydb", Service: "mysql", Date: hoursAfter(2)},
+		Event{Kind: KindUnit, Action: ActionRemove, Resource: "app1", Quantity: 1, Date: hoursAfter(5)},
+	)
+	err := Checkpoint(hoursAfter(4))
+	c.Assert(err, check.IsNil)
+	err = Checkpoint(hoursAfter(4))
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	var checkpoints []checkpoint
+	err = conn.MeteringCheckpoints().Find(nil).All(&checkpoints)
+	c.Assert(err, check.IsNil)
+	c.Assert(checkpoints, check.HasLen, 1)
+	c.Assert(checkpoints[0].Date.Equal(hoursAfter(4)), check.Equals, true)
+	c.Assert(checkpoints[0].Resources, check.DeepEquals, []resourceSnapshot{
+		{Kind: KindUnit, Resource: "app1", Team: "team1", Pool: "pool1", Plan: "small", Quantity: 3},
+	})
+}
+
+func (s *S) TestReportStartsFromCheckpoint(c *check.C) {
+	s.recordEvents(c,
+		Event{Kind: KindUnit, Action: ActionAdd, Resource: "app1", Team: "team1", Pool: "pool1", Plan: "small", Quantity: 3, Date: hoursAfter(0)},
+		Event{Kind: KindUnit, Action: ActionRemove, Resource: "app1", Quantity: 1, Date: hoursAfter(6)},
+	)
+	err := Checkpoint(hoursAfter(4))
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	_, err = conn.MeteringEvents().RemoveAll(bson.M{"date": bson.M{"$lt": hoursAfter(4)}})
+	c.Assert(err, check.IsNil)
+	usage, err := Report(hoursAfter(5), hoursAfter(8))
+	c.Assert(err, check.IsNil)
+	c.Assert(usage, check.DeepEquals, []Usage{
+		{Kind: KindUnit, Team: "team1", Pool: "pool1", Plan: "small", Hours: 7},
+	})
+}
+
+func (s *S) TestWriteCSV(c *check.C) {
+	var buf bytes.Buffer
+	err := WriteCSV(&buf, []Usage{
+		{Kind: KindInstance, Team: "team1", Plan: "medium", Hours: 5},
+		{Kind: KindUnit, Team: "team1", Pool: "pool1", Plan: "small", Hours: 1.0 / 3},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "kind,team,pool,plan,hours\ninstance,team1,,medium,5.00\nunit,team1,pool1,small,0.33\n")
+}
@@ -28,6 +28,8 @@ type runContainerActionsArgs struct {
 	writer           io.Writer
 	isDeploy         bool
 	buildingImage    string
+	exposedPort      string
+	entrypoint       []string
 	provisioner      *dockerProvisioner
 }
 
@@ -105,6 +107,7 @@ var insertEmptyContainerInDB = action.Action{
 			Status:        provision.StatusCreated.String(),
 			Image:         args.imageID,
 			BuildingImage: args.buildingImage,
+			ExposedPort:   args.exposedPort,
 		}
 		coll := args.provisioner.collection()
 		defer coll.Close()
@@ -7,6 +7,7 @@ package docker
 import (
 	"crypto"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -98,12 +99,23 @@ type container struct {
 	Name                    string
 	User                    string
 	BuildingImage           string
+	ExposedPort             string
 	LastStatusUpdate        time.Time
 	LastSuccessStatusUpdate time.Time
 	LockedUntil             time.Time
 	appCache                provision.App
 }
 
+// port returns the port exposed by the container. Containers based on images
+// built outside tsuru expose the port defined in the image, other containers
+// expose the port defined in the docker:run-cmd:port setting.
+func (c *container) port() (string, error) {
+	if c.ExposedPort != "" {
+		return c.ExposedPort, nil
+	}
+	return getPort()
+}
+
 func (c *container) shortID() string {
 	if len(c.ID) > 10 {
 		return c.ID[:10]
@@ -130,7 +142,7 @@ func randomString() string {
 
 // creates a new container in Docker.
 func (c *container) create(args runContainerActionsArgs) error {
-	port, err := getPort()
+	port, err := c.port()
 	if err != nil {
 		log.Errorf("error on getting port for container %s - %s", c.AppName, port)
 		return err
@@ -164,6 +176,15 @@ func (c *container) create(args runContainerActionsArgs) error {
 		}
 		config.Env = append(config.Env, fmt.Sprintf("TSURU_SHAREDFS_MOUNTPOINT=%s", sharedMount))
 	}
+	if args.exposedPort != "" {
+		// images built outside tsuru don't run tsuru_unit_agent, so the
+		// environment variables must be injected in the container.
+		config.Entrypoint = args.entrypoint
+		config.Env = append(config.Env, fmt.Sprintf("PORT=%s", port))
+		for _, env := range args.app.Envs() {
+			config.Env = append(config.Env, fmt.Sprintf("%s=%s", env.Name, env.Value))
+		}
+	}
 	opts := docker.CreateContainerOptions{Name: c.Name, Config: &config}
 	var nodeList []string
 	if len(args.destinationHosts) > 0 {
@@ -192,7 +213,7 @@ type containerNetworkInfo struct {
 // networkInfo returns the IP and the host port for the container.
 func (c *container) networkInfo(p *dockerProvisioner) (containerNetworkInfo, error) {
 	var netInfo containerNetworkInfo
-	port, err := getPort()
+	port, err := c.port()
 	if err != nil {
 		return netInfo, err
 	}
@@ -287,10 +308,17 @@ func (p *dockerProvisioner) deployPipeline(app provision.App, imageId string, co
 }
 
 func (p *dockerProvisioner) start(app provision.App, imageId string, w io.Writer, destinationHosts ...string) (*container, error) {
-	commands, err := runWithAgentCmds(app)
+	metadata, err := getImageMetadata(imageId)
 	if err != nil {
 		return nil, err
 	}
+	commands := metadata.Cmd
+	if !metadata.isExternal() {
+		commands, err = runWithAgentCmds(app)
+		if err != nil {
+			return nil, err
+		}
+	}
 	actions := []*action.Action{
 		&insertEmptyContainerInDB,
 		&createContainer,
@@ -304,6 +332,8 @@ func (p *dockerProvisioner) start(app provision.App, imageId string, w io.Writer
 		imageID:          imageId,
 		commands:         commands,
 		destinationHosts: destinationHosts,
+		exposedPort:      metadata.ExposedPort,
+		entrypoint:       metadata.Entrypoint,
 		provisioner:      p,
 	}
 	err = pipeline.Execute(args)
@@ -492,7 +522,7 @@ func (c *container) stop(p *dockerProvisioner) error {
 }
 
 func (c *container) start(p *dockerProvisioner, isDeploy bool) error {
-	port, err := getPort()
+	port, err := c.port()
 	if err != nil {
 		return err
 	}
@@ -577,6 +607,68 @@ func (p *dockerProvisioner) pushImage(name, tag string) error {
 	return nil
 }
 
+// pullExternalImage pulls an image built outside tsuru, tagging and pushing
+// it as a new image of the app. It returns the name of the new app image.
+func (p *dockerProvisioner) pullExternalImage(app provision.App, imageName string, w io.Writer) (string, error) {
+	fmt.Fprintf(w, "\n---- Pulling image %s ----\n", imageName)
+	var buf safe.Buffer
+	pullOpts := docker.PullImageOptions{Repository: imageName, OutputStream: &buf}
+	err := p.getCluster().PullImage(pullOpts, docker.AuthConfiguration{})
+	if err != nil {
+		log.Errorf("[docker] Failed to pull image %q (%s): %s", imageName, err, buf.String())
+		return "", err
+	}
+	image, err := p.getCluster().InspectImage(imageName)
+	if err != nil {
+		return "", err
+	}
+	metadata, err := externalImageMetadata(image)
+	if err != nil {
+		return "", err
+	}
+	newImage, err := appNewImageName(app.GetName())
+	if err != nil {
+		return "", err
+	}
+	repository, tag := splitImageName(newImage)
+	tagOpts := docker.TagImageOptions{Repo: repository, Tag: tag, Force: true}
+	err = p.getCluster().TagImage(imageName, tagOpts)
+	if err != nil {
+		return "", err
+	}
+	err = p.pushImage(repository, tag)
+	if err != nil {
+		return "", err
+	}
+	err = saveImageMetadata(newImage, metadata)
+	if err != nil {
+		return "", err
+	}
+	return newImage, nil
+}
+
+// externalImageMetadata extracts the port and the command used to start
+// containers based on the given image. The image must expose exactly one TCP
+// port.
+func externalImageMetadata(image *docker.Image) (imageMetadata, error) {
+	var metadata imageMetadata
+	if image.Config == nil || len(image.Config.ExposedPorts) != 1 {
+		return metadata, errors.New("the image must expose exactly one port")
+	}
+	for port := range image.Config.ExposedPorts {
+		if port.Proto() != "tcp" {
+			return metadata, fmt.Errorf("the port exposed by the image must be a TCP port, got %s", port)
+		}
+		metadata.ExposedPort = port.Port()
+	}
+	if len(image.Config.Entrypoint) == 0 && len(image.Config.Cmd) == 0 {
+		return metadata, errors.New("the image must define an entrypoint or a command")
+	}
+	metadata.Entrypoint = image.Config.Entrypoint
+	metadata.Cmd = image.Config.Cmd
+	return metadata, nil
+}
+
 // unitFromContainer returns a unit that represents a container.
 func unitFromContainer(c container) provision.Unit {
 	return provision.Unit{
@@ -571,6 +571,22 @@ func (s *S) TestGetImageUseAppImageIfContainersExist(c *check.C) {
 	c.Assert(img, check.Equals, "tsuru/app-myapp")
 }
 
+func (s *S) TestGetImageUsePlatformImageIfAppImageIsExternal(c *check.C) {
+	cont := container{ID: "bleble", Type: "python", AppName: "myapp", Image: "tsuru/app-myapp:v1"}
+	coll := s.p.collection()
+	err := coll.Insert(cont)
+	defer coll.Close()
+	c.Assert(err, check.IsNil)
+	defer coll.RemoveAll(bson.M{"id": "bleble"})
+	err = appendAppImageName("myapp", "tsuru/app-myapp:v1")
+	c.Assert(err, check.IsNil)
+	err = saveImageMetadata("tsuru/app-myapp:v1", imageMetadata{ExposedPort: "8000", Cmd: []string{"/bin/myapp"}})
+	c.Assert(err, check.IsNil)
+	app := provisiontest.NewFakeApp("myapp", "python", 1)
+	img := s.p.getBuildImage(app)
+	c.Assert(img, check.Equals, "tsuru/python")
+}
+
 func (s *S) TestGetImageWithRegistry(c *check.C) {
 	config.Set("docker:registry", "localhost:3030")
 	defer config.Unset("docker:registry")
@@ -581,6 +597,56 @@ func (s *S) TestGetImageWithRegistry(c *check.C) {
 	c.Assert(img, check.Equals, expected)
 }
 
+func (s *S) TestContainerPort(c *check.C) {
+	cont := container{ID: "bleble"}
+	port, err := cont.port()
+	c.Assert(err, check.IsNil)
+	expected, err := getPort()
+	c.Assert(err, check.IsNil)
+	c.Assert(port, check.Equals, expected)
+	cont.ExposedPort = "8000"
+	port, err = cont.port()
+	c.Assert(err, check.IsNil)
+	c.Assert(port, check.Equals, "8000")
+}
+
+func (s *S) TestExternalImageMetadata(c *check.C) {
+	image := docker.Image{
+		Config: &docker.Config{
+			ExposedPorts: map[docker.Port]struct{}{"8000/tcp": {}},
+			Entrypoint:   []string{"/bin/myapp"},
+			Cmd:          []string{"--serve"},
+		},
+	}
+	metadata, err := externalImageMetadata(&image)
+	c.Assert(err, check.IsNil)
+	c.Assert(metadata, check.DeepEquals, imageMetadata{
+		ExposedPort: "8000",
+		Entrypoint:  []string{"/bin/myapp"},
+		Cmd:         []string{"--serve"},
+	})
+}
+
+func (s *S) TestExternalImageMetadataInvalidPorts(c *check.C) {
+	image := docker.Image{Config: &docker.Config{Cmd: []string{"/bin/myapp"}}}
+	_, err := externalImageMetadata(&image)
+	c.Assert(err, check.ErrorMatches, "the image must expose exactly one port")
+	image.Config.ExposedPorts = map[docker.Port]struct{}{"8000/tcp": {}, "8001/tcp": {}}
+	_, err = externalImageMetadata(&image)
+	c.Assert(err, check.ErrorMatches, "the image must expose exactly one port")
+	image.Config.ExposedPorts = map[docker.Port]struct{}{"53/udp": {}}
+	_, err = externalImageMetadata(&image)
+	c.Assert(err, check.ErrorMatches, "the port exposed by the image must be a TCP port, got 53/udp")
+}
+
+func (s *S) TestExternalImageMetadataWithoutCommand(c *check.C) {
+	image := docker.Image{
+		Config: &docker.Config{ExposedPorts: map[docker.Port]struct{}{"8000/tcp": {}}},
+	}
+	_, err := externalImageMetadata(&image)
+	c.Assert(err, check.ErrorMatches, "the image must define an entrypoint or a command")
+}
+
 func (s *S) TestContainerCommit(c *check.C) {
 	cont, err := s.newContainer(nil, nil)
 	c.Assert(err, check.IsNil)
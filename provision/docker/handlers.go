@@ -25,19 +25,19 @@ import (
 )
 
 func init() {
-	api.RegisterHandler("/docker/node", "GET", api.AdminRequiredHandler(listNodeHandler))
-	api.RegisterHandler("/docker/node/apps/{appname}/containers", "GET", api.AdminRequiredHandler(listContainersHandler))
-	api.RegisterHandler("/docker/node/{address}/containers", "GET", api.AdminRequiredHandler(listContainersHandler))
-	api.RegisterHandler("/docker/node", "POST", api.AdminRequiredHandler(addNodeHandler))
-	api.RegisterHandler("/docker/node", "PUT", api.AdminRequiredHandler(updateNodeHandler))
-	api.RegisterHandler("/docker/node", "DELETE", api.AdminRequiredHandler(removeNodeHandler))
-	api.RegisterHandler("/docker/container/{id}/move", "POST", api.AdminRequiredHandler(moveContainerHandler))
-	api.RegisterHandler("/docker/containers/move", "POST", api.AdminRequiredHandler(moveContainersHandler))
-	api.RegisterHandler("/docker/containers/rebalance", "POST", api.AdminRequiredHandler(rebalanceContainersHandler))
-	api.RegisterHandler("/docker/fix-containers", "POST", api.AdminRequiredHandler(fixContainersHandler))
-	api.RegisterHandler("/docker/healing", "GET", api.AdminRequiredHandler(healingHistoryHandler))
-	api.RegisterHandler("/docker/autoscale", "GET", api.AdminRequiredHandler(autoScaleHistoryHandler))
-	api.RegisterHandler("/docker/autoscale/run", "POST", api.AdminRequiredHandler(autoScaleRunHandler))
+	api.RegisterHandler("/docker/node", "GET", api.PermissionRequiredHandler(auth.PermNodeManage, listNodeHandler))
+	api.RegisterHandler("/docker/node/apps/{appname}/containers", "GET", api.PermissionRequiredHandler(auth.PermNodeManage, listContainersHandler))
+	api.RegisterHandler("/docker/node/{address}/containers", "GET", api.PermissionRequiredHandler(auth.PermNodeManage, listContainersHandler))
+	api.RegisterHandler("/docker/node", "POST", api.PermissionRequiredHandler(auth.PermNodeManage, addNodeHandler))
+	api.RegisterHandler("/docker/node", "PUT", api.PermissionRequiredHandler(auth.PermNodeManage, updateNodeHandler))
+	api.RegisterHandler("/docker/node", "DELETE", api.PermissionRequiredHandler(auth.PermNodeManage, removeNodeHandler))
+	api.RegisterHandler("/docker/container/{id}/move", "POST", api.PermissionRequiredHandler(auth.PermNodeManage, moveContainerHandler))
+	api.RegisterHandler("/docker/containers/move", "POST", api.PermissionRequiredHandler(auth.PermNodeManage, moveContainersHandler))
+	api.RegisterHandler("/docker/containers/rebalance", "POST", api.PermissionRequiredHandler(auth.PermNodeManage, rebalanceContainersHandler))
+	api.RegisterHandler("/docker/fix-containers", "POST", api.PermissionRequiredHandler(auth.PermNodeManage, fixContainersHandler))
+	api.RegisterHandler("/docker/healing", "GET", api.PermissionRequiredHandler(auth.PermNodeManage, healingHistoryHandler))
+	api.RegisterHandler("/docker/autoscale", "GET", api.PermissionRequiredHandler(auth.PermNodeManage, autoScaleHistoryHandler))
+	api.RegisterHandler("/docker/autoscale/run", "POST", api.PermissionRequiredHandler(auth.PermNodeManage, autoScaleRunHandler))
 }
 
 func validateNodeAddress(address string) error {
@@ -79,15 +79,19 @@ func MigrateImages() error {
 // the platform image will be returned if:
 // * there are no containers;
 // * the container have an empty image name;
-// * the deploy number is multiple of 10.
+// * the deploy number is multiple of 10;
+// * the current app image was built outside tsuru.
 // in all other cases the app image name will be returne.
 func (p *dockerProvisioner) getBuildImage(app provision.App) string {
 	if p.usePlatformImage(app) {
-		return platformImageName(app.GetPlatform())
+		return appPlatformImageName(app)
 	}
 	appImageName, err := appCurrentImageName(app.GetName())
 	if err != nil {
-		return platformImageName(app.GetPlatform())
+		return appPlatformImageName(app)
+	}
+	if metadata, err := getImageMetadata(appImageName); err == nil && metadata.isExternal() {
+		return appPlatformImageName(app)
 	}
 	return appImageName
 }
@@ -153,6 +157,77 @@ func getImageTsuruYamlDataWithFallback(imageName, appName string) (provision.Tsu
 	return yamlData, nil
 }
 
+// imageMetadata holds information about images built outside tsuru. These
+// images don't run tsuru_unit_agent, so containers based on them are started
+// using the port and the entrypoint defined in the image.
+type imageMetadata struct {
+	ExposedPort string
+	Entrypoint  []string
+	Cmd         []string
+}
+
+func (m *imageMetadata) isExternal() bool {
+	return m.ExposedPort != ""
+}
+
+func saveImageMetadata(imageName string, metadata imageMetadata) error {
+	coll, err := imageCustomDataColl()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	_, err = coll.UpsertId(imageName, bson.M{"$set": bson.M{"metadata": metadata}})
+	return err
+}
+
+func getImageMetadata(imageName string) (imageMetadata, error) {
+	var data struct {
+		Metadata imageMetadata
+	}
+	coll, err := imageCustomDataColl()
+	if err != nil {
+		return data.Metadata, err
+	}
+	defer coll.Close()
+	err = coll.FindId(imageName).One(&data)
+	if err == mgo.ErrNotFound {
+		return data.Metadata, nil
+	}
+	return data.Metadata, err
+}
+
+// imageRegistry returns the registry where the given image is stored. Images
+// without an explicit registry are stored in the Docker Hub, identified as
+// "docker.io".
+func imageRegistry(imageName string) string {
+	parts := strings.SplitN(imageName, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0]
+	}
+	return "docker.io"
+}
+
+func isAllowedExternalImage(imageName string) bool {
+	registries, _ := config.GetList("docker:external-registries")
+	registry := imageRegistry(imageName)
+	for _, r := range registries {
+		if r == registry {
+			return true
+		}
+	}
+	return false
+}
+
+// splitImageName splits the image name in repository and tag. The tag
+// defaults to "latest".
+func splitImageName(imageName string) (string, string) {
+	i := strings.LastIndex(imageName, ":")
+	if i < 0 || strings.Contains(imageName[i:], "/") {
+		return imageName, "latest"
+	}
+	return imageName[:i], imageName[i+1:]
+}
+
 func appBasicImageName(appName string) string {
 	return fmt.Sprintf("%s/app-%s", basicImageName(), appName)
 }
@@ -304,6 +379,16 @@ func platformImageName(platformName string) string {
 	return fmt.Sprintf("%s/%s", basicImageName(), platformName)
 }
 
+// appPlatformImageName returns the name of the image of the platform version
+// used by the app.
+func appPlatformImageName(app provision.App) string {
+	imageName := platformImageName(app.GetPlatform())
+	if version := app.GetPlatformVersion(); version != "" {
+		return imageName + ":" + version
+	}
+	return imageName
+}
+
 func basicImageName() string {
 	parts := make([]string, 0, 2)
 	registry, _ := config.GetString("docker:registry")
@@ -15,6 +15,7 @@ import (
 	"github.com/tsuru/tsuru/app"
 	"github.com/tsuru/tsuru/db"
 	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/provision/provisiontest"
 	"gopkg.in/check.v1"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -278,6 +279,13 @@ func (s *S) TestPlatformImageName(c *check.C) {
 	c.Assert(platName, check.Equals, "localhost:3030/tsuru/ruby")
 }
 
+func (s *S) TestAppPlatformImageName(c *check.C) {
+	app := provisiontest.NewFakeApp("myapp", "python", 1)
+	c.Assert(appPlatformImageName(app), check.Equals, "tsuru/python")
+	app.PlatformVersion = "3.4-2015.06"
+	c.Assert(appPlatformImageName(app), check.Equals, "tsuru/python:3.4-2015.06")
+}
+
 func (s *S) TestDeleteAllAppImageNames(c *check.C) {
 	err := appendAppImageName("myapp", "tsuru/app-myapp:v1")
 	c.Assert(err, check.IsNil)
@@ -395,3 +403,67 @@ func (s *S) TestPullAppImageNamesRemovesCustomData(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Assert(yamlData, check.DeepEquals, provision.TsuruYamlData{})
 }
+
+func (s *S) TestSaveAndGetImageMetadata(c *check.C) {
+	metadata := imageMetadata{
+		ExposedPort: "8000",
+		Entrypoint:  []string{"/bin/myapp"},
+		Cmd:         []string{"--serve"},
+	}
+	err := saveImageMetadata("tsuru/app-myapp:v1", metadata)
+	c.Assert(err, check.IsNil)
+	dbMetadata, err := getImageMetadata("tsuru/app-myapp:v1")
+	c.Assert(err, check.IsNil)
+	c.Assert(dbMetadata, check.DeepEquals, metadata)
+	c.Assert(dbMetadata.isExternal(), check.Equals, true)
+}
+
+func (s *S) TestGetImageMetadataNotFound(c *check.C) {
+	metadata, err := getImageMetadata("tsuru/app-myapp:v1")
+	c.Assert(err, check.IsNil)
+	c.Assert(metadata.isExternal(), check.Equals, false)
+}
+
+func (s *S) TestImageRegistry(c *check.C) {
+	var tests = []struct {
+		image    string
+		registry string
+	}{
+		{"python", "docker.io"},
+		{"tsuru/python", "docker.io"},
+		{"tsuru/python:latest", "docker.io"},
+		{"localhost/myimage", "localhost"},
+		{"localhost:5000/myimage", "localhost:5000"},
+		{"registry.example.com/tsuru/python:1.0", "registry.example.com"},
+	}
+	for _, t := range tests {
+		c.Check(imageRegistry(t.image), check.Equals, t.registry)
+	}
+}
+
+func (s *S) TestIsAllowedExternalImage(c *check.C) {
+	c.Assert(isAllowedExternalImage("registry.example.com/myimage"), check.Equals, false)
+	config.Set("docker:external-registries", []interface{}{"registry.example.com", "docker.io"})
+	defer config.Unset("docker:external-registries")
+	c.Assert(isAllowedExternalImage("registry.example.com/myimage"), check.Equals, true)
+	c.Assert(isAllowedExternalImage("tsuru/python"), check.Equals, true)
+	c.Assert(isAllowedExternalImage("localhost:5000/myimage"), check.Equals, false)
+}
+
+func (s *S) TestSplitImageName(c *check.C) {
+	var tests = []struct {
+		image string
+		repo  string
+		tag   string
+	}{
+		{"python", "python", "latest"},
+		{"tsuru/python:2.7", "tsuru/python", "2.7"},
+		{"localhost:5000/myimage", "localhost:5000/myimage", "latest"},
+		{"localhost:5000/myimage:v1", "localhost:5000/myimage", "v1"},
+	}
+	for _, t := range tests {
+		repo, tag := splitImageName(t.image)
+		c.Check(repo, check.Equals, t.repo)
+		c.Check(tag, check.Equals, t.tag)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"sync"
 	"time"
 
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
 	"github.com/fsouza/go-dockerclient"
@@ -329,6 +330,54 @@ func (p *dockerProvisioner) ImageDeploy(app provision.App, imageId string, w io.
 	return imageId, p.deploy(app, imageId, w)
 }
 
+func (p *dockerProvisioner) ExternalImageDeploy(app provision.App, imageName string, w io.Writer) (string, error) {
+	if !isAllowedExternalImage(imageName) {
+		return "", fmt.Errorf("the image %s is not stored in an allowed registry", imageName)
+	}
+	imageId, err := p.pullExternalImage(app, imageName, w)
+	if err != nil {
+		return "", err
+	}
+	return imageId, p.deployAndClean(app, imageId, w)
+}
+
+// CancelDeploy stops the containers building the app. The deploy pipeline
+// fails waiting for the build, rolling back the deploy.
+func (p *dockerProvisioner) CancelDeploy(app provision.App) error {
+	containers, err := p.listContainersBy(bson.M{"appname": app.GetName(), "status": provision.StatusBuilding.String()})
+	if err != nil {
+		return err
+	}
+	if len(containers) == 0 {
+		return provision.ErrNothingToCancel
+	}
+	for _, c := range containers {
+		err = p.getCluster().StopContainer(c.ID, 10)
+		if err != nil {
+			log.Errorf("error on stop building container %s: %s", c.ID, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *dockerProvisioner) ImageData(imageName string) (provision.ImageData, error) {
+	var data provision.ImageData
+	yamlData, err := getImageTsuruYamlData(imageName)
+	if err != nil && err != mgo.ErrNotFound {
+		return data, err
+	}
+	data.TsuruYaml = yamlData
+	image, err := p.getCluster().InspectImage(imageName)
+	if err != nil {
+		return data, err
+	}
+	if image.Config != nil {
+		data.Labels = image.Config.Labels
+	}
+	return data, nil
+}
+
 func (p *dockerProvisioner) GitDeploy(app provision.App, version string, w io.Writer) (string, error) {
 	imageId, err := p.gitDeploy(app, version, w)
 	if err != nil {
@@ -765,6 +814,13 @@ func (p *dockerProvisioner) PlatformAdd(name string, args map[string]string, w i
 	if err != nil {
 		return err
 	}
+	if version := args["version"]; version != "" {
+		tagOpts := docker.TagImageOptions{Repo: imageName, Tag: version, Force: true}
+		err = cluster.TagImage(imageName, tagOpts)
+		if err != nil {
+			return err
+		}
+	}
 	return p.pushImage(imageName, "")
 }
 
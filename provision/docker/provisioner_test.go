@@ -430,6 +430,109 @@ func (s *S) TestImageDeployInvalidImage(c *check.C) {
 	c.Assert(units, check.HasLen, 0)
 }
 
+func (s *S) TestExternalImageDeploy(c *check.C) {
+	go s.stopContainers(1)
+	config.Set("docker:external-registries", []interface{}{"registry.example.com"})
+	defer config.Unset("docker:external-registries")
+	err := s.newFakeImage(s.p, "tsuru/app-otherapp:v1")
+	c.Assert(err, check.IsNil)
+	s.server.CustomHandler("/images/registry.example.com/myimage:1.0/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		image := docker.Image{
+			ID: "myimage",
+			Config: &docker.Config{
+				ExposedPorts: map[docker.Port]struct{}{"8000/tcp": {}},
+				Entrypoint:   []string{"/bin/myapp"},
+				Cmd:          []string{"--serve"},
+			},
+		}
+		json.NewEncoder(w).Encode(image)
+	}))
+	a := app.App{
+		Name:     "otherapp",
+		Platform: "python",
+	}
+	conn, err := db.Conn()
+	defer conn.Close()
+	err = conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer conn.Apps().Remove(bson.M{"name": a.Name})
+	s.p.Provision(&a)
+	defer s.p.Destroy(&a)
+	w := safe.NewBuffer(make([]byte, 2048))
+	err = app.Deploy(app.DeployOptions{
+		App:           &a,
+		OutputStream:  w,
+		ExternalImage: "registry.example.com/myimage:1.0",
+	})
+	c.Assert(err, check.IsNil)
+	units := a.Units()
+	c.Assert(units, check.HasLen, 1)
+	images, err := listAppImages("otherapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(images, check.DeepEquals, []string{"tsuru/app-otherapp:v1"})
+	metadata, err := getImageMetadata("tsuru/app-otherapp:v1")
+	c.Assert(err, check.IsNil)
+	c.Assert(metadata, check.DeepEquals, imageMetadata{
+		ExposedPort: "8000",
+		Entrypoint:  []string{"/bin/myapp"},
+		Cmd:         []string{"--serve"},
+	})
+	cont, err := s.p.getContainer(units[0].Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(cont.ExposedPort, check.Equals, "8000")
+	dockerContainer, err := s.p.getCluster().InspectContainer(cont.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(dockerContainer.Config.Entrypoint, check.DeepEquals, []string{"/bin/myapp"})
+	c.Assert(dockerContainer.Config.Cmd, check.DeepEquals, []string{"--serve"})
+	c.Assert(dockerContainer.Config.Env, check.DeepEquals, []string{"PORT=8000"})
+}
+
+func (s *S) TestExternalImageDeployRegistryNotAllowed(c *check.C) {
+	config.Set("docker:external-registries", []interface{}{"registry.example.com"})
+	defer config.Unset("docker:external-registries")
+	a := app.App{
+		Name:     "otherapp",
+		Platform: "python",
+	}
+	conn, err := db.Conn()
+	defer conn.Close()
+	err = conn.Apps().Insert(a)
+	c.Assert(err, check.IsNil)
+	defer conn.Apps().Remove(bson.M{"name": a.Name})
+	s.p.Provision(&a)
+	defer s.p.Destroy(&a)
+	w := safe.NewBuffer(make([]byte, 2048))
+	err = app.Deploy(app.DeployOptions{
+		App:           &a,
+		OutputStream:  w,
+		ExternalImage: "otherregistry.example.com/myimage:1.0",
+	})
+	c.Assert(err, check.ErrorMatches, "the image otherregistry.example.com/myimage:1.0 is not stored in an allowed registry")
+	units := a.Units()
+	c.Assert(units, check.HasLen, 0)
+}
+
+func (s *S) TestImageData(c *check.C) {
+	err := s.newFakeImage(s.p, "tsuru/app-otherapp:v1")
+	c.Assert(err, check.IsNil)
+	s.server.CustomHandler("/images/tsuru/app-otherapp:v1/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		image := docker.Image{
+			ID:     "otherapp",
+			Config: &docker.Config{Labels: map[string]string{"version": "1.0"}},
+		}
+		json.NewEncoder(w).Encode(image)
+	}))
+	customData := map[string]interface{}{
+		"healthcheck": map[string]interface{}{"path": "/status"},
+	}
+	err = saveImageCustomData("tsuru/app-otherapp:v1", customData)
+	c.Assert(err, check.IsNil)
+	data, err := s.p.ImageData("tsuru/app-otherapp:v1")
+	c.Assert(err, check.IsNil)
+	c.Assert(data.TsuruYaml.Healthcheck.Path, check.Equals, "/status")
+	c.Assert(data.Labels, check.DeepEquals, map[string]string{"version": "1.0"})
+}
+
 func (s *S) TestImageDeployFailureDoesntEraseImage(c *check.C) {
 	err := s.newFakeImage(s.p, "tsuru/app-otherapp:v1")
 	c.Assert(err, check.IsNil)
@@ -1035,6 +1138,35 @@ func (s *S) TestProvisionerStop(c *check.C) {
 	c.Assert(dockerContainer.State.Running, check.Equals, false)
 }
 
+func (s *S) TestProvisionerCancelDeploy(c *check.C) {
+	dcli, _ := docker.NewClient(s.server.URL())
+	app := provisiontest.NewFakeApp("almah", "static", 2)
+	building, err := s.newContainer(&newContainerOpts{AppName: app.GetName(), Status: provision.StatusBuilding.String()}, nil)
+	c.Assert(err, check.IsNil)
+	defer s.removeTestContainer(building)
+	err = dcli.StartContainer(building.ID, nil)
+	c.Assert(err, check.IsNil)
+	started, err := s.newContainer(&newContainerOpts{AppName: app.GetName(), Status: provision.StatusStarted.String()}, nil)
+	c.Assert(err, check.IsNil)
+	defer s.removeTestContainer(started)
+	err = dcli.StartContainer(started.ID, nil)
+	c.Assert(err, check.IsNil)
+	err = s.p.CancelDeploy(app)
+	c.Assert(err, check.IsNil)
+	dockerContainer, err := dcli.InspectContainer(building.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(dockerContainer.State.Running, check.Equals, false)
+	dockerContainer, err = dcli.InspectContainer(started.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(dockerContainer.State.Running, check.Equals, true)
+}
+
+func (s *S) TestProvisionerCancelDeployNothingToCancel(c *check.C) {
+	app := provisiontest.NewFakeApp("almah", "static", 2)
+	err := s.p.CancelDeploy(app)
+	c.Assert(err, check.Equals, provision.ErrNothingToCancel)
+}
+
 func (s *S) TestProvisionerStopSkipAlreadyStoppedContainers(c *check.C) {
 	dcli, _ := docker.NewClient(s.server.URL())
 	app := provisiontest.NewFakeApp("almah", "static", 2)
@@ -1093,6 +1225,37 @@ func (s *S) TestProvisionerPlatformAdd(c *check.C) {
 	c.Assert(requests[2].URL.Path, check.Equals, "/images/localhost:3030/tsuru/test/push")
 }
 
+func (s *S) TestProvisionerPlatformAddWithVersion(c *check.C) {
+	var requests []*http.Request
+	server, err := testing.NewServer("127.0.0.1:0", nil, func(r *http.Request) {
+		requests = append(requests, r)
+	})
+	c.Assert(err, check.IsNil)
+	defer server.Stop()
+	config.Set("docker:registry", "localhost:3030")
+	defer config.Unset("docker:registry")
+	var p dockerProvisioner
+	err = p.Initialize()
+	c.Assert(err, check.IsNil)
+	p.cluster, _ = cluster.New(nil, &cluster.MapStorage{},
+		cluster.Node{Address: server.URL()})
+	args := map[string]string{"dockerfile": "http://localhost/Dockerfile", "version": "3.4-2015.06"}
+	err = p.PlatformAdd("test", args, bytes.NewBuffer(nil))
+	c.Assert(err, check.IsNil)
+	c.Assert(requests[0].URL.Path, check.Equals, "/build")
+	c.Assert(requests[0].URL.Query().Get("t"), check.Equals, platformImageName("test"))
+	var tagged bool
+	for _, r := range requests {
+		if r.URL.Path == "/images/localhost:3030/tsuru/test/tag" {
+			c.Assert(r.URL.Query().Get("repo"), check.Equals, platformImageName("test"))
+			c.Assert(r.URL.Query().Get("tag"), check.Equals, "3.4-2015.06")
+			tagged = true
+		}
+	}
+	c.Assert(tagged, check.Equals, true)
+	c.Assert(requests[len(requests)-1].URL.Path, check.Equals, "/images/localhost:3030/tsuru/test/push")
+}
+
 func (s *S) TestProvisionerPlatformAddWithoutArgs(c *check.C) {
 	err := s.p.PlatformAdd("test", nil, nil)
 	c.Assert(err, check.NotNil)
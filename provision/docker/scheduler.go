@@ -7,7 +7,6 @@ package docker
 import (
 	"errors"
 	"fmt"
-	"math"
 	"strconv"
 	"sync"
 
@@ -135,6 +134,22 @@ func (s *segregatedScheduler) aggregateContainersByHostApp(hosts []string, appNa
 	return s.aggregateContainersBy(bson.M{"$match": bson.M{"appname": appName, "hostaddr": bson.M{"$in": hosts}, "id": bson.M{"$nin": s.ignoredContainers}}})
 }
 
+func (s *segregatedScheduler) aggregateBuildContainersByHost(hosts []string) (map[string]int, error) {
+	return s.aggregateContainersBy(bson.M{"$match": bson.M{"buildingimage": bson.M{"$nin": []interface{}{"", nil}}, "hostaddr": bson.M{"$in": hosts}, "id": bson.M{"$nin": s.ignoredContainers}}})
+}
+
+// isBuildContainer checks whether the container with the given name is used
+// to build an image in a deploy.
+func (s *segregatedScheduler) isBuildContainer(contName string) bool {
+	if contName == "" {
+		return false
+	}
+	coll := s.provisioner.collection()
+	defer coll.Close()
+	n, err := coll.Find(bson.M{"name": contName, "buildingimage": bson.M{"$nin": []interface{}{"", nil}}}).Count()
+	return err == nil && n > 0
+}
+
 func (s *segregatedScheduler) GetRemovableContainer(appName string, c *cluster.Cluster) (string, error) {
 	a, _ := app.GetByName(appName)
 	nodes, err := s.provisioner.Nodes(a)
@@ -201,6 +216,25 @@ func (s *segregatedScheduler) nodesToHosts(nodes []cluster.Node) ([]string, map[
 	return hosts, hostsMap
 }
 
+// nodeLoad holds the number of containers in a node that are considered when
+// choosing a node: build containers, containers of the app and all
+// containers, in this order of precedence.
+type nodeLoad struct {
+	builds        int
+	appContainers int
+	containers    int
+}
+
+func (l nodeLoad) less(other nodeLoad) bool {
+	if l.builds != other.builds {
+		return l.builds < other.builds
+	}
+	if l.appContainers != other.appContainers {
+		return l.appContainers < other.appContainers
+	}
+	return l.containers < other.containers
+}
+
 // chooseNode finds which is the node with the minimum number
 // of containers and returns it
 func (s *segregatedScheduler) chooseNode(nodes []cluster.Node, contName string, appName string) (string, error) {
@@ -217,19 +251,28 @@ func (s *segregatedScheduler) chooseNode(nodes []cluster.Node, contName string,
 	if err != nil {
 		return chosenNode, err
 	}
+	// Build containers are spread across nodes, so concurrent deploys don't
+	// pile up in the same node.
+	var buildCountMap map[string]int
+	if s.isBuildContainer(contName) {
+		buildCountMap, err = s.aggregateBuildContainersByHost(hosts)
+		if err != nil {
+			return chosenNode, err
+		}
+	}
 	// Finally finding the host with the minimum value for
-	// the pair [appCount, hostCount]
+	// the triple [buildCount, appCount, hostCount]
 	var minHost string
-	minCount := math.MaxInt32
-	for _, host := range hosts {
-		adjCount := appCountMap[host]*10000 + hostCountMap[host]
-		if adjCount < minCount {
-			minCount = adjCount
+	var minLoad nodeLoad
+	for i, host := range hosts {
+		load := nodeLoad{builds: buildCountMap[host], appContainers: appCountMap[host], containers: hostCountMap[host]}
+		if i == 0 || load.less(minLoad) {
+			minLoad = load
 			minHost = host
 		}
 	}
 	chosenNode = hostsMap[minHost]
-	log.Debugf("[scheduler] Chosen node for container %s: %#v Count: %d", contName, chosenNode, minCount)
+	log.Debugf("[scheduler] Chosen node for container %s: %#v Load: %+v", contName, chosenNode, minLoad)
 	if contName != "" {
 		coll := s.provisioner.collection()
 		defer coll.Close()
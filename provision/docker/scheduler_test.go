@@ -369,6 +369,52 @@ func (s *S) TestChooseNodeDistributesNodesEqually(c *check.C) {
 	c.Check(n, check.Equals, unitsPerNode)
 }
 
+func (s *S) TestChooseNodeSpreadsBuildContainers(c *check.C) {
+	nodes := []cluster.Node{
+		{Address: "http://server1:1234"},
+		{Address: "http://server2:1234"},
+	}
+	contColl := s.p.collection()
+	defer contColl.RemoveAll(bson.M{"appname": bson.M{"$in": []string{"coolapp10", "coolapp11"}}})
+	cont1 := container{ID: "pre1", Name: "existingUnit1", AppName: "coolapp10", HostAddr: "server2"}
+	err := contColl.Insert(cont1)
+	c.Assert(err, check.IsNil)
+	cont2 := container{ID: "pre2", Name: "existingBuild", AppName: "coolapp10", HostAddr: "server1", BuildingImage: "tsuru/app-coolapp10:v1"}
+	err = contColl.Insert(cont2)
+	c.Assert(err, check.IsNil)
+	sched := segregatedScheduler{provisioner: s.p}
+	cont := container{ID: "build1", Name: "buildUnit", AppName: "coolapp11", BuildingImage: "tsuru/app-coolapp11:v1"}
+	err = contColl.Insert(cont)
+	c.Assert(err, check.IsNil)
+	node, err := sched.chooseNode(nodes, cont.Name, "coolapp11")
+	c.Assert(err, check.IsNil)
+	c.Assert(node, check.Equals, "http://server2:1234")
+	cont = container{ID: "unit1", Name: "regularUnit", AppName: "coolapp11"}
+	err = contColl.Insert(cont)
+	c.Assert(err, check.IsNil)
+	node, err = sched.chooseNode(nodes, cont.Name, "coolapp11")
+	c.Assert(err, check.IsNil)
+	c.Assert(node, check.Equals, "http://server1:1234")
+}
+
+func (s *S) TestNodeLoadLess(c *check.C) {
+	var tests = []struct {
+		a, b     nodeLoad
+		expected bool
+	}{
+		{nodeLoad{0, 0, 1}, nodeLoad{0, 0, 2}, true},
+		{nodeLoad{0, 0, 2}, nodeLoad{0, 0, 2}, false},
+		{nodeLoad{0, 0, 20000}, nodeLoad{0, 1, 0}, true},
+		{nodeLoad{0, 1, 0}, nodeLoad{0, 0, 20000}, false},
+		{nodeLoad{0, 5000, 100000}, nodeLoad{1, 0, 0}, true},
+		{nodeLoad{1, 0, 0}, nodeLoad{0, 5000, 100000}, false},
+		{nodeLoad{1, 2, 3}, nodeLoad{1, 2, 4}, true},
+	}
+	for _, t := range tests {
+		c.Check(t.a.less(t.b), check.Equals, t.expected, check.Commentf("%+v < %+v", t.a, t.b))
+	}
+}
+
 func (s *S) TestChooseNodeDistributesNodesEquallyDifferentApps(c *check.C) {
 	nodes := []cluster.Node{
 		{Address: "http://server1:1234"},
@@ -19,6 +19,10 @@ var ErrInvalidStatus = errors.New("invalid status")
 
 var ErrEmptyApp = errors.New("no units for this app")
 
+// ErrNothingToCancel is returned by provisioners that can't cancel the deploy
+// in progress, because it is not building the app anymore.
+var ErrNothingToCancel = errors.New("nothing to cancel: the deploy is not building the app")
+
 // Status represents the status of a unit in tsuru.
 type Status string
 
@@ -134,6 +138,10 @@ type App interface {
 	// to the Unit `Type` field.
 	GetPlatform() string
 
+	// GetPlatformVersion returns the version of the platform used by the
+	// app. An empty version means the latest version of the platform.
+	GetPlatformVersion() string
+
 	// GetDeploy returns the deploys that an app has.
 	GetDeploys() uint
 
@@ -203,6 +211,31 @@ type ImageDeployer interface {
 	ImageDeploy(app App, image string, w io.Writer) (string, error)
 }
 
+// ExternalImageDeployer is a provisioner that can deploy the application from
+// an image built outside tsuru, stored in an external registry.
+type ExternalImageDeployer interface {
+	ExternalImageDeploy(app App, image string, w io.Writer) (string, error)
+}
+
+// DeployCanceler is a provisioner that can cancel a deploy in progress,
+// stopping the build of the app. It returns ErrNothingToCancel when the app is
+// not being built.
+type DeployCanceler interface {
+	CancelDeploy(app App) error
+}
+
+// ImageData holds information about an image generated in a deploy.
+type ImageData struct {
+	TsuruYaml TsuruYamlData
+	Labels    map[string]string
+}
+
+// ImageDataProvider is a provisioner that can describe the images generated
+// in deploys.
+type ImageDataProvider interface {
+	ImageData(imageName string) (ImageData, error)
+}
+
 // Provisioner is the basic interface of this package.
 //
 // Any tsuru provisioner must implement this interface in order to provision
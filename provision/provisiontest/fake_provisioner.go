@@ -25,25 +25,26 @@ func init() {
 
 // Fake implementation for provision.App.
 type FakeApp struct {
-	name           string
-	platform       string
-	units          []provision.Unit
-	logs           []string
-	logMut         sync.Mutex
-	Commands       []string
-	Memory         int64
-	Swap           int64
-	CpuShare       int
-	commMut        sync.Mutex
-	Deploys        uint
-	env            map[string]bind.EnvVar
-	bindCalls      []*provision.Unit
-	bindLock       sync.Mutex
-	instances      map[string][]bind.ServiceInstance
-	Pool           string
-	UpdatePlatform bool
-	TeamOwner      string
-	Teams          []string
+	name            string
+	platform        string
+	units           []provision.Unit
+	logs            []string
+	logMut          sync.Mutex
+	Commands        []string
+	Memory          int64
+	Swap            int64
+	CpuShare        int
+	commMut         sync.Mutex
+	Deploys         uint
+	env             map[string]bind.EnvVar
+	bindCalls       []*provision.Unit
+	bindLock        sync.Mutex
+	instances       map[string][]bind.ServiceInstance
+	Pool            string
+	UpdatePlatform  bool
+	PlatformVersion string
+	TeamOwner       string
+	Teams           []string
 }
 
 func NewFakeApp(name, platform string, units int) *FakeApp {
@@ -194,6 +195,10 @@ func (a *FakeApp) GetPlatform() string {
 	return a.platform
 }
 
+func (a *FakeApp) GetPlatformVersion() string {
+	return a.PlatformVersion
+}
+
 func (a *FakeApp) GetDeploys() uint {
 	return a.Deploys
 }
@@ -307,6 +312,7 @@ type FakeProvisioner struct {
 	mut      sync.RWMutex
 	shells   map[string][]provision.ShellOptions
 	shellMut sync.Mutex
+	images   map[string]provision.ImageData
 }
 
 func NewFakeProvisioner() *FakeProvisioner {
@@ -315,6 +321,7 @@ func NewFakeProvisioner() *FakeProvisioner {
 	p.failures = make(chan failure, 8)
 	p.apps = make(map[string]provisionedApp)
 	p.shells = make(map[string][]provision.ShellOptions)
+	p.images = make(map[string]provision.ImageData)
 	return &p
 }
 
@@ -402,6 +409,21 @@ func (p *FakeProvisioner) Version(app provision.App) string {
 	return p.apps[app.GetName()].version
 }
 
+// LastImage returns the last external image deployed in the given app.
+func (p *FakeProvisioner) LastImage(app provision.App) string {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	return p.apps[app.GetName()].lastImage
+}
+
+// Cancels returns the number of times the deploy of the given app was
+// canceled.
+func (p *FakeProvisioner) Cancels(app provision.App) int {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	return p.apps[app.GetName()].cancels
+}
+
 // PrepareOutput sends the given slice of bytes to a queue of outputs.
 //
 // Each prepared output will be used in the ExecuteCommand. It might be sent to
@@ -432,6 +454,7 @@ func (p *FakeProvisioner) Reset() {
 
 	p.mut.Lock()
 	p.apps = make(map[string]provisionedApp)
+	p.images = make(map[string]provision.ImageData)
 	p.mut.Unlock()
 
 	p.shellMut.Lock()
@@ -526,6 +549,53 @@ func (p *FakeProvisioner) ImageDeploy(app provision.App, img string, w io.Writer
 	return img, nil
 }
 
+func (p *FakeProvisioner) CancelDeploy(app provision.App) error {
+	if err := p.getError("CancelDeploy"); err != nil {
+		return err
+	}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	pApp, ok := p.apps[app.GetName()]
+	if !ok {
+		return errNotProvisioned
+	}
+	pApp.cancels++
+	p.apps[app.GetName()] = pApp
+	return nil
+}
+
+// SetImageData defines the data returned by ImageData for the given image.
+func (p *FakeProvisioner) SetImageData(imageName string, data provision.ImageData) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.images[imageName] = data
+}
+
+func (p *FakeProvisioner) ImageData(imageName string) (provision.ImageData, error) {
+	if err := p.getError("ImageData"); err != nil {
+		return provision.ImageData{}, err
+	}
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	return p.images[imageName], nil
+}
+
+func (p *FakeProvisioner) ExternalImageDeploy(app provision.App, img string, w io.Writer) (string, error) {
+	if err := p.getError("ExternalImageDeploy"); err != nil {
+		return "", err
+	}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	pApp, ok := p.apps[app.GetName()]
+	if !ok {
+		return "", errNotProvisioned
+	}
+	w.Write([]byte("External image deploy called"))
+	pApp.lastImage = img
+	p.apps[app.GetName()] = pApp
+	return "app-image", nil
+}
+
 func (p *FakeProvisioner) Provision(app provision.App) error {
 	if err := p.getError("Provision"); err != nil {
 		return err
@@ -1008,6 +1078,8 @@ type provisionedApp struct {
 	version     string
 	lastArchive string
 	lastFile    io.ReadCloser
+	lastImage   string
+	cancels     int
 	cnames      []string
 	addr        string
 	unitLen     int
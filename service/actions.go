@@ -68,13 +68,21 @@ var createServiceInstance = action.Action{
 
 // insertServiceInstance is an action that inserts an instance in the database.
 //
-// The first argument in the context must be a Service Instance.
+// The first argument in the context must be a Service Instance. When the
+// previous action returns the instance, that one is inserted instead, so the
+// state reported by the service API is kept.
 var insertServiceInstance = action.Action{
 	Name: "insert-service-instance",
 	Forward: func(ctx action.FWContext) (action.Result, error) {
-		instance, ok := ctx.Params[1].(ServiceInstance)
+		instance, ok := ctx.Previous.(ServiceInstance)
 		if !ok {
-			return nil, stderrors.New("Second parameter must be a ServiceInstance.")
+			instance, ok = ctx.Params[1].(ServiceInstance)
+			if !ok {
+				return nil, stderrors.New("Second parameter must be a ServiceInstance.")
+			}
+		}
+		if instance.State == "" {
+			instance.setState(StateReady, "")
 		}
 		conn, err := db.Conn()
 		if err != nil {
@@ -117,6 +125,9 @@ var addAppToServiceInstance = action.Action{
 		if err := conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si); err != nil {
 			return nil, err
 		}
+		if err := si.checkReady(); err != nil {
+			return nil, err
+		}
 		a, ok := ctx.Params[0].(bind.App)
 		if !ok {
 			return nil, stderrors.New("First parameter must be a bind.App.")
@@ -133,13 +144,14 @@ var addAppToServiceInstance = action.Action{
 		si, ok := ctx.Params[1].(ServiceInstance)
 		if !ok {
 			log.Error("Second parameter must be a ServiceInstance.")
+			return
 		}
 		a, ok := ctx.Params[0].(bind.App)
 		if !ok {
 			log.Error("First parameter must be a bind.App.")
+			return
 		}
-		si.RemoveApp(a.GetName())
-		if err := si.update(); err != nil {
+		if err := si.pullApp(a.GetName()); err != nil {
 			log.Errorf("Could not remove app from service instance: %s", err.Error())
 		}
 	},
@@ -239,10 +251,22 @@ var setTsuruServices = action.Action{
 			return
 		}
 		instance := ctx.FWResult.(bind.ServiceInstance)
-		app.RemoveInstance(si.ServiceName, instance, writer)
+		if err := app.RemoveInstance(si.ServiceName, instance, writer); err != nil {
+			log.Errorf("Could not remove the instance %q from the app %q, unsetting its environment variables: %s", si.Name, app.GetName(), err)
+			names := make([]string, 0, len(instance.Envs))
+			for name := range instance.Envs {
+				names = append(names, name)
+			}
+			if err = app.UnsetEnvs(names, false, writer); err != nil {
+				log.Errorf("Could not unset the environment variables of the instance %q: %s", si.Name, err)
+			}
+		}
 	},
 }
 
+// bindUnitsToServiceInstance binds all units of the app to the service
+// instance. When any unit fails to bind, the units that were already bound
+// are unbound before the error is returned.
 var bindUnitsToServiceInstance = action.Action{
 	Name: "bind-units-to-service-instance",
 	Forward: func(ctx action.FWContext) (action.Result, error) {
@@ -259,30 +283,215 @@ var bindUnitsToServiceInstance = action.Action{
 			return nil, stderrors.New(msg)
 		}
 		units := app.GetUnits()
-		if len(units) == 0 {
-			return nil, nil
-		}
-		errChan := make(chan error, len(units)+1)
-		var wg sync.WaitGroup
-		wg.Add(len(units))
-		for _, unit := range units {
-			go func(unit bind.Unit) {
-				defer wg.Done()
-				err := si.BindUnit(app, unit)
-				if err != nil {
-					errChan <- err
-					return
-				}
-			}(unit)
+		bound, err := forEachUnit(units, func(unit bind.Unit) error {
+			return si.BindUnit(app, unit)
+		})
+		if err != nil {
+			log.Error(err.Error())
+			forEachUnit(bound, func(unit bind.Unit) error {
+				return si.UnbindUnit(app, unit)
+			})
+			return nil, err
+		}
+		return units, nil
+	},
+	Backward: func(ctx action.BWContext) {
+		si, ok := ctx.Params[1].(ServiceInstance)
+		if !ok {
+			log.Error("Second parameter must be a ServiceInstance.")
+			return
+		}
+		app, ok := ctx.Params[0].(bind.App)
+		if !ok {
+			log.Error("First parameter must be a bind.App.")
+			return
+		}
+		units, _ := ctx.FWResult.([]bind.Unit)
+		forEachUnit(units, func(unit bind.Unit) error {
+			return si.UnbindUnit(app, unit)
+		})
+	},
+}
+
+// removeAppFromServiceInstance is the first action of the unbind pipeline,
+// removing the app from the list of apps of the service instance.
+var removeAppFromServiceInstance = action.Action{
+	Name: "remove-app-from-service-instance",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		si, ok := ctx.Params[1].(ServiceInstance)
+		if !ok {
+			return nil, stderrors.New("Second parameter must be a ServiceInstance.")
+		}
+		a, ok := ctx.Params[0].(bind.App)
+		if !ok {
+			return nil, stderrors.New("First parameter must be a bind.App.")
+		}
+		if err := si.RemoveApp(a.GetName()); err != nil {
+			return nil, &errors.HTTP{Code: http.StatusPreconditionFailed, Message: "This app is not bound to this service instance."}
+		}
+		return nil, si.pullApp(a.GetName())
+	},
+	Backward: func(ctx action.BWContext) {
+		si, ok := ctx.Params[1].(ServiceInstance)
+		if !ok {
+			log.Error("Second parameter must be a ServiceInstance.")
+			return
+		}
+		a, ok := ctx.Params[0].(bind.App)
+		if !ok {
+			log.Error("First parameter must be a bind.App.")
+			return
 		}
-		wg.Wait()
-		close(errChan)
-		if err, ok := <-errChan; ok {
+		if err := si.addToSetApp(a.GetName()); err != nil {
+			log.Errorf("Could not add app back to service instance: %s", err.Error())
+		}
+	},
+	MinParams: 2,
+}
+
+// unbindUnitsFromServiceInstance unbinds all units of the app from the
+// service instance. When any unit fails to unbind, the units that were
+// already unbound are bound again before the error is returned.
+var unbindUnitsFromServiceInstance = action.Action{
+	Name: "unbind-units-from-service-instance",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		si, ok := ctx.Params[1].(ServiceInstance)
+		if !ok {
+			return nil, stderrors.New("Second parameter must be a ServiceInstance.")
+		}
+		app, ok := ctx.Params[0].(bind.App)
+		if !ok {
+			return nil, stderrors.New("First parameter must be a bind.App.")
+		}
+		units := app.GetUnits()
+		unbound, err := forEachUnit(units, func(unit bind.Unit) error {
+			return si.UnbindUnit(app, unit)
+		})
+		if err != nil {
 			log.Error(err.Error())
+			forEachUnit(unbound, func(unit bind.Unit) error {
+				return si.BindUnit(app, unit)
+			})
 			return nil, err
 		}
-		return nil, nil
+		return units, nil
 	},
 	Backward: func(ctx action.BWContext) {
+		si, ok := ctx.Params[1].(ServiceInstance)
+		if !ok {
+			log.Error("Second parameter must be a ServiceInstance.")
+			return
+		}
+		app, ok := ctx.Params[0].(bind.App)
+		if !ok {
+			log.Error("First parameter must be a bind.App.")
+			return
+		}
+		units, _ := ctx.FWResult.([]bind.Unit)
+		forEachUnit(units, func(unit bind.Unit) error {
+			return si.BindUnit(app, unit)
+		})
+	},
+	MinParams: 2,
+}
+
+// unbindAppFromServiceInstance asks the service API to unbind the app.
+var unbindAppFromServiceInstance = action.Action{
+	Name: "unbind-app-from-service-instance",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		si, ok := ctx.Params[1].(ServiceInstance)
+		if !ok {
+			return nil, stderrors.New("Second parameter must be a ServiceInstance.")
+		}
+		app, ok := ctx.Params[0].(bind.App)
+		if !ok {
+			return nil, stderrors.New("First parameter must be a bind.App.")
+		}
+		endpoint, err := si.Service().getClient("production")
+		if err != nil {
+			return nil, err
+		}
+		return nil, endpoint.UnbindApp(&si, app)
 	},
+	Backward: func(ctx action.BWContext) {
+		si, ok := ctx.Params[1].(ServiceInstance)
+		if !ok {
+			log.Error("Second parameter must be a ServiceInstance.")
+			return
+		}
+		app, ok := ctx.Params[0].(bind.App)
+		if !ok {
+			log.Error("First parameter must be a bind.App.")
+			return
+		}
+		endpoint, err := si.Service().getClient("production")
+		if err != nil {
+			log.Errorf("Could not get endpoint: %s.", err.Error())
+			return
+		}
+		if _, err = endpoint.BindApp(&si, app); err != nil {
+			log.Errorf("Could not bind the app %q again: %s", app.GetName(), err)
+		}
+	},
+	MinParams: 2,
+}
+
+// removeTsuruServices removes the environment variables of the service
+// instance from the app, along with its entry in TSURU_SERVICES. It's the
+// last action of the unbind pipeline.
+var removeTsuruServices = action.Action{
+	Name: "remove-TSURU_SERVICES-env-var",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		var writer io.Writer
+		if len(ctx.Params) > 2 && ctx.Params[2] != nil {
+			var ok bool
+			writer, ok = ctx.Params[2].(io.Writer)
+			if !ok {
+				return nil, stderrors.New("Third parameter must be a io.Writer.")
+			}
+		}
+		si, ok := ctx.Params[1].(ServiceInstance)
+		if !ok {
+			return nil, stderrors.New("Second parameter must be a ServiceInstance.")
+		}
+		app, ok := ctx.Params[0].(bind.App)
+		if !ok {
+			return nil, stderrors.New("First parameter must be a bind.App.")
+		}
+		instance := bind.ServiceInstance{Name: si.Name, Envs: make(map[string]string)}
+		for k, envVar := range app.InstanceEnv(si.Name) {
+			instance.Envs[k] = envVar.Value
+		}
+		return instance, app.RemoveInstance(si.ServiceName, instance, writer)
+	},
+	MinParams: 2,
+}
+
+// forEachUnit runs fn for all units concurrently, returning the units for
+// which fn succeeded and the first error.
+func forEachUnit(units []bind.Unit, fn func(bind.Unit) error) ([]bind.Unit, error) {
+	var (
+		wg       sync.WaitGroup
+		mut      sync.Mutex
+		firstErr error
+		done     []bind.Unit
+	)
+	wg.Add(len(units))
+	for _, unit := range units {
+		go func(unit bind.Unit) {
+			defer wg.Done()
+			err := fn(unit)
+			mut.Lock()
+			defer mut.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			done = append(done, unit)
+		}(unit)
+	}
+	wg.Wait()
+	return done, firstErr
 }
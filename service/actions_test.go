@@ -128,6 +128,26 @@ func (s *S) TestInsertServiceInstanceForward(c *check.C) {
 	defer s.conn.ServiceInstances().Remove(bson.M{"name": instance.Name})
 	err = s.conn.ServiceInstances().Find(bson.M{"name": instance.Name}).One(&instance)
 	c.Assert(err, check.IsNil)
+	c.Assert(instance.State, check.Equals, StateReady)
+	c.Assert(instance.Transitions, check.HasLen, 1)
+}
+
+func (s *S) TestInsertServiceInstanceForwardPreviousResult(c *check.C) {
+	srv := Service{Name: "mongodb"}
+	instance := ServiceInstance{Name: "mysql"}
+	pending := instance
+	pending.setState(StatePending, "")
+	ctx := action.FWContext{
+		Params:   []interface{}{srv, instance},
+		Previous: pending,
+	}
+	_, err := insertServiceInstance.Forward(ctx)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": instance.Name})
+	err = s.conn.ServiceInstances().Find(bson.M{"name": instance.Name}).One(&instance)
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.State, check.Equals, StatePending)
+	c.Assert(instance.Transitions, check.HasLen, 1)
 }
 
 func (s *S) TestInsertServiceInstanceForwardParams(c *check.C) {
@@ -221,6 +241,28 @@ func (s *S) TestAddAppToServiceInstanceForwardTwice(c *check.C) {
 	c.Assert(err, check.ErrorMatches, "^This app is already bound to this service instance.$")
 }
 
+func (s *S) TestAddAppToServiceInstanceForwardNotReady(c *check.C) {
+	si := ServiceInstance{Name: "mysql"}
+	si.setState(StatePending, "")
+	err := s.conn.ServiceInstances().Insert(&si)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": si.Name})
+	a := provisiontest.NewFakeApp("myapp", "static", 1)
+	defer s.conn.Apps().Remove(bson.M{"name": a.GetName()})
+	ctx := action.FWContext{
+		Params: []interface{}{a, si},
+	}
+	_, err = addAppToServiceInstance.Forward(ctx)
+	c.Assert(err, check.Equals, ErrInstanceNotReady)
+	err = s.conn.ServiceInstances().Update(bson.M{"name": si.Name}, bson.M{"$set": bson.M{"state": StateFailed}})
+	c.Assert(err, check.IsNil)
+	_, err = addAppToServiceInstance.Forward(ctx)
+	c.Assert(err, check.Equals, ErrInstanceFailed)
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Apps, check.HasLen, 0)
+}
+
 func (s *S) TestAddAppToServiceInstanceBackwardRemovesAppFromServiceInstance(c *check.C) {
 	si := ServiceInstance{Name: "mysql"}
 	err := s.conn.ServiceInstances().Insert(&si)
@@ -352,3 +394,160 @@ func (s *S) TestSetTsuruServicesBackward(c *check.C) {
 	instances := a.GetInstances("mysql")
 	c.Assert(instances, check.HasLen, 0)
 }
+
+func (s *S) TestSetTsuruServicesBackwardUnsetsEnvsWhenTheInstanceIsMissing(c *check.C) {
+	instance := bind.ServiceInstance{
+		Name: "my-mysql",
+		Envs: map[string]string{"DATABASE_NAME": "mydb"},
+	}
+	si := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	a := provisiontest.NewFakeApp("myapp", "static", 1)
+	a.SetEnv(bind.EnvVar{Name: "DATABASE_NAME", Value: "mydb", InstanceName: si.Name})
+	a.SetEnv(bind.EnvVar{Name: "MY_VAR", Value: "123"})
+	ctx := action.BWContext{
+		Params:   []interface{}{a, si},
+		FWResult: instance,
+	}
+	setTsuruServices.Backward(ctx)
+	c.Assert(a.Envs(), check.DeepEquals, map[string]bind.EnvVar{
+		"MY_VAR": {Name: "MY_VAR", Value: "123"},
+	})
+}
+
+func (s *S) TestBindUnitsToServiceInstanceForwardUnbindsBoundUnitsOnFailure(c *check.C) {
+	var binds, unbinds int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			atomic.AddInt32(&unbinds, 1)
+			return
+		}
+		if atomic.AddInt32(&binds, 1) > 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+	service := Service{Name: "mysql", Endpoint: map[string]string{"production": ts.URL}}
+	err := service.Create()
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(service.Name)
+	si := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	a := provisiontest.NewFakeApp("myapp", "static", 3)
+	ctx := action.FWContext{Params: []interface{}{a, si}}
+	_, err = bindUnitsToServiceInstance.Forward(ctx)
+	c.Assert(err, check.NotNil)
+	c.Assert(atomic.LoadInt32(&binds), check.Equals, int32(3))
+	c.Assert(atomic.LoadInt32(&unbinds), check.Equals, int32(1))
+}
+
+func (s *S) TestBindUnitsToServiceInstanceBackward(c *check.C) {
+	var unbinds int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" && r.URL.Path == "/resources/my-mysql/bind" {
+			atomic.AddInt32(&unbinds, 1)
+		}
+	}))
+	defer ts.Close()
+	service := Service{Name: "mysql", Endpoint: map[string]string{"production": ts.URL}}
+	err := service.Create()
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(service.Name)
+	si := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	a := provisiontest.NewFakeApp("myapp", "static", 2)
+	ctx := action.BWContext{
+		Params:   []interface{}{a, si},
+		FWResult: a.GetUnits(),
+	}
+	bindUnitsToServiceInstance.Backward(ctx)
+	c.Assert(atomic.LoadInt32(&unbinds), check.Equals, int32(2))
+}
+
+func (s *S) TestRemoveAppFromServiceInstanceForward(c *check.C) {
+	a := provisiontest.NewFakeApp("myapp", "static", 1)
+	si := ServiceInstance{Name: "mysql", Apps: []string{a.GetName(), "otherapp"}}
+	err := s.conn.ServiceInstances().Insert(&si)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": si.Name})
+	ctx := action.FWContext{Params: []interface{}{a, si}}
+	_, err = removeAppFromServiceInstance.Forward(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Apps, check.DeepEquals, []string{"otherapp"})
+}
+
+func (s *S) TestRemoveAppFromServiceInstanceForwardNotBound(c *check.C) {
+	a := provisiontest.NewFakeApp("myapp", "static", 1)
+	si := ServiceInstance{Name: "mysql"}
+	ctx := action.FWContext{Params: []interface{}{a, si}}
+	_, err := removeAppFromServiceInstance.Forward(ctx)
+	c.Assert(err, check.ErrorMatches, "^This app is not bound to this service instance.$")
+}
+
+func (s *S) TestRemoveAppFromServiceInstanceBackward(c *check.C) {
+	a := provisiontest.NewFakeApp("myapp", "static", 1)
+	si := ServiceInstance{Name: "mysql", Apps: []string{"otherapp"}}
+	err := s.conn.ServiceInstances().Insert(&si)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": si.Name})
+	ctx := action.BWContext{Params: []interface{}{a, si}}
+	removeAppFromServiceInstance.Backward(ctx)
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Apps, check.DeepEquals, []string{"otherapp", a.GetName()})
+}
+
+func (s *S) TestUnbindUnitsFromServiceInstanceForwardRebindsUnitsOnFailure(c *check.C) {
+	var binds, unbinds int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			atomic.AddInt32(&binds, 1)
+			return
+		}
+		if atomic.AddInt32(&unbinds, 1) > 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+	service := Service{Name: "mysql", Endpoint: map[string]string{"production": ts.URL}}
+	err := service.Create()
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(service.Name)
+	si := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	a := provisiontest.NewFakeApp("myapp", "static", 3)
+	ctx := action.FWContext{Params: []interface{}{a, si}}
+	_, err = unbindUnitsFromServiceInstance.Forward(ctx)
+	c.Assert(err, check.NotNil)
+	c.Assert(atomic.LoadInt32(&unbinds), check.Equals, int32(3))
+	c.Assert(atomic.LoadInt32(&binds), check.Equals, int32(1))
+}
+
+func (s *S) TestUnbindAppFromServiceInstanceBackward(c *check.C) {
+	var called int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && r.URL.Path == "/resources/my-mysql/bind-app" {
+			atomic.StoreInt32(&called, 1)
+		}
+		w.Write([]byte(`{"DATABASE_USER":"root"}`))
+	}))
+	defer ts.Close()
+	service := Service{Name: "mysql", Endpoint: map[string]string{"production": ts.URL}}
+	err := service.Create()
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(service.Name)
+	si := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	a := provisiontest.NewFakeApp("myapp", "static", 1)
+	ctx := action.BWContext{Params: []interface{}{a, si}}
+	unbindAppFromServiceInstance.Backward(ctx)
+	c.Assert(atomic.LoadInt32(&called), check.Equals, int32(1))
+}
+
+func (s *S) TestRemoveTsuruServicesForward(c *check.C) {
+	si := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	a := provisiontest.NewFakeApp("myapp", "static", 1)
+	err := a.AddInstance("mysql", bind.ServiceInstance{Name: si.Name}, nil)
+	c.Assert(err, check.IsNil)
+	ctx := action.FWContext{Params: []interface{}{a, si}}
+	_, err = removeTsuruServices.Forward(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(a.GetInstances("mysql"), check.HasLen, 0)
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/hc"
+	"github.com/tsuru/tsuru/log"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+func init() {
+	hc.AddChecker("Service APIs", breakersHealthCheck)
+}
+
+var breakers = struct {
+	sync.Mutex
+	m map[string]*circuitBreaker
+}{m: make(map[string]*circuitBreaker)}
+
+// circuitBreaker protects tsuru from service APIs that are down. After a
+// number of consecutive failures (defined by the setting
+// services:circuit-breaker:failures), the circuit opens and requests to the
+// service API fail right away, for the time defined by the setting
+// services:circuit-breaker:cooldown, in seconds. After that, one request is
+// let through: the circuit closes if it succeeds, and opens again otherwise.
+type circuitBreaker struct {
+	sync.Mutex
+	service   string
+	endpoint  string
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// getBreaker returns the circuit breaker of the service API in the given
+// endpoint, creating it if needed.
+func getBreaker(service, endpoint string) *circuitBreaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	b, ok := breakers.m[endpoint]
+	if !ok {
+		if service == "" {
+			service = endpoint
+		}
+		b = &circuitBreaker{service: service, endpoint: endpoint}
+		breakers.m[endpoint] = b
+	}
+	return b
+}
+
+// allow returns an error when the circuit is open, meaning that the request
+// should not be sent to the service API.
+func (b *circuitBreaker) allow() error {
+	b.Lock()
+	defer b.Unlock()
+	if b.openUntil.IsZero() {
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return fmt.Errorf("the service API of %q is unavailable, try again later", b.service)
+	}
+	b.probing = true
+	return nil
+}
+
+func (b *circuitBreaker) success() {
+	b.Lock()
+	defer b.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.probing = false
+}
+
+func (b *circuitBreaker) failure() {
+	b.Lock()
+	defer b.Unlock()
+	b.failures++
+	b.probing = false
+	threshold := defaultBreakerFailures
+	if value, err := config.GetInt("services:circuit-breaker:failures"); err == nil {
+		threshold = value
+	}
+	if threshold <= 0 || b.failures < threshold {
+		return
+	}
+	cooldown := defaultBreakerCooldown
+	if seconds, err := config.GetInt("services:circuit-breaker:cooldown"); err == nil && seconds > 0 {
+		cooldown = time.Duration(seconds) * time.Second
+	}
+	if b.openUntil.IsZero() {
+		log.Errorf("[circuit-breaker] the service API of %q failed %d times, opening the circuit", b.service, b.failures)
+	}
+	b.openUntil = time.Now().Add(cooldown)
+}
+
+func (b *circuitBreaker) isOpen() bool {
+	b.Lock()
+	defer b.Unlock()
+	return !b.openUntil.IsZero()
+}
+
+// breakersHealthCheck reports, as a warning, the services whose circuit is
+// open. Unavailable service APIs don't make the API server unhealthy.
+func breakersHealthCheck() error {
+	breakers.Lock()
+	defer breakers.Unlock()
+	var open []string
+	for _, b := range breakers.m {
+		if b.isOpen() {
+			open = append(open, b.service)
+		}
+	}
+	if len(open) == 0 {
+		return nil
+	}
+	sort.Strings(open)
+	return hc.Warning(fmt.Sprintf("the service APIs of %s are unavailable", strings.Join(open, ", ")))
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/hc"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestCircuitBreakerOpensAfterFailures(c *check.C) {
+	config.Set("services:circuit-breaker:failures", 2)
+	defer config.Unset("services:circuit-breaker:failures")
+	b := &circuitBreaker{service: "mysql"}
+	c.Assert(b.allow(), check.IsNil)
+	b.failure()
+	c.Assert(b.allow(), check.IsNil)
+	c.Assert(b.isOpen(), check.Equals, false)
+	b.failure()
+	c.Assert(b.isOpen(), check.Equals, true)
+	c.Assert(b.allow(), check.ErrorMatches, `the service API of "mysql" is unavailable, try again later`)
+}
+
+func (s *S) TestCircuitBreakerSuccessResetsFailures(c *check.C) {
+	config.Set("services:circuit-breaker:failures", 2)
+	defer config.Unset("services:circuit-breaker:failures")
+	b := &circuitBreaker{service: "mysql"}
+	b.failure()
+	b.success()
+	b.failure()
+	c.Assert(b.isOpen(), check.Equals, false)
+}
+
+func (s *S) TestCircuitBreakerDisabled(c *check.C) {
+	config.Set("services:circuit-breaker:failures", 0)
+	defer config.Unset("services:circuit-breaker:failures")
+	b := &circuitBreaker{service: "mysql"}
+	for i := 0; i < 10; i++ {
+		b.failure()
+	}
+	c.Assert(b.isOpen(), check.Equals, false)
+}
+
+func (s *S) TestCircuitBreakerHalfOpen(c *check.C) {
+	b := &circuitBreaker{service: "mysql", failures: defaultBreakerFailures, openUntil: time.Now().Add(-time.Second)}
+	c.Assert(b.allow(), check.IsNil)
+	c.Assert(b.allow(), check.NotNil)
+	b.failure()
+	c.Assert(b.isOpen(), check.Equals, true)
+	c.Assert(b.allow(), check.NotNil)
+	b.openUntil = time.Now().Add(-time.Second)
+	c.Assert(b.allow(), check.IsNil)
+	b.success()
+	c.Assert(b.isOpen(), check.Equals, false)
+	c.Assert(b.allow(), check.IsNil)
+}
+
+func (s *S) TestClientStopsCallingServiceWhenTheCircuitIsOpen(c *check.C) {
+	breakers.Lock()
+	breakers.m = make(map[string]*circuitBreaker)
+	breakers.Unlock()
+	config.Set("services:client:retries", 0)
+	defer config.Unset("services:client:retries")
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+	instance := ServiceInstance{Name: "his-redis", ServiceName: "redis"}
+	client := &Client{name: "redis", endpoint: ts.URL, username: "user", password: "abcde"}
+	for i := 0; i < defaultBreakerFailures; i++ {
+		_, err := client.Status(&instance)
+		c.Assert(err, check.NotNil)
+	}
+	_, err := client.Status(&instance)
+	c.Assert(err, check.ErrorMatches, `.*the service API of "redis" is unavailable, try again later`)
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(defaultBreakerFailures))
+	c.Assert(breakersHealthCheck(), check.ErrorMatches, `the service APIs of .*redis.* are unavailable`)
+	c.Assert(breakersHealthCheck(), check.FitsTypeOf, hc.Warning(""))
+	getBreaker("redis", ts.URL).success()
+	c.Assert(breakersHealthCheck(), check.IsNil)
+}
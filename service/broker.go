@@ -0,0 +1,548 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/app/bind"
+	"github.com/tsuru/tsuru/errors"
+	"github.com/tsuru/tsuru/log"
+)
+
+const (
+	brokerAPIVersion  = "2.13"
+	defaultCatalogTTL = 5 * time.Minute
+)
+
+var envNameRegexp = regexp.MustCompile(`[^A-Z0-9_]+`)
+
+var ErrBrokerProxyNotSupported = &errors.HTTP{
+	Code:    http.StatusBadRequest,
+	Message: "Service brokers don't support proxied requests.",
+}
+
+type brokerPlan struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type brokerService struct {
+	ID    string       `json:"id"`
+	Name  string       `json:"name"`
+	Plans []brokerPlan `json:"plans"`
+}
+
+type brokerOperation struct {
+	Operation   string `json:"operation"`
+	State       string `json:"state"`
+	Description string `json:"description"`
+}
+
+// brokerClient talks to service brokers implementing the Open Service Broker
+// API (v2), as used by Cloud Foundry. The service is the name or the id of
+// the service in the catalog of the broker, and instances are identified in
+// the broker by their names.
+//
+// Requests to brokers share the timeouts, retries and circuit breakers of the
+// requests to tsuru's own service APIs.
+type brokerClient struct {
+	name     string
+	endpoint string
+	username string
+	password string
+	service  string
+}
+
+// catalogs caches the services in the catalog of each broker, by endpoint.
+var catalogs = struct {
+	sync.Mutex
+	m map[string]cachedCatalog
+}{m: make(map[string]cachedCatalog)}
+
+type cachedCatalog struct {
+	services []brokerService
+	expireAt time.Time
+}
+
+func catalogTTL() time.Duration {
+	if seconds, err := config.GetInt("services:broker:catalog-ttl"); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultCatalogTTL
+}
+
+func (c *brokerClient) issueRequest(operation, path, method string, query url.Values, body interface{}) (*http.Response, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	u := strings.TrimRight(c.endpoint, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return doRequest(getBreaker(c.name, c.endpoint), operation, method, func() (*http.Request, error) {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(data)
+		}
+		req, err := http.NewRequest(method, u, reader)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Add("Content-Type", "application/json")
+		}
+		req.Header.Add("Accept", "application/json")
+		req.Header.Add("X-Broker-API-Version", brokerAPIVersion)
+		req.SetBasicAuth(c.username, c.password)
+		req.Close = true
+		return req, nil
+	})
+}
+
+// brokerError builds the error message from the description returned by the
+// broker, falling back to the raw body of the response.
+func brokerError(resp *http.Response) string {
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	var result struct {
+		Error       string `json:"error"`
+		Description string `json:"description"`
+	}
+	if json.Unmarshal(data, &result) == nil && (result.Description != "" || result.Error != "") {
+		if result.Description != "" {
+			return result.Description
+		}
+		return result.Error
+	}
+	if len(data) == 0 {
+		return resp.Status
+	}
+	return string(data)
+}
+
+// catalog returns the service of the client in the catalog of the broker.
+// The catalog is cached for the time defined by the setting
+// services:broker:catalog-ttl, and fetched again when the service isn't in
+// the cached catalog.
+func (c *brokerClient) catalog() (*brokerService, error) {
+	catalogs.Lock()
+	cached, ok := catalogs.m[c.endpoint]
+	catalogs.Unlock()
+	if ok && time.Now().Before(cached.expireAt) {
+		if service := c.findService(cached.services); service != nil {
+			return service, nil
+		}
+	}
+	services, err := c.fetchCatalog()
+	if err != nil {
+		return nil, err
+	}
+	catalogs.Lock()
+	catalogs.m[c.endpoint] = cachedCatalog{services: services, expireAt: time.Now().Add(catalogTTL())}
+	catalogs.Unlock()
+	if service := c.findService(services); service != nil {
+		return service, nil
+	}
+	return nil, fmt.Errorf("The service %q is not in the catalog of the broker.", c.service)
+}
+
+func (c *brokerClient) fetchCatalog() ([]brokerService, error) {
+	resp, err := c.issueRequest("plans", "/v2/catalog", "GET", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to get the catalog of the broker: %s", brokerError(resp))
+	}
+	defer resp.Body.Close()
+	var catalog struct {
+		Services []brokerService `json:"services"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&catalog); err != nil {
+		return nil, err
+	}
+	return catalog.Services, nil
+}
+
+// findService returns the service of the client in the given services.
+func (c *brokerClient) findService(services []brokerService) *brokerService {
+	for _, s := range services {
+		if s.Name == c.service || s.ID == c.service {
+			return &s
+		}
+	}
+	return nil
+}
+
+// plan returns the plan with the given name, or the first plan of the service
+// when the name is empty.
+func (s *brokerService) plan(name string) (*brokerPlan, error) {
+	for i, p := range s.Plans {
+		if p.Name == name || name == "" {
+			return &s.Plans[i], nil
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("The service %q has no plans.", s.Name)
+	}
+	return nil, fmt.Errorf("The plan %q does not exist in the service %q.", name, s.Name)
+}
+
+// ids returns the id of the service and the id of the plan of the instance,
+// which are needed in most requests to the broker.
+func (c *brokerClient) ids(instance *ServiceInstance) (string, string, error) {
+	service, err := c.catalog()
+	if err != nil {
+		return "", "", err
+	}
+	plan, err := service.plan(instance.PlanName)
+	if err != nil {
+		return "", "", err
+	}
+	return service.ID, plan.ID, nil
+}
+
+func instancePath(instance *ServiceInstance) string {
+	return "/v2/service_instances/" + url.QueryEscape(instance.Name)
+}
+
+func bindingPath(instance *ServiceInstance, app bind.App) string {
+	return instancePath(instance) + "/service_bindings/" + url.QueryEscape(app.GetName())
+}
+
+// lastOperation gets the state of the last operation on the instance. The
+// response is returned when the broker doesn't know the instance, or doesn't
+// provide the last operation endpoint.
+func (c *brokerClient) lastOperation(instance *ServiceInstance, serviceID, planID, operation string) (*brokerOperation, *http.Response, error) {
+	query := url.Values{"service_id": {serviceID}, "plan_id": {planID}}
+	if operation != "" {
+		query.Set("operation", operation)
+	}
+	resp, err := c.issueRequest("status", instancePath(instance)+"/last_operation", "GET", query, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp, nil
+	}
+	defer resp.Body.Close()
+	var op brokerOperation
+	if err = json.NewDecoder(resp.Body).Decode(&op); err != nil {
+		return nil, nil, err
+	}
+	return &op, nil, nil
+}
+
+// accepted marks the instance as pending until the asynchronous operation
+// started by the request finishes. The state of the operation is then polled
+// by the pending instances watcher.
+func accepted(instance *ServiceInstance, operation string, resp *http.Response) {
+	var op brokerOperation
+	json.NewDecoder(resp.Body).Decode(&op)
+	resp.Body.Close()
+	instance.setState(StatePending, "")
+	instance.Operation = operation
+	instance.BrokerOperation = op.Operation
+}
+
+func (c *brokerClient) Create(instance *ServiceInstance, user string) error {
+	log.Debugf("Attempting to provision the service instance %q at %q broker", instance.Name, instance.ServiceName)
+	err := c.create(instance)
+	if err != nil {
+		msg := "Failed to create the instance " + instance.Name + ": " + err.Error()
+		log.Error(msg)
+		return &errors.HTTP{Code: http.StatusInternalServerError, Message: msg}
+	}
+	return nil
+}
+
+func (c *brokerClient) create(instance *ServiceInstance) error {
+	serviceID, planID, err := c.ids(instance)
+	if err != nil {
+		return err
+	}
+	body := map[string]interface{}{
+		"service_id":        serviceID,
+		"plan_id":           planID,
+		"organization_guid": instance.TeamOwner,
+		"space_guid":        instance.TeamOwner,
+	}
+	if len(instance.Parameters) > 0 {
+		body["parameters"] = instance.Parameters
+	}
+	query := url.Values{"accepts_incomplete": {"true"}}
+	resp, err := c.issueRequest("create", instancePath(instance), "PUT", query, body)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		resp.Body.Close()
+		return nil
+	case http.StatusAccepted:
+		accepted(instance, "", resp)
+		return nil
+	}
+	return stderrors.New(brokerError(resp))
+}
+
+func (c *brokerClient) Destroy(instance *ServiceInstance) error {
+	log.Debugf("Attempting to deprovision the service instance %q at %q broker", instance.Name, instance.ServiceName)
+	err := c.destroy(instance)
+	if err != nil {
+		msg := "Failed to destroy the instance " + instance.Name + ": " + err.Error()
+		log.Error(msg)
+		return &errors.HTTP{Code: http.StatusInternalServerError, Message: msg}
+	}
+	return nil
+}
+
+func (c *brokerClient) destroy(instance *ServiceInstance) error {
+	serviceID, planID, err := c.ids(instance)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"service_id": {serviceID}, "plan_id": {planID}, "accepts_incomplete": {"true"}}
+	resp, err := c.issueRequest("destroy", instancePath(instance), "DELETE", query, nil)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusGone:
+		resp.Body.Close()
+		return nil
+	case http.StatusAccepted:
+		accepted(instance, OperationDeprovision, resp)
+		return nil
+	}
+	return stderrors.New(brokerError(resp))
+}
+
+func (c *brokerClient) UpdatePlan(instance *ServiceInstance, plan string) error {
+	log.Debugf("Attempting to update the plan of the service instance %q at %q broker", instance.Name, instance.ServiceName)
+	err := c.updatePlan(instance, plan)
+	if err != nil {
+		msg := "Failed to update the plan of the instance " + instance.Name + ": " + err.Error()
+		log.Error(msg)
+		return &errors.HTTP{Code: http.StatusInternalServerError, Message: msg}
+	}
+	return nil
+}
+
+func (c *brokerClient) updatePlan(instance *ServiceInstance, plan string) error {
+	service, err := c.catalog()
+	if err != nil {
+		return err
+	}
+	current, err := service.plan(instance.PlanName)
+	if err != nil {
+		return err
+	}
+	next, err := service.plan(plan)
+	if err != nil {
+		return err
+	}
+	body := map[string]interface{}{
+		"service_id": service.ID,
+		"plan_id":    next.ID,
+		"previous_values": map[string]string{
+			"service_id": service.ID,
+			"plan_id":    current.ID,
+		},
+	}
+	query := url.Values{"accepts_incomplete": {"true"}}
+	resp, err := c.issueRequest("update-plan", instancePath(instance), "PATCH", query, body)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		resp.Body.Close()
+		return nil
+	case http.StatusAccepted:
+		accepted(instance, OperationUpdate, resp)
+		instance.PendingPlan = plan
+		return nil
+	}
+	return stderrors.New(brokerError(resp))
+}
+
+// BindApp creates a binding for the app. The credentials returned by the
+// broker are turned into environment variables prefixed with the name of the
+// service, with values that aren't strings encoded in JSON.
+func (c *brokerClient) BindApp(instance *ServiceInstance, app bind.App) (map[string]string, error) {
+	log.Debugf("Calling bind of instance %q and %q app at %q broker", instance.Name, app.GetName(), instance.ServiceName)
+	serviceID, planID, err := c.ids(instance)
+	if err != nil {
+		return nil, err
+	}
+	body := map[string]interface{}{
+		"service_id": serviceID,
+		"plan_id":    planID,
+		"app_guid":   app.GetName(),
+		"bind_resource": map[string]string{
+			"app_guid": app.GetName(),
+		},
+	}
+	resp, err := c.issueRequest("bind", bindingPath(instance, app), "PUT", nil, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		msg := fmt.Sprintf("Failed to bind the instance %q to the app %q: %s", instance.Name, app.GetName(), brokerError(resp))
+		log.Error(msg)
+		return nil, &errors.HTTP{Code: http.StatusInternalServerError, Message: msg}
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Credentials map[string]interface{} `json:"credentials"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	envs := make(map[string]string, len(result.Credentials))
+	for key, value := range result.Credentials {
+		name := envName(instance.ServiceName, key)
+		if s, ok := value.(string); ok {
+			envs[name] = s
+		} else {
+			data, _ := json.Marshal(value)
+			envs[name] = string(data)
+		}
+	}
+	return envs, nil
+}
+
+func envName(service, key string) string {
+	return envNameRegexp.ReplaceAllString(strings.ToUpper(service+"_"+key), "_")
+}
+
+// BindUnit does nothing, brokers don't know about units.
+func (c *brokerClient) BindUnit(instance *ServiceInstance, app bind.App, unit bind.Unit) error {
+	return nil
+}
+
+func (c *brokerClient) UnbindApp(instance *ServiceInstance, app bind.App) error {
+	log.Debugf("Calling unbind of service instance %q and app %q at %q broker", instance.Name, app.GetName(), instance.ServiceName)
+	serviceID, planID, err := c.ids(instance)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"service_id": {serviceID}, "plan_id": {planID}}
+	resp, err := c.issueRequest("unbind", bindingPath(instance, app), "DELETE", query, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusGone {
+		msg := fmt.Sprintf("Failed to unbind the instance %q from the app %q: %s", instance.Name, app.GetName(), brokerError(resp))
+		log.Error(msg)
+		return &errors.HTTP{Code: http.StatusInternalServerError, Message: msg}
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// UnbindUnit does nothing, brokers don't know about units.
+func (c *brokerClient) UnbindUnit(instance *ServiceInstance, app bind.App, unit bind.Unit) error {
+	return nil
+}
+
+// Status maps the state of the last operation on the instance to the status
+// of the instance. Brokers that never provision asynchronously don't need to
+// implement the last operation endpoint, so instances of those brokers are
+// always up. Instances being deprovisioned are reported as gone once the
+// broker finishes removing them.
+func (c *brokerClient) Status(instance *ServiceInstance) (string, error) {
+	status, err := c.status(instance)
+	if err != nil {
+		msg := "Failed to get status of instance " + instance.Name + ": " + err.Error()
+		log.Error(msg)
+		return "", &errors.HTTP{Code: http.StatusInternalServerError, Message: msg}
+	}
+	return status, nil
+}
+
+func (c *brokerClient) status(instance *ServiceInstance) (string, error) {
+	service, err := c.catalog()
+	if err != nil {
+		return "", err
+	}
+	planName := instance.PlanName
+	if instance.Operation == OperationUpdate {
+		planName = instance.PendingPlan
+	}
+	plan, err := service.plan(planName)
+	if err != nil {
+		return "", err
+	}
+	op, resp, err := c.lastOperation(instance, service.ID, plan.ID, instance.BrokerOperation)
+	if err != nil {
+		return "", err
+	}
+	deprovisioning := instance.Operation == OperationDeprovision
+	if resp != nil {
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			resp.Body.Close()
+			return "up", nil
+		case resp.StatusCode == http.StatusGone && deprovisioning:
+			resp.Body.Close()
+			return "gone", nil
+		}
+		return "", stderrors.New(brokerError(resp))
+	}
+	switch op.State {
+	case "in progress":
+		return "pending", nil
+	case "succeeded":
+		if deprovisioning {
+			return "gone", nil
+		}
+		return "up", nil
+	case "failed":
+		return "down", nil
+	}
+	return "", fmt.Errorf("unknown state %q", op.State)
+}
+
+// Info returns no additional info, brokers don't provide it.
+func (c *brokerClient) Info(instance *ServiceInstance) ([]map[string]string, error) {
+	return nil, nil
+}
+
+func (c *brokerClient) Plans() ([]Plan, error) {
+	service, err := c.catalog()
+	if err != nil {
+		return nil, err
+	}
+	plans := make([]Plan, len(service.Plans))
+	for i, p := range service.Plans {
+		plans[i] = Plan{Name: p.Name, Description: p.Description}
+	}
+	return plans, nil
+}
+
+func (c *brokerClient) Proxy(path string, w http.ResponseWriter, r *http.Request) error {
+	return ErrBrokerProxyNotSupported
+}
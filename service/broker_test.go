@@ -0,0 +1,503 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/errors"
+	"github.com/tsuru/tsuru/provision/provisiontest"
+	"gopkg.in/check.v1"
+)
+
+const brokerCatalog = `{"services": [
+	{"id": "other-id", "name": "other", "plans": [{"id": "other-plan", "name": "small"}]},
+	{"id": "mysql-id", "name": "p-mysql", "plans": [
+		{"id": "small-id", "name": "small", "description": "Small database"},
+		{"id": "large-id", "name": "large", "description": "Large database"}
+	]}
+]}`
+
+type brokerRequest struct {
+	method string
+	path   string
+	query  map[string][]string
+	body   map[string]interface{}
+	header http.Header
+}
+
+// fakeBroker is a service broker that answers every request, except the
+// catalog, with the responses set for the path of the request, in order. The
+// last response is repeated. Requests to the catalog are only counted.
+type fakeBroker struct {
+	sync.Mutex
+	requests        []brokerRequest
+	responses       map[string][]brokerResponse
+	catalogRequests int
+}
+
+type brokerResponse struct {
+	status int
+	body   string
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{responses: make(map[string][]brokerResponse)}
+}
+
+func (b *fakeBroker) respond(method, path string, status int, body string) {
+	b.Lock()
+	defer b.Unlock()
+	key := method + " " + path
+	b.responses[key] = append(b.responses[key], brokerResponse{status: status, body: body})
+}
+
+func (b *fakeBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.Lock()
+	defer b.Unlock()
+	if r.URL.Path == "/v2/catalog" {
+		b.catalogRequests++
+		w.Write([]byte(brokerCatalog))
+		return
+	}
+	req := brokerRequest{method: r.Method, path: r.URL.Path, query: r.URL.Query(), header: r.Header}
+	json.NewDecoder(r.Body).Decode(&req.body)
+	b.requests = append(b.requests, req)
+	key := r.Method + " " + r.URL.Path
+	responses := b.responses[key]
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	resp := responses[0]
+	if len(responses) > 1 {
+		b.responses[key] = responses[1:]
+	}
+	w.WriteHeader(resp.status)
+	w.Write([]byte(resp.body))
+}
+
+func (s *S) brokerClient(c *check.C, b *fakeBroker) (*brokerClient, func()) {
+	ts := httptest.NewServer(b)
+	return &brokerClient{endpoint: ts.URL, username: "user", password: "abcde", service: "p-mysql"}, ts.Close
+}
+
+func (s *S) TestBrokerPlans(c *check.C) {
+	client, cleanup := s.brokerClient(c, newFakeBroker())
+	defer cleanup()
+	plans, err := client.Plans()
+	c.Assert(err, check.IsNil)
+	c.Assert(plans, check.DeepEquals, []Plan{
+		{Name: "small", Description: "Small database"},
+		{Name: "large", Description: "Large database"},
+	})
+}
+
+func (s *S) TestBrokerServiceNotInCatalog(c *check.C) {
+	client, cleanup := s.brokerClient(c, newFakeBroker())
+	defer cleanup()
+	client.service = "unknown"
+	_, err := client.Plans()
+	c.Assert(err, check.ErrorMatches, `The service "unknown" is not in the catalog of the broker.`)
+	client.service = "mysql-id"
+	plans, err := client.Plans()
+	c.Assert(err, check.IsNil)
+	c.Assert(plans, check.HasLen, 2)
+}
+
+func (s *S) TestBrokerCachesCatalog(c *check.C) {
+	b := newFakeBroker()
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	_, err := client.Plans()
+	c.Assert(err, check.IsNil)
+	_, err = client.Plans()
+	c.Assert(err, check.IsNil)
+	other := *client
+	other.service = "other"
+	plans, err := other.Plans()
+	c.Assert(err, check.IsNil)
+	c.Assert(plans, check.HasLen, 1)
+	c.Assert(b.catalogRequests, check.Equals, 1)
+}
+
+func (s *S) TestBrokerCatalogExpires(c *check.C) {
+	config.Set("services:broker:catalog-ttl", 0)
+	defer config.Unset("services:broker:catalog-ttl")
+	b := newFakeBroker()
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	_, err := client.Plans()
+	c.Assert(err, check.IsNil)
+	_, err = client.Plans()
+	c.Assert(err, check.IsNil)
+	c.Assert(b.catalogRequests, check.Equals, 2)
+}
+
+func (s *S) TestBrokerRefetchesCatalogForUnknownService(c *check.C) {
+	b := newFakeBroker()
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	_, err := client.Plans()
+	c.Assert(err, check.IsNil)
+	client.service = "unknown"
+	_, err = client.Plans()
+	c.Assert(err, check.NotNil)
+	c.Assert(b.catalogRequests, check.Equals, 2)
+}
+
+func (s *S) TestBrokerRetriesUnavailableBroker(c *check.C) {
+	config.Set("services:client:retry-delay", 0)
+	defer config.Unset("services:client:retry-delay")
+	b := newFakeBroker()
+	b.respond("DELETE", "/v2/service_instances/my-mysql", http.StatusServiceUnavailable, "")
+	b.respond("DELETE", "/v2/service_instances/my-mysql", http.StatusOK, "{}")
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql", PlanName: "small"}
+	err := client.Destroy(&instance)
+	c.Assert(err, check.IsNil)
+	c.Assert(b.requests, check.HasLen, 2)
+}
+
+func (s *S) TestBrokerStopsCallingBrokerWhenTheCircuitIsOpen(c *check.C) {
+	config.Set("services:client:retries", 0)
+	defer config.Unset("services:client:retries")
+	b := newFakeBroker()
+	b.respond("GET", "/v2/service_instances/my-mysql/last_operation", http.StatusBadGateway, "")
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql", PlanName: "small"}
+	for i := 0; i < defaultBreakerFailures; i++ {
+		_, err := client.Status(&instance)
+		c.Assert(err, check.NotNil)
+	}
+	c.Assert(b.requests, check.HasLen, defaultBreakerFailures)
+	_, err := client.Status(&instance)
+	c.Assert(err, check.ErrorMatches, `.*unavailable, try again later.*`)
+	c.Assert(b.requests, check.HasLen, defaultBreakerFailures)
+}
+
+func (s *S) TestBrokerCreate(c *check.C) {
+	b := newFakeBroker()
+	b.respond("PUT", "/v2/service_instances/my-mysql", http.StatusCreated, "{}")
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql", PlanName: "large", TeamOwner: "theteam"}
+	err := client.Create(&instance, "my@user")
+	c.Assert(err, check.IsNil)
+	c.Assert(b.requests, check.HasLen, 1)
+	req := b.requests[0]
+	c.Assert(req.query["accepts_incomplete"], check.DeepEquals, []string{"true"})
+	c.Assert(req.body, check.DeepEquals, map[string]interface{}{
+		"service_id":        "mysql-id",
+		"plan_id":           "large-id",
+		"organization_guid": "theteam",
+		"space_guid":        "theteam",
+	})
+	c.Assert(req.header.Get("X-Broker-API-Version"), check.Equals, brokerAPIVersion)
+	c.Assert(req.header.Get("Content-Type"), check.Equals, "application/json")
+	c.Assert(req.header.Get("Authorization"), check.Equals, "Basic dXNlcjphYmNkZQ==")
+}
+
+func (s *S) TestBrokerCreateUsesFirstPlanByDefault(c *check.C) {
+	b := newFakeBroker()
+	b.respond("PUT", "/v2/service_instances/my-mysql", http.StatusOK, "{}")
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql", TeamOwner: "theteam"}
+	err := client.Create(&instance, "my@user")
+	c.Assert(err, check.IsNil)
+	c.Assert(b.requests[0].body["plan_id"], check.Equals, "small-id")
+}
+
+func (s *S) TestBrokerCreateSendsParameters(c *check.C) {
+	b := newFakeBroker()
+	b.respond("PUT", "/v2/service_instances/my-mysql", http.StatusCreated, "{}")
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql", TeamOwner: "theteam", Parameters: map[string]string{"version": "5.6"}}
+	err := client.Create(&instance, "my@user")
+	c.Assert(err, check.IsNil)
+	c.Assert(b.requests[0].body["parameters"], check.DeepEquals, map[string]interface{}{"version": "5.6"})
+}
+
+func (s *S) TestBrokerCreateUnknownPlan(c *check.C) {
+	b := newFakeBroker()
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql", PlanName: "huge"}
+	err := client.Create(&instance, "my@user")
+	c.Assert(err, check.FitsTypeOf, &errors.HTTP{})
+	c.Assert(err, check.ErrorMatches, `Failed to create the instance my-mysql: The plan "huge" does not exist in the service "p-mysql".`)
+	c.Assert(b.requests, check.HasLen, 0)
+}
+
+func (s *S) TestBrokerCreateFailure(c *check.C) {
+	b := newFakeBroker()
+	b.respond("PUT", "/v2/service_instances/my-mysql", http.StatusConflict, `{"description": "instance already exists"}`)
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	err := client.Create(&instance, "my@user")
+	c.Assert(err, check.FitsTypeOf, &errors.HTTP{})
+	c.Assert(err.(*errors.HTTP).Code, check.Equals, http.StatusInternalServerError)
+	c.Assert(err, check.ErrorMatches, "Failed to create the instance my-mysql: instance already exists")
+}
+
+func (s *S) TestBrokerCreateAsync(c *check.C) {
+	b := newFakeBroker()
+	b.respond("PUT", "/v2/service_instances/my-mysql", http.StatusAccepted, `{"operation": "op-1"}`)
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	err := client.Create(&instance, "my@user")
+	c.Assert(err, check.IsNil)
+	c.Assert(b.requests, check.HasLen, 1)
+	c.Assert(instance.State, check.Equals, StatePending)
+	c.Assert(instance.Transitions, check.HasLen, 1)
+}
+
+func (s *S) TestBrokerDestroy(c *check.C) {
+	b := newFakeBroker()
+	b.respond("DELETE", "/v2/service_instances/my-mysql", http.StatusOK, "{}")
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql", PlanName: "large"}
+	err := client.Destroy(&instance)
+	c.Assert(err, check.IsNil)
+	c.Assert(b.requests, check.HasLen, 1)
+	c.Assert(b.requests[0].query["service_id"], check.DeepEquals, []string{"mysql-id"})
+	c.Assert(b.requests[0].query["plan_id"], check.DeepEquals, []string{"large-id"})
+	c.Assert(b.requests[0].query["accepts_incomplete"], check.DeepEquals, []string{"true"})
+}
+
+func (s *S) TestBrokerDestroyAsync(c *check.C) {
+	b := newFakeBroker()
+	b.respond("DELETE", "/v2/service_instances/my-mysql", http.StatusAccepted, `{"operation": "op-2"}`)
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	err := client.Destroy(&instance)
+	c.Assert(err, check.IsNil)
+	c.Assert(b.requests, check.HasLen, 1)
+	c.Assert(instance.State, check.Equals, StatePending)
+	c.Assert(instance.Operation, check.Equals, OperationDeprovision)
+	c.Assert(instance.BrokerOperation, check.Equals, "op-2")
+}
+
+func (s *S) TestBrokerDestroyGone(c *check.C) {
+	b := newFakeBroker()
+	b.respond("DELETE", "/v2/service_instances/my-mysql", http.StatusGone, "{}")
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	err := client.Destroy(&instance)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestBrokerUpdatePlan(c *check.C) {
+	b := newFakeBroker()
+	b.respond("PATCH", "/v2/service_instances/my-mysql", http.StatusOK, "{}")
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql", PlanName: "small"}
+	err := client.UpdatePlan(&instance, "large")
+	c.Assert(err, check.IsNil)
+	c.Assert(b.requests, check.HasLen, 1)
+	c.Assert(b.requests[0].query["accepts_incomplete"], check.DeepEquals, []string{"true"})
+	c.Assert(b.requests[0].body, check.DeepEquals, map[string]interface{}{
+		"service_id": "mysql-id",
+		"plan_id":    "large-id",
+		"previous_values": map[string]interface{}{
+			"service_id": "mysql-id",
+			"plan_id":    "small-id",
+		},
+	})
+}
+
+func (s *S) TestBrokerUpdatePlanAsync(c *check.C) {
+	b := newFakeBroker()
+	b.respond("PATCH", "/v2/service_instances/my-mysql", http.StatusAccepted, `{"operation": "op-3"}`)
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql", PlanName: "large"}
+	err := client.UpdatePlan(&instance, "small")
+	c.Assert(err, check.IsNil)
+	c.Assert(b.requests, check.HasLen, 1)
+	c.Assert(instance.PlanName, check.Equals, "large")
+	c.Assert(instance.State, check.Equals, StatePending)
+	c.Assert(instance.Operation, check.Equals, OperationUpdate)
+	c.Assert(instance.PendingPlan, check.Equals, "small")
+	c.Assert(instance.BrokerOperation, check.Equals, "op-3")
+}
+
+func (s *S) TestBrokerBindApp(c *check.C) {
+	b := newFakeBroker()
+	b.respond("PUT", "/v2/service_instances/my-mysql/service_bindings/her-app", http.StatusCreated,
+		`{"credentials": {"uri": "mysql://u:p@host:3306/db", "port": 3306, "read-replicas": ["a", "b"]}}`)
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	a := provisiontest.NewFakeApp("her-app", "python", 1)
+	envs, err := client.BindApp(&instance, a)
+	c.Assert(err, check.IsNil)
+	c.Assert(envs, check.DeepEquals, map[string]string{
+		"MYSQL_URI":           "mysql://u:p@host:3306/db",
+		"MYSQL_PORT":          "3306",
+		"MYSQL_READ_REPLICAS": `["a","b"]`,
+	})
+	c.Assert(b.requests[0].body, check.DeepEquals, map[string]interface{}{
+		"service_id":    "mysql-id",
+		"plan_id":       "small-id",
+		"app_guid":      "her-app",
+		"bind_resource": map[string]interface{}{"app_guid": "her-app"},
+	})
+}
+
+func (s *S) TestBrokerBindAppFailure(c *check.C) {
+	b := newFakeBroker()
+	b.respond("PUT", "/v2/service_instances/my-mysql/service_bindings/her-app", http.StatusInternalServerError, "something went wrong")
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	a := provisiontest.NewFakeApp("her-app", "python", 1)
+	_, err := client.BindApp(&instance, a)
+	c.Assert(err, check.FitsTypeOf, &errors.HTTP{})
+	c.Assert(err, check.ErrorMatches, `Failed to bind the instance "my-mysql" to the app "her-app": something went wrong`)
+}
+
+func (s *S) TestBrokerBindAndUnbindUnitDoNothing(c *check.C) {
+	b := newFakeBroker()
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	a := provisiontest.NewFakeApp("her-app", "python", 1)
+	err := client.BindUnit(&instance, a, a.GetUnits()[0])
+	c.Assert(err, check.IsNil)
+	err = client.UnbindUnit(&instance, a, a.GetUnits()[0])
+	c.Assert(err, check.IsNil)
+	c.Assert(b.requests, check.HasLen, 0)
+}
+
+func (s *S) TestBrokerUnbindApp(c *check.C) {
+	b := newFakeBroker()
+	b.respond("DELETE", "/v2/service_instances/my-mysql/service_bindings/her-app", http.StatusOK, "{}")
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	a := provisiontest.NewFakeApp("her-app", "python", 1)
+	err := client.UnbindApp(&instance, a)
+	c.Assert(err, check.IsNil)
+	c.Assert(b.requests[0].query["service_id"], check.DeepEquals, []string{"mysql-id"})
+	c.Assert(b.requests[0].query["plan_id"], check.DeepEquals, []string{"small-id"})
+}
+
+func (s *S) TestBrokerUnbindAppFailure(c *check.C) {
+	b := newFakeBroker()
+	b.respond("DELETE", "/v2/service_instances/my-mysql/service_bindings/her-app", http.StatusInternalServerError, `{"description": "try again"}`)
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	a := provisiontest.NewFakeApp("her-app", "python", 1)
+	err := client.UnbindApp(&instance, a)
+	c.Assert(err, check.ErrorMatches, `Failed to unbind the instance "my-mysql" from the app "her-app": try again`)
+}
+
+func (s *S) TestBrokerStatus(c *check.C) {
+	var tests = []struct {
+		status int
+		body   string
+		result string
+	}{
+		{http.StatusOK, `{"state": "in progress"}`, "pending"},
+		{http.StatusOK, `{"state": "succeeded"}`, "up"},
+		{http.StatusOK, `{"state": "failed"}`, "down"},
+		{http.StatusNotFound, "", "up"},
+	}
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	for _, t := range tests {
+		b := newFakeBroker()
+		b.respond("GET", "/v2/service_instances/my-mysql/last_operation", t.status, t.body)
+		client, cleanup := s.brokerClient(c, b)
+		status, err := client.Status(&instance)
+		cleanup()
+		c.Check(err, check.IsNil)
+		c.Check(status, check.Equals, t.result)
+	}
+}
+
+func (s *S) TestBrokerStatusGone(c *check.C) {
+	b := newFakeBroker()
+	b.respond("GET", "/v2/service_instances/my-mysql/last_operation", http.StatusGone, `{"description": "gone"}`)
+	client, cleanup := s.brokerClient(c, b)
+	defer cleanup()
+	instance := ServiceInstance{Name: "my-mysql", ServiceName: "mysql"}
+	_, err := client.Status(&instance)
+	c.Assert(err, check.ErrorMatches, "Failed to get status of instance my-mysql: gone")
+}
+
+func (s *S) TestBrokerStatusPendingOperation(c *check.C) {
+	var tests = []struct {
+		operation string
+		status    int
+		body      string
+		result    string
+	}{
+		{OperationUpdate, http.StatusOK, `{"state": "succeeded"}`, "up"},
+		{OperationUpdate, http.StatusOK, `{"state": "failed"}`, "down"},
+		{OperationDeprovision, http.StatusOK, `{"state": "in progress"}`, "pending"},
+		{OperationDeprovision, http.StatusOK, `{"state": "succeeded"}`, "gone"},
+		{OperationDeprovision, http.StatusGone, `{}`, "gone"},
+	}
+	for _, t := range tests {
+		instance := ServiceInstance{
+			Name:            "my-mysql",
+			ServiceName:     "mysql",
+			PlanName:        "large",
+			State:           StatePending,
+			Operation:       t.operation,
+			BrokerOperation: "op-4",
+		}
+		if t.operation == OperationUpdate {
+			instance.PendingPlan = "small"
+		}
+		b := newFakeBroker()
+		b.respond("GET", "/v2/service_instances/my-mysql/last_operation", t.status, t.body)
+		client, cleanup := s.brokerClient(c, b)
+		status, err := client.Status(&instance)
+		cleanup()
+		c.Check(err, check.IsNil)
+		c.Check(status, check.Equals, t.result)
+		c.Check(b.requests[0].query["operation"], check.DeepEquals, []string{"op-4"})
+		if t.operation == OperationUpdate {
+			c.Check(b.requests[0].query["plan_id"], check.DeepEquals, []string{"small-id"})
+		}
+	}
+}
+
+func (s *S) TestBrokerInfo(c *check.C) {
+	client, cleanup := s.brokerClient(c, newFakeBroker())
+	defer cleanup()
+	info, err := client.Info(&ServiceInstance{Name: "my-mysql"})
+	c.Assert(err, check.IsNil)
+	c.Assert(info, check.IsNil)
+}
+
+func (s *S) TestBrokerProxy(c *check.C) {
+	client, cleanup := s.brokerClient(c, newFakeBroker())
+	defer cleanup()
+	err := client.Proxy("/", httptest.NewRecorder(), nil)
+	c.Assert(err, check.Equals, ErrBrokerProxyNotSupported)
+}
+
+func (s *S) TestEnvName(c *check.C) {
+	c.Assert(envName("mysql", "uri"), check.Equals, "MYSQL_URI")
+	c.Assert(envName("my-sql", "read.replicas"), check.Equals, "MY_SQL_READ_REPLICAS")
+}
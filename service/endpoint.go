@@ -5,6 +5,9 @@
 package service
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,19 +16,49 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/tsuru/config"
 	"github.com/tsuru/tsuru/app/bind"
 	"github.com/tsuru/tsuru/errors"
 	"github.com/tsuru/tsuru/log"
 )
 
+// ServiceClient is used to manage service instances in the API of a service.
+// Client implements tsuru's own protocol, and brokerClient implements the
+// Open Service Broker API.
+//
+// Create marks the instance as pending when the service API accepts the
+// request, but doesn't finish the provisioning right away.
+type ServiceClient interface {
+	Create(instance *ServiceInstance, user string) error
+	Destroy(instance *ServiceInstance) error
+	UpdatePlan(instance *ServiceInstance, plan string) error
+	BindApp(instance *ServiceInstance, app bind.App) (map[string]string, error)
+	BindUnit(instance *ServiceInstance, app bind.App, unit bind.Unit) error
+	UnbindApp(instance *ServiceInstance, app bind.App) error
+	UnbindUnit(instance *ServiceInstance, app bind.App, unit bind.Unit) error
+	Status(instance *ServiceInstance) (string, error)
+	Info(instance *ServiceInstance) ([]map[string]string, error)
+	Plans() ([]Plan, error)
+	Proxy(path string, w http.ResponseWriter, r *http.Request) error
+}
+
 type Client struct {
+	name     string
 	endpoint string
 	username string
 	password string
 }
 
+const (
+	defaultRequestTimeout = time.Minute
+	defaultRequestRetries = 2
+	defaultRetryDelay     = 100 * time.Millisecond
+)
+
 func (c *Client) buildErrorMessage(err error, resp *http.Response) string {
 	if err != nil {
 		return err.Error()
@@ -37,27 +70,124 @@ func (c *Client) buildErrorMessage(err error, resp *http.Response) string {
 	return ""
 }
 
-func (c *Client) issueRequest(path, method string, params map[string][]string) (*http.Response, error) {
+// issueRequest sends a request to the service API, signed with the password
+// of the service. The operation defines the timeout of the request, which can
+// be set with the setting services:client:timeouts:<operation>.
+//
+// Idempotent requests (GET, PUT and DELETE) are retried when the service API
+// can't be reached, and no request is sent while the circuit breaker of the
+// service API is open.
+func (c *Client) issueRequest(operation, path, method string, params map[string][]string) (*http.Response, error) {
 	log.Debug("Issuing request...")
 	v := url.Values(params)
-	var suffix string
-	var body io.Reader
+	var suffix, body string
 	if method == "GET" {
 		suffix = "?" + v.Encode()
 	} else {
-		body = strings.NewReader(v.Encode())
+		body = v.Encode()
 	}
 	url := strings.TrimRight(c.endpoint, "/") + "/" + strings.Trim(path, "/") + suffix
-	req, err := http.NewRequest(method, url, body)
+	return doRequest(getBreaker(c.name, c.endpoint), operation, method, func() (*http.Request, error) {
+		return c.newRequest(method, url, body)
+	})
+}
+
+// doRequest sends the request built by newRequest through the circuit
+// breaker, with the timeout of the operation. Idempotent requests are sent
+// again, with a new request from newRequest, while the service API is
+// unavailable, up to the number of retries in services:client:retries.
+func doRequest(breaker *circuitBreaker, operation, method string, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	client := &http.Client{Timeout: requestTimeout(operation)}
+	attempts := 1
+	if method == "GET" || method == "PUT" || method == "DELETE" {
+		attempts += requestRetries()
+	}
+	var resp *http.Response
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(retryDelay())
+		}
+		if err = breaker.allow(); err != nil {
+			return nil, err
+		}
+		var req *http.Request
+		req, err = newRequest()
+		if err != nil {
+			log.Errorf("Got error while creating request: %s", err)
+			return nil, err
+		}
+		resp, err = client.Do(req)
+		if err == nil && !isUnavailable(resp) {
+			breaker.success()
+			return resp, nil
+		}
+		breaker.failure()
+		if err == nil && i < attempts-1 {
+			resp.Body.Close()
+		}
+	}
+	return resp, err
+}
+
+func (c *Client) newRequest(method, url, body string) (*http.Request, error) {
+	var reader io.Reader
+	if method != "GET" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, reader)
 	if err != nil {
-		log.Errorf("Got error while creating request: %s", err)
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Add("Accept", "application/json")
 	req.SetBasicAuth(c.username, c.password)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Tsuru-Timestamp", timestamp)
+	req.Header.Set("X-Tsuru-Signature", requestSignature(c.password, method, req.URL.RequestURI(), timestamp, body))
 	req.Close = true
-	return http.DefaultClient.Do(req)
+	return req, nil
+}
+
+// requestSignature returns the HMAC-SHA256, in hexadecimal, of the method,
+// the path (with the query string), the timestamp and the body of the
+// request, separated by new lines, using the password of the service as key.
+func requestSignature(secret, method, uri, timestamp, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, method+"\n"+uri+"\n"+timestamp+"\n"+body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func isUnavailable(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func requestTimeout(operation string) time.Duration {
+	if seconds, err := config.GetInt("services:client:timeouts:" + operation); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if seconds, err := config.GetInt("services:client:timeout"); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultRequestTimeout
+}
+
+func requestRetries() int {
+	if retries, err := config.GetInt("services:client:retries"); err == nil && retries >= 0 {
+		return retries
+	}
+	return defaultRequestRetries
+}
+
+func retryDelay() time.Duration {
+	if ms, err := config.GetInt("services:client:retry-delay"); err == nil && ms >= 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return defaultRetryDelay
 }
 
 func (c *Client) jsonFromResponse(resp *http.Response, v interface{}) error {
@@ -83,7 +213,16 @@ func (c *Client) Create(instance *ServiceInstance, user string) error {
 	if instance.PlanName != "" {
 		params["plan"] = []string{instance.PlanName}
 	}
-	if resp, err = c.issueRequest("/resources", "POST", params); err == nil && resp.StatusCode < 300 {
+	if len(instance.Tags) > 0 {
+		params["tag"] = instance.Tags
+	}
+	for name, value := range instance.Parameters {
+		params["parameters."+name] = []string{value}
+	}
+	if resp, err = c.issueRequest("create", "/resources", "POST", params); err == nil && resp.StatusCode < 300 {
+		if resp.StatusCode == http.StatusAccepted {
+			instance.setState(StatePending, "")
+		}
 		return nil
 	}
 	msg := "Failed to create the instance " + instance.Name + ": " + c.buildErrorMessage(err, resp)
@@ -93,7 +232,7 @@ func (c *Client) Create(instance *ServiceInstance, user string) error {
 
 func (c *Client) Destroy(instance *ServiceInstance) error {
 	log.Debug("Attempting to call destroy of service instance " + instance.Name + " at " + instance.ServiceName + " api")
-	resp, err := c.issueRequest("/resources/"+instance.GetIdentifier(), "DELETE", nil)
+	resp, err := c.issueRequest("destroy", "/resources/"+instance.GetIdentifier(), "DELETE", nil)
 	if err == nil && resp.StatusCode > 299 {
 		msg := "Failed to destroy the instance " + instance.Name + ": " + c.buildErrorMessage(err, resp)
 		log.Error(msg)
@@ -102,6 +241,21 @@ func (c *Client) Destroy(instance *ServiceInstance) error {
 	return err
 }
 
+// UpdatePlan asks the service API to move the instance to another plan.
+func (c *Client) UpdatePlan(instance *ServiceInstance, plan string) error {
+	log.Debug("Attempting to call update plan of service instance " + instance.Name + " at " + instance.ServiceName + " api")
+	params := map[string][]string{
+		"plan": {plan},
+	}
+	resp, err := c.issueRequest("update-plan", "/resources/"+instance.GetIdentifier()+"/plan", "PUT", params)
+	if err == nil && resp.StatusCode > 299 {
+		msg := "Failed to update the plan of the instance " + instance.Name + ": " + c.buildErrorMessage(err, resp)
+		log.Error(msg)
+		return &errors.HTTP{Code: http.StatusInternalServerError, Message: msg}
+	}
+	return err
+}
+
 func (c *Client) BindApp(instance *ServiceInstance, app bind.App) (map[string]string, error) {
 	log.Debugf("Calling bind of instance %q and %q app at %q API",
 		instance.Name, app.GetName(), instance.ServiceName)
@@ -109,9 +263,9 @@ func (c *Client) BindApp(instance *ServiceInstance, app bind.App) (map[string]st
 	params := map[string][]string{
 		"app-host": {app.GetIp()},
 	}
-	resp, err := c.issueRequest("/resources/"+instance.GetIdentifier()+"/bind-app", "POST", params)
+	resp, err := c.issueRequest("bind", "/resources/"+instance.GetIdentifier()+"/bind-app", "POST", params)
 	if resp != nil && resp.StatusCode == http.StatusNotFound {
-		resp, err = c.issueRequest("/resources/"+instance.GetIdentifier()+"/bind", "POST", params)
+		resp, err = c.issueRequest("bind", "/resources/"+instance.GetIdentifier()+"/bind", "POST", params)
 	}
 	if err != nil {
 		if m, _ := regexp.MatchString("", err.Error()); m {
@@ -143,7 +297,7 @@ func (c *Client) BindUnit(instance *ServiceInstance, app bind.App, unit bind.Uni
 		"app-host":  {app.GetIp()},
 		"unit-host": {unit.GetIp()},
 	}
-	resp, err := c.issueRequest("/resources/"+instance.GetIdentifier()+"/bind", "POST", params)
+	resp, err := c.issueRequest("bind", "/resources/"+instance.GetIdentifier()+"/bind", "POST", params)
 	if err != nil {
 		if m, _ := regexp.MatchString("", err.Error()); m {
 			return fmt.Errorf("%s api is down.", instance.Name)
@@ -161,6 +315,12 @@ func (c *Client) BindUnit(instance *ServiceInstance, app bind.App, unit bind.Uni
 	return nil
 }
 
+// unbindGone checks whether the service API answered an unbind request saying
+// that the binding doesn't exist, which means it's already unbound.
+func unbindGone(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone
+}
+
 func (c *Client) UnbindApp(instance *ServiceInstance, app bind.App) error {
 	log.Debugf("Calling unbind of service instance %q and app %q at %q", instance.Name, app.GetName(), instance.ServiceName)
 	var resp *http.Response
@@ -168,7 +328,10 @@ func (c *Client) UnbindApp(instance *ServiceInstance, app bind.App) error {
 	params := map[string][]string{
 		"app-host": {app.GetIp()},
 	}
-	resp, err := c.issueRequest(url, "DELETE", params)
+	resp, err := c.issueRequest("unbind", url, "DELETE", params)
+	if err == nil && unbindGone(resp) {
+		return nil
+	}
 	if err == nil && resp.StatusCode > 299 {
 		msg := fmt.Sprintf("Failed to unbind (%q): %s", url, c.buildErrorMessage(err, resp))
 		log.Error(msg)
@@ -185,7 +348,10 @@ func (c *Client) UnbindUnit(instance *ServiceInstance, app bind.App, unit bind.U
 		"app-host":  {app.GetIp()},
 		"unit-host": {unit.GetIp()},
 	}
-	resp, err := c.issueRequest(url, "DELETE", params)
+	resp, err := c.issueRequest("unbind", url, "DELETE", params)
+	if err == nil && unbindGone(resp) {
+		return nil
+	}
 	if err == nil && resp.StatusCode > 299 {
 		msg := fmt.Sprintf("Failed to unbind (%q): %s", url, c.buildErrorMessage(err, resp))
 		log.Error(msg)
@@ -207,7 +373,7 @@ func (c *Client) Status(instance *ServiceInstance) (string, error) {
 		err  error
 	)
 	url := "/resources/" + instance.GetIdentifier() + "/status"
-	if resp, err = c.issueRequest(url, "GET", nil); err == nil {
+	if resp, err = c.issueRequest("status", url, "GET", nil); err == nil {
 		switch resp.StatusCode {
 		case 202:
 			return "pending", nil
@@ -230,7 +396,7 @@ func (c *Client) Status(instance *ServiceInstance) (string, error) {
 func (c *Client) Info(instance *ServiceInstance) ([]map[string]string, error) {
 	log.Debug("Attempting to call info of service instance " + instance.Name + " at " + instance.ServiceName + " api")
 	url := "/resources/" + instance.GetIdentifier()
-	resp, err := c.issueRequest(url, "GET", nil)
+	resp, err := c.issueRequest("info", url, "GET", nil)
 	if err != nil || resp.StatusCode != 200 {
 		return nil, err
 	}
@@ -248,7 +414,7 @@ func (c *Client) Info(instance *ServiceInstance) ([]map[string]string, error) {
 // GET /resources/plans
 func (c *Client) Plans() ([]Plan, error) {
 	url := "/resources/plans"
-	resp, err := c.issueRequest(url, "GET", nil)
+	resp, err := c.issueRequest("plans", url, "GET", nil)
 	if err != nil || resp.StatusCode != 200 {
 		return nil, err
 	}
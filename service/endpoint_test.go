@@ -11,10 +11,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/tsuru/config"
 	"github.com/tsuru/tsuru/errors"
 	"github.com/tsuru/tsuru/provision/provisiontest"
 	"gopkg.in/check.v1"
@@ -164,6 +167,48 @@ func (s *S) TestCreateShouldSendTheNameOfTheResourceToTheEndpoint(c *check.C) {
 	c.Assert("close", check.Equals, h.request.Header.Get("Connection"))
 }
 
+func (s *S) TestCreateShouldSendTagsAndParameters(c *check.C) {
+	h := TestHandler{}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+	instance := ServiceInstance{
+		Name:        "my-redis",
+		ServiceName: "redis",
+		TeamOwner:   "myteam",
+		Tags:        []string{"production", "cache"},
+		Parameters:  map[string]string{"version": "3.0"},
+	}
+	client := &Client{endpoint: ts.URL, username: "user", password: "abcde"}
+	err := client.Create(&instance, "my@user")
+	c.Assert(err, check.IsNil)
+	h.Lock()
+	defer h.Unlock()
+	v, err := url.ParseQuery(string(h.body))
+	c.Assert(err, check.IsNil)
+	c.Assert(map[string][]string(v), check.DeepEquals, map[string][]string{
+		"name":               {"my-redis"},
+		"user":               {"my@user"},
+		"team":               {"myteam"},
+		"tag":                {"production", "cache"},
+		"parameters.version": {"3.0"},
+	})
+}
+
+func (s *S) TestCreateShouldMarkTheInstanceAsPendingWhenAPIReturns202(c *check.C) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	instance := ServiceInstance{Name: "my-redis", ServiceName: "redis"}
+	client := &Client{endpoint: ts.URL, username: "user", password: "abcde"}
+	err := client.Create(&instance, "my@user")
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.State, check.Equals, StatePending)
+	c.Assert(instance.Transitions, check.HasLen, 1)
+	c.Assert(instance.Transitions[0].State, check.Equals, StatePending)
+}
+
 func (s *S) TestCreateShouldReturnErrorIfTheRequestFail(c *check.C) {
 	ts := httptest.NewServer(http.HandlerFunc(failHandler))
 	defer ts.Close()
@@ -199,6 +244,32 @@ func (s *S) TestDestroyShouldReturnErrorIfTheRequestFails(c *check.C) {
 	c.Assert(err, check.ErrorMatches, "^Failed to destroy the instance "+instance.Name+": Server failed to do its job.$")
 }
 
+func (s *S) TestUpdatePlanShouldSendAPUTToThePlanURL(c *check.C) {
+	h := TestHandler{}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+	instance := ServiceInstance{Name: "his-redis", ServiceName: "redis", PlanName: "small"}
+	client := &Client{endpoint: ts.URL, username: "user", password: "abcde"}
+	err := client.UpdatePlan(&instance, "large")
+	c.Assert(err, check.IsNil)
+	h.Lock()
+	defer h.Unlock()
+	c.Assert(h.url, check.Equals, "/resources/his-redis/plan")
+	c.Assert(h.method, check.Equals, "PUT")
+	v, err := url.ParseQuery(string(h.body))
+	c.Assert(err, check.IsNil)
+	c.Assert(v.Get("plan"), check.Equals, "large")
+}
+
+func (s *S) TestUpdatePlanShouldReturnErrorIfTheRequestFails(c *check.C) {
+	ts := httptest.NewServer(http.HandlerFunc(failHandler))
+	defer ts.Close()
+	instance := ServiceInstance{Name: "his-redis", ServiceName: "redis"}
+	client := &Client{endpoint: ts.URL, username: "user", password: "abcde"}
+	err := client.UpdatePlan(&instance, "large")
+	c.Assert(err, check.ErrorMatches, "^Failed to update the plan of the instance "+instance.Name+": Server failed to do its job.$")
+}
+
 func (s *S) TestBindAppShouldSendAPOSTToTheResourceURL(c *check.C) {
 	h := TestHandler{}
 	ts := httptest.NewServer(&h)
@@ -401,6 +472,22 @@ func (s *S) TestUnbindUnitRequestFailure(c *check.C) {
 	c.Assert(err.Error(), check.Equals, expected)
 }
 
+func (s *S) TestUnbindAlreadyUnbound(c *check.C) {
+	for _, code := range []int{http.StatusNotFound, http.StatusGone} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		}))
+		instance := ServiceInstance{Name: "heaven-can-wait", ServiceName: "heaven"}
+		a := provisiontest.NewFakeApp("arch-enemy", "python", 1)
+		client := &Client{endpoint: ts.URL, username: "user", password: "abcde"}
+		err := client.UnbindUnit(&instance, a, a.GetUnits()[0])
+		c.Check(err, check.IsNil)
+		err = client.UnbindApp(&instance, a)
+		c.Check(err, check.IsNil)
+		ts.Close()
+	}
+}
+
 func (s *S) TestBuildErrorMessageWithNilResponse(c *check.C) {
 	cli := Client{}
 	err := stderrors.New("epic fail")
@@ -550,3 +637,101 @@ func (s *S) TestProxyWithBodyAndHeaders(c *check.C) {
 	c.Assert(proxiedRequest.Host, check.Equals, tsUrl.Host)
 	c.Assert(string(readBodyStr), check.Equals, `{"bla": "bla"}`)
 }
+
+func (s *S) TestIssueRequestSignsTheRequest(c *check.C) {
+	h := TestHandler{}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+	instance := ServiceInstance{Name: "his-redis", ServiceName: "redis"}
+	client := &Client{endpoint: ts.URL, username: "user", password: "abcde"}
+	err := client.UpdatePlan(&instance, "small")
+	c.Assert(err, check.IsNil)
+	h.Lock()
+	defer h.Unlock()
+	timestamp := h.request.Header.Get("X-Tsuru-Timestamp")
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	c.Assert(err, check.IsNil)
+	c.Assert(time.Now().Unix()-unix < 5, check.Equals, true)
+	expected := requestSignature("abcde", "PUT", "/resources/his-redis/plan", timestamp, "plan=small")
+	c.Assert(h.request.Header.Get("X-Tsuru-Signature"), check.Equals, expected)
+	c.Assert(requestSignature("other", "PUT", "/resources/his-redis/plan", timestamp, "plan=small"), check.Not(check.Equals), expected)
+}
+
+func (s *S) TestIssueRequestRetriesIdempotentRequests(c *check.C) {
+	config.Set("services:client:retry-delay", 0)
+	defer config.Unset("services:client:retry-delay")
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	instance := ServiceInstance{Name: "his-redis", ServiceName: "redis"}
+	client := &Client{endpoint: ts.URL, username: "user", password: "abcde"}
+	err := client.Destroy(&instance)
+	c.Assert(err, check.IsNil)
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(3))
+}
+
+func (s *S) TestIssueRequestRetriesLimit(c *check.C) {
+	config.Set("services:client:retry-delay", 0)
+	defer config.Unset("services:client:retry-delay")
+	config.Set("services:client:retries", 1)
+	defer config.Unset("services:client:retries")
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("try again later"))
+	}))
+	defer ts.Close()
+	instance := ServiceInstance{Name: "his-redis", ServiceName: "redis"}
+	client := &Client{endpoint: ts.URL, username: "user", password: "abcde"}
+	err := client.Destroy(&instance)
+	c.Assert(err, check.ErrorMatches, "Failed to destroy the instance his-redis: try again later")
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(2))
+}
+
+func (s *S) TestIssueRequestDoesNotRetryPOST(c *check.C) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	instance := ServiceInstance{Name: "his-redis", ServiceName: "redis"}
+	client := &Client{endpoint: ts.URL, username: "user", password: "abcde"}
+	err := client.Create(&instance, "user@tsuru.io")
+	c.Assert(err, check.NotNil)
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(1))
+}
+
+func (s *S) TestIssueRequestTimeout(c *check.C) {
+	config.Set("services:client:timeouts:status", 1)
+	defer config.Unset("services:client:timeouts:status")
+	config.Set("services:client:retries", 0)
+	defer config.Unset("services:client:retries")
+	done := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+	instance := ServiceInstance{Name: "his-redis", ServiceName: "redis"}
+	client := &Client{endpoint: ts.URL, username: "user", password: "abcde"}
+	start := time.Now()
+	_, err := client.Status(&instance)
+	c.Assert(err, check.NotNil)
+	c.Assert(time.Since(start) < 3*time.Second, check.Equals, true)
+}
+
+func (s *S) TestRequestTimeout(c *check.C) {
+	c.Assert(requestTimeout("bind"), check.Equals, defaultRequestTimeout)
+	config.Set("services:client:timeout", 10)
+	defer config.Unset("services:client:timeout")
+	config.Set("services:client:timeouts:status", 2)
+	defer config.Unset("services:client:timeouts:status")
+	c.Assert(requestTimeout("bind"), check.Equals, 10*time.Second)
+	c.Assert(requestTimeout("status"), check.Equals, 2*time.Second)
+}
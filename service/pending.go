@@ -0,0 +1,144 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/log"
+	"github.com/tsuru/tsuru/metering"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	defaultPendingPollInterval = 10 * time.Second
+	defaultPendingTimeout      = time.Hour
+)
+
+// StartPendingInstancesWatcher starts checking, in background, the status of
+// the service instances that are still being provisioned by their service
+// APIs. The interval between checks is defined by the setting
+// services:pending:poll-interval, and the time instances are allowed to stay
+// pending by services:pending:timeout, both in seconds.
+func StartPendingInstancesWatcher() {
+	interval := defaultPendingPollInterval
+	if seconds, err := config.GetInt("services:pending:poll-interval"); err == nil && seconds > 0 {
+		interval = time.Duration(seconds) * time.Second
+	}
+	timeout := defaultPendingTimeout
+	if seconds, err := config.GetInt("services:pending:timeout"); err == nil && seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	go runPendingInstancesWatcher(interval, timeout)
+}
+
+func runPendingInstancesWatcher(interval, timeout time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := CheckPendingInstances(timeout); err != nil {
+			log.Errorf("[pending-instances] unable to check pending instances: %s", err)
+		}
+	}
+}
+
+// CheckPendingInstances asks the service API for the status of each pending
+// service instance, marking it as ready once the service API reports it's up,
+// and as failed when the service API reports it's down or the instance stays
+// pending for longer than the given timeout. Instances pending because of an
+// update of their plan or their removal are updated or removed once the
+// operation finishes, and return to ready if the operation fails.
+func CheckPendingInstances(timeout time.Duration) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var instances []ServiceInstance
+	err = conn.ServiceInstances().Find(bson.M{"state": StatePending}).All(&instances)
+	if err != nil {
+		return err
+	}
+	for _, si := range instances {
+		state, message := checkPendingInstance(&si, timeout)
+		if state == StatePending {
+			continue
+		}
+		if si.Operation == OperationDeprovision && state == StateReady {
+			err = conn.ServiceInstances().Remove(bson.M{"name": si.Name, "state": StatePending})
+			if err == nil {
+				si.recordMetering(metering.ActionDestroy)
+			} else if err != mgo.ErrNotFound {
+				log.Errorf("[pending-instances] unable to remove the instance %q: %s", si.Name, err)
+			}
+			continue
+		}
+		if si.Operation != "" {
+			// the instance is left as it was before the failed operation
+			state = StateReady
+		}
+		set := bson.M{"state": state}
+		if si.Operation == OperationUpdate && message == "" {
+			set["plan_name"] = si.PendingPlan
+		}
+		transition := StateTransition{State: state, Date: time.Now().UTC(), Message: message}
+		err = conn.ServiceInstances().Update(
+			bson.M{"name": si.Name, "state": StatePending},
+			bson.M{
+				"$set":   set,
+				"$push":  bson.M{"transitions": transition},
+				"$unset": bson.M{"operation": "", "pendingplan": "", "brokeroperation": ""},
+			},
+		)
+		if err != nil && err != mgo.ErrNotFound {
+			log.Errorf("[pending-instances] unable to update the instance %q: %s", si.Name, err)
+			continue
+		}
+		if err == nil && si.Operation == OperationUpdate && message == "" {
+			si.PlanName = si.PendingPlan
+			si.recordMetering(metering.ActionUpdate)
+		}
+	}
+	return nil
+}
+
+// checkPendingInstance returns the state the instance should move to, along
+// with a message explaining the transition.
+func checkPendingInstance(si *ServiceInstance, timeout time.Duration) (string, string) {
+	status, err := si.Status()
+	if err != nil {
+		log.Errorf("[pending-instances] unable to get the status of the instance %q: %s", si.Name, err)
+	}
+	switch {
+	case err == nil && status == "up" && si.Operation != OperationDeprovision:
+		return StateReady, ""
+	case err == nil && status == "gone" && si.Operation == OperationDeprovision:
+		return StateReady, ""
+	case err == nil && status == "down":
+		return StateFailed, "the service API failed to " + si.operationDescription()
+	case si.pendingSince().Add(timeout).Before(time.Now()):
+		return StateFailed, "timed out waiting for the service API"
+	}
+	return StatePending, ""
+}
+
+func (si *ServiceInstance) operationDescription() string {
+	switch si.Operation {
+	case OperationUpdate:
+		return "update the plan of the instance"
+	case OperationDeprovision:
+		return "remove the instance"
+	}
+	return "provision the instance"
+}
+
+func (si *ServiceInstance) pendingSince() time.Time {
+	if len(si.Transitions) == 0 {
+		return time.Time{}
+	}
+	return si.Transitions[len(si.Transitions)-1].Date
+}
@@ -0,0 +1,176 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *S) pendingInstance(c *check.C, status int) (ServiceInstance, func()) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	srv := Service{Name: "mysql", Endpoint: map[string]string{"production": ts.URL}}
+	err := s.conn.Services().Insert(&srv)
+	c.Assert(err, check.IsNil)
+	si := ServiceInstance{Name: "my-mysql", ServiceName: srv.Name}
+	si.setState(StatePending, "")
+	err = s.conn.ServiceInstances().Insert(&si)
+	c.Assert(err, check.IsNil)
+	return si, func() {
+		ts.Close()
+		s.conn.ServiceInstances().Remove(bson.M{"name": si.Name})
+	}
+}
+
+func (s *S) TestCheckPendingInstancesReady(c *check.C) {
+	si, cleanup := s.pendingInstance(c, http.StatusNoContent)
+	defer cleanup()
+	err := CheckPendingInstances(time.Hour)
+	c.Assert(err, check.IsNil)
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.State, check.Equals, StateReady)
+	c.Assert(si.Transitions, check.HasLen, 2)
+	c.Assert(si.Transitions[1].State, check.Equals, StateReady)
+}
+
+func (s *S) TestCheckPendingInstancesStillPending(c *check.C) {
+	si, cleanup := s.pendingInstance(c, http.StatusAccepted)
+	defer cleanup()
+	err := CheckPendingInstances(time.Hour)
+	c.Assert(err, check.IsNil)
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.State, check.Equals, StatePending)
+	c.Assert(si.Transitions, check.HasLen, 1)
+}
+
+func (s *S) TestCheckPendingInstancesFailed(c *check.C) {
+	si, cleanup := s.pendingInstance(c, http.StatusInternalServerError)
+	defer cleanup()
+	err := CheckPendingInstances(time.Hour)
+	c.Assert(err, check.IsNil)
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.State, check.Equals, StateFailed)
+	c.Assert(si.Transitions, check.HasLen, 2)
+	c.Assert(si.Transitions[1].Message, check.Equals, "the service API failed to provision the instance")
+}
+
+func (s *S) TestCheckPendingInstancesTimeout(c *check.C) {
+	si, cleanup := s.pendingInstance(c, http.StatusAccepted)
+	defer cleanup()
+	err := CheckPendingInstances(0)
+	c.Assert(err, check.IsNil)
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.State, check.Equals, StateFailed)
+	c.Assert(si.Transitions[1].Message, check.Equals, "timed out waiting for the service API")
+}
+
+func (s *S) TestCheckPendingInstancesIgnoresReadyInstances(c *check.C) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	srv := Service{Name: "mysql", Endpoint: map[string]string{"production": ts.URL}}
+	err := s.conn.Services().Insert(&srv)
+	c.Assert(err, check.IsNil)
+	si := ServiceInstance{Name: "my-mysql", ServiceName: srv.Name}
+	err = s.conn.ServiceInstances().Insert(&si)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": si.Name})
+	err = CheckPendingInstances(0)
+	c.Assert(err, check.IsNil)
+	c.Assert(requests, check.Equals, 0)
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.State, check.Equals, "")
+}
+
+func (s *S) brokerPendingInstance(c *check.C, b *fakeBroker, operation string) (ServiceInstance, func()) {
+	ts := httptest.NewServer(b)
+	srv := Service{Name: "mysql", Broker: "p-mysql", Endpoint: map[string]string{"production": ts.URL}}
+	err := s.conn.Services().Insert(&srv)
+	c.Assert(err, check.IsNil)
+	si := ServiceInstance{Name: "my-mysql", ServiceName: srv.Name, PlanName: "small"}
+	si.setState(StateReady, "")
+	si.setState(StatePending, "")
+	si.Operation = operation
+	if operation == OperationUpdate {
+		si.PendingPlan = "large"
+	}
+	err = s.conn.ServiceInstances().Insert(&si)
+	c.Assert(err, check.IsNil)
+	return si, func() {
+		ts.Close()
+		s.conn.ServiceInstances().Remove(bson.M{"name": si.Name})
+		s.conn.MeteringEvents().RemoveAll(nil)
+	}
+}
+
+func (s *S) TestCheckPendingInstancesUpdateSucceeded(c *check.C) {
+	b := newFakeBroker()
+	b.respond("GET", "/v2/service_instances/my-mysql/last_operation", http.StatusOK, `{"state": "succeeded"}`)
+	si, cleanup := s.brokerPendingInstance(c, b, OperationUpdate)
+	defer cleanup()
+	err := CheckPendingInstances(time.Hour)
+	c.Assert(err, check.IsNil)
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.State, check.Equals, StateReady)
+	c.Assert(si.PlanName, check.Equals, "large")
+	c.Assert(si.Operation, check.Equals, "")
+	c.Assert(si.PendingPlan, check.Equals, "")
+	c.Assert(si.Transitions, check.HasLen, 3)
+}
+
+func (s *S) TestCheckPendingInstancesUpdateFailed(c *check.C) {
+	b := newFakeBroker()
+	b.respond("GET", "/v2/service_instances/my-mysql/last_operation", http.StatusOK, `{"state": "failed"}`)
+	si, cleanup := s.brokerPendingInstance(c, b, OperationUpdate)
+	defer cleanup()
+	err := CheckPendingInstances(time.Hour)
+	c.Assert(err, check.IsNil)
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.State, check.Equals, StateReady)
+	c.Assert(si.PlanName, check.Equals, "small")
+	c.Assert(si.Operation, check.Equals, "")
+	c.Assert(si.Transitions[2].Message, check.Equals, "the service API failed to update the plan of the instance")
+}
+
+func (s *S) TestCheckPendingInstancesDeprovisionSucceeded(c *check.C) {
+	b := newFakeBroker()
+	b.respond("GET", "/v2/service_instances/my-mysql/last_operation", http.StatusGone, `{}`)
+	si, cleanup := s.brokerPendingInstance(c, b, OperationDeprovision)
+	defer cleanup()
+	err := CheckPendingInstances(time.Hour)
+	c.Assert(err, check.IsNil)
+	n, err := s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 0)
+}
+
+func (s *S) TestCheckPendingInstancesDeprovisionInProgress(c *check.C) {
+	b := newFakeBroker()
+	b.respond("GET", "/v2/service_instances/my-mysql/last_operation", http.StatusOK, `{"state": "in progress"}`)
+	si, cleanup := s.brokerPendingInstance(c, b, OperationDeprovision)
+	defer cleanup()
+	err := CheckPendingInstances(time.Hour)
+	c.Assert(err, check.IsNil)
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.State, check.Equals, StatePending)
+	c.Assert(si.Operation, check.Equals, OperationDeprovision)
+}
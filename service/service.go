@@ -22,6 +22,10 @@ type Service struct {
 	Teams        []string
 	Doc          string
 	IsRestricted bool `bson:"is_restricted"`
+	// Broker is the name or the id of the service in the catalog of a
+	// service broker. When it's set, the endpoints of the service are
+	// expected to implement the Open Service Broker API.
+	Broker string
 }
 
 var (
@@ -73,12 +77,16 @@ func (s *Service) Delete() error {
 	return err
 }
 
-func (s *Service) getClient(endpoint string) (cli *Client, err error) {
+func (s *Service) getClient(endpoint string) (cli ServiceClient, err error) {
 	if e, ok := s.Endpoint[endpoint]; ok {
 		if p, _ := regexp.MatchString("^https?://", e); !p {
 			e = "http://" + e
 		}
-		cli = &Client{endpoint: e, username: s.GetUsername(), password: s.Password}
+		if s.Broker != "" {
+			cli = &brokerClient{name: s.Name, endpoint: e, username: s.GetUsername(), password: s.Password, service: s.Broker}
+		} else {
+			cli = &Client{name: s.Name, endpoint: e, username: s.GetUsername(), password: s.Password}
+		}
 	} else {
 		err = errors.New("Unknown endpoint: " + endpoint)
 	}
@@ -171,4 +179,7 @@ func GetServicesByOwnerTeams(teamKind string, u *auth.User) ([]Service, error) {
 type ServiceModel struct {
 	Service   string   `json:"service"`
 	Instances []string `json:"instances"`
+
+	// InstanceTags contains the tags of the instances, by instance name.
+	InstanceTags map[string][]string `json:"instance_tags,omitempty"`
 }
@@ -7,11 +7,13 @@ package service
 import (
 	"encoding/json"
 	stderrors "errors"
+	"fmt"
 	"io"
 	"net/http"
 	"regexp"
 	"strconv"
-	"sync"
+	"strings"
+	"time"
 
 	"github.com/tsuru/tsuru/action"
 	"github.com/tsuru/tsuru/app/bind"
@@ -19,7 +21,9 @@ import (
 	"github.com/tsuru/tsuru/db"
 	"github.com/tsuru/tsuru/errors"
 	"github.com/tsuru/tsuru/log"
+	"github.com/tsuru/tsuru/metering"
 	"github.com/tsuru/tsuru/rec"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -29,10 +33,42 @@ var (
 	ErrInstanceNameAlreadyExists = stderrors.New("instance name already exists.")
 	ErrAccessNotAllowed          = stderrors.New("user does not have access to this service instance")
 	ErrMultipleTeams             = stderrors.New("user is member of multiple teams, please specify the team that owns the service instance")
+	ErrTeamAlreadyHasAccess      = stderrors.New("This team already has access to this service instance")
+	ErrTeamHasNoAccess           = stderrors.New("This team does not have access to this service instance")
+	ErrRevokeOwnerAccess         = stderrors.New("You cannot revoke the access from the team that owns this service instance")
+	ErrTeamServiceRestricted     = stderrors.New("This team does not have access to the service of this service instance")
+	ErrInvalidPlan               = stderrors.New("invalid plan")
+	ErrEmptyParameterName        = &errors.HTTP{Code: http.StatusBadRequest, Message: "The name of the parameters of the service instance can't be empty."}
+	ErrInstanceNotReady          = &errors.HTTP{Code: http.StatusPreconditionFailed, Message: "You cannot bind any app to this service instance because it is not ready yet."}
+	ErrInstanceFailed            = &errors.HTTP{Code: http.StatusPreconditionFailed, Message: "You cannot bind any app to this service instance because its provisioning failed."}
+	ErrInstanceNotUpdatable      = &errors.HTTP{Code: http.StatusConflict, Message: "You cannot change the plan of this service instance while it is pending or failed."}
 
 	instanceNameRegexp = regexp.MustCompile(`^[A-Za-z][-a-zA-Z0-9_]+$`)
 )
 
+// States of service instances. Instances are pending while the service API is
+// still provisioning them. Instances created before states were introduced
+// have no state, and are considered ready.
+const (
+	StatePending = "pending"
+	StateReady   = "ready"
+	StateFailed  = "failed"
+)
+
+// Operations that keep an existing service instance pending, besides its
+// provisioning.
+const (
+	OperationUpdate      = "update"
+	OperationDeprovision = "deprovision"
+)
+
+// StateTransition records a change in the state of a service instance.
+type StateTransition struct {
+	State   string
+	Date    time.Time
+	Message string `bson:",omitempty" json:",omitempty"`
+}
+
 type ServiceInstance struct {
 	Name        string
 	Id          int
@@ -41,9 +77,22 @@ type ServiceInstance struct {
 	Apps        []string
 	Teams       []string
 	TeamOwner   string
+	State       string
+	Transitions []StateTransition
+	Tags        []string
+	Parameters  map[string]string
+	// Operation is the operation that keeps the instance pending, empty
+	// while the instance is provisioned. PendingPlan is the plan the
+	// instance moves to once an update finishes, and BrokerOperation
+	// identifies the operation in service brokers.
+	Operation       string `bson:",omitempty"`
+	PendingPlan     string `bson:",omitempty"`
+	BrokerOperation string `bson:",omitempty"`
 }
 
-// DeleteInstance deletes the service instance from the database.
+// DeleteInstance deletes the service instance from the database. Instances
+// that the service API removes asynchronously are kept pending, and deleted
+// once the removal finishes.
 func DeleteInstance(si *ServiceInstance) error {
 	if len(si.Apps) > 0 {
 		msg := "This service instance is bound to at least one app. Unbind them before removing it"
@@ -58,7 +107,15 @@ func DeleteInstance(si *ServiceInstance) error {
 		return err
 	}
 	defer conn.Close()
-	return conn.ServiceInstances().Remove(bson.M{"name": si.Name})
+	if si.Operation == OperationDeprovision {
+		return si.savePendingOperation(conn)
+	}
+	err = conn.ServiceInstances().Remove(bson.M{"name": si.Name})
+	if err != nil {
+		return err
+	}
+	si.recordMetering(metering.ActionDestroy)
+	return nil
 }
 
 func (si *ServiceInstance) GetIdentifier() string {
@@ -81,10 +138,50 @@ func (si *ServiceInstance) MarshalJSON() ([]byte, error) {
 		"Apps":        si.Apps,
 		"ServiceName": si.ServiceName,
 		"Info":        info,
+		"State":       si.state(),
+		"Transitions": si.Transitions,
+		"Tags":        si.Tags,
+		"Parameters":  si.Parameters,
 	}
 	return json.Marshal(&data)
 }
 
+func (si *ServiceInstance) state() string {
+	if si.State == "" {
+		return StateReady
+	}
+	return si.State
+}
+
+func (si *ServiceInstance) setState(state, message string) {
+	si.State = state
+	si.Transitions = append(si.Transitions, StateTransition{State: state, Date: time.Now().UTC(), Message: message})
+}
+
+// savePendingOperation stores the asynchronous operation started on the
+// instance by the service API, which is finished by the pending instances
+// watcher.
+func (si *ServiceInstance) savePendingOperation(conn *db.Storage) error {
+	return conn.ServiceInstances().Update(bson.M{"name": si.Name}, bson.M{"$set": bson.M{
+		"state":           si.State,
+		"transitions":     si.Transitions,
+		"operation":       si.Operation,
+		"pendingplan":     si.PendingPlan,
+		"brokeroperation": si.BrokerOperation,
+	}})
+}
+
+// checkReady returns an error when apps can't be bound to the instance.
+func (si *ServiceInstance) checkReady() error {
+	switch si.state() {
+	case StatePending:
+		return ErrInstanceNotReady
+	case StateFailed:
+		return ErrInstanceFailed
+	}
+	return nil
+}
+
 func (si *ServiceInstance) Info() (map[string]string, error) {
 	endpoint, err := si.Service().getClient("production")
 	if err != nil {
@@ -152,6 +249,28 @@ func (si *ServiceInstance) RemoveApp(appName string) error {
 	return nil
 }
 
+// pullApp removes the app from the instance document, without touching the
+// other fields.
+func (si *ServiceInstance) pullApp(appName string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.ServiceInstances().Update(bson.M{"name": si.Name}, bson.M{"$pull": bson.M{"apps": appName}})
+}
+
+// addToSetApp adds the app to the instance document, without touching the
+// other fields.
+func (si *ServiceInstance) addToSetApp(appName string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.ServiceInstances().Update(bson.M{"name": si.Name}, bson.M{"$addToSet": bson.M{"apps": appName}})
+}
+
 func (si *ServiceInstance) update() error {
 	conn, err := db.Conn()
 	if err != nil {
@@ -161,6 +280,160 @@ func (si *ServiceInstance) update() error {
 	return conn.ServiceInstances().Update(bson.M{"name": si.Name}, si)
 }
 
+// Grant gives the team access to the service instance. Instances of restricted
+// services can be shared only with the teams that have access to the service.
+func (si *ServiceInstance) Grant(teamName string) error {
+	for _, t := range si.Teams {
+		if t == teamName {
+			return ErrTeamAlreadyHasAccess
+		}
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var srv Service
+	err = conn.Services().FindId(si.ServiceName).One(&srv)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	if srv.IsRestricted && !srv.HasTeam(&auth.Team{Name: teamName}) {
+		return ErrTeamServiceRestricted
+	}
+	err = conn.ServiceInstances().Update(bson.M{"name": si.Name}, bson.M{"$addToSet": bson.M{"teams": teamName}})
+	if err != nil {
+		return err
+	}
+	si.Teams = append(si.Teams, teamName)
+	return nil
+}
+
+// Revoke removes the access of the team to the service instance. The access
+// of the team that owns the instance can't be revoked.
+func (si *ServiceInstance) Revoke(teamName string) error {
+	index := -1
+	for i, t := range si.Teams {
+		if t == teamName {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return ErrTeamHasNoAccess
+	}
+	if teamName == si.TeamOwner || len(si.Teams) < 2 {
+		return ErrRevokeOwnerAccess
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.ServiceInstances().Update(bson.M{"name": si.Name}, bson.M{"$pull": bson.M{"teams": teamName}})
+	if err != nil {
+		return err
+	}
+	si.Teams = append(si.Teams[:index], si.Teams[index+1:]...)
+	return nil
+}
+
+// UpdatePlan moves the service instance to another plan of its service. The
+// service API is asked to change the plan before it's stored. When the
+// service API changes the plan asynchronously, the instance is kept pending
+// until the change finishes. Only ready instances, with no pending operation,
+// can move to another plan.
+func (si *ServiceInstance) UpdatePlan(planName string) error {
+	if si.state() != StateReady || si.Operation != "" {
+		return ErrInstanceNotUpdatable
+	}
+	if planName == si.PlanName {
+		return nil
+	}
+	plans, err := GetPlansByServiceName(si.ServiceName)
+	if err != nil {
+		return err
+	}
+	var found bool
+	for _, plan := range plans {
+		if plan.Name == planName {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ErrInvalidPlan
+	}
+	endpoint, err := si.Service().getClient("production")
+	if err != nil {
+		return err
+	}
+	err = endpoint.UpdatePlan(si, planName)
+	if err != nil {
+		return err
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if si.Operation == OperationUpdate {
+		return si.savePendingOperation(conn)
+	}
+	err = conn.ServiceInstances().Update(bson.M{"name": si.Name}, bson.M{"$set": bson.M{"plan_name": planName}})
+	if err != nil {
+		return err
+	}
+	si.PlanName = planName
+	si.recordMetering(metering.ActionUpdate)
+	return nil
+}
+
+// recordMetering records an event of the instance for metering. Failures
+// are logged, as they must not break the operation on the instance.
+func (si *ServiceInstance) recordMetering(action string) {
+	err := metering.Record(metering.Event{
+		Kind:     metering.KindInstance,
+		Action:   action,
+		Resource: si.Name,
+		Service:  si.ServiceName,
+		Team:     si.TeamOwner,
+		Plan:     si.PlanName,
+	})
+	if err != nil {
+		log.Errorf("[metering] unable to record the %s event of the service instance %q: %s", action, si.Name, err)
+	}
+}
+
+// RecordMeteringBaseline records, for metering, the service instances that
+// already existed when their events started being recorded.
+func RecordMeteringBaseline() error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var instances []ServiceInstance
+	err = conn.ServiceInstances().Find(nil).All(&instances)
+	if err != nil {
+		return err
+	}
+	for _, si := range instances {
+		_, err = metering.RecordBaseline(metering.Event{
+			Kind:     metering.KindInstance,
+			Action:   metering.ActionCreate,
+			Resource: si.Name,
+			Service:  si.ServiceName,
+			Team:     si.TeamOwner,
+			Plan:     si.PlanName,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // BindApp makes the bind between the service instance and an app.
 func (si *ServiceInstance) BindApp(app bind.App, writer io.Writer) error {
 	actions := []*action.Action{
@@ -182,32 +455,54 @@ func (si *ServiceInstance) BindUnit(app bind.App, unit bind.Unit) error {
 	return endpoint.BindUnit(si, app, unit)
 }
 
-// UnbindApp makes the unbind between the service instance and an app.
+// UnbindApp makes the unbind between the service instance and an app. Like
+// BindApp, it runs as a pipeline: when any step fails, the steps already
+// executed are rolled back, so the app stays bound to the instance.
 func (si *ServiceInstance) UnbindApp(app bind.App, writer io.Writer) error {
-	err := si.RemoveApp(app.GetName())
-	if err != nil {
-		return &errors.HTTP{Code: http.StatusPreconditionFailed, Message: "This app is not bound to this service instance."}
+	actions := []*action.Action{
+		&removeAppFromServiceInstance,
+		&unbindUnitsFromServiceInstance,
+		&unbindAppFromServiceInstance,
+		&removeTsuruServices,
 	}
-	err = si.update()
+	pipeline := action.NewPipeline(actions...)
+	return pipeline.Execute(app, *si, writer)
+}
+
+// ForceUnbindApp unbinds the app from the service instance in a best-effort
+// way: errors from the service API, including open circuit breakers, are
+// logged and written to the writer instead of stopping the unbind, so the app
+// is always removed from the instance, along with the environment variables
+// of the instance.
+func (si *ServiceInstance) ForceUnbindApp(app bind.App, writer io.Writer) error {
+	err := si.pullApp(app.GetName())
 	if err != nil {
 		return err
 	}
-	var wg sync.WaitGroup
-	for _, unit := range app.GetUnits() {
-		wg.Add(1)
-		go func(unit bind.Unit) {
-			si.UnbindUnit(app, unit)
-			wg.Done()
-		}(unit)
+	ignore := func(err error) {
+		log.Errorf("Ignored error unbinding the app %q from the service instance %q: %s", app.GetName(), si.Name, err)
+		if writer != nil {
+			fmt.Fprintf(writer, "Ignored error unbinding from the service instance %q: %s\n", si.Name, err)
+		}
+	}
+	endpoint, err := si.Service().getClient("production")
+	if err != nil {
+		ignore(err)
+	} else {
+		forEachUnit(app.GetUnits(), func(unit bind.Unit) error {
+			if err := endpoint.UnbindUnit(si, app, unit); err != nil {
+				ignore(err)
+			}
+			return nil
+		})
+		if err = endpoint.UnbindApp(si, app); err != nil {
+			ignore(err)
+		}
 	}
 	instance := bind.ServiceInstance{Name: si.Name, Envs: make(map[string]string)}
 	for k, envVar := range app.InstanceEnv(si.Name) {
 		instance.Envs[k] = envVar.Value
 	}
-	wg.Wait()
-	if endpoint, err := si.Service().getClient("production"); err == nil {
-		endpoint.UnbindApp(si, app)
-	}
 	return app.RemoveInstance(si.ServiceName, instance, writer)
 }
 
@@ -265,6 +560,12 @@ func CreateServiceInstance(instance ServiceInstance, service *Service, user *aut
 	if err != nil {
 		return err
 	}
+	for name := range instance.Parameters {
+		if strings.TrimSpace(name) == "" {
+			return ErrEmptyParameterName
+		}
+	}
+	instance.Tags = processTags(instance.Tags)
 	instance.ServiceName = service.Name
 	teams, err := user.Teams()
 	if err != nil {
@@ -290,12 +591,57 @@ func CreateServiceInstance(instance ServiceInstance, service *Service, user *aut
 			}
 		}
 		if !found {
-			return auth.ErrTeamNotFound
+			err = addPermittedTeamOwner(&instance, service, user)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	actions := []*action.Action{&createServiceInstance, &insertServiceInstance}
 	pipeline := action.NewPipeline(actions...)
-	return pipeline.Execute(*service, instance, user.Email)
+	err = pipeline.Execute(*service, instance, user.Email)
+	if err != nil {
+		return err
+	}
+	instance.recordMetering(metering.ActionCreate)
+	return nil
+}
+
+// processTags trims the tags, removing empty and duplicated ones.
+func processTags(tags []string) []string {
+	if tags == nil {
+		return nil
+	}
+	processed := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		processed = append(processed, tag)
+	}
+	return processed
+}
+
+// addPermittedTeamOwner allows users that are not members of the team owner
+// of the instance to create it, as long as they have a role granting the
+// permission to create service instances in the team.
+func addPermittedTeamOwner(instance *ServiceInstance, service *Service, user *auth.User) error {
+	team, err := auth.GetTeam(instance.TeamOwner)
+	if err != nil {
+		return auth.ErrTeamNotFound
+	}
+	if service.IsRestricted && !service.HasTeam(team) {
+		return auth.ErrTeamNotFound
+	}
+	ctx := auth.PermissionContext{Type: auth.CtxTeam, Value: team.Name}
+	if !auth.CheckPermission(user, auth.PermServiceInstanceCreate, ctx) {
+		return auth.ErrTeamNotFound
+	}
+	instance.Teams = append(instance.Teams, team.Name)
+	return nil
 }
 
 func GetServiceInstancesByServices(services []Service) ([]ServiceInstance, error) {
@@ -311,7 +657,11 @@ func GetServiceInstancesByServices(services []Service) ([]ServiceInstance, error
 	return instances, err
 }
 
-func GetServiceInstancesByServicesAndTeams(services []Service, u *auth.User, appName string) ([]ServiceInstance, error) {
+// GetServiceInstancesByServicesAndTeams returns the instances of the given
+// services that the user has access to. When appName is not empty, only the
+// instances bound to the app are returned, and when tags are given, only the
+// instances that have all of them.
+func GetServiceInstancesByServicesAndTeams(services []Service, u *auth.User, appName string, tags []string) ([]ServiceInstance, error) {
 	var instances []ServiceInstance
 	teams, err := u.Teams()
 	if err != nil {
@@ -333,11 +683,27 @@ func GetServiceInstancesByServicesAndTeams(services []Service, u *auth.User, app
 	if appName != "" {
 		query["apps"] = appName
 	}
+	if len(tags) > 0 {
+		query["tags"] = bson.M{"$all": tags}
+	}
 	err = conn.ServiceInstances().Find(query).All(&instances)
 	return instances, err
 }
 
+// GetServiceInstance returns the service instance with the given name, as
+// long as the user is at least a developer in one of its teams.
 func GetServiceInstance(name string, u *auth.User) (*ServiceInstance, error) {
+	return getServiceInstance(name, u, auth.CheckUserAccess)
+}
+
+// GetServiceInstanceForRead works like GetServiceInstance, but also allows
+// viewers of the teams of the instance. It must only be used to give
+// read-only access to the instance.
+func GetServiceInstanceForRead(name string, u *auth.User) (*ServiceInstance, error) {
+	return getServiceInstance(name, u, auth.CheckUserReadAccess)
+}
+
+func getServiceInstance(name string, u *auth.User, checkAccess func([]string, *auth.User) bool) (*ServiceInstance, error) {
 	conn, err := db.Conn()
 	if err != nil {
 		return nil, err
@@ -349,7 +715,7 @@ func GetServiceInstance(name string, u *auth.User) (*ServiceInstance, error) {
 	if err != nil {
 		return nil, ErrServiceInstanceNotFound
 	}
-	if !auth.CheckUserAccess(instance.Teams, u) {
+	if !checkAccess(instance.Teams, u) {
 		return nil, ErrAccessNotAllowed
 	}
 	return &instance, nil
@@ -9,8 +9,10 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strconv"
 	"sync/atomic"
+	"time"
 
 	"github.com/tsuru/config"
 	"github.com/tsuru/tsuru/action"
@@ -18,6 +20,7 @@ import (
 	"github.com/tsuru/tsuru/auth"
 	"github.com/tsuru/tsuru/db"
 	"github.com/tsuru/tsuru/db/dbtest"
+	"github.com/tsuru/tsuru/metering"
 	"github.com/tsuru/tsuru/provision/provisiontest"
 	"github.com/tsuru/tsuru/rec/rectest"
 	"gopkg.in/check.v1"
@@ -209,6 +212,148 @@ func (s *InstanceSuite) TestUnbindApp(c *check.C) {
 	c.Assert(buf.String(), check.Equals, "remove instance")
 }
 
+func (s *InstanceSuite) TestUnbindAppRollsBackWhenTheServiceFails(c *check.C) {
+	var binds int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/resources/my-mysql/bind-app" && r.Method == "DELETE" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("unbind failed"))
+			return
+		}
+		if r.URL.Path == "/resources/my-mysql/bind" && r.Method == "POST" {
+			atomic.AddInt32(&binds, 1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	service := Service{Name: "mysql", Endpoint: map[string]string{"production": ts.URL}}
+	err := service.Create()
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(service.Name)
+	a := provisiontest.NewFakeApp("myapp", "static", 2)
+	si := ServiceInstance{
+		Name:        "my-mysql",
+		ServiceName: "mysql",
+		Teams:       []string{s.team.Name},
+		Apps:        []string{a.GetName()},
+	}
+	err = si.Create()
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().RemoveId(si.Name)
+	instance := bind.ServiceInstance{Name: si.Name}
+	err = a.AddInstance(si.ServiceName, instance, nil)
+	c.Assert(err, check.IsNil)
+	err = si.UnbindApp(a, nil)
+	c.Assert(err, check.ErrorMatches, `.*unbind failed.*`)
+	c.Assert(atomic.LoadInt32(&binds), check.Equals, int32(2))
+	c.Assert(a.GetInstances("mysql"), check.HasLen, 1)
+	var dbInstance ServiceInstance
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&dbInstance)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbInstance.Apps, check.DeepEquals, []string{a.GetName()})
+}
+
+func (s *InstanceSuite) TestForceUnbindAppIgnoresServiceFailures(c *check.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("service is down"))
+	}))
+	defer ts.Close()
+	service := Service{Name: "mysql", Endpoint: map[string]string{"production": ts.URL}}
+	err := service.Create()
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(service.Name)
+	a := provisiontest.NewFakeApp("myapp", "static", 2)
+	si := ServiceInstance{
+		Name:        "my-mysql",
+		ServiceName: "mysql",
+		Teams:       []string{s.team.Name},
+		Apps:        []string{a.GetName()},
+	}
+	err = si.Create()
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().RemoveId(si.Name)
+	instance := bind.ServiceInstance{Name: si.Name}
+	err = a.AddInstance(si.ServiceName, instance, nil)
+	c.Assert(err, check.IsNil)
+	var buf bytes.Buffer
+	err = si.ForceUnbindApp(a, &buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s).*Ignored error unbinding from the service instance "my-mysql".*service is down.*`)
+	c.Assert(a.GetInstances("mysql"), check.HasLen, 0)
+	var dbInstance ServiceInstance
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&dbInstance)
+	c.Assert(err, check.IsNil)
+	c.Assert(dbInstance.Apps, check.HasLen, 0)
+}
+
+func (s *InstanceSuite) TestUnbindAppPipeline(c *check.C) {
+	oldRemoveAppFromServiceInstance := removeAppFromServiceInstance
+	oldUnbindUnitsFromServiceInstance := unbindUnitsFromServiceInstance
+	oldUnbindAppFromServiceInstance := unbindAppFromServiceInstance
+	oldRemoveTsuruServices := removeTsuruServices
+	defer func() {
+		removeAppFromServiceInstance = oldRemoveAppFromServiceInstance
+		unbindUnitsFromServiceInstance = oldUnbindUnitsFromServiceInstance
+		unbindAppFromServiceInstance = oldUnbindAppFromServiceInstance
+		removeTsuruServices = oldRemoveTsuruServices
+	}()
+	var calls []string
+	var params []interface{}
+	removeAppFromServiceInstance = action.Action{
+		Forward: func(ctx action.FWContext) (action.Result, error) {
+			calls = append(calls, "removeAppFromServiceInstance")
+			params = ctx.Params
+			return nil, nil
+		},
+	}
+	unbindUnitsFromServiceInstance = action.Action{
+		Forward: func(ctx action.FWContext) (action.Result, error) {
+			calls = append(calls, "unbindUnitsFromServiceInstance")
+			return nil, nil
+		},
+	}
+	unbindAppFromServiceInstance = action.Action{
+		Forward: func(ctx action.FWContext) (action.Result, error) {
+			calls = append(calls, "unbindAppFromServiceInstance")
+			return nil, nil
+		},
+	}
+	removeTsuruServices = action.Action{
+		Forward: func(ctx action.FWContext) (action.Result, error) {
+			calls = append(calls, "removeTsuruServices")
+			return nil, nil
+		},
+	}
+	var si ServiceInstance
+	a := provisiontest.NewFakeApp("myapp", "python", 1)
+	var buf bytes.Buffer
+	err := si.UnbindApp(a, &buf)
+	c.Assert(err, check.IsNil)
+	expectedCalls := []string{
+		"removeAppFromServiceInstance", "unbindUnitsFromServiceInstance",
+		"unbindAppFromServiceInstance", "removeTsuruServices",
+	}
+	c.Assert(calls, check.DeepEquals, expectedCalls)
+	c.Assert(params, check.DeepEquals, []interface{}{a, si, &buf})
+}
+
+func (s *InstanceSuite) TestGetServiceInstanceViewer(c *check.C) {
+	team := auth.Team{Name: "viewers", Users: []string{"owner@raul.com", s.user.Email}, Owners: []string{"owner@raul.com"}, Viewers: []string{s.user.Email}}
+	err := s.conn.Teams().Insert(team)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Teams().RemoveId(team.Name)
+	sInstance := ServiceInstance{Name: "t3sql", ServiceName: "mysql", Teams: []string{team.Name}}
+	err = s.conn.ServiceInstances().Insert(&sInstance)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": sInstance.Name})
+	_, err = GetServiceInstance(sInstance.Name, s.user)
+	c.Assert(err, check.Equals, ErrAccessNotAllowed)
+	instance, err := GetServiceInstanceForRead(sInstance.Name, s.user)
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.Name, check.Equals, sInstance.Name)
+}
+
 func (s *InstanceSuite) TestGetServiceInstancesByServices(c *check.C) {
 	srvc := Service{Name: "mysql"}
 	err := s.conn.Services().Insert(&srvc)
@@ -325,7 +470,7 @@ func (s *InstanceSuite) TestGetServiceInstancesByServicesAndTeams(c *check.C) {
 	c.Assert(err, check.IsNil)
 	defer s.conn.ServiceInstances().Remove(bson.M{"name": sInstance3.Name})
 	expected := []ServiceInstance{sInstance, sInstance2}
-	sInstances, err := GetServiceInstancesByServicesAndTeams([]Service{srvc, srvc2}, s.user, "")
+	sInstances, err := GetServiceInstancesByServicesAndTeams([]Service{srvc, srvc2}, s.user, "", nil)
 	c.Assert(err, check.IsNil)
 	c.Assert(sInstances, check.DeepEquals, expected)
 }
@@ -358,11 +503,37 @@ func (s *InstanceSuite) TestGetServiceInstancesByServicesAndTeamsAppFilter(c *ch
 	c.Assert(err, check.IsNil)
 	defer s.conn.ServiceInstances().Remove(bson.M{"name": sInstance2.Name})
 	expected := []ServiceInstance{sInstance}
-	sInstances, err := GetServiceInstancesByServicesAndTeams([]Service{srvc, srvc2}, s.user, "app1")
+	sInstances, err := GetServiceInstancesByServicesAndTeams([]Service{srvc, srvc2}, s.user, "app1", nil)
 	c.Assert(err, check.IsNil)
 	c.Assert(sInstances, check.DeepEquals, expected)
 }
 
+func (s *InstanceSuite) TestGetServiceInstancesByServicesAndTeamsTagFilter(c *check.C) {
+	srvc := Service{Name: "mysql", Teams: []string{s.team.Name}, IsRestricted: true}
+	err := s.conn.Services().Insert(&srvc)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(srvc.Name)
+	instances := []ServiceInstance{
+		{Name: "j4sql", ServiceName: srvc.Name, Teams: []string{s.team.Name}, Tags: []string{"production", "backup"}},
+		{Name: "j5sql", ServiceName: srvc.Name, Teams: []string{s.team.Name}, Tags: []string{"production"}},
+		{Name: "j6sql", ServiceName: srvc.Name, Teams: []string{s.team.Name}},
+	}
+	for _, instance := range instances {
+		err = s.conn.ServiceInstances().Insert(&instance)
+		c.Assert(err, check.IsNil)
+		defer s.conn.ServiceInstances().Remove(bson.M{"name": instance.Name})
+	}
+	result, err := GetServiceInstancesByServicesAndTeams([]Service{srvc}, s.user, "", []string{"production"})
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.HasLen, 2)
+	c.Assert(result[0].Name, check.Equals, "j4sql")
+	c.Assert(result[1].Name, check.Equals, "j5sql")
+	result, err = GetServiceInstancesByServicesAndTeams([]Service{srvc}, s.user, "", []string{"production", "backup"})
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.HasLen, 1)
+	c.Assert(result[0].Name, check.Equals, "j4sql")
+}
+
 func (s *InstanceSuite) TestGetServiceInstancesByServicesAndTeamsForUsersThatAreNotMembersOfAnyTeam(c *check.C) {
 	u := auth.User{Email: "noteamforme@globo.com"}
 	err := u.Create()
@@ -380,7 +551,7 @@ func (s *InstanceSuite) TestGetServiceInstancesByServicesAndTeamsForUsersThatAre
 	err = s.conn.ServiceInstances().Insert(&instance)
 	c.Assert(err, check.IsNil)
 	defer s.conn.ServiceInstances().Remove(bson.M{"name": instance.Name})
-	instances, err := GetServiceInstancesByServicesAndTeams([]Service{srvc}, &u, "")
+	instances, err := GetServiceInstancesByServicesAndTeams([]Service{srvc}, &u, "", nil)
 	c.Assert(err, check.IsNil)
 	c.Assert(instances, check.IsNil)
 }
@@ -407,7 +578,7 @@ func (s *InstanceSuite) TestGetServiceinstancesByServicesAndTeamsUserAdmin(c *ch
 	err = s.conn.ServiceInstances().Insert(&instance)
 	c.Assert(err, check.IsNil)
 	defer s.conn.ServiceInstances().Remove(bson.M{"name": instance.Name})
-	instances, err := GetServiceInstancesByServicesAndTeams([]Service{srvc}, &u, "")
+	instances, err := GetServiceInstancesByServicesAndTeams([]Service{srvc}, &u, "", nil)
 	c.Assert(err, check.IsNil)
 	c.Assert(instances, check.DeepEquals, []ServiceInstance{instance})
 }
@@ -453,6 +624,10 @@ func (s *InstanceSuite) TestMarshalJSON(c *check.C) {
 		"Apps":        nil,
 		"ServiceName": "mysql",
 		"Info":        map[string]interface{}{"key": "value"},
+		"State":       "ready",
+		"Transitions": nil,
+		"Tags":        nil,
+		"Parameters":  nil,
 	}
 	c.Assert(result, check.DeepEquals, expected)
 }
@@ -475,6 +650,10 @@ func (s *InstanceSuite) TestMarshalJSONWithoutInfo(c *check.C) {
 		"Apps":        nil,
 		"ServiceName": "mysql",
 		"Info":        nil,
+		"State":       "ready",
+		"Transitions": nil,
+		"Tags":        nil,
+		"Parameters":  nil,
 	}
 	c.Assert(result, check.DeepEquals, expected)
 }
@@ -497,10 +676,37 @@ func (s *InstanceSuite) TestMarshalJSONWithoutEndpoint(c *check.C) {
 		"Apps":        nil,
 		"ServiceName": "mysql",
 		"Info":        nil,
+		"State":       "ready",
+		"Transitions": nil,
+		"Tags":        nil,
+		"Parameters":  nil,
 	}
 	c.Assert(result, check.DeepEquals, expected)
 }
 
+func (s *InstanceSuite) TestMarshalJSONWithState(c *check.C) {
+	srvc := Service{Name: "mysql"}
+	err := s.conn.Services().Insert(&srvc)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(srvc.Name)
+	si := ServiceInstance{Name: "ql", ServiceName: srvc.Name}
+	si.setState(StatePending, "")
+	si.setState(StateFailed, "no space left")
+	data, err := json.Marshal(&si)
+	c.Assert(err, check.IsNil)
+	var result struct {
+		State       string
+		Transitions []StateTransition
+	}
+	err = json.Unmarshal(data, &result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.State, check.Equals, StateFailed)
+	c.Assert(result.Transitions, check.HasLen, 2)
+	c.Assert(result.Transitions[0].State, check.Equals, StatePending)
+	c.Assert(result.Transitions[1].State, check.Equals, StateFailed)
+	c.Assert(result.Transitions[1].Message, check.Equals, "no space left")
+}
+
 func (s *InstanceSuite) TestDeleteInstance(c *check.C) {
 	h := TestHandler{}
 	ts := httptest.NewServer(&h)
@@ -523,6 +729,75 @@ func (s *InstanceSuite) TestDeleteInstance(c *check.C) {
 	c.Assert(h.method, check.Equals, "DELETE")
 }
 
+func (s *InstanceSuite) TestDeleteInstanceRecordsMetering(c *check.C) {
+	h := TestHandler{}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+	srv := Service{Name: "mongodb", Endpoint: map[string]string{"production": ts.URL}}
+	err := s.conn.Services().Insert(&srv)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(srv.Name)
+	si := ServiceInstance{Name: "instance", ServiceName: srv.Name, PlanName: "small", TeamOwner: "Raul"}
+	err = s.conn.ServiceInstances().Insert(&si)
+	c.Assert(err, check.IsNil)
+	err = DeleteInstance(&si)
+	c.Assert(err, check.IsNil)
+	defer s.conn.MeteringEvents().RemoveAll(nil)
+	var events []metering.Event
+	err = s.conn.MeteringEvents().Find(bson.M{"resource": "instance"}).All(&events)
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].Action, check.Equals, metering.ActionDestroy)
+	c.Assert(events[0].Team, check.Equals, "Raul")
+	c.Assert(events[0].Plan, check.Equals, "small")
+}
+
+func (s *InstanceSuite) TestDeleteInstanceAsync(c *check.C) {
+	b := newFakeBroker()
+	b.respond("DELETE", "/v2/service_instances/instance", http.StatusAccepted, `{"operation": "op-1"}`)
+	ts := httptest.NewServer(b)
+	defer ts.Close()
+	srv := Service{Name: "mysql", Broker: "p-mysql", Endpoint: map[string]string{"production": ts.URL}}
+	err := s.conn.Services().Insert(&srv)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(srv.Name)
+	si := ServiceInstance{Name: "instance", ServiceName: srv.Name, PlanName: "small"}
+	err = s.conn.ServiceInstances().Insert(&si)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": si.Name})
+	err = DeleteInstance(&si)
+	c.Assert(err, check.IsNil)
+	var instance ServiceInstance
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&instance)
+	c.Assert(err, check.IsNil)
+	c.Assert(instance.State, check.Equals, StatePending)
+	c.Assert(instance.Operation, check.Equals, OperationDeprovision)
+	c.Assert(instance.BrokerOperation, check.Equals, "op-1")
+}
+
+func (s *InstanceSuite) TestRecordMeteringBaseline(c *check.C) {
+	si1 := ServiceInstance{Name: "instance1", ServiceName: "mongodb", PlanName: "small", TeamOwner: "Raul"}
+	si2 := ServiceInstance{Name: "instance2", ServiceName: "mongodb", PlanName: "small", TeamOwner: "Raul"}
+	err := s.conn.ServiceInstances().Insert(&si1, &si2)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().RemoveAll(bson.M{"service_name": "mongodb"})
+	defer s.conn.MeteringEvents().RemoveAll(nil)
+	si2.recordMetering(metering.ActionCreate)
+	err = RecordMeteringBaseline()
+	c.Assert(err, check.IsNil)
+	var events []metering.Event
+	err = s.conn.MeteringEvents().Find(bson.M{"resource": "instance1"}).All(&events)
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].Action, check.Equals, metering.ActionCreate)
+	c.Assert(events[0].Service, check.Equals, "mongodb")
+	c.Assert(events[0].Team, check.Equals, "Raul")
+	c.Assert(events[0].Plan, check.Equals, "small")
+	n, err := s.conn.MeteringEvents().Find(bson.M{"resource": "instance2"}).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 1)
+}
+
 func (s *InstanceSuite) TestDeleteInstanceWithApps(c *check.C) {
 	si := ServiceInstance{Name: "instance", Apps: []string{"foo"}}
 	err := s.conn.ServiceInstances().Insert(&si)
@@ -555,6 +830,97 @@ func (s *InstanceSuite) TestCreateServiceInstance(c *check.C) {
 	c.Assert(si.Teams, check.DeepEquals, []string{s.team.Name})
 }
 
+func (s *InstanceSuite) TestCreateServiceInstanceWithTagsAndParameters(c *check.C) {
+	var form url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	srv := Service{Name: "mongodb", Endpoint: map[string]string{"production": ts.URL}}
+	err := s.conn.Services().Insert(&srv)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(srv.Name)
+	instance := ServiceInstance{
+		Name:       "instance",
+		Tags:       []string{" production", "", "backup", "production"},
+		Parameters: map[string]string{"version": "3.0", "region": "us-east"},
+	}
+	err = CreateServiceInstance(instance, &srv, s.user)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": "instance"})
+	si, err := GetServiceInstance("instance", s.user)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Tags, check.DeepEquals, []string{"production", "backup"})
+	c.Assert(si.Parameters, check.DeepEquals, map[string]string{"version": "3.0", "region": "us-east"})
+	c.Assert(form["tag"], check.DeepEquals, []string{"production", "backup"})
+	c.Assert(form.Get("parameters.version"), check.Equals, "3.0")
+	c.Assert(form.Get("parameters.region"), check.Equals, "us-east")
+}
+
+func (s *InstanceSuite) TestCreateServiceInstanceRecordsMetering(c *check.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+	srv := Service{Name: "mongodb", Endpoint: map[string]string{"production": ts.URL}}
+	err := s.conn.Services().Insert(&srv)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(srv.Name)
+	instance := ServiceInstance{Name: "instance", PlanName: "small"}
+	err = CreateServiceInstance(instance, &srv, s.user)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": "instance"})
+	defer s.conn.MeteringEvents().RemoveAll(nil)
+	var events []metering.Event
+	err = s.conn.MeteringEvents().Find(bson.M{"resource": "instance"}).All(&events)
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 1)
+	events[0].Date = time.Time{}
+	c.Assert(events[0], check.DeepEquals, metering.Event{
+		Kind:     metering.KindInstance,
+		Action:   metering.ActionCreate,
+		Resource: "instance",
+		Service:  "mongodb",
+		Team:     s.team.Name,
+		Plan:     "small",
+	})
+}
+
+func (s *InstanceSuite) TestCreateServiceInstanceEmptyParameterName(c *check.C) {
+	srv := Service{Name: "mongodb", Endpoint: map[string]string{"production": "http://localhost:1234"}}
+	err := s.conn.Services().Insert(&srv)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(srv.Name)
+	instance := ServiceInstance{Name: "instance", Parameters: map[string]string{" ": "3.0"}}
+	err = CreateServiceInstance(instance, &srv, s.user)
+	c.Assert(err, check.Equals, ErrEmptyParameterName)
+	n, err := s.conn.ServiceInstances().Find(bson.M{"name": "instance"}).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 0)
+}
+
+func (s *InstanceSuite) TestCreateServiceInstancePending(c *check.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+	srv := Service{Name: "mongodb", Endpoint: map[string]string{"production": ts.URL}}
+	err := s.conn.Services().Insert(&srv)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(srv.Name)
+	instance := ServiceInstance{Name: "instance", PlanName: "small"}
+	err = CreateServiceInstance(instance, &srv, s.user)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": "instance"})
+	si, err := GetServiceInstance("instance", s.user)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.State, check.Equals, StatePending)
+	c.Assert(si.Transitions, check.HasLen, 1)
+	c.Assert(si.TeamOwner, check.Equals, s.team.Name)
+}
+
 func (s *InstanceSuite) TestCreateSpecifyOwner(c *check.C) {
 	var requests int32
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -776,3 +1142,164 @@ func (s *InstanceSuite) TestGetIdentfier(c *check.C) {
 	identifier = srv.GetIdentifier()
 	c.Assert(identifier, check.Equals, strconv.Itoa(srv.Id))
 }
+
+func (s *InstanceSuite) TestGrant(c *check.C) {
+	si := ServiceInstance{Name: "mongo-1", Teams: []string{s.team.Name}, TeamOwner: s.team.Name}
+	err := s.conn.ServiceInstances().Insert(&si)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": si.Name})
+	err = si.Grant("otherteam")
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Teams, check.DeepEquals, []string{s.team.Name, "otherteam"})
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Teams, check.DeepEquals, []string{s.team.Name, "otherteam"})
+	err = si.Grant("otherteam")
+	c.Assert(err, check.Equals, ErrTeamAlreadyHasAccess)
+}
+
+func (s *InstanceSuite) TestGrantRestrictedService(c *check.C) {
+	srv := Service{Name: "mongodb", IsRestricted: true, Teams: []string{s.team.Name, "allowedteam"}}
+	err := s.conn.Services().Insert(&srv)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(srv.Name)
+	si := ServiceInstance{Name: "mongo-1", ServiceName: srv.Name, Teams: []string{s.team.Name}, TeamOwner: s.team.Name}
+	err = s.conn.ServiceInstances().Insert(&si)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": si.Name})
+	err = si.Grant("otherteam")
+	c.Assert(err, check.Equals, ErrTeamServiceRestricted)
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Teams, check.DeepEquals, []string{s.team.Name})
+	err = si.Grant("allowedteam")
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Teams, check.DeepEquals, []string{s.team.Name, "allowedteam"})
+}
+
+func (s *InstanceSuite) TestRevoke(c *check.C) {
+	si := ServiceInstance{Name: "mongo-1", Teams: []string{s.team.Name, "otherteam"}, TeamOwner: s.team.Name}
+	err := s.conn.ServiceInstances().Insert(&si)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": si.Name})
+	err = si.Revoke("otherteam")
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Teams, check.DeepEquals, []string{s.team.Name})
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.Teams, check.DeepEquals, []string{s.team.Name})
+	err = si.Revoke("otherteam")
+	c.Assert(err, check.Equals, ErrTeamHasNoAccess)
+}
+
+func (s *InstanceSuite) TestRevokeOwner(c *check.C) {
+	si := ServiceInstance{Name: "mongo-1", Teams: []string{s.team.Name, "otherteam"}, TeamOwner: s.team.Name}
+	err := si.Revoke(s.team.Name)
+	c.Assert(err, check.Equals, ErrRevokeOwnerAccess)
+	legacy := ServiceInstance{Name: "mongo-2", Teams: []string{s.team.Name}}
+	err = legacy.Revoke(s.team.Name)
+	c.Assert(err, check.Equals, ErrRevokeOwnerAccess)
+}
+
+func (s *InstanceSuite) TestUpdatePlan(c *check.C) {
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/resources/plans" {
+			w.Write([]byte(`[{"name": "small", "description": "small"}, {"name": "large", "description": "large"}]`))
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.FormValue("plan"))
+	}))
+	defer ts.Close()
+	srv := Service{Name: "mongodb", Endpoint: map[string]string{"production": ts.URL}}
+	err := s.conn.Services().Insert(&srv)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(srv.Name)
+	si := ServiceInstance{Name: "mongo-1", ServiceName: srv.Name, PlanName: "small"}
+	err = s.conn.ServiceInstances().Insert(&si)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": si.Name})
+	err = si.UpdatePlan("large")
+	c.Assert(err, check.IsNil)
+	c.Assert(si.PlanName, check.Equals, "large")
+	c.Assert(requests, check.DeepEquals, []string{"PUT /resources/mongo-1/plan large"})
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.PlanName, check.Equals, "large")
+	err = si.UpdatePlan("large")
+	c.Assert(err, check.IsNil)
+	c.Assert(requests, check.HasLen, 1)
+	defer s.conn.MeteringEvents().RemoveAll(nil)
+	var events []metering.Event
+	err = s.conn.MeteringEvents().Find(bson.M{"resource": si.Name}).All(&events)
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].Action, check.Equals, metering.ActionUpdate)
+	c.Assert(events[0].Plan, check.Equals, "large")
+}
+
+func (s *InstanceSuite) TestUpdatePlanInvalidPlan(c *check.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"name": "small", "description": "small"}]`))
+	}))
+	defer ts.Close()
+	srv := Service{Name: "mongodb", Endpoint: map[string]string{"production": ts.URL}}
+	err := s.conn.Services().Insert(&srv)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(srv.Name)
+	si := ServiceInstance{Name: "mongo-1", ServiceName: srv.Name, PlanName: "small"}
+	err = si.UpdatePlan("huge")
+	c.Assert(err, check.Equals, ErrInvalidPlan)
+	c.Assert(si.PlanName, check.Equals, "small")
+}
+
+func (s *InstanceSuite) TestUpdatePlanInstanceNotReady(c *check.C) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`[{"name": "small", "description": "small"}, {"name": "large", "description": "large"}]`))
+	}))
+	defer ts.Close()
+	srv := Service{Name: "mongodb", Endpoint: map[string]string{"production": ts.URL}}
+	err := s.conn.Services().Insert(&srv)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(srv.Name)
+	instances := []ServiceInstance{
+		{Name: "mongo-1", ServiceName: srv.Name, PlanName: "small", State: StatePending},
+		{Name: "mongo-2", ServiceName: srv.Name, PlanName: "small", State: StateFailed},
+		{Name: "mongo-3", ServiceName: srv.Name, PlanName: "small", State: StatePending, Operation: OperationUpdate, PendingPlan: "large"},
+		{Name: "mongo-4", ServiceName: srv.Name, PlanName: "small", State: StateReady, Operation: OperationDeprovision},
+	}
+	for _, si := range instances {
+		err = si.UpdatePlan("large")
+		c.Assert(err, check.Equals, ErrInstanceNotUpdatable)
+		c.Assert(si.PlanName, check.Equals, "small")
+	}
+	c.Assert(requests, check.Equals, 0)
+	c.Assert(ErrInstanceNotUpdatable.Code, check.Equals, http.StatusConflict)
+}
+
+func (s *InstanceSuite) TestUpdatePlanServiceAPIFailure(c *check.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/resources/plans" {
+			w.Write([]byte(`[{"name": "small", "description": "small"}, {"name": "large", "description": "large"}]`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("cannot downgrade"))
+	}))
+	defer ts.Close()
+	srv := Service{Name: "mongodb", Endpoint: map[string]string{"production": ts.URL}}
+	err := s.conn.Services().Insert(&srv)
+	c.Assert(err, check.IsNil)
+	defer s.conn.Services().RemoveId(srv.Name)
+	si := ServiceInstance{Name: "mongo-1", ServiceName: srv.Name, PlanName: "small"}
+	err = s.conn.ServiceInstances().Insert(&si)
+	c.Assert(err, check.IsNil)
+	defer s.conn.ServiceInstances().Remove(bson.M{"name": si.Name})
+	err = si.UpdatePlan("large")
+	c.Assert(err, check.ErrorMatches, "Failed to update the plan of the instance mongo-1: cannot downgrade")
+	err = s.conn.ServiceInstances().Find(bson.M{"name": si.Name}).One(&si)
+	c.Assert(err, check.IsNil)
+	c.Assert(si.PlanName, check.Equals, "small")
+}
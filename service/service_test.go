@@ -68,6 +68,7 @@ func (s *S) TestGetClient(c *check.C) {
 	service := Service{Name: "redis", Password: "abcde", Endpoint: endpoints}
 	cli, err := service.getClient("production")
 	expected := &Client{
+		name:     "redis",
 		endpoint: endpoints["production"],
 		username: "redis",
 		password: "abcde",
@@ -83,6 +84,7 @@ func (s *S) TestGetClientWithServiceUsername(c *check.C) {
 	service := Service{Name: "redis", Username: "redis_test", Password: "abcde", Endpoint: endpoints}
 	cli, err := service.getClient("production")
 	expected := &Client{
+		name:     "redis",
 		endpoint: endpoints["production"],
 		username: "redis_test",
 		password: "abcde",
@@ -98,7 +100,7 @@ func (s *S) TestGetClientWithouHTTP(c *check.C) {
 	service := Service{Name: "redis", Endpoint: endpoints}
 	cli, err := service.getClient("production")
 	c.Assert(err, check.IsNil)
-	c.Assert(cli.endpoint, check.Equals, "http://mysql.api.com")
+	c.Assert(cli.(*Client).endpoint, check.Equals, "http://mysql.api.com")
 }
 
 func (s *S) TestGetClientWithHTTPS(c *check.C) {
@@ -108,7 +110,24 @@ func (s *S) TestGetClientWithHTTPS(c *check.C) {
 	service := Service{Name: "redis", Endpoint: endpoints}
 	cli, err := service.getClient("production")
 	c.Assert(err, check.IsNil)
-	c.Assert(cli.endpoint, check.Equals, "https://mysql.api.com")
+	c.Assert(cli.(*Client).endpoint, check.Equals, "https://mysql.api.com")
+}
+
+func (s *S) TestGetClientWithBroker(c *check.C) {
+	endpoints := map[string]string{
+		"production": "broker.api.com",
+	}
+	service := Service{Name: "mysql", Password: "abcde", Endpoint: endpoints, Broker: "p-mysql"}
+	cli, err := service.getClient("production")
+	expected := &brokerClient{
+		name:     "mysql",
+		endpoint: "http://broker.api.com",
+		username: "mysql",
+		password: "abcde",
+		service:  "p-mysql",
+	}
+	c.Assert(err, check.IsNil)
+	c.Assert(cli, check.DeepEquals, expected)
 }
 
 func (s *S) TestGetClientWithUnknownEndpoint(c *check.C) {
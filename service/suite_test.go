@@ -69,4 +69,10 @@ func (s *S) TearDownSuite(c *check.C) {
 func (s *S) TearDownTest(c *check.C) {
 	_, err := s.conn.Services().RemoveAll(nil)
 	c.Assert(err, check.IsNil)
+	breakers.Lock()
+	breakers.m = make(map[string]*circuitBreaker)
+	breakers.Unlock()
+	catalogs.Lock()
+	catalogs.m = make(map[string]cachedCatalog)
+	catalogs.Unlock()
 }